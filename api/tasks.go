@@ -13,13 +13,17 @@ import (
 
 // MemoryStats holds memory usage related stats
 type MemoryStats struct {
-	RSS            uint64
-	Cache          uint64
-	Swap           uint64
-	MaxUsage       uint64
-	KernelUsage    uint64
-	KernelMaxUsage uint64
-	Measured       []string
+	RSS             uint64
+	Cache           uint64
+	Swap            uint64
+	MaxUsage        uint64
+	KernelUsage     uint64
+	KernelMaxUsage  uint64
+	Usage           uint64
+	WorkingSet      uint64
+	MajorPageFaults uint64
+	MinorPageFaults uint64
+	Measured        []string
 }
 
 // CpuStats holds cpu usage related stats
@@ -30,6 +34,7 @@ type CpuStats struct {
 	ThrottledPeriods uint64
 	ThrottledTime    uint64
 	Percent          float64
+	ThrottledPercent float64
 	Measured         []string
 }
 
@@ -389,8 +394,13 @@ func (g *TaskGroup) RequireDisk(disk *EphemeralDisk) *TaskGroup {
 
 // LogConfig provides configuration for log rotation
 type LogConfig struct {
-	MaxFiles      *int `mapstructure:"max_files"`
-	MaxFileSizeMB *int `mapstructure:"max_file_size"`
+	MaxFiles        *int   `mapstructure:"max_files"`
+	MaxFileSizeMB   *int   `mapstructure:"max_file_size"`
+	FileNamePattern string `mapstructure:"file_name_pattern"`
+	FileMode        string `mapstructure:"file_mode"`
+	FileOwner       string `mapstructure:"file_owner"`
+	BufferSizeKB    int    `mapstructure:"buffer_size"`
+	CombineLogs     bool   `mapstructure:"combine_logs"`
 }
 
 func DefaultLogConfig() *LogConfig {
@@ -416,24 +426,27 @@ type DispatchPayloadConfig struct {
 
 // Task is a single process in a task group.
 type Task struct {
-	Name            string
-	Driver          string
-	User            string
-	Config          map[string]interface{}
-	Constraints     []*Constraint
-	Env             map[string]string
-	Services        []*Service
-	Resources       *Resources
-	Meta            map[string]string
-	KillTimeout     *time.Duration `mapstructure:"kill_timeout"`
-	LogConfig       *LogConfig     `mapstructure:"logs"`
-	Artifacts       []*TaskArtifact
-	Vault           *Vault
-	Templates       []*Template
-	DispatchPayload *DispatchPayloadConfig
-	Leader          bool
-	ShutdownDelay   time.Duration `mapstructure:"shutdown_delay"`
-	KillSignal      string        `mapstructure:"kill_signal"`
+	Name             string
+	Driver           string
+	User             string
+	Config           map[string]interface{}
+	Constraints      []*Constraint
+	Env              map[string]string
+	Services         []*Service
+	Resources        *Resources
+	Meta             map[string]string
+	KillTimeout      *time.Duration `mapstructure:"kill_timeout"`
+	LogConfig        *LogConfig     `mapstructure:"logs"`
+	Artifacts        []*TaskArtifact
+	Vault            *Vault
+	Templates        []*Template
+	DispatchPayload  *DispatchPayloadConfig
+	Leader           bool
+	ShutdownDelay    time.Duration `mapstructure:"shutdown_delay"`
+	ShutdownOrder    int           `mapstructure:"shutdown_order"`
+	StartOrder       int           `mapstructure:"start_order"`
+	ChrootMaxTotalMB int           `mapstructure:"chroot_max_total_mb"`
+	KillSignal       string        `mapstructure:"kill_signal"`
 }
 
 func (t *Task) Canonicalize(tg *TaskGroup, job *Job) {
@@ -647,6 +660,10 @@ const (
 	TaskRestartSignal          = "Restart Signaled"
 	TaskLeaderDead             = "Leader Task Dead"
 	TaskBuildingTaskDir        = "Building Task Directory"
+	TaskChrootBuildFailed      = "Chroot Build Failed"
+	TaskDiskQuotaExceeded      = "Disk Quota Exceeded"
+	TaskCPUThrottled           = "CPU Throttled"
+	TaskUnmountFailed          = "Unmount Failed"
 )
 
 // TaskEvent is an event that effects the state of a task and contains meta-data
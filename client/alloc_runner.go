@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
@@ -66,6 +67,10 @@ type AllocRunner struct {
 
 	taskStatusLock sync.RWMutex
 
+	// taskStateCh is closed and replaced whenever the state of a task
+	// changes. It is guarded by taskStatusLock.
+	taskStateCh chan struct{}
+
 	updateCh chan *structs.Allocation
 
 	vaultClient  vaultclient.VaultClient
@@ -166,6 +171,7 @@ func NewAllocRunner(logger *log.Logger, config *config.Config, stateDB *bolt.DB,
 		allocBroadcast: cstructs.NewAllocBroadcaster(8),
 		prevAlloc:      prevAlloc,
 		dirtyCh:        make(chan struct{}, 1),
+		taskStateCh:    make(chan struct{}),
 		allocDir:       allocdir.NewAllocDir(logger, filepath.Join(config.AllocDir, alloc.ID)),
 		tasks:          make(map[string]*TaskRunner),
 		taskStates:     copyTaskStates(alloc.TaskStates),
@@ -344,6 +350,7 @@ func (r *AllocRunner) RestoreState() error {
 		}
 
 		tr := NewTaskRunner(r.logger, r.config, r.stateDB, r.setTaskState, td, r.Alloc(), task, r.vaultClient, r.consulClient)
+		tr.startGate = r.waitForStartOrder
 		r.tasks[name] = tr
 
 		if restartReason, err := tr.RestoreState(); err != nil {
@@ -500,9 +507,35 @@ func (r *AllocRunner) DestroyState() error {
 
 // DestroyContext is used to destroy the context
 func (r *AllocRunner) DestroyContext() error {
+	r.setUnmountPolicy()
 	return r.allocDir.Destroy()
 }
 
+// setUnmountPolicy sets how the alloc dir handles mounts failing to unmount
+// from the client's options.
+func (r *AllocRunner) setUnmountPolicy() {
+	retries := r.config.ReadIntDefault("chroot.unmount_retries", config.DefaultUnmountRetries)
+	failure := r.config.ReadDefault("chroot.unmount_failure", allocdir.UnmountFailureRemove)
+	if err := r.allocDir.SetUnmountPolicy(retries, failure); err != nil {
+		r.logger.Printf("[WARN] client: ignoring invalid chroot.unmount_failure: %v", err)
+		r.allocDir.SetUnmountPolicy(retries, allocdir.UnmountFailureRemove)
+	}
+}
+
+// emitUnmountEvents emits an event for every mount of a task directory that
+// failed to unmount.
+func (r *AllocRunner) emitUnmountEvents(err error) {
+	merr, ok := err.(*multierror.Error)
+	if !ok {
+		return
+	}
+	for _, e := range merr.Errors {
+		if uerr, ok := e.(*allocdir.UnmountError); ok {
+			r.setTaskState(uerr.Task, "", structs.NewTaskEvent(structs.TaskUnmountFailed).SetMessage(uerr.Error()), true)
+		}
+	}
+}
+
 // GetAllocDir returns the alloc dir for the alloc runner
 func (r *AllocRunner) GetAllocDir() *allocdir.AllocDir {
 	return r.allocDir
@@ -772,8 +805,10 @@ func (r *AllocRunner) setTaskState(taskName, state string, event *structs.TaskEv
 		}
 	}
 
-	// Store the new state
+	// Store the new state and notify tasks waiting on it
 	taskState.State = state
+	close(r.taskStateCh)
+	r.taskStateCh = make(chan struct{})
 
 	select {
 	case r.dirtyCh <- struct{}{}:
@@ -781,6 +816,64 @@ func (r *AllocRunner) setTaskState(taskName, state string, event *structs.TaskEv
 	}
 }
 
+// waitForStartOrder blocks until the tasks of the group with a lower start
+// order than the given task are ready, the timeout elapses or stopCh is
+// closed. A task is ready once it is running or has completed successfully.
+// The tasks that aren't ready are returned if the timeout elapses, and an
+// error as soon as any of them is dead after failing as it will never become
+// ready.
+func (r *AllocRunner) waitForStartOrder(task *structs.Task, timeout time.Duration, stopCh <-chan struct{}) ([]string, error) {
+	alloc := r.Alloc()
+	tg := alloc.Job.LookupTaskGroup(alloc.TaskGroup)
+	if tg == nil {
+		return nil, nil
+	}
+
+	var deps []string
+	for _, t := range tg.Tasks {
+		if t.StartOrder < task.StartOrder {
+			deps = append(deps, t.Name)
+		}
+	}
+	if len(deps) == 0 {
+		return nil, nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		var pending, failed []string
+		r.taskStatusLock.RLock()
+		for _, name := range deps {
+			state, ok := r.taskStates[name]
+			switch {
+			case ok && (state.State == structs.TaskStateRunning || state.Successful()):
+			case ok && state.State == structs.TaskStateDead && state.Failed:
+				failed = append(failed, name)
+			default:
+				pending = append(pending, name)
+			}
+		}
+		changedCh := r.taskStateCh
+		r.taskStatusLock.RUnlock()
+
+		if len(failed) != 0 {
+			return nil, fmt.Errorf("tasks %v of lower start orders failed", failed)
+		}
+		if len(pending) == 0 {
+			return nil, nil
+		}
+
+		select {
+		case <-changedCh:
+		case <-timer.C:
+			return pending, nil
+		case <-stopCh:
+			return nil, nil
+		}
+	}
+}
+
 // appendTaskEvent updates the task status by appending the new event.
 func (r *AllocRunner) appendTaskEvent(state *structs.TaskState, event *structs.TaskEvent) {
 	capacity := 10
@@ -892,6 +985,7 @@ func (r *AllocRunner) Run() {
 		r.allocDirLock.Unlock()
 
 		tr := NewTaskRunner(r.logger, r.config, r.stateDB, r.setTaskState, taskdir, r.Alloc(), task.Copy(), r.vaultClient, r.consulClient)
+		tr.startGate = r.waitForStartOrder
 		r.tasks[task.Name] = tr
 		tr.MarkReceived()
 
@@ -899,6 +993,14 @@ func (r *AllocRunner) Run() {
 	}
 	r.taskLock.Unlock()
 
+	// Start watching the disk usage of the tasks
+	diskQuotaCtx, diskQuotaCancel := context.WithCancel(r.ctx)
+	diskQuotaDoneCh := make(chan struct{})
+	go func() {
+		defer close(diskQuotaDoneCh)
+		r.watchDiskQuota(diskQuotaCtx)
+	}()
+
 	// taskDestroyEvent contains an event that caused the destroyment of a task
 	// in the allocation.
 	var taskDestroyEvent *structs.TaskEvent
@@ -947,6 +1049,11 @@ OUTER:
 		}
 	}
 
+	// Stop watching the disk usage so that no task is left throttled while
+	// it's killed
+	diskQuotaCancel()
+	<-diskQuotaDoneCh
+
 	// Kill the task runners
 	r.destroyTaskRunners(taskDestroyEvent)
 
@@ -989,21 +1096,79 @@ func (r *AllocRunner) destroyTaskRunners(destroyEvent *structs.TaskEvent) {
 		}
 	}
 
-	// Then destroy non-leader tasks concurrently
+	// Then destroy non-leader tasks in ascending shutdown order. Tasks of
+	// the same order are destroyed concurrently.
+	tasks := make(map[string]*structs.Task, len(tg.Tasks))
+	for _, task := range tg.Tasks {
+		tasks[task.Name] = task
+	}
+
+	byOrder := make(map[int][]string)
 	r.taskLock.RLock()
-	for name, tr := range r.tasks {
-		if name != leader {
-			tr.Destroy(destroyEvent)
+	for name := range r.tasks {
+		if name == leader {
+			continue
+		}
+		order := 0
+		if task, ok := tasks[name]; ok {
+			order = task.ShutdownOrder
 		}
+		byOrder[order] = append(byOrder[order], name)
 	}
 	r.taskLock.RUnlock()
 
+	orders := make([]int, 0, len(byOrder))
+	for order := range byOrder {
+		orders = append(orders, order)
+	}
+	sort.Ints(orders)
+
+	for i, order := range orders {
+		var trs []*TaskRunner
+		var timeout time.Duration
+		r.taskLock.RLock()
+		for _, name := range byOrder[order] {
+			if tr, ok := r.tasks[name]; ok {
+				trs = append(trs, tr)
+			}
+			if task, ok := tasks[name]; ok && task.ShutdownDelay+task.KillTimeout > timeout {
+				timeout = task.ShutdownDelay + task.KillTimeout
+			}
+		}
+		r.taskLock.RUnlock()
+
+		for _, tr := range trs {
+			tr.Destroy(destroyEvent)
+		}
+
+		// Wait for the tasks to exit before destroying the next order
+		if i < len(orders)-1 {
+			r.logger.Printf("[DEBUG] client: alloc %q waiting for tasks %v of shutdown order %d to exit",
+				r.allocID, byOrder[order], order)
+			waitForTaskRunners(trs, timeout)
+		}
+	}
+
 	// Wait for termination of the task runners
 	for _, tr := range r.getTaskRunners() {
 		<-tr.WaitCh()
 	}
 }
 
+// waitForTaskRunners waits for the task runners to exit or the timeout to
+// elapse.
+func waitForTaskRunners(trs []*TaskRunner, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for _, tr := range trs {
+		select {
+		case <-tr.WaitCh():
+		case <-timer.C:
+			return
+		}
+	}
+}
+
 // handleDestroy blocks till the AllocRunner should be destroyed and does the
 // necessary cleanup.
 func (r *AllocRunner) handleDestroy() {
@@ -1029,8 +1194,13 @@ func (r *AllocRunner) handleDestroy() {
 
 	// Unmount any mounted directories as no tasks are running and makes
 	// cleaning up Nomad's data directory simpler.
+	r.setUnmountPolicy()
 	if err := r.allocDir.UnmountAll(); err != nil {
 		r.logger.Printf("[ERR] client: alloc %q unable unmount task directories: %v", r.allocID, err)
+
+		// Report the failed mounts with the final state
+		r.emitUnmountEvents(err)
+		alloc = r.Alloc()
 	}
 
 	// Update the server with the alloc's status -- also marks the alloc as
@@ -1168,6 +1338,16 @@ func (r *AllocRunner) Destroy() {
 	r.allocBroadcast.Close()
 }
 
+// DetachTasks stops managing the allocation's tasks without killing them, for
+// the tasks to be reattached to when the allocation is restored.
+func (r *AllocRunner) DetachTasks() {
+	r.taskLock.RLock()
+	defer r.taskLock.RUnlock()
+	for _, tr := range r.tasks {
+		tr.Detach()
+	}
+}
+
 // IsDestroyed returns true if the AllocRunner is not running and has been
 // destroyed (GC'd).
 func (r *AllocRunner) IsDestroyed() bool {
@@ -0,0 +1,200 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/client/driver"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// diskQuotaWarn emits an event when an allocation exceeds its ephemeral
+	// disk.
+	diskQuotaWarn = "warn"
+
+	// diskQuotaThrottle additionally pauses the allocation's tasks for half
+	// of every interval while the ephemeral disk is exceeded.
+	diskQuotaThrottle = "throttle"
+
+	// diskQuotaKill additionally kills the allocation's tasks, failing them.
+	diskQuotaKill = "kill"
+
+	// diskQuotaEventSource is the source used for killing tasks
+	diskQuotaEventSource = "disk quota"
+)
+
+// diskQuotaWatcher compares the disk usage of an allocation to its ephemeral
+// disk and enforces the configured action on its tasks once it's exceeded.
+type diskQuotaWatcher struct {
+	action   string
+	reserved int64
+
+	// pause is how long tasks are stopped for per interval when throttling
+	pause time.Duration
+
+	// dirs are the directories the allocation's disk usage is summed over
+	dirs []string
+
+	// over is whether the usage exceeded the ephemeral disk when last sampled
+	over bool
+}
+
+// watchDiskQuota samples the allocation's disk usage every interval until ctx
+// is done if the client enables the disk quota. The usage is sampled once for
+// all tasks as they share the ephemeral disk.
+func (r *AllocRunner) watchDiskQuota(ctx context.Context) {
+	action := r.config.ReadDefault("disk_quota.action", "")
+	switch action {
+	case "":
+		return
+	case diskQuotaWarn, diskQuotaThrottle, diskQuotaKill:
+	default:
+		r.logger.Printf("[WARN] client: ignoring invalid disk_quota.action %q; must be %q, %q or %q",
+			action, diskQuotaWarn, diskQuotaThrottle, diskQuotaKill)
+		return
+	}
+
+	alloc := r.Alloc()
+	tg := alloc.Job.LookupTaskGroup(alloc.TaskGroup)
+	if tg == nil || tg.EphemeralDisk == nil || tg.EphemeralDisk.SizeMB == 0 {
+		return
+	}
+
+	interval := r.config.ReadDurationDefault("disk_quota.interval", config.DefaultDiskQuotaInterval)
+	w := &diskQuotaWatcher{
+		action:   action,
+		reserved: int64(tg.EphemeralDisk.SizeMB) * MB,
+		pause:    interval / 2,
+	}
+	r.allocDirLock.Lock()
+	w.dirs = append(w.dirs, r.allocDir.SharedDir)
+	for _, task := range tg.Tasks {
+		w.dirs = append(w.dirs,
+			filepath.Join(r.allocDir.AllocDir, task.Name, allocdir.TaskLocal),
+			filepath.Join(r.allocDir.AllocDir, task.Name, allocdir.TmpDirName))
+	}
+	r.allocDirLock.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if !r.checkDiskQuota(ctx, w, diskUsage(w.dirs)) {
+			return
+		}
+	}
+}
+
+// checkDiskQuota enforces the quota given the allocation's disk usage in
+// bytes. It returns false once the tasks are killed.
+func (r *AllocRunner) checkDiskQuota(ctx context.Context, w *diskQuotaWatcher, used int64) bool {
+	if used <= w.reserved {
+		if w.over {
+			w.over = false
+			r.logger.Printf("[INFO] client: alloc %q is back within its ephemeral disk", r.allocID)
+			r.emitDiskQuotaEvent(fmt.Sprintf("Disk usage of %d MB is back within the ephemeral disk of %d MB", used/MB, w.reserved/MB))
+		}
+		return true
+	}
+
+	msg := fmt.Sprintf("Disk usage of %d MB exceeds the ephemeral disk of %d MB", used/MB, w.reserved/MB)
+	if !w.over {
+		w.over = true
+		r.logger.Printf("[WARN] client: alloc %q: %s", r.allocID, msg)
+		r.emitDiskQuotaEvent(msg)
+	}
+
+	switch w.action {
+	case diskQuotaThrottle:
+		r.throttleTasks(ctx, w.pause)
+	case diskQuotaKill:
+		for _, tr := range r.getTaskRunners() {
+			tr.Kill(diskQuotaEventSource, fmt.Sprintf("disk quota exceeded: %s", msg), true)
+		}
+		return false
+	}
+	return true
+}
+
+// emitDiskQuotaEvent emits a disk quota event on the tasks that are running.
+func (r *AllocRunner) emitDiskQuotaEvent(msg string) {
+	for _, tr := range r.getTaskRunners() {
+		if tr.getHandle() != nil {
+			tr.EmitEvent(structs.TaskDiskQuotaExceeded, msg)
+		}
+	}
+}
+
+// throttleTasks stops the processes of the running tasks for the pause, or
+// until ctx is done, and then continues them. Tasks are never left stopped so
+// that they can still remove files to get back within the ephemeral disk.
+func (r *AllocRunner) throttleTasks(ctx context.Context, pause time.Duration) {
+	var stopped []*TaskRunner
+	for _, tr := range r.getTaskRunners() {
+		if r.signalDiskQuota(tr, "SIGSTOP") {
+			stopped = append(stopped, tr)
+		}
+	}
+	if len(stopped) == 0 {
+		return
+	}
+
+	select {
+	case <-time.After(pause):
+	case <-ctx.Done():
+	}
+
+	for _, tr := range stopped {
+		r.signalDiskQuota(tr, "SIGCONT")
+	}
+}
+
+// signalDiskQuota sends the named signal to all processes of the task if its
+// driver supports it, or else its main process, and returns whether it was
+// sent.
+func (r *AllocRunner) signalDiskQuota(tr *TaskRunner, name string) bool {
+	handle := tr.getHandle()
+	if handle == nil {
+		return false
+	}
+
+	sig, err := driver.ParseSignal(name)
+	if err == nil {
+		if gs, ok := handle.(driver.GroupSignaler); ok {
+			err = gs.SignalGroup(sig)
+		} else {
+			err = handle.Signal(sig)
+		}
+	}
+	if err != nil {
+		r.logger.Printf("[WARN] client: failed to send %s to task %q for alloc %q: %v", name, tr.task.Name, r.allocID, err)
+		return false
+	}
+	return true
+}
+
+// diskUsage returns the total size of the regular files in the directories.
+// Files that are removed while walking are skipped.
+func diskUsage(dirs []string) int64 {
+	var used int64
+	for _, dir := range dirs {
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err == nil && fi.Mode().IsRegular() {
+				used += fi.Size()
+			}
+			return nil
+		})
+	}
+	return used
+}
@@ -291,8 +291,9 @@ func (a *allocHealthTracker) watchTaskEvents() {
 
 		// Store the task states
 		a.l.Lock()
+		now := time.Now()
 		for task, state := range alloc.TaskStates {
-			a.taskHealth[task].state = state
+			a.taskHealth[task].setState(state, now)
 		}
 		a.l.Unlock()
 
@@ -465,6 +466,30 @@ type taskHealthState struct {
 	task              *structs.Task
 	state             *structs.TaskState
 	taskRegistrations *consul.TaskRegistration
+
+	// runningSince is when the task started running on the monotonic clock.
+	// Unlike the state's StartedAt it's unaffected by changes of the wall
+	// clock once the task has been seen running.
+	runningSince time.Time
+}
+
+// setState stores the task's state as of now. The first time the task is seen
+// running its start is pinned to the monotonic clock so that the clock being
+// changed afterwards doesn't affect how long it's considered running.
+func (t *taskHealthState) setState(state *structs.TaskState, now time.Time) {
+	switch {
+	case state.State != structs.TaskStateRunning:
+		t.runningSince = time.Time{}
+	case t.runningSince.IsZero() || t.state == nil || !t.state.StartedAt.Equal(state.StartedAt):
+		// Account for the time the task ran before it was seen running. The
+		// wall clock having been set back can't make it start in the future.
+		elapsed := now.Sub(state.StartedAt)
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		t.runningSince = now.Add(-elapsed)
+	}
+	t.state = state
 }
 
 // event takes the deadline time for the allocation to be healthy and the update
@@ -490,7 +515,7 @@ func (t *taskHealthState) event(deadline time.Time, update *structs.UpdateStrate
 		}
 
 		// We are running so check if we have been running long enough
-		if t.state.StartedAt.Add(update.MinHealthyTime).After(deadline) {
+		if t.runningSince.Add(update.MinHealthyTime).After(deadline) {
 			return fmt.Sprintf("Task not running for min_healthy_time of %v by deadline", update.MinHealthyTime), true
 		}
 	}
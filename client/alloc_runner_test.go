@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -14,6 +15,7 @@ import (
 	"github.com/boltdb/bolt"
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/nomad/client/allocdir"
 	"github.com/hashicorp/nomad/command/agent/consul"
 	"github.com/hashicorp/nomad/helper/testlog"
 	"github.com/hashicorp/nomad/helper/uuid"
@@ -254,6 +256,52 @@ func TestAllocRunner_DeploymentHealth_Healthy_NoChecks(t *testing.T) {
 	}
 }
 
+// Test that a task is considered running for the min_healthy_time based on the
+// monotonic clock even if the wall clock jumps.
+func TestAllocRunner_DeploymentHealth_ClockChange(t *testing.T) {
+	t.Parallel()
+	update := &structs.UpdateStrategy{MinHealthyTime: 10 * time.Second}
+	task := &structs.Task{Name: "web"}
+	now := time.Now()
+	deadline := now.Add(15 * time.Second)
+
+	cases := []struct {
+		name      string
+		startedAt time.Time
+		seen      time.Time
+		unhealthy bool
+	}{
+		// The clock was set back an hour after the task started so its start
+		// appears to be in the future
+		{"clock set back", now.Add(time.Hour), now, false},
+		{"started before being seen", now.Add(-time.Minute), now, false},
+		{"not running long enough", now.Add(8 * time.Second), now.Add(8 * time.Second), true},
+	}
+
+	for _, c := range cases {
+		h := &taskHealthState{task: task}
+		h.setState(&structs.TaskState{State: structs.TaskStateRunning, StartedAt: c.startedAt.Round(0).UTC()}, c.seen)
+		msg, unhealthy := h.event(deadline, update)
+		if unhealthy != c.unhealthy {
+			t.Fatalf("%s: got unhealthy %v (%q); want %v", c.name, unhealthy, msg, c.unhealthy)
+		}
+	}
+
+	// The time the task is running since survives later updates of its state
+	h := &taskHealthState{task: task}
+	h.setState(&structs.TaskState{State: structs.TaskStateRunning, StartedAt: now.Round(0).UTC()}, now)
+	h.setState(&structs.TaskState{State: structs.TaskStateRunning, StartedAt: now.Round(0).UTC()}, now.Add(time.Hour))
+	if !h.runningSince.Equal(now) {
+		t.Fatalf("running since %v; want %v", h.runningSince, now)
+	}
+
+	// Stopping resets it
+	h.setState(&structs.TaskState{State: structs.TaskStateDead}, now)
+	if !h.runningSince.IsZero() {
+		t.Fatalf("running since %v after the task stopped", h.runningSince)
+	}
+}
+
 // Test that the watcher will mark the allocation as healthy with checks
 func TestAllocRunner_DeploymentHealth_Healthy_Checks(t *testing.T) {
 	t.Parallel()
@@ -1365,6 +1413,219 @@ func TestAllocRunner_TaskLeader_StopTG(t *testing.T) {
 	})
 }
 
+// TestAllocRunner_ShutdownOrder_StopTG asserts that stopping a task group
+// kills its tasks in ascending shutdown order.
+func TestAllocRunner_ShutdownOrder_StopTG(t *testing.T) {
+	t.Parallel()
+	upd, ar := testAllocRunner(t, false)
+
+	// Create 3 tasks with descending shutdown orders
+	task := ar.alloc.Job.TaskGroups[0].Tasks[0]
+	task.Name = "shipper"
+	task.Driver = "mock_driver"
+	task.ShutdownOrder = 2
+	task.KillTimeout = 10 * time.Millisecond
+	task.Config = map[string]interface{}{
+		"run_for": "10s",
+	}
+
+	task2 := task.Copy()
+	task2.Name = "sidecar"
+	task2.ShutdownOrder = 1
+
+	task3 := task.Copy()
+	task3.Name = "main"
+	task3.ShutdownOrder = 0
+	ar.alloc.Job.TaskGroups[0].Tasks = append(ar.alloc.Job.TaskGroups[0].Tasks, task2, task3)
+	ar.alloc.TaskResources[task2.Name] = task2.Resources
+	ar.alloc.TaskResources[task3.Name] = task3.Resources
+	defer ar.Destroy()
+
+	go ar.Run()
+
+	// Wait for tasks to start
+	oldCount, last := upd.Last()
+	testutil.WaitForResult(func() (bool, error) {
+		oldCount, last = upd.Last()
+		if last == nil {
+			return false, fmt.Errorf("No updates")
+		}
+		if n := len(last.TaskStates); n != 3 {
+			return false, fmt.Errorf("Not enough task states (want: 3; found %d)", n)
+		}
+		for name, state := range last.TaskStates {
+			if state.State != structs.TaskStateRunning {
+				return false, fmt.Errorf("Task %q is not running yet (it's %q)", name, state.State)
+			}
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// Stop alloc
+	update := ar.Alloc()
+	update.DesiredStatus = structs.AllocDesiredStatusStop
+	ar.Update(update)
+
+	// Wait for tasks to stop
+	testutil.WaitForResult(func() (bool, error) {
+		newCount, last := upd.Last()
+		if newCount == oldCount {
+			return false, fmt.Errorf("no new updates (count: %d)", newCount)
+		}
+		for _, name := range []string{"main", "sidecar", "shipper"} {
+			if last.TaskStates[name].State != structs.TaskStateDead {
+				return false, fmt.Errorf("Task %q is not dead yet", name)
+			}
+		}
+		if last.TaskStates["main"].FinishedAt.UnixNano() >= last.TaskStates["sidecar"].FinishedAt.UnixNano() {
+			return false, fmt.Errorf("expected main to finish before sidecar: %s >= %s",
+				last.TaskStates["main"].FinishedAt, last.TaskStates["sidecar"].FinishedAt)
+		}
+		if last.TaskStates["sidecar"].FinishedAt.UnixNano() >= last.TaskStates["shipper"].FinishedAt.UnixNano() {
+			return false, fmt.Errorf("expected sidecar to finish before shipper: %s >= %s",
+				last.TaskStates["sidecar"].FinishedAt, last.TaskStates["shipper"].FinishedAt)
+		}
+		return true, nil
+	}, func(err error) {
+		count, last := upd.Last()
+		t.Logf("Updates: %d", count)
+		for name, state := range last.TaskStates {
+			t.Logf("%s: %s", name, state.State)
+		}
+		t.Fatalf("err: %v", err)
+	})
+}
+
+// TestAllocRunner_StartOrder asserts that tasks are only started once the
+// tasks of lower start orders are running.
+func TestAllocRunner_StartOrder(t *testing.T) {
+	t.Parallel()
+	upd, ar := testAllocRunner(t, false)
+
+	// The database is slow to start and the web task starts after it
+	task := ar.alloc.Job.TaskGroups[0].Tasks[0]
+	task.Name = "db"
+	task.Driver = "mock_driver"
+	task.StartOrder = 0
+	task.Config = map[string]interface{}{
+		"start_block_for": "500ms",
+		"run_for":         "10s",
+	}
+
+	task2 := task.Copy()
+	task2.Name = "web"
+	task2.StartOrder = 1
+	task2.Config = map[string]interface{}{
+		"run_for": "10s",
+	}
+	ar.alloc.Job.TaskGroups[0].Tasks = append(ar.alloc.Job.TaskGroups[0].Tasks, task2)
+	ar.alloc.TaskResources[task2.Name] = task2.Resources
+	defer ar.Destroy()
+
+	go ar.Run()
+
+	testutil.WaitForResult(func() (bool, error) {
+		_, last := upd.Last()
+		if last == nil {
+			return false, fmt.Errorf("No updates")
+		}
+		for _, name := range []string{"db", "web"} {
+			state, ok := last.TaskStates[name]
+			if !ok || state.State != structs.TaskStateRunning {
+				return false, fmt.Errorf("Task %q is not running yet", name)
+			}
+		}
+		if db, web := last.TaskStates["db"].StartedAt, last.TaskStates["web"].StartedAt; !web.After(db) {
+			return false, fmt.Errorf("expected web to start after db: %s <= %s", web, db)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+// TestAllocRunner_StartOrder_Timeout asserts that a task fails if the tasks of
+// lower start orders aren't running before the timeout.
+func TestAllocRunner_StartOrder_Timeout(t *testing.T) {
+	t.Parallel()
+	upd, ar := testAllocRunner(t, false)
+	ar.config.Options = map[string]string{
+		"start_order.timeout": "100ms",
+	}
+
+	task := ar.alloc.Job.TaskGroups[0].Tasks[0]
+	task.Name = "db"
+	task.Driver = "mock_driver"
+	task.StartOrder = 0
+	task.Config = map[string]interface{}{
+		"start_block_for": "10s",
+		"run_for":         "10s",
+	}
+
+	task2 := task.Copy()
+	task2.Name = "web"
+	task2.StartOrder = 1
+	task2.Config = map[string]interface{}{
+		"run_for": "10s",
+	}
+	ar.alloc.Job.TaskGroups[0].Tasks = append(ar.alloc.Job.TaskGroups[0].Tasks, task2)
+	ar.alloc.TaskResources[task2.Name] = task2.Resources
+	defer ar.Destroy()
+
+	go ar.Run()
+
+	testutil.WaitForResult(func() (bool, error) {
+		_, last := upd.Last()
+		if last == nil {
+			return false, fmt.Errorf("No updates")
+		}
+		state, ok := last.TaskStates["web"]
+		if !ok || state.State != structs.TaskStateDead {
+			return false, fmt.Errorf("Task web is not dead yet")
+		}
+		if !state.Failed {
+			return false, fmt.Errorf("expected web to fail")
+		}
+		for _, e := range state.Events {
+			if e.Type == structs.TaskSetupFailure && strings.Contains(e.SetupError, "[db]") {
+				return true, nil
+			}
+		}
+		return false, fmt.Errorf("expected a setup failure naming db: %#v", state.Events)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+// TestAllocRunner_StartOrder_Failed asserts that waiting for the tasks of lower
+// start orders fails right away if one of them is dead after failing, such as
+// after restoring an alloc, rather than waiting for the timeout.
+func TestAllocRunner_StartOrder_Failed(t *testing.T) {
+	t.Parallel()
+	_, ar := testAllocRunner(t, false)
+	defer ar.Destroy()
+
+	task := ar.alloc.Job.TaskGroups[0].Tasks[0]
+	task.Name = "db"
+	task.StartOrder = 0
+	task2 := task.Copy()
+	task2.Name = "web"
+	task2.StartOrder = 1
+	ar.alloc.Job.TaskGroups[0].Tasks = append(ar.alloc.Job.TaskGroups[0].Tasks, task2)
+	ar.taskStates["db"] = &structs.TaskState{State: structs.TaskStateDead, Failed: true}
+
+	start := time.Now()
+	pending, err := ar.waitForStartOrder(task2, time.Minute, nil)
+	if err == nil || !strings.Contains(err.Error(), "[db]") {
+		t.Fatalf("expected an error naming db; got pending %v, err %v", pending, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("waited %v for a failed task", elapsed)
+	}
+}
+
 // TestAllocRunner_TaskLeader_StopRestoredTG asserts that when stopping a
 // restored task group with a leader that failed before restoring the leader is
 // not stopped as it does not exist.
@@ -1534,3 +1795,192 @@ func TestAllocRunner_MoveAllocDir(t *testing.T) {
 		t.Fatalf("file %v not found", dataFile)
 	}
 }
+
+func TestAllocRunner_UnmountEvents(t *testing.T) {
+	t.Parallel()
+	_, ar := testAllocRunner(t, false)
+	task := ar.alloc.Job.TaskGroups[0].Tasks[0]
+
+	var merr multierror.Error
+	merr.Errors = append(merr.Errors,
+		&allocdir.UnmountError{Task: task.Name, Err: fmt.Errorf("device or resource busy")},
+		fmt.Errorf("not an unmount error"))
+	ar.emitUnmountEvents(merr.ErrorOrNil())
+
+	state := ar.taskStates[task.Name]
+	if state == nil || len(state.Events) != 1 {
+		t.Fatalf("expected one event, got: %#v", state)
+	}
+	if e := state.Events[0]; e.Type != structs.TaskUnmountFailed || e.Message != "device or resource busy" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
+
+func TestAllocRunner_DiskQuota_Kill(t *testing.T) {
+	t.Parallel()
+	upd, ar := testAllocRunner(t, false)
+	ar.config.Options = map[string]string{
+		"disk_quota.action":   "kill",
+		"disk_quota.interval": "100ms",
+	}
+	ar.alloc.Job.TaskGroups[0].EphemeralDisk.SizeMB = 1
+
+	// Both tasks are killed although only the shared alloc dir is written to
+	task := ar.alloc.Job.TaskGroups[0].Tasks[0]
+	task.Config = map[string]interface{}{
+		"run_for": "10s",
+	}
+	task2 := task.Copy()
+	task2.Name = "task 2"
+	ar.alloc.Job.TaskGroups[0].Tasks = append(ar.alloc.Job.TaskGroups[0].Tasks, task2)
+	ar.alloc.TaskResources[task2.Name] = task2.Resources
+	go ar.Run()
+	defer ar.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		_, last := upd.Last()
+		if last == nil {
+			return false, fmt.Errorf("No updates")
+		}
+		for _, name := range []string{task.Name, task2.Name} {
+			if state := last.TaskStates[name]; state == nil || state.State != structs.TaskStateRunning {
+				return false, fmt.Errorf("task %q not running: %v", name, state)
+			}
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	data := make([]byte, 2*MB)
+	if err := ioutil.WriteFile(filepath.Join(ar.allocDir.SharedDir, allocdir.SharedDataDir, "data"), data, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	testutil.WaitForResult(func() (bool, error) {
+		_, last := upd.Last()
+		if last.ClientStatus != structs.AllocClientStatusFailed {
+			return false, fmt.Errorf("got status %v; want %v", last.ClientStatus, structs.AllocClientStatusFailed)
+		}
+		for _, name := range []string{task.Name, task2.Name} {
+			state := last.TaskStates[name]
+			if state.State != structs.TaskStateDead || !state.Failed {
+				return false, fmt.Errorf("task %q should have failed: %v", name, state)
+			}
+			var exceeded, killing int
+			for _, e := range state.Events {
+				switch e.Type {
+				case structs.TaskDiskQuotaExceeded:
+					exceeded++
+				case structs.TaskKilling:
+					if strings.Contains(e.KillReason, "disk quota exceeded") {
+						killing++
+					}
+				}
+			}
+			if exceeded != 1 || killing != 1 {
+				return false, fmt.Errorf("got %d exceeded and %d killing events for task %q; want 1 each", exceeded, killing, name)
+			}
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+// testAllocRunnerRunning runs the mock task of the alloc runner until the
+// test is done.
+func testAllocRunnerRunning(t *testing.T) (*MockAllocStateUpdater, *AllocRunner) {
+	upd, ar := testAllocRunner(t, false)
+	ar.alloc.Job.TaskGroups[0].Tasks[0].Config["run_for"] = "10s"
+	go ar.Run()
+
+	testutil.WaitForResult(func() (bool, error) {
+		_, last := upd.Last()
+		if last == nil || last.ClientStatus != structs.AllocClientStatusRunning {
+			return false, fmt.Errorf("alloc not running: %v", last)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	return upd, ar
+}
+
+// testDiskQuotaEvents returns the disk quota events of the alloc's task.
+func testDiskQuotaEvents(ar *AllocRunner) []*structs.TaskEvent {
+	ar.taskStatusLock.RLock()
+	defer ar.taskStatusLock.RUnlock()
+
+	var events []*structs.TaskEvent
+	for _, e := range ar.taskStates[ar.alloc.Job.TaskGroups[0].Tasks[0].Name].Events {
+		if e.Type == structs.TaskDiskQuotaExceeded {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func TestAllocRunner_DiskQuota_Warn(t *testing.T) {
+	t.Parallel()
+	_, ar := testAllocRunnerRunning(t)
+	defer ar.Destroy()
+
+	w := &diskQuotaWatcher{action: diskQuotaWarn, reserved: 10 * MB}
+
+	// An event is emitted once when crossing the ephemeral disk either way
+	for _, used := range []int64{5 * MB, 11 * MB, 12 * MB, 9 * MB} {
+		if !ar.checkDiskQuota(context.Background(), w, used) {
+			t.Fatalf("tasks shouldn't be killed when warning")
+		}
+	}
+	events := testDiskQuotaEvents(ar)
+	if len(events) != 2 {
+		t.Fatalf("got %d events; want 2: %v", len(events), events)
+	}
+	if !strings.Contains(events[0].Message, "11 MB exceeds") {
+		t.Fatalf("bad message: %q", events[0].Message)
+	}
+}
+
+func TestAllocRunner_DiskQuota_Throttle(t *testing.T) {
+	t.Parallel()
+	_, ar := testAllocRunnerRunning(t)
+	defer ar.Destroy()
+
+	pause := 500 * time.Millisecond
+	w := &diskQuotaWatcher{action: diskQuotaThrottle, reserved: 10 * MB, pause: pause}
+
+	// The tasks aren't paused while within the ephemeral disk
+	start := time.Now()
+	if !ar.checkDiskQuota(context.Background(), w, 5*MB) {
+		t.Fatalf("tasks shouldn't be killed when throttling")
+	}
+	if d := time.Since(start); d >= pause {
+		t.Fatalf("tasks paused for %v within the ephemeral disk", d)
+	}
+
+	// They're paused for the pause of every sample once exceeded
+	for i := 0; i < 2; i++ {
+		start = time.Now()
+		if !ar.checkDiskQuota(context.Background(), w, 11*MB) {
+			t.Fatalf("tasks shouldn't be killed when throttling")
+		}
+		if d := time.Since(start); d < pause {
+			t.Fatalf("tasks paused for %v; want %v", d, pause)
+		}
+	}
+
+	// The pause is cut short once the watcher is stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	ar.checkDiskQuota(ctx, w, 11*MB)
+	if d := time.Since(start); d >= pause {
+		t.Fatalf("tasks paused for %v after the watcher stopped", d)
+	}
+
+	if events := testDiskQuotaEvents(ar); len(events) != 1 {
+		t.Fatalf("got %d events; want 1: %v", len(events), events)
+	}
+}
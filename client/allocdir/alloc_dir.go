@@ -22,6 +22,63 @@ const (
 	// idUnsupported is what the uid/gid will be set to on platforms (eg
 	// Windows) that don't support integer ownership identifiers.
 	idUnsupported = -1
+
+	// ChrootStaleCheckNone disables detecting stale chroot files.
+	ChrootStaleCheckNone = ""
+
+	// ChrootStaleCheckMtime detects stale chroot files by comparing their
+	// size and modification time with the host.
+	ChrootStaleCheckMtime = "mtime"
+
+	// ChrootStaleCheckHash detects stale chroot files by comparing their
+	// size and contents with the host.
+	ChrootStaleCheckHash = "hash"
+
+	// MountPropagationPrivate keeps mount events from propagating between
+	// the host and bind mounts into the chroot.
+	MountPropagationPrivate = "private"
+
+	// MountPropagationSlave propagates mount events on the host into bind
+	// mounts into the chroot but not the other way.
+	MountPropagationSlave = "slave"
+
+	// MountPropagationShared propagates mount events both ways between the
+	// host and bind mounts into the chroot.
+	MountPropagationShared = "shared"
+
+	// UnmountFailureRemove removes the alloc dir even if some of its mounts
+	// failed to unmount.
+	UnmountFailureRemove = "remove"
+
+	// UnmountFailureKeep keeps the alloc dir if some of its mounts failed to
+	// unmount so that nothing is removed through them.
+	UnmountFailureKeep = "keep"
+
+	// UnmountFailureDetach lazily detaches the mounts that failed to unmount
+	// so that the alloc dir can be removed.
+	UnmountFailureDetach = "detach"
+
+	// unmountRetryBackoff is the backoff before the first retry of failed
+	// unmounts. It doubles with every retry.
+	unmountRetryBackoff = 100 * time.Millisecond
+
+	// mountsDirName is the name of the directory in the client's alloc dir
+	// holding the records of the mounts made into the task dirs of each
+	// alloc, so that they're unmounted even if the client restarted since
+	// mounting them.
+	mountsDirName = "mounts"
+
+	// bindMountsFile is the file in a task's mounts record dir recording the
+	// host paths bind mounted into the chroot.
+	bindMountsFile = "bind"
+
+	// chrootBaseMountsFile is the file in a task's mounts record dir
+	// recording where the shared chroot base is bind mounted into the chroot.
+	chrootBaseMountsFile = "chroot-base"
+
+	// ChrootBaseDirName is the name of the directory in the client's alloc
+	// dir holding the shared chroot bases.
+	ChrootBaseDirName = "chroot-base"
 )
 
 var (
@@ -73,9 +130,25 @@ type AllocDir struct {
 	// built is true if Build has successfully run
 	built bool
 
+	// unmountRetries is the number of times failed unmounts are retried and
+	// unmountFailure how the mounts failing afterwards are handled.
+	unmountRetries int
+	unmountFailure string
+
 	logger *log.Logger
 }
 
+// UnmountError is the error of tearing down the mounts of a task dir.
+type UnmountError struct {
+	// Task is the name of the task whose directory failed to be torn down
+	Task string
+	Err  error
+}
+
+func (e *UnmountError) Error() string {
+	return e.Err.Error()
+}
+
 // AllocDirFS exposes file operations on the alloc dir
 type AllocDirFS interface {
 	List(path string) ([]*cstructs.AllocFileInfo, error)
@@ -244,6 +317,20 @@ func (d *AllocDir) Move(other *AllocDir, tasks []*structs.Task) error {
 	return nil
 }
 
+// SetUnmountPolicy sets how many times failed unmounts are retried and how
+// the mounts still failing afterwards are handled when the alloc dir is
+// destroyed, one of remove, keep or detach.
+func (d *AllocDir) SetUnmountPolicy(retries int, failure string) error {
+	switch failure {
+	case UnmountFailureRemove, UnmountFailureKeep, UnmountFailureDetach:
+	default:
+		return fmt.Errorf("unknown unmount failure policy %q", failure)
+	}
+	d.unmountRetries = retries
+	d.unmountFailure = failure
+	return nil
+}
+
 // Tears down previously build directory structure.
 func (d *AllocDir) Destroy() error {
 
@@ -251,10 +338,31 @@ func (d *AllocDir) Destroy() error {
 	var mErr multierror.Error
 	if err := d.UnmountAll(); err != nil {
 		mErr.Errors = append(mErr.Errors, err)
+
+		// Don't remove anything through the mounts that are left
+		if d.unmountFailure == UnmountFailureKeep {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("keeping alloc dir %q as it's still mounted", d.AllocDir))
+			return mErr.ErrorOrNil()
+		}
+	}
+
+	// Host paths or a shared chroot base still bind mounted would be removed
+	// from the host
+	for _, dir := range d.TaskDirs {
+		if mounts, _ := dir.bindMounts(); len(mounts) != 0 {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("keeping alloc dir %q as host paths are still mounted into it: %v", d.AllocDir, mounts))
+			return mErr.ErrorOrNil()
+		}
+		if mounts, _ := dir.chrootBaseMounts(); len(mounts) != 0 {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("keeping alloc dir %q as the shared chroot base is still mounted into it: %v", d.AllocDir, mounts))
+			return mErr.ErrorOrNil()
+		}
 	}
 
 	if err := os.RemoveAll(d.AllocDir); err != nil {
 		mErr.Errors = append(mErr.Errors, fmt.Errorf("failed to remove alloc dir %q: %v", d.AllocDir, err))
+	} else if err := os.RemoveAll(d.mountsRecordDir()); err != nil {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("failed to remove the mounts record of alloc dir %q: %v", d.AllocDir, err))
 	}
 
 	// Unset built since the alloc dir has been destroyed.
@@ -262,35 +370,118 @@ func (d *AllocDir) Destroy() error {
 	return mErr.ErrorOrNil()
 }
 
-// UnmountAll linked/mounted directories in task dirs.
+// mountsRecordDir returns the directory the mounts of the alloc's tasks are
+// recorded in.
+func (d *AllocDir) mountsRecordDir() string {
+	return filepath.Join(filepath.Dir(d.AllocDir), mountsDirName, filepath.Base(d.AllocDir))
+}
+
+// UnmountAll linked/mounted directories in task dirs. Every mount is torn down
+// independently and the failed ones are retried with a backoff, such as
+// mounts that are busy right after the task exited. The errors of the mounts
+// still failing are returned as UnmountErrors.
 func (d *AllocDir) UnmountAll() error {
 	var mErr multierror.Error
-	for _, dir := range d.TaskDirs {
-		// Check if the directory has the shared alloc mounted.
-		if pathExists(dir.SharedTaskDir) {
-			if err := unlinkDir(dir.SharedTaskDir); err != nil {
-				mErr.Errors = append(mErr.Errors,
-					fmt.Errorf("failed to unmount shared alloc dir %q: %v", dir.SharedTaskDir, err))
-			} else if err := os.RemoveAll(dir.SharedTaskDir); err != nil {
-				mErr.Errors = append(mErr.Errors,
-					fmt.Errorf("failed to delete shared alloc dir %q: %v", dir.SharedTaskDir, err))
+	for name, dir := range d.TaskDirs {
+		mErr.Errors = append(mErr.Errors, d.unmountTaskDir(name, dir)...)
+	}
+
+	return mErr.ErrorOrNil()
+}
+
+// teardownStep tears down one of the mounts of a task dir.
+type teardownStep struct {
+	// mounts are detached if the step fails with the detach policy
+	mounts []string
+	run    func() error
+	err    error
+}
+
+// unmountTaskDir tears down the mounts of the task dir, retrying the failed
+// ones, and returns the errors of the mounts still failing.
+func (d *AllocDir) unmountTaskDir(name string, dir *TaskDir) []error {
+	bindMounts, _ := dir.bindMounts()
+	baseMounts, _ := dir.chrootBaseMounts()
+	steps := []*teardownStep{
+		{
+			mounts: bindMounts,
+			run:    dir.unmountBindMounts,
+		},
+		{
+			mounts: baseMounts,
+			run:    dir.unmountChrootBase,
+		},
+		{
+			mounts: []string{dir.SharedTaskDir},
+			run: func() error {
+				// Check if the directory has the shared alloc mounted.
+				if !pathExists(dir.SharedTaskDir) {
+					return nil
+				}
+				if err := unlinkDir(dir.SharedTaskDir); err != nil {
+					return fmt.Errorf("failed to unmount shared alloc dir %q: %v", dir.SharedTaskDir, err)
+				}
+				if err := os.RemoveAll(dir.SharedTaskDir); err != nil {
+					return fmt.Errorf("failed to delete shared alloc dir %q: %v", dir.SharedTaskDir, err)
+				}
+				return nil
+			},
+		},
+		{
+			mounts: []string{dir.SecretsDir},
+			run: func() error {
+				if !pathExists(dir.SecretsDir) {
+					return nil
+				}
+				if err := removeSecretDir(dir.SecretsDir); err != nil {
+					return fmt.Errorf("failed to remove the secret dir %q: %v", dir.SecretsDir, err)
+				}
+				return nil
+			},
+		},
+		{
+			// Unmount dev/ and proc/ have been mounted.
+			mounts: []string{filepath.Join(dir.Dir, "dev"), filepath.Join(dir.Dir, "proc")},
+			run:    dir.unmountSpecialDirs,
+		},
+	}
+
+	backoff := unmountRetryBackoff
+	for attempt := 0; ; attempt++ {
+		var failed []*teardownStep
+		for _, step := range steps {
+			if step.err = step.run(); step.err != nil {
+				failed = append(failed, step)
 			}
 		}
+		steps = failed
+		if len(steps) == 0 || attempt >= d.unmountRetries {
+			break
+		}
+
+		d.logger.Printf("[DEBUG] allocdir: retrying %d failed unmounts of task %q in %v", len(steps), name, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
 
-		if pathExists(dir.SecretsDir) {
-			if err := removeSecretDir(dir.SecretsDir); err != nil {
-				mErr.Errors = append(mErr.Errors,
-					fmt.Errorf("failed to remove the secret dir %q: %v", dir.SecretsDir, err))
+	if d.unmountFailure == UnmountFailureDetach {
+		for _, step := range steps {
+			for _, mount := range step.mounts {
+				if err := detachDir(mount); err != nil {
+					d.logger.Printf("[WARN] allocdir: failed to detach %q: %v", mount, err)
+				}
 			}
+			step.err = step.run()
 		}
+	}
 
-		// Unmount dev/ and proc/ have been mounted.
-		if err := dir.unmountSpecialDirs(); err != nil {
-			mErr.Errors = append(mErr.Errors, err)
+	var errs []error
+	for _, step := range steps {
+		if step.err != nil {
+			errs = append(errs, &UnmountError{Task: name, Err: step.err})
 		}
 	}
-
-	return mErr.ErrorOrNil()
+	return errs
 }
 
 // Build the directory tree for an allocation.
@@ -456,7 +647,7 @@ func getFileWatcher(path string) watch.FileWatcher {
 
 // fileCopy from src to dst setting the permissions and owner (if uid & gid are
 // both greater than 0)
-func fileCopy(src, dst string, uid, gid int, perm os.FileMode) error {
+func fileCopy(ctx context.Context, src, dst string, uid, gid int, perm os.FileMode) error {
 	// Do a simple copy.
 	srcFile, err := os.Open(src)
 	if err != nil {
@@ -470,7 +661,13 @@ func fileCopy(src, dst string, uid, gid int, perm os.FileMode) error {
 	}
 	defer dstFile.Close()
 
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
+	// Only copies that can be canceled are read through the context so that
+	// the others can use copy_file_range
+	var r io.Reader = srcFile
+	if ctx.Done() != nil {
+		r = &contextReader{ctx: ctx, r: srcFile}
+	}
+	if _, err := io.Copy(dstFile, r); err != nil {
 		return fmt.Errorf("Couldn't copy %q to %q: %v", src, dst, err)
 	}
 
@@ -480,9 +677,30 @@ func fileCopy(src, dst string, uid, gid int, perm os.FileMode) error {
 		}
 	}
 
+	// Preserve the modification time so stale copies can be detected
+	if fi, err := srcFile.Stat(); err == nil {
+		if err := os.Chtimes(dst, fi.ModTime(), fi.ModTime()); err != nil {
+			return fmt.Errorf("Couldn't copy %q to %q: %v", src, dst, err)
+		}
+	}
+
 	return nil
 }
 
+// contextReader stops reading once its context is done so that copies from
+// slow sources are abandoned.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
 // pathExists is a helper function to check if the path exists.
 func pathExists(path string) bool {
 	if _, err := os.Stat(path); err != nil {
@@ -0,0 +1,91 @@
+package allocdir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// OpenFileBeneath opens the file at the relative path rel within root like
+// os.OpenFile without following symbolic links, creating its missing parent
+// directories if flag includes os.O_CREATE.
+func OpenFileBeneath(root, rel string, flag int, perm os.FileMode) (*os.File, error) {
+	dir, err := OpenDirBeneath(root, filepath.Dir(rel), flag&os.O_CREATE != 0, 0755)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	return OpenFileAt(dir, filepath.Base(rel), flag, perm)
+}
+
+// WriteFileBeneath replaces the file at the relative path rel within root with
+// data without following symbolic links. The file is replaced atomically so
+// readers never see partial data.
+func WriteFileBeneath(root, rel string, data []byte, perm os.FileMode) error {
+	dir, err := OpenDirBeneath(root, filepath.Dir(rel), true, 0755)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	name := filepath.Base(rel)
+	tmp := name + ".tmp"
+	RemoveAt(dir, tmp)
+	f, err := OpenFileAt(dir, tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = RenameAt(dir, tmp, dir, name)
+	}
+	if err != nil {
+		RemoveAt(dir, tmp)
+		return err
+	}
+	return nil
+}
+
+// RemoveBeneath removes the file at the relative path rel within root without
+// following symbolic links.
+func RemoveBeneath(root, rel string) error {
+	dir, err := OpenDirBeneath(root, filepath.Dir(rel), false, 0)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return RemoveAt(dir, filepath.Base(rel))
+}
+
+// splitBeneath returns the components of the relative path rel, which must
+// not escape the directory it's relative to.
+func splitBeneath(rel string) ([]string, error) {
+	if filepath.IsAbs(rel) {
+		return nil, fmt.Errorf("path %q must be relative", rel)
+	}
+
+	var parts []string
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			return nil, fmt.Errorf("path %q must not contain %q", rel, "..")
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+// checkBeneathName returns an error if name isn't the name of an entry within
+// a directory.
+func checkBeneathName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// +build dragonfly netbsd openbsd windows
+
+package allocdir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// OpenDirBeneath opens the directory at the relative path rel within root,
+// failing if any of its components is a symbolic link. Missing directories are
+// created with mode if create is set. Unlike on Linux the components are
+// checked before they're opened rather than resolved relative to each other.
+func OpenDirBeneath(root, rel string, create bool, mode os.FileMode) (*os.File, error) {
+	parts, err := splitBeneath(rel)
+	if err != nil {
+		return nil, err
+	}
+
+	path := root
+	for _, part := range parts {
+		path = filepath.Join(path, part)
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) && create {
+			if err := os.Mkdir(path, mode); err != nil && !os.IsExist(err) {
+				return nil, err
+			}
+			fi, err = os.Lstat(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("%q is not a directory", path)
+		}
+	}
+	return os.Open(path)
+}
+
+// OpenFileAt opens the file name within the directory dir like os.OpenFile,
+// failing if name is a symbolic link.
+func OpenFileAt(dir *os.File, name string, flag int, perm os.FileMode) (*os.File, error) {
+	if err := checkBeneathName(name); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir.Name(), name)
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return nil, fmt.Errorf("refusing to open symbolic link %q", path)
+	}
+	return os.OpenFile(path, flag, perm)
+}
+
+// OpenRegularFileAt opens the regular file name within the directory dir for
+// reading, failing if name is a symbolic link or any other kind of file.
+func OpenRegularFileAt(dir *os.File, name string) (*os.File, error) {
+	if err := checkBeneathName(name); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir.Name(), name)
+	if fi, err := os.Lstat(path); err != nil {
+		return nil, err
+	} else if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%q is not a regular file", path)
+	}
+	return os.Open(path)
+}
+
+// RenameAt renames the entry oldname within the directory olddir to newname
+// within newdir, replacing newname if it exists.
+func RenameAt(olddir *os.File, oldname string, newdir *os.File, newname string) error {
+	if err := checkBeneathName(oldname); err != nil {
+		return err
+	}
+	if err := checkBeneathName(newname); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(olddir.Name(), oldname), filepath.Join(newdir.Name(), newname))
+}
+
+// RemoveAt removes the file or empty directory name within the directory dir.
+func RemoveAt(dir *os.File, name string) error {
+	if err := checkBeneathName(name); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(dir.Name(), name))
+}
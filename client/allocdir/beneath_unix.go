@@ -0,0 +1,152 @@
+// +build darwin freebsd linux solaris
+
+package allocdir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// OpenDirBeneath opens the directory at the relative path rel within root
+// without following symbolic links in any of its components, so a task that
+// controls the directories within root can't redirect the client to a path
+// outside of it. Missing directories are created with mode if create is set.
+func OpenDirBeneath(root, rel string, create bool, mode os.FileMode) (*os.File, error) {
+	parts, err := splitBeneath(rel)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+
+	path := root
+	for _, part := range parts {
+		path = filepath.Join(path, part)
+		next, err := openDirAt(fd, part)
+		if err == unix.ENOENT && create {
+			if err = unix.Mkdirat(fd, part, uint32(mode.Perm())); err == nil || err == unix.EEXIST {
+				next, err = openDirAt(fd, part)
+			}
+		}
+		unix.Close(fd)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: path, Err: err}
+		}
+		fd = next
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// openDirAt opens the directory name within the directory dirfd if name isn't
+// a symbolic link.
+func openDirAt(dirfd int, name string) (int, error) {
+	return unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+}
+
+// OpenFileAt opens the file name within the directory dir like os.OpenFile
+// but fails if name is a symbolic link or a hard link to a file elsewhere, as
+// a task could use either to have the client write to a file it can't access.
+func OpenFileAt(dir *os.File, name string, flag int, perm os.FileMode) (*os.File, error) {
+	if err := checkBeneathName(name); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir.Name(), name)
+	fd, err := unix.Openat(int(dir.Fd()), name, (flag&^os.O_TRUNC)|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(perm.Perm()))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	f := os.NewFile(uintptr(fd), path)
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFREG && st.Nlink > 1 {
+		f.Close()
+		return nil, fmt.Errorf("refusing to open %q as it has %d hard links", path, st.Nlink)
+	}
+	if flag&os.O_TRUNC != 0 {
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// OpenRegularFileAt opens the regular file name within the directory dir for
+// reading, failing if name is a symbolic link or any other kind of file. It
+// doesn't block if name is a FIFO, so a task can't hang the client with one.
+// Unlike OpenFileAt it allows hard links as nothing is written to the file.
+func OpenRegularFileAt(dir *os.File, name string) (*os.File, error) {
+	if err := checkBeneathName(name); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir.Name(), name)
+	fd, err := unix.Openat(int(dir.Fd()), name, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		unix.Close(fd)
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFREG {
+		unix.Close(fd)
+		return nil, fmt.Errorf("%q is not a regular file", path)
+	}
+
+	// Reads of regular files don't block, so the descriptor is made
+	// blocking again for os.File to read it directly
+	if err := unix.SetNonblock(fd, false); err != nil {
+		unix.Close(fd)
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// RenameAt renames the entry oldname within the directory olddir to newname
+// within newdir, replacing newname if it exists. Neither is followed if it's a
+// symbolic link.
+func RenameAt(olddir *os.File, oldname string, newdir *os.File, newname string) error {
+	if err := checkBeneathName(oldname); err != nil {
+		return err
+	}
+	if err := checkBeneathName(newname); err != nil {
+		return err
+	}
+	if err := unix.Renameat(int(olddir.Fd()), oldname, int(newdir.Fd()), newname); err != nil {
+		return &os.LinkError{Op: "rename", Old: filepath.Join(olddir.Name(), oldname), New: filepath.Join(newdir.Name(), newname), Err: err}
+	}
+	return nil
+}
+
+// RemoveAt removes the file or empty directory name within the directory dir
+// without following it if it's a symbolic link.
+func RemoveAt(dir *os.File, name string) error {
+	if err := checkBeneathName(name); err != nil {
+		return err
+	}
+	fd := int(dir.Fd())
+	err := unix.Unlinkat(fd, name, 0)
+	if err == unix.EISDIR || err == unix.EPERM {
+		if rmdirErr := unix.Unlinkat(fd, name, unix.AT_REMOVEDIR); rmdirErr != unix.ENOTDIR {
+			err = rmdirErr
+		}
+	}
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: filepath.Join(dir.Name(), name), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// +build darwin freebsd linux solaris
+
+package allocdir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestBeneath_WriteRemove(t *testing.T) {
+	root, err := ioutil.TempDir("", "nomadtest-beneath")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := WriteFileBeneath(root, "local/run/task.pid", []byte("1\n"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(root, "local", "run", "task.pid"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(data) != "1\n" {
+		t.Fatalf("unexpected contents %q", data)
+	}
+
+	if err := RemoveBeneath(root, "local/run/task.pid"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "local", "run", "task.pid")); !os.IsNotExist(err) {
+		t.Fatalf("expected file to be removed; got %v", err)
+	}
+
+	if err := WriteFileBeneath(root, "../task.pid", []byte("1\n"), 0644); err == nil {
+		t.Fatalf("expected error writing outside of the root")
+	}
+}
+
+func TestBeneath_Symlinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "nomadtest-beneath")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "nomadtest-beneath")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	target := filepath.Join(outside, "target")
+	if err := ioutil.WriteFile(target, []byte("keep"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A symlinked directory isn't followed
+	if err := os.Symlink(outside, filepath.Join(root, "local")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := WriteFileBeneath(root, "local/task.pid", []byte("1\n"), 0644); err == nil {
+		t.Fatalf("expected error writing through a symlinked directory")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "task.pid")); !os.IsNotExist(err) {
+		t.Fatalf("expected no file outside of the root; got %v", err)
+	}
+
+	// Neither is a symlinked file
+	if err := os.Symlink(target, filepath.Join(root, "stats")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := OpenFileBeneath(root, "stats", os.O_WRONLY|os.O_APPEND, 0644); err == nil {
+		t.Fatalf("expected error opening a symlinked file")
+	}
+
+	// Nor a hard link to a file elsewhere
+	if err := os.Link(target, filepath.Join(root, "linked")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := OpenFileBeneath(root, "linked", os.O_WRONLY|os.O_TRUNC, 0644); err == nil {
+		t.Fatalf("expected error opening a hard linked file")
+	}
+
+	data, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(data) != "keep" {
+		t.Fatalf("file outside of the root was modified: %q", data)
+	}
+}
+
+func TestBeneath_OpenRegularFileAt(t *testing.T) {
+	root, err := ioutil.TempDir("", "nomadtest-beneath")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(root)
+	if err := ioutil.WriteFile(filepath.Join(root, "file"), []byte("data"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Link(filepath.Join(root, "file"), filepath.Join(root, "linked")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Symlink("file", filepath.Join(root, "symlink")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := unix.Mkfifo(filepath.Join(root, "fifo"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	dir, err := OpenDirBeneath(root, ".", false, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer dir.Close()
+
+	// Regular files are read, even if they're hard linked
+	for _, name := range []string{"file", "linked"} {
+		f, err := OpenRegularFileAt(dir, name)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil || string(data) != "data" {
+			t.Fatalf("expected to read %q, got %q: %v", name, data, err)
+		}
+	}
+
+	// Symlinks, FIFOs and directories fail without blocking
+	for _, name := range []string{"symlink", "fifo", "."} {
+		if f, err := OpenRegularFileAt(dir, name); err == nil {
+			f.Close()
+			t.Fatalf("expected an error opening %q", name)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+// +build !linux
+
+package allocdir
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// ChownTreeBeneath changes the owner of the directory at the relative path rel
+// within root and of everything within it without following symbolic links. A
+// missing directory is ignored.
+func ChownTreeBeneath(root, rel string, uid, gid int) error {
+	dir, err := OpenDirBeneath(root, rel, false, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	path := dir.Name()
+	dir.Close()
+	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
@@ -0,0 +1,70 @@
+package allocdir
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// ChownTreeBeneath changes the owner of the directory at the relative path rel
+// within root and of everything within it. Symbolic links aren't followed but
+// changed themselves, and files with several hard links are skipped, so a
+// task can't have the client change the owner of a file elsewhere. A missing
+// directory is ignored.
+func ChownTreeBeneath(root, rel string, uid, gid int) error {
+	dir, err := OpenDirBeneath(root, rel, false, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return chownTreeAt(dir, uid, gid)
+}
+
+// chownTreeAt changes the owner of the directory dir and of everything within
+// it like ChownTreeBeneath.
+func chownTreeAt(dir *os.File, uid, gid int) error {
+	if err := dir.Chown(uid, gid); err != nil {
+		return err
+	}
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+
+	fd := int(dir.Fd())
+	for _, name := range names {
+		path := filepath.Join(dir.Name(), name)
+		var st unix.Stat_t
+		if err := unix.Fstatat(fd, name, &st, unix.AT_SYMLINK_NOFOLLOW); err == unix.ENOENT {
+			continue
+		} else if err != nil {
+			return &os.PathError{Op: "stat", Path: path, Err: err}
+		}
+
+		switch st.Mode & unix.S_IFMT {
+		case unix.S_IFDIR:
+			subfd, err := openDirAt(fd, name)
+			if err != nil {
+				return &os.PathError{Op: "open", Path: path, Err: err}
+			}
+			sub := os.NewFile(uintptr(subfd), path)
+			err = chownTreeAt(sub, uid, gid)
+			sub.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		case unix.S_IFREG:
+			if st.Nlink > 1 {
+				continue
+			}
+		}
+		if err := unix.Fchownat(fd, name, uid, gid, unix.AT_SYMLINK_NOFOLLOW); err != nil && err != unix.ENOENT {
+			return &os.PathError{Op: "chown", Path: path, Err: err}
+		}
+	}
+	return nil
+}
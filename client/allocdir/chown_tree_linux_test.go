@@ -0,0 +1,72 @@
+package allocdir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestChownTreeBeneath(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Must be root to change the owner of files")
+	}
+	root, err := ioutil.TempDir("", "nomadtest-beneath")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "nomadtest-beneath")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	target := filepath.Join(outside, "target")
+	if err := ioutil.WriteFile(target, nil, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	local := filepath.Join(root, "local")
+	if err := os.MkdirAll(filepath.Join(local, "sub"), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(local, "sub", "file"), nil, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(local, "dir-link")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Link(target, filepath.Join(local, "hard-link")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	const id = 100000
+	if err := ChownTreeBeneath(root, "local", id, id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, path := range []string{local, filepath.Join(local, "sub"), filepath.Join(local, "sub", "file"), filepath.Join(local, "dir-link")} {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if uid := fi.Sys().(*syscall.Stat_t).Uid; uid != id {
+			t.Fatalf("expected %q to be owned by %d; got %d", path, id, uid)
+		}
+	}
+
+	// Neither the symlinked directory nor the hard linked file are changed
+	for _, path := range []string{outside, target} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if uid := fi.Sys().(*syscall.Stat_t).Uid; uid != 0 {
+			t.Fatalf("expected %q outside of the root to keep its owner; got %d", path, uid)
+		}
+	}
+
+	if err := ChownTreeBeneath(root, "missing", id, id); err != nil {
+		t.Fatalf("expected a missing directory to be ignored; got %v", err)
+	}
+}
@@ -0,0 +1,470 @@
+package allocdir
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// chrootBaseBuildPrefix prefixes the directories shared chroot bases are
+	// built in before they're renamed into place.
+	chrootBaseBuildPrefix = ".building-"
+
+	// chrootBaseLinkPrefix prefixes the symlinks that replace the current
+	// base of a key.
+	chrootBaseLinkPrefix = ".link-"
+
+	// chrootBaseSizeFile is the file in the root of a shared chroot base
+	// recording the size of the files embedded into it. It's never mounted
+	// into a chroot as only the base's destinations are.
+	chrootBaseSizeFile = ".size"
+
+	// chrootBaseSourceFile is the file in a task's mounts record dir
+	// recording which shared chroot base the task mounts.
+	chrootBaseSourceFile = "chroot-base-source"
+)
+
+var (
+	// chrootBaseLocks serializes building the shared chroot base of a key
+	// within the client so that it's only built once.
+	chrootBaseLocks     = make(map[string]*sync.Mutex)
+	chrootBaseLocksLock sync.Mutex
+
+	// chrootBasesLock is held for reading while a task picks and records
+	// the shared chroot base it mounts, and for writing while unused bases
+	// are removed so that a base isn't removed before it's recorded.
+	chrootBasesLock sync.RWMutex
+)
+
+// chrootBaseLock returns the lock of the shared chroot base at the path.
+func chrootBaseLock(path string) *sync.Mutex {
+	chrootBaseLocksLock.Lock()
+	defer chrootBaseLocksLock.Unlock()
+	l, ok := chrootBaseLocks[path]
+	if !ok {
+		l = &sync.Mutex{}
+		chrootBaseLocks[path] = l
+	}
+	return l
+}
+
+// chrootBaseKey returns the key of the shared chroot base of the entries.
+// Changing the entries changes the key so that a new base is built.
+func chrootBaseKey(entries map[string]string) string {
+	sources := make([]string, 0, len(entries))
+	for source := range entries {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	h := sha256.New()
+	for _, source := range sources {
+		fmt.Fprintf(h, "%s\x00%s\n", source, entries[source])
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// isTaskBuiltDir returns whether the top level directory of the relative path
+// is one the task dir is built with, which are writable by the task.
+func isTaskBuiltDir(rel string) bool {
+	top := strings.SplitN(rel, string(filepath.Separator), 2)[0]
+	_, ok := TaskDirs[top]
+	return ok || top == SharedAllocName || top == TaskLocal || top == TaskSecrets
+}
+
+// splitChrootEntries splits the entries into the ones shared through the
+// chroot base and the ones embedded into the writable directories of the
+// task. The destinations the base is mounted at are returned sorted, without
+// the ones within another.
+func splitChrootEntries(entries map[string]string) (shared, task map[string]string, dests []string) {
+	shared = make(map[string]string)
+	task = make(map[string]string)
+	var all []string
+	for source, dest := range entries {
+		rel := filepath.Clean(string(filepath.Separator) + dest)[1:]
+		switch {
+		case rel == "":
+			continue
+		case isTaskBuiltDir(rel):
+			task[source] = dest
+		default:
+			shared[source] = dest
+			all = append(all, rel)
+		}
+	}
+
+	sort.Strings(all)
+	for _, rel := range all {
+		if n := len(dests); n != 0 && (rel == dests[n-1] || strings.HasPrefix(rel, dests[n-1]+string(filepath.Separator))) {
+			continue
+		}
+		dests = append(dests, rel)
+	}
+	return shared, task, dests
+}
+
+// chrootBase returns the shared chroot base of the entries, building it if
+// it doesn't exist yet. Every base is built in a uniquely named directory,
+// and the key of the entries is a symlink to its current base that's only
+// replaced once a base is complete, so that a partially built base is never
+// used, even by another client sharing the directory. If stale files are
+// detected and the current base no longer matches the host, a new base is
+// built and the old one is kept for the tasks still mounting it. The size of
+// the base is checked against the task's limit as the base may have been
+// built by a task with another limit.
+func (t *TaskDir) chrootBase(ctx context.Context, entries map[string]string) (string, error) {
+	key := chrootBaseKey(entries)
+	current := filepath.Join(t.chrootBaseDir, key)
+	l := chrootBaseLock(current)
+	l.Lock()
+	defer l.Unlock()
+
+	if name, err := os.Readlink(current); err == nil {
+		base := filepath.Join(t.chrootBaseDir, name)
+		stale, err := t.chrootBaseStale(ctx, base, entries)
+		if err != nil {
+			return "", err
+		}
+		if !stale {
+			if err := t.checkChrootBaseSize(base); err != nil {
+				return "", err
+			}
+			return base, nil
+		}
+		t.logger.Printf("[DEBUG] client.alloc_dir: shared chroot base %q is stale", base)
+	}
+
+	if err := os.MkdirAll(t.chrootBaseDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create the chroot base dir %q: %v", t.chrootBaseDir, err)
+	}
+	build, err := ioutil.TempDir(t.chrootBaseDir, chrootBaseBuildPrefix+key+"-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create the chroot base %q: %v", current, err)
+	}
+	name := strings.TrimPrefix(filepath.Base(build), chrootBaseBuildPrefix)
+	base := filepath.Join(t.chrootBaseDir, name)
+
+	t.logger.Printf("[DEBUG] client.alloc_dir: building shared chroot base %q", base)
+	builder := &TaskDir{
+		Dir:                build,
+		chrootConcurrency:  t.chrootConcurrency,
+		chrootMaxBytes:     t.chrootMaxBytes,
+		chrootBuildTimeout: t.chrootBuildTimeout,
+		logger:             t.logger,
+	}
+	if err := builder.embedDirs(ctx, entries); err != nil {
+		if terr, ok := err.(*chrootTimeoutError); ok && terr.pendingCh != nil {
+			go func() {
+				<-terr.pendingCh
+				os.RemoveAll(build)
+			}()
+		} else {
+			os.RemoveAll(build)
+		}
+		return "", err
+	}
+	if err := writeChrootBaseSize(build); err != nil {
+		os.RemoveAll(build)
+		return "", err
+	}
+
+	if err := os.Rename(build, base); err != nil {
+		os.RemoveAll(build)
+		return "", fmt.Errorf("failed to create the chroot base %q: %v", base, err)
+	}
+	link := filepath.Join(t.chrootBaseDir, chrootBaseLinkPrefix+name)
+	if err := os.Symlink(name, link); err != nil {
+		os.RemoveAll(base)
+		return "", fmt.Errorf("failed to link the chroot base %q: %v", base, err)
+	}
+	if err := os.Rename(link, current); err != nil {
+		os.Remove(link)
+		os.RemoveAll(base)
+		return "", fmt.Errorf("failed to link the chroot base %q: %v", base, err)
+	}
+	return base, nil
+}
+
+// chrootBaseStale returns whether the shared chroot base no longer matches
+// the host files of its entries according to the stale check. Files added
+// on the host make the base stale as well.
+func (t *TaskDir) chrootBaseStale(ctx context.Context, base string, entries map[string]string) (bool, error) {
+	if t.chrootStaleCheck == ChrootStaleCheckNone {
+		return false, nil
+	}
+
+	for source, dest := range entries {
+		// Like when embedding, the entry itself is followed if it's a
+		// symlink but the files within it aren't
+		s, err := os.Stat(source)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return false, fmt.Errorf("Couldn't stat %v: %v", source, err)
+		}
+
+		stale, err := t.chrootBaseEntryStale(ctx, source, filepath.Join(base, dest), s)
+		if err != nil || stale {
+			return stale, err
+		}
+	}
+	return false, nil
+}
+
+// chrootBaseEntryStale returns whether the copy dest of the host file or
+// directory source in a shared chroot base is stale.
+func (t *TaskDir) chrootBaseEntryStale(ctx context.Context, source, dest string, s os.FileInfo) (bool, error) {
+	if ctx.Err() != nil {
+		return false, &chrootTimeoutError{timeout: t.chrootBuildTimeout}
+	}
+
+	d, err := os.Lstat(dest)
+	if os.IsNotExist(err) {
+		return s.IsDir() || s.Mode().IsRegular(), nil
+	} else if err != nil {
+		return false, fmt.Errorf("Couldn't stat %v: %v", dest, err)
+	}
+
+	switch {
+	case s.Mode().IsRegular():
+		return t.isStale(source, dest, d)
+	case !s.IsDir():
+		return false, nil
+	}
+
+	dirEntries, err := ioutil.ReadDir(source)
+	if err != nil {
+		return false, fmt.Errorf("Couldn't read directory %v: %v", source, err)
+	}
+	for _, entry := range dirEntries {
+		stale, err := t.chrootBaseEntryStale(ctx, filepath.Join(source, entry.Name()), filepath.Join(dest, entry.Name()), entry)
+		if err != nil || stale {
+			return stale, err
+		}
+	}
+	return false, nil
+}
+
+// writeChrootBaseSize records the size of the files embedded into the shared
+// chroot base.
+func writeChrootBaseSize(base string) error {
+	var size int64
+	err := filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(base, chrootBaseSizeFile), []byte(strconv.FormatInt(size, 10)), 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record the size of the chroot base %q: %v", base, err)
+	}
+	return nil
+}
+
+// checkChrootBaseSize returns an error if the shared chroot base exceeds the
+// task's chroot size limit.
+func (t *TaskDir) checkChrootBaseSize(base string) error {
+	if t.chrootMaxBytes <= 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(base, chrootBaseSizeFile))
+	if err != nil {
+		return fmt.Errorf("failed to read the size of the chroot base %q: %v", base, err)
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size of the chroot base %q: %v", base, err)
+	}
+	if size > t.chrootMaxBytes {
+		return &chrootSizeError{limit: t.chrootMaxBytes, source: base}
+	}
+	return nil
+}
+
+// mountChrootBase bind mounts the shared chroot base of the entries into the
+// chroot read-only, building the base first if needed. Entries within the
+// writable directories of the task are embedded into the task dir instead if
+// embedTask is set. Like host paths, every mount is recorded before it's made so that
+// UnmountAll tears it down, and paths that were mounted by a previous start
+// of the task are skipped unless they're from a base that has since been
+// replaced. Bases no task mounts anymore are removed afterwards.
+func (t *TaskDir) mountChrootBase(ctx context.Context, entries map[string]string, embedTask bool) error {
+	shared, task, dests := splitChrootEntries(entries)
+	if embedTask && len(task) != 0 {
+		if err := t.embedDirs(ctx, task); err != nil {
+			return err
+		}
+	}
+	if len(shared) == 0 {
+		return nil
+	}
+
+	base, err := t.useChrootBase(ctx, shared)
+	if err != nil {
+		return err
+	}
+	defer collectChrootBases(t.chrootBaseDir, base)
+
+	recorded, err := t.chrootBaseMounts()
+	if err != nil {
+		return err
+	}
+	mounted := make(map[string]struct{}, len(recorded))
+	for _, dest := range recorded {
+		mounted[dest] = struct{}{}
+	}
+
+	for _, rel := range dests {
+		dest := filepath.Join(t.Dir, rel)
+		if _, ok := mounted[dest]; ok {
+			continue
+		}
+
+		// Sources missing on the host aren't in the base
+		src := filepath.Join(base, rel)
+		info, err := os.Stat(src)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Couldn't stat %v: %v", src, err)
+		}
+		recorded = append(recorded, dest)
+		mounted[dest] = struct{}{}
+		if err := t.writeMounts(chrootBaseMountsFile, recorded); err != nil {
+			return err
+		}
+		if err := t.bindMount(src, rel, info.IsDir(), true); err != nil {
+			return fmt.Errorf("failed to mount the chroot base at %q: %v", rel, err)
+		}
+	}
+	return nil
+}
+
+// useChrootBase returns the shared chroot base of the entries and records
+// that the task mounts it. The mounts of a base the task mounted before are
+// torn down if it was since replaced.
+func (t *TaskDir) useChrootBase(ctx context.Context, entries map[string]string) (string, error) {
+	chrootBasesLock.RLock()
+	defer chrootBasesLock.RUnlock()
+
+	base, err := t.chrootBase(ctx, entries)
+	if err != nil {
+		return "", err
+	}
+
+	previous, err := t.readMounts(chrootBaseSourceFile)
+	if err != nil {
+		return "", err
+	}
+	if len(previous) != 0 && previous[0] != base {
+		if err := t.releaseChrootBase(); err != nil {
+			return "", err
+		}
+	}
+
+	// The base is recorded as mounted until all of its mounts are torn down
+	if err := t.writeMounts(chrootBaseSourceFile, []string{base}); err != nil {
+		return "", err
+	}
+	return base, nil
+}
+
+// chrootBaseMounts returns the paths the shared chroot base was bind mounted
+// at in the task dir.
+func (t *TaskDir) chrootBaseMounts() ([]string, error) {
+	return t.readMounts(chrootBaseMountsFile)
+}
+
+// unmountChrootBase unmounts the shared chroot base, most recent first, and
+// keeps the record of the mounts that failed. Once all of them are torn down
+// the base is no longer recorded as mounted by the task and retired bases
+// that aren't mounted anymore are removed.
+func (t *TaskDir) unmountChrootBase() error {
+	source, err := t.readMounts(chrootBaseSourceFile)
+	if err != nil {
+		return err
+	}
+	if err := t.releaseChrootBase(); err != nil {
+		return err
+	}
+	if len(source) != 0 {
+		collectChrootBases(filepath.Dir(source[0]), "")
+	}
+	return nil
+}
+
+// releaseChrootBase unmounts the shared chroot base and removes the record
+// of the task mounting it once all of its mounts are torn down.
+func (t *TaskDir) releaseChrootBase() error {
+	if err := t.unmountRecorded(chrootBaseMountsFile, "chroot base"); err != nil {
+		return err
+	}
+	return t.writeMounts(chrootBaseSourceFile, nil)
+}
+
+// collectChrootBases removes the shared chroot bases in the dir that no task
+// records as mounted, except for current. Without a current base, the
+// current bases of every key are kept for tasks to come and only replaced
+// bases are removed. Bases being built are left alone.
+func collectChrootBases(dir, current string) {
+	chrootBasesLock.Lock()
+	defer chrootBasesLock.Unlock()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	// Every task's record is in <mounts dir>/<alloc id>/<task>
+	used := map[string]struct{}{current: struct{}{}}
+	records, _ := filepath.Glob(filepath.Join(filepath.Dir(dir), mountsDirName, "*", "*", chrootBaseSourceFile))
+	for _, record := range records {
+		data, err := ioutil.ReadFile(record)
+		if err != nil {
+			// Keep every base if it's unknown which are in use
+			return
+		}
+		used[strings.TrimSpace(string(data))] = struct{}{}
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		name, err := os.Readlink(path)
+		if err != nil {
+			continue
+		}
+		if current == "" {
+			used[filepath.Join(dir, name)] = struct{}{}
+		} else if _, ok := used[filepath.Join(dir, name)]; !ok {
+			os.Remove(path)
+		}
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), chrootBaseBuildPrefix) {
+			continue
+		}
+		if _, ok := used[path]; !ok {
+			os.RemoveAll(path)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package allocdir
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestChrootBaseKey(t *testing.T) {
+	a := map[string]string{"/bin": "/bin", "/usr": "/usr"}
+	b := map[string]string{"/usr": "/usr", "/bin": "/bin"}
+	if chrootBaseKey(a) != chrootBaseKey(b) {
+		t.Fatalf("expected the key to be independent of the map order")
+	}
+
+	// Changing the sources or their destinations invalidates the base
+	for _, c := range []map[string]string{
+		{"/bin": "/bin"},
+		{"/bin": "/bin", "/usr": "/usr", "/etc": "/etc"},
+		{"/bin": "/bin", "/usr": "/opt/usr"},
+	} {
+		if chrootBaseKey(c) == chrootBaseKey(a) {
+			t.Fatalf("expected %v to have another key than %v", c, a)
+		}
+	}
+}
+
+func TestSplitChrootEntries(t *testing.T) {
+	entries := map[string]string{
+		"/bin":            "/bin",
+		"/usr":            "/usr",
+		"/opt/local":      "/usr/local",
+		"/run/resolvconf": "/run/resolvconf",
+		"/etc/skel":       "/local/skel",
+		"/srv/cache":      "tmp/cache",
+		"/root":           "/",
+	}
+	shared, task, dests := splitChrootEntries(entries)
+
+	expShared := map[string]string{
+		"/bin":            "/bin",
+		"/usr":            "/usr",
+		"/opt/local":      "/usr/local",
+		"/run/resolvconf": "/run/resolvconf",
+	}
+	if !reflect.DeepEqual(shared, expShared) {
+		t.Fatalf("shared: got %v; want %v", shared, expShared)
+	}
+	expTask := map[string]string{
+		"/etc/skel":  "/local/skel",
+		"/srv/cache": "tmp/cache",
+	}
+	if !reflect.DeepEqual(task, expTask) {
+		t.Fatalf("task: got %v; want %v", task, expTask)
+	}
+
+	// usr/local is within the mount of usr
+	expDests := []string{"bin", "run/resolvconf", "usr"}
+	if !reflect.DeepEqual(dests, expDests) {
+		t.Fatalf("dests: got %v; want %v", dests, expDests)
+	}
+}
+
+func TestTaskDir_ChrootBase_Concurrent(t *testing.T) {
+	host, err := ioutil.TempDir("", "AllocDirHost")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(host)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(filepath.Join(host, name), []byte(name), 0644); err != nil {
+			t.Fatalf("Couldn't create file in host dir %v: %v", host, err)
+		}
+	}
+
+	tmp, err := ioutil.TempDir("", "ChrootBase")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// Tasks starting concurrently share one complete base
+	entries := map[string]string{host: "/opt/data"}
+	const tasks = 8
+	bases := make([]string, tasks)
+	errs := make([]error, tasks)
+	var wg sync.WaitGroup
+	for i := 0; i < tasks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			td := &TaskDir{chrootBaseDir: tmp, logger: testLogger()}
+			bases[i], errs[i] = td.chrootBase(context.Background(), entries)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < tasks; i++ {
+		if errs[i] != nil {
+			t.Fatalf("chrootBase() failed: %v", errs[i])
+		}
+		if bases[i] != bases[0] {
+			t.Fatalf("expected a single base; got %q and %q", bases[0], bases[i])
+		}
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		out, err := ioutil.ReadFile(filepath.Join(bases[0], "opt", "data", name))
+		if err != nil {
+			t.Fatalf("Couldn't read base file: %v", err)
+		}
+		if string(out) != name {
+			t.Fatalf("base file %q has %q", name, out)
+		}
+	}
+
+	// Changing the entries builds another base
+	other := map[string]string{host: "/opt/other"}
+	td := &TaskDir{chrootBaseDir: tmp, logger: testLogger()}
+	base, err := td.chrootBase(context.Background(), other)
+	if err != nil {
+		t.Fatalf("chrootBase() failed: %v", err)
+	}
+	if base == bases[0] {
+		t.Fatalf("expected another base for changed entries")
+	}
+
+	// Nothing is left of the builds
+	files, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		t.Fatalf("Couldn't read base dir: %v", err)
+	}
+	var links int
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), chrootBaseBuildPrefix) || strings.HasPrefix(f.Name(), chrootBaseLinkPrefix) {
+			t.Fatalf("build dir %q left behind", f.Name())
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			links++
+		}
+	}
+
+	// Every base is linked from its key
+	if len(files) != 4 || links != 2 {
+		t.Fatalf("expected 2 linked bases; got %d entries", len(files))
+	}
+}
@@ -0,0 +1,120 @@
+package allocdir
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+const (
+	// ChrootErrPermission is the category of chroot build failures caused by
+	// missing permissions or read-only file systems.
+	ChrootErrPermission = "permission_denied"
+
+	// ChrootErrDiskFull is the category of chroot build failures caused by
+	// the task directory's file system running out of space.
+	ChrootErrDiskFull = "disk_full"
+
+	// ChrootErrSourceMissing is the category of chroot build failures caused
+	// by a chroot_env source disappearing or not resolving.
+	ChrootErrSourceMissing = "source_missing"
+
+	// ChrootErrSizeLimit is the category of chroot build failures caused by
+	// the chroot exceeding its size limit.
+	ChrootErrSizeLimit = "size_limit"
+
+	// ChrootErrTimeout is the category of chroot build failures caused by
+	// building the chroot exceeding its timeout.
+	ChrootErrTimeout = "timeout"
+
+	// ChrootErrUnknown is the category of all other chroot build failures.
+	ChrootErrUnknown = "unknown"
+)
+
+// chrootErrnoCategories maps the errors that are recognized in the messages
+// of chroot build failures to their category. The errors are matched by
+// message as most are wrapped in formatted errors.
+var chrootErrnoCategories = []struct {
+	errno    syscall.Errno
+	category string
+}{
+	{syscall.EACCES, ChrootErrPermission},
+	{syscall.EPERM, ChrootErrPermission},
+	{syscall.EROFS, ChrootErrPermission},
+	{syscall.ENOSPC, ChrootErrDiskFull},
+	{syscall.EDQUOT, ChrootErrDiskFull},
+	{syscall.ENOENT, ChrootErrSourceMissing},
+	{syscall.ENOTDIR, ChrootErrSourceMissing},
+}
+
+// ChrootBuildError is returned if building a task's chroot fails. It
+// categorizes the failure and includes a hint at how to remedy it.
+type ChrootBuildError struct {
+	// Category is the category of the failure, one of the ChrootErr
+	// constants
+	Category string
+
+	// Hint explains how an operator can remedy the failure, if known
+	Hint string
+
+	// Err is the underlying error
+	Err error
+}
+
+func (e *ChrootBuildError) Error() string {
+	if e.Hint == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v (%s)", e.Err, e.Hint)
+}
+
+// newChrootBuildError categorizes the failure to build the chroot of the
+// task directory at dir.
+func newChrootBuildError(dir string, err error) *ChrootBuildError {
+	category := chrootErrorCategory(err)
+	return &ChrootBuildError{
+		Category: category,
+		Hint:     chrootErrorHint(category, dir),
+		Err:      err,
+	}
+}
+
+// chrootErrorCategory returns the category of the chroot build failure.
+func chrootErrorCategory(err error) string {
+	if _, ok := err.(*chrootSizeError); ok {
+		return ChrootErrSizeLimit
+	}
+	if _, ok := err.(*chrootTimeoutError); ok {
+		return ChrootErrTimeout
+	}
+
+	msg := err.Error()
+	for _, c := range chrootErrnoCategories {
+		if errno, ok := err.(syscall.Errno); ok && errno == c.errno {
+			return c.category
+		}
+		if strings.HasSuffix(msg, c.errno.Error()) {
+			return c.category
+		}
+	}
+	return ChrootErrUnknown
+}
+
+// chrootErrorHint returns how to remedy a chroot build failure of the
+// category for the task directory at dir.
+func chrootErrorHint(category, dir string) string {
+	switch category {
+	case ChrootErrPermission:
+		return fmt.Sprintf("permission denied in %s: run the client as root and check the data_dir isn't on a read-only file system", dir)
+	case ChrootErrDiskFull:
+		return fmt.Sprintf("disk full on %s: free space or lower the chroot size by trimming chroot_env", dir)
+	case ChrootErrSourceMissing:
+		return "source missing: check that the chroot_env sources and the targets of their symlinks exist on the host"
+	case ChrootErrSizeLimit:
+		return "raise chroot.max_total_mb or the task's chroot_max_total_mb, or trim chroot_env"
+	case ChrootErrTimeout:
+		return "check the chroot_env sources for slow or hung file systems such as network mounts, or raise chroot.build_timeout"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,45 @@
+package allocdir
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestChrootBuildError_Category(t *testing.T) {
+	cases := []struct {
+		err      error
+		category string
+	}{
+		{fmt.Errorf("Couldn't create destination directory /a/bin: mkdir /a/bin: %v", syscall.EACCES), ChrootErrPermission},
+		{fmt.Errorf("Couldn't create destination directory /a/bin: mkdir /a/bin: %v", syscall.EROFS), ChrootErrPermission},
+		{fmt.Errorf("Couldn't copy /bin/ls to /a/bin/ls: write /a/bin/ls: %v", syscall.ENOSPC), ChrootErrDiskFull},
+		{fmt.Errorf("Couldn't resolve symlink for /lib/x: lstat /lib/y: %v", syscall.ENOENT), ChrootErrSourceMissing},
+		{syscall.EDQUOT, ChrootErrDiskFull},
+		{&chrootSizeError{limit: 1024 * 1024, source: "/usr"}, ChrootErrSizeLimit},
+		{fmt.Errorf("Couldn't embed /bin: it resolves outside of the chroot"), ChrootErrUnknown},
+	}
+
+	for _, c := range cases {
+		err := newChrootBuildError("/var/nomad/alloc/1/web", c.err)
+		if err.Category != c.category {
+			t.Errorf("category of %q = %q; want %q", c.err, err.Category, c.category)
+		}
+		if err.Err != c.err {
+			t.Errorf("underlying error of %q = %v", c.err, err.Err)
+		}
+		if c.category == ChrootErrUnknown {
+			if err.Hint != "" || err.Error() != c.err.Error() {
+				t.Errorf("unknown error %q got hint %q", c.err, err.Hint)
+			}
+		} else if err.Hint == "" || !strings.HasSuffix(err.Error(), "("+err.Hint+")") {
+			t.Errorf("error %q is missing a hint: %v", c.err, err)
+		}
+	}
+
+	hint := chrootErrorHint(ChrootErrDiskFull, "/var/nomad")
+	if !strings.HasPrefix(hint, "disk full on /var/nomad") {
+		t.Fatalf("unexpected disk full hint %q", hint)
+	}
+}
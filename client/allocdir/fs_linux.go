@@ -40,6 +40,17 @@ func unlinkDir(dir string) error {
 	return nil
 }
 
+// detachDir lazily unmounts a directory that is busy so that it's unmounted
+// once it isn't in use anymore. If the dir isn't mounted no error is returned.
+func detachDir(dir string) error {
+	if err := syscall.Unmount(dir, syscall.MNT_DETACH); err != nil {
+		if err != syscall.EINVAL && err != syscall.ENOENT {
+			return err
+		}
+	}
+	return nil
+}
+
 // createSecretDir creates the secrets dir folder at the given path using a
 // tmpfs
 func createSecretDir(dir string) error {
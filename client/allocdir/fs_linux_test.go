@@ -10,6 +10,8 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/hashicorp/go-multierror"
+	cstructs "github.com/hashicorp/nomad/client/structs"
 	"golang.org/x/sys/unix"
 )
 
@@ -165,3 +167,86 @@ func TestLinuxUnprivilegedSecretDir(t *testing.T) {
 		t.Fatalf("error removing nonexistent secrets dir %q: %v", secretsDir, err)
 	}
 }
+
+// TestLinuxUnmountPolicy asserts busy mounts of task dirs are reported and
+// handled according to the unmount policy.
+func TestLinuxUnmountPolicy(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+
+	// busyAllocDir returns an alloc dir with a task whose shared alloc dir
+	// mount is kept busy by a mount within it
+	busyAllocDir := func() (*AllocDir, *TaskDir) {
+		tmp, err := ioutil.TempDir("", "nomadtest-unmount")
+		if err != nil {
+			t.Fatalf("unable to create tempdir for test: %v", err)
+		}
+		d := NewAllocDir(testLogger(), tmp)
+		td := d.NewTaskDir("web")
+		if err := d.Build(); err != nil {
+			t.Fatalf("Build() failed: %v", err)
+		}
+		if err := td.Build(false, nil, cstructs.FSIsolationChroot); err != nil {
+			t.Fatalf("TaskDir.Build failed: %v", err)
+		}
+		busy := filepath.Join(td.SharedTaskDir, "busy")
+		if err := os.Mkdir(busy, 0777); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := unix.Mount("tmpfs", busy, "tmpfs", 0, ""); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return d, td
+	}
+
+	// Mounts still failing after the retries are reported
+	{
+		d, td := busyAllocDir()
+		busy := filepath.Join(td.SharedTaskDir, "busy")
+		if err := d.SetUnmountPolicy(1, UnmountFailureKeep); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		err := d.UnmountAll()
+		merr, ok := err.(*multierror.Error)
+		if !ok || len(merr.Errors) != 1 {
+			t.Fatalf("expected one error, got: %v", err)
+		}
+		if uerr, ok := merr.Errors[0].(*UnmountError); !ok || uerr.Task != "web" {
+			t.Fatalf("expected an unmount error of the task, got: %#v", merr.Errors[0])
+		}
+
+		// The alloc dir is kept
+		if err := d.Destroy(); err == nil {
+			t.Fatalf("expected an error destroying the alloc dir")
+		}
+		if !pathExists(d.AllocDir) {
+			t.Fatalf("expected the alloc dir to be kept")
+		}
+
+		unix.Unmount(busy, 0)
+		if err := d.Destroy(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Busy mounts are detached
+	{
+		d, _ := busyAllocDir()
+		if err := d.SetUnmountPolicy(0, UnmountFailureDetach); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := d.Destroy(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if pathExists(d.AllocDir) {
+			t.Fatalf("expected the alloc dir to be removed")
+		}
+	}
+
+	d := NewAllocDir(testLogger(), "foo")
+	if err := d.SetUnmountPolicy(0, "foo"); err == nil {
+		t.Fatalf("expected an error for an unknown policy")
+	}
+}
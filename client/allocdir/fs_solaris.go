@@ -15,6 +15,11 @@ func unlinkDir(dir string) error {
 	return syscall.Unlink(dir)
 }
 
+// detachDir is a noop as directories are linked rather than mounted.
+func detachDir(dir string) error {
+	return nil
+}
+
 // createSecretDir creates the secrets dir folder at the given path
 func createSecretDir(dir string) error {
 	// TODO solaris has support for tmpfs so use that
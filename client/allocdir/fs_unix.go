@@ -3,6 +3,7 @@
 package allocdir
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/user"
@@ -83,7 +84,7 @@ func getGid(u *user.User) (int, error) {
 
 // linkOrCopy attempts to hardlink dst to src and fallsback to copying if the
 // hardlink fails.
-func linkOrCopy(src, dst string, uid, gid int, perm os.FileMode) error {
+func linkOrCopy(ctx context.Context, src, dst string, uid, gid int, perm os.FileMode) error {
 	// Avoid link/copy if the file already exists in the chroot
 	// TODO 0.6 clean this up. This was needed because chroot creation fails
 	// when a process restarts.
@@ -95,7 +96,7 @@ func linkOrCopy(src, dst string, uid, gid int, perm os.FileMode) error {
 		return nil
 	}
 
-	return fileCopy(src, dst, uid, gid, perm)
+	return fileCopy(ctx, src, dst, uid, gid, perm)
 }
 
 func getOwner(fi os.FileInfo) (int, int) {
@@ -1,6 +1,7 @@
 package allocdir
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 )
@@ -20,8 +21,8 @@ var (
 )
 
 // linkOrCopy is always copies dst to src on Windows.
-func linkOrCopy(src, dst string, uid, gid int, perm os.FileMode) error {
-	return fileCopy(src, dst, uid, gid, perm)
+func linkOrCopy(ctx context.Context, src, dst string, uid, gid int, perm os.FileMode) error {
+	return fileCopy(ctx, src, dst, uid, gid, perm)
 }
 
 // The windows version does nothing currently.
@@ -34,6 +35,11 @@ func unlinkDir(dir string) error {
 	return nil
 }
 
+// The windows version does nothing currently.
+func detachDir(dir string) error {
+	return nil
+}
+
 // createSecretDir creates the secrets dir folder at the given path
 func createSecretDir(dir string) error {
 	return os.MkdirAll(dir, 0777)
@@ -1,12 +1,22 @@
 package allocdir
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/go-multierror"
 	cstructs "github.com/hashicorp/nomad/client/structs"
 )
 
@@ -37,6 +47,31 @@ type TaskDir struct {
 	// <task_dir>/secrets/
 	SecretsDir string
 
+	// chrootConcurrency is the number of files embedded in parallel when
+	// building the chroot.
+	chrootConcurrency int
+
+	// chrootStaleCheck is the method used to detect chroot files that are
+	// out of date with the host.
+	chrootStaleCheck string
+
+	// chrootMaxBytes is the limit of the total size of the files embedded
+	// in the chroot. Zero means unlimited.
+	chrootMaxBytes int64
+
+	// chrootBuildTimeout is how long embedding the files of the chroot may
+	// take. Zero means unlimited.
+	chrootBuildTimeout time.Duration
+
+	// chrootBaseDir is the directory holding the shared chroot bases that
+	// are bind mounted into the chroot instead of embedding the entries.
+	// Empty embeds the entries into every chroot.
+	chrootBaseDir string
+
+	// mountPropagation is the propagation of the bind mounts into the
+	// chroot. Empty means private.
+	mountPropagation string
+
 	logger *log.Logger
 }
 
@@ -65,6 +100,219 @@ func (t *TaskDir) Copy() *TaskDir {
 	return &tcopy
 }
 
+// SetChrootConcurrency sets the number of files that are linked or copied in
+// parallel when building the chroot. Values less than one embed serially.
+func (t *TaskDir) SetChrootConcurrency(n int) {
+	t.chrootConcurrency = n
+}
+
+// SetChrootMaxTotalMB limits the total size of the files embedded when building
+// the chroot. Building the chroot fails and the partially built chroot is
+// removed once the limit is exceeded. Zero means unlimited.
+func (t *TaskDir) SetChrootMaxTotalMB(mb int) {
+	t.chrootMaxBytes = int64(mb) * 1024 * 1024
+}
+
+// SetChrootBuildTimeout limits how long embedding the files of the chroot may
+// take, such as when a source is on a hung network file system. Building the
+// chroot fails and the partially built chroot is removed once it times out.
+// Zero means unlimited.
+func (t *TaskDir) SetChrootBuildTimeout(timeout time.Duration) {
+	t.chrootBuildTimeout = timeout
+}
+
+// SetChrootBaseDir makes the chroot entries be embedded once into a shared
+// read-only base within the directory, which is then bind mounted into every
+// chroot built with the same entries. Empty embeds the entries into every
+// chroot.
+func (t *TaskDir) SetChrootBaseDir(dir string) {
+	t.chrootBaseDir = dir
+}
+
+// SetChrootStaleCheck sets the method used to detect files in the chroot that
+// no longer match the host. Stale files are refreshed when the chroot is
+// built, even if it was created before.
+func (t *TaskDir) SetChrootStaleCheck(method string) error {
+	switch method {
+	case ChrootStaleCheckNone, ChrootStaleCheckMtime, ChrootStaleCheckHash:
+		t.chrootStaleCheck = method
+		return nil
+	default:
+		return fmt.Errorf("unknown chroot stale check %q", method)
+	}
+}
+
+// SetMountPropagation sets the propagation of the bind mounts into the chroot
+// to one of private, slave or shared. It applies to mounts made afterwards.
+func (t *TaskDir) SetMountPropagation(propagation string) error {
+	switch propagation {
+	case MountPropagationPrivate, MountPropagationSlave, MountPropagationShared:
+		t.mountPropagation = propagation
+		return nil
+	default:
+		return fmt.Errorf("unknown mount propagation %q", propagation)
+	}
+}
+
+// BindMount is a host path bind mounted into the chroot of a task.
+type BindMount struct {
+	// HostPath is the absolute path of the file or directory on the host
+	HostPath string
+
+	// TaskPath is the absolute path within the chroot it's mounted at
+	TaskPath string
+
+	// ReadOnly mounts it read-only
+	ReadOnly bool
+
+	// Device requires HostPath to be a device node within /dev, which is
+	// resolved without following symbolic links
+	Device bool
+}
+
+// MountHostPaths bind mounts the host paths into the chroot. Every mount is
+// recorded outside of the task dir before it's made so that UnmountAll tears
+// it down even if the task or the client was killed since. Paths that were
+// mounted by a previous start of the task are skipped.
+func (t *TaskDir) MountHostPaths(mounts []*BindMount) error {
+	recorded, err := t.bindMounts()
+	if err != nil {
+		return err
+	}
+	mounted := make(map[string]struct{}, len(recorded))
+	for _, dest := range recorded {
+		mounted[dest] = struct{}{}
+	}
+
+	for _, m := range mounts {
+		rel := strings.TrimPrefix(filepath.Clean(m.TaskPath), "/")
+		dest := filepath.Join(t.Dir, rel)
+		if _, ok := mounted[dest]; ok {
+			continue
+		}
+
+		dir := false
+		if !m.Device {
+			info, err := os.Stat(m.HostPath)
+			if err != nil {
+				return fmt.Errorf("host path %q can't be mounted into the chroot: %v", m.HostPath, err)
+			}
+			dir = info.IsDir()
+		}
+
+		recorded = append(recorded, dest)
+		mounted[dest] = struct{}{}
+		if err := t.writeBindMounts(recorded); err != nil {
+			return err
+		}
+		if m.Device {
+			err = t.bindMountDevice(m.HostPath, rel, m.ReadOnly)
+		} else {
+			err = t.bindMount(m.HostPath, rel, dir, m.ReadOnly)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to mount host path %q at %q: %v", m.HostPath, m.TaskPath, err)
+		}
+	}
+	return nil
+}
+
+// bindMounts returns the paths host paths were bind mounted at in the task
+// dir.
+func (t *TaskDir) bindMounts() ([]string, error) {
+	return t.readMounts(bindMountsFile)
+}
+
+// writeBindMounts records the paths host paths are bind mounted at, removing
+// the record if there are none.
+func (t *TaskDir) writeBindMounts(mounts []string) error {
+	return t.writeMounts(bindMountsFile, mounts)
+}
+
+// unmountBindMounts unmounts the host paths bind mounted into the chroot,
+// most recent first, and keeps the record of the ones that failed.
+func (t *TaskDir) unmountBindMounts() error {
+	return t.unmountRecorded(bindMountsFile, "host path")
+}
+
+// mountsRecordDir returns the directory the mounts of the task are recorded
+// in, <client alloc dir>/mounts/<alloc id>/<task>. It's outside of every
+// alloc dir so that tasks can't tamper with the records.
+func (t *TaskDir) mountsRecordDir() string {
+	allocDir := filepath.Dir(t.Dir)
+	return filepath.Join(filepath.Dir(allocDir), mountsDirName, filepath.Base(allocDir), filepath.Base(t.Dir))
+}
+
+// readMounts returns the mount points recorded in the file.
+func (t *TaskDir) readMounts(file string) ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(t.mountsRecordDir(), file))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read mounts record %q: %v", file, err)
+	}
+
+	var mounts []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			mounts = append(mounts, line)
+		}
+	}
+	return mounts, nil
+}
+
+// writeMounts records the mount points in the file, removing the file if
+// there are none.
+func (t *TaskDir) writeMounts(file string, mounts []string) error {
+	dir := t.mountsRecordDir()
+	path := filepath.Join(dir, file)
+	if len(mounts) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove mounts record %q: %v", file, err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create mounts record dir: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(strings.Join(mounts, "\n")+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to record mounts in %q: %v", file, err)
+	}
+	return nil
+}
+
+// unmountRecorded unmounts the mount points recorded in the file, most
+// recent first, and keeps the record of the ones that failed. The kind of
+// the mounts is used in errors.
+func (t *TaskDir) unmountRecorded(file, kind string) error {
+	mounts, err := t.readMounts(file)
+	if err != nil {
+		return err
+	}
+
+	var mErr multierror.Error
+	var remaining []string
+	for i := len(mounts) - 1; i >= 0; i-- {
+		// The mount points are within the task dir, which the task controls,
+		// so they're resolved beneath it
+		rel, err := filepath.Rel(t.Dir, mounts[i])
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("recorded %s mount %q is outside of the task dir", kind, mounts[i]))
+			remaining = append([]string{mounts[i]}, remaining...)
+			continue
+		}
+		if err := unmountBeneath(t.Dir, rel); err != nil {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("failed to unmount %s at %q: %v", kind, mounts[i], err))
+			remaining = append([]string{mounts[i]}, remaining...)
+		}
+	}
+	if err := t.writeMounts(file, remaining); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
+	}
+	return mErr.ErrorOrNil()
+}
+
 // Build default directories and permissions in a task directory. chrootCreated
 // allows skipping chroot creation if the caller knows it has already been
 // done.
@@ -110,6 +358,9 @@ func (t *TaskDir) Build(chrootCreated bool, chroot map[string]string, fsi cstruc
 			if err := linkDir(t.SharedAllocDir, t.SharedTaskDir); err != nil {
 				return fmt.Errorf("Failed to mount shared directory for task: %v", err)
 			}
+			if err := t.setMountPropagation(t.SharedTaskDir); err != nil {
+				return fmt.Errorf("Failed to set the propagation of the shared directory for task: %v", err)
+			}
 		}
 	}
 
@@ -137,26 +388,352 @@ func (t *TaskDir) Build(chrootCreated bool, chroot map[string]string, fsi cstruc
 // attempts hardlink and then defaults to copying. If the path exists on the
 // host and can't be embedded an error is returned. If chrootCreated is true
 // skip expensive embedding operations and only ephemeral operations (eg
-// mounting /dev) are done.
+// mounting /dev) are done. Errors are returned as a ChrootBuildError.
 func (t *TaskDir) buildChroot(chrootCreated bool, entries map[string]string) error {
-	if !chrootCreated {
+	ctx := context.Background()
+	if t.chrootBuildTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.chrootBuildTimeout)
+		defer cancel()
+	}
+
+	// Stale files can only be found by embedding again
+	embed := !chrootCreated || t.chrootStaleCheck != ChrootStaleCheckNone
+	if t.chrootBaseDir != "" {
+		// Mount the shared base, which is only built once
+		if err := t.mountChrootBase(ctx, entries, embed); err != nil {
+			return newChrootBuildError(t.Dir, err)
+		}
+	} else if embed {
 		// Link/copy chroot entries
-		if err := t.embedDirs(entries); err != nil {
-			return err
+		if err := t.embedDirs(ctx, entries); err != nil {
+			return newChrootBuildError(t.Dir, err)
 		}
 	}
 
 	// Mount special dirs
 	if err := t.mountSpecialDirs(); err != nil {
+		return newChrootBuildError(t.Dir, err)
+	}
+
+	return nil
+}
+
+// maxEmbedSymlinks is the number of symlinks EmbedPath follows before giving
+// up, matching the limit of Linux.
+const maxEmbedSymlinks = 40
+
+// EmbedPath embeds the host file at the absolute path into the chroot again,
+// replacing any existing copy. Symlinks along the path are recreated in the
+// chroot and followed so that a symlink flipped on the host since the chroot
+// was built is picked up. Only host files the chroot entries already embed at
+// the same path are embedded, so that the path can't add host files the
+// operator didn't put into the chroot.
+func (t *TaskDir) EmbedPath(path string, entries map[string]string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("path %q must be absolute", path)
+	}
+
+	hops := 0
+	resolved := string(filepath.Separator)
+	rest := splitPathComponents(path)
+	for len(rest) != 0 {
+		host := filepath.Join(resolved, rest[0])
+		rest = rest[1:]
+
+		fi, err := os.Lstat(host)
+		if err != nil {
+			return fmt.Errorf("Couldn't stat %v: %v", host, err)
+		}
+		if !embedAllowed(entries, host, fi.IsDir()) {
+			return fmt.Errorf("Couldn't embed %v: %v is not within the chroot_env", path, host)
+		}
+		dest := filepath.Join(t.Dir, host)
+		if err := t.checkInChroot(dest); err != nil {
+			return err
+		}
+
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			if hops++; hops > maxEmbedSymlinks {
+				return fmt.Errorf("Couldn't embed %v: too many levels of symbolic links", path)
+			}
+			target, err := os.Readlink(host)
+			if err != nil {
+				return fmt.Errorf("Couldn't resolve symlink for %v: %v", host, err)
+			}
+			if err := os.RemoveAll(dest); err != nil {
+				return fmt.Errorf("Couldn't remove %v: %v", dest, err)
+			}
+			if err := os.Symlink(target, dest); err != nil {
+				return fmt.Errorf("Couldn't create symlink: %v", err)
+			}
+
+			// Continue with the components of the target
+			if filepath.IsAbs(target) {
+				resolved = string(filepath.Separator)
+			}
+			rest = append(splitPathComponents(target), rest...)
+
+		case fi.IsDir():
+			if len(rest) == 0 {
+				return fmt.Errorf("Couldn't embed %v: it is a directory", path)
+			}
+			if dfi, err := os.Lstat(dest); err == nil && !dfi.IsDir() {
+				if err := os.Remove(dest); err != nil {
+					return fmt.Errorf("Couldn't remove %v: %v", dest, err)
+				}
+			}
+			if err := createDir(t.Dir, host); err != nil {
+				return fmt.Errorf("Couldn't create destination directory %v: %v", dest, err)
+			}
+			resolved = host
+
+		case fi.Mode().IsRegular() && len(rest) == 0:
+			if err := os.RemoveAll(dest); err != nil {
+				return fmt.Errorf("Couldn't remove %v: %v", dest, err)
+			}
+			uid, gid := getOwner(fi)
+			return linkOrCopy(context.Background(), host, dest, uid, gid, fi.Mode().Perm())
+
+		default:
+			return fmt.Errorf("Couldn't embed %v: %v is not a regular file", path, host)
+		}
+	}
+	return nil
+}
+
+// embedAllowed returns whether the host path is within a source of the chroot
+// entries that is embedded at the same path. Directories leading to such a
+// source are allowed too, as they're created in the chroot to embed it.
+func embedAllowed(entries map[string]string, host string, dir bool) bool {
+	for source, dest := range entries {
+		source = filepath.Clean(source)
+		if source != filepath.Clean(dest) {
+			continue
+		}
+		if pathWithin(host, source) || dir && pathWithin(source, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathWithin returns whether the absolute path is dir or within it.
+func pathWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkInChroot returns an error if the parent directory of dest resolves to
+// a path outside the task directory, such as through a stale symlink in the
+// chroot, so that host files are never replaced.
+func (t *TaskDir) checkInChroot(dest string) error {
+	parent, err := filepath.EvalSymlinks(filepath.Dir(dest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	root, err := filepath.EvalSymlinks(t.Dir)
+	if err != nil {
+		return err
+	}
+	if parent != root && !strings.HasPrefix(parent, root+string(filepath.Separator)) {
+		return fmt.Errorf("Couldn't embed %v: it resolves outside of the chroot", dest)
+	}
+	return nil
+}
+
+// splitPathComponents splits the path into its non-empty components.
+func splitPathComponents(path string) []string {
+	var parts []string
+	for _, p := range strings.Split(filepath.Clean(path), string(filepath.Separator)) {
+		if p != "" && p != "." {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// chrootFile is a regular file to be linked or copied into the chroot.
+type chrootFile struct {
+	source string
+	dest   string
+	uid    int
+	gid    int
+	perm   os.FileMode
+}
+
+// chrootLink is a symlink to be created in the chroot.
+type chrootLink struct {
+	target string
+	dest   string
+}
+
+// chrootSizeError is returned if the files embedded in the chroot exceed its
+// size limit.
+type chrootSizeError struct {
+	limit  int64
+	source string
+}
+
+func (e *chrootSizeError) Error() string {
+	return fmt.Sprintf("chroot exceeds its limit of %d MB while embedding %v; check the chroot_env for overly broad entries",
+		e.limit/(1024*1024), e.source)
+}
+
+// chrootCancelGrace is how long embedding files waits for the copies in
+// progress to stop after building the chroot timed out.
+const chrootCancelGrace = time.Second
+
+// chrootTimeoutError is returned if embedding the files of the chroot exceeds
+// its timeout.
+type chrootTimeoutError struct {
+	timeout time.Duration
+
+	// pendingCh is closed once the walk or the copies in progress stopped,
+	// or nil if they already did. Walks and copies blocked on a hung file
+	// system can't be interrupted.
+	pendingCh <-chan struct{}
+}
+
+func (e *chrootTimeoutError) Error() string {
+	return fmt.Sprintf("building the chroot timed out after %v", e.timeout)
+}
+
+// chrootCleanups tracks the removals of partially built chroots that wait for
+// abandoned walks and copies to stop, keyed by the task directory.
+var chrootCleanups = struct {
+	sync.Mutex
+	m map[string]chan struct{}
+}{m: make(map[string]chan struct{})}
+
+// waitChrootCleanup waits for the removal of a partially built chroot in the
+// task directory to finish so that it can't remove the files embedded by a later build. An
+// error is returned if the context is done first.
+func (t *TaskDir) waitChrootCleanup(ctx context.Context) error {
+	chrootCleanups.Lock()
+	doneCh, ok := chrootCleanups.m[t.Dir]
+	chrootCleanups.Unlock()
+	if !ok {
+		return nil
+	}
+
+	t.logger.Printf("[DEBUG] client.alloc_dir: waiting for the removal of the partially built chroot %q", t.Dir)
+	select {
+	case <-doneCh:
+		return nil
+	case <-ctx.Done():
+		return &chrootTimeoutError{timeout: t.chrootBuildTimeout}
+	}
+}
+
+// removeEmbedsOnce removes the destinations of the entries once pendingCh is
+// closed. Building the chroot again waits for the removal.
+func (t *TaskDir) removeEmbedsOnce(pendingCh <-chan struct{}, entries map[string]string) {
+	doneCh := make(chan struct{})
+	chrootCleanups.Lock()
+	chrootCleanups.m[t.Dir] = doneCh
+	chrootCleanups.Unlock()
+
+	t.logger.Printf("[WARN] client.alloc_dir: removing partially built chroot %q once the copies in progress stop", t.Dir)
+	go func() {
+		<-pendingCh
+		t.removeEmbeds(entries)
+
+		chrootCleanups.Lock()
+		if chrootCleanups.m[t.Dir] == doneCh {
+			delete(chrootCleanups.m, t.Dir)
+		}
+		chrootCleanups.Unlock()
+		close(doneCh)
+	}()
+}
+
+// embedDirs embeds the entries into the chroot. Directories are created while
+// walking the sources, regular files are then embedded in parallel and
+// symlinks are created last so that their targets already exist. If the
+// chroot exceeds its size limit, nothing is embedded and the destinations of
+// the entries are removed again. Likewise, if the context is done before the
+// chroot is built, the destinations are removed once the walk and the copies
+// in progress stopped.
+func (t *TaskDir) embedDirs(ctx context.Context, entries map[string]string) error {
+	if err := t.waitChrootCleanup(ctx); err != nil {
+		return err
+	}
+
+	files, links, err := t.walkEmbeds(ctx, entries)
+	if err == nil {
+		err = t.embedFiles(ctx, files)
+	}
+	switch e := err.(type) {
+	case nil:
+	case *chrootSizeError:
+		t.removeEmbeds(entries)
+		return err
+	case *chrootTimeoutError:
+		if e.pendingCh == nil {
+			t.removeEmbeds(entries)
+			return err
+		}
+		t.removeEmbedsOnce(e.pendingCh, entries)
+		return err
+	default:
 		return err
 	}
 
+	for _, l := range links {
+		if err := os.Symlink(l.target, l.dest); err != nil {
+			// Symlinking twice
+			if err.(*os.LinkError).Err.Error() != "file exists" {
+				return fmt.Errorf("Couldn't create symlink: %v", err)
+			}
+		}
+	}
+
 	return nil
 }
 
-func (t *TaskDir) embedDirs(entries map[string]string) error {
+// walkEmbeds collects the files and symlinks to embed for the entries until
+// the context is done. Stat'ing or reading the sources on a hung network file
+// system can't be interrupted, so the walk is abandoned rather than waited
+// for once it's done.
+func (t *TaskDir) walkEmbeds(ctx context.Context, entries map[string]string) ([]*chrootFile, []*chrootLink, error) {
+	var files []*chrootFile
+	var links []*chrootLink
+	var err error
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		var size int64
+		err = t.collectEmbeds(ctx, entries, &files, &links, &size)
+	}()
+
+	select {
+	case <-doneCh:
+		return files, links, err
+	case <-ctx.Done():
+	}
+
+	select {
+	case <-doneCh:
+		return nil, nil, &chrootTimeoutError{timeout: t.chrootBuildTimeout}
+	case <-time.After(chrootCancelGrace):
+		return nil, nil, &chrootTimeoutError{timeout: t.chrootBuildTimeout, pendingCh: doneCh}
+	}
+}
+
+// collectEmbeds creates the destination directories for the entries and
+// collects the files and symlinks that need to be embedded within them.
+func (t *TaskDir) collectEmbeds(ctx context.Context, entries map[string]string, files *[]*chrootFile, links *[]*chrootLink, size *int64) error {
 	subdirs := make(map[string]string)
 	for source, dest := range entries {
+		if ctx.Err() != nil {
+			return &chrootTimeoutError{timeout: t.chrootBuildTimeout}
+		}
+
 		// Check to see if directory exists on host.
 		s, err := os.Stat(source)
 		if os.IsNotExist(err) {
@@ -169,13 +746,18 @@ func (t *TaskDir) embedDirs(entries map[string]string) error {
 				return fmt.Errorf("Couldn't create destination directory %v: %v", dest, err)
 			}
 
-			// Copy the file.
-			taskEntry := filepath.Join(t.Dir, dest)
-			uid, gid := getOwner(s)
-			if err := linkOrCopy(source, taskEntry, uid, gid, s.Mode().Perm()); err != nil {
+			if err := t.addChrootSize(size, s.Size(), source); err != nil {
 				return err
 			}
 
+			uid, gid := getOwner(s)
+			*files = append(*files, &chrootFile{
+				source: source,
+				dest:   filepath.Join(t.Dir, dest),
+				uid:    uid,
+				gid:    gid,
+				perm:   s.Mode().Perm(),
+			})
 			continue
 		}
 
@@ -201,9 +783,11 @@ func (t *TaskDir) embedDirs(entries map[string]string) error {
 			}
 
 			// Check if entry exists. This can happen if restarting a failed
-			// task.
+			// task. Existing files are revisited if they may be stale.
 			if _, err := os.Lstat(taskEntry); err == nil {
-				continue
+				if !entry.Mode().IsRegular() || t.chrootStaleCheck == ChrootStaleCheckNone {
+					continue
+				}
 			}
 
 			if !entry.Mode().IsRegular() {
@@ -217,26 +801,215 @@ func (t *TaskDir) embedDirs(entries map[string]string) error {
 					return fmt.Errorf("Couldn't resolve symlink for %v: %v", source, err)
 				}
 
-				if err := os.Symlink(link, taskEntry); err != nil {
-					// Symlinking twice
-					if err.(*os.LinkError).Err.Error() != "file exists" {
-						return fmt.Errorf("Couldn't create symlink: %v", err)
-					}
-				}
+				*links = append(*links, &chrootLink{target: link, dest: taskEntry})
 				continue
 			}
 
-			uid, gid := getOwner(entry)
-			if err := linkOrCopy(hostEntry, taskEntry, uid, gid, entry.Mode().Perm()); err != nil {
+			if err := t.addChrootSize(size, entry.Size(), hostEntry); err != nil {
 				return err
 			}
+
+			uid, gid := getOwner(entry)
+			*files = append(*files, &chrootFile{
+				source: hostEntry,
+				dest:   taskEntry,
+				uid:    uid,
+				gid:    gid,
+				perm:   entry.Mode().Perm(),
+			})
 		}
 	}
 
-	// Recurse on self to copy subdirectories.
+	// Recurse on self to collect subdirectories.
 	if len(subdirs) != 0 {
-		return t.embedDirs(subdirs)
+		return t.collectEmbeds(ctx, subdirs, files, links, size)
 	}
 
 	return nil
 }
+
+// addChrootSize adds the size of the file at source to the total size of the
+// chroot and returns an error if the total exceeds the chroot's limit.
+func (t *TaskDir) addChrootSize(total *int64, size int64, source string) error {
+	*total += size
+	if t.chrootMaxBytes > 0 && *total > t.chrootMaxBytes {
+		return &chrootSizeError{limit: t.chrootMaxBytes, source: source}
+	}
+	return nil
+}
+
+// removeEmbeds removes the destinations of the chroot entries from the task
+// directory. The directories the task directory is built with are kept.
+func (t *TaskDir) removeEmbeds(entries map[string]string) {
+	for _, dest := range entries {
+		rel := filepath.Clean(string(filepath.Separator) + dest)
+		if rel == string(filepath.Separator) {
+			continue
+		}
+		if isTaskBuiltDir(rel[1:]) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(t.Dir, rel)); err != nil {
+			t.logger.Printf("[WARN] client.alloc_dir: failed to remove %q from chroot %q: %v", rel, t.Dir, err)
+		}
+	}
+}
+
+// embedFiles links or copies the files into the chroot using a bounded number
+// of workers. The first error encountered is returned. Once the context is
+// done, no more files are embedded and the copies in progress are abandoned.
+func (t *TaskDir) embedFiles(ctx context.Context, files []*chrootFile) error {
+	workers := t.chrootConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(files) {
+		workers = len(files)
+	}
+
+	var stale int64
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	doneCh := make(chan struct{})
+	fileCh := make(chan *chrootFile)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range fileCh {
+				if ctx.Err() != nil {
+					continue
+				}
+				refreshed, err := t.removeStale(f)
+				if refreshed {
+					atomic.AddInt64(&stale, 1)
+				}
+				if err == nil {
+					err = linkOrCopy(ctx, f.source, f.dest, f.uid, f.gid, f.perm)
+				}
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						close(doneCh)
+					})
+				}
+			}
+		}()
+	}
+
+OUTER:
+	for _, f := range files {
+		select {
+		case fileCh <- f:
+		case <-doneCh:
+			break OUTER
+		case <-ctx.Done():
+			break OUTER
+		}
+	}
+	close(fileCh)
+
+	waitCh := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(waitCh)
+	}()
+	select {
+	case <-waitCh:
+	case <-ctx.Done():
+		select {
+		case <-waitCh:
+			return &chrootTimeoutError{timeout: t.chrootBuildTimeout}
+		case <-time.After(chrootCancelGrace):
+			return &chrootTimeoutError{timeout: t.chrootBuildTimeout, pendingCh: waitCh}
+		}
+	}
+	if ctx.Err() != nil {
+		return &chrootTimeoutError{timeout: t.chrootBuildTimeout}
+	}
+
+	if stale > 0 {
+		metrics.IncrCounter([]string{"client", "allocs", "chroot_stale_files"}, float32(stale))
+		t.logger.Printf("[DEBUG] client.alloc_dir: refreshed %d stale files in chroot %q", stale, t.Dir)
+	}
+
+	return firstErr
+}
+
+// removeStale removes the chroot copy of the file if it no longer matches the
+// host so that it is embedded again. It returns whether the file was removed.
+func (t *TaskDir) removeStale(f *chrootFile) (bool, error) {
+	if t.chrootStaleCheck == ChrootStaleCheckNone {
+		return false, nil
+	}
+
+	dst, err := os.Lstat(f.dest)
+	if err != nil {
+		return false, nil
+	}
+	stale, err := t.isStale(f.source, f.dest, dst)
+	if err != nil || !stale {
+		return false, err
+	}
+
+	if err := os.Remove(f.dest); err != nil {
+		return false, fmt.Errorf("Couldn't remove stale chroot file %v: %v", f.dest, err)
+	}
+	return true, nil
+}
+
+// isStale returns whether the chroot copy dest of the host file source, with
+// the info dst, no longer matches the host according to the stale check.
+func (t *TaskDir) isStale(source, dest string, dst os.FileInfo) (bool, error) {
+	src, err := os.Stat(source)
+	if err != nil {
+		return false, fmt.Errorf("Couldn't stat %v: %v", source, err)
+	}
+
+	// Hardlinks to the host file are always up to date
+	if os.SameFile(src, dst) {
+		return false, nil
+	}
+
+	if src.Size() != dst.Size() {
+		return true, nil
+	}
+	switch t.chrootStaleCheck {
+	case ChrootStaleCheckMtime:
+		return !src.ModTime().Equal(dst.ModTime()), nil
+	case ChrootStaleCheckHash:
+		return contentsDiffer(source, dest)
+	}
+	return false, nil
+}
+
+// contentsDiffer returns whether the contents of the two files differ by
+// comparing their SHA-256 digests.
+func contentsDiffer(a, b string) (bool, error) {
+	hashA, err := hashFile(a)
+	if err != nil {
+		return false, err
+	}
+	hashB, err := hashFile(b)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(hashA, hashB), nil
+}
+
+// hashFile returns the SHA-256 digest of the file's contents.
+func hashFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't open %v: %v", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("Couldn't hash %v: %v", path, err)
+	}
+	return h.Sum(nil), nil
+}
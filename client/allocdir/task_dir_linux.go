@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/hashicorp/go-multierror"
+	"golang.org/x/sys/unix"
 )
 
 // mountSpecialDirs mounts the dev and proc file system from the host to the
@@ -49,6 +51,219 @@ func (t *TaskDir) mountSpecialDirs() error {
 	return nil
 }
 
+// setMountPropagation sets the propagation of the bind mount at dir. Private
+// is the default so that mounts made within the chroot don't leak to the
+// host.
+func (t *TaskDir) setMountPropagation(dir string) error {
+	var flag uintptr = syscall.MS_PRIVATE
+	switch t.mountPropagation {
+	case MountPropagationSlave:
+		flag = syscall.MS_SLAVE
+	case MountPropagationShared:
+		flag = syscall.MS_SHARED
+	}
+	if err := syscall.Mount("", dir, "", flag, ""); err != nil {
+		return os.NewSyscallError("mount", err)
+	}
+	return nil
+}
+
+// bindMount bind mounts the host file or directory at src to rel within the
+// task dir, creating rel if it doesn't exist. rel is resolved without
+// following symbolic links, so that a link in the chroot can't redirect the
+// mount onto a host path.
+func (t *TaskDir) bindMount(src, rel string, dir, readOnly bool) error {
+	if err := createBeneath(t.Dir, rel, dir); err != nil {
+		return err
+	}
+	target, err := openPathBeneath(t.Dir, rel)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	// Mounting onto the descriptor's link in /proc mounts onto the file it
+	// refers to rather than resolving rel again
+	if err := syscall.Mount(src, procFdPath(target), "", syscall.MS_BIND, ""); err != nil {
+		return os.NewSyscallError("mount", err)
+	}
+
+	// The descriptor refers to the covered file, so the mount is opened to
+	// change it
+	mounted, err := openPathBeneath(t.Dir, rel)
+	if err != nil {
+		return err
+	}
+	defer mounted.Close()
+
+	// Bind mounts can only be made read-only by remounting them
+	if readOnly {
+		if err := syscall.Mount("", procFdPath(mounted), "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			syscall.Unmount(procFdPath(mounted), 0)
+			return os.NewSyscallError("mount", err)
+		}
+	}
+	return t.setMountPropagation(procFdPath(mounted))
+}
+
+// createBeneath creates the directory, or the empty file if dir isn't set,
+// at rel within root and its parents if they don't exist, without following
+// symbolic links.
+func createBeneath(root, rel string, dir bool) error {
+	if dir {
+		f, err := OpenDirBeneath(root, rel, true, 0755)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	parent, err := OpenDirBeneath(root, filepath.Dir(rel), true, 0755)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	fd, err := unix.Openat(int(parent.Fd()), filepath.Base(rel), unix.O_RDONLY|unix.O_CREAT|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0644)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: filepath.Join(root, rel), Err: err}
+	}
+	return unix.Close(fd)
+}
+
+// bindMountDevice bind mounts the device node at path within /dev to rel
+// within the task dir. Unlike bindMount's source, path is resolved without
+// following symbolic links, so that a link in /dev can't expose another host
+// path to the task.
+func (t *TaskDir) bindMountDevice(path, rel string, readOnly bool) error {
+	dev, err := OpenDevice(path)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	return t.bindMount(procFdPath(dev), rel, false, readOnly)
+}
+
+// OpenDevice opens the character or block device node at path, which must be
+// within /dev, as a path descriptor without following symbolic links in any
+// of its components.
+func OpenDevice(path string) (*os.File, error) {
+	if filepath.Clean(path) != path || !strings.HasPrefix(path, "/dev/") {
+		return nil, fmt.Errorf("device %q must be a clean path within /dev", path)
+	}
+	f, err := openPathBeneath("/dev", strings.TrimPrefix(path, "/dev/"))
+	if err != nil {
+		return nil, err
+	}
+
+	var st unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	if typ := st.Mode & unix.S_IFMT; typ != unix.S_IFCHR && typ != unix.S_IFBLK {
+		f.Close()
+		return nil, fmt.Errorf("%q is not a device", path)
+	}
+	return f, nil
+}
+
+// openPathBeneath opens the file or directory at rel within root as a path
+// descriptor without following symbolic links, to be used as the target of a
+// mount through procFdPath.
+func openPathBeneath(root, rel string) (*os.File, error) {
+	parent, err := OpenDirBeneath(root, filepath.Dir(rel), false, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer parent.Close()
+
+	path := filepath.Join(root, rel)
+	fd, err := unix.Openat(int(parent.Fd()), filepath.Base(rel), unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	f := os.NewFile(uintptr(fd), path)
+
+	// O_PATH opens a symbolic link itself rather than failing
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		f.Close()
+		return nil, &os.PathError{Op: "open", Path: path, Err: unix.ELOOP}
+	}
+	return f, nil
+}
+
+// unmountBeneath unmounts the mount point at rel within root. Like bindMount,
+// rel is resolved without following symbolic links, so that a link swapped in
+// for the mount point or one of its parents can't get a host mount unmounted.
+// If rel doesn't exist or isn't a mount point no error is returned. Neither is
+// one if a parent was replaced by a link, as the mount was moved or detached
+// along with the directory it was in.
+func unmountBeneath(root, rel string) error {
+	parent, err := OpenDirBeneath(root, filepath.Dir(rel), false, 0)
+	if err != nil {
+		if os.IsNotExist(err) || isLinkErr(err) {
+			return nil
+		}
+		return err
+	}
+	defer parent.Close()
+
+	// Only the final component is looked up from the descriptor's link in
+	// /proc, and UMOUNT_NOFOLLOW refuses it if it's a link
+	path := filepath.Join(procFdPath(parent), filepath.Base(rel))
+	if err := unix.Unmount(path, unix.UMOUNT_NOFOLLOW); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return &os.PathError{Op: "unmount", Path: filepath.Join(root, rel), Err: err}
+	}
+	return nil
+}
+
+// isLinkErr returns whether the error is from refusing to follow a symbolic
+// link.
+func isLinkErr(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == unix.ELOOP || err == unix.ENOTDIR
+}
+
+// procFdPath returns the path of the file's descriptor in /proc, which refers
+// to the opened file regardless of changes to the path it was opened at.
+func procFdPath(f *os.File) string {
+	return fmt.Sprintf("/proc/self/fd/%d", f.Fd())
+}
+
+// MountTmpfsBeneath mounts a tmpfs of the size at rel within root, creating
+// rel if it doesn't exist. Like bindMount, rel is resolved without following
+// symbolic links. It's called by the executor within the task's mount
+// namespace, so the tmpfs is only visible to the task and is released along
+// with the namespace.
+func MountTmpfsBeneath(root, rel string, sizeMB int) error {
+	if err := createBeneath(root, rel, true); err != nil {
+		return err
+	}
+	target, err := openPathBeneath(root, rel)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	return tmpfsMount(procFdPath(target), sizeMB)
+}
+
+// tmpfsMount mounts a tmpfs of the size at the existing directory dst. Like
+// /tmp, it's writable by every user.
+func tmpfsMount(dst string, sizeMB int) error {
+	data := fmt.Sprintf("size=%dm,mode=1777", sizeMB)
+	if err := syscall.Mount("tmpfs", dst, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, data); err != nil {
+		return os.NewSyscallError("mount", err)
+	}
+	return nil
+}
+
 // unmountSpecialDirs unmounts the dev and proc file system from the chroot. No
 // error is returned if the directories do not exist or have already been
 // unmounted.
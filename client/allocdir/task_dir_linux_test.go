@@ -1,11 +1,15 @@
 package allocdir
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	cstructs "github.com/hashicorp/nomad/client/structs"
 	"golang.org/x/sys/unix"
 )
 
@@ -70,3 +74,655 @@ func TestLinuxSpecialDirs(t *testing.T) {
 		t.Fatalf("error re-unmounting special dirs in %q: %v", td.Dir, err)
 	}
 }
+
+// TestLinuxMountPropagation ensures the shared alloc dir is bind mounted into
+// the task dir with the configured propagation.
+func TestLinuxMountPropagation(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+
+	tmp, err := ioutil.TempDir("", "nomadtest-propagation")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(testLogger(), tmp)
+	defer d.Destroy()
+	td := d.NewTaskDir("test")
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+
+	if err := td.SetMountPropagation("foo"); err == nil {
+		t.Fatalf("expected an error for an unknown propagation")
+	}
+	if err := td.SetMountPropagation(MountPropagationShared); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := td.Build(false, nil, cstructs.FSIsolationChroot); err != nil {
+		t.Fatalf("TaskDir.Build failed: %v", err)
+	}
+
+	// The optional fields of the mount in /proc/self/mountinfo mark it as
+	// shared
+	mountinfo, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, line := range strings.Split(string(mountinfo), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 7 || fields[4] != td.SharedTaskDir {
+			continue
+		}
+		if !strings.HasPrefix(fields[6], "shared:") {
+			t.Fatalf("expected a shared mount, got: %q", line)
+		}
+		return
+	}
+	t.Fatalf("no mount found at %q", td.SharedTaskDir)
+}
+
+// countMounts returns the number of mounts at path.
+func countMounts(t *testing.T, path string) int {
+	mountinfo, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	n := 0
+	for _, line := range strings.Split(string(mountinfo), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 5 && fields[4] == path {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLinuxMountHostPaths(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+
+	host, err := ioutil.TempDir("", "nomadtest-hostpath")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(host)
+	hostFile := filepath.Join(host, "ca.pem")
+	if err := ioutil.WriteFile(hostFile, []byte("cert"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	tmp, err := ioutil.TempDir("", "nomadtest-bindmounts")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(testLogger(), tmp)
+	td := d.NewTaskDir("test")
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	if err := td.Build(false, nil, cstructs.FSIsolationChroot); err != nil {
+		t.Fatalf("TaskDir.Build failed: %v", err)
+	}
+
+	// Missing host paths fail before anything is mounted
+	missing := []*BindMount{{HostPath: filepath.Join(host, "missing"), TaskPath: "/data"}}
+	if err := td.MountHostPaths(missing); err == nil || !strings.Contains(err.Error(), "can't be mounted") {
+		t.Fatalf("expected an error for a missing host path, got: %v", err)
+	}
+
+	mounts := []*BindMount{
+		{HostPath: host, TaskPath: "/data"},
+		{HostPath: hostFile, TaskPath: "/etc/pki/ca.pem", ReadOnly: true},
+	}
+	if err := td.MountHostPaths(mounts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Mounting again, such as when the task restarts, doesn't stack mounts
+	if err := td.MountHostPaths(mounts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dataDir := filepath.Join(td.Dir, "data")
+	pkiFile := filepath.Join(td.Dir, "etc", "pki", "ca.pem")
+	if n := countMounts(t, dataDir); n != 1 {
+		t.Fatalf("expected one mount at %q, got %d", dataDir, n)
+	}
+
+	if data, err := ioutil.ReadFile(pkiFile); err != nil || string(data) != "cert" {
+		t.Fatalf("expected the host file in the chroot, got %q: %v", data, err)
+	}
+	if err := ioutil.WriteFile(pkiFile, []byte("changed"), 0644); err == nil {
+		t.Fatalf("expected the read-only mount to be read-only")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dataDir, "written"), []byte("task"), 0644); err != nil {
+		t.Fatalf("expected the mount to be writable: %v", err)
+	}
+
+	// The mounts are recorded outside of the task dir
+	if pathExists(filepath.Join(td.Dir, bindMountsFile)) {
+		t.Fatalf("expected no record in the task dir")
+	}
+	if recorded, err := td.bindMounts(); err != nil || len(recorded) != 2 {
+		t.Fatalf("expected two recorded mounts, got %v: %v", recorded, err)
+	}
+
+	// Symlinks in the chroot aren't followed to mount onto the host
+	outside, err := ioutil.TempDir("", "nomadtest-outside")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.Symlink(outside, filepath.Join(td.Dir, "link")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	linked := []*BindMount{{HostPath: host, TaskPath: "/link/data"}}
+	if err := td.MountHostPaths(linked); err == nil {
+		t.Fatalf("expected an error mounting through a symlink")
+	}
+	if n := countMounts(t, filepath.Join(outside, "data")); n != 0 || pathExists(filepath.Join(outside, "data")) {
+		t.Fatalf("expected nothing to be mounted outside of the chroot")
+	}
+
+	// An alloc dir restored after the client restarted tears down the
+	// recorded mounts
+	restored := NewAllocDir(testLogger(), tmp)
+	restored.NewTaskDir("test")
+	if err := restored.Destroy(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := countMounts(t, dataDir) + countMounts(t, pkiFile); n != 0 {
+		t.Fatalf("expected the mounts to be torn down, found %d", n)
+	}
+	if pathExists(tmp) {
+		t.Fatalf("expected the alloc dir to be removed")
+	}
+	if pathExists(restored.mountsRecordDir()) {
+		t.Fatalf("expected the mounts record to be removed")
+	}
+
+	// The host paths survive
+	if _, err := os.Stat(filepath.Join(host, "written")); err != nil {
+		t.Fatalf("expected the host dir to be kept: %v", err)
+	}
+	if data, err := ioutil.ReadFile(hostFile); err != nil || string(data) != "cert" {
+		t.Fatalf("expected the host file to be kept, got %q: %v", data, err)
+	}
+}
+
+// TestLinuxMountHostPaths_SwappedLink ensures tearing down the mounts doesn't
+// follow a symbolic link swapped in for the mount point's parent onto a host
+// mount.
+func TestLinuxMountHostPaths_SwappedLink(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+
+	host, err := ioutil.TempDir("", "nomadtest-hostpath")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(host)
+
+	// A mount on the host the task must not get unmounted
+	outside, err := ioutil.TempDir("", "nomadtest-outside")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	hostMount := filepath.Join(outside, "data")
+	if err := linkDir(host, hostMount); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer unlinkDir(hostMount)
+
+	tmp, err := ioutil.TempDir("", "nomadtest-bindmounts")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(testLogger(), tmp)
+	td := d.NewTaskDir("test")
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	if err := td.Build(false, nil, cstructs.FSIsolationChroot); err != nil {
+		t.Fatalf("TaskDir.Build failed: %v", err)
+	}
+	if err := td.MountHostPaths([]*BindMount{{HostPath: host, TaskPath: "/nested/data"}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Replace the mount point's parent with a link to the host mount's
+	nested := filepath.Join(td.Dir, "nested")
+	if err := unlinkDir(filepath.Join(nested, "data")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.RemoveAll(nested); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Symlink(outside, nested); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := td.unmountBindMounts(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := countMounts(t, hostMount); n != 1 {
+		t.Fatalf("expected the host mount to be kept, found %d", n)
+	}
+}
+
+// TestLinuxOpenDevice ensures devices are only opened within /dev without
+// following symbolic links.
+func TestLinuxOpenDevice(t *testing.T) {
+	f, err := OpenDevice("/dev/null")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	f.Close()
+
+	for _, path := range []string{"/tmp", "/dev", "/dev/../dev/null", "/dev/shm"} {
+		if f, err := OpenDevice(path); err == nil {
+			f.Close()
+			t.Fatalf("expected an error opening %q", path)
+		}
+	}
+
+	// /dev/stdin is a link to /proc/self/fd/0
+	if fi, err := os.Lstat("/dev/stdin"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Skip("/dev/stdin isn't a symbolic link")
+	}
+	if f, err := OpenDevice("/dev/stdin"); err == nil {
+		f.Close()
+		t.Fatalf("expected an error opening a symbolic link")
+	}
+}
+
+// TestLinuxMountHostPaths_Device ensures device nodes are mounted into the
+// chroot.
+func TestLinuxMountHostPaths_Device(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+
+	tmp, err := ioutil.TempDir("", "nomadtest-devices")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(testLogger(), tmp)
+	defer d.Destroy()
+	td := d.NewTaskDir("test")
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	if err := td.Build(false, nil, cstructs.FSIsolationChroot); err != nil {
+		t.Fatalf("TaskDir.Build failed: %v", err)
+	}
+
+	// Paths that aren't device nodes within /dev fail before anything is
+	// mounted
+	for i, path := range []string{"/etc/hostname", "/dev/shm"} {
+		mounts := []*BindMount{{HostPath: path, TaskPath: fmt.Sprintf("/test%d", i), Device: true}}
+		if err := td.MountHostPaths(mounts); err == nil {
+			t.Fatalf("expected an error mounting %q as a device", path)
+		}
+	}
+
+	mounts := []*BindMount{{HostPath: "/dev/null", TaskPath: "/test-null", Device: true}}
+	if err := td.MountHostPaths(mounts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var host, mounted unix.Stat_t
+	if err := unix.Stat("/dev/null", &host); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := unix.Lstat(filepath.Join(td.Dir, "test-null"), &mounted); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if mounted.Mode&unix.S_IFMT != unix.S_IFCHR || mounted.Rdev != host.Rdev {
+		t.Fatalf("expected the host's /dev/null in the chroot, got mode %o rdev %d", mounted.Mode, mounted.Rdev)
+	}
+}
+
+func TestLinuxMountTmpfsBeneath(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+
+	root, err := ioutil.TempDir("", "nomadtest-tmpfs")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "nomadtest-tmpfs")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(outside)
+
+	if err := MountTmpfsBeneath(root, "scratch", 8); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	scratch := filepath.Join(root, "scratch")
+	defer unix.Unmount(scratch, unix.MNT_DETACH)
+
+	var stat unix.Statfs_t
+	if err := unix.Statfs(scratch, &stat); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if size := uint64(stat.Blocks) * uint64(stat.Bsize); size != 8*1024*1024 {
+		t.Fatalf("expected a tmpfs of 8 MB, got %d bytes", size)
+	}
+	if err := ioutil.WriteFile(filepath.Join(scratch, "written"), []byte("task"), 0644); err != nil {
+		t.Fatalf("expected the tmpfs to be writable: %v", err)
+	}
+
+	// A symlink within the root isn't followed onto a host path
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := MountTmpfsBeneath(root, "link", 8); err == nil {
+		unix.Unmount(outside, unix.MNT_DETACH)
+		t.Fatalf("expected error mounting onto a symlink")
+	}
+	if n := countMounts(t, outside); n != 0 {
+		t.Fatalf("expected no mount at %q, found %d", outside, n)
+	}
+}
+
+func TestLinuxBuildChroot_Timeout(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+
+	// A source on another file system is copied rather than hardlinked
+	host, err := ioutil.TempDir("", "nomadtest-slowsource")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(host)
+	if err := tmpfsMount(host, 1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer unix.Unmount(host, unix.MNT_DETACH)
+
+	// The source is a FIFO fed slowly, like a file on a sluggish NFS mount
+	slow := filepath.Join(host, "slow")
+	if err := unix.Mkfifo(slow, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go func() {
+		f, err := os.OpenFile(slow, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(50 * time.Millisecond):
+				if _, err := f.Write([]byte("x")); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	tmp, err := ioutil.TempDir("", "nomadtest-chroottimeout")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(testLogger(), tmp)
+	defer d.Destroy()
+	td := d.NewTaskDir("test")
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	td.SetChrootBuildTimeout(300 * time.Millisecond)
+
+	start := time.Now()
+	err = td.Build(false, map[string]string{slow: "/opt/data/slow"}, cstructs.FSIsolationChroot)
+	cerr, ok := err.(*ChrootBuildError)
+	if !ok || cerr.Category != ChrootErrTimeout {
+		t.Fatalf("expected a timeout, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected building the chroot to time out promptly, took %v", elapsed)
+	}
+
+	// The partially copied file was removed
+	if _, err := os.Stat(filepath.Join(td.Dir, "opt", "data", "slow")); !os.IsNotExist(err) {
+		t.Fatalf("expected the partial copy to be removed: %v", err)
+	}
+}
+
+// TestLinuxTaskDir_SharedChrootBase asserts tasks share a read-only chroot
+// base that is replaced once the host changes.
+func TestLinuxTaskDir_SharedChrootBase(t *testing.T) {
+	if unix.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+
+	host, err := ioutil.TempDir("", "nomadtest-chrootbasehost")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(host)
+	const files = 20
+	for i := 0; i < files; i++ {
+		if err := ioutil.WriteFile(filepath.Join(host, fmt.Sprintf("file%d", i)), []byte("x"), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	chroot := map[string]string{host: "/opt/data"}
+
+	tmp, err := ioutil.TempDir("", "nomadtest-chrootbase")
+	if err != nil {
+		t.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	baseDir := filepath.Join(tmp, ChrootBaseDirName)
+
+	build := func(name string, maxMB int) (*AllocDir, *TaskDir, error) {
+		d := NewAllocDir(testLogger(), filepath.Join(tmp, name))
+		td := d.NewTaskDir("test")
+		if err := d.Build(); err != nil {
+			t.Fatalf("Build() failed: %v", err)
+		}
+		td.SetChrootBaseDir(baseDir)
+		td.SetChrootMaxTotalMB(maxMB)
+		if err := td.SetChrootStaleCheck(ChrootStaleCheckMtime); err != nil {
+			t.Fatalf("SetChrootStaleCheck() failed: %v", err)
+		}
+		return d, td, td.Build(false, chroot, cstructs.FSIsolationChroot)
+	}
+	bases := func() []string {
+		paths, err := filepath.Glob(filepath.Join(baseDir, "*", "opt"))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var bases []string
+		for _, path := range paths {
+			if info, err := os.Lstat(filepath.Dir(path)); err == nil && info.IsDir() {
+				bases = append(bases, filepath.Dir(path))
+			}
+		}
+		return bases
+	}
+	sameFile := func(a, b string) bool {
+		ai, err := os.Stat(a)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		bi, err := os.Stat(b)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return os.SameFile(ai, bi)
+	}
+
+	first, firstTd, err := build("first", 0)
+	if err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	defer first.Destroy()
+	second, td, err := build("second", 0)
+	if err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+
+	// Both tasks mount the files of the single base rather than embedding
+	// their own copies
+	names := bases()
+	if len(names) != 1 {
+		t.Fatalf("expected a single base, found %v", names)
+	}
+	base := names[0]
+	for _, dir := range []string{firstTd.Dir, td.Dir} {
+		if !sameFile(filepath.Join(dir, "opt", "data", "file0"), filepath.Join(base, "opt", "data", "file0")) {
+			t.Fatalf("expected %q to mount the shared base", dir)
+		}
+	}
+
+	// The base is complete and read-only
+	infos, err := ioutil.ReadDir(filepath.Join(td.Dir, "opt", "data"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(infos) != files {
+		t.Fatalf("expected %d files in the chroot, found %d", files, len(infos))
+	}
+	if err := ioutil.WriteFile(filepath.Join(td.Dir, "opt", "data", "new"), nil, 0644); err == nil {
+		t.Fatalf("expected the shared base to be read-only")
+	}
+
+	// Destroying the alloc unmounts the base but keeps it for other tasks
+	if err := second.Destroy(); err != nil {
+		t.Fatalf("Destroy() failed: %v", err)
+	}
+	if names := bases(); len(names) != 1 {
+		t.Fatalf("expected a single base, found %v", names)
+	}
+
+	// The file added on the host makes the base stale, so a new one is
+	// built while the old one is kept until the first task is done
+	if err := ioutil.WriteFile(filepath.Join(host, "large"), make([]byte, 2*1024*1024), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	third, td, err := build("third", 0)
+	if err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	defer third.Destroy()
+	if !pathExists(filepath.Join(td.Dir, "opt", "data", "large")) {
+		t.Fatalf("expected the new base to have the file added on the host")
+	}
+	if names := bases(); len(names) != 2 {
+		t.Fatalf("expected the new and the old base, found %v", names)
+	}
+	if err := first.Destroy(); err != nil {
+		t.Fatalf("Destroy() failed: %v", err)
+	}
+	if names := bases(); len(names) != 1 || names[0] == base {
+		t.Fatalf("expected only the new base, found %v", names)
+	}
+
+	// A task whose limit the existing base exceeds fails
+	limited, _, err := build("limited", 1)
+	defer limited.Destroy()
+	if berr, ok := err.(*ChrootBuildError); !ok || berr.Category != ChrootErrSizeLimit {
+		t.Fatalf("expected the size limit to be exceeded, got %v", err)
+	}
+}
+
+// BenchmarkTaskDir_BuildChroot compares building the chroot of a task by
+// embedding its entries with mounting a shared chroot base that's already
+// built, which is the startup latency the base saves every task after the
+// first.
+func BenchmarkTaskDir_BuildChroot(b *testing.B) {
+	if unix.Geteuid() != 0 {
+		b.Skip("Must be run as root")
+	}
+
+	// The host files are on another file system so that they're copied, as
+	// they are when the alloc dir isn't on the root file system
+	host, err := ioutil.TempDir("", "nomadtest-benchchroothost")
+	if err != nil {
+		b.Fatalf("unable to create tempdir for test: %v", err)
+	}
+	defer os.RemoveAll(host)
+	if err := tmpfsMount(host, 64); err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	defer unix.Unmount(host, unix.MNT_DETACH)
+	data := make([]byte, 16*1024)
+	for i := 0; i < 20; i++ {
+		dir := filepath.Join(host, fmt.Sprintf("dir%d", i))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+		for j := 0; j < 50; j++ {
+			if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", j)), data, 0644); err != nil {
+				b.Fatalf("err: %v", err)
+			}
+		}
+	}
+	chroot := map[string]string{host: "/opt/data"}
+
+	for _, shared := range []bool{false, true} {
+		name := "Cold"
+		if shared {
+			name = "SharedBase"
+		}
+		b.Run(name, func(b *testing.B) {
+			tmp, err := ioutil.TempDir("", "nomadtest-benchchroot")
+			if err != nil {
+				b.Fatalf("unable to create tempdir for test: %v", err)
+			}
+			defer os.RemoveAll(tmp)
+
+			build := func(i int) *AllocDir {
+				d := NewAllocDir(testLogger(), filepath.Join(tmp, fmt.Sprintf("alloc%d", i)))
+				td := d.NewTaskDir("test")
+				if err := d.Build(); err != nil {
+					b.Fatalf("Build() failed: %v", err)
+				}
+				if shared {
+					td.SetChrootBaseDir(filepath.Join(tmp, ChrootBaseDirName))
+				}
+				if err := td.Build(false, chroot, cstructs.FSIsolationChroot); err != nil {
+					b.Fatalf("Build() failed: %v", err)
+				}
+				return d
+			}
+
+			// The shared base is built by the first task
+			if shared {
+				defer build(-1).Destroy()
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				d := build(i)
+				b.StopTimer()
+				if err := d.Destroy(); err != nil {
+					b.Fatalf("Destroy() failed: %v", err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
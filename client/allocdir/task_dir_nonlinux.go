@@ -2,6 +2,11 @@
 
 package allocdir
 
+import (
+	"fmt"
+	"path/filepath"
+)
+
 // currently a noop on non-Linux platforms
 func (d *TaskDir) mountSpecialDirs() error {
 	return nil
@@ -11,3 +16,28 @@ func (d *TaskDir) mountSpecialDirs() error {
 func (d *TaskDir) unmountSpecialDirs() error {
 	return nil
 }
+
+// currently a noop on non-Linux platforms
+func (d *TaskDir) setMountPropagation(dir string) error {
+	return nil
+}
+
+// bindMount isn't supported as the chroot is only built on Linux.
+func (d *TaskDir) bindMount(src, rel string, dir, readOnly bool) error {
+	return fmt.Errorf("bind mounts are only supported on Linux")
+}
+
+// unmountBeneath unmounts the mount point at rel within root. If rel doesn't
+// exist or isn't a mount point no error is returned.
+func unmountBeneath(root, rel string) error {
+	path := filepath.Join(root, rel)
+	if !pathExists(path) {
+		return nil
+	}
+	return unlinkDir(path)
+}
+
+// bindMountDevice isn't supported as the chroot is only built on Linux.
+func (d *TaskDir) bindMountDevice(path, rel string, readOnly bool) error {
+	return fmt.Errorf("bind mounts are only supported on Linux")
+}
@@ -1,10 +1,13 @@
 package allocdir
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	cstructs "github.com/hashicorp/nomad/client/structs"
 )
@@ -26,7 +29,7 @@ func TestTaskDir_EmbedNonExistent(t *testing.T) {
 
 	fakeDir := "/foobarbaz"
 	mapping := map[string]string{fakeDir: fakeDir}
-	if err := td.embedDirs(mapping); err != nil {
+	if err := td.embedDirs(context.Background(), mapping); err != nil {
 		t.Fatalf("embedDirs(%v) should should skip %v since it does not exist", mapping, fakeDir)
 	}
 }
@@ -73,7 +76,7 @@ func TestTaskDir_EmbedDirs(t *testing.T) {
 	// Create mapping from host dir to task dir.
 	taskDest := "bin/test/"
 	mapping := map[string]string{host: taskDest}
-	if err := td.embedDirs(mapping); err != nil {
+	if err := td.embedDirs(context.Background(), mapping); err != nil {
 		t.Fatalf("embedDirs(%v) failed: %v", mapping, err)
 	}
 
@@ -85,6 +88,348 @@ func TestTaskDir_EmbedDirs(t *testing.T) {
 	}
 }
 
+// Test that rebuilding a chroot refreshes files replaced on the host.
+func TestTaskDir_EmbedDirs_Stale(t *testing.T) {
+	for _, method := range []string{ChrootStaleCheckMtime, ChrootStaleCheckHash} {
+		t.Run(method, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "AllocDir")
+			if err != nil {
+				t.Fatalf("Couldn't create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tmp)
+
+			d := NewAllocDir(testLogger(), tmp)
+			defer d.Destroy()
+			td := d.NewTaskDir(t1.Name)
+			if err := d.Build(); err != nil {
+				t.Fatalf("Build() failed: %v", err)
+			}
+			if err := td.SetChrootStaleCheck(method); err != nil {
+				t.Fatalf("SetChrootStaleCheck(%q) failed: %v", method, err)
+			}
+
+			host, err := ioutil.TempDir("", "AllocDirHost")
+			if err != nil {
+				t.Fatalf("Couldn't create temp dir: %v", err)
+			}
+			defer os.RemoveAll(host)
+
+			hostFile := filepath.Join(host, "foo")
+			if err := ioutil.WriteFile(hostFile, []byte("old"), 0777); err != nil {
+				t.Fatalf("Coudn't create file in host dir %v: %v", host, err)
+			}
+
+			taskDest := "bin/test/"
+			mapping := map[string]string{host: taskDest}
+			if err := td.embedDirs(context.Background(), mapping); err != nil {
+				t.Fatalf("embedDirs(%v) failed: %v", mapping, err)
+			}
+
+			// Replace the host file the way a package manager would
+			newFile := filepath.Join(host, ".foo.new")
+			if err := ioutil.WriteFile(newFile, []byte("new"), 0777); err != nil {
+				t.Fatalf("Coudn't create file in host dir %v: %v", host, err)
+			}
+			if err := os.Rename(newFile, hostFile); err != nil {
+				t.Fatalf("Couldn't replace host file: %v", err)
+			}
+			later := time.Now().Add(time.Hour)
+			if err := os.Chtimes(hostFile, later, later); err != nil {
+				t.Fatalf("Couldn't change host file times: %v", err)
+			}
+
+			if err := td.embedDirs(context.Background(), mapping); err != nil {
+				t.Fatalf("embedDirs(%v) failed: %v", mapping, err)
+			}
+
+			out, err := ioutil.ReadFile(filepath.Join(td.Dir, taskDest, "foo"))
+			if err != nil {
+				t.Fatalf("Couldn't read chroot file: %v", err)
+			}
+			if string(out) != "new" {
+				t.Fatalf("Chroot file not refreshed; got %q", out)
+			}
+		})
+	}
+
+	td := &TaskDir{}
+	if err := td.SetChrootStaleCheck("foo"); err == nil {
+		t.Fatalf("expected error for unknown stale check")
+	}
+}
+
+// Test that building a chroot larger than its limit fails and removes the
+// partially built chroot.
+func TestTaskDir_EmbedDirs_SizeLimit(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "AllocDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(testLogger(), tmp)
+	defer d.Destroy()
+	td := d.NewTaskDir(t1.Name)
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	td.SetChrootMaxTotalMB(1)
+
+	host, err := ioutil.TempDir("", "AllocDirHost")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(host)
+
+	// Two files that only exceed the limit together
+	data := make([]byte, 600*1024)
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(host, name), data, 0644); err != nil {
+			t.Fatalf("Coudn't create file in host dir %v: %v", host, err)
+		}
+	}
+
+	taskDest := "bin/test/"
+	mapping := map[string]string{host: taskDest}
+	err = td.embedDirs(context.Background(), mapping)
+	if _, ok := err.(*chrootSizeError); !ok {
+		t.Fatalf("embedDirs(%v) should fail with a size error; got %v", mapping, err)
+	}
+	if _, err := os.Stat(filepath.Join(td.Dir, taskDest)); !os.IsNotExist(err) {
+		t.Fatalf("partial chroot %v not removed: %v", taskDest, err)
+	}
+
+	// Raising the limit allows the chroot to be built
+	td.SetChrootMaxTotalMB(2)
+	if err := td.embedDirs(context.Background(), mapping); err != nil {
+		t.Fatalf("embedDirs(%v) failed: %v", mapping, err)
+	}
+}
+
+// Test that rebuilding a chroot waits for the removal of the partially built
+// chroot of an earlier build that timed out.
+func TestTaskDir_EmbedDirs_WaitsForCleanup(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "AllocDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(testLogger(), tmp)
+	defer d.Destroy()
+	td := d.NewTaskDir(t1.Name)
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+
+	host, err := ioutil.TempDir("", "AllocDirHost")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(host)
+	if err := ioutil.WriteFile(filepath.Join(host, "foo"), []byte{'a'}, 0777); err != nil {
+		t.Fatalf("Coudn't create file in host dir %v: %v", host, err)
+	}
+	mapping := map[string]string{host: "bin/test/"}
+	embedded := filepath.Join(td.Dir, "bin", "test", "foo")
+
+	// The earlier build is still waiting for an abandoned copy
+	pendingCh := make(chan struct{})
+	td.removeEmbedsOnce(pendingCh, mapping)
+
+	// A build with a timeout gives up waiting
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, ok := td.embedDirs(ctx, mapping).(*chrootTimeoutError); !ok {
+		t.Fatalf("expected a timeout")
+	}
+	if _, err := os.Stat(embedded); !os.IsNotExist(err) {
+		t.Fatalf("file embedded while the removal is pending: %v", err)
+	}
+
+	// Otherwise the build waits and its files aren't removed
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- td.embedDirs(context.Background(), mapping)
+	}()
+	select {
+	case err := <-errCh:
+		t.Fatalf("embedDirs returned while the removal is pending: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(pendingCh)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("embedDirs(%v) failed: %v", mapping, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("embedDirs didn't return once the removal finished")
+	}
+	if _, err := os.Stat(embedded); err != nil {
+		t.Fatalf("File %v not embedded: %v", embedded, err)
+	}
+}
+
+// Test that embedding a path again follows symlinks flipped on the host and
+// never writes through stale symlinks in the chroot.
+func TestTaskDir_EmbedPath(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "AllocDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(testLogger(), tmp)
+	defer d.Destroy()
+	td := d.NewTaskDir(t1.Name)
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+
+	host, err := ioutil.TempDir("", "AllocDirHost")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(host)
+
+	for _, v := range []string{"v1", "v2", "v3"} {
+		if err := os.MkdirAll(filepath.Join(host, v), 0755); err != nil {
+			t.Fatalf("Failed to make dir: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(host, v, "app"), []byte(v), 0755); err != nil {
+			t.Fatalf("Coudn't create file in host dir %v: %v", host, err)
+		}
+	}
+
+	current := filepath.Join(host, "current")
+	cmd := filepath.Join(current, "app")
+	entries := map[string]string{host: host}
+	for _, v := range []string{"v1", "v2"} {
+		os.Remove(current)
+		if err := os.Symlink(v, current); err != nil {
+			t.Fatalf("Couldn't create symlink: %v", err)
+		}
+		if err := td.EmbedPath(cmd, entries); err != nil {
+			t.Fatalf("EmbedPath(%v) failed: %v", cmd, err)
+		}
+		out, err := ioutil.ReadFile(filepath.Join(td.Dir, cmd))
+		if err != nil {
+			t.Fatalf("Couldn't read embedded command: %v", err)
+		}
+		if string(out) != v {
+			t.Fatalf("embedded command is %q; want %q", out, v)
+		}
+	}
+
+	// A stale symlink in the chroot pointing at the host is replaced rather
+	// than followed
+	stale := filepath.Join(td.Dir, host, "v3")
+	if err := os.Symlink(filepath.Join(host, "v1"), stale); err != nil {
+		t.Fatalf("Couldn't create symlink: %v", err)
+	}
+	if err := td.EmbedPath(filepath.Join(host, "v3", "app"), entries); err != nil {
+		t.Fatalf("EmbedPath failed: %v", err)
+	}
+	if fi, err := os.Lstat(stale); err != nil || !fi.IsDir() {
+		t.Fatalf("stale symlink %v not replaced by a directory: %v", stale, err)
+	}
+	if out, _ := ioutil.ReadFile(filepath.Join(host, "v1", "app")); string(out) != "v1" {
+		t.Fatalf("host file overwritten: %q", out)
+	}
+
+	// Host files outside the chroot entries aren't embedded, whether named
+	// directly or through a symlink
+	other, err := ioutil.TempDir("", "AllocDirOther")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(other)
+	secret := filepath.Join(other, "secret")
+	if err := ioutil.WriteFile(secret, []byte("secret"), 0600); err != nil {
+		t.Fatalf("Coudn't create file in host dir %v: %v", other, err)
+	}
+	if err := td.EmbedPath(secret, entries); err == nil {
+		t.Fatalf("EmbedPath(%v) should have failed", secret)
+	}
+	if err := os.Symlink(secret, filepath.Join(host, "escape")); err != nil {
+		t.Fatalf("Couldn't create symlink: %v", err)
+	}
+	if err := td.EmbedPath(filepath.Join(host, "escape"), entries); err == nil {
+		t.Fatalf("EmbedPath through a symlink out of the entries should have failed")
+	}
+	if _, err := os.Stat(filepath.Join(td.Dir, secret)); !os.IsNotExist(err) {
+		t.Fatalf("file outside the entries embedded: %v", err)
+	}
+
+	// Sources embedded at another path aren't embedded again
+	if err := td.EmbedPath(cmd, map[string]string{host: "/app"}); err == nil {
+		t.Fatalf("EmbedPath(%v) of a moved source should have failed", cmd)
+	}
+}
+
+// Test that building a chroot in parallel embeds all files and symlinks.
+func TestTaskDir_EmbedDirs_Concurrent(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "AllocDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(testLogger(), tmp)
+	defer d.Destroy()
+	td := d.NewTaskDir(t1.Name)
+	if err := d.Build(); err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	td.SetChrootConcurrency(8)
+
+	host, err := ioutil.TempDir("", "AllocDirHost")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(host)
+
+	// Create a nested tree of files with a symlink pointing at one of them
+	var exp []string
+	taskDest := "bin/test/"
+	for i := 0; i < 5; i++ {
+		dir := filepath.Join(host, fmt.Sprintf("dir%d", i))
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			t.Fatalf("Failed to make dir %v: %v", dir, err)
+		}
+		for j := 0; j < 10; j++ {
+			name := fmt.Sprintf("file%d", j)
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte{'a'}, 0777); err != nil {
+				t.Fatalf("Coudn't create file in host dir %v: %v", dir, err)
+			}
+			exp = append(exp, filepath.Join(td.Dir, taskDest, fmt.Sprintf("dir%d", i), name))
+		}
+	}
+	if err := os.Symlink("dir0/file0", filepath.Join(host, "link")); err != nil {
+		t.Fatalf("Couldn't create symlink: %v", err)
+	}
+
+	mapping := map[string]string{host: taskDest}
+	if err := td.embedDirs(context.Background(), mapping); err != nil {
+		t.Fatalf("embedDirs(%v) failed: %v", mapping, err)
+	}
+
+	for _, f := range exp {
+		if _, err := os.Stat(f); os.IsNotExist(err) {
+			t.Fatalf("File %v not embedded: %v", f, err)
+		}
+	}
+
+	link := filepath.Join(td.Dir, taskDest, "link")
+	if target, err := os.Readlink(link); err != nil || target != "dir0/file0" {
+		t.Fatalf("Symlink %v not embedded; target %q: %v", link, target, err)
+	}
+	if _, err := os.Stat(link); err != nil {
+		t.Fatalf("Symlink %v does not resolve: %v", link, err)
+	}
+}
+
 // Test that task dirs for image based isolation don't require root.
 func TestTaskDir_NonRoot_Image(t *testing.T) {
 	if os.Geteuid() == 0 {
@@ -490,12 +490,18 @@ func (c *Client) Shutdown() error {
 	// Stop Garbage collector
 	c.garbageCollector.Stop()
 
-	// Destroy all the running allocations.
+	// Destroy all the running allocations. Otherwise the tasks are detached
+	// from so that they keep running, such as across an upgrade, until the
+	// allocations are restored.
 	if c.config.DevMode {
 		for _, ar := range c.getAllocRunners() {
 			ar.Destroy()
 			<-ar.WaitCh()
 		}
+	} else {
+		for _, ar := range c.getAllocRunners() {
+			ar.DetachTasks()
+		}
 	}
 
 	c.shutdown = true
@@ -41,6 +41,38 @@ var (
 		"java",
 	}, ",")
 
+	// DefaultChrootCopyConcurrency is the default number of files copied in
+	// parallel while building a task's chroot.
+	DefaultChrootCopyConcurrency = 4
+
+	// DefaultChrootBuildTimeout is the default time allowed for building a
+	// task's chroot before it is removed and the task fails.
+	DefaultChrootBuildTimeout = 10 * time.Minute
+
+	// DefaultPrestartProgressInterval is the default interval at which
+	// events report the progress of slow steps preparing a task.
+	DefaultPrestartProgressInterval = time.Minute
+
+	// DefaultCgroupWriteRetries is the default number of times writing a
+	// task's cgroup limits is retried after transient errors.
+	DefaultCgroupWriteRetries = 3
+
+	// DefaultStartOrderTimeout is the default time a task waits for the
+	// tasks of lower start orders to be running.
+	DefaultStartOrderTimeout = 5 * time.Minute
+
+	// DefaultDiskQuotaInterval is the default interval at which the disk
+	// usage of allocations is compared to their ephemeral disk.
+	DefaultDiskQuotaInterval = 30 * time.Second
+
+	// DefaultCPUThrottleDuration is the default duration a task has to be CPU
+	// throttled above the threshold for before an event is emitted.
+	DefaultCPUThrottleDuration = 1 * time.Minute
+
+	// DefaultUnmountRetries is the default number of times the failed
+	// unmounts of a task's directory are retried when tearing it down.
+	DefaultUnmountRetries = 3
+
 	// A mapping of directories on the host OS to attempt to embed inside each
 	// task's chroot.
 	DefaultChrootEnv = map[string]string{
@@ -0,0 +1,407 @@
+package driver
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/driver/executor"
+)
+
+const (
+	// binaryStatic is a statically linked ELF binary.
+	binaryStatic = "static"
+
+	// binaryDynamic is a dynamically linked ELF binary.
+	binaryDynamic = "dynamic"
+
+	// binaryScript is a script starting with an interpreter directive.
+	binaryScript = "script"
+
+	// binaryUnknown is neither an ELF binary nor a script and can't be
+	// executed directly.
+	binaryUnknown = "unknown"
+)
+
+// binaryInfo describes how an executable is linked.
+type binaryInfo struct {
+	// Path is the path the executable was inspected at
+	Path string
+
+	// Kind is one of the binary* kinds
+	Kind string
+
+	// Interpreter is the dynamic linker of a dynamic binary or the
+	// interpreter of a script
+	Interpreter string
+
+	// Machine is the architecture an ELF binary is built for
+	Machine elf.Machine
+
+	// GlibcVersion is the highest glibc symbol version a dynamic binary
+	// requires, such as "2.34", or empty if it doesn't link against glibc
+	GlibcVersion string
+}
+
+// String returns a human readable description of the binary.
+func (b *binaryInfo) String() string {
+	switch b.Kind {
+	case binaryStatic:
+		return "a statically linked binary"
+	case binaryDynamic:
+		if b.GlibcVersion != "" {
+			return fmt.Sprintf("a dynamically linked binary using interpreter %s and requiring glibc %s", b.Interpreter, b.GlibcVersion)
+		}
+		return fmt.Sprintf("a dynamically linked binary using interpreter %s", b.Interpreter)
+	case binaryScript:
+		return fmt.Sprintf("a script using interpreter %s", b.Interpreter)
+	default:
+		return "neither an ELF binary nor a script"
+	}
+}
+
+// Executable returns an error explaining why the binary can't be executed
+// directly, or nil if it can.
+func (b *binaryInfo) Executable() error {
+	if b.Kind != binaryUnknown {
+		return nil
+	}
+	return fmt.Errorf("command %q is neither an ELF binary nor a script starting with \"#!\" "+
+		"and would fail with \"exec format error\"; run it through an interpreter such as /bin/sh instead", b.Path)
+}
+
+// Compatible returns an error explaining why the binary can't run on a node
+// with the architecture and glibc version, or nil if it can. 32-bit binaries
+// of the node's architecture family, such as 386 binaries on amd64, are
+// compatible. An empty glibc version skips checking the binary's glibc
+// requirement.
+func (b *binaryInfo) Compatible(goarch, glibc string) error {
+	if b.Kind != binaryStatic && b.Kind != binaryDynamic {
+		return nil
+	}
+
+	if !executor.ELFMachineRunnable(goarch, b.Machine) {
+		return fmt.Errorf("command %q is built for %s but the node's architecture is %s "+
+			"and it would fail with \"exec format error\"", b.Path, b.Machine, goarch)
+	}
+
+	if b.GlibcVersion != "" && glibc != "" && compareVersions(b.GlibcVersion, glibc) > 0 {
+		return fmt.Errorf("command %q requires glibc %s but the node has glibc %s "+
+			"and it would fail with \"version `GLIBC_%s' not found\"; build it against an older glibc or link it statically",
+			b.Path, b.GlibcVersion, glibc, b.GlibcVersion)
+	}
+	return nil
+}
+
+// maxInterpreterLine is the most of a script's first line that's read for its
+// interpreter directive, the kernel's limit.
+const maxInterpreterLine = 256
+
+// openTaskBinary opens the command the task runs from root, which is the
+// task's directory containing its chroot: within the task's local directory
+// and then root, as the executor resolves it. The host's $PATH isn't searched
+// as a binary found there isn't the one that runs in the chroot. The task
+// controls root, so symbolic links are resolved within it and the command
+// must be a regular file, as a FIFO or device could hang or exhaust the
+// client.
+func openTaskBinary(root, bin string) (*os.File, error) {
+	for _, rel := range []string{filepath.Join(allocdir.TaskLocal, bin), bin} {
+		path, err := resolveInRoot(root, rel)
+		if err != nil {
+			continue
+		}
+		resolved, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil, err
+		}
+
+		dir, err := allocdir.OpenDirBeneath(root, filepath.Dir(resolved), false, 0)
+		if err != nil {
+			return nil, err
+		}
+		f, err := allocdir.OpenRegularFileAt(dir, filepath.Base(resolved))
+		dir.Close()
+		return f, err
+	}
+	return nil, fmt.Errorf("binary %q could not be found", bin)
+}
+
+// inspectBinary determines how the executable is linked.
+func inspectBinary(file *os.File) (*binaryInfo, error) {
+	info := &binaryInfo{Path: file.Name()}
+
+	f, err := elf.NewFile(file)
+	if err != nil {
+		if _, ok := err.(*elf.FormatError); !ok {
+			return nil, err
+		}
+		return inspectScript(info, file)
+	}
+
+	info.Kind = binaryStatic
+	info.Machine = f.Machine
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+
+		interp, err := ioutil.ReadAll(prog.Open())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read interpreter of %q: %v", info.Path, err)
+		}
+		info.Kind = binaryDynamic
+		info.Interpreter = string(bytes.TrimRight(interp, "\x00"))
+		info.GlibcVersion = requiredGlibcVersion(f)
+		break
+	}
+	return info, nil
+}
+
+// requiredGlibcVersion returns the highest GLIBC_ version of the symbols the
+// ELF binary imports or empty if it imports none.
+func requiredGlibcVersion(f *elf.File) string {
+	syms, err := f.ImportedSymbols()
+	if err != nil {
+		return ""
+	}
+
+	var required string
+	for _, sym := range syms {
+		if !strings.HasPrefix(sym.Version, "GLIBC_") {
+			continue
+		}
+		v := strings.TrimPrefix(sym.Version, "GLIBC_")
+		if _, ok := parseVersion(v); !ok {
+			// Skip GLIBC_PRIVATE
+			continue
+		}
+		if required == "" || compareVersions(v, required) > 0 {
+			required = v
+		}
+	}
+	return required
+}
+
+// parseVersion parses a dotted version such as "2.34".
+func parseVersion(v string) ([]int, bool) {
+	parts := strings.Split(v, ".")
+	nums := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, false
+		}
+		nums[i] = n
+	}
+	return nums, true
+}
+
+// compareVersions compares the dotted versions a and b, returning -1, 0 or 1.
+// Invalid versions compare as equal.
+func compareVersions(a, b string) int {
+	av, ok := parseVersion(a)
+	if !ok {
+		return 0
+	}
+	bv, ok := parseVersion(b)
+	if !ok {
+		return 0
+	}
+	for i := 0; i < len(av) || i < len(bv); i++ {
+		var x, y int
+		if i < len(av) {
+			x = av[i]
+		}
+		if i < len(bv) {
+			y = bv[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+var (
+	// hostGlibc caches the glibc version of the host
+	hostGlibc     string
+	hostGlibcOnce sync.Once
+)
+
+// hostGlibcVersion returns the version of the host's glibc, such as "2.31",
+// or empty if the host doesn't use glibc.
+func hostGlibcVersion() string {
+	hostGlibcOnce.Do(func() {
+		out, err := exec.Command("getconf", "GNU_LIBC_VERSION").Output()
+		if err != nil {
+			return
+		}
+
+		// The output is "glibc 2.31"
+		fields := strings.Fields(string(out))
+		if len(fields) == 2 && fields[0] == "glibc" {
+			if _, ok := parseVersion(fields[1]); ok {
+				hostGlibc = fields[1]
+			}
+		}
+	})
+	return hostGlibc
+}
+
+// libDirs are the directories glibc's libc.so.6 is usually installed in,
+// relative to the root. Their multiarch subdirectories such as
+// x86_64-linux-gnu are searched as well.
+var libDirs = []string{"lib64", "usr/lib64", "lib", "usr/lib"}
+
+// rootGlibcVersion returns the version of the glibc installed within root,
+// such as a task's chroot, or empty if none is found. Symbolic links are
+// resolved within root so that the version of the glibc the task loads is
+// returned rather than the host's.
+func rootGlibcVersion(root string) string {
+	for _, lib := range libDirs {
+		dir, err := resolveInRoot(root, lib)
+		if err != nil {
+			continue
+		}
+
+		rels := []string{filepath.Join(lib, "libc.so.6")}
+		if multiarch, err := filepath.Glob(filepath.Join(dir, "*-linux-gnu*")); err == nil {
+			for _, m := range multiarch {
+				rels = append(rels, filepath.Join(lib, filepath.Base(m), "libc.so.6"))
+			}
+		}
+		for _, rel := range rels {
+			path, err := resolveInRoot(root, rel)
+			if err != nil {
+				continue
+			}
+			if v := libcVersion(path); v != "" {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+// libcVersion returns the highest GLIBC_ version the ELF library at path
+// defines, which is the version of glibc for its libc.so.6, or empty if it
+// defines none.
+func libcVersion(path string) string {
+	f, err := elf.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	dynstr := f.Section(".dynstr")
+	if dynstr == nil {
+		return ""
+	}
+	data, err := dynstr.Data()
+	if err != nil {
+		return ""
+	}
+
+	var version string
+	for _, str := range bytes.Split(data, []byte{0}) {
+		if !bytes.HasPrefix(str, []byte("GLIBC_")) {
+			continue
+		}
+		v := string(str[len("GLIBC_"):])
+		if _, ok := parseVersion(v); !ok {
+			continue
+		}
+		if version == "" || compareVersions(v, version) > 0 {
+			version = v
+		}
+	}
+	return version
+}
+
+// maxRootLinks is the number of symbolic links resolveInRoot follows before
+// giving up, like the kernel's limit.
+const maxRootLinks = 40
+
+// resolveInRoot returns the host path of the relative path rel within root
+// after resolving its symbolic links as if root was the filesystem's root.
+// Absolute link targets and ".." components can't escape root.
+func resolveInRoot(root, rel string) (string, error) {
+	resolved := ""
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	links := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if resolved = filepath.Dir(resolved); resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		path := filepath.Join(root, next)
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxRootLinks {
+			return "", fmt.Errorf("too many links resolving %q within %q", rel, root)
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(target, "/") {
+			resolved = ""
+		}
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// inspectScript determines whether the non-ELF file is a script with an
+// interpreter directive. At most maxInterpreterLine bytes are read.
+func inspectScript(info *binaryInfo, f *os.File) (*binaryInfo, error) {
+	buf := make([]byte, maxInterpreterLine)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	line := string(buf[:n])
+	if i := strings.IndexByte(line, '\n'); i != -1 {
+		line = line[:i]
+	}
+
+	if !strings.HasPrefix(line, "#!") {
+		info.Kind = binaryUnknown
+		return info, nil
+	}
+
+	info.Kind = binaryScript
+	if fields := strings.Fields(strings.TrimPrefix(line, "#!")); len(fields) > 0 {
+		info.Interpreter = fields[0]
+	}
+	return info, nil
+}
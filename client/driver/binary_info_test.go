@@ -0,0 +1,208 @@
+package driver
+
+import (
+	"debug/elf"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/stretchr/testify/require"
+)
+
+// inspectPath inspects the executable at path.
+func inspectPath(path string) (*binaryInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return inspectBinary(f)
+}
+
+func TestBinaryInfo_Inspect(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "binaryinfo")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// The test binary itself is an ELF binary
+	self, err := os.Executable()
+	require.Nil(err)
+	info, err := inspectPath(self)
+	require.Nil(err)
+	require.Contains([]string{binaryStatic, binaryDynamic}, info.Kind)
+	require.Nil(info.Executable())
+
+	script := filepath.Join(dir, "script.sh")
+	require.Nil(ioutil.WriteFile(script, []byte("#!/bin/sh -e\necho hi\n"), 0755))
+	info, err = inspectPath(script)
+	require.Nil(err)
+	require.Equal(binaryScript, info.Kind)
+	require.Equal("/bin/sh", info.Interpreter)
+	require.Nil(info.Executable())
+
+	text := filepath.Join(dir, "text")
+	require.Nil(ioutil.WriteFile(text, []byte("echo hi\n"), 0755))
+	info, err = inspectPath(text)
+	require.Nil(err)
+	require.Equal(binaryUnknown, info.Kind)
+	require.NotNil(info.Executable())
+	require.Contains(info.Executable().Error(), "exec format error")
+
+	// Only the start of a first line without a newline is read
+	long := filepath.Join(dir, "long")
+	require.Nil(ioutil.WriteFile(long, append([]byte("#!/bin/sh"), make([]byte, 1<<20)...), 0755))
+	info, err = inspectPath(long)
+	require.Nil(err)
+	require.Equal(binaryScript, info.Kind)
+}
+
+func TestBinaryInfo_OpenTaskBinary(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("", "binaryinfo")
+	require.Nil(err)
+	defer os.RemoveAll(root)
+
+	local := filepath.Join(root, allocdir.TaskLocal)
+	require.Nil(os.MkdirAll(filepath.Join(root, "bin"), 0755))
+	require.Nil(os.MkdirAll(local, 0755))
+	require.Nil(ioutil.WriteFile(filepath.Join(root, "bin", "app"), []byte("#!/bin/sh\n"), 0755))
+
+	// The command is found in the task's root
+	f, err := openTaskBinary(root, "bin/app")
+	require.Nil(err)
+	require.Equal(filepath.Join(root, "bin", "app"), f.Name())
+	f.Close()
+
+	// The task's local directory comes first
+	require.Nil(os.MkdirAll(filepath.Join(local, "bin"), 0755))
+	require.Nil(ioutil.WriteFile(filepath.Join(local, "bin", "app"), []byte("#!/bin/sh\n"), 0755))
+	f, err = openTaskBinary(root, "bin/app")
+	require.Nil(err)
+	require.Equal(filepath.Join(local, "bin", "app"), f.Name())
+	f.Close()
+
+	// Links resolve within the root rather than the host
+	require.Nil(os.Symlink("/bin/app", filepath.Join(root, "link")))
+	f, err = openTaskBinary(root, "link")
+	require.Nil(err)
+	require.Equal(filepath.Join(root, "bin", "app"), f.Name())
+	f.Close()
+
+	// The host's $PATH isn't searched
+	_, err = openTaskBinary(root, "sh")
+	require.NotNil(err)
+
+	// Directories are refused
+	_, err = openTaskBinary(root, "bin")
+	require.NotNil(err)
+}
+
+func TestBinaryInfo_Compatible(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	info := &binaryInfo{
+		Path:         "/bin/app",
+		Kind:         binaryDynamic,
+		Interpreter:  "/lib64/ld-linux-x86-64.so.2",
+		Machine:      elf.EM_X86_64,
+		GlibcVersion: "2.34",
+	}
+	require.Nil(info.Compatible("amd64", "2.34"))
+	require.Nil(info.Compatible("amd64", "2.35"))
+	require.Nil(info.Compatible("amd64", ""))
+
+	err := info.Compatible("amd64", "2.31")
+	require.NotNil(err)
+	require.Contains(err.Error(), "requires glibc 2.34 but the node has glibc 2.31")
+
+	err = info.Compatible("arm64", "2.34")
+	require.NotNil(err)
+	require.Contains(err.Error(), "exec format error")
+
+	// 32-bit binaries of the same family are compatible
+	info.Machine = elf.EM_386
+	require.Nil(info.Compatible("amd64", "2.34"))
+	info.Machine = elf.EM_ARM
+	require.Nil(info.Compatible("arm64", "2.34"))
+	require.NotNil(info.Compatible("amd64", "2.34"))
+
+	// Scripts are checked by their interpreter
+	script := &binaryInfo{Path: "/bin/app.sh", Kind: binaryScript, Interpreter: "/bin/sh"}
+	require.Nil(script.Compatible("arm64", "2.1"))
+
+	// Binaries on the host are compatible with it
+	if sh, err := inspectPath("/bin/sh"); err == nil {
+		require.Nil(sh.Compatible(runtime.GOARCH, hostGlibcVersion()))
+	}
+}
+
+func TestBinaryInfo_ResolveInRoot(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("", "binaryinfo")
+	require.Nil(err)
+	defer os.RemoveAll(root)
+
+	require.Nil(os.MkdirAll(filepath.Join(root, "usr", "lib"), 0755))
+	require.Nil(ioutil.WriteFile(filepath.Join(root, "usr", "lib", "libc.so.6"), nil, 0644))
+
+	// Absolute links resolve within the root
+	require.Nil(os.Symlink("/usr/lib", filepath.Join(root, "lib")))
+	path, err := resolveInRoot(root, "lib/libc.so.6")
+	require.Nil(err)
+	require.Equal(filepath.Join(root, "usr", "lib", "libc.so.6"), path)
+
+	// Neither links nor ".." escape the root
+	require.Nil(os.Symlink("../../../../..", filepath.Join(root, "up")))
+	path, err = resolveInRoot(root, "up/usr/lib/libc.so.6")
+	require.Nil(err)
+	require.Equal(filepath.Join(root, "usr", "lib", "libc.so.6"), path)
+	_, err = resolveInRoot(root, "../"+filepath.Base(root)+"/lib")
+	require.NotNil(err)
+
+	// Link loops fail
+	require.Nil(os.Symlink("loop", filepath.Join(root, "loop")))
+	_, err = resolveInRoot(root, "loop")
+	require.NotNil(err)
+}
+
+func TestBinaryInfo_RootGlibcVersion(t *testing.T) {
+	t.Parallel()
+	host := hostGlibcVersion()
+	if host == "" {
+		t.Skip("host doesn't use glibc")
+	}
+	require := require.New(t)
+
+	// The host's root has the host's glibc
+	require.Equal(host, rootGlibcVersion("/"))
+
+	// A root without glibc has none even if it links to the host's
+	root, err := ioutil.TempDir("", "binaryinfo")
+	require.Nil(err)
+	defer os.RemoveAll(root)
+	require.Nil(os.Symlink("/lib", filepath.Join(root, "lib")))
+	require.Nil(os.Symlink("/usr", filepath.Join(root, "usr")))
+	require.Equal("", rootGlibcVersion(root))
+}
+
+func TestBinaryInfo_CompareVersions(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	require.Equal(0, compareVersions("2.34", "2.34"))
+	require.Equal(0, compareVersions("2.3", "2.3.0"))
+	require.Equal(-1, compareVersions("2.9", "2.10"))
+	require.Equal(1, compareVersions("2.17", "2.2.5"))
+	require.Equal(0, compareVersions("PRIVATE", "2.2"))
+}
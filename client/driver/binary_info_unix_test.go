@@ -0,0 +1,43 @@
+// +build !windows
+
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBinaryInfo_OpenTaskBinary_FIFO(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("", "binaryinfo")
+	require.Nil(err)
+	defer os.RemoveAll(root)
+
+	// A FIFO without a writer is refused rather than blocking
+	require.Nil(syscall.Mkfifo(filepath.Join(root, "fifo"), 0644))
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := openTaskBinary(root, "fifo")
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		require.NotNil(err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("opening a FIFO blocked")
+	}
+
+	// Links to the host's devices resolve within the root
+	require.Nil(os.Symlink("/dev/zero", filepath.Join(root, "zero")))
+	require.Nil(os.MkdirAll(filepath.Join(root, "dev"), 0755))
+	_, err = openTaskBinary(root, "zero")
+	require.NotNil(err)
+}
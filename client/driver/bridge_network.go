@@ -0,0 +1,189 @@
+package driver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/nomad/client/driver/env"
+	"github.com/hashicorp/nomad/client/driver/executor"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// networkModeHost shares the host's network with the task
+	networkModeHost = "host"
+
+	// networkModeBridge runs the task in its own network namespace attached
+	// to a host bridge
+	networkModeBridge = "bridge"
+
+	// execBridgeConfigOption is the key for the name of the host bridge
+	// tasks in the bridge network mode are attached to.
+	execBridgeConfigOption = "driver.exec.bridge"
+
+	// execBridgeSubnetConfigOption is the key for the IPv4 subnet the
+	// addresses of the bridge and its tasks are allocated from.
+	execBridgeSubnetConfigOption = "driver.exec.bridge_subnet"
+
+	// defaultExecBridge and defaultExecBridgeSubnet are the default host
+	// bridge and its subnet
+	defaultExecBridge       = "nomad"
+	defaultExecBridgeSubnet = "172.26.64.0/20"
+)
+
+var (
+	// globalBridgeAddrs tracks the addresses of the tasks on the node's
+	// bridge.
+	globalBridgeAddrs = newBridgeAddrAllocator()
+)
+
+// bridgeAddrAllocator allocates the addresses of tasks attached to the host
+// bridge. The first address of the subnet is the bridge's.
+type bridgeAddrAllocator struct {
+	// owners maps an address to the ID of the task it's allocated to
+	owners map[string]string
+
+	// addrs maps a task ID to its address
+	addrs map[string]string
+
+	lock sync.Mutex
+}
+
+// newBridgeAddrAllocator returns an empty bridgeAddrAllocator.
+func newBridgeAddrAllocator() *bridgeAddrAllocator {
+	return &bridgeAddrAllocator{
+		owners: make(map[string]string),
+		addrs:  make(map[string]string),
+	}
+}
+
+// Acquire allocates a free address of the subnet to the task with the given
+// ID. A task that already has an address of the subnet keeps it.
+func (a *bridgeAddrAllocator) Acquire(id string, subnet *net.IPNet) (net.IP, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if addr, ok := a.addrs[id]; ok {
+		if ip := net.ParseIP(addr); subnet.Contains(ip) {
+			return ip, nil
+		}
+		a.release(id)
+	}
+
+	first, last := subnetHosts(subnet)
+	for i := first + 1; i <= last; i++ {
+		ip := uint32ToIP(i)
+		if _, ok := a.owners[ip.String()]; ok {
+			continue
+		}
+		a.owners[ip.String()] = id
+		a.addrs[id] = ip.String()
+		return ip, nil
+	}
+	return nil, fmt.Errorf("no free addresses left in bridge subnet %s", subnet)
+}
+
+// Reserve tracks the address as allocated to the task with the given ID,
+// such as when reattaching to the task.
+func (a *bridgeAddrAllocator) Reserve(id string, ip net.IP) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.release(id)
+	a.owners[ip.String()] = id
+	a.addrs[id] = ip.String()
+}
+
+// Release frees the address of the task with the given ID.
+func (a *bridgeAddrAllocator) Release(id string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.release(id)
+}
+
+// release frees the address of the task. The lock must be held.
+func (a *bridgeAddrAllocator) release(id string) {
+	if addr, ok := a.addrs[id]; ok && a.owners[addr] == id {
+		delete(a.owners, addr)
+	}
+	delete(a.addrs, id)
+}
+
+// parseBridgeSubnet parses the IPv4 subnet of the bridge, which must leave
+// room for the bridge and at least one task.
+func parseBridgeSubnet(subnet string) (*net.IPNet, error) {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", execBridgeSubnetConfigOption, subnet, err)
+	}
+	ones, bits := ipNet.Mask.Size()
+	if ipNet.IP.To4() == nil || bits != 32 || ones > 30 {
+		return nil, fmt.Errorf("%s %q must be an IPv4 subnet of at most /30", execBridgeSubnetConfigOption, subnet)
+	}
+	return ipNet, nil
+}
+
+// subnetHosts returns the first and last host address of the IPv4 subnet.
+func subnetHosts(subnet *net.IPNet) (uint32, uint32) {
+	network := binary.BigEndian.Uint32(subnet.IP.To4())
+	broadcast := network | ^binary.BigEndian.Uint32(net.IP(subnet.Mask).To4())
+	return network + 1, broadcast - 1
+}
+
+// uint32ToIP returns the IPv4 address.
+func uint32ToIP(i uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, i)
+	return ip
+}
+
+// bridgeNetwork returns the network of the task with the given address on
+// the bridge. The task's ports are forwarded from the host to its address.
+func bridgeNetwork(bridge string, subnet *net.IPNet, ip net.IP, task *structs.Task) *executor.BridgeNetwork {
+	first, _ := subnetHosts(subnet)
+	ones, _ := subnet.Mask.Size()
+	return &executor.BridgeNetwork{
+		Bridge:  bridge,
+		Gateway: fmt.Sprintf("%s/%d", uint32ToIP(first), ones),
+		Address: fmt.Sprintf("%s/%d", ip, ones),
+		Ports:   taskPorts(task),
+	}
+}
+
+// taskPorts returns the reserved and dynamic ports of the task's network
+// resources.
+func taskPorts(task *structs.Task) []int {
+	if task.Resources == nil {
+		return nil
+	}
+	var ports []int
+	for _, n := range task.Resources.Networks {
+		for _, p := range n.ReservedPorts {
+			ports = append(ports, p.Value)
+		}
+		for _, p := range n.DynamicPorts {
+			ports = append(ports, p.Value)
+		}
+	}
+	return ports
+}
+
+// bridgeTaskEnv returns a copy of the task's environment in which the
+// addresses of the task's ports are its address on the bridge, as it can't
+// bind to the host's addresses within its network namespace.
+func bridgeTaskEnv(taskEnv *env.TaskEnv, ip net.IP) *env.TaskEnv {
+	envMap := taskEnv.Map()
+	for k, v := range envMap {
+		switch {
+		case strings.HasPrefix(k, env.IpPrefix):
+			envMap[k] = ip.String()
+		case strings.HasPrefix(k, env.AddrPrefix):
+			if _, port, err := net.SplitHostPort(v); err == nil {
+				envMap[k] = net.JoinHostPort(ip.String(), port)
+			}
+		}
+	}
+	return env.NewTaskEnv(envMap, taskEnv.NodeAttrs)
+}
@@ -0,0 +1,108 @@
+package driver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/hashicorp/nomad/client/driver/env"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBridgeAddrAllocator(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	subnet, err := parseBridgeSubnet("10.0.0.0/30")
+	require.Nil(err)
+	a := newBridgeAddrAllocator()
+
+	// The first address is the bridge's
+	ip, err := a.Acquire("a", subnet)
+	require.Nil(err)
+	require.Equal("10.0.0.2", ip.String())
+
+	// Tasks keep their address
+	ip, err = a.Acquire("a", subnet)
+	require.Nil(err)
+	require.Equal("10.0.0.2", ip.String())
+
+	// The broadcast address isn't allocated
+	_, err = a.Acquire("b", subnet)
+	require.NotNil(err)
+
+	a.Release("a")
+	ip, err = a.Acquire("b", subnet)
+	require.Nil(err)
+	require.Equal("10.0.0.2", ip.String())
+
+	// Reattached tasks reserve their address
+	a.Reserve("c", net.ParseIP("10.0.0.5"))
+	subnet, err = parseBridgeSubnet("10.0.0.0/29")
+	require.Nil(err)
+	ip, err = a.Acquire("d", subnet)
+	require.Nil(err)
+	require.Equal("10.0.0.3", ip.String())
+	ip, err = a.Acquire("e", subnet)
+	require.Nil(err)
+	require.Equal("10.0.0.4", ip.String())
+	ip, err = a.Acquire("f", subnet)
+	require.Nil(err)
+	require.Equal("10.0.0.6", ip.String())
+}
+
+func TestParseBridgeSubnet(t *testing.T) {
+	t.Parallel()
+
+	for _, subnet := range []string{"172.26.64.0/20", "10.0.0.0/30"} {
+		if _, err := parseBridgeSubnet(subnet); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for _, subnet := range []string{"10.0.0.0/31", "fd00::/64", "10.0.0.1"} {
+		if _, err := parseBridgeSubnet(subnet); err == nil {
+			t.Fatalf("expected error for %q", subnet)
+		}
+	}
+}
+
+func TestBridgeNetwork(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	subnet, err := parseBridgeSubnet("172.26.64.0/20")
+	require.Nil(err)
+	task := &structs.Task{
+		Resources: &structs.Resources{
+			Networks: []*structs.NetworkResource{
+				{
+					ReservedPorts: []structs.Port{{Label: "admin", Value: 8000}},
+					DynamicPorts:  []structs.Port{{Label: "http", Value: 23456}},
+				},
+			},
+		},
+	}
+	n := bridgeNetwork("nomad", subnet, net.ParseIP("172.26.64.2"), task)
+	require.Equal("nomad", n.Bridge)
+	require.Equal("172.26.64.1/20", n.Gateway)
+	require.Equal("172.26.64.2/20", n.Address)
+	require.Equal([]int{8000, 23456}, n.Ports)
+}
+
+func TestBridgeTaskEnv(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	taskEnv := env.NewTaskEnv(map[string]string{
+		env.IpPrefix + "http":   "10.1.1.1",
+		env.AddrPrefix + "http": "10.1.1.1:8080",
+		env.PortPrefix + "http": "8080",
+	}, nil)
+	envMap := bridgeTaskEnv(taskEnv, net.ParseIP("172.26.64.2")).Map()
+	require.Equal("172.26.64.2", envMap[env.IpPrefix+"http"])
+	require.Equal("172.26.64.2:8080", envMap[env.AddrPrefix+"http"])
+	require.Equal("8080", envMap[env.PortPrefix+"http"])
+
+	// The original environment is unchanged
+	require.Equal("10.1.1.1", taskEnv.Map()[env.IpPrefix+"http"])
+}
@@ -0,0 +1,189 @@
+package driver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// capabilityNames are the names of the Linux capabilities indexed by their
+// bit in the capability sets of /proc/<pid>/status.
+var capabilityNames = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_DAC_READ_SEARCH",
+	"CAP_FOWNER",
+	"CAP_FSETID",
+	"CAP_KILL",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETPCAP",
+	"CAP_LINUX_IMMUTABLE",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_NET_BROADCAST",
+	"CAP_NET_ADMIN",
+	"CAP_NET_RAW",
+	"CAP_IPC_LOCK",
+	"CAP_IPC_OWNER",
+	"CAP_SYS_MODULE",
+	"CAP_SYS_RAWIO",
+	"CAP_SYS_CHROOT",
+	"CAP_SYS_PTRACE",
+	"CAP_SYS_PACCT",
+	"CAP_SYS_ADMIN",
+	"CAP_SYS_BOOT",
+	"CAP_SYS_NICE",
+	"CAP_SYS_RESOURCE",
+	"CAP_SYS_TIME",
+	"CAP_SYS_TTY_CONFIG",
+	"CAP_MKNOD",
+	"CAP_LEASE",
+	"CAP_AUDIT_WRITE",
+	"CAP_AUDIT_CONTROL",
+	"CAP_SETFCAP",
+	"CAP_MAC_OVERRIDE",
+	"CAP_MAC_ADMIN",
+	"CAP_SYSLOG",
+	"CAP_WAKE_ALARM",
+	"CAP_BLOCK_SUSPEND",
+	"CAP_AUDIT_READ",
+	"CAP_PERFMON",
+	"CAP_BPF",
+	"CAP_CHECKPOINT_RESTORE",
+}
+
+// parseCapabilityBoundingSet returns the capability bounding set in the
+// contents of /proc/<pid>/status.
+func parseCapabilityBoundingSet(r io.Reader) (uint64, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != "CapBnd:" {
+			continue
+		}
+		set, err := strconv.ParseUint(fields[1], 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid capability bounding set %q: %v", fields[1], err)
+		}
+		return set, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("status is missing the capability bounding set")
+}
+
+// capabilitySetNames returns the sorted, comma separated names of the
+// capabilities in the set. Capabilities newer than the client are skipped as
+// they can't be named.
+func capabilitySetNames(set uint64) string {
+	var names []string
+	for bit, name := range capabilityNames {
+		if set&(1<<uint(bit)) != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// capabilityBit returns the bit of the capability with the canonical name.
+func capabilityBit(name string) (int, bool) {
+	for bit, n := range capabilityNames {
+		if n == name {
+			return bit, true
+		}
+	}
+	return 0, false
+}
+
+// capabilityBits returns the bits of the capabilities with the canonical
+// names, as the executor sets them by bit.
+func capabilityBits(names []string) []int {
+	bits := make([]int, 0, len(names))
+	for _, name := range names {
+		if bit, ok := capabilityBit(name); ok {
+			bits = append(bits, bit)
+		}
+	}
+	return bits
+}
+
+// parseCapabilities returns the canonical names, such as
+// "CAP_NET_BIND_SERVICE", of the capabilities. Names are case insensitive and
+// the "CAP_" prefix is optional. The names are returned sorted and without
+// duplicates.
+func parseCapabilities(names []string) ([]string, error) {
+	seen := make(map[string]struct{}, len(names))
+	caps := make([]string, 0, len(names))
+	for _, name := range names {
+		c := strings.ToUpper(strings.TrimSpace(name))
+		if !strings.HasPrefix(c, "CAP_") {
+			c = "CAP_" + c
+		}
+		if _, ok := capabilityBit(c); !ok {
+			return nil, fmt.Errorf("unknown capability %q", name)
+		}
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		seen[c] = struct{}{}
+		caps = append(caps, c)
+	}
+	sort.Strings(caps)
+	return caps, nil
+}
+
+// parseCapAddDrop returns the canonical names of the capabilities the task
+// adds and drops. A capability can't be both added and dropped.
+func parseCapAddDrop(add, drop []string) ([]string, []string, error) {
+	capAdd, err := parseCapabilities(add)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid cap_add: %v", err)
+	}
+	capDrop, err := parseCapabilities(drop)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid cap_drop: %v", err)
+	}
+	for _, a := range capAdd {
+		for _, d := range capDrop {
+			if a == d {
+				return nil, nil, fmt.Errorf("capability %s can't be both added and dropped", a)
+			}
+		}
+	}
+	return capAdd, capDrop, nil
+}
+
+// checkCapabilitiesAllowed returns an error if the task adds capabilities
+// that aren't in the operator's allowlist. Invalid names in the allowlist
+// allow nothing.
+func checkCapabilitiesAllowed(add []string, allowList map[string]struct{}) error {
+	allowed := make(map[string]struct{}, len(allowList))
+	for name := range allowList {
+		if caps, err := parseCapabilities([]string{name}); err == nil {
+			allowed[caps[0]] = struct{}{}
+		}
+	}
+
+	var denied []string
+	for _, c := range add {
+		if _, ok := allowed[c]; !ok {
+			denied = append(denied, c)
+		}
+	}
+	if len(denied) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(allowed))
+	for c := range allowed {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("cap_add requests %s, which the client doesn't allow; %s allows [%s]",
+		strings.Join(denied, ", "), execAllowCapsConfigOption, strings.Join(names, ", "))
+}
@@ -0,0 +1,121 @@
+package driver
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCapabilities_ParseBoundingSet(t *testing.T) {
+	t.Parallel()
+
+	status := `Name:	nomad
+Umask:	0022
+CapInh:	0000000000000000
+CapPrm:	000001ffffffffff
+CapEff:	000001ffffffffff
+CapBnd:	00000000a80425fb
+CapAmb:	0000000000000000
+`
+	set, err := parseCapabilityBoundingSet(strings.NewReader(status))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if set != 0xa80425fb {
+		t.Fatalf("unexpected bounding set %x", set)
+	}
+
+	// The default capabilities of Docker containers
+	exp := "CAP_AUDIT_WRITE,CAP_CHOWN,CAP_DAC_OVERRIDE,CAP_FOWNER,CAP_FSETID,CAP_KILL,CAP_MKNOD," +
+		"CAP_NET_BIND_SERVICE,CAP_NET_RAW,CAP_SETFCAP,CAP_SETGID,CAP_SETPCAP,CAP_SETUID,CAP_SYS_CHROOT"
+	if names := capabilitySetNames(set); names != exp {
+		t.Fatalf("expected %q; got %q", exp, names)
+	}
+
+	// Capabilities newer than the client are skipped
+	if names := capabilitySetNames(1<<10 | 1<<63); names != "CAP_NET_BIND_SERVICE" {
+		t.Fatalf("unexpected names %q", names)
+	}
+	if names := capabilitySetNames(0); names != "" {
+		t.Fatalf("unexpected names %q", names)
+	}
+
+	if _, err := parseCapabilityBoundingSet(strings.NewReader("Name:\tnomad\n")); err == nil {
+		t.Fatalf("expected an error for a missing bounding set")
+	}
+	if _, err := parseCapabilityBoundingSet(strings.NewReader("CapBnd:\tlots\n")); err == nil {
+		t.Fatalf("expected an error for an invalid bounding set")
+	}
+}
+
+func TestCapabilities_Parse(t *testing.T) {
+	t.Parallel()
+
+	caps, err := parseCapabilities([]string{"net_bind_service", "CAP_SYS_TIME", "Cap_Net_Bind_Service", " chown "})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	exp := []string{"CAP_CHOWN", "CAP_NET_BIND_SERVICE", "CAP_SYS_TIME"}
+	if !reflect.DeepEqual(caps, exp) {
+		t.Fatalf("expected %v; got %v", exp, caps)
+	}
+
+	if _, err := parseCapabilities([]string{"CAP_FLY"}); err == nil {
+		t.Fatalf("expected an error for an unknown capability")
+	}
+	if caps, err := parseCapabilities(nil); err != nil || len(caps) != 0 {
+		t.Fatalf("expected no capabilities, got %v: %v", caps, err)
+	}
+
+	if bits := capabilityBits([]string{"CAP_NET_BIND_SERVICE", "CAP_SYS_ADMIN"}); !reflect.DeepEqual(bits, []int{10, 21}) {
+		t.Fatalf("expected bits [10 21], got %v", bits)
+	}
+}
+
+func TestCapabilities_ParseCapAddDrop(t *testing.T) {
+	t.Parallel()
+
+	add, drop, err := parseCapAddDrop([]string{"net_bind_service"}, []string{"CAP_NET_RAW", "sys_admin"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(add, []string{"CAP_NET_BIND_SERVICE"}) {
+		t.Fatalf("unexpected cap_add %v", add)
+	}
+	if !reflect.DeepEqual(drop, []string{"CAP_NET_RAW", "CAP_SYS_ADMIN"}) {
+		t.Fatalf("unexpected cap_drop %v", drop)
+	}
+
+	if _, _, err := parseCapAddDrop([]string{"CAP_FLY"}, nil); err == nil || !strings.Contains(err.Error(), "cap_add") {
+		t.Fatalf("expected an error for an unknown capability, got: %v", err)
+	}
+	if _, _, err := parseCapAddDrop([]string{"net_raw"}, []string{"CAP_NET_RAW"}); err == nil {
+		t.Fatalf("expected an error for a capability both added and dropped")
+	}
+}
+
+func TestCapabilities_CheckAllowed(t *testing.T) {
+	t.Parallel()
+
+	allowList := map[string]struct{}{"net_bind_service": {}, "CAP_CHOWN": {}, "bogus": {}}
+	if err := checkCapabilitiesAllowed([]string{"CAP_CHOWN", "CAP_NET_BIND_SERVICE"}, allowList); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := checkCapabilitiesAllowed(nil, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	err := checkCapabilitiesAllowed([]string{"CAP_NET_BIND_SERVICE", "CAP_SYS_ADMIN"}, allowList)
+	if err == nil {
+		t.Fatalf("expected an error for a capability that isn't allowed")
+	}
+	exp := "cap_add requests CAP_SYS_ADMIN, which the client doesn't allow; driver.exec.allow_caps allows [CAP_CHOWN, CAP_NET_BIND_SERVICE]"
+	if err.Error() != exp {
+		t.Fatalf("expected %q; got %q", exp, err)
+	}
+
+	// Nothing is allowed by default
+	if err := checkCapabilitiesAllowed([]string{"CAP_CHOWN"}, nil); err == nil {
+		t.Fatalf("expected an error without an allowlist")
+	}
+}
@@ -0,0 +1,91 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+)
+
+const (
+	// coreMtimeSlack is how long before the task started a core dump may
+	// appear to be written, as file times come from a coarse clock that lags
+	// behind the time the task was started at
+	coreMtimeSlack = time.Second
+)
+
+var (
+	// corePatternFile holds the kernel's pattern of the paths core dumps are
+	// written to
+	corePatternFile = "/proc/sys/kernel/core_pattern"
+)
+
+// readCorePattern returns the kernel's core_pattern.
+func readCorePattern() (string, error) {
+	data, err := ioutil.ReadFile(corePatternFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read core_pattern: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// corePatternDir returns the directory the kernel writes core dumps to with
+// the pattern. Absolute directories are resolved from the root of the crashing
+// process, so they're within the task's chroot, and relative ones from its
+// working directory. An error explains why the pattern can't be honored, such
+// as cores being piped to a helper on the host.
+func corePatternDir(pattern string, chroot bool) (string, error) {
+	switch {
+	case pattern == "":
+		return "", fmt.Errorf("core_pattern is empty")
+	case strings.HasPrefix(pattern, "|"):
+		return "", fmt.Errorf("core_pattern %q pipes core dumps to a helper on the host", pattern)
+	}
+
+	dir := filepath.Dir(pattern)
+	if strings.Contains(dir, "%") {
+		return "", fmt.Errorf("core_pattern %q names its directory with specifiers", pattern)
+	}
+	if filepath.IsAbs(dir) && !chroot {
+		return "", fmt.Errorf("core_pattern %q writes core dumps to the host as the task has no chroot", pattern)
+	}
+	return dir, nil
+}
+
+// corePrefix returns the literal prefix of the names of the core dumps written
+// with the pattern, before its first specifier.
+func corePrefix(pattern string) string {
+	name := filepath.Base(pattern)
+	if i := strings.Index(name, "%"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// createCoreDumpDir creates the directory rel within the task dir the kernel
+// writes the task's core dumps to, if it doesn't exist. The task controls its
+// task dir, so the directory is opened without following symbolic links.
+// Created directories are writable by every user, like /tmp, as cores are
+// written with the task's credentials.
+func createCoreDumpDir(taskDir, rel string) error {
+	dir, err := allocdir.OpenDirBeneath(taskDir, rel, false, 0)
+	if err == nil {
+		return dir.Close()
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to open core dump directory: %v", err)
+	}
+
+	dir, err = allocdir.OpenDirBeneath(taskDir, rel, true, 0777)
+	if err != nil {
+		return fmt.Errorf("failed to create core dump directory: %v", err)
+	}
+	defer dir.Close()
+	if err := dir.Chmod(os.ModeSticky | 0777); err != nil {
+		return fmt.Errorf("failed to create core dump directory: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCorePatternDir(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		pattern string
+		chroot  bool
+		dir     string
+		err     bool
+	}{
+		{"core", true, ".", false},
+		{"core.%e.%p", false, ".", false},
+		{"cores/core.%p", true, "cores", false},
+		{"/var/crash/core.%e", true, "/var/crash", false},
+		{"/var/crash/core.%e", false, "", true},
+		{"|/usr/lib/systemd/systemd-coredump %P %u", true, "", true},
+		{"/var/crash/%e/core", true, "", true},
+		{"", true, "", true},
+	}
+	for _, c := range cases {
+		dir, err := corePatternDir(c.pattern, c.chroot)
+		if c.err {
+			if err == nil {
+				t.Fatalf("pattern %q: expected error", c.pattern)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("pattern %q: %v", c.pattern, err)
+		}
+		if dir != c.dir {
+			t.Fatalf("pattern %q: expected dir %q; got %q", c.pattern, c.dir, dir)
+		}
+	}
+}
+
+func TestCorePrefix(t *testing.T) {
+	t.Parallel()
+	cases := map[string]string{
+		"core":                "core",
+		"/var/crash/core.%e":  "core.",
+		"cores/%e.core":       "",
+		"core-%e-%p-%t":       "core-",
+		"/tmp/app.core.%p.%t": "app.core.",
+	}
+	for pattern, exp := range cases {
+		if act := corePrefix(pattern); act != exp {
+			t.Fatalf("pattern %q: expected prefix %q; got %q", pattern, exp, act)
+		}
+	}
+}
+
+func TestCreateCoreDumpDir(t *testing.T) {
+	t.Parallel()
+	taskDir, err := ioutil.TempDir("", "core_dump")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(taskDir)
+
+	if err := createCoreDumpDir(taskDir, "local/cores"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fi, err := os.Stat(filepath.Join(taskDir, "local", "cores"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if fi.Mode()&os.ModeSticky == 0 || fi.Mode().Perm() != 0777 {
+		t.Fatalf("expected the directory to be writable by everyone; got %v", fi.Mode())
+	}
+
+	if err := createCoreDumpDir(taskDir, "../cores"); err == nil {
+		t.Fatalf("expected error for a directory outside of the task dir")
+	}
+
+	// A symlink the task put in place of a directory isn't followed
+	outside, err := ioutil.TempDir("", "core_dump")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.Symlink(outside, filepath.Join(taskDir, "var")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := createCoreDumpDir(taskDir, "var/crash"); err == nil {
+		t.Fatalf("expected error creating the directory through a symlink")
+	}
+	if entries, _ := ioutil.ReadDir(outside); len(entries) != 0 {
+		t.Fatalf("directory created outside of the task dir: %v", entries)
+	}
+	if fi, err := os.Stat(outside); err != nil || fi.Mode().Perm() == 0777 {
+		t.Fatalf("directory outside of the task dir was changed: %v %v", fi.Mode(), err)
+	}
+}
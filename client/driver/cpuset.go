@@ -0,0 +1,180 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// cpusetPolicyStrict rejects tasks pinned to cores another task is
+	// already pinned to.
+	cpusetPolicyStrict = "strict"
+
+	// cpusetPolicyBestEffort warns about tasks pinned to cores another task
+	// is already pinned to but allows them to share the cores.
+	cpusetPolicyBestEffort = "best-effort"
+
+	// maxCpusetCore is the highest core a cpuset may list, the most CPUs
+	// the kernel supports. Cpusets are parsed by the servers when jobs are
+	// validated, so ranges are bounded before they're expanded.
+	maxCpusetCore = 8191
+)
+
+var (
+	// globalCpusets tracks the cores the tasks of all drivers on the node
+	// are pinned to.
+	globalCpusets = newCpusetTracker()
+)
+
+// cpusetTracker tracks the cores tasks on the node are pinned to so that
+// overlapping pins can be detected.
+type cpusetTracker struct {
+	// owners maps a core to the IDs of the tasks pinned to it
+	owners map[int]map[string]struct{}
+
+	// cores maps a task ID to the cores it's pinned to
+	cores map[string][]int
+
+	lock sync.Mutex
+}
+
+// newCpusetTracker returns an empty cpusetTracker.
+func newCpusetTracker() *cpusetTracker {
+	return &cpusetTracker{
+		owners: make(map[int]map[string]struct{}),
+		cores:  make(map[string][]int),
+	}
+}
+
+// Acquire pins the task with the given ID to the cores. The cores that are
+// shared with other tasks are returned. If strict is set and any core is
+// shared, nothing is pinned and an error is returned instead.
+func (t *cpusetTracker) Acquire(id string, cores []int, strict bool) ([]int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var shared []int
+	for _, c := range cores {
+		for owner := range t.owners[c] {
+			if owner != id {
+				shared = append(shared, c)
+				break
+			}
+		}
+	}
+	if strict && len(shared) != 0 {
+		return shared, fmt.Errorf("cpuset cores %s are already pinned by other tasks", formatCpuset(shared))
+	}
+
+	t.release(id)
+	for _, c := range cores {
+		if t.owners[c] == nil {
+			t.owners[c] = make(map[string]struct{})
+		}
+		t.owners[c][id] = struct{}{}
+	}
+	t.cores[id] = cores
+	return shared, nil
+}
+
+// Release unpins the task with the given ID from its cores.
+func (t *cpusetTracker) Release(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.release(id)
+}
+
+// release unpins the task. The lock must be held.
+func (t *cpusetTracker) release(id string) {
+	for _, c := range t.cores[id] {
+		delete(t.owners[c], id)
+		if len(t.owners[c]) == 0 {
+			delete(t.owners, c)
+		}
+	}
+	delete(t.cores, id)
+}
+
+// checkCpusetOnline returns an error if any of the cores of the cpuset isn't
+// among the online cores, both in the cgroup cpuset format.
+func checkCpusetOnline(cpuset, online string) error {
+	cores, err := parseCpuset(cpuset)
+	if err != nil {
+		return err
+	}
+	onlineCores, err := parseCpuset(online)
+	if err != nil {
+		return fmt.Errorf("failed to parse the online cores: %v", err)
+	}
+
+	isOnline := make(map[int]struct{}, len(onlineCores))
+	for _, c := range onlineCores {
+		isOnline[c] = struct{}{}
+	}
+	var offline []int
+	for _, c := range cores {
+		if _, ok := isOnline[c]; !ok {
+			offline = append(offline, c)
+		}
+	}
+	if len(offline) != 0 {
+		return fmt.Errorf("cpuset cores %s aren't online; the online cores are %s", formatCpuset(offline), formatCpuset(onlineCores))
+	}
+	return nil
+}
+
+// parseCpuset parses a list of cores in the cgroup cpuset format, such as
+// "0-3,6", into a sorted list of unique cores.
+func parseCpuset(s string) ([]int, error) {
+	seen := make(map[int]struct{})
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		lo, hi := part, part
+		if i := strings.Index(part, "-"); i != -1 {
+			lo, hi = part[:i], part[i+1:]
+		}
+
+		start, err := strconv.Atoi(lo)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid cpuset %q: %q is not a core or range of cores", s, part)
+		}
+		end, err := strconv.Atoi(hi)
+		if err != nil || end < start {
+			return nil, fmt.Errorf("invalid cpuset %q: %q is not a core or range of cores", s, part)
+		}
+		if end > maxCpusetCore {
+			return nil, fmt.Errorf("invalid cpuset %q: cores must not exceed %d", s, maxCpusetCore)
+		}
+		for c := start; c <= end; c++ {
+			seen[c] = struct{}{}
+		}
+	}
+
+	cores := make([]int, 0, len(seen))
+	for c := range seen {
+		cores = append(cores, c)
+	}
+	sort.Ints(cores)
+	return cores, nil
+}
+
+// formatCpuset formats a sorted list of cores in the cgroup cpuset format.
+func formatCpuset(cores []int) string {
+	var parts []string
+	for i := 0; i < len(cores); {
+		j := i
+		for j+1 < len(cores) && cores[j+1] == cores[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(cores[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", cores[i], cores[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,86 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCpuset_Parse(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	cores, err := parseCpuset("4,0-2, 6-7,1")
+	require.Nil(err)
+	require.Equal([]int{0, 1, 2, 4, 6, 7}, cores)
+	require.Equal("0-2,4,6-7", formatCpuset(cores))
+
+	for _, s := range []string{"", "a", "1-", "3-1", "-1", "1,,2", "8192"} {
+		_, err := parseCpuset(s)
+		require.NotNil(err, "cpuset %q", s)
+	}
+}
+
+func TestCpuset_Parse_Huge(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Huge ranges are rejected before they're expanded
+	_, err := parseCpuset("0-9223372036854775807")
+	require.NotNil(err)
+	require.Contains(err.Error(), "must not exceed 8191")
+
+	cores, err := parseCpuset("8190-8191")
+	require.Nil(err)
+	require.Equal([]int{8190, 8191}, cores)
+}
+
+func TestCpuset_CheckOnline(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	require.Nil(checkCpusetOnline("0-1,3", "0-3"))
+
+	err := checkCpusetOnline("2-5", "0-3")
+	require.NotNil(err)
+	require.Contains(err.Error(), "cores 4-5 aren't online")
+}
+
+func TestCpusetTracker_Acquire(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	tracker := newCpusetTracker()
+
+	shared, err := tracker.Acquire("a", []int{0, 1}, true)
+	require.Nil(err)
+	require.Empty(shared)
+
+	// Reacquiring the same cores isn't a conflict
+	shared, err = tracker.Acquire("a", []int{0, 1}, true)
+	require.Nil(err)
+	require.Empty(shared)
+
+	// Overlapping cores are rejected in strict mode
+	shared, err = tracker.Acquire("b", []int{1, 2}, true)
+	require.NotNil(err)
+	require.Equal([]int{1}, shared)
+	require.NotContains(tracker.cores, "b")
+
+	// And shared in best-effort mode
+	shared, err = tracker.Acquire("b", []int{1, 2}, false)
+	require.Nil(err)
+	require.Equal([]int{1}, shared)
+
+	// Cores are free once all tasks pinned to them are released
+	tracker.Release("a")
+	shared, err = tracker.Acquire("c", []int{0}, true)
+	require.Nil(err)
+	require.Empty(shared)
+	_, err = tracker.Acquire("d", []int{1}, true)
+	require.NotNil(err)
+
+	tracker.Release("b")
+	tracker.Release("c")
+	require.Empty(tracker.owners)
+	require.Empty(tracker.cores)
+}
@@ -0,0 +1,328 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	cstructs "github.com/hashicorp/nomad/client/structs"
+)
+
+const (
+	// crashReportDir is the directory within the shared alloc dir crash
+	// reports are written to
+	crashReportDir = "crash"
+
+	// defaultCrashReportTTL is how long crash reports are kept if no TTL is
+	// configured
+	defaultCrashReportTTL = 24 * time.Hour
+
+	// maxCrashReportPruneInterval bounds how often crash reports older than
+	// their TTL are removed while the task runs
+	maxCrashReportPruneInterval = time.Hour
+)
+
+var (
+	// crashSignals are the signals that indicate a task crashed
+	crashSignals = map[int]string{
+		int(syscall.SIGSEGV): "SIGSEGV",
+		int(syscall.SIGABRT): "SIGABRT",
+		int(syscall.SIGBUS):  "SIGBUS",
+		int(syscall.SIGILL):  "SIGILL",
+		int(syscall.SIGFPE):  "SIGFPE",
+	}
+)
+
+// crashReport is the diagnostic state of a task that crashed.
+type crashReport struct {
+	Task     string
+	Time     time.Time
+	Signal   string
+	ExitCode int
+
+	// Command is the interpolated command and arguments of the task
+	Command []string
+
+	// EnvKeys are the names of the task's environment variables. Their
+	// values are omitted as they may be secrets.
+	EnvKeys []string
+
+	// TaskDir is the host path of the task's directory and chroot, which is
+	// kept until the allocation is garbage collected
+	TaskDir string
+
+	// LastStats is the last resource usage collected before the crash
+	LastStats *cstructs.TaskResourceUsage `json:",omitempty"`
+
+	// OpenFiles maps the pids of the task's processes to the targets of
+	// their file descriptors as last collected before the crash
+	OpenFiles map[string][]string `json:",omitempty"`
+
+	// Cores are the names of the core dumps the task wrote, which were moved
+	// next to the report
+	Cores []string `json:",omitempty"`
+}
+
+// crashReporter writes a crash report to the shared alloc dir if a task dies
+// from a crash signal and moves the task's core dumps next to it. Stats and
+// open files can't be collected once the task died so the last ones collected
+// while it ran are kept. Tasks can write to the shared alloc dir and their
+// task dir, so neither is accessed through paths a task could redirect with
+// symbolic links.
+type crashReporter struct {
+	task    string
+	taskDir string
+
+	// allocDir is the host path of the shared alloc dir the crash report
+	// directory is created in
+	allocDir string
+
+	// coreDir is the directory, relative to the task dir, the host's
+	// core_pattern writes the task's core dumps to and corePrefix the prefix
+	// of their names. If coreDir is empty, the core dumps named core or
+	// core.<pid> in the task dir are moved.
+	coreDir    string
+	corePrefix string
+
+	// coresOnly is set if the task keeps its core dumps without writing
+	// crash reports
+	coresOnly bool
+
+	ttl     time.Duration
+	command []string
+	envKeys []string
+
+	lastStats *cstructs.TaskResourceUsage
+	openFiles map[string][]string
+	lock      sync.Mutex
+}
+
+// isCrashSignal returns whether a task killed by the signal crashed.
+func isCrashSignal(signal int) bool {
+	_, ok := crashSignals[signal]
+	return ok
+}
+
+// observe keeps the resource usage of the running task along with a snapshot
+// of the files its processes have open.
+func (c *crashReporter) observe(ru *cstructs.TaskResourceUsage) {
+	var pids []int
+	for p := range ru.Pids {
+		if pid, err := strconv.Atoi(p); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	files := openFiles(procDir, pids)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lastStats = ru
+	c.openFiles = files
+}
+
+// run removes the crash reports and core dumps of the task that are older
+// than the TTL periodically until stopCh is closed.
+func (c *crashReporter) run(stopCh <-chan struct{}) {
+	interval := c.ttl
+	if interval > maxCrashReportPruneInterval {
+		interval = maxCrashReportPruneInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+
+		dir, err := allocdir.OpenDirBeneath(c.allocDir, crashReportDir, false, 0)
+		if err != nil {
+			continue
+		}
+		c.prune(dir, time.Now())
+		dir.Close()
+	}
+}
+
+// report writes the crash report of the task that was killed by the signal
+// and returns its path along with the names of the core dumps the task wrote
+// since it started, which are moved next to the report. Reports older than
+// the TTL are removed.
+func (c *crashReporter) report(signal, exitCode int, since time.Time) (string, []string, error) {
+	now := time.Now()
+	dir, err := allocdir.OpenDirBeneath(c.allocDir, crashReportDir, true, 0755)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to open crash report directory: %v", err)
+	}
+	defer dir.Close()
+	c.prune(dir, now)
+
+	prefix := fmt.Sprintf("%s-%d", c.task, now.UnixNano())
+	c.lock.Lock()
+	r := &crashReport{
+		Task:      c.task,
+		Time:      now.UTC(),
+		Signal:    crashSignals[signal],
+		ExitCode:  exitCode,
+		Command:   c.command,
+		EnvKeys:   c.envKeys,
+		TaskDir:   c.taskDir,
+		LastStats: c.lastStats,
+		OpenFiles: c.openFiles,
+	}
+	c.lock.Unlock()
+	r.Cores = c.moveCores(dir, prefix, since)
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", r.Cores, fmt.Errorf("failed to encode crash report: %v", err)
+	}
+	name := prefix + ".json"
+	f, err := allocdir.OpenFileAt(dir, name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", r.Cores, fmt.Errorf("failed to write crash report: %v", err)
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", r.Cores, fmt.Errorf("failed to write crash report: %v", err)
+	}
+	return filepath.Join(dir.Name(), name), r.Cores, nil
+}
+
+// keepCores moves the core dumps the task wrote since it started into the
+// crash report directory without writing a report and returns their names.
+func (c *crashReporter) keepCores(since time.Time) ([]string, error) {
+	now := time.Now()
+	dir, err := allocdir.OpenDirBeneath(c.allocDir, crashReportDir, true, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open crash report directory: %v", err)
+	}
+	defer dir.Close()
+	c.prune(dir, now)
+	return c.moveCores(dir, fmt.Sprintf("%s-%d", c.task, now.UnixNano()), since), nil
+}
+
+// moveCores moves the core dumps the task wrote since it started into the
+// crash report directory dir and returns their new names. Entries of the
+// core dump directory are only accessed relative to it, and those that
+// aren't regular files, such as symbolic links, are left in place.
+func (c *crashReporter) moveCores(dir *os.File, prefix string, since time.Time) []string {
+	coreDir, err := allocdir.OpenDirBeneath(c.taskDir, c.coreDir, false, 0)
+	if err != nil {
+		return nil
+	}
+	defer coreDir.Close()
+	names, err := coreDir.Readdirnames(-1)
+	if err != nil {
+		return nil
+	}
+
+	var cores []string
+	since = since.Add(-coreMtimeSlack)
+	for _, name := range names {
+		if !c.isCore(name) {
+			continue
+		}
+		fi, err := statAt(coreDir, name)
+		if err != nil || !fi.Mode().IsRegular() || fi.ModTime().Before(since) {
+			continue
+		}
+		dest := fmt.Sprintf("%s-%s", prefix, name)
+		if err := allocdir.RenameAt(coreDir, name, dir, dest); err != nil {
+			continue
+		}
+
+		// The task may have replaced the core dump since it was checked
+		if moved, err := statAt(dir, dest); err != nil || !os.SameFile(fi, moved) {
+			allocdir.RemoveAt(dir, dest)
+			continue
+		}
+		cores = append(cores, dest)
+	}
+	return cores
+}
+
+// isCore returns whether name is the name of a core dump of the task.
+func (c *crashReporter) isCore(name string) bool {
+	if c.coreDir == "" {
+		return name == "core" || strings.HasPrefix(name, "core.")
+	}
+	return strings.HasPrefix(name, c.corePrefix)
+}
+
+// statAt returns the file info of the file name within the directory dir
+// without following it if it's a symbolic link or blocking if it's a FIFO.
+func statAt(dir *os.File, name string) (os.FileInfo, error) {
+	f, err := allocdir.OpenFileAt(dir, name, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// prune removes the crash reports and core dumps of the task in the crash
+// report directory dir that are older than the TTL.
+func (c *crashReporter) prune(dir *os.File, now time.Time) {
+	if _, err := dir.Seek(0, 0); err != nil {
+		return
+	}
+	entries, err := dir.Readdir(-1)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), c.task+"-") && now.Sub(e.ModTime()) > c.ttl {
+			allocdir.RemoveAt(dir, e.Name())
+		}
+	}
+}
+
+// openFiles returns the targets of the file descriptors of the processes from
+// the proc file system mounted at dir, keyed by pid.
+func openFiles(dir string, pids []int) map[string][]string {
+	files := make(map[string][]string, len(pids))
+	for _, pid := range pids {
+		fdDir := filepath.Join(dir, strconv.Itoa(pid), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+
+		var targets []string
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil {
+				continue
+			}
+			targets = append(targets, fmt.Sprintf("%s -> %s", fd.Name(), target))
+		}
+		sort.Strings(targets)
+		files[strconv.Itoa(pid)] = targets
+	}
+	return files
+}
+
+// envKeys returns the sorted names of the environment variables.
+func envKeys(env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
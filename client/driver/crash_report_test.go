@@ -0,0 +1,282 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	cstructs "github.com/hashicorp/nomad/client/structs"
+	"github.com/hashicorp/nomad/testutil"
+)
+
+func TestCrashReporter_Report(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "crash_report")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	taskDir := filepath.Join(dir, "web")
+	if err := os.MkdirAll(taskDir, 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, name := range []string{"core.123", "corefile"} {
+		if err := ioutil.WriteFile(filepath.Join(taskDir, name), []byte("core"), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	c := &crashReporter{
+		task:     "web",
+		taskDir:  taskDir,
+		allocDir: filepath.Join(dir, "alloc"),
+		ttl:      time.Hour,
+		command:  []string{"/bin/web", "-port", "80"},
+		envKeys:  envKeys(map[string]string{"SECRET": "hunter2", "HOME": "/"}),
+	}
+	c.observe(&cstructs.TaskResourceUsage{Timestamp: 1})
+
+	// A report of the task that outlived its TTL is removed
+	reportDir := filepath.Join(c.allocDir, crashReportDir)
+	if err := os.MkdirAll(reportDir, 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stale := filepath.Join(reportDir, "web-1.json")
+	if err := ioutil.WriteFile(stale, []byte("{}"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	path, cores, err := c.report(int(syscall.SIGABRT), 134, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("stale report wasn't removed: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if bytes.Contains(data, []byte("hunter2")) {
+		t.Fatalf("report contains an environment value: %s", data)
+	}
+	var r crashReport
+	if err := json.Unmarshal(data, &r); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if r.Signal != "SIGABRT" || r.ExitCode != 134 || r.LastStats == nil || r.TaskDir != taskDir {
+		t.Fatalf("bad report: %s", data)
+	}
+	if len(r.EnvKeys) != 2 || r.EnvKeys[0] != "HOME" || r.EnvKeys[1] != "SECRET" {
+		t.Fatalf("bad env keys: %v", r.EnvKeys)
+	}
+
+	// Only the core dump is moved next to the report
+	if len(r.Cores) != 1 || len(cores) != 1 || cores[0] != r.Cores[0] {
+		t.Fatalf("got cores %v and %v; want 1", r.Cores, cores)
+	}
+	if _, err := os.Stat(filepath.Join(reportDir, r.Cores[0])); err != nil {
+		t.Fatalf("core wasn't moved: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(taskDir, "corefile")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A symlink a task put in place of the report directory isn't followed
+	outside, err := ioutil.TempDir("", "crash_report")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	os.RemoveAll(reportDir)
+	if err := os.Symlink(outside, reportDir); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, _, err := c.report(int(syscall.SIGABRT), 134, time.Now()); err == nil {
+		t.Fatalf("expected error writing through a symlink")
+	}
+	if entries, _ := ioutil.ReadDir(outside); len(entries) != 0 {
+		t.Fatalf("report written outside of the alloc dir: %v", entries)
+	}
+}
+
+func TestCrashReporter_keepCores(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "crash_report")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	taskDir := filepath.Join(dir, "web")
+	coreDir := filepath.Join(taskDir, "var", "crash")
+	for _, path := range []string{coreDir, filepath.Join(dir, "alloc")} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for _, name := range []string{"app.core.123", "app.core.1", "web.log"} {
+		if err := ioutil.WriteFile(filepath.Join(coreDir, name), []byte("core"), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Cores left from before the task started aren't the task's
+	started := time.Now().Add(-time.Minute)
+	old := started.Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(coreDir, "app.core.1"), old, old); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Files the task links into its core dump directory aren't moved
+	outside := filepath.Join(dir, "host")
+	if err := ioutil.WriteFile(outside, []byte("host"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(coreDir, "app.core.2")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Link(outside, filepath.Join(coreDir, "app.core.3")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	c := &crashReporter{
+		task:       "web",
+		taskDir:    taskDir,
+		allocDir:   filepath.Join(dir, "alloc"),
+		ttl:        time.Hour,
+		coreDir:    "var/crash",
+		corePrefix: "app.core.",
+		coresOnly:  true,
+	}
+	cores, err := c.keepCores(started)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(cores) != 1 {
+		t.Fatalf("expected one core; got %v", cores)
+	}
+	if _, err := os.Stat(filepath.Join(c.allocDir, crashReportDir, cores[0])); err != nil {
+		t.Fatalf("core wasn't moved: %v", err)
+	}
+	for _, name := range []string{"app.core.1", "app.core.2", "app.core.3", "web.log"} {
+		if _, err := os.Lstat(filepath.Join(coreDir, name)); err != nil {
+			t.Fatalf("%s shouldn't have been moved: %v", name, err)
+		}
+	}
+
+	// A symlink the task put in place of its core dump directory isn't
+	// followed
+	if err := os.RemoveAll(filepath.Join(taskDir, "var")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	hostDir := filepath.Join(dir, "host-var")
+	if err := os.MkdirAll(filepath.Join(hostDir, "crash"), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	hostCore := filepath.Join(hostDir, "crash", "app.core.4")
+	if err := ioutil.WriteFile(hostCore, []byte("host"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Symlink(hostDir, filepath.Join(taskDir, "var")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if cores, err := c.keepCores(started); err != nil || len(cores) != 0 {
+		t.Fatalf("expected no cores moved through a symlink; got %v, %v", cores, err)
+	}
+	if _, err := os.Stat(hostCore); err != nil {
+		t.Fatalf("host file was moved: %v", err)
+	}
+}
+
+func TestCrashReporter_run(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "crash_report")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &crashReporter{
+		task:     "web",
+		allocDir: dir,
+		ttl:      50 * time.Millisecond,
+	}
+	reportDir := filepath.Join(dir, crashReportDir)
+	if err := os.MkdirAll(reportDir, 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	report := filepath.Join(reportDir, "web-1.json")
+	other := filepath.Join(reportDir, "api-1.json")
+	for _, path := range []string{report, other} {
+		if err := ioutil.WriteFile(path, []byte("{}"), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Reports of the task are removed once they outlived the TTL without
+	// waiting for the next crash
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.run(stopCh)
+	testutil.WaitForResult(func() (bool, error) {
+		if _, err := os.Stat(report); !os.IsNotExist(err) {
+			return false, fmt.Errorf("report wasn't removed: %v", err)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("report of another task was removed: %v", err)
+	}
+}
+
+func TestCrashReporter_isCrashSignal(t *testing.T) {
+	t.Parallel()
+	for sig, exp := range map[syscall.Signal]bool{
+		syscall.SIGSEGV: true,
+		syscall.SIGABRT: true,
+		syscall.SIGTERM: false,
+		syscall.SIGKILL: false,
+	} {
+		if act := isCrashSignal(int(sig)); act != exp {
+			t.Fatalf("isCrashSignal(%v) = %v; want %v", sig, act, exp)
+		}
+	}
+}
+
+func TestCrashReporter_openFiles(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "crash_report")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fdDir := filepath.Join(dir, "10", "fd")
+	if err := os.MkdirAll(fdDir, 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Symlink("/var/log/web.log", filepath.Join(fdDir, "3")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Processes that exited are skipped
+	files := openFiles(dir, []int{10, 11})
+	if len(files) != 1 || len(files["10"]) != 1 || files["10"][0] != "3 -> /var/log/web.log" {
+		t.Fatalf("bad open files: %v", files)
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"github.com/hashicorp/nomad/client/driver/env"
 	"github.com/hashicorp/nomad/client/driver/executor"
 	dstructs "github.com/hashicorp/nomad/client/driver/structs"
+	"github.com/hashicorp/nomad/client/stats"
 	cstructs "github.com/hashicorp/nomad/client/structs"
 	"github.com/hashicorp/nomad/helper"
 	"github.com/hashicorp/nomad/helper/fields"
@@ -52,7 +53,7 @@ var (
 
 	// The statistics the Docker driver exposes
 	DockerMeasuredMemStats = []string{"RSS", "Cache", "Swap", "Max Usage"}
-	DockerMeasuredCpuStats = []string{"Throttled Periods", "Throttled Time", "Percent"}
+	DockerMeasuredCpuStats = []string{"Throttled Periods", "Throttled Time", "Throttled Percent", "Percent"}
 
 	// recoverableErrTimeouts returns a recoverable error if the error was due
 	// to timeouts
@@ -1889,7 +1890,10 @@ func (h *DockerHandle) collectStats() {
 				cs := &cstructs.CpuStats{
 					ThrottledPeriods: s.CPUStats.ThrottlingData.ThrottledPeriods,
 					ThrottledTime:    s.CPUStats.ThrottlingData.ThrottledTime,
-					Measured:         DockerMeasuredCpuStats,
+					ThrottledPercent: stats.ThrottledPercent(
+						s.PreCPUStats.ThrottlingData.Periods, s.PreCPUStats.ThrottlingData.ThrottledPeriods,
+						s.CPUStats.ThrottlingData.Periods, s.CPUStats.ThrottlingData.ThrottledPeriods),
+					Measured: DockerMeasuredCpuStats,
 				}
 
 				// Calculate percentage
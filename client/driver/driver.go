@@ -8,6 +8,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"time"
 
 	"github.com/hashicorp/nomad/client/allocdir"
 	"github.com/hashicorp/nomad/client/config"
@@ -34,6 +35,10 @@ var (
 	// DriverStatsNotImplemented is the error to be returned if a driver doesn't
 	// implement stats.
 	DriverStatsNotImplemented = errors.New("stats not implemented for driver")
+
+	// ScriptExecSkipped is the error returned by ScriptExecutors that skip
+	// the Exec call because too many are running in the task.
+	ScriptExecSkipped = errors.New("exec skipped as the task's concurrent exec limit is reached")
 )
 
 // NewDriver is used to instantiate and return a new driver
@@ -235,6 +240,14 @@ type Driver interface {
 	// Drivers must validate their configuration
 	Validate(map[string]interface{}) error
 
+	// ValidateTask validates the task beyond its config without starting
+	// it, such as whether its command exists. It's only called once the
+	// config is valid and must not create anything or touch the filesystem
+	// beyond stat checks. Drivers without a node to check against,
+	// such as on servers, only validate what doesn't depend on the node.
+	// DriverContext implements it as a noop for drivers that don't.
+	ValidateTask(*structs.Task) error
+
 	// Abilities returns the abilities of the driver
 	Abilities() DriverAbilities
 
@@ -242,6 +255,13 @@ type Driver interface {
 	FSIsolation() cstructs.FSIsolation
 }
 
+// TaskFSIsolator is an optional interface for Drivers whose filesystem
+// isolation depends on the task's config. The task dir is built with the
+// returned isolation rather than the driver's.
+type TaskFSIsolator interface {
+	TaskFSIsolation(*structs.Task) cstructs.FSIsolation
+}
+
 // DriverAbilities marks the abilities the driver has.
 type DriverAbilities struct {
 	// SendSignals marks the driver as being able to send signals
@@ -250,6 +270,11 @@ type DriverAbilities struct {
 	// Exec marks the driver as being able to execute arbitrary commands
 	// such as health checks. Used by the ScriptExecutor interface.
 	Exec bool
+
+	// CombineLogs marks the driver as being able to write the task's stdout
+	// and stderr to a single set of log files, as set by the task's
+	// combine_logs.
+	CombineLogs bool
 }
 
 // LogEventFn is a callback which allows Drivers to emit task events.
@@ -274,6 +299,12 @@ func NewEmptyDriverContext() *DriverContext {
 	return &DriverContext{}
 }
 
+// ValidateTask is the default noop of drivers that don't validate tasks
+// beyond their config.
+func (d *DriverContext) ValidateTask(*structs.Task) error {
+	return nil
+}
+
 // NewDriverContext initializes a new DriverContext with the specified fields.
 // This enables other packages to create DriverContexts but keeps the fields
 // private to the driver. If we want to change this later we can gorename all of
@@ -317,12 +348,144 @@ type DriverHandle interface {
 	ScriptExecutor
 }
 
+// StackDumper is an optional interface for DriverHandles that can ask the task
+// to dump the stacks of its threads or goroutines to its logs.
+type StackDumper interface {
+	DumpStack() error
+}
+
+// GroupSignaler is an optional interface for DriverHandles that can signal
+// every process of the task rather than only its main process.
+type GroupSignaler interface {
+	SignalGroup(s os.Signal) error
+}
+
+// CgroupReader is an optional interface for DriverHandles that can return the
+// host path of the task's cgroup, such as for monitoring tools reading its
+// stats. An empty path is returned if the task isn't in a cgroup.
+type CgroupReader interface {
+	CgroupPath() string
+}
+
+// TaskIdentifier is an optional interface for DriverHandles that identify
+// their task with a stable ID. Unlike the task's PID, the ID is the same across
+// restarts of the task and reattaches of the handle, so it can be used to
+// correlate the task's logs and metrics.
+type TaskIdentifier interface {
+	TaskID() string
+}
+
+// Detacher is an optional interface for DriverHandles that can stop managing
+// their task without killing it, so that it can be reattached to by opening
+// the handle's ID. The client detaches from its tasks when it shuts down
+// outside of dev mode, such as to be upgraded.
+type Detacher interface {
+	Detach() error
+}
+
+// OutputReader is an optional interface for DriverHandles that can return the
+// most recent output of the task if its log config enables buffering.
+type OutputReader interface {
+	RecentOutput() (stdout, stderr []byte, err error)
+}
+
+// LogStreamer is an optional interface for DriverHandles that can stream the
+// log files of a stream of the task, "stdout", "stderr" or "output" if the
+// task combines its logs. Rotated files are read in order, starting with the
+// oldest, so that output isn't dropped when the files rotate. With follow, the
+// stream continues with new output until ctx is done or the reader is closed.
+type LogStreamer interface {
+	Logs(ctx context.Context, stream string, follow bool) (io.ReadCloser, error)
+}
+
+// StreamingExecutor is an optional interface for DriverHandles that can execute
+// commands in the task's context interactively. Stdin is streamed to the
+// command and its stdout and stderr to the writers as they're written. The
+// command's stdin is closed once stdin returns EOF. With tty, the command runs
+// in a pseudo terminal whose output is streamed to stdout. The exit code is
+// returned once the command exited.
+type StreamingExecutor interface {
+	ExecStreaming(ctx context.Context, cmd string, args []string, tty bool, stdin io.Reader, stdout, stderr io.Writer) (int, error)
+}
+
+// EnvironmentReader is an optional interface for DriverHandles that can return
+// the environment their task was started with, after interpolation. With
+// redact, the values of secrets such as the Vault token are redacted.
+type EnvironmentReader interface {
+	Environment(redact bool) map[string]string
+}
+
+// EventStreamer is an optional interface for DriverHandles that publish the
+// lifecycle transitions of their task. Events are buffered and dropped while
+// the consumer falls behind, except for the exited event, which is always
+// delivered before the channel is closed. Reattached handles first publish the current state of the task.
+type EventStreamer interface {
+	Events() <-chan *DriverEvent
+}
+
+// The types of DriverEvents
+const (
+	DriverEventStarting  = "starting"
+	DriverEventStarted   = "started"
+	DriverEventSignaled  = "signaled"
+	DriverEventKilled    = "killed"
+	DriverEventExited    = "exited"
+	DriverEventHealthy   = "healthy"
+	DriverEventUnhealthy = "unhealthy"
+)
+
+// DriverEvent is a lifecycle transition of a task published by an
+// EventStreamer.
+type DriverEvent struct {
+	// Type is one of the DriverEvent* constants
+	Type string
+
+	// TaskID is the stable ID of the task, if the handle has one
+	TaskID string
+
+	// Reason describes the transition
+	Reason string
+
+	// Time is when the transition occurred
+	Time time.Time
+}
+
+// HealthChecker is an optional interface for DriverHandles that check the
+// health of their task by running a command within it, independently of
+// Consul. Handles of tasks without a health check report HealthUnknown.
+type HealthChecker interface {
+	Health() HealthState
+}
+
+// HealthState is the health of a task reported by a HealthChecker.
+type HealthState string
+
+const (
+	// HealthUnknown is reported until the task's health check first
+	// completes, including after reattaching to the task.
+	HealthUnknown HealthState = "unknown"
+
+	// HealthHealthy is reported once the health check passed.
+	HealthHealthy HealthState = "healthy"
+
+	// HealthUnhealthy is reported once the health check failed its threshold
+	// of consecutive times.
+	HealthUnhealthy HealthState = "unhealthy"
+)
+
 // ScriptExecutor is an interface that supports Exec()ing commands in the
 // driver's context. Split out of DriverHandle to ease testing.
 type ScriptExecutor interface {
 	Exec(ctx context.Context, cmd string, args []string) ([]byte, int, error)
 }
 
+// SplitOutputExecutor is an optional interface for DriverHandles that can
+// Exec() commands returning their stdout and stderr separately, such as for
+// checks that parse stderr. Each is truncated to the last CheckBufSize bytes.
+type SplitOutputExecutor interface {
+	ExecSplitOutput(ctx context.Context, cmd string, args []string) (stdout, stderr []byte, code int, err error)
+}
+
 // ExecContext is a task's execution context
 type ExecContext struct {
 	// TaskDir contains information about the task directory structure.
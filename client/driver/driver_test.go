@@ -130,15 +130,20 @@ func testDriverContexts(t *testing.T, task *structs.Task) *testContext {
 		return nil
 	}
 
+	fsi := tmpdrv.FSIsolation()
+	if isolator, ok := tmpdrv.(TaskFSIsolator); ok {
+		fsi = isolator.TaskFSIsolation(task)
+	}
+
 	// Build the task dir
 	td := allocDir.NewTaskDir(task.Name)
-	if err := td.Build(false, config.DefaultChrootEnv, tmpdrv.FSIsolation()); err != nil {
+	if err := td.Build(false, config.DefaultChrootEnv, fsi); err != nil {
 		allocDir.Destroy()
-		t.Fatalf("TaskDir.Build(%#v, %q) failed: %v", config.DefaultChrootEnv, tmpdrv.FSIsolation(), err)
+		t.Fatalf("TaskDir.Build(%#v, %q) failed: %v", config.DefaultChrootEnv, fsi, err)
 		return nil
 	}
 	eb := env.NewBuilder(cfg.Node, alloc, task, cfg.Region)
-	SetEnvvars(eb, tmpdrv.FSIsolation(), td, cfg)
+	SetEnvvars(eb, fsi, td, cfg)
 	execCtx := NewExecContext(td, eb.Build())
 
 	logger := testLogger()
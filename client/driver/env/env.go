@@ -79,6 +79,17 @@ const (
 	// map is specified.
 	HostPortPrefix = "NOMAD_HOST_PORT_"
 
+	// MetricsPort is the port a task exposes metrics on, copied from the
+	// port of the label drivers are configured to expose metrics on.
+	MetricsPort = "NOMAD_METRICS_PORT"
+
+	// MetricsAddr is the host's ip:port a task exposes metrics on.
+	MetricsAddr = "NOMAD_METRICS_ADDR"
+
+	// WrappedCommand is the command of a task that drivers wrap in a
+	// command wrapper configured by the client.
+	WrappedCommand = "NOMAD_WRAPPED_COMMAND"
+
 	// MetaPrefix is the prefix for passing task meta data.
 	MetaPrefix = "NOMAD_META_"
 
@@ -192,6 +203,14 @@ type Builder struct {
 	// hostEnv are environment variables filtered from the host
 	hostEnv map[string]string
 
+	// hostEnvPassthrough, if not nil, are the only host environment
+	// variables passed through to the task
+	hostEnvPassthrough map[string]struct{}
+
+	// defaultEnv are environment variables the client configures for every
+	// task of a driver
+	defaultEnv map[string]string
+
 	// nodeAttrs are Node attributes and metadata
 	nodeAttrs map[string]string
 
@@ -332,15 +351,26 @@ func (b *Builder) Build() *TaskEnv {
 
 	// Interpolate and add environment variables
 	for k, v := range b.hostEnv {
+		if b.hostEnvPassthrough != nil {
+			if _, ok := b.hostEnvPassthrough[k]; !ok {
+				continue
+			}
+		}
 		envMap[k] = hargs.ReplaceEnv(v, nodeAttrs, envMap)
 	}
 
-	// Copy interpolated task env vars second as they override host env vars
+	// Copy interpolated default env vars second as they override host env
+	// vars
+	for k, v := range b.defaultEnv {
+		envMap[k] = hargs.ReplaceEnv(v, nodeAttrs, envMap)
+	}
+
+	// Copy interpolated task env vars third as they override default env vars
 	for k, v := range b.envvars {
 		envMap[k] = hargs.ReplaceEnv(v, nodeAttrs, envMap)
 	}
 
-	// Copy template env vars third as they override task env vars
+	// Copy template env vars fourth as they override task env vars
 	for k, v := range b.templateEnv {
 		envMap[k] = v
 	}
@@ -536,6 +566,29 @@ func (b *Builder) SetHostEnvvars(filter []string) *Builder {
 	return b
 }
 
+// SetHostEnvPassthrough limits the host environment variables added to the
+// task to the given keys. Keys filtered by SetHostEnvvars stay filtered.
+func (b *Builder) SetHostEnvPassthrough(keys []string) *Builder {
+	passthrough := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		passthrough[k] = struct{}{}
+	}
+
+	b.mu.Lock()
+	b.hostEnvPassthrough = passthrough
+	b.mu.Unlock()
+	return b
+}
+
+// SetDefaultEnv sets the environment variables the client configures for the
+// task's driver. Task environment variables take precedence over them.
+func (b *Builder) SetDefaultEnv(m map[string]string) *Builder {
+	b.mu.Lock()
+	b.defaultEnv = m
+	b.mu.Unlock()
+	return b
+}
+
 func (b *Builder) SetTemplateEnv(m map[string]string) *Builder {
 	b.mu.Lock()
 	b.templateEnv = m
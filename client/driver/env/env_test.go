@@ -267,6 +267,26 @@ func TestEnvironment_Envvars(t *testing.T) {
 	}
 }
 
+func TestEnvironment_DefaultEnv(t *testing.T) {
+	n := mock.Node()
+	n.NodeClass = "test class"
+	a := mock.Alloc()
+	task := a.Job.TaskGroups[0].Tasks[0]
+	task.Env = map[string]string{"HTTP_PROXY": "http://task-proxy"}
+	defaults := map[string]string{
+		"HTTP_PROXY":    "http://node-proxy",
+		"TELEMETRY_TAG": "${node.class}/${NOMAD_TASK_NAME}",
+	}
+	act := NewBuilder(n, a, task, "global").SetDefaultEnv(defaults).Build().Map()
+
+	if v := act["HTTP_PROXY"]; v != "http://task-proxy" {
+		t.Fatalf("expected task env to take precedence but found HTTP_PROXY=%q", v)
+	}
+	if exp := n.NodeClass + "/" + task.Name; act["TELEMETRY_TAG"] != exp {
+		t.Fatalf("expected TELEMETRY_TAG=%q but found %q", exp, act["TELEMETRY_TAG"])
+	}
+}
+
 func TestEnvironment_Interpolate(t *testing.T) {
 	n := mock.Node()
 	n.Attributes["arch"] = "x86"
@@ -311,6 +331,27 @@ func TestEnvironment_AppendHostEnvvars(t *testing.T) {
 	}
 }
 
+func TestEnvironment_HostEnvPassthrough(t *testing.T) {
+	os.Setenv("NOMAD_TEST_PASSTHROUGH_TZ", "UTC")
+	os.Setenv("NOMAD_TEST_PASSTHROUGH_LANG", "C.UTF-8")
+	defer os.Unsetenv("NOMAD_TEST_PASSTHROUGH_TZ")
+	defer os.Unsetenv("NOMAD_TEST_PASSTHROUGH_LANG")
+
+	act := testEnvBuilder().
+		SetHostEnvvars(nil).
+		SetHostEnvPassthrough([]string{"NOMAD_TEST_PASSTHROUGH_TZ", "NOMAD_TEST_PASSTHROUGH_MISSING"}).
+		Build().Map()
+
+	if v := act["NOMAD_TEST_PASSTHROUGH_TZ"]; v != "UTC" {
+		t.Fatalf("expected NOMAD_TEST_PASSTHROUGH_TZ=UTC to be passed through but found %q", v)
+	}
+	for _, k := range []string{"NOMAD_TEST_PASSTHROUGH_LANG", "NOMAD_TEST_PASSTHROUGH_MISSING", "PATH"} {
+		if _, ok := act[k]; ok {
+			t.Fatalf("expected %q not to be passed through", k)
+		}
+	}
+}
+
 // TestEnvironment_DashesInTaskName asserts dashes in port labels are properly
 // converted to underscores in environment variables.
 // See: https://github.com/hashicorp/nomad/issues/2405
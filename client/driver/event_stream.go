@@ -0,0 +1,79 @@
+package driver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// eventStreamBuffer is the number of events buffered for a slow consumer
+// before further events are dropped.
+const eventStreamBuffer = 16
+
+// eventStream publishes the lifecycle transitions of a task handle on a
+// buffered channel. Publishing never blocks: events are dropped while the
+// buffer is full so that a slow consumer can't stall the handle. The exited
+// event is never dropped; the oldest buffered event makes room for it instead.
+type eventStream struct {
+	taskID string
+	ch     chan *DriverEvent
+	closed bool
+	lock   sync.Mutex
+}
+
+// newEventStream returns an empty eventStream for the task with the given ID.
+func newEventStream(taskID string) *eventStream {
+	return &eventStream{
+		taskID: taskID,
+		ch:     make(chan *DriverEvent, eventStreamBuffer),
+	}
+}
+
+// Events returns the channel events are published on. It's closed after the
+// exited event.
+func (s *eventStream) Events() <-chan *DriverEvent {
+	return s.ch
+}
+
+// publish publishes an event of the given type that occurred at the given
+// time. It returns false if the event was dropped.
+func (s *eventStream) publish(at time.Time, typ, reason string, args ...interface{}) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	event := &DriverEvent{
+		Type:   typ,
+		TaskID: s.taskID,
+		Reason: fmt.Sprintf(reason, args...),
+		Time:   at,
+	}
+	var sent bool
+	select {
+	case s.ch <- event:
+		sent = true
+	default:
+	}
+
+	// Consumers need the exited event to know the task is gone. Only
+	// publishers send while holding the lock, so once the oldest event is
+	// dropped there's room for it.
+	if !sent && typ == DriverEventExited {
+		select {
+		case <-s.ch:
+		default:
+		}
+		s.ch <- event
+		sent = true
+	}
+
+	// Nothing is published after the task exited
+	if typ == DriverEventExited {
+		s.closed = true
+		close(s.ch)
+	}
+	return sent
+}
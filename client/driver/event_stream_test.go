@@ -0,0 +1,60 @@
+package driver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventStream_Publish(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	s := newEventStream("3f1c2a4e-8d9b-5c6f-a7e8-1b2c3d4e5f60")
+	now := time.Now()
+	require.True(s.publish(now, DriverEventStarted, "Started command with pid %d", 42))
+
+	event := <-s.Events()
+	require.Equal(DriverEventStarted, event.Type)
+	require.Equal("3f1c2a4e-8d9b-5c6f-a7e8-1b2c3d4e5f60", event.TaskID)
+	require.Equal("Started command with pid 42", event.Reason)
+	require.Equal(now, event.Time)
+}
+
+func TestEventStream_DropsWhenFull(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Publishing to a full buffer doesn't block
+	s := newEventStream("")
+	for i := 0; i < eventStreamBuffer; i++ {
+		require.True(s.publish(time.Now(), DriverEventSignaled, "Sent %d", i))
+	}
+	require.False(s.publish(time.Now(), DriverEventSignaled, "dropped"))
+
+	// The exited event replaces the oldest event rather than being dropped
+	require.True(s.publish(time.Now(), DriverEventExited, "exited"))
+	var events []*DriverEvent
+	for event := range s.Events() {
+		events = append(events, event)
+	}
+	require.Len(events, eventStreamBuffer)
+	require.Equal("Sent 1", events[0].Reason)
+	require.Equal(DriverEventExited, events[len(events)-1].Type)
+}
+
+func TestEventStream_ClosedAfterExit(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	s := newEventStream("")
+	require.True(s.publish(time.Now(), DriverEventExited, "exited"))
+	require.False(s.publish(time.Now(), DriverEventKilled, "killed"))
+
+	event, ok := <-s.Events()
+	require.True(ok)
+	require.Equal(DriverEventExited, event.Type)
+	_, ok = <-s.Events()
+	require.False(ok)
+}
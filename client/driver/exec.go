@@ -1,25 +1,223 @@
 package driver
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
+	"os/exec"
+	"os/user"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/armon/circbuf"
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/consul-template/signals"
 	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/go-plugin"
 	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/client/driver/env"
 	"github.com/hashicorp/nomad/client/driver/executor"
+	"github.com/hashicorp/nomad/client/driver/logging"
 	dstructs "github.com/hashicorp/nomad/client/driver/structs"
 	cstructs "github.com/hashicorp/nomad/client/structs"
 	"github.com/hashicorp/nomad/helper/fields"
+	"github.com/hashicorp/nomad/helper/stats"
 	"github.com/hashicorp/nomad/nomad/structs"
 	"github.com/mitchellh/mapstructure"
 )
 
+const (
+	// defaultStackDumpSignal is sent to dump a task's stacks if none is
+	// configured. Go binaries write a dump of all goroutines on SIGQUIT.
+	defaultStackDumpSignal = "SIGQUIT"
+
+	// defaultPreKillTimeout is how long the pre_kill_command runs before the
+	// task is killed anyway if no timeout is configured.
+	defaultPreKillTimeout = 10 * time.Second
+
+	// maxPreKillTimeout bounds the pre_kill_timeout as killing the task
+	// blocks for it.
+	maxPreKillTimeout = 5 * time.Minute
+
+	// defaultPostStartTimeout is how long the post_start_command runs before
+	// it's stopped if no timeout is configured.
+	defaultPostStartTimeout = 10 * time.Second
+
+	// maxPostStartTimeout bounds the post_start_timeout as starting the task
+	// blocks for it.
+	maxPostStartTimeout = 5 * time.Minute
+
+	// defaultDevicePermissions are the device cgroup permissions granted to
+	// a device that doesn't set any: read, write and mknod.
+	defaultDevicePermissions = "rwm"
+
+	// maxStartConfirmation bounds the start_confirmation window as starting
+	// the task blocks for it.
+	maxStartConfirmation = 30 * time.Second
+
+	// defaultMemorySoftLimitGrace is how long a task may exceed its
+	// memory_soft_limit before it's killed if no grace is configured.
+	defaultMemorySoftLimitGrace = 30 * time.Second
+
+	// minMemorySoftLimitGrace is how often the executor checks the memory
+	// usage of the task, so shorter grace periods can't be enforced.
+	minMemorySoftLimitGrace = time.Second
+
+	// maxOOMScoreAdj is the highest oom_score_adj, making the task the first
+	// to be picked by the OOM killer.
+	maxOOMScoreAdj = 1000
+
+	// minIOWeight and maxIOWeight bound the blkio weight of tasks.
+	minIOWeight = 10
+	maxIOWeight = 1000
+
+	// minNice and maxNice bound the nice value of tasks, from the highest
+	// scheduling priority to the lowest.
+	minNice = -20
+	maxNice = 19
+
+	// execMemoryCheckConfigOption is the key for checking that the node has
+	// enough available memory for a task before starting it.
+	execMemoryCheckConfigOption = "driver.exec.memory_check"
+
+	// execMemoryHeadroomConfigOption is the key for the memory in MB that
+	// must remain available in addition to the task's memory.
+	execMemoryHeadroomConfigOption = "driver.exec.memory_headroom"
+
+	// execCpusetPolicyConfigOption is the key for the policy applied when a
+	// task is pinned to cores another task is already pinned to.
+	execCpusetPolicyConfigOption = "driver.exec.cpuset_policy"
+
+	// execEnvConfigPrefix is the prefix of the keys of environment variables
+	// set for every exec task, such as "driver.exec.env.HTTP_PROXY".
+	execEnvConfigPrefix = "driver.exec.env."
+
+	// execEnvSecretsConfigOption is the key for the list of default
+	// environment variables whose values are redacted from logs and never
+	// exported.
+	execEnvSecretsConfigOption = "driver.exec.env_secrets"
+
+	// execAllowCapsConfigOption is the key for the list of capabilities
+	// tasks may add with cap_add. Tasks can't add any capability by default.
+	execAllowCapsConfigOption = "driver.exec.allow_caps"
+
+	// execAllowGroupsConfigOption is the key for the list of groups tasks
+	// may run with through group and groups. Tasks can't run with any group
+	// by default, as groups such as disk grant access to the host.
+	execAllowGroupsConfigOption = "driver.exec.allow_groups"
+
+	// execDenyGroupsConfigOption is the key for the list of groups tasks may
+	// never run with through group and groups, even if they're allowed.
+	execDenyGroupsConfigOption = "driver.exec.deny_groups"
+
+	// execDefaultDenyGroups denies the root group unless the operator
+	// configures the denylist.
+	execDefaultDenyGroups = "0"
+
+	// execUlimitMaxConfigPrefix is the prefix of the keys of the highest
+	// hard limit tasks may set for a ulimit, such as
+	// "driver.exec.ulimit_max.nofile". Tasks can't raise the hard limit of
+	// a ulimit without one above the client's own.
+	execUlimitMaxConfigPrefix = "driver.exec.ulimit_max."
+
+	// execCommandWrapperConfigOption is the key for the path, within the
+	// chroot, of a binary every task's command is wrapped in. The wrapper
+	// is passed the command and its arguments and is expected to exec them.
+	execCommandWrapperConfigOption = "driver.exec.command_wrapper"
+
+	// execNoChrootConfigOption is the key for allowing tasks to disable their
+	// chroot with no_chroot and run against the host's root. It's disabled
+	// by default as nothing keeps such tasks from the host's files.
+	execNoChrootConfigOption = "driver.exec.no_chroot.enable"
+
+	// execChrootMountsConfigOption is the key for allowing tasks to bind
+	// mount host paths into their chroot with chroot_mounts. It's disabled
+	// by default as the host paths are exposed to the task.
+	execChrootMountsConfigOption = "driver.exec.chroot_mounts.enable"
+
+	// execOOMDisableJobsConfigOption is the key for the list of jobs whose
+	// tasks may disable the OOM killer of their cgroup with oom_disable. No
+	// job may by default as a cgroup out of memory without an OOM killer can
+	// deadlock.
+	execOOMDisableJobsConfigOption = "driver.exec.oom_disable.allowed_jobs"
+
+	// execFingerprintPeriodConfigOption is the key for the interval the
+	// driver's capabilities are re-fingerprinted at. Zero disables it.
+	execFingerprintPeriodConfigOption = "driver.exec.fingerprint_period"
+
+	// defaultExecFingerprintPeriod is the default interval the driver's
+	// capabilities are re-fingerprinted at.
+	defaultExecFingerprintPeriod = 15 * time.Second
+
+	// execMinStartIntervalConfigOption is the key for the minimum interval
+	// between starts of the same task. Zero disables the throttling.
+	execMinStartIntervalConfigOption = "driver.exec.min_start_interval"
+
+	// execMinNiceConfigOption is the key for the lowest nice value tasks may
+	// set. It defaults to 0 so that tasks can't raise their scheduling
+	// priority above that of the client's other tasks.
+	execMinNiceConfigOption = "driver.exec.min_nice"
+
+	// execStatsIntervalConfigOption is the key for how long a sample of a
+	// task's stats is reused for. Zero samples the stats on every call.
+	execStatsIntervalConfigOption = "driver.exec.stats_interval"
+
+	// defaultExecStatsInterval is the default interval a task's stats are
+	// sampled at, shorter than the default collection interval.
+	defaultExecStatsInterval = 500 * time.Millisecond
+
+	// execShellAttrPrefix is the prefix of the Node Attributes set to "1" for
+	// each shell found in /bin of the chroot, such as "driver.exec.shell.sh"
+	execShellAttrPrefix = "driver.exec.shell."
+
+	// execDeviceAttrPrefix is the prefix of the Node Attributes set to "1"
+	// for each device tasks commonly list found on the host, named by its
+	// path within /dev with dots for slashes, such as
+	// "driver.exec.devices.net.tun"
+	execDeviceAttrPrefix = "driver.exec.devices."
+
+	// defaultTmpfsMemoryFraction divides the task's memory into the default
+	// size of a tmpfs, as its contents are charged to the task's memory.
+	defaultTmpfsMemoryFraction = 2
+
+	// scratchDirMode is the mode of scratch directories. The setgid bit
+	// makes files created within them inherit the directory's group.
+	scratchDirMode = os.ModeSetgid | 0770
+
+	// listenFdsEnv and listenFdNamesEnv tell socket activated tasks the
+	// number and names of the sockets passed to them, as systemd does.
+	listenFdsEnv     = "LISTEN_FDS"
+	listenFdNamesEnv = "LISTEN_FDNAMES"
+)
+
+// execShells are the shells the fingerprint looks for in /bin of the chroot
+// so that jobs can constrain on the shells their commands run with.
+var execShells = []string{"bash", "dash", "sh"}
+
+// envNameRe matches the names of environment variables tasks may inherit from
+// the host.
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// execDevices are the patterns of the devices the fingerprint looks for so
+// that jobs can constrain on the devices they list.
+var execDevices = []string{"/dev/kvm", "/dev/fuse", "/dev/net/tun", "/dev/vhost-net", "/dev/vhost-vsock", "/dev/dri/renderD*", "/dev/nvidia[0-9]*"}
+
+// reservedChrootDirs are the directories of the chroot managed by the client,
+// which chroot mounts and tmpfs can't be mounted within.
+var reservedChrootDirs = []string{allocdir.SharedAllocName, allocdir.TaskLocal, allocdir.TaskSecrets, "dev", "proc"}
+
 // ExecDriver fork/execs tasks using as many of the underlying OS's isolation
 // features.
 type ExecDriver struct {
@@ -28,11 +226,375 @@ type ExecDriver struct {
 	// A tri-state boolean to know if the fingerprinting has happened and
 	// whether it has been successful
 	fingerprintSuccess *bool
+
+	// capabilities are the dynamic attributes of the last fingerprint, used
+	// to log when they change
+	capabilities map[string]string
+
+	// taskID is the stable ID of the driver's task. It's empty unless the
+	// driver was created for a task.
+	taskID string
 }
 
 type ExecDriverConfig struct {
-	Command string   `mapstructure:"command"`
-	Args    []string `mapstructure:"args"`
+	Command           string              `mapstructure:"command"`
+	Args              []string            `mapstructure:"args"`
+	SignalCoalesceRaw []map[string]string `mapstructure:"signal_coalesce"`
+	ExportEnv         bool                `mapstructure:"export_env"`
+	ExportEnvExclude  []string            `mapstructure:"export_env_exclude"`
+	StackDumpSignal   string              `mapstructure:"stack_dump_signal"`
+	PidFile           string              `mapstructure:"pid_file"`
+	Cpuset            string              `mapstructure:"cpuset"`
+	CpusetCpus        string              `mapstructure:"cpuset_cpus"`
+	ScratchDir        string              `mapstructure:"scratch_dir"`
+	ScratchGroup      string              `mapstructure:"scratch_group"`
+
+	// ResolveCommandEachStart embeds the command into the chroot again on
+	// every start so that symlinks flipped on the host are followed.
+	ResolveCommandEachStart bool `mapstructure:"resolve_command_each_start"`
+
+	// MetricsPort is the label of the port the task exposes metrics on.
+	MetricsPort string `mapstructure:"metrics_port"`
+
+	// SocketActivation is the label of the port the driver listens on and
+	// passes to the task as its first socket activated file descriptor.
+	SocketActivation string `mapstructure:"socket_activation"`
+
+	// TrackCgroup waits for and kills all processes in the task's cgroup
+	// rather than only the command so that daemonizing commands are tracked.
+	TrackCgroup bool `mapstructure:"track_cgroup"`
+
+	// StatsFile is the path, relative to the task directory, the task's
+	// resource usage is periodically appended to as JSON lines.
+	StatsFile         string `mapstructure:"stats_file"`
+	StatsFileInterval string `mapstructure:"stats_file_interval"`
+	StatsFileMaxMB    int    `mapstructure:"stats_file_max_mb"`
+
+	// MaxThreads limits the processes and threads of the task's user through
+	// RLIMIT_NPROC. ThreadsThreshold is the thread count of the task at which
+	// an event is emitted and defaults to 90% of MaxThreads.
+	MaxThreads       int `mapstructure:"max_threads"`
+	ThreadsThreshold int `mapstructure:"threads_threshold"`
+
+	// CrashReport writes a crash report to the alloc dir and keeps the task's
+	// core dumps if the task dies from a crash signal. Reports are removed
+	// once they're older than CrashReportTTL.
+	CrashReport    bool   `mapstructure:"crash_report"`
+	CrashReportTTL string `mapstructure:"crash_report_ttl"`
+
+	// CoreDump raises the task's soft core size limit to its hard limit and
+	// moves the core dumps it writes into its task directory to the crash
+	// report directory once it exits, where they're kept for CrashReportTTL.
+	CoreDump bool `mapstructure:"core_dump"`
+
+	// PreKillCommand is run with PreKillArgs within the task's chroot and
+	// cgroup before the task is killed, for at most PreKillTimeout.
+	PreKillCommand string   `mapstructure:"pre_kill_command"`
+	PreKillArgs    []string `mapstructure:"pre_kill_args"`
+	PreKillTimeout string   `mapstructure:"pre_kill_timeout"`
+
+	// PostStartCommand is run with PostStartArgs within the task's chroot
+	// and cgroup once the task has started, for at most PostStartTimeout. If
+	// PostStartFatal is set the task fails to start if the command fails.
+	PostStartCommand string   `mapstructure:"post_start_command"`
+	PostStartArgs    []string `mapstructure:"post_start_args"`
+	PostStartTimeout string   `mapstructure:"post_start_timeout"`
+	PostStartFatal   bool     `mapstructure:"post_start_fatal"`
+
+	// ReapHookProcesses kills the background processes the pre-kill and
+	// post-start commands, and other commands exec'd within the task, leave
+	// running once they exit rather than leaving them running until the task
+	// exits.
+	ReapHookProcesses bool `mapstructure:"reap_hook_processes"`
+
+	// HealthCheck is run within the task to check its health, independently
+	// of Consul. At most one may be set.
+	HealthCheck []*ExecHealthCheck `mapstructure:"health_check"`
+
+	// Readiness gates Start on the task being ready. At most one may be set.
+	Readiness []*ExecReadiness `mapstructure:"readiness"`
+
+	// StartConfirmation is the window after starting the task in which the
+	// executor confirms that it exec'd and didn't fail before returning.
+	StartConfirmation string `mapstructure:"start_confirmation"`
+
+	// SkipABICheck skips checking that the command's architecture and glibc
+	// version are compatible with the node before starting it.
+	SkipABICheck bool `mapstructure:"skip_abi_check"`
+
+	// OOMScoreAdj raises the chance of the task being picked by the OOM
+	// killer when the node runs out of memory.
+	OOMScoreAdj int `mapstructure:"oom_score_adj"`
+
+	// Umask is the octal file mode creation mask the task is started with.
+	Umask string `mapstructure:"umask"`
+
+	// Nice is the scheduling priority the task is started with, from -20 to
+	// 19. Higher values lower the priority.
+	Nice int `mapstructure:"nice"`
+
+	// NoSwap limits the task's memory and swap to its memory limit so that
+	// it can't swap.
+	NoSwap bool `mapstructure:"no_swap"`
+
+	// OOMDisable disables the OOM killer of the task's memory cgroup so that
+	// the task is paused rather than killed when it runs out of memory.
+	OOMDisable bool `mapstructure:"oom_disable"`
+
+	// EnvFile is the path, relative to the task dir, of a file of KEY=VALUE
+	// lines merged into the task's environment when it's started. The task
+	// fails to start if it doesn't exist, unless EnvFileOptional is set.
+	EnvFile         string `mapstructure:"env_file"`
+	EnvFileOptional bool   `mapstructure:"env_file_optional"`
+
+	// HostEnvPassthrough, if set, are the only host environment variables
+	// the task inherits rather than every one not in the client's
+	// env.blacklist. The task's own environment takes precedence over them.
+	HostEnvPassthrough []string `mapstructure:"host_env_passthrough"`
+
+	// WorkDir is the directory, relative to the task dir, the task is
+	// started in. By default it's started at the root of the task dir.
+	WorkDir string `mapstructure:"work_dir"`
+
+	// Ulimit are the resource limits, keyed by name, the task is started
+	// with.
+	Ulimit []map[string]string `mapstructure:"ulimit"`
+
+	// CapAdd are the capabilities granted to the task even if it doesn't
+	// run as root and CapDrop the ones it can never gain.
+	CapAdd  []string `mapstructure:"cap_add"`
+	CapDrop []string `mapstructure:"cap_drop"`
+
+	// NetworkMode is either "host", the default, or "bridge" to run the task
+	// in its own network namespace attached to a host bridge.
+	NetworkMode string `mapstructure:"network_mode"`
+
+	// Userns runs the task as root of a user namespace whose ids are mapped
+	// to subordinate ids of the userns owner rather than the host's ids.
+	Userns []*ExecUserns `mapstructure:"userns"`
+
+	// KillEscalationSignal is sent to the task's process group if it's still
+	// running half of its kill timeout after being sent its kill signal.
+	KillEscalationSignal string `mapstructure:"kill_escalation_signal"`
+
+	// SignalProcessGroup starts the task in its own process group and sends
+	// signals to the whole group rather than only the task's process.
+	SignalProcessGroup bool `mapstructure:"signal_process_group"`
+
+	// ResetSignals starts the task with the default disposition of every
+	// signal, even those the client was started ignoring.
+	ResetSignals bool `mapstructure:"reset_signals"`
+
+	// IgnoreSignals are the names of the signals the task is started
+	// ignoring, such as "SIGPIPE" for tasks that check write errors instead.
+	IgnoreSignals []string `mapstructure:"ignore_signals"`
+
+	// MemorySoftLimit is the memory usage in MB above which the task is
+	// killed once it stayed above it for MemorySoftLimitGrace. It must be
+	// below the task's memory limit, which still throttles the task.
+	MemorySoftLimit      int    `mapstructure:"memory_soft_limit"`
+	MemorySoftLimitGrace string `mapstructure:"memory_soft_limit_grace"`
+
+	// NoChroot runs the task against the host's root rather than in a
+	// chroot, still limiting its resources. The client must allow it.
+	NoChroot bool `mapstructure:"no_chroot"`
+
+	// ChrootMounts are host paths bind mounted into the task's chroot.
+	ChrootMounts []*ExecChrootMount `mapstructure:"chroot_mounts"`
+
+	// Tmpfs are memory backed file systems mounted into the task's chroot.
+	Tmpfs []*ExecTmpfsMount `mapstructure:"tmpfs"`
+
+	// SecretFiles maps the names of files written to the task's secrets dir
+	// to their contents. The variables interpolated into them are removed
+	// from the task's environment.
+	SecretFiles map[string]string `mapstructure:"secret_files"`
+
+	// ReadonlyRootfs mounts the root of the task's chroot read-only, leaving
+	// only the alloc dir, the secrets dir and the tmpfs mounts writable.
+	ReadonlyRootfs bool `mapstructure:"readonly_rootfs"`
+
+	// IOWeight is the relative weight, from 10 to 1000, of the task's block
+	// I/O. It takes precedence over the task's IOPS resource.
+	IOWeight int `mapstructure:"io_weight"`
+
+	// IOLimits cap the block I/O bandwidth of the task per device.
+	IOLimits []*ExecIOLimit `mapstructure:"io_limit"`
+
+	// Devices are the device nodes of the host the task may access. Tasks
+	// setting them may only access them and the default devices.
+	Devices []*ExecDevice `mapstructure:"devices"`
+
+	// Group overrides the primary group of the task's user.
+	Group string `mapstructure:"group"`
+
+	// Groups are added to the supplementary groups of the task's user.
+	Groups []string `mapstructure:"groups"`
+}
+
+// taskGroups returns the groups the task runs with through group and groups.
+func (c *ExecDriverConfig) taskGroups() []string {
+	var groups []string
+	if c.Group != "" {
+		groups = append(groups, c.Group)
+	}
+	return append(groups, c.Groups...)
+}
+
+// cpuset returns the cores the task is pinned to, set by either cpuset or its
+// alias cpuset_cpus.
+func (c *ExecDriverConfig) cpuset() string {
+	if c.CpusetCpus != "" {
+		return c.CpusetCpus
+	}
+	return c.Cpuset
+}
+
+// ulimits parses the resource limits the task is started with.
+func (c *ExecDriverConfig) ulimits() ([]*executor.Ulimit, error) {
+	return executor.ParseUlimits(mapMergeStrStr(c.Ulimit...))
+}
+
+// checkUlimitsAllowed returns an error if any of the task's ulimits sets a
+// hard limit above the client's maximum for it, which is the client's own
+// hard limit unless the operator configured one.
+func checkUlimitsAllowed(conf *config.Config, ulimits []map[string]string) error {
+	parsed, err := executor.ParseUlimits(mapMergeStrStr(ulimits...))
+	if err != nil {
+		return err
+	}
+
+	for _, u := range parsed {
+		key := execUlimitMaxConfigPrefix + u.Name
+		var max uint64
+		if raw := conf.Read(key); raw != "" {
+			limits, err := executor.ParseUlimits(map[string]string{u.Name: raw})
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", key, err)
+			}
+			max = limits[0].Hard
+		} else if max, err = executor.HardUlimit(u.Name); err != nil {
+			return err
+		}
+
+		if u.Hard > max {
+			return fmt.Errorf("hard limit of ulimit %s exceeds the client's maximum of %s; set %q to raise it",
+				u.Name, executor.FormatUlimitValue(max), key)
+		}
+	}
+	return nil
+}
+
+// ExecChrootMount is a host path bind mounted into the chroot of a task.
+type ExecChrootMount struct {
+	HostPath string `mapstructure:"host_path"`
+	TaskPath string `mapstructure:"task_path"`
+	ReadOnly bool   `mapstructure:"readonly"`
+}
+
+// ExecIOLimit caps the bandwidth, in bytes per second, of the block I/O of a
+// task to a device. Zero leaves a direction unlimited.
+type ExecIOLimit struct {
+	Device   string `mapstructure:"device"`
+	ReadBps  int64  `mapstructure:"read_bps"`
+	WriteBps int64  `mapstructure:"write_bps"`
+}
+
+// ExecDevice is a device node of the host a task may access, at the same path
+// within its chroot, with the device cgroup permissions, a combination of
+// "r", "w" and "m". All of them are granted if they're empty.
+type ExecDevice struct {
+	Path        string `mapstructure:"path"`
+	Permissions string `mapstructure:"permissions"`
+}
+
+// ExecHealthCheck is a command run with its arguments within a task every
+// interval, for at most timeout, to check the task's health. The task is
+// unhealthy once it fails threshold consecutive times.
+type ExecHealthCheck struct {
+	Command   string   `mapstructure:"command"`
+	Args      []string `mapstructure:"args"`
+	Interval  string   `mapstructure:"interval"`
+	Timeout   string   `mapstructure:"timeout"`
+	Threshold int      `mapstructure:"threshold"`
+}
+
+// ExecReadiness is a condition Start waits for, for at most timeout, before
+// the task is considered started: a file existing within the task's chroot,
+// a TCP address accepting connections or a sentinel written to stdout.
+type ExecReadiness struct {
+	File    string `mapstructure:"file"`
+	TCP     string `mapstructure:"tcp"`
+	Stdout  string `mapstructure:"stdout"`
+	Timeout string `mapstructure:"timeout"`
+}
+
+// ioLimits resolves the devices of the task's I/O limits.
+func (c *ExecDriverConfig) ioLimits() ([]*executor.IOLimit, error) {
+	limits := make([]*executor.IOLimit, len(c.IOLimits))
+	for i, l := range c.IOLimits {
+		major, minor, err := blockDevice(l.Device)
+		if err != nil {
+			return nil, fmt.Errorf("invalid io_limit device %q: %v", l.Device, err)
+		}
+		limits[i] = &executor.IOLimit{
+			Major:    major,
+			Minor:    minor,
+			ReadBps:  uint64(l.ReadBps),
+			WriteBps: uint64(l.WriteBps),
+		}
+	}
+	return limits, nil
+}
+
+// devices resolves the device nodes of the task's devices.
+func (c *ExecDriverConfig) devices() ([]*executor.Device, error) {
+	devices := make([]*executor.Device, len(c.Devices))
+	for i, d := range c.Devices {
+		path := filepath.Clean(d.Path)
+		typ, major, minor, err := deviceNode(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device %q: %v", d.Path, err)
+		}
+		permissions := d.Permissions
+		if permissions == "" {
+			permissions = defaultDevicePermissions
+		}
+		devices[i] = &executor.Device{
+			Path:        path,
+			Type:        typ,
+			Major:       major,
+			Minor:       minor,
+			Permissions: permissions,
+		}
+	}
+	return devices, nil
+}
+
+// ExecTmpfsMount is a tmpfs mounted into the chroot of a task.
+type ExecTmpfsMount struct {
+	Path   string `mapstructure:"path"`
+	SizeMB int    `mapstructure:"size_mb"`
+}
+
+// tmpfsMounts returns the tmpfs mounted into the chroot of the task. Mounts
+// without a size default to a fraction of the task's memory.
+func (c *ExecDriverConfig) tmpfsMounts(task *structs.Task) []*executor.TmpfsMount {
+	mounts := make([]*executor.TmpfsMount, len(c.Tmpfs))
+	for i, m := range c.Tmpfs {
+		size := m.SizeMB
+		if size == 0 && task.Resources != nil {
+			size = task.Resources.MemoryMB / defaultTmpfsMemoryFraction
+		}
+		if size == 0 {
+			size = 1
+		}
+		mounts[i] = &executor.TmpfsMount{
+			TaskPath: m.Path,
+			SizeMB:   size,
+		}
+	}
+	return mounts
 }
 
 // execHandle is returned from Start/Open as a handle to the PID
@@ -48,11 +610,110 @@ type execHandle struct {
 	waitCh          chan *dstructs.WaitResult
 	doneCh          chan struct{}
 	version         string
+
+	// detachCh is closed once the handle is detached from the task, which
+	// keeps running.
+	detachCh   chan struct{}
+	detachOnce sync.Once
+
+	// taskID is the stable ID of the task. It's persisted in the handle ID
+	// so that reattached handles report the same ID.
+	taskID string
+
+	// signalCoalesce is the per signal coalescing window and is persisted in
+	// the handle ID so that reattached handles keep coalescing signals.
+	signalCoalesce  map[string]time.Duration
+	signalCoalescer *signalCoalescer
+
+	// stackDumpSignal is sent to the task to ask it to dump its stacks
+	stackDumpSignal string
+
+	// preKillCommand is the command and arguments run within the task before
+	// it's killed, if any, for at most preKillTimeout.
+	preKillCommand []string
+	preKillTimeout time.Duration
+
+	// pidFile is the host path of the file the user process's PID is
+	// written to, if any. It is removed when the task exits.
+	pidFile string
+
+	// cpuset is the set of cores the task is pinned to, if any, and cpusetID
+	// the ID the cores are tracked under. They're released when the task
+	// exits.
+	cpuset   string
+	cpusetID string
+
+	// bridgeAddr is the task's address on the host bridge, if any, and
+	// bridgeID the ID it's allocated under. It's released when the task
+	// exits.
+	bridgeAddr string
+	bridgeID   string
+
+	// userns maps the ids of the task's user namespace, if any, to the
+	// subordinate ids allocated under usernsID. They're released when the
+	// task exits.
+	userns   *executor.UserNamespace
+	usernsID string
+
+	// statsFile is the host path of the file the task's stats are appended
+	// to every statsFileInterval, if any. It's rotated once it exceeds
+	// statsFileMaxBytes.
+	statsFile         string
+	statsFileInterval time.Duration
+	statsFileMaxBytes int64
+
+	// threadsThreshold is the thread count at which an event is emitted. The
+	// threads aren't counted if it's zero.
+	threadsThreshold int
+
+	// crashReporter writes a crash report if the task dies from a crash
+	// signal and keeps its core dumps. It's nil unless crash reports are
+	// enabled or the task's core dumps are kept.
+	crashReporter *crashReporter
+	emitEvent     LogEventFn
+
+	// statsInterval is how long a sample of the task's stats is reused for
+	// so that concurrent callers don't each advance the executor's
+	// calculation of CPU and throttling percentages between samples.
+	statsInterval time.Duration
+	statsLock     sync.Mutex
+	lastStats     *cstructs.TaskResourceUsage
+	lastStatsAt   time.Time
+
+	// startedAt is when the executor started the task. It's persisted in the
+	// handle ID so that reattached handles report how long the task ran.
+	startedAt time.Time
+
+	// healthChecker checks the task's health. It's nil unless a health check
+	// is configured.
+	healthChecker *healthChecker
+
+	// logFiles maps the streams of the task's logs to the name of their log
+	// files without the rotation index. It's persisted in the handle ID as
+	// the names depend on the task's log config.
+	logFiles map[string]string
+
+	// events publishes the task's lifecycle transitions
+	events *eventStream
+
+	// env is the environment the task was started with and envSecrets the
+	// keys of the variables whose values are secrets. The values of secrets
+	// aren't persisted in the handle ID, so reattached handles hold them
+	// redacted.
+	env        map[string]string
+	envSecrets map[string]struct{}
 }
 
 // NewExecDriver is used to create a new exec driver
 func NewExecDriver(ctx *DriverContext) Driver {
-	return &ExecDriver{DriverContext: *ctx}
+	d := &ExecDriver{DriverContext: *ctx}
+
+	// The lines logged for a task are tagged with its ID
+	if d.allocID != "" {
+		d.taskID = taskUUID(d.allocID, d.taskName)
+		d.logger = newTaskLogger(d.logger, d.taskID)
+	}
+	return d
 }
 
 // Validate is used to validate the driver configuration
@@ -67,6 +728,195 @@ func (d *ExecDriver) Validate(config map[string]interface{}) error {
 			"args": {
 				Type: fields.TypeArray,
 			},
+			"signal_coalesce": {
+				Type: fields.TypeArray,
+			},
+			"export_env": {
+				Type: fields.TypeBool,
+			},
+			"export_env_exclude": {
+				Type: fields.TypeArray,
+			},
+			"stack_dump_signal": {
+				Type: fields.TypeString,
+			},
+			"pid_file": {
+				Type: fields.TypeString,
+			},
+			"cpuset": {
+				Type: fields.TypeString,
+			},
+			"cpuset_cpus": {
+				Type: fields.TypeString,
+			},
+			"scratch_dir": {
+				Type: fields.TypeString,
+			},
+			"scratch_group": {
+				Type: fields.TypeString,
+			},
+			"resolve_command_each_start": {
+				Type: fields.TypeBool,
+			},
+			"metrics_port": {
+				Type: fields.TypeString,
+			},
+			"socket_activation": {
+				Type: fields.TypeString,
+			},
+			"track_cgroup": {
+				Type: fields.TypeBool,
+			},
+			"stats_file": {
+				Type: fields.TypeString,
+			},
+			"stats_file_interval": {
+				Type: fields.TypeString,
+			},
+			"stats_file_max_mb": {
+				Type: fields.TypeInt,
+			},
+			"max_threads": {
+				Type: fields.TypeInt,
+			},
+			"threads_threshold": {
+				Type: fields.TypeInt,
+			},
+			"core_dump": {
+				Type: fields.TypeBool,
+			},
+			"crash_report": {
+				Type: fields.TypeBool,
+			},
+			"crash_report_ttl": {
+				Type: fields.TypeString,
+			},
+			"start_confirmation": {
+				Type: fields.TypeString,
+			},
+			"pre_kill_command": {
+				Type: fields.TypeString,
+			},
+			"pre_kill_args": {
+				Type: fields.TypeArray,
+			},
+			"pre_kill_timeout": {
+				Type: fields.TypeString,
+			},
+			"post_start_command": {
+				Type: fields.TypeString,
+			},
+			"post_start_args": {
+				Type: fields.TypeArray,
+			},
+			"post_start_timeout": {
+				Type: fields.TypeString,
+			},
+			"post_start_fatal": {
+				Type: fields.TypeBool,
+			},
+			"reap_hook_processes": {
+				Type: fields.TypeBool,
+			},
+			"skip_abi_check": {
+				Type: fields.TypeBool,
+			},
+			"oom_score_adj": {
+				Type: fields.TypeInt,
+			},
+			"umask": {
+				Type: fields.TypeString,
+			},
+			"nice": {
+				Type: fields.TypeInt,
+			},
+			"no_swap": {
+				Type: fields.TypeBool,
+			},
+			"oom_disable": {
+				Type: fields.TypeBool,
+			},
+			"env_file": {
+				Type: fields.TypeString,
+			},
+			"env_file_optional": {
+				Type: fields.TypeBool,
+			},
+			"host_env_passthrough": {
+				Type: fields.TypeArray,
+			},
+			"work_dir": {
+				Type: fields.TypeString,
+			},
+			"ulimit": {
+				Type: fields.TypeArray,
+			},
+			"cap_add": {
+				Type: fields.TypeArray,
+			},
+			"cap_drop": {
+				Type: fields.TypeArray,
+			},
+			"network_mode": {
+				Type: fields.TypeString,
+			},
+			"userns": {
+				Type: fields.TypeArray,
+			},
+			"kill_escalation_signal": {
+				Type: fields.TypeString,
+			},
+			"signal_process_group": {
+				Type: fields.TypeBool,
+			},
+			"memory_soft_limit": {
+				Type: fields.TypeInt,
+			},
+			"memory_soft_limit_grace": {
+				Type: fields.TypeString,
+			},
+			"no_chroot": {
+				Type: fields.TypeBool,
+			},
+			"chroot_mounts": {
+				Type: fields.TypeArray,
+			},
+			"tmpfs": {
+				Type: fields.TypeArray,
+			},
+			"readonly_rootfs": {
+				Type: fields.TypeBool,
+			},
+			"secret_files": {
+				Type: fields.TypeMap,
+			},
+			"reset_signals": {
+				Type: fields.TypeBool,
+			},
+			"ignore_signals": {
+				Type: fields.TypeArray,
+			},
+			"io_weight": {
+				Type: fields.TypeInt,
+			},
+			"io_limit": {
+				Type: fields.TypeArray,
+			},
+			"devices": {
+				Type: fields.TypeArray,
+			},
+			"health_check": {
+				Type: fields.TypeArray,
+			},
+			"readiness": {
+				Type: fields.TypeArray,
+			},
+			"group": {
+				Type: fields.TypeString,
+			},
+			"groups": {
+				Type: fields.TypeArray,
+			},
 		},
 	}
 
@@ -74,116 +924,1983 @@ func (d *ExecDriver) Validate(config map[string]interface{}) error {
 		return err
 	}
 
-	return nil
-}
+	// Check the PID file stays within an arbitrary task directory
+	if pidFile := fd.Get("pid_file").(string); pidFile != "" {
+		if _, err := taskFilePath("pid_file", "/task", pidFile); err != nil {
+			return err
+		}
+	}
 
-func (d *ExecDriver) Abilities() DriverAbilities {
-	return DriverAbilities{
-		SendSignals: true,
-		Exec:        true,
+	// Interpolated work dirs are checked once they're resolved
+	if workDir := fd.Get("work_dir").(string); workDir != "" && !strings.Contains(workDir, "${") {
+		if _, err := workDirPath("/task", workDir); err != nil {
+			return err
+		}
 	}
-}
 
-func (d *ExecDriver) FSIsolation() cstructs.FSIsolation {
-	return cstructs.FSIsolationChroot
-}
+	cpuset, cpusetCpus := fd.Get("cpuset").(string), fd.Get("cpuset_cpus").(string)
+	if cpuset != "" && cpusetCpus != "" {
+		return fmt.Errorf("only one of cpuset and cpuset_cpus may be set")
+	}
+	for _, c := range []string{cpuset, cpusetCpus} {
+		if c == "" {
+			continue
+		}
+		if _, err := parseCpuset(c); err != nil {
+			return err
+		}
+	}
 
-func (d *ExecDriver) Periodic() (bool, time.Duration) {
-	return true, 15 * time.Second
+	if statsFile := fd.Get("stats_file").(string); statsFile != "" {
+		if _, err := taskFilePath("stats_file", "/task", statsFile); err != nil {
+			return err
+		}
+	}
+	if _, err := statsFileInterval(fd.Get("stats_file_interval").(string)); err != nil {
+		return err
+	}
+	if fd.Get("stats_file_max_mb").(int) < 0 {
+		return fmt.Errorf("stats_file_max_mb must not be negative")
+	}
+
+	maxThreads, threshold := fd.Get("max_threads").(int), fd.Get("threads_threshold").(int)
+	if maxThreads < 0 {
+		return fmt.Errorf("max_threads must not be negative")
+	}
+	if threshold < 0 {
+		return fmt.Errorf("threads_threshold must not be negative")
+	}
+	if maxThreads > 0 && threshold > maxThreads {
+		return fmt.Errorf("threads_threshold %d must not exceed max_threads %d", threshold, maxThreads)
+	}
+
+	if _, err := crashReportTTL(fd.Get("crash_report_ttl").(string)); err != nil {
+		return err
+	}
+
+	if _, err := startConfirmation(fd.Get("start_confirmation").(string)); err != nil {
+		return err
+	}
+
+	if cmd := fd.Get("pre_kill_command").(string); cmd != "" {
+		if err := validateCommand(cmd, "pre_kill_args"); err != nil {
+			return fmt.Errorf("invalid pre_kill_command: %v", err)
+		}
+	}
+	if _, err := preKillTimeout(fd.Get("pre_kill_timeout").(string)); err != nil {
+		return err
+	}
+
+	if cmd := fd.Get("post_start_command").(string); cmd != "" {
+		if err := validateCommand(cmd, "post_start_args"); err != nil {
+			return fmt.Errorf("invalid post_start_command: %v", err)
+		}
+	}
+	if _, err := postStartTimeout(fd.Get("post_start_timeout").(string)); err != nil {
+		return err
+	}
+
+	var healthChecks []*ExecHealthCheck
+	if err := mapstructure.WeakDecode(fd.Get("health_check"), &healthChecks); err != nil {
+		return fmt.Errorf("invalid health_check: %v", err)
+	}
+	if _, err := parseHealthCheck(healthChecks); err != nil {
+		return err
+	}
+
+	var readinessGates []*ExecReadiness
+	if err := mapstructure.WeakDecode(fd.Get("readiness"), &readinessGates); err != nil {
+		return fmt.Errorf("invalid readiness: %v", err)
+	}
+	if _, err := parseReadiness(readinessGates); err != nil {
+		return err
+	}
+
+	// Lowering the score would let tasks make the OOM killer pick the client
+	// or other tasks instead
+	if adj := fd.Get("oom_score_adj").(int); adj < 0 || adj > maxOOMScoreAdj {
+		return fmt.Errorf("oom_score_adj %d must be between 0 and %d", adj, maxOOMScoreAdj)
+	}
+
+	if err := checkNice(fd.Get("nice").(int)); err != nil {
+		return err
+	}
+
+	if umask := fd.Get("umask").(string); umask != "" {
+		if _, err := parseUmask(umask); err != nil {
+			return err
+		}
+	}
+
+	var ulimitRaw []map[string]string
+	if err := mapstructure.WeakDecode(fd.Get("ulimit"), &ulimitRaw); err != nil {
+		return fmt.Errorf("invalid ulimit: %v", err)
+	}
+	ulimit := mapMergeStrStr(ulimitRaw...)
+	if _, err := executor.ParseUlimits(ulimit); err != nil {
+		return err
+	}
+	if _, ok := ulimit["nproc"]; ok && maxThreads > 0 {
+		return fmt.Errorf("only one of max_threads and the nproc ulimit may be set")
+	}
+
+	var capAdd, capDrop []string
+	if err := mapstructure.WeakDecode(fd.Get("cap_add"), &capAdd); err != nil {
+		return fmt.Errorf("invalid cap_add: %v", err)
+	}
+	if err := mapstructure.WeakDecode(fd.Get("cap_drop"), &capDrop); err != nil {
+		return fmt.Errorf("invalid cap_drop: %v", err)
+	}
+	if _, _, err := parseCapAddDrop(capAdd, capDrop); err != nil {
+		return err
+	}
+
+	switch mode := fd.Get("network_mode").(string); mode {
+	case "", networkModeHost, networkModeBridge:
+	default:
+		return fmt.Errorf("invalid network_mode %q; must be %q or %q", mode, networkModeHost, networkModeBridge)
+	}
+
+	var userns []*ExecUserns
+	if err := mapstructure.WeakDecode(fd.Get("userns"), &userns); err != nil {
+		return fmt.Errorf("invalid userns: %v", err)
+	}
+	if _, err := parseUserns(userns); err != nil {
+		return err
+	}
+
+	if sig := fd.Get("kill_escalation_signal").(string); sig != "" {
+		if _, err := getTaskKillSignal(sig); err != nil {
+			return fmt.Errorf("invalid kill_escalation_signal: %v", err)
+		}
+	}
+
+	softLimit, grace := fd.Get("memory_soft_limit").(int), fd.Get("memory_soft_limit_grace").(string)
+	if softLimit < 0 {
+		return fmt.Errorf("memory_soft_limit must not be negative")
+	}
+	if grace != "" && softLimit == 0 {
+		return fmt.Errorf("memory_soft_limit_grace requires memory_soft_limit")
+	}
+	if _, err := memorySoftLimitGrace(grace); err != nil {
+		return err
+	}
+
+	var mounts []*ExecChrootMount
+	if err := mapstructure.WeakDecode(fd.Get("chroot_mounts"), &mounts); err != nil {
+		return fmt.Errorf("invalid chroot_mounts: %v", err)
+	}
+	if err := validateChrootMounts(mounts); err != nil {
+		return err
+	}
+
+	var tmpfs []*ExecTmpfsMount
+	if err := mapstructure.WeakDecode(fd.Get("tmpfs"), &tmpfs); err != nil {
+		return fmt.Errorf("invalid tmpfs: %v", err)
+	}
+	if err := validateTmpfsMounts(tmpfs); err != nil {
+		return err
+	}
+
+	if fd.Get("no_chroot").(bool) {
+		switch {
+		case len(mounts) != 0:
+			return fmt.Errorf("chroot_mounts can't be set with no_chroot")
+		case len(tmpfs) != 0:
+			return fmt.Errorf("tmpfs can't be set with no_chroot")
+		case fd.Get("resolve_command_each_start").(bool):
+			return fmt.Errorf("resolve_command_each_start can't be set with no_chroot")
+		case fd.Get("readonly_rootfs").(bool):
+			return fmt.Errorf("readonly_rootfs can't be set with no_chroot")
+		}
+	}
+
+	var secretFiles map[string]string
+	if err := mapstructure.WeakDecode(fd.Get("secret_files"), &secretFiles); err != nil {
+		return fmt.Errorf("invalid secret_files: %v", err)
+	}
+	if err := validateSecretFiles(secretFiles); err != nil {
+		return err
+	}
+
+	var ignoreSignals []string
+	if err := mapstructure.WeakDecode(fd.Get("ignore_signals"), &ignoreSignals); err != nil {
+		return fmt.Errorf("invalid ignore_signals: %v", err)
+	}
+	if _, err := parseIgnoreSignals(ignoreSignals); err != nil {
+		return err
+	}
+
+	var passthrough []string
+	if err := mapstructure.WeakDecode(fd.Get("host_env_passthrough"), &passthrough); err != nil {
+		return fmt.Errorf("invalid host_env_passthrough: %v", err)
+	}
+	for _, k := range passthrough {
+		if !envNameRe.MatchString(k) {
+			return fmt.Errorf("host_env_passthrough name %q is not a valid environment variable name", k)
+		}
+	}
+
+	// Only the declared tmpfs mounts are writable besides the alloc and
+	// secrets dirs
+	if fd.Get("readonly_rootfs").(bool) {
+		for _, m := range mounts {
+			if !m.ReadOnly {
+				return fmt.Errorf("chroot_mounts task_path %q must be readonly with readonly_rootfs", m.TaskPath)
+			}
+		}
+	}
+
+	if weight := fd.Get("io_weight").(int); weight != 0 && (weight < minIOWeight || weight > maxIOWeight) {
+		return fmt.Errorf("io_weight %d must be between %d and %d", weight, minIOWeight, maxIOWeight)
+	}
+	var ioLimits []*ExecIOLimit
+	if err := mapstructure.WeakDecode(fd.Get("io_limit"), &ioLimits); err != nil {
+		return fmt.Errorf("invalid io_limit: %v", err)
+	}
+	if err := validateIOLimits(ioLimits); err != nil {
+		return err
+	}
+	var devices []*ExecDevice
+	if err := mapstructure.WeakDecode(fd.Get("devices"), &devices); err != nil {
+		return fmt.Errorf("invalid devices: %v", err)
+	}
+	if err := validateDevices(devices); err != nil {
+		return err
+	}
+
+	scratchDir, scratchGroup := fd.Get("scratch_dir").(string), fd.Get("scratch_group").(string)
+	if scratchDir != "" {
+		if _, err := scratchDirPath("/alloc", scratchDir); err != nil {
+			return err
+		}
+		if scratchGroup == "" {
+			return fmt.Errorf("scratch_group must be set with scratch_dir")
+		}
+	} else if scratchGroup != "" {
+		return fmt.Errorf("scratch_group requires scratch_dir")
+	}
+
+	return nil
+}
+
+// ValidateTask validates that the task's command, user and groups can be found
+// on the node without building the chroot.
+func (d *ExecDriver) ValidateTask(task *structs.Task) error {
+	var driverConfig ExecDriverConfig
+	if err := mapstructure.WeakDecode(task.Config, &driverConfig); err != nil {
+		return err
+	}
+
+	if label := driverConfig.SocketActivation; label != "" && !taskHasPort(task, label) {
+		return fmt.Errorf("socket_activation port %q is not a port of the task", label)
+	}
+
+	// The hard limit would throttle the task before it reaches the soft limit
+	if limit := driverConfig.MemorySoftLimit; limit > 0 && task.Resources != nil && limit >= task.Resources.MemoryMB {
+		return fmt.Errorf("memory_soft_limit of %d MB must be below the task's memory of %d MB", limit, task.Resources.MemoryMB)
+	}
+
+	// The rest is checked against the node, which servers don't have
+	if d.config == nil {
+		return nil
+	}
+
+	var mErr multierror.Error
+	chroot := config.DefaultChrootEnv
+	if len(d.config.ChrootEnv) > 0 {
+		chroot = d.config.ChrootEnv
+	}
+	// Host paths are only checked once the client allows the option that
+	// reaches them, so that the errors don't reveal which host paths exist
+	checkCommand, checkMounts := true, true
+	if driverConfig.NoChroot {
+		if !d.config.ReadBoolDefault(execNoChrootConfigOption, false) {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("no_chroot is not allowed by the client; set %q to enable it", execNoChrootConfigOption))
+			checkCommand = false
+		}
+		// The command is found at its host path
+		chroot = map[string]string{"/": "/"}
+	}
+	if len(driverConfig.ChrootMounts) != 0 && !d.config.ReadBoolDefault(execChrootMountsConfigOption, false) {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("chroot_mounts are not allowed by the client; set %q to enable them", execChrootMountsConfigOption))
+		checkMounts = false
+	}
+	if driverConfig.OOMDisable && len(d.config.ReadStringListToMap(execOOMDisableJobsConfigOption)) == 0 {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("oom_disable is not allowed by the client; add the job to %q to enable it", execOOMDisableJobsConfigOption))
+	}
+	if checkCommand {
+		if err := validateCommandExists(task, &driverConfig, chroot); err != nil {
+			mErr.Errors = append(mErr.Errors, err)
+		}
+	}
+	if task.User != "" {
+		if _, err := user.Lookup(task.User); err != nil {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("failed to look up user %q: %v", task.User, err))
+		}
+	}
+	if driverConfig.ScratchGroup != "" {
+		if _, err := lookupGID(driverConfig.ScratchGroup); err != nil {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("invalid scratch_group: %v", err))
+		}
+	}
+	if err := checkGroupsAllowed(d.config, driverConfig.taskGroups()); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
+	}
+	if err := checkUlimitsAllowed(d.config, driverConfig.Ulimit); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
+	}
+	for _, m := range driverConfig.ChrootMounts {
+		if !checkMounts || strings.Contains(m.HostPath, "${") {
+			continue
+		}
+		if _, err := os.Stat(m.HostPath); err != nil {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("host path %q can't be mounted into the chroot: %v", m.HostPath, err))
+		}
+	}
+	return mErr.ErrorOrNil()
+}
+
+func (d *ExecDriver) Abilities() DriverAbilities {
+	return DriverAbilities{
+		SendSignals: true,
+		Exec:        true,
+		CombineLogs: true,
+	}
+}
+
+func (d *ExecDriver) FSIsolation() cstructs.FSIsolation {
+	return cstructs.FSIsolationChroot
+}
+
+// TaskFSIsolation skips building the chroot of tasks that set no_chroot.
+func (d *ExecDriver) TaskFSIsolation(task *structs.Task) cstructs.FSIsolation {
+	var driverConfig ExecDriverConfig
+	if err := mapstructure.WeakDecode(task.Config, &driverConfig); err == nil && driverConfig.NoChroot {
+		return cstructs.FSIsolationNone
+	}
+	return cstructs.FSIsolationChroot
+}
+
+func (d *ExecDriver) Periodic() (bool, time.Duration) {
+	period := defaultExecFingerprintPeriod
+	if d.config != nil {
+		period = d.config.ReadDurationDefault(execFingerprintPeriodConfigOption, period)
+	}
+	if period <= 0 {
+		return false, 0
+	}
+	return true, period
+}
+
+// parseCgroupControllers returns the sorted, comma separated cgroup
+// controllers enabled in the contents of /proc/cgroups.
+func parseCgroupControllers(r io.Reader) (string, error) {
+	var controllers []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// The columns are the name, hierarchy, number of cgroups and
+		// whether it's enabled
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			continue
+		}
+		if fields[3] == "1" {
+			controllers = append(controllers, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	sort.Strings(controllers)
+	return strings.Join(controllers, ","), nil
+}
+
+func (d *ExecDriver) Prestart(ctx *ExecContext, task *structs.Task) (*PrestartResponse, error) {
+	var driverConfig ExecDriverConfig
+	if err := mapstructure.WeakDecode(task.Config, &driverConfig); err != nil {
+		return nil, err
+	}
+
+	if d.config.ReadBoolDefault(execMemoryCheckConfigOption, false) {
+		if err := d.checkMemory(task); err != nil {
+			return nil, err
+		}
+	}
+
+	if driverConfig.Umask != "" {
+		if _, err := parseUmask(driverConfig.Umask); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkNice(driverConfig.Nice); err != nil {
+		return nil, err
+	}
+	if err := d.checkMinNice(driverConfig.Nice); err != nil {
+		return nil, err
+	}
+	if driverConfig.NoSwap && !memorySwapSupported(d.DriverContext.node) {
+		return nil, fmt.Errorf("no_swap requires swap accounting in the kernel's memory cgroup")
+	}
+	if driverConfig.OOMDisable && !oomDisableSupported(d.DriverContext.node) {
+		return nil, fmt.Errorf("oom_disable requires the OOM control of the memory cgroup of cgroup v1")
+	}
+	if len(driverConfig.Userns) != 0 {
+		if !d.config.ReadBoolDefault(execUsernsConfigOption, false) {
+			return nil, fmt.Errorf("userns is not allowed by the client; set %q to enable it", execUsernsConfigOption)
+		}
+		if d.DriverContext.node.Attributes[execDriverUsernsAttr] != "1" {
+			return nil, fmt.Errorf("userns requires user namespaces and subordinate ids of %q",
+				d.config.ReadDefault(execUsernsOwnerConfigOption, defaultUsernsOwner))
+		}
+	}
+	if driverConfig.IOWeight != 0 || len(driverConfig.IOLimits) != 0 {
+		if !ioIsolationSupported(d.DriverContext.node) {
+			return nil, fmt.Errorf("io_weight and io_limit require the blkio cgroup controller, or the io controller of cgroup v2")
+		}
+		if driverConfig.IOWeight != 0 && !ioWeightSupported(d.DriverContext.node) {
+			return nil, fmt.Errorf("io_weight requires an I/O scheduler supporting blkio weights, such as CFQ")
+		}
+		if _, err := driverConfig.ioLimits(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := driverConfig.ulimits(); err != nil {
+		return nil, err
+	}
+
+	// The work dir may be provided by artifacts, which are fetched before
+	// Prestart
+	if driverConfig.WorkDir != "" {
+		path, err := workDirPath(ctx.TaskDir.Dir, ctx.TaskEnv.ReplaceEnv(driverConfig.WorkDir))
+		if err != nil {
+			return nil, err
+		}
+		if fi, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("work_dir %q does not exist: %v", driverConfig.WorkDir, err)
+		} else if !fi.IsDir() {
+			return nil, fmt.Errorf("work_dir %q is not a directory", driverConfig.WorkDir)
+		}
+	}
+
+	// Cores can go offline after the node was fingerprinted
+	if cpuset := driverConfig.cpuset(); cpuset != "" {
+		if online := stats.CPUOnline(); online != "" {
+			if err := checkCpusetOnline(cpuset, online); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if driverConfig.ScratchDir != "" {
+		if _, err := scratchDirPath(ctx.TaskDir.SharedAllocDir, driverConfig.ScratchDir); err != nil {
+			return nil, err
+		}
+		gid, err := lookupGID(driverConfig.ScratchGroup)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scratch_group: %v", err)
+		}
+		if err := createScratchDir(ctx.TaskDir.SharedAllocDir, driverConfig.ScratchDir, gid); err != nil {
+			return nil, err
+		}
+	}
+
+	// The chroot was built before Prestart, so host paths are mounted into
+	// it here. They're unmounted when the alloc dir is destroyed. The
+	// client's config may have changed since the task was validated.
+	if len(driverConfig.ChrootMounts) != 0 {
+		if !d.config.ReadBoolDefault(execChrootMountsConfigOption, false) {
+			return nil, fmt.Errorf("chroot_mounts are not allowed by the client")
+		}
+		mounts := make([]*allocdir.BindMount, len(driverConfig.ChrootMounts))
+		for i, m := range driverConfig.ChrootMounts {
+			mounts[i] = &allocdir.BindMount{
+				HostPath: ctx.TaskEnv.ReplaceEnv(m.HostPath),
+				TaskPath: ctx.TaskEnv.ReplaceEnv(m.TaskPath),
+				ReadOnly: m.ReadOnly,
+			}
+		}
+		if err := ctx.TaskDir.MountHostPaths(mounts); err != nil {
+			return nil, err
+		}
+	}
+
+	// The devices are resolved to check that they exist and mounted over
+	// the chroot's /dev so that the task sees the host's nodes
+	if len(driverConfig.Devices) != 0 {
+		devices, err := driverConfig.devices()
+		if err != nil {
+			return nil, err
+		}
+		if !driverConfig.NoChroot {
+			mounts := make([]*allocdir.BindMount, len(devices))
+			for i, d := range devices {
+				mounts[i] = &allocdir.BindMount{HostPath: d.Path, TaskPath: d.Path, Device: true}
+			}
+			if err := ctx.TaskDir.MountHostPaths(mounts); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// A tmpfs larger than the host's memory can never be filled, so it's
+	// rejected rather than letting the task run into it.
+	if len(driverConfig.Tmpfs) != 0 {
+		mounts := driverConfig.tmpfsMounts(task)
+		totalMB, err := hostTotalMemoryMB()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read host memory: %v", err)
+		}
+		if err := checkTmpfsSize(mounts, totalMB); err != nil {
+			return nil, err
+		}
+	}
+
+	// Report how the command is linked to help debug missing libraries. If
+	// it can't be found, Start reports the error.
+	command := ctx.TaskEnv.ReplaceEnv(driverConfig.Command)
+	f, err := openTaskBinary(ctx.TaskDir.Dir, command)
+	if err != nil {
+		return nil, nil
+	}
+	info, err := inspectBinary(f)
+	f.Close()
+	if err != nil {
+		d.logger.Printf("[WARN] driver.exec: failed to inspect command %q: %v", command, err)
+		return nil, nil
+	}
+
+	d.logger.Printf("[DEBUG] driver.exec: command %q of task %q is %s", command, task.Name, info)
+	d.emitEvent("Command %q is %s", command, info)
+	if err := info.Executable(); err != nil {
+		return nil, err
+	}
+
+	// Fail early rather than with an obscure loader error once started. The
+	// command loads the glibc of its chroot, which may differ from the host's.
+	if !driverConfig.SkipABICheck {
+		glibc := hostGlibcVersion()
+		if !driverConfig.NoChroot {
+			glibc = rootGlibcVersion(ctx.TaskDir.Dir)
+		}
+		if err := info.Compatible(runtime.GOARCH, glibc); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// checkMemory returns an error if the node doesn't have enough available
+// memory to start the task, guarding against overcommit when the scheduler's
+// view of the node is stale.
+func (d *ExecDriver) checkMemory(task *structs.Task) error {
+	headroom := d.config.ReadIntDefault(execMemoryHeadroomConfigOption, 0)
+	if headroom < 0 {
+		return fmt.Errorf("%s must not be negative: %d", execMemoryHeadroomConfigOption, headroom)
+	}
+
+	available, err := hostAvailableMemoryMB()
+	if err != nil {
+		d.logger.Printf("[WARN] driver.exec: skipping memory check of task %q: %v", task.Name, err)
+		return nil
+	}
+	return checkAvailableMemory(task, headroom, available)
+}
+
+func (d *ExecDriver) Start(ctx *ExecContext, task *structs.Task) (*StartResponse, error) {
+	resp, err := d.start(ctx, task)
+	if err != nil {
+		category := dstructs.StartFailureCategory(err)
+		metrics.IncrCounterWithLabels([]string{"client", "driver", "exec", "start_failure"}, 1,
+			[]metrics.Label{{Name: "category", Value: string(category)}})
+		d.logger.Printf("[DEBUG] driver.exec: failed to start task %q (category %q): %v", task.Name, category, err)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// start starts the task, returning a StartError that categorizes any failure.
+func (d *ExecDriver) start(ctx *ExecContext, task *structs.Task) (*StartResponse, error) {
+	// Protect the node from tasks crash looping faster than their restart
+	// policy delays them
+	if interval := d.config.ReadDurationDefault(execMinStartIntervalConfigOption, 0); interval > 0 {
+		id := fmt.Sprintf("%s/%s", d.DriverContext.allocID, task.Name)
+		if wait := globalStartThrottle.Allow(id, time.Now(), interval); wait > 0 {
+			return nil, dstructs.NewStartError(dstructs.StartFailureThrottled, dstructs.NewStartTooSoonError(wait))
+		}
+	}
+
+	var driverConfig ExecDriverConfig
+	if err := mapstructure.WeakDecode(task.Config, &driverConfig); err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+
+	// Get the command to be ran
+	command := driverConfig.Command
+	if err := validateCommand(command, "args"); err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+
+	signalCoalesce, err := parseSignalCoalesce(mapMergeStrStr(driverConfig.SignalCoalesceRaw...))
+	if err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+	coalescer, err := newSignalCoalescer(signalCoalesce)
+	if err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+
+	var preKillCommand []string
+	if driverConfig.PreKillCommand != "" {
+		preKillCommand = append([]string{driverConfig.PreKillCommand}, driverConfig.PreKillArgs...)
+	}
+	preKillTimeout, err := preKillTimeout(driverConfig.PreKillTimeout)
+	if err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+	var postStartCommand []string
+	if driverConfig.PostStartCommand != "" {
+		postStartCommand = append([]string{driverConfig.PostStartCommand}, driverConfig.PostStartArgs...)
+	}
+	postStartTimeout, err := postStartTimeout(driverConfig.PostStartTimeout)
+	if err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+	healthCheck, err := parseHealthCheck(driverConfig.HealthCheck)
+	if err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+	readiness, err := parseReadiness(driverConfig.Readiness)
+	if err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+
+	stackDumpSignal := driverConfig.StackDumpSignal
+	if stackDumpSignal == "" {
+		stackDumpSignal = defaultStackDumpSignal
+	}
+	if _, err := signals.Parse(stackDumpSignal); err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig,
+			fmt.Errorf("invalid stack_dump_signal: %v", err))
+	}
+
+	// Checked again as the client's config may have changed since the task
+	// was validated
+	if driverConfig.NoChroot && !d.config.ReadBoolDefault(execNoChrootConfigOption, false) {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig,
+			fmt.Errorf("no_chroot is not allowed by the client"))
+	}
+	if len(driverConfig.Userns) != 0 && !d.config.ReadBoolDefault(execUsernsConfigOption, false) {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig,
+			fmt.Errorf("userns is not allowed by the client"))
+	}
+	if driverConfig.OOMDisable {
+		job := ctx.TaskEnv.EnvMap[env.JobName]
+		if _, ok := d.config.ReadStringListToMap(execOOMDisableJobsConfigOption)[job]; !ok {
+			return nil, dstructs.NewStartError(dstructs.StartFailureConfig,
+				fmt.Errorf("oom_disable is not allowed for job %q by the client", job))
+		}
+		d.logger.Printf("[WARN] driver.exec: disabling the OOM killer of task %q; it's paused rather than killed once it runs out of memory, which can deadlock it", d.taskName)
+	}
+
+	var pidFile string
+	if driverConfig.PidFile != "" {
+		pidFile, err = taskFilePath("pid_file", ctx.TaskDir.Dir, driverConfig.PidFile)
+		if err != nil {
+			return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+		}
+	}
+
+	var workDir string
+	if driverConfig.WorkDir != "" {
+		path, err := workDirPath(ctx.TaskDir.Dir, ctx.TaskEnv.ReplaceEnv(driverConfig.WorkDir))
+		if err != nil {
+			return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+		}
+		if workDir, err = filepath.Rel(ctx.TaskDir.Dir, path); err != nil {
+			return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+		}
+	}
+
+	var statsFile string
+	if driverConfig.StatsFile != "" {
+		statsFile, err = taskFilePath("stats_file", ctx.TaskDir.Dir, driverConfig.StatsFile)
+		if err != nil {
+			return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+		}
+	}
+	statsInterval, err := statsFileInterval(driverConfig.StatsFileInterval)
+	if err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+	statsMaxMB := driverConfig.StatsFileMaxMB
+	if statsMaxMB == 0 {
+		statsMaxMB = defaultStatsFileMaxMB
+	}
+
+	// Cores are written wherever the host's core_pattern says, so they can
+	// only be kept if it writes them into the task's directory
+	var coreDir, corePrefix string
+	keepCores := false
+	if driverConfig.CoreDump {
+		coreDir, corePrefix, err = d.coreDumpDir(ctx, workDir, !driverConfig.NoChroot)
+		if err != nil {
+			d.logger.Printf("[WARN] driver.exec: core dumps of task %q won't be kept: %v", d.taskName, err)
+			d.emitEvent("Core dumps won't be kept: %v", err)
+		}
+		keepCores = err == nil
+	}
+
+	var crashTTL time.Duration
+	if driverConfig.CrashReport || keepCores {
+		crashTTL, err = crashReportTTL(driverConfig.CrashReportTTL)
+		if err != nil {
+			return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+		}
+	}
+
+	confirmation, err := startConfirmation(driverConfig.StartConfirmation)
+	if err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+
+	softLimitGrace, err := memorySoftLimitGrace(driverConfig.MemorySoftLimitGrace)
+	if err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+
+	ulimits, err := driverConfig.ulimits()
+	if err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+	if err := checkUlimitsAllowed(d.config, driverConfig.Ulimit); err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+
+	ioLimits, err := driverConfig.ioLimits()
+	if err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+	devices, err := driverConfig.devices()
+	if err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+
+	capAdd, capDrop, err := parseCapAddDrop(driverConfig.CapAdd, driverConfig.CapDrop)
+	if err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+	if err := checkCapabilitiesAllowed(capAdd, d.config.ReadStringListToMap(execAllowCapsConfigOption)); err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+	if err := checkGroupsAllowed(d.config, driverConfig.taskGroups()); err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+
+	taskEnv := ctx.TaskEnv
+	if driverConfig.MetricsPort != "" {
+		var addr string
+		taskEnv, addr, err = metricsTaskEnv(ctx.TaskEnv, driverConfig.MetricsPort)
+		if err != nil {
+			return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+		}
+		d.logger.Printf("[DEBUG] driver.exec: task %q exposes metrics at %s", task.Name, addr)
+		d.emitEvent("Exposing metrics at %s", addr)
+	}
+
+	var listenAddr string
+	if driverConfig.SocketActivation != "" {
+		taskEnv, listenAddr, err = socketActivationTaskEnv(taskEnv, driverConfig.SocketActivation)
+		if err != nil {
+			return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+		}
+		d.logger.Printf("[DEBUG] driver.exec: passing socket listening on %s to task %q", listenAddr, task.Name)
+	}
+
+	// The task's address on the bridge is released once it exits
+	var bridge *executor.BridgeNetwork
+	var bridgeAddr string
+	var launched bool
+	bridgeID := fmt.Sprintf("%s/%s", d.DriverContext.allocID, task.Name)
+	if driverConfig.NetworkMode == networkModeBridge {
+		subnet, err := parseBridgeSubnet(d.config.ReadDefault(execBridgeSubnetConfigOption, defaultExecBridgeSubnet))
+		if err != nil {
+			return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+		}
+		ip, err := globalBridgeAddrs.Acquire(bridgeID, subnet)
+		if err != nil {
+			return nil, dstructs.NewStartError(dstructs.StartFailureNetwork, structs.NewRecoverableError(err, true))
+		}
+		defer func() {
+			if !launched {
+				globalBridgeAddrs.Release(bridgeID)
+			}
+		}()
+
+		bridge = bridgeNetwork(d.config.ReadDefault(execBridgeConfigOption, defaultExecBridge), subnet, ip, task)
+		bridgeAddr = ip.String()
+		taskEnv = bridgeTaskEnv(taskEnv, ip)
+		d.logger.Printf("[DEBUG] driver.exec: attaching task %q to bridge %s with address %s", task.Name, bridge.Bridge, bridge.Address)
+		d.emitEvent("Attaching to bridge %s with address %s", bridge.Bridge, ip)
+	}
+
+	// The readiness gate is prepared before the task can write to its logs
+	if readiness != nil {
+		if err := readiness.prepare(task, ctx.TaskDir.Dir, bridgeAddr, ctx.TaskDir.LogDir, taskLogFiles(task.LogConfig, d.taskName, d.allocID)); err != nil {
+			return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+		}
+	}
+
+	// The subordinate ids of the task's user namespace are released once it
+	// exits
+	usernsSize, err := parseUserns(driverConfig.Userns)
+	if err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+	var userns *executor.UserNamespace
+	usernsID := fmt.Sprintf("%s/%s", d.DriverContext.allocID, task.Name)
+	if usernsSize != 0 {
+		owner := d.config.ReadDefault(execUsernsOwnerConfigOption, defaultUsernsOwner)
+		userns, err = acquireUserns(usernsID, owner, usernsSize)
+		if err != nil {
+			return nil, dstructs.NewStartError(dstructs.StartFailureUser, structs.NewRecoverableError(err, true))
+		}
+		defer func() {
+			if !launched {
+				releaseUserns(usernsID)
+			}
+		}()
+		if err := chownUsernsTaskDir(ctx.TaskDir, userns); err != nil {
+			return nil, dstructs.NewStartError(dstructs.StartFailureFilesystem, err)
+		}
+		d.logger.Printf("[DEBUG] driver.exec: mapping root of the user namespace of task %q to uid %d and gid %d", task.Name, userns.UID, userns.GID)
+	}
+
+	// Host environment variables passed through are only logged as the
+	// task's environment was already built
+	if len(driverConfig.HostEnvPassthrough) != 0 {
+		blacklist := d.config.ReadStringListToMapDefault("env.blacklist", config.DefaultEnvBlacklist)
+		for _, k := range driverConfig.HostEnvPassthrough {
+			if _, ok := blacklist[k]; ok {
+				d.logger.Printf("[WARN] driver.exec: not passing host environment variable %q through to task %q as it's in env.blacklist", k, task.Name)
+			} else if _, ok := os.LookupEnv(k); !ok {
+				d.logger.Printf("[DEBUG] driver.exec: host environment variable %q passed through to task %q isn't set", k, task.Name)
+			}
+		}
+	}
+
+	secrets := d.config.ReadStringListToMap(execEnvSecretsConfigOption)
+	if defaults := execDefaultEnv(d.config); len(defaults) != 0 {
+		d.logger.Printf("[DEBUG] driver.exec: default environment of task %q: %s", task.Name, redactEnv(defaults, secrets))
+	}
+
+	// The variables interpolated into secret files are only exposed to the
+	// task through the files
+	var secretFiles map[string]string
+	var secretFileVars []string
+	if len(driverConfig.SecretFiles) != 0 {
+		secretFiles, secretFileVars = interpolateSecretFiles(taskEnv, driverConfig.SecretFiles)
+		taskEnv = withoutTaskEnv(taskEnv, secretFileVars)
+		d.logger.Printf("[DEBUG] driver.exec: removed %v from the environment of task %q for its secret files", secretFileVars, task.Name)
+	}
+
+	// Embed the command into the chroot again so that a new target of a
+	// symlink flipped on the host since the chroot was built is started. Only
+	// what the chroot_env embeds is embedded again.
+	if driverConfig.ResolveCommandEachStart {
+		chroot := config.DefaultChrootEnv
+		if len(d.config.ChrootEnv) > 0 {
+			chroot = d.config.ChrootEnv
+		}
+		if path, ok := hostCommandPath(ctx.TaskDir, ctx.TaskEnv.ReplaceEnv(command)); ok {
+			if err := ctx.TaskDir.EmbedPath(path, chroot); err != nil {
+				return nil, dstructs.NewStartError(dstructs.StartFailureFilesystem,
+					fmt.Errorf("failed to resolve command: %v", err))
+			}
+			d.logger.Printf("[DEBUG] driver.exec: resolved command %q of task %q again", path, task.Name)
+		}
+	}
+
+	// Wrap the command in the site's wrapper, which execs the command with
+	// its arguments after doing its accounting.
+	args := driverConfig.Args
+	if wrapper := d.config.Read(execCommandWrapperConfigOption); wrapper != "" {
+		root := ctx.TaskDir.Dir
+		if driverConfig.NoChroot {
+			root = "/"
+		}
+		if err := checkCommandWrapper(root, wrapper); err != nil {
+			return nil, dstructs.NewStartError(dstructs.StartFailureFilesystem, err)
+		}
+		taskEnv = wrappedTaskEnv(taskEnv, taskEnv.ReplaceEnv(command))
+		args = append([]string{command}, args...)
+		command = wrapper
+	}
+
+	// Export the task's environment for sibling tasks before launching so
+	// that it is available as soon as the task is running.
+	if driverConfig.ExportEnv {
+		exclude := append([]string{}, driverConfig.ExportEnvExclude...)
+		exclude = append(exclude, secretFileVars...)
+		for k := range secrets {
+			exclude = append(exclude, k)
+		}
+		if err := exportTaskEnv(ctx, task, exclude); err != nil {
+			return nil, dstructs.NewStartError(dstructs.StartFailureFilesystem, err)
+		}
+	}
+
+	pluginLogFile := filepath.Join(ctx.TaskDir.Dir, "executor.out")
+	executorConfig := &dstructs.ExecutorConfig{
+		LogFile:  pluginLogFile,
+		LogLevel: d.config.LogLevel,
+	}
+	exec, pluginClient, err := createExecutor(d.config.LogOutput, d.config, executorConfig)
+	if err != nil {
+		return nil, dstructs.NewStartError(dstructs.StartFailureExecutor, err)
+	}
+	executorCtx := &executor.ExecutorContext{
+		TaskEnv: taskEnv,
+		Driver:  "exec",
+		LogDir:  ctx.TaskDir.LogDir,
+		TaskDir: ctx.TaskDir.Dir,
+		Task:    task,
+	}
+	if err := exec.SetContext(executorCtx); err != nil {
+		pluginClient.Kill()
+		return nil, dstructs.NewStartError(dstructs.StartFailureExecutor,
+			fmt.Errorf("failed to set executor context: %v", err))
+	}
+
+	taskKillSignal, err := getTaskKillSignal(task.KillSignal)
+	if err != nil {
+		pluginClient.Kill()
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+	var escalationSignal os.Signal
+	if driverConfig.KillEscalationSignal != "" {
+		escalationSignal, err = getTaskKillSignal(driverConfig.KillEscalationSignal)
+		if err != nil {
+			pluginClient.Kill()
+			return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+		}
+	}
+
+	ignoreSignals, err := parseIgnoreSignals(driverConfig.IgnoreSignals)
+	if err != nil {
+		pluginClient.Kill()
+		return nil, dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+
+	cpusetID := fmt.Sprintf("%s/%s", d.DriverContext.allocID, task.Name)
+	cpuset := driverConfig.cpuset()
+	if cpuset != "" {
+		if err := d.acquireCpuset(cpusetID, cpuset); err != nil {
+			pluginClient.Kill()
+			return nil, err
+		}
+	}
+
+	// Tasks in a user namespace run as its root unless they set a user
+	execUser := getExecutorUser(task)
+	if userns != nil && task.User == "" {
+		execUser = "root"
+	}
+
+	execCmd := &executor.ExecCommand{
+		Cmd:            command,
+		Args:           args,
+		TaskKillSignal: taskKillSignal,
+		FSIsolation:    !driverConfig.NoChroot,
+		ReadonlyRootfs: driverConfig.ReadonlyRootfs,
+		Tmpfs:          driverConfig.tmpfsMounts(task),
+		SecretFiles:    secretFiles,
+		ResourceLimits: true,
+		User:           execUser,
+		Group:          driverConfig.Group,
+		ExtraGroups:    driverConfig.Groups,
+		ListenAddr:     listenAddr,
+		BridgeNetwork:  bridge,
+		CpusetCpus:     cpuset,
+		CgroupRetries:  d.config.ReadIntDefault("cgroup.write_retries", config.DefaultCgroupWriteRetries),
+		ReapOrphans:    d.config.ReadBoolDefault("executor.reap_orphans", false),
+		TrackCgroup:    driverConfig.TrackCgroup,
+		MaxThreads:     driverConfig.MaxThreads,
+		OOMScoreAdj:    driverConfig.OOMScoreAdj,
+		Umask:          driverConfig.Umask,
+		Nice:           driverConfig.Nice,
+		IOWeight:       uint16(driverConfig.IOWeight),
+		IOLimits:       ioLimits,
+		Devices:        devices,
+		NoSwap:         driverConfig.NoSwap,
+		OOMDisable:     driverConfig.OOMDisable,
+		Ulimits:        ulimits,
+		CoreDump:       driverConfig.CoreDump,
+		CapAdd:         capabilityBits(capAdd),
+		CapDrop:        capabilityBits(capDrop),
+
+		EnvFile:              driverConfig.EnvFile,
+		EnvFileOptional:      driverConfig.EnvFileOptional,
+		WorkDir:              workDir,
+		StartConfirmation:    confirmation,
+		KillEscalationSignal: escalationSignal,
+		KillEscalationDelay:  task.KillTimeout / 2,
+		SignalProcessGroup:   driverConfig.SignalProcessGroup,
+		ResetSignals:         driverConfig.ResetSignals,
+		IgnoreSignals:        ignoreSignals,
+		MemorySoftLimit:      uint64(driverConfig.MemorySoftLimit) * 1024 * 1024,
+		ReapExecProcesses:    driverConfig.ReapHookProcesses,
+		MemorySoftLimitGrace: softLimitGrace,
+		UserNamespace:        userns,
+	}
+
+	startingAt := time.Now()
+	ps, err := exec.LaunchCmd(execCmd)
+	if err != nil {
+		// Exiting the executor removes the network namespace
+		if bridge != nil {
+			exec.Exit()
+		}
+		pluginClient.Kill()
+		globalCpusets.Release(cpusetID)
+		return nil, dstructs.NewStartError(executor.LaunchErrorCategory(err), err)
+	}
+
+	startedAt := time.Now()
+	launched = true
+	d.logger.Printf("[DEBUG] driver.exec: started process via plugin with pid: %v", ps.Pid)
+	if ps.CgroupRetries > 0 {
+		metrics.IncrCounter([]string{"client", "driver", "exec", "cgroup_write_retries"}, float32(ps.CgroupRetries))
+	}
+
+	if pidFile != "" {
+		if err := writePidFile(ctx.TaskDir.Dir, pidFile, ps.Pid); err != nil {
+			d.logger.Printf("[WARN] driver.exec: %v", err)
+		}
+	}
+
+	// Return a driver handle
+	maxKill := d.DriverContext.config.MaxKillTimeout
+	h := &execHandle{
+		pluginClient:      pluginClient,
+		userPid:           ps.Pid,
+		executor:          exec,
+		isolationConfig:   ps.IsolationConfig,
+		killTimeout:       GetKillTimeout(task.KillTimeout, maxKill),
+		maxKillTimeout:    maxKill,
+		logger:            d.logger,
+		version:           d.config.Version.VersionNumber(),
+		taskID:            d.taskID,
+		doneCh:            make(chan struct{}),
+		detachCh:          make(chan struct{}),
+		waitCh:            make(chan *dstructs.WaitResult, 1),
+		taskDir:           ctx.TaskDir,
+		signalCoalesce:    signalCoalesce,
+		signalCoalescer:   coalescer,
+		stackDumpSignal:   stackDumpSignal,
+		preKillCommand:    preKillCommand,
+		preKillTimeout:    preKillTimeout,
+		pidFile:           pidFile,
+		cpuset:            cpuset,
+		cpusetID:          cpusetID,
+		bridgeAddr:        bridgeAddr,
+		bridgeID:          bridgeID,
+		userns:            userns,
+		usernsID:          usernsID,
+		statsFile:         statsFile,
+		statsFileInterval: statsInterval,
+		statsFileMaxBytes: int64(statsMaxMB) * 1024 * 1024,
+		threadsThreshold:  threadsThreshold(driverConfig.MaxThreads, driverConfig.ThreadsThreshold),
+		emitEvent:         d.emitEvent,
+		statsInterval:     d.statsInterval(),
+		events:            newEventStream(d.taskID),
+		startedAt:         ps.Time,
+		logFiles:          taskLogFiles(task.LogConfig, d.taskName, d.allocID),
+		env:               ps.Env,
+		envSecrets:        taskEnvSecrets(secrets),
+	}
+	h.events.publish(startingAt, DriverEventStarting, "Launching command %q", execCmd.Cmd)
+	h.events.publish(startedAt, DriverEventStarted, "Started command with pid %d", ps.Pid)
+	if crashTTL != 0 {
+		command := append([]string{taskEnv.ReplaceEnv(command)}, taskEnv.ParseAndReplace(args)...)
+		h.crashReporter = d.newCrashReporter(ctx, crashTTL, command)
+		h.crashReporter.coreDir = coreDir
+		h.crashReporter.corePrefix = corePrefix
+		h.crashReporter.coresOnly = !driverConfig.CrashReport
+		go h.crashReporter.run(h.doneCh)
+	}
+	go h.run()
+
+	// The task isn't started until it's ready, so it's killed if it isn't
+	if readiness != nil {
+		if err := readiness.waitReady(h); err != nil {
+			d.logger.Printf("[WARN] driver.exec: killing task %q: %v", d.taskName, err)
+			if kerr := h.Kill(); kerr != nil {
+				d.logger.Printf("[ERR] driver.exec: failed to kill task %q: %v", d.taskName, kerr)
+			}
+			return nil, dstructs.NewStartError(dstructs.StartFailureCommand, structs.NewRecoverableError(err, true))
+		}
+		d.logger.Printf("[DEBUG] driver.exec: task %q is ready", d.taskName)
+	}
+
+	// The post-start command runs once the task is started and ready
+	if len(postStartCommand) != 0 {
+		if err := h.runPostStart(postStartCommand, postStartTimeout); err != nil {
+			if driverConfig.PostStartFatal {
+				d.logger.Printf("[WARN] driver.exec: killing task %q: %v", d.taskName, err)
+				if kerr := h.Kill(); kerr != nil {
+					d.logger.Printf("[ERR] driver.exec: failed to kill task %q: %v", d.taskName, kerr)
+				}
+				return nil, dstructs.NewStartError(dstructs.StartFailureCommand, structs.NewRecoverableError(err, true))
+			}
+			d.logger.Printf("[WARN] driver.exec: %v", err)
+			d.emitEvent("%v", err)
+		}
+	}
+
+	h.startStatsFile()
+	d.startThreadMonitor(h)
+	d.startHealthChecker(h, healthCheck)
+	return &StartResponse{Handle: h}, nil
+}
+
+func (d *ExecDriver) Cleanup(*ExecContext, *CreatedResources) error { return nil }
+
+// acquireCpuset tracks the task as pinned to the cores of the cpuset. If the
+// cores are shared with other tasks, the task is rejected under the strict
+// policy and otherwise allowed to share them with a warning.
+func (d *ExecDriver) acquireCpuset(id, cpuset string) error {
+	cores, err := parseCpuset(cpuset)
+	if err != nil {
+		return dstructs.NewStartError(dstructs.StartFailureConfig, err)
+	}
+
+	var strict bool
+	switch policy := d.config.ReadDefault(execCpusetPolicyConfigOption, cpusetPolicyStrict); policy {
+	case cpusetPolicyStrict:
+		strict = true
+	case cpusetPolicyBestEffort:
+	default:
+		return dstructs.NewStartError(dstructs.StartFailureConfig,
+			fmt.Errorf("invalid %s %q; must be %q or %q", execCpusetPolicyConfigOption, policy, cpusetPolicyStrict, cpusetPolicyBestEffort))
+	}
+
+	shared, err := globalCpusets.Acquire(id, cores, strict)
+	if err != nil {
+		// The cores may be released by the time the task is restarted
+		return dstructs.NewStartError(dstructs.StartFailureCgroup, structs.NewRecoverableError(err, true))
+	}
+	if len(shared) != 0 {
+		d.logger.Printf("[WARN] driver.exec: task %q shares cpuset cores %s with other tasks", id, formatCpuset(shared))
+		d.emitEvent("Sharing cpuset cores %s with other tasks", formatCpuset(shared))
+	}
+	return nil
+}
+
+// taskFilePath returns the host path of a file given by the option in the
+// task's config. The path is relative to the task directory and must not
+// escape it.
+func taskFilePath(option, taskDir, path string) (string, error) {
+	p := filepath.Join(taskDir, path)
+	rel, err := filepath.Rel(taskDir, p)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s %q: %v", option, path, err)
+	}
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s %q must be a file within the task directory", option, path)
+	}
+	return p, nil
+}
+
+// workDirPath returns the host path of the work dir of a task. The work dir is
+// relative to the task directory and must not escape it.
+func workDirPath(taskDir, workDir string) (string, error) {
+	p := filepath.Join(taskDir, workDir)
+	if !pathWithin(p, taskDir) {
+		return "", fmt.Errorf("work_dir %q must be within the task directory", workDir)
+	}
+	return p, nil
+}
+
+// validateCommandExists returns an error if the task's absolute command isn't
+// found at the host path it's copied into the chroot from. Commands that are
+// interpolated, looked up in the PATH or that the task dir, artifacts,
+// templates or chroot mounts may provide are only resolved once started.
+func validateCommandExists(task *structs.Task, driverConfig *ExecDriverConfig, chroot map[string]string) error {
+	command := driverConfig.Command
+	if !filepath.IsAbs(command) || strings.Contains(command, "${") {
+		return nil
+	}
+	command = filepath.Clean(command)
+
+	provided := []string{allocdir.SharedAllocName, allocdir.TaskLocal, allocdir.TaskSecrets}
+	for _, artifact := range task.Artifacts {
+		provided = append(provided, artifact.RelativeDest)
+	}
+	for _, tmpl := range task.Templates {
+		provided = append(provided, tmpl.DestPath)
+	}
+	for _, m := range driverConfig.ChrootMounts {
+		provided = append(provided, m.TaskPath)
+	}
+	for _, m := range driverConfig.Tmpfs {
+		provided = append(provided, m.Path)
+	}
+	for _, p := range provided {
+		if pathWithin(command, filepath.Join("/", p)) {
+			return nil
+		}
+	}
+
+	hostPath := chrootHostPath(chroot, command)
+	if hostPath == "" {
+		return fmt.Errorf("command %q isn't within the chroot", driverConfig.Command)
+	}
+	if _, err := os.Stat(hostPath); err != nil {
+		return fmt.Errorf("command %q can't be found: %v", driverConfig.Command, err)
+	}
+	return nil
+}
+
+// chrootHostPath returns the host path the clean, absolute path within the
+// chroot is copied from, using the most specific chroot entry, or "" if no
+// entry provides it.
+func chrootHostPath(chroot map[string]string, path string) string {
+	hostPath, dest := "", ""
+	for src, d := range chroot {
+		if pathWithin(path, d) && len(d) > len(dest) {
+			hostPath, dest = filepath.Join(src, strings.TrimPrefix(path, d)), d
+		}
+	}
+	return hostPath
+}
+
+// chrootShells returns which of the execShells are executables in /bin of the
+// chroot. Only their host paths are stat'd, so it's cheap enough to run on
+// every fingerprint.
+func chrootShells(chroot map[string]string) map[string]bool {
+	shells := make(map[string]bool, len(execShells))
+	for _, shell := range execShells {
+		hostPath := chrootHostPath(chroot, filepath.Join("/bin", shell))
+		if hostPath == "" {
+			continue
+		}
+		if fi, err := os.Stat(hostPath); err == nil && fi.Mode().IsRegular() && fi.Mode().Perm()&0111 != 0 {
+			shells[shell] = true
+		}
+	}
+	return shells
+}
+
+// pathWithin returns whether the clean, absolute path is dir or within it.
+func pathWithin(path, dir string) bool {
+	dir = filepath.Clean(dir)
+	return dir == "/" || path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// validateChrootMounts returns an error if a chroot mount isn't an absolute
+// host path mounted at an absolute path within the chroot outside of the
+// directories managed by the client.
+func validateChrootMounts(mounts []*ExecChrootMount) error {
+	for _, m := range mounts {
+		if !filepath.IsAbs(m.HostPath) {
+			return fmt.Errorf("chroot_mounts host_path %q must be an absolute path", m.HostPath)
+		}
+		if err := validateChrootPath("chroot_mounts task_path", m.TaskPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateChrootPath returns an error if the path something is mounted at
+// within the chroot isn't absolute, is the root of the chroot or is within one
+// of the reservedChrootDirs. The name of the path is used in errors.
+func validateChrootPath(name, path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%s %q must be an absolute path", name, path)
+	}
+	p := filepath.Clean(path)
+	if p == "/" {
+		return fmt.Errorf("%s %q must not be the root of the chroot", name, path)
+	}
+	for _, dir := range reservedChrootDirs {
+		if p == "/"+dir || strings.HasPrefix(p, "/"+dir+"/") {
+			return fmt.Errorf("%s %q must not be within /%s", name, path, dir)
+		}
+	}
+	return nil
+}
+
+// validateDevices returns an error if a device isn't an absolute path within
+// /dev, is listed twice or has permissions other than a combination of "r",
+// "w" and "m".
+func validateDevices(devices []*ExecDevice) error {
+	seen := make(map[string]struct{}, len(devices))
+	for _, d := range devices {
+		if !filepath.IsAbs(d.Path) {
+			return fmt.Errorf("device %q must be an absolute path", d.Path)
+		}
+		p := filepath.Clean(d.Path)
+		if !strings.HasPrefix(p, "/dev/") {
+			return fmt.Errorf("device %q must be within /dev", d.Path)
+		}
+		if _, ok := seen[p]; ok {
+			return fmt.Errorf("device %q is listed more than once", d.Path)
+		}
+		seen[p] = struct{}{}
+
+		for i, c := range d.Permissions {
+			if !strings.ContainsRune(defaultDevicePermissions, c) || strings.ContainsRune(d.Permissions[:i], c) {
+				return fmt.Errorf("device %q permissions %q must be a combination of \"r\", \"w\" and \"m\"", d.Path, d.Permissions)
+			}
+		}
+	}
+	return nil
+}
+
+// validateIOLimits returns an error if an I/O limit isn't for an absolute
+// device path or doesn't limit a direction with a positive bandwidth.
+func validateIOLimits(limits []*ExecIOLimit) error {
+	for _, l := range limits {
+		if !filepath.IsAbs(l.Device) {
+			return fmt.Errorf("io_limit device %q must be an absolute path", l.Device)
+		}
+		if l.ReadBps < 0 || l.WriteBps < 0 {
+			return fmt.Errorf("io_limit read_bps and write_bps of %q must not be negative", l.Device)
+		}
+		if l.ReadBps == 0 && l.WriteBps == 0 {
+			return fmt.Errorf("io_limit of %q must set read_bps or write_bps", l.Device)
+		}
+	}
+	return nil
+}
+
+// validateTmpfsMounts returns an error if a tmpfs isn't mounted at an
+// absolute path within the chroot outside of the directories managed by the
+// client, or has a negative size.
+func validateTmpfsMounts(mounts []*ExecTmpfsMount) error {
+	for _, m := range mounts {
+		if err := validateChrootPath("tmpfs path", m.Path); err != nil {
+			return err
+		}
+		if m.SizeMB < 0 {
+			return fmt.Errorf("tmpfs size_mb of %q must not be negative", m.Path)
+		}
+	}
+	return nil
+}
+
+// threadsThreshold returns the thread count at which an event is emitted. It
+// defaults to 90% of the maximum threads, if any.
+func threadsThreshold(maxThreads, threshold int) int {
+	if threshold == 0 && maxThreads > 0 {
+		threshold = maxThreads * 9 / 10
+		if threshold == 0 {
+			threshold = 1
+		}
+	}
+	return threshold
+}
+
+// startThreadMonitor starts counting the task's threads until it exits, if a
+// threshold is configured.
+func (d *ExecDriver) startThreadMonitor(h *execHandle) {
+	if h.threadsThreshold == 0 {
+		return
+	}
+	m := &threadMonitor{
+		threshold:  h.threadsThreshold,
+		stats:      h.Stats,
+		excludePid: h.pluginClient.ReattachConfig().Pid,
+		emitEvent:  d.emitEvent,
+		labels: []metrics.Label{
+			{Name: "alloc_id", Value: d.allocID},
+			{Name: "task", Value: d.taskName},
+		},
+		logger: d.logger,
+	}
+	go m.run(h.doneCh)
+}
+
+// startHealthChecker starts checking the task's health until it exits, if a
+// health check is configured.
+func (d *ExecDriver) startHealthChecker(h *execHandle, check *healthCheck) {
+	if check == nil {
+		return
+	}
+	h.healthChecker = newHealthChecker(check, h.Exec, h.events, d.emitEvent, d.logger)
+	go h.healthChecker.run(h.doneCh)
+}
+
+// crashReportTTL parses the crash_report_ttl, returning the default TTL if
+// it's empty.
+func crashReportTTL(ttl string) (time.Duration, error) {
+	if ttl == "" {
+		return defaultCrashReportTTL, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, fmt.Errorf("invalid crash_report_ttl %q: %v", ttl, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("crash_report_ttl %q must be positive", ttl)
+	}
+	return d, nil
+}
+
+// preKillTimeout parses the pre_kill_timeout, returning the default timeout
+// if it's empty.
+func preKillTimeout(timeout string) (time.Duration, error) {
+	return hookTimeout("pre_kill_timeout", timeout, defaultPreKillTimeout, maxPreKillTimeout)
+}
+
+// postStartTimeout parses the post_start_timeout, returning the default
+// timeout if it's empty.
+func postStartTimeout(timeout string) (time.Duration, error) {
+	return hookTimeout("post_start_timeout", timeout, defaultPostStartTimeout, maxPostStartTimeout)
+}
+
+// hookTimeout parses the timeout of a hook command set by the named option,
+// returning def if it's empty. The timeout must be positive and at most max.
+func hookTimeout(option, timeout string, def, max time.Duration) (time.Duration, error) {
+	if timeout == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", option, timeout, err)
+	}
+	if d <= 0 || d > max {
+		return 0, fmt.Errorf("%s %q must be positive and at most %v", option, timeout, max)
+	}
+	return d, nil
+}
+
+// startConfirmation parses the start_confirmation window, returning zero if
+// it's empty.
+func startConfirmation(window string) (time.Duration, error) {
+	if window == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil {
+		return 0, fmt.Errorf("invalid start_confirmation %q: %v", window, err)
+	}
+	if d <= 0 || d > maxStartConfirmation {
+		return 0, fmt.Errorf("start_confirmation %q must be positive and at most %v", window, maxStartConfirmation)
+	}
+	return d, nil
+}
+
+// memorySoftLimitGrace parses the memory_soft_limit_grace, returning the
+// default if it's empty.
+func memorySoftLimitGrace(grace string) (time.Duration, error) {
+	if grace == "" {
+		return defaultMemorySoftLimitGrace, nil
+	}
+	d, err := time.ParseDuration(grace)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory_soft_limit_grace %q: %v", grace, err)
+	}
+	if d < minMemorySoftLimitGrace {
+		return 0, fmt.Errorf("memory_soft_limit_grace %q must be at least %v", grace, minMemorySoftLimitGrace)
+	}
+	return d, nil
+}
+
+// checkMinNice returns an error if the nice value is below the client's
+// minimum.
+func (d *ExecDriver) checkMinNice(nice int) error {
+	min := d.config.ReadIntDefault(execMinNiceConfigOption, 0)
+	if err := checkNice(min); err != nil {
+		return fmt.Errorf("%s: %v", execMinNiceConfigOption, err)
+	}
+	if nice < min {
+		return fmt.Errorf("nice %d is below the client's minimum of %d; lower %q to allow it", nice, min, execMinNiceConfigOption)
+	}
+	return nil
+}
+
+// checkNice returns an error if the nice value is out of range.
+func checkNice(nice int) error {
+	if nice < minNice || nice > maxNice {
+		return fmt.Errorf("nice %d must be between %d and %d", nice, minNice, maxNice)
+	}
+	return nil
+}
+
+// parseIgnoreSignals parses the names of the signals a task is started
+// ignoring. Signals the executor relies on, or that can't be ignored, are
+// rejected.
+func parseIgnoreSignals(names []string) ([]os.Signal, error) {
+	sigs := make([]os.Signal, 0, len(names))
+	for _, name := range names {
+		sig, err := ParseSignal(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignore_signals: %v", err)
+		}
+		if !ignorableSignal(sig) {
+			return nil, fmt.Errorf("ignore_signals signal %q can't be ignored", name)
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+// parseUmask parses the octal umask.
+func parseUmask(umask string) (os.FileMode, error) {
+	mask, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid umask %q: must be octal", umask)
+	}
+	if mask > 0777 {
+		return 0, fmt.Errorf("umask %q must be at most 0777", umask)
+	}
+	return os.FileMode(mask), nil
+}
+
+// newCrashReporter returns the crash reporter of the task writing reports to
+// the shared alloc dir.
+func (d *ExecDriver) newCrashReporter(ctx *ExecContext, ttl time.Duration, command []string) *crashReporter {
+	return &crashReporter{
+		task:     d.taskName,
+		taskDir:  ctx.TaskDir.Dir,
+		allocDir: ctx.TaskDir.SharedAllocDir,
+		ttl:      ttl,
+		command:  command,
+		envKeys:  envKeys(ctx.TaskEnv.Map()),
+	}
+}
+
+// coreDumpDir returns the directory, relative to the task dir, the host's
+// core_pattern writes the task's core dumps to, creating it if needed, along
+// with the prefix of their names. An error explains why the pattern doesn't
+// write them into the task's directory. workDir is the task's working
+// directory relative to its task dir.
+func (d *ExecDriver) coreDumpDir(ctx *ExecContext, workDir string, chroot bool) (string, string, error) {
+	pattern, err := readCorePattern()
+	if err != nil {
+		return "", "", err
+	}
+	dir, err := corePatternDir(pattern, chroot)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Absolute directories are within the chroot
+	rel := filepath.Join(".", dir)
+	if !filepath.IsAbs(dir) {
+		rel = filepath.Join(".", workDir, dir)
+	}
+	if err := createCoreDumpDir(ctx.TaskDir.Dir, rel); err != nil {
+		return "", "", err
+	}
+	return rel, corePrefix(pattern), nil
+}
+
+// statsFileInterval parses the stats_file_interval, returning the default
+// interval if it's empty.
+func statsFileInterval(interval string) (time.Duration, error) {
+	if interval == "" {
+		return defaultStatsFileInterval, nil
+	}
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid stats_file_interval %q: %v", interval, err)
+	}
+	if d < time.Second {
+		return 0, fmt.Errorf("stats_file_interval %q must be at least 1s", interval)
+	}
+	return d, nil
+}
+
+// hostCommandPath resolves the command like the executor does when starting
+// it, and returns its host path if it's provided by the host rather than the
+// task directory. The executor prefers the task's local dir and the root of
+// the task dir, where artifacts and templates put commands, before looking
+// relative commands up in the PATH.
+func hostCommandPath(taskDir *allocdir.TaskDir, command string) (string, bool) {
+	if command == "" {
+		return "", false
+	}
+	if _, err := os.Stat(filepath.Join(taskDir.LocalDir, command)); err == nil {
+		return "", false
+	}
+	if filepath.IsAbs(command) {
+		return command, true
+	}
+	if _, err := os.Stat(filepath.Join(taskDir.Dir, command)); err == nil {
+		return "", false
+	}
+
+	host, err := exec.LookPath(command)
+	if err != nil || !filepath.IsAbs(host) {
+		return "", false
+	}
+	return host, true
+}
+
+// writePidFile writes the pid to the file at path within the task dir,
+// replacing it atomically so readers never see a partial PID. The task may
+// control the directories within its task dir so symbolic links aren't
+// followed.
+func writePidFile(taskDir, path string, pid int) error {
+	rel, err := filepath.Rel(taskDir, path)
+	if err != nil {
+		return fmt.Errorf("failed to write pid file: %v", err)
+	}
+	if err := allocdir.WriteFileBeneath(taskDir, rel, []byte(fmt.Sprintf("%d\n", pid)), 0644); err != nil {
+		return fmt.Errorf("failed to write pid file: %v", err)
+	}
+	return nil
+}
+
+// removePidFile removes the pid file at path within the task dir without
+// following symbolic links.
+func removePidFile(taskDir, path string) error {
+	rel, err := filepath.Rel(taskDir, path)
+	if err != nil {
+		return err
+	}
+	return allocdir.RemoveBeneath(taskDir, rel)
+}
+
+// scratchDirPath returns the host path of the scratch directory given in the
+// task's config. The scratch directory must be a directory directly within the
+// shared alloc dir and not one of the directories created by Nomad.
+func scratchDirPath(allocDir, name string) (string, error) {
+	if name == "." || name == ".." || strings.ContainsRune(name, filepath.Separator) {
+		return "", fmt.Errorf("scratch_dir %q must be the name of a directory within the alloc directory", name)
+	}
+	for _, reserved := range allocdir.SharedAllocDirs {
+		if name == reserved {
+			return "", fmt.Errorf("scratch_dir %q is reserved", name)
+		}
+	}
+	return filepath.Join(allocDir, name), nil
+}
+
+// createScratchDir creates the scratch directory name within the shared alloc
+// dir, if it doesn't exist yet, and ensures it's owned by the client and the
+// group and has the setgid bit set so that the files of all tasks are
+// accessible by the group. Tasks can write to the shared alloc dir so the
+// directory is changed through a descriptor rather than its path, which a task
+// could replace with a symlink, and a directory a task created in its place is
+// taken over from the task. A directory created here is removed again if it
+// can't be set up.
+func createScratchDir(allocDir, name string, gid uint32) error {
+	created := false
+	dir, err := allocdir.OpenDirBeneath(allocDir, name, false, 0)
+	if os.IsNotExist(err) {
+		created = true
+		dir, err = allocdir.OpenDirBeneath(allocDir, name, true, 0770)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open scratch_dir %q: %v", name, err)
+	}
+	defer dir.Close()
+
+	err = dir.Chown(os.Getuid(), int(gid))
+	if err != nil {
+		err = fmt.Errorf("failed to set owner of scratch_dir: %v", err)
+	} else if err = dir.Chmod(scratchDirMode); err != nil {
+		err = fmt.Errorf("failed to set mode of scratch_dir: %v", err)
+	}
+	if err != nil && created {
+		if parent, openErr := os.Open(allocDir); openErr == nil {
+			allocdir.RemoveAt(parent, name)
+			parent.Close()
+		}
+	}
+	return err
+}
+
+// execDefaultEnv returns the environment variables the client configures for
+// every exec task. Their values may use Nomad interpolation.
+func execDefaultEnv(conf *config.Config) map[string]string {
+	defaults := make(map[string]string)
+	for k, v := range conf.Options {
+		if strings.HasPrefix(k, execEnvConfigPrefix) && len(k) > len(execEnvConfigPrefix) {
+			defaults[strings.TrimPrefix(k, execEnvConfigPrefix)] = v
+		}
+	}
+	return defaults
+}
+
+// execHostEnvPassthrough returns the host environment variables the exec task
+// inherits and whether it limits them at all.
+func execHostEnvPassthrough(task *structs.Task) ([]string, bool) {
+	if _, ok := task.Config["host_env_passthrough"]; !ok {
+		return nil, false
+	}
+	var driverConfig ExecDriverConfig
+	if err := mapstructure.WeakDecode(task.Config, &driverConfig); err != nil {
+		return nil, false
+	}
+	return driverConfig.HostEnvPassthrough, true
 }
 
-func (d *ExecDriver) Prestart(*ExecContext, *structs.Task) (*PrestartResponse, error) {
-	return nil, nil
+// metricsTaskEnv returns a copy of the task's environment advertising the port
+// with the given label as the task's metrics endpoint along with the address
+// of the endpoint.
+func metricsTaskEnv(taskEnv *env.TaskEnv, label string) (*env.TaskEnv, string, error) {
+	envMap := taskEnv.Map()
+	port, ok := envMap[env.PortPrefix+label]
+	if !ok {
+		return nil, "", fmt.Errorf("metrics_port %q is not a port of the task", label)
+	}
+	addr := envMap[env.AddrPrefix+label]
+
+	envMap[env.MetricsPort] = port
+	envMap[env.MetricsAddr] = addr
+	return env.NewTaskEnv(envMap, taskEnv.NodeAttrs), addr, nil
 }
 
-func (d *ExecDriver) Start(ctx *ExecContext, task *structs.Task) (*StartResponse, error) {
-	var driverConfig ExecDriverConfig
-	if err := mapstructure.WeakDecode(task.Config, &driverConfig); err != nil {
-		return nil, err
+// taskHasPort returns whether the task's network resources have a port with
+// the given label.
+func taskHasPort(task *structs.Task, label string) bool {
+	if task.Resources == nil {
+		return false
 	}
+	for _, n := range task.Resources.Networks {
+		for _, ports := range [][]structs.Port{n.ReservedPorts, n.DynamicPorts} {
+			for _, p := range ports {
+				if p.Label == label {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
 
-	// Get the command to be ran
-	command := driverConfig.Command
-	if err := validateCommand(command, "args"); err != nil {
-		return nil, err
+// socketActivationTaskEnv returns a copy of the task's environment telling it
+// that a socket listening on the port with the given label is passed to it,
+// along with the address of the port.
+func socketActivationTaskEnv(taskEnv *env.TaskEnv, label string) (*env.TaskEnv, string, error) {
+	envMap := taskEnv.Map()
+	addr, ok := envMap[env.AddrPrefix+label]
+	if !ok {
+		return nil, "", fmt.Errorf("socket_activation port %q is not a port of the task", label)
 	}
 
-	pluginLogFile := filepath.Join(ctx.TaskDir.Dir, "executor.out")
-	executorConfig := &dstructs.ExecutorConfig{
-		LogFile:  pluginLogFile,
-		LogLevel: d.config.LogLevel,
+	envMap[listenFdsEnv] = "1"
+	envMap[listenFdNamesEnv] = label
+	return env.NewTaskEnv(envMap, taskEnv.NodeAttrs), addr, nil
+}
+
+// checkCommandWrapper checks that the command wrapper is an executable file
+// within the task's chroot.
+func checkCommandWrapper(taskDir, wrapper string) error {
+	if !filepath.IsAbs(wrapper) {
+		return fmt.Errorf("%s %q must be an absolute path within the chroot", execCommandWrapperConfigOption, wrapper)
 	}
-	exec, pluginClient, err := createExecutor(d.config.LogOutput, d.config, executorConfig)
+	fi, err := os.Stat(filepath.Join(taskDir, wrapper))
 	if err != nil {
-		return nil, err
-	}
-	executorCtx := &executor.ExecutorContext{
-		TaskEnv: ctx.TaskEnv,
-		Driver:  "exec",
-		LogDir:  ctx.TaskDir.LogDir,
-		TaskDir: ctx.TaskDir.Dir,
-		Task:    task,
+		return fmt.Errorf("command wrapper %q not found in the task's chroot: %v", wrapper, err)
 	}
-	if err := exec.SetContext(executorCtx); err != nil {
-		pluginClient.Kill()
-		return nil, fmt.Errorf("failed to set executor context: %v", err)
+	if !fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("command wrapper %q in the task's chroot is not an executable file", wrapper)
 	}
+	return nil
+}
 
-	taskKillSignal, err := getTaskKillSignal(task.KillSignal)
-	if err != nil {
-		return nil, err
+// wrappedTaskEnv returns a copy of the task's environment telling the command
+// wrapper which command it wraps.
+func wrappedTaskEnv(taskEnv *env.TaskEnv, command string) *env.TaskEnv {
+	envMap := taskEnv.Map()
+	envMap[env.WrappedCommand] = command
+	return env.NewTaskEnv(envMap, taskEnv.NodeAttrs)
+}
+
+// exportTaskEnv writes the task's environment to <task>.env in the shared
+// alloc dir. The Vault token and any variables listed in exclude are treated
+// as secrets and never written.
+func exportTaskEnv(ctx *ExecContext, task *structs.Task, exclude []string) error {
+	secrets := map[string]struct{}{
+		env.VaultToken: {},
+	}
+	for _, k := range exclude {
+		secrets[k] = struct{}{}
 	}
 
-	execCmd := &executor.ExecCommand{
-		Cmd:            command,
-		Args:           driverConfig.Args,
-		TaskKillSignal: taskKillSignal,
-		FSIsolation:    true,
-		ResourceLimits: true,
-		User:           getExecutorUser(task),
+	path := filepath.Join(ctx.TaskDir.SharedAllocDir, fmt.Sprintf("%s.env", task.Name))
+	if err := writeEnvFile(path, ctx.TaskEnv.Map(), secrets); err != nil {
+		return fmt.Errorf("failed to export task environment: %v", err)
 	}
+	return nil
+}
 
-	ps, err := exec.LaunchCmd(execCmd)
-	if err != nil {
-		pluginClient.Kill()
-		return nil, err
+// taskLogFiles returns the name of the log files of each stream of a task
+// without the rotation index.
+func taskLogFiles(logConfig *structs.LogConfig, task, allocID string) map[string]string {
+	streams := []string{"stdout", "stderr"}
+	if logConfig != nil && logConfig.CombineLogs {
+		streams = []string{structs.LogStreamCombined}
+	}
+	files := make(map[string]string, len(streams))
+	for _, stream := range streams {
+		files[stream] = logConfig.FileBaseName(task, allocID, stream)
 	}
+	return files
+}
 
-	d.logger.Printf("[DEBUG] driver.exec: started process via plugin with pid: %v", ps.Pid)
+// taskEnvSecrets returns the keys of the task's environment variables whose
+// values are secrets: the Vault token and the default variables listed in
+// driver.exec.env_secrets.
+func taskEnvSecrets(defaults map[string]struct{}) map[string]struct{} {
+	secrets := map[string]struct{}{
+		env.VaultToken: {},
+	}
+	for k := range defaults {
+		secrets[k] = struct{}{}
+	}
+	return secrets
+}
 
-	// Return a driver handle
-	maxKill := d.DriverContext.config.MaxKillTimeout
-	h := &execHandle{
-		pluginClient:    pluginClient,
-		userPid:         ps.Pid,
-		executor:        exec,
-		isolationConfig: ps.IsolationConfig,
-		killTimeout:     GetKillTimeout(task.KillTimeout, maxKill),
-		maxKillTimeout:  maxKill,
-		logger:          d.logger,
-		version:         d.config.Version.VersionNumber(),
-		doneCh:          make(chan struct{}),
-		waitCh:          make(chan *dstructs.WaitResult, 1),
-		taskDir:         ctx.TaskDir,
+// restoreTaskEnv returns the environment a reattached task was started with
+// from the environment persisted in its handle ID. The values of the secrets
+// aren't persisted, so they're redacted rather than taken from the task's
+// current environment, which may have changed since it was started.
+func restoreTaskEnv(persisted map[string]string, secrets map[string]struct{}) map[string]string {
+	envMap := make(map[string]string, len(persisted)+len(secrets))
+	for k, v := range persisted {
+		envMap[k] = v
 	}
-	go h.run()
-	return &StartResponse{Handle: h}, nil
+	for k := range secrets {
+		envMap[k] = redactedValue
+	}
+	return envMap
 }
 
-func (d *ExecDriver) Cleanup(*ExecContext, *CreatedResources) error { return nil }
+// execIdVersion is the version of the execId schema. It's bumped whenever
+// the type or meaning of a field changes, along with a migration from the
+// previous version in execIdMigrations.
+const execIdVersion = 1
+
+// execIdMigrations migrate the fields of an execId from the version at their
+// index to the next version.
+var execIdMigrations = []func(values map[string]json.RawMessage) error{
+	// IDs written before the schema was versioned only differ in the fields
+	// they lack or carry over from older releases, which are ignored
+	func(map[string]json.RawMessage) error { return nil },
+}
 
 type execId struct {
+	// HandleVersion is the execIdVersion the ID was written with
+	HandleVersion int
+
 	Version         string
+	TaskID          string
 	KillTimeout     time.Duration
 	MaxKillTimeout  time.Duration
 	UserPid         int
 	IsolationConfig *dstructs.IsolationConfig
 	PluginConfig    *PluginReattachConfig
+	SignalCoalesce  map[string]time.Duration
+	StackDumpSignal string
+	PreKillCommand  []string
+	PreKillTimeout  time.Duration
+	PidFile         string
+	Cpuset          string
+	CpusetID        string
+	BridgeAddr      string
+	BridgeID        string
+	Userns          *executor.UserNamespace
+	UsernsID        string
+
+	StatsFile         string
+	StatsFileInterval time.Duration
+	StatsFileMaxBytes int64
+	ThreadsThreshold  int
+
+	// CrashReportTTL is zero unless crash reports are enabled
+	CrashReportTTL time.Duration
+	CrashCommand   []string
+
+	// CoreDir is empty unless the task's core dumps are kept from where the
+	// host's core_pattern writes them. CoresOnly is set if no crash reports
+	// are written.
+	CoreDir    string
+	CorePrefix string
+	CoresOnly  bool
+
+	StartedAt time.Time
+
+	// HealthCheck is nil unless a health check is configured
+	HealthCheck *healthCheck
+
+	LogFiles map[string]string
+
+	// Env is the environment the task was started with, without the values
+	// of the secrets it was started with, which are listed in EnvSecrets
+	Env        map[string]string
+	EnvSecrets []string
 }
 
-func (d *ExecDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, error) {
+// parseExecId parses the handle ID written by ID, migrating IDs written by
+// older versions. Unknown fields are ignored but a field that can't be parsed
+// is an error, as the task would otherwise be reattached with a partial
+// configuration.
+func parseExecId(handleID string, logger *log.Logger) (*execId, error) {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(handleID), &values); err != nil {
+		return nil, err
+	}
+
+	var version int
+	if raw, ok := values["HandleVersion"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return nil, fmt.Errorf("invalid handle version: %v", err)
+		}
+	}
+	if version > execIdVersion {
+		logger.Printf("[WARN] driver.exec: handle version %d is newer than %d; fields may be ignored", version, execIdVersion)
+	}
+	for v := version; v >= 0 && v < execIdVersion; v++ {
+		if err := execIdMigrations[v](values); err != nil {
+			return nil, fmt.Errorf("failed to migrate handle from version %d: %v", v, err)
+		}
+	}
+
+	// Decode the fields one by one into the returned ID so that errors name
+	// the field. Field names match case-insensitively, so names that differ
+	// only in case are rejected rather than decoded into the same slice or
+	// map; every field of the ID is then decoded into a fresh value.
 	id := &execId{}
-	if err := json.Unmarshal([]byte(handleID), id); err != nil {
+	seen := make(map[string]string, len(values))
+	for name, raw := range values {
+		if other, ok := seen[strings.ToLower(name)]; ok {
+			return nil, fmt.Errorf("duplicate fields %q and %q in handle", other, name)
+		}
+		seen[strings.ToLower(name)] = name
+
+		field, err := json.Marshal(map[string]json.RawMessage{name: raw})
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(field, id); err != nil {
+			return nil, fmt.Errorf("invalid field %q of handle: %v", name, err)
+		}
+	}
+
+	if id.PluginConfig == nil || id.UserPid == 0 {
+		return nil, fmt.Errorf("handle lacks the plugin config or user pid required to reattach")
+	}
+	id.HandleVersion = execIdVersion
+	return id, nil
+}
+
+func (d *ExecDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, error) {
+	id, err := parseExecId(handleID, d.logger)
+	if err != nil {
 		return nil, fmt.Errorf("Failed to parse handle '%s': %v", handleID, err)
 	}
 
@@ -209,32 +2926,158 @@ func (d *ExecDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, erro
 
 	ver, _ := exec.Version()
 	d.logger.Printf("[DEBUG] driver.exec : version of executor: %v", ver.Version)
+
+	coalescer, err := newSignalCoalescer(id.SignalCoalesce)
+	if err != nil {
+		d.logger.Printf("[WARN] driver.exec: ignoring invalid signal coalescing config: %v", err)
+		coalescer, _ = newSignalCoalescer(nil)
+	}
+
+	// Track the cores of the running task again. It's already running so the
+	// cores are shared regardless of the policy.
+	if id.Cpuset != "" {
+		if cores, err := parseCpuset(id.Cpuset); err == nil {
+			globalCpusets.Acquire(id.CpusetID, cores, false)
+		}
+	}
+
+	// Track the address of the running task on the bridge again
+	if id.BridgeAddr != "" {
+		if ip := net.ParseIP(id.BridgeAddr); ip != nil {
+			globalBridgeAddrs.Reserve(id.BridgeID, ip)
+		}
+	}
+
+	// Track the subordinate ids of the running task's user namespace again
+	if id.Userns != nil {
+		globalSubUIDs.Reserve(id.UsernsID, id.Userns.UID, id.Userns.Size)
+		globalSubGIDs.Reserve(id.UsernsID, id.Userns.GID, id.Userns.Size)
+	}
+
+	// Handles written before the task's ID was persisted derive it again
+	taskID := id.TaskID
+	if taskID == "" {
+		taskID = d.taskID
+	}
+
 	// Return a driver handle
 	h := &execHandle{
-		pluginClient:    client,
-		executor:        exec,
-		userPid:         id.UserPid,
-		isolationConfig: id.IsolationConfig,
-		logger:          d.logger,
-		version:         id.Version,
-		killTimeout:     id.KillTimeout,
-		maxKillTimeout:  id.MaxKillTimeout,
-		doneCh:          make(chan struct{}),
-		waitCh:          make(chan *dstructs.WaitResult, 1),
-		taskDir:         ctx.TaskDir,
+		pluginClient:      client,
+		executor:          exec,
+		userPid:           id.UserPid,
+		isolationConfig:   id.IsolationConfig,
+		logger:            d.logger,
+		version:           id.Version,
+		taskID:            taskID,
+		killTimeout:       id.KillTimeout,
+		maxKillTimeout:    id.MaxKillTimeout,
+		doneCh:            make(chan struct{}),
+		detachCh:          make(chan struct{}),
+		waitCh:            make(chan *dstructs.WaitResult, 1),
+		taskDir:           ctx.TaskDir,
+		signalCoalesce:    id.SignalCoalesce,
+		signalCoalescer:   coalescer,
+		stackDumpSignal:   id.StackDumpSignal,
+		preKillCommand:    id.PreKillCommand,
+		preKillTimeout:    id.PreKillTimeout,
+		pidFile:           id.PidFile,
+		cpuset:            id.Cpuset,
+		cpusetID:          id.CpusetID,
+		bridgeAddr:        id.BridgeAddr,
+		bridgeID:          id.BridgeID,
+		userns:            id.Userns,
+		usernsID:          id.UsernsID,
+		statsFile:         id.StatsFile,
+		statsFileInterval: id.StatsFileInterval,
+		statsFileMaxBytes: id.StatsFileMaxBytes,
+		threadsThreshold:  id.ThreadsThreshold,
+		startedAt:         id.StartedAt,
+		logFiles:          id.LogFiles,
+		emitEvent:         d.emitEvent,
+		statsInterval:     d.statsInterval(),
+		events:            newEventStream(taskID),
+		envSecrets:        make(map[string]struct{}, len(id.EnvSecrets)),
+	}
+	for _, k := range id.EnvSecrets {
+		h.envSecrets[k] = struct{}{}
+	}
+	if h.logFiles == nil {
+		// Handles written before the log files were persisted use the
+		// default naming
+		h.logFiles = taskLogFiles(nil, d.taskName, d.allocID)
+	}
+	if id.Env != nil {
+		h.env = restoreTaskEnv(id.Env, h.envSecrets)
+	}
+
+	// The transitions before the reattach were published by the previous
+	// handle, so the task's current state is replayed instead
+	h.events.publish(time.Now(), DriverEventStarted, "Reattached to running task with pid %d", id.UserPid)
+	if id.CrashReportTTL != 0 {
+		h.crashReporter = d.newCrashReporter(ctx, id.CrashReportTTL, id.CrashCommand)
+		h.crashReporter.coreDir = id.CoreDir
+		h.crashReporter.corePrefix = id.CorePrefix
+		h.crashReporter.coresOnly = id.CoresOnly
+		go h.crashReporter.run(h.doneCh)
 	}
 	go h.run()
+	h.startStatsFile()
+	d.startThreadMonitor(h)
+	d.startHealthChecker(h, id.HealthCheck)
 	return h, nil
 }
 
 func (h *execHandle) ID() string {
 	id := execId{
-		Version:         h.version,
-		KillTimeout:     h.killTimeout,
-		MaxKillTimeout:  h.maxKillTimeout,
-		PluginConfig:    NewPluginReattachConfig(h.pluginClient.ReattachConfig()),
-		UserPid:         h.userPid,
-		IsolationConfig: h.isolationConfig,
+		HandleVersion:     execIdVersion,
+		Version:           h.version,
+		TaskID:            h.taskID,
+		KillTimeout:       h.killTimeout,
+		MaxKillTimeout:    h.maxKillTimeout,
+		PluginConfig:      NewPluginReattachConfig(h.pluginClient.ReattachConfig()),
+		UserPid:           h.userPid,
+		IsolationConfig:   h.isolationConfig,
+		SignalCoalesce:    h.signalCoalesce,
+		StackDumpSignal:   h.stackDumpSignal,
+		PreKillCommand:    h.preKillCommand,
+		PreKillTimeout:    h.preKillTimeout,
+		PidFile:           h.pidFile,
+		Cpuset:            h.cpuset,
+		CpusetID:          h.cpusetID,
+		BridgeAddr:        h.bridgeAddr,
+		BridgeID:          h.bridgeID,
+		Userns:            h.userns,
+		UsernsID:          h.usernsID,
+		StatsFile:         h.statsFile,
+		StatsFileInterval: h.statsFileInterval,
+		StatsFileMaxBytes: h.statsFileMaxBytes,
+		ThreadsThreshold:  h.threadsThreshold,
+		StartedAt:         h.startedAt,
+		LogFiles:          h.logFiles,
+	}
+	if h.healthChecker != nil {
+		id.HealthCheck = h.healthChecker.check
+	}
+	if h.crashReporter != nil {
+		id.CrashReportTTL = h.crashReporter.ttl
+		id.CrashCommand = h.crashReporter.command
+		id.CoreDir = h.crashReporter.coreDir
+		id.CorePrefix = h.crashReporter.corePrefix
+		id.CoresOnly = h.crashReporter.coresOnly
+	}
+	if h.env != nil {
+		id.Env = make(map[string]string, len(h.env))
+		for k, v := range h.env {
+			if _, ok := h.envSecrets[k]; !ok {
+				id.Env[k] = v
+			}
+		}
+		for k := range h.envSecrets {
+			if _, ok := h.env[k]; ok {
+				id.EnvSecrets = append(id.EnvSecrets, k)
+			}
+		}
+		sort.Strings(id.EnvSecrets)
 	}
 
 	data, err := json.Marshal(id)
@@ -244,6 +3087,36 @@ func (h *execHandle) ID() string {
 	return string(data)
 }
 
+// CgroupPath returns the host path of the cgroup the executor created for the
+// task. Reattached handles derive it from the isolation config in their ID.
+func (h *execHandle) CgroupPath() string {
+	return executor.CgroupPath(h.isolationConfig)
+}
+
+// TaskID returns the stable ID of the task, which is the same across restarts
+// of the task and reattaches of the handle.
+func (h *execHandle) TaskID() string {
+	return h.taskID
+}
+
+// Environment returns the environment the task was started with. With redact,
+// the values of secrets are replaced. Reattached handles always return the
+// values of secrets redacted as they aren't persisted. Handles reattached from
+// IDs written before the environment was persisted return nil.
+func (h *execHandle) Environment(redact bool) map[string]string {
+	if h.env == nil {
+		return nil
+	}
+	envMap := make(map[string]string, len(h.env))
+	for k, v := range h.env {
+		if _, ok := h.envSecrets[k]; ok && redact {
+			v = redactedValue
+		}
+		envMap[k] = v
+	}
+	return envMap
+}
+
 func (h *execHandle) WaitCh() chan *dstructs.WaitResult {
 	return h.waitCh
 }
@@ -266,39 +3139,382 @@ func (h *execHandle) Exec(ctx context.Context, cmd string, args []string) ([]byt
 	return h.executor.Exec(deadline, cmd, args)
 }
 
+// ExecSplitOutput runs the command like Exec, streaming its output to return
+// stdout and stderr separately.
+func (h *execHandle) ExecSplitOutput(ctx context.Context, cmd string, args []string) ([]byte, []byte, int, error) {
+	stdout, _ := circbuf.NewBuffer(int64(dstructs.CheckBufSize))
+	stderr, _ := circbuf.NewBuffer(int64(dstructs.CheckBufSize))
+	code, err := h.ExecStreaming(ctx, cmd, args, false, strings.NewReader(""), stdout, stderr)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return stdout.Bytes(), stderr.Bytes(), code, nil
+}
+
+func (h *execHandle) ExecStreaming(ctx context.Context, cmd string, args []string, tty bool,
+	stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		// No deadline set on context; default to 1 minute
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Minute)
+		defer cancel()
+	}
+	return h.executor.ExecStreaming(ctx, cmd, args, tty, stdin, stdout, stderr)
+}
+
 func (h *execHandle) Signal(s os.Signal) error {
-	return h.executor.Signal(s)
+	if !h.signalCoalescer.Allow(s) {
+		h.logger.Printf("[DEBUG] driver.exec: coalescing signal %v with a recent delivery", s)
+		return nil
+	}
+	if err := h.executor.Signal(s); err != nil {
+		return err
+	}
+	h.events.publish(time.Now(), DriverEventSignaled, "Sent %v", s)
+	return nil
+}
+
+// SignalGroup sends the signal to every process of the task, such as the
+// workers of a task that doesn't forward signals.
+func (h *execHandle) SignalGroup(s os.Signal) error {
+	if !h.signalCoalescer.Allow(s) {
+		h.logger.Printf("[DEBUG] driver.exec: coalescing signal %v with a recent delivery", s)
+		return nil
+	}
+	if err := h.executor.SignalGroup(s); err != nil {
+		return err
+	}
+	h.events.publish(time.Now(), DriverEventSignaled, "Sent %v to all processes", s)
+	return nil
+}
+
+// Events returns the channel the task's lifecycle transitions are published
+// on.
+func (h *execHandle) Events() <-chan *DriverEvent {
+	return h.events.Events()
+}
+
+// Health returns the task's health, which is unknown unless a health check is
+// configured.
+func (h *execHandle) Health() HealthState {
+	if h.healthChecker == nil {
+		return HealthUnknown
+	}
+	return h.healthChecker.Health()
+}
+
+// DumpStack sends the stack dump signal to the task. Whether a dump is written
+// to the task's logs depends on how the task handles the signal.
+func (h *execHandle) DumpStack() error {
+	name := h.stackDumpSignal
+	if name == "" {
+		name = defaultStackDumpSignal
+	}
+	sig, err := signals.Parse(name)
+	if err != nil {
+		return err
+	}
+
+	h.logger.Printf("[DEBUG] driver.exec: sending %v to pid %d to dump its stacks", sig, h.userPid)
+	if err := h.executor.Signal(sig); err != nil {
+		return err
+	}
+	h.events.publish(time.Now(), DriverEventSignaled, "Sent %v to dump stacks", sig)
+	return nil
+}
+
+// RecentOutput returns the most recent output of the task if its log config
+// enables buffering.
+func (h *execHandle) RecentOutput() ([]byte, []byte, error) {
+	out, err := h.executor.RecentOutput()
+	if err != nil {
+		return nil, nil, err
+	}
+	return out.Stdout, out.Stderr, nil
+}
+
+// Logs streams the log files of the stream of the task.
+func (h *execHandle) Logs(ctx context.Context, stream string, follow bool) (io.ReadCloser, error) {
+	base, ok := h.logFiles[stream]
+	if !ok {
+		return nil, fmt.Errorf("task has no logs of stream %q", stream)
+	}
+	return logging.NewRotatedReader(ctx, h.taskDir.LogDir, base, follow)
 }
 
 func (h *execHandle) Kill() error {
+	// The pre-kill command counts against the kill timeout so that the task
+	// is killed within the time the client allows for it
+	start := time.Now()
+	h.runPreKill(h.killTimeout)
+	remaining := h.killTimeout - time.Since(start)
+	if remaining < 0 {
+		remaining = 0
+	}
+
 	if err := h.executor.ShutDown(); err != nil {
 		if h.pluginClient.Exited() {
 			return nil
 		}
 		return fmt.Errorf("executor Shutdown failed: %v", err)
 	}
+	h.events.publish(time.Now(), DriverEventKilled, "Shut down task")
 
 	select {
 	case <-h.doneCh:
-	case <-time.After(h.killTimeout):
+	case <-time.After(remaining):
 		if h.pluginClient.Exited() {
 			break
 		}
 		if err := h.executor.Exit(); err != nil {
 			return fmt.Errorf("executor Exit failed: %v", err)
 		}
+		h.events.publish(time.Now(), DriverEventKilled, "Killed task after kill timeout %v", h.killTimeout)
+	}
+	return nil
+}
+
+// Detach stops managing the task without killing it, so that it can be
+// reattached to with Open and the handle's ID, such as when the client shuts
+// down to be upgraded. The task, its executor and its cgroup keep running.
+// The handle's goroutines are stopped and no result is sent on its wait
+// channel, so the handle must not be used afterwards.
+func (h *execHandle) Detach() error {
+	exec, ok := h.executor.(*ExecutorRPC)
+	if !ok {
+		return fmt.Errorf("executor of type %T can't be detached from", h.executor)
+	}
+
+	// The waiter stops detaching once the task exited
+	detached := false
+	var err error
+	h.detachOnce.Do(func() {
+		detached = true
+		close(h.detachCh)
+		err = exec.Detach()
+	})
+	if !detached {
+		return fmt.Errorf("handle was already detached or its task exited")
 	}
+	if err != nil {
+		return fmt.Errorf("failed to detach from executor: %v", err)
+	}
+
+	// Wait for the waiter to return now that the connection is closed
+	<-h.doneCh
 	return nil
 }
 
+// runPreKill runs the pre-kill command, if any, within the task and waits for
+// it for at most the pre-kill timeout, clamped to the limit. The task is
+// killed regardless of how the command exits, so failures are only logged.
+func (h *execHandle) runPreKill(limit time.Duration) {
+	if len(h.preKillCommand) == 0 {
+		return
+	}
+	select {
+	case <-h.doneCh:
+		return
+	default:
+	}
+
+	timeout := h.preKillTimeout
+	if limit < timeout {
+		timeout = limit
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	type result struct {
+		output []byte
+		code   int
+		err    error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		output, code, err := h.Exec(ctx, h.preKillCommand[0], h.preKillCommand[1:])
+		resultCh <- result{output, code, err}
+	}()
+
+	// The executor is only trusted to stop the command at the deadline, so
+	// the handle stops waiting for it on its own
+	select {
+	case res := <-resultCh:
+		switch {
+		case res.err != nil:
+			h.logger.Printf("[WARN] driver.exec: pre_kill_command %q failed: %v", h.preKillCommand[0], res.err)
+		case res.code != 0:
+			h.logger.Printf("[WARN] driver.exec: pre_kill_command %q exited with code %d: %s", h.preKillCommand[0], res.code, res.output)
+		default:
+			h.logger.Printf("[DEBUG] driver.exec: pre_kill_command %q completed", h.preKillCommand[0])
+		}
+	case <-ctx.Done():
+		h.logger.Printf("[WARN] driver.exec: pre_kill_command %q timed out after %v; killing task", h.preKillCommand[0], timeout)
+	case <-h.doneCh:
+	}
+}
+
+// runPostStart runs the post-start command within the task and waits for it
+// for at most the timeout. Its output is logged and an error is returned if it
+// fails, times out or the task exits first.
+func (h *execHandle) runPostStart(command []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	type result struct {
+		output []byte
+		code   int
+		err    error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		output, code, err := h.Exec(ctx, command[0], command[1:])
+		resultCh <- result{output, code, err}
+	}()
+
+	// The executor is only trusted to stop the command at the deadline, so
+	// the handle stops waiting for it on its own
+	select {
+	case res := <-resultCh:
+		switch {
+		case res.err != nil:
+			return fmt.Errorf("post_start_command %q failed: %v", command[0], res.err)
+		case res.code != 0:
+			h.logger.Printf("[DEBUG] driver.exec: post_start_command %q output: %s", command[0], res.output)
+			return fmt.Errorf("post_start_command %q exited with code %d", command[0], res.code)
+		}
+		h.logger.Printf("[DEBUG] driver.exec: post_start_command %q completed: %s", command[0], res.output)
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("post_start_command %q timed out after %v", command[0], timeout)
+	case <-h.doneCh:
+		return fmt.Errorf("task exited before post_start_command %q completed", command[0])
+	}
+}
+
+// Stats returns the task's resource usage sampled from its cgroup, including
+// its CPU throttling. Samples are reused for the handle's stats interval. The
+// executor keeps the previous sample across reattached handles, so the
+// percentages of the first sample of a reattached handle only cover the time
+// since the last sample rather than counting it twice.
 func (h *execHandle) Stats() (*cstructs.TaskResourceUsage, error) {
-	return h.executor.Stats()
+	h.statsLock.Lock()
+	defer h.statsLock.Unlock()
+
+	if h.lastStats != nil && time.Since(h.lastStatsAt) < h.statsInterval {
+		return h.lastStats, nil
+	}
+
+	sampledAt := time.Now()
+	ru, err := h.executor.Stats()
+	if err != nil {
+		return nil, err
+	}
+	h.lastStats, h.lastStatsAt = ru, sampledAt
+
+	if h.crashReporter != nil {
+		h.crashReporter.observe(ru)
+	}
+	return ru, nil
+}
+
+// statsInterval returns how long samples of a task's stats are reused for.
+func (d *ExecDriver) statsInterval() time.Duration {
+	interval := d.config.ReadDurationDefault(execStatsIntervalConfigOption, defaultExecStatsInterval)
+	if interval < 0 {
+		d.logger.Printf("[WARN] driver.exec: ignoring negative %s %v", execStatsIntervalConfigOption, interval)
+		return defaultExecStatsInterval
+	}
+	return interval
+}
+
+// startStatsFile starts appending the task's stats to its stats file until
+// the task exits, if a stats file is configured.
+func (h *execHandle) startStatsFile() {
+	if h.statsFile == "" {
+		return
+	}
+	rel, err := filepath.Rel(h.taskDir.Dir, h.statsFile)
+	if err != nil {
+		h.logger.Printf("[WARN] driver.exec: invalid stats file %q: %v", h.statsFile, err)
+		return
+	}
+	w := &statsFileWriter{
+		dir:      h.taskDir.Dir,
+		path:     rel,
+		interval: h.statsFileInterval,
+		maxBytes: h.statsFileMaxBytes,
+		stats:    h.Stats,
+		logger:   h.logger,
+	}
+	go w.run(h.doneCh)
+}
+
+// reportCrash writes the crash report of the task killed by the signal and
+// returns the paths, relative to the alloc dir, of the core dumps moved next
+// to it.
+func (h *execHandle) reportCrash(signal, exitCode int) []string {
+	path, cores, err := h.crashReporter.report(signal, exitCode, h.startedAt)
+	cores = crashReportPaths(cores)
+	if err != nil {
+		h.logger.Printf("[WARN] driver.exec: failed to write crash report: %v", err)
+		return cores
+	}
+
+	h.logger.Printf("[INFO] driver.exec: task crashed with %s; wrote crash report to %s", crashSignals[signal], path)
+	if h.emitEvent != nil {
+		rel := filepath.Join(allocdir.SharedAllocName, crashReportDir, filepath.Base(path))
+		h.emitEvent("Task crashed with %s; wrote crash report to %s", crashSignals[signal], rel)
+	}
+	return cores
+}
+
+// keepCores moves the task's core dumps to the crash report directory and
+// returns their paths relative to the alloc dir.
+func (h *execHandle) keepCores() []string {
+	cores, err := h.crashReporter.keepCores(h.startedAt)
+	if err != nil {
+		h.logger.Printf("[WARN] driver.exec: failed to keep core dumps: %v", err)
+	}
+	cores = crashReportPaths(cores)
+	if len(cores) == 0 {
+		return cores
+	}
+
+	h.logger.Printf("[INFO] driver.exec: task dumped core; moved core dumps to %s", strings.Join(cores, ", "))
+	if h.emitEvent != nil {
+		h.emitEvent("Task dumped core to %s", strings.Join(cores, ", "))
+	}
+	return cores
+}
+
+// crashReportPaths returns the paths, relative to the alloc dir, of the files
+// named names in the crash report directory.
+func crashReportPaths(names []string) []string {
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = filepath.Join(allocdir.SharedAllocName, crashReportDir, name)
+	}
+	return paths
 }
 
 func (h *execHandle) run() {
 	ps, werr := h.executor.Wait()
+	exitedAt := time.Now()
 	close(h.doneCh)
 
+	// The task, its executor and the resources it holds are left as they are
+	// once detached, even if the task exited meanwhile, so that they're
+	// cleaned up by the handle reattaching to it. Otherwise the handle can no
+	// longer be detached.
+	h.detachOnce.Do(func() {})
+	select {
+	case <-h.detachCh:
+		h.logger.Printf("[DEBUG] driver.exec: detached from task with pid %d", h.userPid)
+		return
+	default:
+	}
+
 	// If the exitcode is 0 and we had an error that means the plugin didn't
 	// connect and doesn't know the state of the user process so we are killing
 	// the user process so that when we create a new executor on restarting the
@@ -319,7 +3535,54 @@ func (h *execHandle) run() {
 	}
 	h.pluginClient.Kill()
 
+	// Remove the PID file as the process is gone
+	if h.pidFile != "" {
+		if err := removePidFile(h.taskDir.Dir, h.pidFile); err != nil && !os.IsNotExist(err) {
+			h.logger.Printf("[WARN] driver.exec: failed to remove pid file: %v", err)
+		}
+	}
+
+	// Release the cores the task was pinned to
+	if h.cpuset != "" {
+		globalCpusets.Release(h.cpusetID)
+	}
+
+	// Release the task's address on the bridge
+	if h.bridgeAddr != "" {
+		globalBridgeAddrs.Release(h.bridgeID)
+	}
+
+	// Release the subordinate ids of the task's user namespace
+	if h.userns != nil {
+		releaseUserns(h.usernsID)
+	}
+
+	// Record the state of the task if it crashed and keep its core dumps
+	// before they're overwritten by the next run
+	var cores []string
+	if h.crashReporter != nil {
+		switch {
+		case !h.crashReporter.coresOnly && isCrashSignal(ps.Signal):
+			cores = h.reportCrash(ps.Signal, ps.ExitCode)
+		case ps.CoreDumped:
+			cores = h.keepCores()
+		}
+	}
+
 	// Send the results
-	h.waitCh <- dstructs.NewWaitResult(ps.ExitCode, ps.Signal, werr)
+	res := dstructs.NewWaitResult(ps.ExitCode, ps.Signal, werr)
+	res.OOMKilled = ps.OOMKilled
+	res.MemorySoftLimitKilled = ps.MemorySoftLimitKilled
+	res.CoreDumped = ps.CoreDumped
+	res.CoreFiles = cores
+	res.UserTime = ps.UserTime
+	res.SystemTime = ps.SystemTime
+	res.StartedAt = h.startedAt
+	res.FinishedAt = ps.Time
+	if res.FinishedAt.IsZero() {
+		res.FinishedAt = exitedAt
+	}
+	h.events.publish(exitedAt, DriverEventExited, "%v", res)
+	h.waitCh <- res
 	close(h.waitCh)
 }
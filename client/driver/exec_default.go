@@ -3,8 +3,12 @@
 package driver
 
 import (
+	"fmt"
+	"os"
+
 	cstructs "github.com/hashicorp/nomad/client/structs"
 	"github.com/hashicorp/nomad/helper"
+	"github.com/hashicorp/nomad/nomad/structs"
 )
 
 func (d *ExecDriver) Fingerprint(req *cstructs.FingerprintRequest, resp *cstructs.FingerprintResponse) error {
@@ -12,3 +16,46 @@ func (d *ExecDriver) Fingerprint(req *cstructs.FingerprintRequest, resp *cstruct
 	resp.Detected = true
 	return nil
 }
+
+// networkIsolationSupported returns false as tasks can only be placed in their
+// own network namespace on Linux.
+func networkIsolationSupported() bool {
+	return false
+}
+
+// oomDisableSupported returns false as only Linux cgroups have an OOM killer
+// that can be disabled.
+func oomDisableSupported(node *structs.Node) bool {
+	return false
+}
+
+// memorySwapSupported returns false as only Linux cgroups account swap.
+func memorySwapSupported(node *structs.Node) bool {
+	return false
+}
+
+// ioIsolationSupported returns false as only Linux cgroups throttle block I/O.
+func ioIsolationSupported(node *structs.Node) bool {
+	return false
+}
+
+// ioWeightSupported returns false as only Linux cgroups weigh block I/O.
+func ioWeightSupported(node *structs.Node) bool {
+	return false
+}
+
+// blockDevice returns an error as block I/O is only limited on Linux.
+func blockDevice(path string) (major, minor int64, err error) {
+	return 0, 0, fmt.Errorf("block I/O limits are only supported on Linux")
+}
+
+// deviceNode returns an error as access to devices is only limited on Linux.
+func deviceNode(path string) (typ rune, major, minor int64, err error) {
+	return 0, 0, 0, fmt.Errorf("devices are only supported on Linux")
+}
+
+// ignorableSignal returns false as tasks are only started ignoring signals on
+// Linux.
+func ignorableSignal(sig os.Signal) bool {
+	return false
+}
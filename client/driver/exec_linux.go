@@ -1,8 +1,20 @@
 package driver
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/config"
 	cstructs "github.com/hashicorp/nomad/client/structs"
 	"github.com/hashicorp/nomad/helper"
+	"github.com/hashicorp/nomad/nomad/structs"
 	"golang.org/x/sys/unix"
 )
 
@@ -10,6 +22,78 @@ const (
 	// The key populated in Node Attributes to indicate the presence of the Exec
 	// driver
 	execDriverAttr = "driver.exec"
+
+	// execDriverArchAttr is the key populated in Node Attributes with the
+	// architecture of binaries the Exec driver can run
+	execDriverArchAttr = "driver.exec.arch"
+
+	// execDriverMaxThreadsAttr is the key populated in Node Attributes if the
+	// Exec driver supports limiting the threads of tasks
+	execDriverMaxThreadsAttr = "driver.exec.max_threads"
+
+	// execDriverMountPropagationAttr is the key populated in Node Attributes
+	// with the propagation of the bind mounts into the chroot of tasks
+	execDriverMountPropagationAttr = "driver.exec.mount_propagation"
+
+	// execDriverGlibcVersionAttr is the key populated in Node Attributes with
+	// the node's glibc version if it uses glibc
+	execDriverGlibcVersionAttr = "driver.exec.glibc_version"
+
+	// execDriverCgroupControllersAttr is the key populated in Node Attributes
+	// with the enabled cgroup controllers
+	execDriverCgroupControllersAttr = "driver.exec.cgroup_controllers"
+
+	// execDriverCgroupVersionAttr is the key populated in Node Attributes
+	// with the version of the cgroup hierarchy tasks are placed in, "1" for
+	// the v1 hierarchies or "2" for the v2 unified hierarchy
+	execDriverCgroupVersionAttr = "driver.exec.cgroup_version"
+
+	// execDriverUserNamespacesAttr is the key populated in Node Attributes if
+	// the kernel supports user namespaces
+	execDriverUserNamespacesAttr = "driver.exec.user_namespaces"
+
+	// execDriverOOMEventsAttr is the key populated in Node Attributes if the
+	// memory cgroup reports OOM kills, so that tasks killed for exceeding
+	// their memory limit can be told apart from other failures
+	execDriverOOMEventsAttr = "driver.exec.oom_events"
+
+	// execDriverMemorySwapAttr is the key populated in Node Attributes if the
+	// memory cgroup accounts swap, so that tasks can be kept from swapping
+	execDriverMemorySwapAttr = "driver.exec.memory_swap"
+
+	// execDriverOOMDisableAttr is the key populated in Node Attributes if the
+	// OOM killer of the memory cgroup can be disabled with oom_disable
+	execDriverOOMDisableAttr = "driver.exec.oom_disable"
+
+	// execDriverIOIsolationAttr is the key populated in Node Attributes if the
+	// block I/O of tasks can be throttled, set to the cgroup version doing so
+	// as v1 or v2
+	execDriverIOIsolationAttr = "driver.exec.io_isolation"
+
+	// execDriverNetworkIsolationAttr is the key populated in Node Attributes
+	// if tasks can be run in their own network namespace attached to a host
+	// bridge
+	execDriverNetworkIsolationAttr = "driver.exec.network_isolation"
+
+	// execDriverCapabilitiesAttr is the key populated in Node Attributes with
+	// the capabilities tasks running as root are granted
+	execDriverCapabilitiesAttr = "driver.exec.capabilities"
+
+	// execDriverCoreDumpAttr is the key populated in Node Attributes if the
+	// kernel's core_pattern writes core dumps into the chroot of tasks, so
+	// that the core dumps of tasks setting core_dump are kept
+	execDriverCoreDumpAttr = "driver.exec.core_dump"
+
+	// execDriverNoChrootAttr is the key populated in Node Attributes if the
+	// client allows tasks to run without a chroot
+	execDriverNoChrootAttr = "driver.exec.no_chroot"
+
+	// execDriverChrootMountsAttr is the key populated in Node Attributes if
+	// the client allows tasks to bind mount host paths into their chroot
+	execDriverChrootMountsAttr = "driver.exec.chroot_mounts"
+
+	// mountNamespacePath exists if the kernel supports mount namespaces
+	mountNamespacePath = "/proc/self/ns/mnt"
 )
 
 func (d *ExecDriver) Fingerprint(req *cstructs.FingerprintRequest, resp *cstructs.FingerprintResponse) error {
@@ -21,22 +105,445 @@ func (d *ExecDriver) Fingerprint(req *cstructs.FingerprintRequest, resp *cstruct
 		if d.fingerprintSuccess == nil || *d.fingerprintSuccess {
 			d.logger.Printf("[INFO] driver.exec: cgroups unavailable, disabling")
 		}
-		d.fingerprintSuccess = helper.BoolToPtr(false)
-		resp.RemoveAttribute(execDriverAttr)
+		d.disable(resp)
 		return nil
 	} else if unix.Geteuid() != 0 {
 		if d.fingerprintSuccess == nil || *d.fingerprintSuccess {
 			d.logger.Printf("[DEBUG] driver.exec: must run as root user, disabling")
 		}
-		d.fingerprintSuccess = helper.BoolToPtr(false)
-		resp.RemoveAttribute(execDriverAttr)
+		d.disable(resp)
 		return nil
 	}
 
+	// Propagating mounts from the host into the chroot requires mount
+	// namespaces
+	propagation := allocdir.MountPropagationPrivate
+	if req.Config != nil {
+		propagation = req.Config.ReadDefault("chroot.mount_propagation", propagation)
+	}
+	if propagation != allocdir.MountPropagationPrivate {
+		if _, err := os.Stat(mountNamespacePath); err != nil {
+			if d.fingerprintSuccess == nil || *d.fingerprintSuccess {
+				d.logger.Printf("[WARN] driver.exec: %s mount propagation requires mount namespaces, disabling", propagation)
+			}
+			d.disable(resp)
+			return nil
+		}
+	}
+
 	if d.fingerprintSuccess == nil || !*d.fingerprintSuccess {
 		d.logger.Printf("[DEBUG] driver.exec: exec driver is enabled")
 	}
 	resp.AddAttribute(execDriverAttr, "1")
+	resp.AddAttribute(execDriverArchAttr, runtime.GOARCH)
+	resp.AddAttribute(execDriverMaxThreadsAttr, "1")
+	resp.AddAttribute(execDriverMountPropagationAttr, propagation)
+	if glibc := hostGlibcVersion(); glibc != "" {
+		resp.AddAttribute(execDriverGlibcVersionAttr, glibc)
+	} else {
+		resp.RemoveAttribute(execDriverGlibcVersionAttr)
+	}
+	if req.Config != nil && req.Config.ReadBoolDefault(execNoChrootConfigOption, false) {
+		resp.AddAttribute(execDriverNoChrootAttr, "1")
+	} else {
+		resp.RemoveAttribute(execDriverNoChrootAttr)
+	}
+	if req.Config != nil && req.Config.ReadBoolDefault(execChrootMountsConfigOption, false) {
+		resp.AddAttribute(execDriverChrootMountsAttr, "1")
+	} else {
+		resp.RemoveAttribute(execDriverChrootMountsAttr)
+	}
+	d.fingerprintCapabilities(req, resp)
 	d.fingerprintSuccess = helper.BoolToPtr(true)
 	return nil
 }
+
+// execDriverAttrs are the attributes set when the driver is enabled, other than
+// the ones of its dynamic capabilities.
+var execDriverAttrs = []string{
+	execDriverAttr,
+	execDriverArchAttr,
+	execDriverMaxThreadsAttr,
+	execDriverMountPropagationAttr,
+	execDriverGlibcVersionAttr,
+	execDriverNoChrootAttr,
+	execDriverChrootMountsAttr,
+}
+
+// execCapabilityAttrs are the attributes of the dynamic capabilities, other
+// than the ones of shells and devices.
+var execCapabilityAttrs = []string{
+	execDriverCgroupControllersAttr,
+	execDriverCgroupVersionAttr,
+	execDriverUserNamespacesAttr,
+	execDriverUsernsAttr,
+	execDriverOOMEventsAttr,
+	execDriverMemorySwapAttr,
+	execDriverOOMDisableAttr,
+	execDriverIOIsolationAttr,
+	execDriverNetworkIsolationAttr,
+	execDriverCoreDumpAttr,
+	execDriverCapabilitiesAttr,
+}
+
+// disable marks the driver as undetected and removes all of its attributes.
+func (d *ExecDriver) disable(resp *cstructs.FingerprintResponse) {
+	d.fingerprintSuccess = helper.BoolToPtr(false)
+	for _, attr := range execDriverAttrs {
+		resp.RemoveAttribute(attr)
+	}
+	d.removeCapabilities(resp)
+}
+
+// fingerprintCapabilities sets the attributes of the capabilities that can
+// change while the client runs, such as cgroup controllers being mounted,
+// user namespaces being enabled or shells being installed. The client only
+// updates the node if they changed.
+func (d *ExecDriver) fingerprintCapabilities(req *cstructs.FingerprintRequest, resp *cstructs.FingerprintResponse) {
+	capabilities := make(map[string]string, 10+len(execShells))
+	node := req.Node
+
+	if version := cgroupVersion(node); version != "" {
+		capabilities[execDriverCgroupVersionAttr] = version
+	}
+
+	if f, err := os.Open("/proc/cgroups"); err == nil {
+		controllers, err := parseCgroupControllers(f)
+		f.Close()
+		if err != nil {
+			d.logger.Printf("[WARN] driver.exec: failed to read cgroup controllers: %v", err)
+		} else if controllers != "" {
+			capabilities[execDriverCgroupControllersAttr] = controllers
+		}
+	}
+
+	if userNamespacesEnabled() {
+		capabilities[execDriverUserNamespacesAttr] = "1"
+
+		owner := defaultUsernsOwner
+		if req.Config != nil {
+			owner = req.Config.ReadDefault(execUsernsOwnerConfigOption, owner)
+		}
+		if req.Config != nil && req.Config.ReadBoolDefault(execUsernsConfigOption, false) && usernsSupported(owner) {
+			capabilities[execDriverUsernsAttr] = "1"
+		}
+	}
+
+	if oomEventsSupported(node) {
+		capabilities[execDriverOOMEventsAttr] = "1"
+	}
+
+	if memorySwapSupported(node) {
+		capabilities[execDriverMemorySwapAttr] = "1"
+	}
+
+	if oomDisableSupported(node) {
+		capabilities[execDriverOOMDisableAttr] = "1"
+	}
+
+	if ioIsolationSupported(node) {
+		capabilities[execDriverIOIsolationAttr] = "v" + cgroupVersion(node)
+	}
+
+	if networkIsolationSupported() {
+		capabilities[execDriverNetworkIsolationAttr] = "1"
+	}
+
+	if pattern, err := readCorePattern(); err == nil {
+		if _, err := corePatternDir(pattern, true); err == nil {
+			capabilities[execDriverCoreDumpAttr] = "1"
+		}
+	}
+
+	// Tasks inherit the bounding set of the executor, which inherits the
+	// client's
+	if f, err := os.Open("/proc/self/status"); err == nil {
+		set, err := parseCapabilityBoundingSet(f)
+		f.Close()
+		if err != nil {
+			d.logger.Printf("[WARN] driver.exec: failed to read capabilities: %v", err)
+		} else if names := capabilitySetNames(set); names != "" {
+			capabilities[execDriverCapabilitiesAttr] = names
+		}
+	}
+
+	chroot := config.DefaultChrootEnv
+	if req.Config != nil && len(req.Config.ChrootEnv) > 0 {
+		chroot = req.Config.ChrootEnv
+	}
+	shells := chrootShells(chroot)
+	for _, shell := range execShells {
+		if shells[shell] {
+			capabilities[execShellAttrPrefix+shell] = "1"
+		}
+	}
+
+	for _, name := range hostDevices(execDevices) {
+		capabilities[execDeviceAttrPrefix+name] = "1"
+	}
+
+	attrs := append([]string(nil), execCapabilityAttrs...)
+	for _, shell := range execShells {
+		attrs = append(attrs, execShellAttrPrefix+shell)
+	}
+
+	// Devices come and go, so the ones found previously are removed
+	devices := make(map[string]struct{})
+	for _, caps := range []map[string]string{d.capabilities, capabilities} {
+		for attr := range caps {
+			if strings.HasPrefix(attr, execDeviceAttrPrefix) {
+				devices[attr] = struct{}{}
+			}
+		}
+	}
+	for attr := range devices {
+		attrs = append(attrs, attr)
+	}
+	for _, attr := range attrs {
+		if v, ok := capabilities[attr]; ok {
+			resp.AddAttribute(attr, v)
+		} else {
+			resp.RemoveAttribute(attr)
+		}
+		if d.capabilities != nil && capabilities[attr] != d.capabilities[attr] {
+			d.logger.Printf("[INFO] driver.exec: %s changed from %q to %q", attr, d.capabilities[attr], capabilities[attr])
+		}
+	}
+	d.capabilities = capabilities
+}
+
+// removeCapabilities removes the attributes of the dynamic capabilities when
+// the driver is disabled.
+func (d *ExecDriver) removeCapabilities(resp *cstructs.FingerprintResponse) {
+	for _, attr := range execCapabilityAttrs {
+		resp.RemoveAttribute(attr)
+	}
+	for _, shell := range execShells {
+		resp.RemoveAttribute(execShellAttrPrefix + shell)
+	}
+	for attr := range d.capabilities {
+		if strings.HasPrefix(attr, execDeviceAttrPrefix) {
+			resp.RemoveAttribute(attr)
+		}
+	}
+	d.capabilities = nil
+}
+
+// cgroupVersion returns the version of the node's cgroup hierarchy, which is
+// "2" if the cgroup mount point is the unified hierarchy rather than the
+// directory of the v1 hierarchies.
+func cgroupVersion(node *structs.Node) string {
+	mount, ok := node.Attributes["unique.cgroup.mountpoint"]
+	if !ok {
+		return ""
+	}
+	if _, err := os.Stat(filepath.Join(mount, "cgroup.controllers")); err == nil {
+		return "2"
+	}
+	return "1"
+}
+
+// unifiedCgroupFile returns the path of the file in a child cgroup of the
+// unified hierarchy, as files such as memory.events don't exist in the root
+// cgroup, or false if no child has it.
+func unifiedCgroupFile(mount, name string) (string, bool) {
+	matches, _ := filepath.Glob(filepath.Join(mount, "*", name))
+	if len(matches) == 0 {
+		return "", false
+	}
+	return matches[0], true
+}
+
+// unifiedControllerEnabled returns whether the root of the unified hierarchy
+// provides the controller.
+func unifiedControllerEnabled(mount, controller string) bool {
+	controllers, err := ioutil.ReadFile(filepath.Join(mount, "cgroup.controllers"))
+	if err != nil {
+		return false
+	}
+	for _, c := range strings.Fields(string(controllers)) {
+		if c == controller {
+			return true
+		}
+	}
+	return false
+}
+
+// oomEventsSupported returns whether the node's memory cgroup counts OOM
+// kills, which requires Linux 4.13 or later.
+func oomEventsSupported(node *structs.Node) bool {
+	mount, ok := node.Attributes["unique.cgroup.mountpoint"]
+	if !ok {
+		return false
+	}
+	path := filepath.Join(mount, "memory", "memory.oom_control")
+	if cgroupVersion(node) == "2" {
+		if path, ok = unifiedCgroupFile(mount, "memory.events"); !ok {
+			return false
+		}
+	}
+	control, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(control), "oom_kill ")
+}
+
+// oomDisableSupported returns whether the OOM killer of the node's memory
+// cgroups can be disabled, which only cgroup v1 supports with
+// memory.oom_control.
+func oomDisableSupported(node *structs.Node) bool {
+	mount, ok := node.Attributes["unique.cgroup.mountpoint"]
+	if !ok || cgroupVersion(node) == "2" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(mount, "memory", "memory.oom_control"))
+	return err == nil
+}
+
+// memorySwapSupported returns whether the node's memory cgroup accounts swap,
+// which requires the kernel to be built with swap accounting and not booted
+// with swapaccount=0.
+func memorySwapSupported(node *structs.Node) bool {
+	mount, ok := node.Attributes["unique.cgroup.mountpoint"]
+	if !ok {
+		return false
+	}
+	if cgroupVersion(node) == "2" {
+		_, ok := unifiedCgroupFile(mount, "memory.swap.max")
+		return ok
+	}
+	_, err := os.Stat(filepath.Join(mount, "memory", "memory.memsw.limit_in_bytes"))
+	return err == nil
+}
+
+// ioIsolationSupported returns whether the node's blkio cgroup, or the io
+// controller of the unified hierarchy, throttles block I/O.
+func ioIsolationSupported(node *structs.Node) bool {
+	mount, ok := node.Attributes["unique.cgroup.mountpoint"]
+	if !ok {
+		return false
+	}
+	if cgroupVersion(node) == "2" {
+		return unifiedControllerEnabled(mount, "io")
+	}
+	_, err := os.Stat(filepath.Join(mount, "blkio", "blkio.throttle.read_bps_device"))
+	return err == nil
+}
+
+// ioWeightSupported returns whether the node's blkio cgroup, or the io
+// controller of the unified hierarchy, weighs block I/O, which depends on the
+// I/O scheduler.
+func ioWeightSupported(node *structs.Node) bool {
+	mount, ok := node.Attributes["unique.cgroup.mountpoint"]
+	if !ok {
+		return false
+	}
+	if cgroupVersion(node) == "2" {
+		for _, name := range []string{"io.bfq.weight", "io.weight"} {
+			if _, ok := unifiedCgroupFile(mount, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	_, err := os.Stat(filepath.Join(mount, "blkio", "blkio.weight"))
+	return err == nil
+}
+
+// blockDevice returns the major and minor number of the block device at path.
+func blockDevice(path string) (major, minor int64, err error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return 0, 0, err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return 0, 0, fmt.Errorf("not a block device")
+	}
+	return int64(unix.Major(uint64(st.Rdev))), int64(unix.Minor(uint64(st.Rdev))), nil
+}
+
+// deviceNode returns the type, 'c' or 'b', and the major and minor number of
+// the character or block device at path within /dev. Symbolic links aren't
+// followed, so that the node is the one the chroot's bind mount exposes.
+func deviceNode(path string) (typ rune, major, minor int64, err error) {
+	f, err := allocdir.OpenDevice(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+
+	var st unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+		return 0, 0, 0, err
+	}
+	typ = 'c'
+	if st.Mode&unix.S_IFMT == unix.S_IFBLK {
+		typ = 'b'
+	}
+	return typ, int64(unix.Major(uint64(st.Rdev))), int64(unix.Minor(uint64(st.Rdev))), nil
+}
+
+// hostDevices returns the names of the devices matching the patterns, their
+// paths within /dev with dots for slashes.
+func hostDevices(patterns []string) []string {
+	var names []string
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			if _, _, _, err := deviceNode(path); err != nil {
+				continue
+			}
+			if rel, err := filepath.Rel("/dev", path); err == nil {
+				names = append(names, strings.Replace(rel, "/", ".", -1))
+			}
+		}
+	}
+	return names
+}
+
+// networkIsolationSupported returns whether the kernel supports network
+// namespaces and ip(8) and iptables(8), which set up the namespaces of tasks
+// and forward traffic to them, are installed. The driver already requires
+// root for the remaining capabilities.
+func networkIsolationSupported() bool {
+	if _, err := os.Stat("/proc/self/ns/net"); err != nil {
+		return false
+	}
+	for _, bin := range []string{"ip", "iptables"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// userNamespacesEnabled returns whether the kernel supports user namespaces
+// and allows creating them.
+func userNamespacesEnabled() bool {
+	if _, err := os.Stat("/proc/self/ns/user"); err != nil {
+		return false
+	}
+
+	// Older kernels don't limit the number of user namespaces
+	max, err := ioutil.ReadFile("/proc/sys/user/max_user_namespaces")
+	if err != nil {
+		return true
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(max)))
+	return err == nil && n > 0
+}
+
+// ignorableSignal returns whether tasks may be started ignoring the signal.
+// SIGKILL and SIGSTOP can't be ignored, ignoring SIGCHLD makes the kernel reap
+// the task's children and the synchronous signals still kill the task when
+// raised by a fault, so only the signals tasks commonly ignore are allowed.
+func ignorableSignal(sig os.Signal) bool {
+	switch sig {
+	case unix.SIGHUP, unix.SIGPIPE, unix.SIGQUIT, unix.SIGTERM, unix.SIGALRM,
+		unix.SIGUSR1, unix.SIGUSR2, unix.SIGTSTP, unix.SIGTTIN, unix.SIGTTOU,
+		unix.SIGWINCH, unix.SIGXCPU, unix.SIGXFSZ:
+		return true
+	}
+	return false
+}
@@ -1,18 +1,26 @@
 package driver
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/nomad/client/allocdir"
 	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/client/driver/env"
+	dstructs "github.com/hashicorp/nomad/client/driver/structs"
 	cstructs "github.com/hashicorp/nomad/client/structs"
 	"github.com/hashicorp/nomad/nomad/structs"
 	"github.com/hashicorp/nomad/testutil"
@@ -53,6 +61,149 @@ func TestExecDriver_Fingerprint(t *testing.T) {
 	if response.Attributes == nil || response.Attributes["driver.exec"] == "" {
 		t.Fatalf("missing driver")
 	}
+	if arch := response.Attributes["driver.exec.arch"]; arch != runtime.GOARCH {
+		t.Fatalf("expected arch %q; got %q", runtime.GOARCH, arch)
+	}
+	if response.Attributes["driver.exec.max_threads"] != "1" {
+		t.Fatalf("missing max_threads support")
+	}
+	if p := response.Attributes["driver.exec.mount_propagation"]; p != "private" {
+		t.Fatalf("expected private mount propagation; got %q", p)
+	}
+	if _, err := os.Stat("/bin/sh"); err == nil && response.Attributes["driver.exec.shell.sh"] != "1" {
+		t.Fatalf("missing sh shell")
+	}
+	if fi, err := os.Stat("/dev/kvm"); err == nil && fi.Mode()&os.ModeCharDevice != 0 && response.Attributes["driver.exec.devices.kvm"] != "1" {
+		t.Fatalf("missing kvm device")
+	}
+	// The mount point is the directory of the v1 hierarchies or the v2
+	// unified hierarchy
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err == nil {
+		if v := response.Attributes["driver.exec.cgroup_version"]; v != "2" {
+			t.Fatalf("expected cgroup version 2; got %q", v)
+		}
+		if matches, _ := filepath.Glob("/sys/fs/cgroup/*/memory.swap.max"); len(matches) != 0 {
+			if response.Attributes["driver.exec.memory_swap"] != "1" {
+				t.Fatalf("missing memory_swap support")
+			}
+		}
+		if _, ok := response.Attributes["driver.exec.oom_disable"]; ok {
+			t.Fatalf("expected no oom_disable support on cgroup v2")
+		}
+		if controllers, err := ioutil.ReadFile("/sys/fs/cgroup/cgroup.controllers"); err == nil && strings.Contains(string(controllers), "io") {
+			if response.Attributes["driver.exec.io_isolation"] != "v2" {
+				t.Fatalf("missing io_isolation support")
+			}
+		}
+	} else {
+		if v := response.Attributes["driver.exec.cgroup_version"]; v != "1" {
+			t.Fatalf("expected cgroup version 1; got %q", v)
+		}
+		if control, err := ioutil.ReadFile("/sys/fs/cgroup/memory/memory.oom_control"); err == nil && strings.Contains(string(control), "oom_kill ") {
+			if response.Attributes["driver.exec.oom_events"] != "1" {
+				t.Fatalf("missing oom_events support")
+			}
+		}
+		if _, err := os.Stat("/sys/fs/cgroup/memory/memory.memsw.limit_in_bytes"); err == nil {
+			if response.Attributes["driver.exec.memory_swap"] != "1" {
+				t.Fatalf("missing memory_swap support")
+			}
+		}
+		if _, err := os.Stat("/sys/fs/cgroup/memory/memory.oom_control"); err == nil {
+			if response.Attributes["driver.exec.oom_disable"] != "1" {
+				t.Fatalf("missing oom_disable support")
+			}
+		}
+		if _, err := os.Stat("/sys/fs/cgroup/blkio/blkio.throttle.read_bps_device"); err == nil {
+			if response.Attributes["driver.exec.io_isolation"] != "v1" {
+				t.Fatalf("missing io_isolation support")
+			}
+		}
+	}
+	if networkIsolationSupported() {
+		if response.Attributes["driver.exec.network_isolation"] != "1" {
+			t.Fatalf("missing network_isolation support")
+		}
+	}
+	if caps := response.Attributes["driver.exec.capabilities"]; !strings.Contains(caps, "CAP_KILL") {
+		t.Fatalf("expected the capabilities to include CAP_KILL; got %q", caps)
+	}
+
+	request.Config.Options = map[string]string{"chroot.mount_propagation": "slave"}
+	response = cstructs.FingerprintResponse{}
+	if err := d.Fingerprint(request, &response); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if p := response.Attributes["driver.exec.mount_propagation"]; p != "slave" {
+		t.Fatalf("expected slave mount propagation; got %q", p)
+	}
+
+	// Re-fingerprinting an unchanged node reports the same capabilities
+	again := cstructs.FingerprintResponse{}
+	if err := d.Fingerprint(request, &again); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(response.Attributes, again.Attributes) {
+		t.Fatalf("expected unchanged attributes %v; got %v", response.Attributes, again.Attributes)
+	}
+
+	// Disabling the driver removes every attribute it set
+	request.Config.Options = map[string]string{
+		execNoChrootConfigOption:     "true",
+		execChrootMountsConfigOption: "true",
+	}
+	enabled := cstructs.FingerprintResponse{}
+	if err := d.Fingerprint(request, &enabled); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	disabled := cstructs.FingerprintResponse{}
+	if err := d.Fingerprint(&cstructs.FingerprintRequest{Config: request.Config, Node: &structs.Node{}}, &disabled); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for attr, v := range enabled.Attributes {
+		if v == "" {
+			continue
+		}
+		if removed, ok := disabled.Attributes[attr]; !ok || removed != "" {
+			t.Fatalf("expected %s to be removed once disabled; got %v", attr, disabled.Attributes)
+		}
+	}
+}
+
+func TestExecDriver_Periodic(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{config: &config.Config{}}).(*ExecDriver)
+
+	if periodic, period := d.Periodic(); !periodic || period != defaultExecFingerprintPeriod {
+		t.Fatalf("expected default period; got %v %v", periodic, period)
+	}
+
+	d.config.Options = map[string]string{"driver.exec.fingerprint_period": "1m"}
+	if periodic, period := d.Periodic(); !periodic || period != time.Minute {
+		t.Fatalf("expected 1m period; got %v %v", periodic, period)
+	}
+
+	d.config.Options["driver.exec.fingerprint_period"] = "0s"
+	if periodic, _ := d.Periodic(); periodic {
+		t.Fatalf("expected periodic fingerprinting to be disabled")
+	}
+}
+
+func TestExecDriver_ParseCgroupControllers(t *testing.T) {
+	t.Parallel()
+	cgroups := `#subsys_name	hierarchy	num_cgroups	enabled
+memory	8	120	1
+cpuset	3	3	1
+pids	0	1	0
+cpu	1	80	1
+`
+	controllers, err := parseCgroupControllers(strings.NewReader(cgroups))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if controllers != "cpu,cpuset,memory" {
+		t.Fatalf("unexpected controllers %q", controllers)
+	}
 }
 
 func TestExecDriver_StartOpen_Wait(t *testing.T) {
@@ -99,7 +250,7 @@ func TestExecDriver_StartOpen_Wait(t *testing.T) {
 	handle2.Kill()
 }
 
-func TestExecDriver_Start_Wait(t *testing.T) {
+func TestExecDriver_CgroupPath(t *testing.T) {
 	if !testutil.IsTravis() {
 		t.Parallel()
 	}
@@ -109,7 +260,7 @@ func TestExecDriver_Start_Wait(t *testing.T) {
 		Driver: "exec",
 		Config: map[string]interface{}{
 			"command": "/bin/sleep",
-			"args":    []string{"2"},
+			"args":    []string{"5"},
 		},
 		LogConfig: &structs.LogConfig{
 			MaxFiles:      10,
@@ -129,41 +280,44 @@ func TestExecDriver_Start_Wait(t *testing.T) {
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
+	defer resp.Handle.Kill()
 
-	// Update should be a no-op
-	err = resp.Handle.Update(task)
+	// The task's process is in the cgroup
+	path := resp.Handle.(CgroupReader).CgroupPath()
+	if path == "" {
+		t.Fatalf("missing cgroup path")
+	}
+	procs, err := ioutil.ReadFile(filepath.Join(path, "cgroup.procs"))
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
+	pid := strconv.Itoa(resp.Handle.(*execHandle).userPid)
+	if !strings.Contains("\n"+string(procs), "\n"+pid+"\n") {
+		t.Fatalf("expected pid %s in cgroup %s; got %q", pid, path, procs)
+	}
 
-	// Task should terminate quickly
-	select {
-	case res := <-resp.Handle.WaitCh():
-		if !res.Successful() {
-			t.Fatalf("err: %v", res)
-		}
-	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
-		t.Fatalf("timeout")
+	// Reattached handles return the same path
+	handle2, err := d.Open(ctx.ExecCtx, resp.Handle.ID())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle2.Kill()
+	if path2 := handle2.(CgroupReader).CgroupPath(); path2 != path {
+		t.Fatalf("expected cgroup path %q after reattaching; got %q", path, path2)
 	}
 }
 
-func TestExecDriver_Start_Wait_AllocDir(t *testing.T) {
+func TestExecDriver_TaskID(t *testing.T) {
 	if !testutil.IsTravis() {
 		t.Parallel()
 	}
 	ctestutils.ExecCompatible(t)
-
-	exp := []byte{'w', 'i', 'n'}
-	file := "output.txt"
 	task := &structs.Task{
 		Name:   "sleep",
 		Driver: "exec",
 		Config: map[string]interface{}{
-			"command": "/bin/bash",
-			"args": []string{
-				"-c",
-				fmt.Sprintf(`sleep 1; echo -n %s > ${%s}/%s`, string(exp), env.AllocDir, file),
-			},
+			"command": "/bin/sleep",
+			"args":    []string{"5"},
 		},
 		LogConfig: &structs.LogConfig{
 			MaxFiles:      10,
@@ -183,30 +337,57 @@ func TestExecDriver_Start_Wait_AllocDir(t *testing.T) {
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
+	defer resp.Handle.Kill()
 
-	// Task should terminate quickly
+	taskID := resp.Handle.(TaskIdentifier).TaskID()
+	if exp := taskUUID(ctx.DriverCtx.allocID, task.Name); taskID != exp {
+		t.Fatalf("expected task ID %q; got %q", exp, taskID)
+	}
+
+	// The task's events carry its ID
 	select {
-	case res := <-resp.Handle.WaitCh():
-		if !res.Successful() {
-			t.Fatalf("err: %v", res)
+	case event := <-resp.Handle.(*execHandle).Events():
+		if event.TaskID != taskID {
+			t.Fatalf("expected event for task %q; got %q", taskID, event.TaskID)
 		}
-	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
-		t.Fatalf("timeout")
+	default:
+		t.Fatalf("expected an event")
 	}
 
-	// Check that data was written to the shared alloc directory.
-	outputFile := filepath.Join(ctx.AllocDir.SharedDir, file)
-	act, err := ioutil.ReadFile(outputFile)
+	// Handles reattached by another driver have the same ID
+	handle2, err := NewExecDriver(ctx.DriverCtx).Open(ctx.ExecCtx, resp.Handle.ID())
 	if err != nil {
-		t.Fatalf("Couldn't read expected output: %v", err)
+		t.Fatalf("err: %v", err)
+	}
+	defer handle2.Kill()
+	if id2 := handle2.(TaskIdentifier).TaskID(); id2 != taskID {
+		t.Fatalf("expected task ID %q after reattaching; got %q", taskID, id2)
 	}
 
-	if !reflect.DeepEqual(act, exp) {
-		t.Fatalf("Command outputted %v; want %v", act, exp)
+	// Handles written without the ID derive the same one
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(resp.Handle.ID()), &values); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if values["TaskID"] != taskID {
+		t.Fatalf("expected task ID %q in the handle ID; got %v", taskID, values["TaskID"])
+	}
+	delete(values, "TaskID")
+	legacy, err := json.Marshal(values)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	handle3, err := d.Open(ctx.ExecCtx, string(legacy))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle3.Kill()
+	if id3 := handle3.(TaskIdentifier).TaskID(); id3 != taskID {
+		t.Fatalf("expected task ID %q for a legacy handle; got %q", taskID, id3)
 	}
 }
 
-func TestExecDriver_Start_Kill_Wait(t *testing.T) {
+func TestExecDriver_Open_LegacyHandle(t *testing.T) {
 	if !testutil.IsTravis() {
 		t.Parallel()
 	}
@@ -222,8 +403,7 @@ func TestExecDriver_Start_Kill_Wait(t *testing.T) {
 			MaxFiles:      10,
 			MaxFileSizeMB: 10,
 		},
-		Resources:   basicResources,
-		KillTimeout: 10 * time.Second,
+		Resources: basicResources,
 	}
 
 	ctx := testDriverContexts(t, task)
@@ -237,27 +417,77 @@ func TestExecDriver_Start_Kill_Wait(t *testing.T) {
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
+	defer resp.Handle.Kill()
 
-	go func() {
-		time.Sleep(100 * time.Millisecond)
-		err := resp.Handle.Kill()
-		if err != nil {
-			t.Fatalf("err: %v", err)
-		}
-	}()
+	// Write the handle as an older version without a handle version and
+	// with a field that has since been removed
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(resp.Handle.ID()), &values); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	delete(values, "HandleVersion")
+	values["TaskDir"] = "/var/nomad/alloc/sleep"
+	legacy, err := json.Marshal(values)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
 
-	// Task should terminate quickly
+	handle2, err := d.Open(ctx.ExecCtx, string(legacy))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := handle2.Kill(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
 	select {
-	case res := <-resp.Handle.WaitCh():
+	case res := <-handle2.WaitCh():
 		if res.Successful() {
-			t.Fatal("should err")
+			t.Fatalf("expected the reattached task to be killed: %v", res)
 		}
-	case <-time.After(time.Duration(testutil.TestMultiplier()*10) * time.Second):
+	case <-time.After(time.Duration(testutil.TestMultiplier()*15) * time.Second):
 		t.Fatalf("timeout")
 	}
+
+	// The reattached handle writes the current version
+	id, err := parseExecId(handle2.ID(), testLogger())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if id.HandleVersion != execIdVersion {
+		t.Fatalf("got handle version %d; want %d", id.HandleVersion, execIdVersion)
+	}
 }
 
-func TestExecDriverUser(t *testing.T) {
+func TestExecDriver_parseExecId(t *testing.T) {
+	t.Parallel()
+
+	// Unknown fields are ignored
+	id, err := parseExecId(`{"UserPid":42,"PluginConfig":{"Pid":43},"KillTimeout":5,"EnvKeys":["FOO"],"HandleVersion":7}`, testLogger())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if id.UserPid != 42 || id.PluginConfig.Pid != 43 || id.KillTimeout != 5 {
+		t.Fatalf("unexpected id: %+v", id)
+	}
+
+	// Fields must be parsed, including those required to reattach
+	for _, handleID := range []string{
+		`{"UserPid":42}`,
+		`{"UserPid":42,"PluginConfig":"43"}`,
+		`{"UserPid":"42","PluginConfig":{"Pid":43}}`,
+		`{"UserPid":42,"PluginConfig":{"Pid":43},"HandleVersion":"1"}`,
+		`{"UserPid":42,"PluginConfig":{"Pid":43},"KillTimeout":"5s"}`,
+		`{"UserPid":42,"PluginConfig":{"Pid":43},"Env":{"FOO":1}}`,
+		`{"UserPid":42,"PluginConfig":{"Pid":43},"Env":{"FOO":"1"},"env":{"BAR":"2"}}`,
+		`[]`,
+	} {
+		if _, err := parseExecId(handleID, testLogger()); err == nil {
+			t.Fatalf("expected error for %s", handleID)
+		}
+	}
+}
+
+func TestExecDriver_Start_Wait(t *testing.T) {
 	if !testutil.IsTravis() {
 		t.Parallel()
 	}
@@ -265,17 +495,15 @@ func TestExecDriverUser(t *testing.T) {
 	task := &structs.Task{
 		Name:   "sleep",
 		Driver: "exec",
-		User:   "alice",
 		Config: map[string]interface{}{
 			"command": "/bin/sleep",
-			"args":    []string{"100"},
+			"args":    []string{"2"},
 		},
 		LogConfig: &structs.LogConfig{
 			MaxFiles:      10,
 			MaxFileSizeMB: 10,
 		},
-		Resources:   basicResources,
-		KillTimeout: 10 * time.Second,
+		Resources: basicResources,
 	}
 
 	ctx := testDriverContexts(t, task)
@@ -286,29 +514,40 @@ func TestExecDriverUser(t *testing.T) {
 		t.Fatalf("prestart err: %v", err)
 	}
 	resp, err := d.Start(ctx.ExecCtx, task)
-	if err == nil {
-		resp.Handle.Kill()
-		t.Fatalf("Should've failed")
+	if err != nil {
+		t.Fatalf("err: %v", err)
 	}
-	msg := "user alice"
-	if !strings.Contains(err.Error(), msg) {
-		t.Fatalf("Expecting '%v' in '%v'", msg, err)
+
+	// Update should be a no-op
+	err = resp.Handle.Update(task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Task should terminate quickly
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+		if rt := res.Runtime(); rt < 2*time.Second {
+			t.Fatalf("got runtime %v; want at least the 2s the task slept", rt)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
 	}
 }
 
-// TestExecDriver_HandlerExec ensures the exec driver's handle properly
-// executes commands inside the container.
-func TestExecDriver_HandlerExec(t *testing.T) {
+func TestExecDriver_Start_Wait_Runtime(t *testing.T) {
 	if !testutil.IsTravis() {
 		t.Parallel()
 	}
 	ctestutils.ExecCompatible(t)
 	task := &structs.Task{
-		Name:   "sleep",
+		Name:   "false",
 		Driver: "exec",
 		Config: map[string]interface{}{
-			"command": "/bin/sleep",
-			"args":    []string{"9000"},
+			"command": "/bin/false",
 		},
 		LogConfig: &structs.LogConfig{
 			MaxFiles:      10,
@@ -328,73 +567,2911 @@ func TestExecDriver_HandlerExec(t *testing.T) {
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	handle := resp.Handle
 
-	// Exec a command that should work and dump the environment
-	out, code, err := handle.Exec(context.Background(), "/bin/sh", []string{"-c", "env | grep NOMAD"})
-	if err != nil {
-		t.Fatalf("error exec'ing stat: %v", err)
+	// A task failing immediately reports a sub-second runtime
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if res.ExitCode != 1 {
+			t.Fatalf("expected exit code 1; got %v", res)
+		}
+		if res.StartedAt.IsZero() || res.FinishedAt.Before(res.StartedAt) {
+			t.Fatalf("unexpected start %v and finish %v", res.StartedAt, res.FinishedAt)
+		}
+		if rt := res.Runtime(); rt <= 0 || rt >= time.Second {
+			t.Fatalf("got runtime %v; want less than a second", rt)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
 	}
-	if code != 0 {
-		t.Fatalf("expected `stat /alloc` to succeed but exit code was: %d", code)
+}
+
+func TestExecDriver_Start_Wait_AllocDir(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
 	}
+	ctestutils.ExecCompatible(t)
 
-	// Assert exec'd commands are run in a task-like environment
-	scriptEnv := make(map[string]string)
-	for _, line := range strings.Split(string(out), "\n") {
-		if line == "" {
-			continue
-		}
-		parts := strings.SplitN(string(line), "=", 2)
-		if len(parts) != 2 {
-			t.Fatalf("Invalid env var: %q", line)
-		}
-		scriptEnv[parts[0]] = parts[1]
+	exp := []byte{'w', 'i', 'n'}
+	file := "output.txt"
+	workDir := "output"
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/bash",
+			"args": []string{
+				"-c",
+				fmt.Sprintf(`sleep 1; echo -n %s > %s`, string(exp), file),
+			},
+			"umask":    "027",
+			"work_dir": fmt.Sprintf("${%s}/%s", env.AllocDir, workDir),
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
 	}
-	if v, ok := scriptEnv["NOMAD_SECRETS_DIR"]; !ok || v != "/secrets" {
-		t.Errorf("Expected NOMAD_SECRETS_DIR=/secrets but found=%t value=%q", ok, v)
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	// The output is written relative to the work dir, which the task's user
+	// must be able to write to
+	dir := filepath.Join(ctx.AllocDir.SharedDir, workDir)
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatalf("err: %v", err)
 	}
-	if v, ok := scriptEnv["NOMAD_ALLOC_ID"]; !ok || v != ctx.DriverCtx.allocID {
-		t.Errorf("Expected NOMAD_SECRETS_DIR=%q but found=%t value=%q", ctx.DriverCtx.allocID, ok, v)
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatalf("err: %v", err)
 	}
 
-	// Assert cgroup membership
-	out, code, err = handle.Exec(context.Background(), "/bin/cat", []string{"/proc/self/cgroup"})
-	if err != nil {
-		t.Fatalf("error exec'ing cat /proc/self/cgroup: %v", err)
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
 	}
-	if code != 0 {
-		t.Fatalf("expected `cat /proc/self/cgroup` to succeed but exit code was: %d", code)
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
 	}
-	found := false
-	for _, line := range strings.Split(string(out), "\n") {
-		// Every cgroup entry should be /nomad/$ALLOC_ID
-		if line == "" {
-			continue
-		}
+
+	// Task should terminate quickly
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// Check that data was written to the shared alloc directory.
+	outputFile := filepath.Join(ctx.AllocDir.SharedDir, workDir, file)
+	act, err := ioutil.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Couldn't read expected output: %v", err)
+	}
+
+	if !reflect.DeepEqual(act, exp) {
+		t.Fatalf("Command outputted %v; want %v", act, exp)
+	}
+
+	// Check that the file was created with the configured umask
+	fi, err := os.Stat(outputFile)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0640 {
+		t.Fatalf("file mode is %v; want %v", mode, os.FileMode(0640))
+	}
+}
+
+func TestExecDriver_Environment(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"5"},
+		},
+		Env: map[string]string{
+			"API_KEY":  "hunter2",
+			"DB_TABLE": "orders",
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	ctx.DriverCtx.config.Options = map[string]string{
+		execEnvSecretsConfigOption: "API_KEY",
+	}
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+
+	handle := resp.Handle.(EnvironmentReader)
+	started := handle.Environment(false)
+	if dir := started[env.AllocDir]; dir != allocdir.SharedAllocContainerPath {
+		t.Fatalf("got %s=%q; want %q", env.AllocDir, dir, allocdir.SharedAllocContainerPath)
+	}
+	if v := started["API_KEY"]; v != "hunter2" {
+		t.Fatalf("got API_KEY=%q; want the secret", v)
+	}
+	if v := handle.Environment(true)["API_KEY"]; v != "<redacted>" {
+		t.Fatalf("got API_KEY=%q; want it redacted", v)
+	}
+
+	// Secrets aren't persisted in the handle ID
+	if id := resp.Handle.ID(); strings.Contains(id, "hunter2") || !strings.Contains(id, "orders") {
+		t.Fatalf("handle ID doesn't persist the environment without the secrets: %s", id)
+	}
+
+	// The environment is restored from the handle ID when reattaching, even
+	// if the task's environment changed since it was started. The secrets
+	// stay redacted.
+	ctx.ExecCtx.TaskEnv = env.NewTaskEnv(map[string]string{"API_KEY": "changed", "DB_TABLE": "changed"}, nil)
+	handle2, err := d.Open(ctx.ExecCtx, resp.Handle.ID())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want := handle.Environment(true)
+	if reattached := handle2.(EnvironmentReader).Environment(false); !reflect.DeepEqual(reattached, want) {
+		t.Fatalf("got environment %v after reattaching; want %v", reattached, want)
+	}
+}
+
+func TestExecDriver_EnvFile(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":  "/bin/bash",
+			"args":     []string{"-c", fmt.Sprintf(`echo -n "$FROM_FILE $FOO" > ${%s}/output.txt`, env.AllocDir)},
+			"env_file": fmt.Sprintf("${%s}/app.env", env.TaskLocalDir),
+		},
+		Env: map[string]string{
+			"FOO": "task",
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+
+	// The task fails to start without the env file
+	if _, err := d.Start(ctx.ExecCtx, task); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("expected missing env file error; got %v", err)
+	}
+
+	envFile := filepath.Join(ctx.ExecCtx.TaskDir.LocalDir, "app.env")
+	if err := ioutil.WriteFile(envFile, []byte("FROM_FILE=file\nFOO=file\n"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The task's env takes precedence over the file
+	act, err := ioutil.ReadFile(filepath.Join(ctx.AllocDir.SharedDir, "output.txt"))
+	if err != nil {
+		t.Fatalf("Couldn't read expected output: %v", err)
+	}
+	if string(act) != "file task" {
+		t.Fatalf("got output %q; want %q", act, "file task")
+	}
+	if v := resp.Handle.(EnvironmentReader).Environment(false)["FROM_FILE"]; v != "file" {
+		t.Fatalf("got FROM_FILE=%q in the handle's environment; want %q", v, "file")
+	}
+}
+
+func TestExecDriver_SecretFiles(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/bash",
+			"args":    []string{"-c", fmt.Sprintf(`echo -n "$(< ${%s}/db_password) ${DB_PASSWORD:-unset}" > ${%s}/output.txt`, env.SecretsDir, env.AllocDir)},
+			"secret_files": map[string]interface{}{
+				"db_password": "${DB_PASSWORD}",
+			},
+		},
+		Env: map[string]string{
+			"DB_PASSWORD": "hunter2",
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The secret is only exposed to the task as a file
+	act, err := ioutil.ReadFile(filepath.Join(ctx.AllocDir.SharedDir, "output.txt"))
+	if err != nil {
+		t.Fatalf("Couldn't read expected output: %v", err)
+	}
+	if string(act) != "hunter2 unset" {
+		t.Fatalf("got output %q; want %q", act, "hunter2 unset")
+	}
+	if _, ok := resp.Handle.(EnvironmentReader).Environment(false)["DB_PASSWORD"]; ok {
+		t.Fatalf("expected DB_PASSWORD not to be in the handle's environment")
+	}
+}
+
+func TestExecDriver_Validate_SecretFiles(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command": "/bin/sleep",
+		"secret_files": map[string]interface{}{
+			"db_password": "${DB_PASSWORD}",
+		},
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	config["secret_files"] = map[string]interface{}{
+		"../db_password": "${DB_PASSWORD}",
+	}
+	if err := d.Validate(config); err == nil {
+		t.Fatalf("expected error for a name outside of the secrets dir")
+	}
+}
+
+func TestExecDriver_Validate_IgnoreSignals(t *testing.T) {
+	t.Parallel()
+	ctestutils.ExecCompatible(t)
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command":        "/bin/sleep",
+		"reset_signals":  true,
+		"ignore_signals": []string{"SIGPIPE", "hup"},
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, sig := range []string{"SIGCHLD", "SIGINT", "SIGKILL", "SIGFOO"} {
+		config["ignore_signals"] = []string{sig}
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("expected error for ignore_signals %q", sig)
+		}
+	}
+}
+
+func TestExecDriver_Validate_HostEnvPassthrough(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command":              "/bin/sleep",
+		"host_env_passthrough": []string{"TZ", "LANG"},
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, name := range []string{"", "1TZ", "TZ=UTC"} {
+		config["host_env_passthrough"] = []string{name}
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("expected error for host_env_passthrough %q", name)
+		}
+	}
+}
+
+func TestExecDriver_Validate_EnvFile(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command":           "/bin/sleep",
+		"env_file":          "local/app.env",
+		"env_file_optional": true,
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	config["env_file_optional"] = "maybe"
+	if err := d.Validate(config); err == nil {
+		t.Fatalf("expected error for env_file_optional %q", "maybe")
+	}
+}
+
+func TestExecDriver_Tmpfs(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/bash",
+			"args": []string{
+				"-c",
+				fmt.Sprintf(`grep ' /scratch tmpfs ' /proc/mounts > ${%s}/mounts.txt`, env.AllocDir),
+			},
+			"tmpfs": []interface{}{
+				map[string]interface{}{"path": "/scratch", "size_mb": 4},
+			},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	// A tmpfs larger than the host's memory is rejected
+	tmpfs := task.Config["tmpfs"]
+	task.Config["tmpfs"] = []interface{}{
+		map[string]interface{}{"path": "/scratch", "size_mb": 1 << 30},
+	}
+	if _, err := d.Prestart(ctx.ExecCtx, task); err == nil || !strings.Contains(err.Error(), "exceed the host's") {
+		t.Fatalf("expected the tmpfs to be rejected, got: %v", err)
+	}
+
+	task.Config["tmpfs"] = tmpfs
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	act, err := ioutil.ReadFile(filepath.Join(ctx.AllocDir.SharedDir, "mounts.txt"))
+	if err != nil {
+		t.Fatalf("Couldn't read expected output: %v", err)
+	}
+	if !strings.Contains(string(act), "size=4096k") {
+		t.Fatalf("expected a tmpfs of 4 MB in the chroot, got %q", act)
+	}
+
+	scratch := filepath.Join(ctx.ExecCtx.TaskDir.Dir, "scratch")
+	if err := ctx.AllocDir.Destroy(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(scratch); !os.IsNotExist(err) {
+		t.Fatalf("expected the tmpfs to be removed with the alloc dir: %v", err)
+	}
+}
+
+func TestExecDriver_Start_Kill_Wait(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"100"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources:   basicResources,
+		KillTimeout: 10 * time.Second,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		err := resp.Handle.Kill()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}()
+
+	// Task should terminate quickly
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if res.Successful() {
+			t.Fatal("should err")
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*10) * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestExecDriver_Start_Kill_Escalation(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+
+	// The command exits on the kill signal but starts a child that ignores it
+	// and is reparented once its parent exited
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":                "/bin/bash",
+			"args":                   []string{"-c", "(trap '' TERM; sleep 100) & echo $! > ${NOMAD_TASK_DIR}/child.pid; wait"},
+			"kill_escalation_signal": "SIGKILL",
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources:   basicResources,
+		KillSignal:  "SIGTERM",
+		KillTimeout: 10 * time.Second,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var child int
+	testutil.WaitForResult(func() (bool, error) {
+		data, err := ioutil.ReadFile(filepath.Join(ctx.ExecCtx.TaskDir.LocalDir, "child.pid"))
+		if err != nil {
+			return false, err
+		}
+		child, err = strconv.Atoi(strings.TrimSpace(string(data)))
+		return err == nil, err
+	}, func(err error) {
+		t.Fatalf("child didn't start: %v", err)
+	})
+
+	start := time.Now()
+	killErr := make(chan error, 1)
+	go func() {
+		killErr <- resp.Handle.Kill()
+	}()
+
+	// The task only exits once the escalation signal killed the child after
+	// half the kill timeout, before the kill timeout destroys it
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if res.Signal != int(syscall.SIGTERM) {
+			t.Fatalf("expected SIGTERM; got %v", res)
+		}
+		if elapsed := time.Since(start); elapsed < task.KillTimeout/2 || elapsed >= task.KillTimeout {
+			t.Fatalf("task exited after %v; expected the escalation after %v", elapsed, task.KillTimeout/2)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*15) * time.Second):
+		t.Fatalf("timeout")
+	}
+	if err := <-killErr; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The reparented child may be left as a zombie until reaped
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", child))
+	if err == nil && !strings.Contains(string(stat), ") Z ") {
+		t.Fatalf("expected child %d to be killed: %s", child, stat)
+	}
+}
+
+func TestExecDriverUser(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		User:   "alice",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"100"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources:   basicResources,
+		KillTimeout: 10 * time.Second,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err == nil {
+		resp.Handle.Kill()
+		t.Fatalf("Should've failed")
+	}
+	msg := "user alice"
+	if !strings.Contains(err.Error(), msg) {
+		t.Fatalf("Expecting '%v' in '%v'", msg, err)
+	}
+	if c := dstructs.StartFailureCategory(err); c != dstructs.StartFailureUser {
+		t.Fatalf("Expecting category %q; got %q", dstructs.StartFailureUser, c)
+	}
+}
+
+func TestExecDriver_Start_InvalidConfig(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"100"},
+			"signal_coalesce": []map[string]interface{}{
+				{"SIGHUP": "soon"},
+			},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err == nil {
+		resp.Handle.Kill()
+		t.Fatalf("Should've failed")
+	}
+	category := dstructs.StartFailureCategory(err)
+	if category != dstructs.StartFailureConfig || !category.UserFault() {
+		t.Fatalf("Expecting user fault category %q; got %q", dstructs.StartFailureConfig, category)
+	}
+}
+
+// TestExecDriver_HandlerExec ensures the exec driver's handle properly
+// executes commands inside the container.
+func TestExecDriver_PreKillCommand(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":          "/bin/sleep",
+			"args":             []string{"9000"},
+			"pre_kill_command": "/bin/sh",
+			"pre_kill_args":    []string{"-c", "test -d /secrets && echo drained > ${NOMAD_ALLOC_DIR}/drained"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := resp.Handle.Kill(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The hook ran within the task's chroot before it was killed
+	act, err := ioutil.ReadFile(filepath.Join(ctx.AllocDir.SharedDir, "drained"))
+	if err != nil {
+		t.Fatalf("expected the pre-kill command to run: %v", err)
+	}
+	if string(act) != "drained\n" {
+		t.Fatalf("unexpected output %q", act)
+	}
+
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if res.Successful() {
+			t.Fatalf("expected the task to be killed")
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestExecDriver_PreKillCommand_Timeout(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":          "/bin/sleep",
+			"args":             []string{"9000"},
+			"pre_kill_command": "/bin/sleep",
+			"pre_kill_args":    []string{"60"},
+			"pre_kill_timeout": "1s",
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The task is killed once the hook times out
+	start := time.Now()
+	if err := resp.Handle.Kill(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-resp.Handle.WaitCh():
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("expected the task to be killed after the pre-kill timeout, took %v", elapsed)
+	}
+}
+
+func TestExecDriver_PreKillCommand_KillTimeout(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":          "/bin/sleep",
+			"args":             []string{"9000"},
+			"pre_kill_command": "/bin/sleep",
+			"pre_kill_args":    []string{"60"},
+			"pre_kill_timeout": "30s",
+		},
+		KillTimeout: time.Second,
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The hook is stopped once the kill timeout elapses rather than the
+	// longer pre-kill timeout
+	start := time.Now()
+	if err := resp.Handle.Kill(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-resp.Handle.WaitCh():
+	case <-time.After(time.Duration(testutil.TestMultiplier()*10) * time.Second):
+		t.Fatalf("timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("expected the task to be killed within the kill timeout, took %v", elapsed)
+	}
+}
+
+func TestExecDriver_Validate_PreKillCommand(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command":          "/bin/sleep",
+		"pre_kill_command": "/usr/local/bin/drain",
+		"pre_kill_args":    []string{"--wait"},
+		"pre_kill_timeout": "30s",
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := []map[string]interface{}{
+		{"pre_kill_command": " /usr/local/bin/drain"},
+		{"pre_kill_timeout": "soon"},
+		{"pre_kill_timeout": "0s"},
+		{"pre_kill_timeout": "1h"},
+	}
+	for _, c := range cases {
+		config := map[string]interface{}{"command": "/bin/sleep"}
+		for k, v := range c {
+			config[k] = v
+		}
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("expected error for %v", c)
+		}
+	}
+}
+
+func TestExecDriver_PostStartCommand(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":            "/bin/sleep",
+			"args":               []string{"9000"},
+			"post_start_command": "/bin/sh",
+			"post_start_args":    []string{"-c", "test -d /secrets && echo ${NOMAD_TASK_NAME} > ${NOMAD_ALLOC_DIR}/registered"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+
+	// The hook ran within the task's chroot and environment before Start
+	// returned
+	act, err := ioutil.ReadFile(filepath.Join(ctx.AllocDir.SharedDir, "registered"))
+	if err != nil {
+		t.Fatalf("expected the post-start command to run: %v", err)
+	}
+	if string(act) != "sleep\n" {
+		t.Fatalf("unexpected output %q", act)
+	}
+}
+
+func TestExecDriver_PostStartCommand_Fatal(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	cases := []struct {
+		args    []string
+		timeout string
+		fatal   bool
+	}{
+		{[]string{"-c", "exit 3"}, "", true},
+		{[]string{"-c", "sleep 60"}, "1s", true},
+		{[]string{"-c", "exit 3"}, "", false},
+	}
+	for _, c := range cases {
+		task := &structs.Task{
+			Name:   "sleep",
+			Driver: "exec",
+			Config: map[string]interface{}{
+				"command":            "/bin/sleep",
+				"args":               []string{"9000"},
+				"post_start_command": "/bin/sh",
+				"post_start_args":    c.args,
+				"post_start_fatal":   c.fatal,
+			},
+			LogConfig: &structs.LogConfig{
+				MaxFiles:      10,
+				MaxFileSizeMB: 10,
+			},
+			Resources: basicResources,
+		}
+		if c.timeout != "" {
+			task.Config["post_start_timeout"] = c.timeout
+		}
+
+		ctx := testDriverContexts(t, task)
+		defer ctx.AllocDir.Destroy()
+		d := NewExecDriver(ctx.DriverCtx)
+
+		if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+			t.Fatalf("prestart err: %v", err)
+		}
+		resp, err := d.Start(ctx.ExecCtx, task)
+		if !c.fatal {
+			if err != nil {
+				t.Fatalf("%v: expected non-fatal post-start failure to be ignored: %v", c.args, err)
+			}
+			resp.Handle.Kill()
+			continue
+		}
+		if err == nil {
+			resp.Handle.Kill()
+			t.Fatalf("%v: expected the task to fail to start", c.args)
+		}
+		if !strings.Contains(err.Error(), "post_start_command") {
+			t.Fatalf("%v: unexpected error: %v", c.args, err)
+		}
+	}
+}
+
+func TestExecDriver_Validate_Devices(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command": "/bin/sleep",
+		"devices": []map[string]interface{}{
+			{"path": "/dev/kvm"},
+			{"path": "/dev/dri/renderD128", "permissions": "rw"},
+		},
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := [][]map[string]interface{}{
+		{{"path": "dev/kvm"}},
+		{{"path": "/tmp/kvm"}},
+		{{"path": "/dev"}},
+		{{"path": "/dev/../tmp/kvm"}},
+		{{"path": "/dev/kvm"}, {"path": "/dev/../dev/kvm"}},
+		{{"path": "/dev/kvm", "permissions": "rx"}},
+		{{"path": "/dev/kvm", "permissions": "rr"}},
+	}
+	for _, c := range cases {
+		config := map[string]interface{}{"command": "/bin/sleep", "devices": c}
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("expected error for %v", c)
+		}
+	}
+}
+
+func TestExecDriver_Validate_PostStartCommand(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command":            "/bin/sleep",
+		"post_start_command": "/usr/local/bin/register",
+		"post_start_args":    []string{"--service", "web"},
+		"post_start_timeout": "30s",
+		"post_start_fatal":   true,
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := []map[string]interface{}{
+		{"post_start_command": " /usr/local/bin/register"},
+		{"post_start_timeout": "soon"},
+		{"post_start_timeout": "0s"},
+		{"post_start_timeout": "1h"},
+	}
+	for _, c := range cases {
+		config := map[string]interface{}{"command": "/bin/sleep"}
+		for k, v := range c {
+			config[k] = v
+		}
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("expected error for %v", c)
+		}
+	}
+}
+
+func TestExecDriver_HandlerExec(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"9000"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	handle := resp.Handle
+
+	// Exec a command that should work and dump the environment
+	out, code, err := handle.Exec(context.Background(), "/bin/sh", []string{"-c", "env | grep NOMAD"})
+	if err != nil {
+		t.Fatalf("error exec'ing stat: %v", err)
+	}
+	if code != 0 {
+		t.Fatalf("expected `stat /alloc` to succeed but exit code was: %d", code)
+	}
+
+	// Assert exec'd commands are run in a task-like environment
+	scriptEnv := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(string(line), "=", 2)
+		if len(parts) != 2 {
+			t.Fatalf("Invalid env var: %q", line)
+		}
+		scriptEnv[parts[0]] = parts[1]
+	}
+	if v, ok := scriptEnv["NOMAD_SECRETS_DIR"]; !ok || v != "/secrets" {
+		t.Errorf("Expected NOMAD_SECRETS_DIR=/secrets but found=%t value=%q", ok, v)
+	}
+	if v, ok := scriptEnv["NOMAD_ALLOC_ID"]; !ok || v != ctx.DriverCtx.allocID {
+		t.Errorf("Expected NOMAD_SECRETS_DIR=%q but found=%t value=%q", ctx.DriverCtx.allocID, ok, v)
+	}
+
+	// Assert cgroup membership
+	out, code, err = handle.Exec(context.Background(), "/bin/cat", []string{"/proc/self/cgroup"})
+	if err != nil {
+		t.Fatalf("error exec'ing cat /proc/self/cgroup: %v", err)
+	}
+	if code != 0 {
+		t.Fatalf("expected `cat /proc/self/cgroup` to succeed but exit code was: %d", code)
+	}
+	found := false
+	for _, line := range strings.Split(string(out), "\n") {
+		// Every cgroup entry should be /nomad/$ALLOC_ID
+		if line == "" {
+			continue
+		}
 		if !strings.Contains(line, ":/nomad/") {
 			t.Errorf("Not a member of the alloc's cgroup: expected=...:/nomad/... -- found=%q", line)
 			continue
 		}
-		found = true
+		found = true
+	}
+	if !found {
+		t.Errorf("exec'd command isn't in the task's cgroup")
+	}
+
+	// Exec a command that should fail
+	out, code, err = handle.Exec(context.Background(), "/usr/bin/stat", []string{"lkjhdsaflkjshowaisxmcvnlia"})
+	if err != nil {
+		t.Fatalf("error exec'ing stat: %v", err)
+	}
+	if code == 0 {
+		t.Fatalf("expected `stat` to fail but exit code was: %d", code)
+	}
+	if expected := "No such file or directory"; !bytes.Contains(out, []byte(expected)) {
+		t.Fatalf("expected output to contain %q but found: %q", expected, out)
+	}
+
+	// Exec a command writing to both streams and assert they're separate
+	splitter, ok := handle.(SplitOutputExecutor)
+	if !ok {
+		t.Fatalf("handle %T doesn't implement SplitOutputExecutor", handle)
+	}
+	script := "for i in 1 2 3; do echo out$i; echo err$i >&2; done; exit 4"
+	stdout, stderr, code, err := splitter.ExecSplitOutput(context.Background(), "/bin/sh", []string{"-c", script})
+	if err != nil {
+		t.Fatalf("error exec'ing script: %v", err)
+	}
+	if code != 4 {
+		t.Fatalf("expected the script to exit with 4 but exit code was: %d", code)
+	}
+	if expected := "out1\nout2\nout3\n"; string(stdout) != expected {
+		t.Fatalf("expected stdout %q but found: %q", expected, stdout)
+	}
+	if expected := "err1\nerr2\nerr3\n"; string(stderr) != expected {
+		t.Fatalf("expected stderr %q but found: %q", expected, stderr)
+	}
+
+	// Exec still returns both streams in a single output
+	out, code, err = handle.Exec(context.Background(), "/bin/sh", []string{"-c", script})
+	if err != nil {
+		t.Fatalf("error exec'ing script: %v", err)
+	}
+	if len(out) != len(stdout)+len(stderr) || !bytes.Contains(out, []byte("out3\n")) || !bytes.Contains(out, []byte("err3\n")) || code != 4 {
+		t.Fatalf("expected the output of both streams and exit code 4 but found: %q and %d", out, code)
+	}
+
+	if err := handle.Kill(); err != nil {
+		t.Fatalf("error killing exec handle: %v", err)
+	}
+}
+
+func TestExecDriver_PidFile(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":  "/bin/sleep",
+			"args":     []string{"100"},
+			"pid_file": "local/run/sleep.pid",
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources:   basicResources,
+		KillTimeout: 10 * time.Second,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	id := &execId{}
+	if err := json.Unmarshal([]byte(resp.Handle.ID()), id); err != nil {
+		t.Fatalf("Failed to parse handle '%s': %v", resp.Handle.ID(), err)
+	}
+
+	pidFile := filepath.Join(ctx.ExecCtx.TaskDir.LocalDir, "run", "sleep.pid")
+	act, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("Couldn't read pid file: %v", err)
+	}
+	if exp := fmt.Sprintf("%d", id.UserPid); strings.TrimSpace(string(act)) != exp {
+		t.Fatalf("pid file contains %q; want %q", act, exp)
+	}
+
+	if err := resp.Handle.Kill(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-resp.Handle.WaitCh():
+	case <-time.After(time.Duration(testutil.TestMultiplier()*15) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Fatalf("pid file wasn't removed: %v", err)
+	}
+}
+
+func TestExecDriver_StatsFile(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":             "/bin/sleep",
+			"args":                []string{"100"},
+			"stats_file":          "local/stats.jsonl",
+			"stats_file_interval": "1s",
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources:   basicResources,
+		KillTimeout: 10 * time.Second,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+
+	statsFile := filepath.Join(ctx.ExecCtx.TaskDir.LocalDir, "stats.jsonl")
+	testutil.WaitForResult(func() (bool, error) {
+		data, err := ioutil.ReadFile(statsFile)
+		if err != nil {
+			return false, err
+		}
+		var record statsFileRecord
+		line := bytes.SplitN(data, []byte("\n"), 2)[0]
+		if err := json.Unmarshal(line, &record); err != nil {
+			return false, fmt.Errorf("invalid record %q: %v", line, err)
+		}
+		if record.Timestamp == 0 || record.MemoryStats == nil {
+			return false, fmt.Errorf("incomplete record %q", line)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("stats file wasn't written: %v", err)
+	})
+}
+
+func TestExecDriver_CrashReport(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "crash",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":      "/bin/bash",
+			"args":         []string{"-c", "sleep 2; kill -SEGV $$"},
+			"crash_report": true,
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources:   basicResources,
+		KillTimeout: 10 * time.Second,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Collect the stats of the running task for the report
+	time.Sleep(time.Second)
+	if _, err := resp.Handle.Stats(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if res.Signal != int(syscall.SIGSEGV) {
+			t.Fatalf("got signal %d; want SIGSEGV", res.Signal)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*10) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	reports, err := filepath.Glob(filepath.Join(ctx.ExecCtx.TaskDir.SharedAllocDir, crashReportDir, "crash-*.json"))
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("got crash reports %v (%v); want 1", reports, err)
+	}
+	data, err := ioutil.ReadFile(reports[0])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var report crashReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if report.Signal != "SIGSEGV" || report.Command[0] != "/bin/bash" || report.LastStats == nil {
+		t.Fatalf("bad report: %s", data)
+	}
+	if len(report.EnvKeys) == 0 || len(report.OpenFiles) == 0 {
+		t.Fatalf("report is missing the environment or open files: %s", data)
+	}
+}
+
+func TestExecDriver_Validate_PidFile(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command":  "/bin/sleep",
+		"pid_file": "local/sleep.pid",
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, path := range []string{"../sleep.pid", "local/../../sleep.pid", "."} {
+		config["pid_file"] = path
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("expected error for pid_file %q", path)
+		}
+	}
+}
+
+func TestExecDriver_Validate_StatsFile(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	valid := map[string]interface{}{
+		"command":             "/bin/sleep",
+		"stats_file":          "local/stats.jsonl",
+		"stats_file_interval": "30s",
+		"stats_file_max_mb":   5,
+	}
+	if err := d.Validate(valid); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for k, v := range map[string]interface{}{
+		"stats_file":          "../stats.jsonl",
+		"stats_file_interval": "100ms",
+		"stats_file_max_mb":   -1,
+	} {
+		config := map[string]interface{}{"command": "/bin/sleep"}
+		config[k] = v
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("expected error for %s %v", k, v)
+		}
+	}
+}
+
+func TestExecDriver_Validate_MaxThreads(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command":           "/bin/sleep",
+		"max_threads":       100,
+		"threads_threshold": 80,
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A threshold may be set without a limit
+	if err := d.Validate(map[string]interface{}{"command": "/bin/sleep", "threads_threshold": 500}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, c := range []map[string]interface{}{
+		{"max_threads": -1},
+		{"threads_threshold": -1},
+		{"max_threads": 100, "threads_threshold": 101},
+	} {
+		c["command"] = "/bin/sleep"
+		if err := d.Validate(c); err == nil {
+			t.Fatalf("expected error for %v", c)
+		}
+	}
+}
+
+func TestExecDriver_Validate_CrashReport(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command":          "/bin/sleep",
+		"crash_report":     true,
+		"crash_report_ttl": "72h",
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, ttl := range []string{"foo", "0s", "-1h"} {
+		config["crash_report_ttl"] = ttl
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("expected error for crash_report_ttl %q", ttl)
+		}
+	}
+}
+
+func TestExecDriver_Validate_StartConfirmation(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command":            "/bin/sleep",
+		"start_confirmation": "500ms",
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, window := range []string{"foo", "0s", "-1s", "1m"} {
+		config["start_confirmation"] = window
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("expected error for start_confirmation %q", window)
+		}
+	}
+}
+
+func TestExecDriver_Validate_SkipABICheck(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command":        "/bin/sleep",
+		"skip_abi_check": true,
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	config["skip_abi_check"] = "maybe"
+	if err := d.Validate(config); err == nil {
+		t.Fatalf("expected error for skip_abi_check")
+	}
+}
+
+func TestExecDriver_Validate_OOMScoreAdj(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command":       "/bin/sleep",
+		"oom_score_adj": 500,
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, adj := range []int{-1, 1001} {
+		config["oom_score_adj"] = adj
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("expected error for oom_score_adj %d", adj)
+		}
+	}
+}
+
+func TestExecDriver_Validate_IO(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command":   "/bin/sleep",
+		"io_weight": 500,
+		"io_limit": []map[string]interface{}{
+			{"device": "/dev/sda", "read_bps": 1048576},
+			{"device": "/dev/sdb", "read_bps": 1048576, "write_bps": 524288},
+		},
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, weight := range []int{9, 1001} {
+		config := map[string]interface{}{
+			"command":   "/bin/sleep",
+			"io_weight": weight,
+		}
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("expected error for io_weight %d", weight)
+		}
+	}
+
+	for _, limit := range []map[string]interface{}{
+		{"device": "sda", "read_bps": 1},
+		{"device": "/dev/sda", "write_bps": -1},
+		{"device": "/dev/sda"},
+	} {
+		config := map[string]interface{}{
+			"command":  "/bin/sleep",
+			"io_limit": []map[string]interface{}{limit},
+		}
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("expected error for io_limit %v", limit)
+		}
+	}
+}
+
+func TestExecDriver_Validate_HealthCheck(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command": "/bin/sleep",
+		"health_check": []map[string]interface{}{
+			{"command": "/bin/check", "args": []string{"--ready"}, "interval": "5s", "timeout": "2s", "threshold": 2},
+		},
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	config["health_check"] = []map[string]interface{}{
+		{"command": "/bin/check", "interval": "5s", "timeout": "10s"},
+	}
+	if err := d.Validate(config); err == nil || !strings.Contains(err.Error(), "at most the interval") {
+		t.Fatalf("expected timeout error; got %v", err)
+	}
+}
+
+func TestExecDriver_Validate_Nice(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	for _, nice := range []int{-20, 0, 19} {
+		config := map[string]interface{}{
+			"command": "/bin/sleep",
+			"nice":    nice,
+		}
+		if err := d.Validate(config); err != nil {
+			t.Fatalf("nice %d: %v", nice, err)
+		}
+	}
+
+	for _, nice := range []int{-21, 20} {
+		config := map[string]interface{}{
+			"command": "/bin/sleep",
+			"nice":    nice,
+		}
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("expected error for nice %d", nice)
+		}
+	}
+}
+
+func TestExecDriver_Validate_Umask(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command": "/bin/sleep",
+		"umask":   "0027",
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, umask := range []string{"18", "abc", "1000"} {
+		config["umask"] = umask
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("expected error for umask %q", umask)
+		}
+	}
+}
+
+func TestExecDriver_Validate_WorkDir(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	for _, workDir := range []string{"local/app", "/alloc/data", "${NOMAD_TASK_DIR}/../../escaped"} {
+		config := map[string]interface{}{
+			"command":  "/bin/sleep",
+			"work_dir": workDir,
+		}
+		if err := d.Validate(config); err != nil {
+			t.Fatalf("work_dir %q: %v", workDir, err)
+		}
+	}
+
+	config := map[string]interface{}{
+		"command":  "/bin/sleep",
+		"work_dir": "../escaped",
+	}
+	if err := d.Validate(config); err == nil {
+		t.Fatalf("expected error for work_dir escaping the task dir")
+	}
+}
+
+func TestExecDriver_Validate_Ulimit(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command": "/bin/sleep",
+		"ulimit": []map[string]string{
+			{"nofile": "65536:65536"},
+			{"core": "0", "nproc": "512:unlimited"},
+		},
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, ulimit := range []map[string]string{
+		{"files": "1024"},
+		{"nofile": "abc"},
+		{"nofile": "2048:1024"},
+	} {
+		config["ulimit"] = []map[string]string{ulimit}
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("expected error for ulimit %v", ulimit)
+		}
+	}
+
+	config["ulimit"] = []map[string]string{{"nproc": "512"}}
+	config["max_threads"] = 512
+	if err := d.Validate(config); err == nil {
+		t.Fatalf("expected error for nproc ulimit with max_threads")
+	}
+}
+
+func TestExecDriver_Validate_NetworkMode(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	for _, mode := range []string{"host", "bridge"} {
+		config := map[string]interface{}{
+			"command":      "/bin/sleep",
+			"network_mode": mode,
+		}
+		if err := d.Validate(config); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	config := map[string]interface{}{
+		"command":      "/bin/sleep",
+		"network_mode": "none",
+	}
+	if err := d.Validate(config); err == nil {
+		t.Fatalf("expected error for network_mode none")
+	}
+}
+
+func TestExecDriver_Validate_KillEscalationSignal(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command":                "/bin/sleep",
+		"kill_escalation_signal": "SIGKILL",
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	config["kill_escalation_signal"] = "SIGFOO"
+	if err := d.Validate(config); err == nil {
+		t.Fatalf("expected error for kill_escalation_signal")
+	}
+}
+
+func TestExecDriver_ValidateTask(t *testing.T) {
+	t.Parallel()
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+		},
+	}
+
+	// Without a node only the config is validated
+	task.Config["command"] = "/bin/missing-command"
+	if err := NewExecDriver(NewEmptyDriverContext()).ValidateTask(task); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	d := NewExecDriver(&DriverContext{config: testConfig(t)})
+	task.Config["command"] = "/bin/sleep"
+	if err := d.ValidateTask(task); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Commands the task may provide itself are only resolved once started
+	for _, command := range []string{"sleep", "/local/sleep", "${NOMAD_TASK_DIR}/sleep", "/opt/sleep"} {
+		task.Config["command"] = command
+		task.Artifacts = []*structs.TaskArtifact{{RelativeDest: "opt/"}}
+		if err := d.ValidateTask(task); err != nil {
+			t.Fatalf("command %q: %v", command, err)
+		}
+	}
+	task.Artifacts = nil
+
+	cases := []struct {
+		command string
+		user    string
+		err     string
+	}{
+		{"/bin/missing-command", "", "can't be found"},
+		{"/opt/sleep", "", "isn't within the chroot"},
+		{"/bin/sleep", "nomad-missing-user", "failed to look up user"},
+	}
+	for _, c := range cases {
+		task.Config["command"] = c.command
+		task.User = c.user
+		if err := d.ValidateTask(task); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("command %q, user %q: expected error containing %q, got: %v", c.command, c.user, c.err, err)
+		}
+	}
+}
+
+func TestExecDriver_Validate_Cpuset(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	for _, key := range []string{"cpuset", "cpuset_cpus"} {
+		config := map[string]interface{}{"command": "/bin/sleep", key: "0-1,3"}
+		if err := d.Validate(config); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		config[key] = "1-0"
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("%s: expected an error for an invalid cpuset", key)
+		}
+	}
+
+	config := map[string]interface{}{"command": "/bin/sleep", "cpuset": "0", "cpuset_cpus": "1"}
+	if err := d.Validate(config); err == nil {
+		t.Fatalf("expected an error when setting both cpuset and cpuset_cpus")
+	}
+}
+
+func TestExecDriver_Validate_ChrootMounts(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command": "/bin/sleep",
+		"chroot_mounts": []map[string]interface{}{
+			{"host_path": "/etc/pki", "task_path": "/etc/pki", "readonly": true},
+			{"host_path": "/srv/data", "task_path": "/data"},
+		},
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := []map[string]interface{}{
+		{"host_path": "srv/data", "task_path": "/data"},
+		{"host_path": "/srv/data", "task_path": "data"},
+		{"host_path": "/srv/data", "task_path": "/"},
+		{"host_path": "/srv/data", "task_path": "/local/data"},
+		{"host_path": "/srv/data", "task_path": "/alloc"},
+		{"host_path": "/srv/data", "task_path": "/proc/../secrets/data"},
+	}
+	for _, c := range cases {
+		config["chroot_mounts"] = []map[string]interface{}{c}
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("expected error for chroot_mounts %v", c)
+		}
+	}
+}
+
+func TestExecDriver_Validate_Capabilities(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command":  "/bin/sleep",
+		"cap_add":  []string{"net_bind_service"},
+		"cap_drop": []string{"CAP_NET_RAW"},
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	config["cap_add"] = []string{"CAP_FLY"}
+	if err := d.Validate(config); err == nil {
+		t.Fatalf("expected error for an unknown capability")
+	}
+	config["cap_add"] = []string{"net_raw"}
+	if err := d.Validate(config); err == nil {
+		t.Fatalf("expected error for a capability both added and dropped")
+	}
+}
+
+func TestExecDriver_Validate_Tmpfs(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command": "/bin/sleep",
+		"tmpfs": []map[string]interface{}{
+			{"path": "/scratch", "size_mb": 64},
+			{"path": "/var/cache"},
+		},
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := []map[string]interface{}{
+		{"path": "scratch"},
+		{"path": "/"},
+		{"path": "/local/scratch"},
+		{"path": "/dev/shm"},
+		{"path": "/scratch", "size_mb": -1},
+	}
+	for _, c := range cases {
+		config["tmpfs"] = []map[string]interface{}{c}
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("expected error for tmpfs %v", c)
+		}
+	}
+}
+
+func TestExecDriver_Validate_ReadonlyRootfs(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command":         "/bin/sleep",
+		"readonly_rootfs": true,
+		"tmpfs": []map[string]interface{}{
+			{"path": "/tmp"},
+		},
+		"chroot_mounts": []map[string]interface{}{
+			{"host_path": "/etc/pki", "task_path": "/etc/pki", "readonly": true},
+		},
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Only the declared tmpfs mounts are writable
+	config["chroot_mounts"] = []map[string]interface{}{
+		{"host_path": "/srv/data", "task_path": "/data"},
+	}
+	if err := d.Validate(config); err == nil {
+		t.Fatalf("expected error for a read-write chroot mount")
+	}
+
+	// The root of the host can't be read-only
+	delete(config, "chroot_mounts")
+	delete(config, "tmpfs")
+	config["no_chroot"] = true
+	if err := d.Validate(config); err == nil {
+		t.Fatalf("expected error for no_chroot")
+	}
+}
+
+func TestExecDriverConfig_TmpfsMounts(t *testing.T) {
+	t.Parallel()
+	task := &structs.Task{Resources: &structs.Resources{MemoryMB: 256}}
+	c := &ExecDriverConfig{
+		Tmpfs: []*ExecTmpfsMount{
+			{Path: "/scratch", SizeMB: 64},
+			{Path: "/var/cache"},
+		},
+	}
+
+	mounts := c.tmpfsMounts(task)
+	if len(mounts) != 2 {
+		t.Fatalf("expected 2 mounts, got %d", len(mounts))
+	}
+	if m := mounts[0]; m.TaskPath != "/scratch" || m.SizeMB != 64 {
+		t.Fatalf("unexpected mount: %+v", m)
+	}
+
+	// Mounts without a size get half of the task's memory
+	if m := mounts[1]; m.TaskPath != "/var/cache" || m.SizeMB != 128 {
+		t.Fatalf("unexpected mount: %+v", m)
+	}
+}
+
+func TestExecDriver_Validate_ScratchDir(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command":       "/bin/sleep",
+		"scratch_dir":   "scratch",
+		"scratch_group": "app",
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, path := range []string{"../scratch", "a/b", ".", "logs"} {
+		config["scratch_dir"] = path
+		if err := d.Validate(config); err == nil {
+			t.Fatalf("expected error for scratch_dir %q", path)
+		}
+	}
+
+	// Both options must be set together
+	if err := d.Validate(map[string]interface{}{"command": "/bin/sleep", "scratch_dir": "scratch"}); err == nil {
+		t.Fatalf("expected error for scratch_dir without scratch_group")
+	}
+	if err := d.Validate(map[string]interface{}{"command": "/bin/sleep", "scratch_group": "app"}); err == nil {
+		t.Fatalf("expected error for scratch_group without scratch_dir")
+	}
+}
+
+func TestExecDriver_Prestart_NotExecutable(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "local/run.txt",
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	file := filepath.Join(ctx.ExecCtx.TaskDir.Dir, "local", "run.txt")
+	if err := ioutil.WriteFile(file, []byte("sleep 1\n"), 0777); err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+
+	_, err := d.Prestart(ctx.ExecCtx, task)
+	if err == nil || !strings.Contains(err.Error(), "exec format error") {
+		t.Fatalf("expected exec format error explanation; got %v", err)
+	}
+}
+
+func TestExecDriver_Prestart_InsufficientMemory(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"1"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	ctx.DriverCtx.config.Options = map[string]string{
+		execMemoryCheckConfigOption:    "true",
+		execMemoryHeadroomConfigOption: "1048576000",
+	}
+	d := NewExecDriver(ctx.DriverCtx)
+
+	_, err := d.Prestart(ctx.ExecCtx, task)
+	if err == nil || !strings.Contains(err.Error(), "insufficient memory") {
+		t.Fatalf("expected insufficient memory error; got %v", err)
+	}
+}
+
+func TestExecDriver_Prestart_NoSwap(t *testing.T) {
+	t.Parallel()
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"1"},
+			"no_swap": true,
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	// The node has no memory cgroup to account swap in
+	delete(ctx.DriverCtx.node.Attributes, "unique.cgroup.mountpoint")
+	_, err := d.Prestart(ctx.ExecCtx, task)
+	if err == nil || !strings.Contains(err.Error(), "no_swap requires swap accounting") {
+		t.Fatalf("expected swap accounting error; got %v", err)
+	}
+}
+
+func TestExecDriver_Prestart_Devices(t *testing.T) {
+	t.Parallel()
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"1"},
+			"devices": []map[string]interface{}{
+				{"path": "/dev/does-not-exist"},
+			},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	_, err := d.Prestart(ctx.ExecCtx, task)
+	if err == nil || !strings.Contains(err.Error(), "invalid device") {
+		t.Fatalf("expected invalid device error; got %v", err)
+	}
+}
+
+func TestExecDriver_Prestart_OOMDisable(t *testing.T) {
+	t.Parallel()
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":     "/bin/sleep",
+			"args":        []string{"1"},
+			"oom_disable": true,
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	// The node has no memory cgroup to disable the OOM killer of
+	delete(ctx.DriverCtx.node.Attributes, "unique.cgroup.mountpoint")
+	_, err := d.Prestart(ctx.ExecCtx, task)
+	if err == nil || !strings.Contains(err.Error(), "oom_disable requires") {
+		t.Fatalf("expected OOM control error; got %v", err)
+	}
+}
+
+func TestExecDriver_Prestart_IO(t *testing.T) {
+	t.Parallel()
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"1"},
+			"io_limit": []map[string]interface{}{
+				{"device": "/dev/null", "read_bps": 1048576},
+			},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	// Limits only apply to block devices
+	if ioIsolationSupported(ctx.DriverCtx.node) {
+		_, err := d.Prestart(ctx.ExecCtx, task)
+		if err == nil || !strings.Contains(err.Error(), "invalid io_limit device") {
+			t.Fatalf("expected invalid device error; got %v", err)
+		}
+	}
+
+	// The node has no blkio cgroup to limit I/O with
+	delete(ctx.DriverCtx.node.Attributes, "unique.cgroup.mountpoint")
+	_, err := d.Prestart(ctx.ExecCtx, task)
+	if err == nil || !strings.Contains(err.Error(), "require the blkio cgroup controller") {
+		t.Fatalf("expected blkio error; got %v", err)
+	}
+}
+
+func TestExecDriver_Prestart_WorkDir(t *testing.T) {
+	t.Parallel()
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":  "/bin/sleep",
+			"args":     []string{"1"},
+			"work_dir": "${NOMAD_TASK_DIR}/app",
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	_, err := d.Prestart(ctx.ExecCtx, task)
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("expected missing work_dir error; got %v", err)
+	}
+
+	// Files aren't directories
+	if err := ioutil.WriteFile(filepath.Join(ctx.ExecCtx.TaskDir.LocalDir, "app"), nil, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, err = d.Prestart(ctx.ExecCtx, task)
+	if err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Fatalf("expected not a directory error; got %v", err)
+	}
+
+	// Interpolated work dirs can't escape the task dir either
+	task.Config["work_dir"] = "${NOMAD_TASK_DIR}/../../escaped"
+	_, err = d.Prestart(ctx.ExecCtx, task)
+	if err == nil || !strings.Contains(err.Error(), "must be within the task directory") {
+		t.Fatalf("expected escaping work_dir error; got %v", err)
+	}
+}
+
+func TestExecDriver_CommandWrapper(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/bash",
+			"args":    []string{"-c", "echo -n $NOMAD_WRAPPED_COMMAND $0 > ${NOMAD_ALLOC_DIR}/wrapped"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	ctx.DriverCtx.config.Options = map[string]string{
+		execCommandWrapperConfigOption: "/usr/bin/env",
+	}
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The wrapper execs the command with its arguments
+	out, err := ioutil.ReadFile(filepath.Join(ctx.AllocDir.SharedDir, "wrapped"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "/bin/bash /bin/bash" {
+		t.Fatalf("got %q; want the wrapped command", out)
+	}
+}
+
+func TestExecDriver_CommandWrapper_Missing(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"1"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	ctx.DriverCtx.config.Options = map[string]string{
+		execCommandWrapperConfigOption: "/opt/accounting/wrap",
+	}
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	_, err := d.Start(ctx.ExecCtx, task)
+	if err == nil || !strings.Contains(err.Error(), "not found in the task's chroot") {
+		t.Fatalf("expected missing wrapper error; got %v", err)
+	}
+	if c := dstructs.StartFailureCategory(err); c != dstructs.StartFailureFilesystem {
+		t.Fatalf("got category %q; want %q", c, dstructs.StartFailureFilesystem)
+	}
+}
+
+func TestExecDriver_RecentOutput(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/bash",
+			"args":    []string{"-c", "echo hello; sleep 10"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+			BufferSizeKB:  1,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+
+	reader, ok := resp.Handle.(OutputReader)
+	if !ok {
+		t.Fatalf("handle %T doesn't implement OutputReader", resp.Handle)
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		stdout, _, err := reader.RecentOutput()
+		if err != nil {
+			return false, err
+		}
+		return string(stdout) == "hello\n", fmt.Errorf("unexpected stdout %q", stdout)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func TestExecDriver_Logs(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/bash",
+			"args":    []string{"-c", "echo oops >&2; for i in 1 2 3; do echo line $i; sleep 0.2; done; sleep 10"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+
+	streamer, ok := resp.Handle.(LogStreamer)
+	if !ok {
+		t.Fatalf("handle %T doesn't implement LogStreamer", resp.Handle)
+	}
+	if _, err := streamer.Logs(context.Background(), structs.LogStreamCombined, false); err == nil {
+		t.Fatalf("expected error streaming logs that aren't combined")
+	}
+
+	// The followed stream is read as the task writes it
+	logCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, err := streamer.Logs(logCtx, "stdout", true)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Close()
+	scanner := bufio.NewScanner(r)
+	for i := 1; i <= 3; i++ {
+		if !scanner.Scan() {
+			t.Fatalf("stream ended after %d lines: %v", i-1, scanner.Err())
+		}
+		if exp := fmt.Sprintf("line %d", i); scanner.Text() != exp {
+			t.Fatalf("got line %q; want %q", scanner.Text(), exp)
+		}
+	}
+
+	r, err = streamer.Logs(context.Background(), "stderr", false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Close()
+	if out, err := ioutil.ReadAll(r); err != nil || string(out) != "oops\n" {
+		t.Fatalf("unexpected stderr %q: %v", out, err)
+	}
+
+	// Reattached handles stream the same log files
+	id, err := parseExecId(resp.Handle.ID(), testLogger())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := map[string]string{"stdout": "sleep.stdout", "stderr": "sleep.stderr"}
+	if !reflect.DeepEqual(id.LogFiles, expected) {
+		t.Fatalf("got log files %v; want %v", id.LogFiles, expected)
+	}
+}
+
+func TestExecDriver_Readiness(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	cases := []struct {
+		script string
+		gate   map[string]interface{}
+	}{
+		{"sleep 1; touch /local/ready; sleep 10", map[string]interface{}{"file": "local/ready"}},
+		{"sleep 1; echo -n 'server lis'; sleep 0.2; echo 'tening'; sleep 10", map[string]interface{}{"stdout": "listening"}},
+	}
+	for _, c := range cases {
+		task := &structs.Task{
+			Name:   "sleep",
+			Driver: "exec",
+			Config: map[string]interface{}{
+				"command":   "/bin/bash",
+				"args":      []string{"-c", c.script},
+				"readiness": []interface{}{c.gate},
+			},
+			LogConfig: &structs.LogConfig{
+				MaxFiles:      10,
+				MaxFileSizeMB: 10,
+			},
+			Resources: basicResources,
+		}
+
+		ctx := testDriverContexts(t, task)
+		defer ctx.AllocDir.Destroy()
+		d := NewExecDriver(ctx.DriverCtx)
+
+		if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+			t.Fatalf("prestart err: %v", err)
+		}
+
+		// Sentinels written by an earlier run of the task are ignored
+		stdout := filepath.Join(ctx.ExecCtx.TaskDir.LogDir, "sleep.stdout.0")
+		if err := ioutil.WriteFile(stdout, []byte("listening\n"), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// Start returns once the task is ready
+		start := time.Now()
+		resp, err := d.Start(ctx.ExecCtx, task)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer resp.Handle.Kill()
+		if elapsed := time.Since(start); elapsed < time.Second {
+			t.Fatalf("expected Start to wait for the task to be ready by %v; returned after %v", c.gate, elapsed)
+		}
 	}
-	if !found {
-		t.Errorf("exec'd command isn't in the task's cgroup")
+}
+
+func TestExecDriver_Readiness_Timeout(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"100"},
+			"readiness": []interface{}{
+				map[string]interface{}{"file": "local/ready", "timeout": "1s"},
+			},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources:   basicResources,
+		KillTimeout: time.Second,
 	}
 
-	// Exec a command that should fail
-	out, code, err = handle.Exec(context.Background(), "/usr/bin/stat", []string{"lkjhdsaflkjshowaisxmcvnlia"})
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err == nil {
+		resp.Handle.Kill()
+		t.Fatalf("expected the task not to be ready")
+	}
+	if !strings.Contains(err.Error(), "readiness timeout of 1s") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rerr, ok := err.(*dstructs.StartError); !ok || !rerr.IsRecoverable() {
+		t.Fatalf("expected a recoverable start error; got %#v", err)
+	}
+}
+
+func TestExecDriver_Validate_Readiness(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command": "/bin/sleep",
+		"readiness": []map[string]interface{}{
+			{"tcp": ":8080", "timeout": "10s"},
+		},
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	config["readiness"] = []map[string]interface{}{
+		{"tcp": ":8080", "stdout": "ready"},
+	}
+	if err := d.Validate(config); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestExecDriver_Validate_MemorySoftLimit(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{
+		"command":                 "/bin/sleep",
+		"memory_soft_limit":       128,
+		"memory_soft_limit_grace": "1m",
+	}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := []map[string]interface{}{
+		{"memory_soft_limit": -1},
+		{"memory_soft_limit": 128, "memory_soft_limit_grace": "100ms"},
+		{"memory_soft_limit": 128, "memory_soft_limit_grace": "soon"},
+		{"memory_soft_limit_grace": "1m"},
+	}
+	for _, c := range cases {
+		c["command"] = "/bin/sleep"
+		if err := d.Validate(c); err == nil {
+			t.Fatalf("expected error for %v", c)
+		}
+	}
+
+	// The soft limit must be below the task's memory
+	task := &structs.Task{
+		Name:      "sleep",
+		Driver:    "exec",
+		Config:    map[string]interface{}{"command": "/bin/sleep", "memory_soft_limit": 256},
+		Resources: &structs.Resources{MemoryMB: 256},
+	}
+	if err := NewExecDriver(NewEmptyDriverContext()).ValidateTask(task); err == nil || !strings.Contains(err.Error(), "must be below") {
+		t.Fatalf("expected the soft limit to be rejected; got %v", err)
+	}
+	task.Config["memory_soft_limit"] = 128
+	if err := NewExecDriver(NewEmptyDriverContext()).ValidateTask(task); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestExecDriver_Validate_NoChroot(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{"command": "/bin/sleep", "no_chroot": true}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := []map[string]interface{}{
+		{"chroot_mounts": []map[string]interface{}{{"host_path": "/opt", "task_path": "/opt"}}},
+		{"tmpfs": []map[string]interface{}{{"path": "/scratch"}}},
+		{"resolve_command_each_start": true},
+	}
+	for _, c := range cases {
+		c["command"] = "/bin/sleep"
+		c["no_chroot"] = true
+		if err := d.Validate(c); err == nil {
+			t.Fatalf("expected error for %v", c)
+		}
+	}
+}
+
+func TestExecDriver_ValidateTask_NoChroot(t *testing.T) {
+	t.Parallel()
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":   "/bin/sleep",
+			"no_chroot": true,
+		},
+	}
+
+	// Servers can't tell whether the client allows it
+	if err := NewExecDriver(NewEmptyDriverContext()).ValidateTask(task); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	conf := testConfig(t)
+	d := NewExecDriver(&DriverContext{config: conf})
+	if err := d.ValidateTask(task); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("expected no_chroot to be rejected; got %v", err)
+	}
+
+	conf.Options = map[string]string{execNoChrootConfigOption: "true"}
+	if err := d.ValidateTask(task); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Commands are found on the host rather than in the chroot
+	task.Config["command"] = "/opt/sleep"
+	if err := d.ValidateTask(task); err == nil || !strings.Contains(err.Error(), "can't be found") {
+		t.Fatalf("expected the command to be looked up on the host; got %v", err)
+	}
+
+	// The host isn't searched unless the client allows it
+	conf.Options = nil
+	if err := d.ValidateTask(task); err == nil || strings.Contains(err.Error(), "can't be found") {
+		t.Fatalf("expected only no_chroot to be rejected; got %v", err)
+	}
+}
+
+func TestExecDriver_ValidateTask_ChrootMounts(t *testing.T) {
+	t.Parallel()
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"chroot_mounts": []map[string]interface{}{
+				{"host_path": "/etc", "task_path": "/host-etc", "readonly": true},
+			},
+		},
+	}
+
+	conf := testConfig(t)
+	d := NewExecDriver(&DriverContext{config: conf})
+	if err := d.ValidateTask(task); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("expected chroot_mounts to be rejected; got %v", err)
+	}
+
+	conf.Options = map[string]string{execChrootMountsConfigOption: "true"}
+	if err := d.ValidateTask(task); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Host paths are only checked once the client allows them
+	task.Config["chroot_mounts"] = []map[string]interface{}{
+		{"host_path": "/nonexistent", "task_path": "/data"},
+	}
+	if err := d.ValidateTask(task); err == nil || !strings.Contains(err.Error(), "can't be mounted") {
+		t.Fatalf("expected the missing host path to be rejected; got %v", err)
+	}
+	conf.Options = nil
+	if err := d.ValidateTask(task); err == nil || strings.Contains(err.Error(), "can't be mounted") {
+		t.Fatalf("expected only chroot_mounts to be rejected; got %v", err)
+	}
+}
+
+func TestExecDriver_ValidateTask_OOMDisable(t *testing.T) {
+	t.Parallel()
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":     "/bin/sleep",
+			"oom_disable": true,
+		},
+	}
+
+	// Servers can't tell whether the client allows it
+	if err := NewExecDriver(NewEmptyDriverContext()).ValidateTask(task); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	conf := testConfig(t)
+	d := NewExecDriver(&DriverContext{config: conf})
+	if err := d.ValidateTask(task); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("expected oom_disable to be rejected; got %v", err)
+	}
+
+	conf.Options = map[string]string{execOOMDisableJobsConfigOption: "coordinator"}
+	if err := d.ValidateTask(task); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestExecDriver_TaskFSIsolation(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{}).(*ExecDriver)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{"command": "/bin/sleep"},
+	}
+	if fsi := d.TaskFSIsolation(task); fsi != cstructs.FSIsolationChroot {
+		t.Fatalf("expected chroot isolation; got %v", fsi)
+	}
+	task.Config["no_chroot"] = true
+	if fsi := d.TaskFSIsolation(task); fsi != cstructs.FSIsolationNone {
+		t.Fatalf("expected no isolation; got %v", fsi)
+	}
+}
+
+func TestChrootShells(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "shells")
 	if err != nil {
-		t.Fatalf("error exec'ing stat: %v", err)
+		t.Fatalf("err: %v", err)
 	}
-	if code == 0 {
-		t.Fatalf("expected `stat` to fail but exit code was: %d", code)
+	defer os.RemoveAll(dir)
+
+	bin := filepath.Join(dir, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatalf("err: %v", err)
 	}
-	if expected := "No such file or directory"; !bytes.Contains(out, []byte(expected)) {
-		t.Fatalf("expected output to contain %q but found: %q", expected, out)
+	ioutil.WriteFile(filepath.Join(bin, "dash"), []byte("#!"), 0755)
+	ioutil.WriteFile(filepath.Join(bin, "bash"), []byte("#!"), 0644)
+	os.Symlink("dash", filepath.Join(bin, "sh"))
+
+	shells := chrootShells(map[string]string{bin: "/bin"})
+	if exp := map[string]bool{"dash": true, "sh": true}; !reflect.DeepEqual(shells, exp) {
+		t.Fatalf("expected %v; got %v", exp, shells)
 	}
 
-	if err := handle.Kill(); err != nil {
-		t.Fatalf("error killing exec handle: %v", err)
+	// Shells outside of the chroot aren't found
+	if shells := chrootShells(map[string]string{dir: "/opt"}); len(shells) != 0 {
+		t.Fatalf("expected no shells; got %v", shells)
+	}
+}
+
+func TestExecDriver_Validate_CoreDump(t *testing.T) {
+	t.Parallel()
+	d := NewExecDriver(&DriverContext{})
+
+	config := map[string]interface{}{"command": "/bin/sleep", "core_dump": true}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The core ulimit sets the hard limit core_dump raises the soft limit to
+	config["ulimit"] = []map[string]string{{"core": "0:1024"}}
+	if err := d.Validate(config); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The core size limit is raised by the launch shim rather than through
+	// the task's ulimits, which are capped by the client
+	c := &ExecDriverConfig{CoreDump: true}
+	ulimits, err := c.ulimits()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ulimits) != 0 {
+		t.Fatalf("expected no ulimits; got %v", ulimits)
+	}
+}
+
+func TestTaskLogFiles(t *testing.T) {
+	t.Parallel()
+	logConfig := &structs.LogConfig{FileNamePattern: "{alloc}-{task}-{stream}", CombineLogs: true}
+	files := taskLogFiles(logConfig, "web", "1234")
+	if expected := map[string]string{"output": "1234-web-output"}; !reflect.DeepEqual(files, expected) {
+		t.Fatalf("got log files %v; want %v", files, expected)
+	}
+
+	files = taskLogFiles(nil, "web", "1234")
+	if expected := map[string]string{"stdout": "web.stdout", "stderr": "web.stderr"}; !reflect.DeepEqual(files, expected) {
+		t.Fatalf("got log files %v; want %v", files, expected)
+	}
+}
+
+func TestExecDriver_Start_CpusetConflict(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"1"},
+			"cpuset":  "0",
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	// Pin another task to the core
+	other := fmt.Sprintf("%s/other", ctx.DriverCtx.allocID)
+	if _, err := globalCpusets.Acquire(other, []int{0}, true); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer globalCpusets.Release(other)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	_, err := d.Start(ctx.ExecCtx, task)
+	if err == nil || !strings.Contains(err.Error(), "already pinned") {
+		t.Fatalf("expected cpuset conflict; got %v", err)
+	}
+	if !structs.IsRecoverable(err) {
+		t.Fatalf("expected cpuset conflict to be recoverable")
+	}
+}
+
+func TestExecDriver_Prestart_CpusetOffline(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":     "/bin/sleep",
+			"args":        []string{"1"},
+			"cpuset_cpus": "4095",
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	_, err := d.Prestart(ctx.ExecCtx, task)
+	if err == nil || !strings.Contains(err.Error(), "aren't online") {
+		t.Fatalf("expected an offline cpuset error; got %v", err)
+	}
+}
+
+func TestExecDriver_socketActivationTaskEnv(t *testing.T) {
+	t.Parallel()
+	taskEnv := env.NewTaskEnv(map[string]string{
+		"NOMAD_PORT_http": "8080",
+		"NOMAD_ADDR_http": "10.0.0.1:8080",
+	}, nil)
+
+	socketEnv, addr, err := socketActivationTaskEnv(taskEnv, "http")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if addr != "10.0.0.1:8080" {
+		t.Fatalf("got addr %q; want %q", addr, "10.0.0.1:8080")
+	}
+	envMap := socketEnv.Map()
+	if envMap["LISTEN_FDS"] != "1" || envMap["LISTEN_FDNAMES"] != "http" {
+		t.Fatalf("socket activation env not set: %v", envMap)
+	}
+	if _, ok := taskEnv.Map()["LISTEN_FDS"]; ok {
+		t.Fatalf("task env modified: %v", taskEnv.Map())
+	}
+
+	if _, _, err := socketActivationTaskEnv(taskEnv, "grpc"); err == nil {
+		t.Fatalf("expected an error for an unknown port label")
+	}
+
+	// Tasks are validated to have the port
+	task := &structs.Task{
+		Name:   "web",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":           "/bin/sleep",
+			"socket_activation": "http",
+		},
+		Resources: &structs.Resources{
+			Networks: []*structs.NetworkResource{{DynamicPorts: []structs.Port{{Label: "http"}}}},
+		},
+	}
+	d := NewExecDriver(NewEmptyDriverContext())
+	if err := d.ValidateTask(task); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	task.Config["socket_activation"] = "grpc"
+	if err := d.ValidateTask(task); err == nil {
+		t.Fatalf("expected an error for an unknown port label")
+	}
+}
+
+func TestExecDriver_metricsTaskEnv(t *testing.T) {
+	t.Parallel()
+	taskEnv := env.NewTaskEnv(map[string]string{
+		"NOMAD_PORT_prom": "9100",
+		"NOMAD_ADDR_prom": "10.0.0.1:9100",
+	}, nil)
+
+	metricsEnv, addr, err := metricsTaskEnv(taskEnv, "prom")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if addr != "10.0.0.1:9100" {
+		t.Fatalf("got addr %q; want %q", addr, "10.0.0.1:9100")
+	}
+	envMap := metricsEnv.Map()
+	if envMap[env.MetricsPort] != "9100" || envMap[env.MetricsAddr] != "10.0.0.1:9100" {
+		t.Fatalf("metrics env not set: %v", envMap)
+	}
+	if _, ok := taskEnv.Map()[env.MetricsPort]; ok {
+		t.Fatalf("task env modified: %v", taskEnv.Map())
+	}
+
+	if _, _, err := metricsTaskEnv(taskEnv, "http"); err == nil {
+		t.Fatalf("expected an error for an unknown port label")
 	}
 }
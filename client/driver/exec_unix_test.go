@@ -3,15 +3,25 @@
 package driver
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/config"
+	dstructs "github.com/hashicorp/nomad/client/driver/structs"
 	"github.com/hashicorp/nomad/nomad/structs"
 	"github.com/hashicorp/nomad/testutil"
 
@@ -48,12 +58,28 @@ func TestExecDriver_KillUserPid_OnPluginReconnectFailure(t *testing.T) {
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
-	defer resp.Handle.Kill()
+
+	// A handle detached from, as by the client shutting down, is reattached
+	// to while its executor runs
+	if err := resp.Handle.(Detacher).Detach(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	handle, err := d.Open(ctx.ExecCtx, resp.Handle.ID())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
 
 	id := &execId{}
-	if err := json.Unmarshal([]byte(resp.Handle.ID()), id); err != nil {
-		t.Fatalf("Failed to parse handle '%s': %v", resp.Handle.ID(), err)
+	if err := json.Unmarshal([]byte(handle.ID()), id); err != nil {
+		t.Fatalf("Failed to parse handle '%s': %v", handle.ID(), err)
+	}
+	userProc, _ := os.FindProcess(id.UserPid)
+	if err := userProc.Signal(syscall.Signal(0)); err != nil {
+		t.Fatalf("expected user process to be alive: %v", err)
 	}
+
+	// Once the executor died the task can't be reattached to and is killed
 	pluginPid := id.PluginConfig.Pid
 	proc, err := os.FindProcess(pluginPid)
 	if err != nil {
@@ -64,7 +90,7 @@ func TestExecDriver_KillUserPid_OnPluginReconnectFailure(t *testing.T) {
 	}
 
 	// Attempt to open
-	handle2, err := d.Open(ctx.ExecCtx, resp.Handle.ID())
+	handle2, err := d.Open(ctx.ExecCtx, handle.ID())
 	if err == nil {
 		t.Fatalf("expected error")
 	}
@@ -74,8 +100,6 @@ func TestExecDriver_KillUserPid_OnPluginReconnectFailure(t *testing.T) {
 	}
 
 	// Test if the userpid is still present
-	userProc, _ := os.FindProcess(id.UserPid)
-
 	for retry := 3; retry > 0; retry-- {
 		if err = userProc.Signal(syscall.Signal(0)); err != nil {
 			// Process is gone as expected; exit
@@ -90,6 +114,144 @@ func TestExecDriver_KillUserPid_OnPluginReconnectFailure(t *testing.T) {
 	}
 }
 
+func TestExecDriver_Stats_Reattach(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"1000000"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+
+	first, err := resp.Handle.Stats()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cs := first.ResourceUsage.CpuStats
+	if measured := strings.Join(cs.Measured, ","); !strings.Contains(measured, "Throttled Periods") || !strings.Contains(measured, "Throttled Time") {
+		t.Fatalf("throttling isn't measured: %v", cs.Measured)
+	}
+
+	// Samples are reused within the stats interval
+	again, err := resp.Handle.Stats()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if again != first {
+		t.Fatalf("expected the sample to be reused")
+	}
+
+	// A reattached handle resumes sampling the same cgroup
+	handle2, err := d.Open(ctx.ExecCtx, resp.Handle.ID())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	time.Sleep(defaultExecStatsInterval)
+	resumed, err := handle2.Stats()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resumed.Timestamp <= first.Timestamp {
+		t.Fatalf("expected a new sample; got timestamps %d and %d", first.Timestamp, resumed.Timestamp)
+	}
+	if rcs := resumed.ResourceUsage.CpuStats; rcs.ThrottledPeriods < cs.ThrottledPeriods || rcs.ThrottledTime < cs.ThrottledTime {
+		t.Fatalf("throttling counters went backwards: %+v then %+v", cs, rcs)
+	}
+}
+
+func TestExecDriver_Detach(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"3"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	id := &execId{}
+	if err := json.Unmarshal([]byte(resp.Handle.ID()), id); err != nil {
+		t.Fatalf("Failed to parse handle '%s': %v", resp.Handle.ID(), err)
+	}
+	if err := resp.Handle.(Detacher).Detach(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := resp.Handle.(Detacher).Detach(); err == nil {
+		t.Fatalf("expected error detaching twice")
+	}
+
+	// The task keeps running without a result
+	userProc, _ := os.FindProcess(id.UserPid)
+	if err := userProc.Signal(syscall.Signal(0)); err != nil {
+		t.Fatalf("expected user process to be alive: %v", err)
+	}
+	select {
+	case res := <-resp.Handle.WaitCh():
+		t.Fatalf("unexpected result of detached handle: %v", res)
+	default:
+	}
+
+	// The reattached handle waits for the task
+	handle2, err := d.Open(ctx.ExecCtx, resp.Handle.ID())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle2.Kill()
+
+	select {
+	case res := <-handle2.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*10) * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
 func TestExecDriver_Signal(t *testing.T) {
 	if !testutil.IsTravis() {
 		t.Parallel()
@@ -168,3 +330,1684 @@ done
 		t.Fatalf("Command outputted %v; want %v", act, exp)
 	}
 }
+
+func TestExecDriver_SignalTask(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "signal",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/bash",
+			"args":    []string{"test.sh"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources:   basicResources,
+		KillTimeout: time.Second,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	testFile := filepath.Join(ctx.ExecCtx.TaskDir.Dir, "test.sh")
+	testData := []byte(`
+trap 'echo parent' WINCH
+/bin/bash -c "trap 'echo child' WINCH; while true; do sleep 0.1; done" &
+while true; do
+    sleep 0.1
+done
+	`)
+	if err := ioutil.WriteFile(testFile, testData, 0777); err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+
+	if err := SignalTask(resp.Handle, "SIGFOO", false); err == nil {
+		t.Fatalf("expected error sending an unknown signal")
+	}
+
+	// The signal is resent until the traps are set up as SIGWINCH is
+	// otherwise ignored
+	outputFile := filepath.Join(ctx.ExecCtx.TaskDir.LogDir, "signal.stdout.0")
+	waitForOutput := func(name string, group bool, output string) string {
+		var act []byte
+		testutil.WaitForResult(func() (bool, error) {
+			if err := SignalTask(resp.Handle, name, group); err != nil {
+				return false, err
+			}
+			act, err = ioutil.ReadFile(outputFile)
+			if err != nil {
+				return false, err
+			}
+			return strings.Contains(string(act), output), fmt.Errorf("unexpected output %q", act)
+		}, func(err error) {
+			t.Fatalf("err: %v", err)
+		})
+		return string(act)
+	}
+
+	// Only the main process is signaled unless the whole group is
+	if act := waitForOutput("winch", false, "parent"); strings.Contains(act, "child") {
+		t.Fatalf("expected only the main process to be signaled; got %q", act)
+	}
+	waitForOutput("SIGWINCH", true, "child")
+}
+
+func TestExecDriver_SignalProcessGroup(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "signal",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":              "/bin/bash",
+			"args":                 []string{"test.sh"},
+			"signal_process_group": true,
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources:   basicResources,
+		KillTimeout: 10 * time.Second,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	testFile := filepath.Join(ctx.ExecCtx.TaskDir.Dir, "test.sh")
+	testData := []byte(`
+trap 'echo parent reloaded' HUP
+/bin/bash -c "trap 'echo child reloaded' HUP; echo child ready; while true; do sleep 0.1; done" &
+echo parent ready
+while true; do
+    sleep 0.1
+done
+	`)
+	if err := ioutil.WriteFile(testFile, testData, 0777); err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	outputFile := filepath.Join(ctx.ExecCtx.TaskDir.LogDir, "signal.stdout.0")
+	waitForOutput := func(lines ...string) {
+		testutil.WaitForResult(func() (bool, error) {
+			act, err := ioutil.ReadFile(outputFile)
+			if err != nil {
+				return false, err
+			}
+			for _, line := range lines {
+				if !strings.Contains(string(act), line) {
+					return false, fmt.Errorf("expected %q in output %q", line, act)
+				}
+			}
+			return true, nil
+		}, func(err error) {
+			t.Fatalf("err: %v", err)
+		})
+	}
+
+	// Both the task and the child it forked reload
+	waitForOutput("parent ready", "child ready")
+	if err := resp.Handle.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitForOutput("parent reloaded", "child reloaded")
+
+	// The kill signal is sent to the whole group too
+	if err := resp.Handle.Kill(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-resp.Handle.WaitCh():
+	case <-time.After(time.Duration(testutil.TestMultiplier()*6) * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestExecDriver_Signal_WaitResult(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"100"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources:   basicResources,
+		KillTimeout: 10 * time.Second,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+
+	// The default action of SIGUSR1 terminates the process without a core
+	if err := resp.Handle.Signal(syscall.SIGUSR1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if res.Successful() {
+			t.Fatal("should err")
+		}
+		if res.Signal != int(syscall.SIGUSR1) {
+			t.Fatalf("expected signal %d; got %d", syscall.SIGUSR1, res.Signal)
+		}
+		if res.CoreDumped {
+			t.Fatalf("expected no core dump")
+		}
+		if res.UserTime < 0 || res.SystemTime < 0 {
+			t.Fatalf("expected CPU times; got user %v and system %v", res.UserTime, res.SystemTime)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*6) * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestExecDriver_Start_Wait_FinalOutput(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "verdict",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/bash",
+			"args":    []string{"-c", "for i in $(seq 1 500); do echo \"line $i\"; done; echo PASS"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*6) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The output is complete as soon as the exit is reported, rather than
+	// once the log files are periodically flushed
+	outputFile := filepath.Join(ctx.ExecCtx.TaskDir.LogDir, "verdict.stdout.0")
+	act, err := ioutil.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Couldn't read expected output: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(act)), "\n")
+	if len(lines) != 501 || lines[0] != "line 1" || lines[500] != "PASS" {
+		t.Fatalf("expected 500 lines and the verdict, got %d lines ending in %q", len(lines), lines[len(lines)-1])
+	}
+}
+
+func TestExecDriver_Ulimit(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "limits",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/bash",
+			"args":    []string{"-c", "ulimit -Sn; ulimit -Hn; ulimit -c"},
+			"ulimit": []map[string]string{
+				{"nofile": "4096:8192"},
+				{"core": "0"},
+			},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	outputFile := filepath.Join(ctx.ExecCtx.TaskDir.LogDir, "limits.stdout.0")
+	act, err := ioutil.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Couldn't read expected output: %v", err)
+	}
+	if exp := "4096\n8192\n0\n"; string(act) != exp {
+		t.Fatalf("Command outputted %q; want %q", act, exp)
+	}
+}
+
+func TestExecDriver_UlimitMax(t *testing.T) {
+	t.Parallel()
+	ctestutils.ExecCompatible(t)
+
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if limit.Max == math.MaxUint64 {
+		t.Skip("the client's nofile hard limit is unlimited")
+	}
+	conf := &config.Config{Options: map[string]string{}}
+
+	// Hard limits up to the client's own are allowed
+	within := []map[string]string{{"nofile": fmt.Sprintf("1024:%d", limit.Max)}}
+	if err := checkUlimitsAllowed(conf, within); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// But raising them requires the operator to allow it
+	above := []map[string]string{{"nofile": fmt.Sprintf("1024:%d", limit.Max+1)}}
+	if err := checkUlimitsAllowed(conf, above); err == nil {
+		t.Fatalf("expected an error raising the hard limit")
+	}
+	conf.Options[execUlimitMaxConfigPrefix+"nofile"] = "unlimited"
+	if err := checkUlimitsAllowed(conf, above); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Which can also lower the maximum
+	conf.Options[execUlimitMaxConfigPrefix+"nofile"] = "512"
+	if err := checkUlimitsAllowed(conf, within); err == nil {
+		t.Fatalf("expected an error exceeding the configured maximum")
+	}
+}
+
+func TestExecDriver_Nice(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "nice",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			// The nice value is the 19th field of the stat of cut itself
+			"command": "/bin/bash",
+			"args":    []string{"-c", "cut -d' ' -f19 /proc/self/stat"},
+			"nice":    10,
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	outputFile := filepath.Join(ctx.ExecCtx.TaskDir.LogDir, "nice.stdout.0")
+	act, err := ioutil.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Couldn't read expected output: %v", err)
+	}
+	if exp := "10\n"; string(act) != exp {
+		t.Fatalf("Command outputted %q; want %q", act, exp)
+	}
+
+	// Out of range values are rejected before starting
+	task.Config["nice"] = 20
+	if _, err := d.Prestart(ctx.ExecCtx, task); err == nil || !strings.Contains(err.Error(), "must be between") {
+		t.Fatalf("expected out of range error; got %v", err)
+	}
+
+	// Values below the client's minimum are rejected
+	task.Config["nice"] = -5
+	if _, err := d.Prestart(ctx.ExecCtx, task); err == nil || !strings.Contains(err.Error(), "below the client's minimum") {
+		t.Fatalf("expected minimum error; got %v", err)
+	}
+	ctx.DriverCtx.config.Options = map[string]string{
+		execMinNiceConfigOption: "-10",
+	}
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("expected nice above the client's minimum to be allowed; got %v", err)
+	}
+}
+
+func TestExecDriver_IgnoreSignals(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "signals",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			// yes fails writing rather than being killed once head exits
+			"command":        "/bin/bash",
+			"args":           []string{"-c", "yes | head -n1; echo ${PIPESTATUS[0]}"},
+			"ignore_signals": []string{"SIGPIPE"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	outputFile := filepath.Join(ctx.ExecCtx.TaskDir.LogDir, "signals.stdout.0")
+	act, err := ioutil.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Couldn't read expected output: %v", err)
+	}
+	if exp := "y\n1\n"; string(act) != exp {
+		t.Fatalf("Command outputted %q; want %q", act, exp)
+	}
+}
+
+func TestExecDriver_CapAdd(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "caps",
+		Driver: "exec",
+		User:   "nobody",
+		Config: map[string]interface{}{
+			"command": "/bin/bash",
+			"args":    []string{"-c", "grep '^CapEff:' /proc/self/status"},
+			"cap_add": []string{"net_bind_service"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+
+	// Capabilities the client doesn't allow fail the start
+	if _, err := d.Start(ctx.ExecCtx, task); err == nil || !strings.Contains(err.Error(), "doesn't allow") {
+		t.Fatalf("expected the capability to be denied, got: %v", err)
+	}
+
+	ctx.DriverCtx.config.Options = map[string]string{execAllowCapsConfigOption: "CAP_NET_BIND_SERVICE"}
+	d = NewExecDriver(ctx.DriverCtx)
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	outputFile := filepath.Join(ctx.ExecCtx.TaskDir.LogDir, "caps.stdout.0")
+	act, err := ioutil.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Couldn't read expected output: %v", err)
+	}
+	if fields := strings.Fields(string(act)); len(fields) != 2 || fields[1] != "0000000000000400" {
+		t.Fatalf("expected only CAP_NET_BIND_SERVICE to be effective, got %q", act)
+	}
+}
+
+func TestExecDriver_NetworkMode_Bridge(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "net",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":      "/bin/bash",
+			"args":         []string{"-c", "cat /proc/net/dev"},
+			"network_mode": "bridge",
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	if !networkIsolationSupported() {
+		t.Skip("network isolation not supported")
+	}
+	ctx.DriverCtx.config.Options = map[string]string{
+		execBridgeConfigOption:       "nomadtest1",
+		execBridgeSubnetConfigOption: "10.251.0.0/24",
+	}
+	defer exec.Command("ip", "link", "del", "nomadtest1").Run()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+
+	var id struct {
+		BridgeAddr      string
+		IsolationConfig struct {
+			NetworkNamespace string
+		}
+	}
+	if err := json.Unmarshal([]byte(resp.Handle.ID()), &id); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if id.BridgeAddr != "10.251.0.2" {
+		t.Fatalf("got bridge address %q; want 10.251.0.2", id.BridgeAddr)
+	}
+
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The task only sees its end of the veth pair and loopback
+	outputFile := filepath.Join(ctx.ExecCtx.TaskDir.LogDir, "net.stdout.0")
+	act, err := ioutil.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Couldn't read expected output: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(act)), "\n")
+	if len(lines) != 4 || !strings.Contains(string(act), "eth0:") || !strings.Contains(string(act), "lo:") {
+		t.Fatalf("unexpected interfaces of the task: %s", act)
+	}
+
+	// The namespace is removed and the address released once the task exits
+	netns := id.IsolationConfig.NetworkNamespace
+	if netns == "" {
+		t.Fatalf("expected a network namespace")
+	}
+	if _, err := os.Stat(filepath.Join("/var/run/netns", netns)); !os.IsNotExist(err) {
+		t.Fatalf("expected network namespace %q to be removed: %v", netns, err)
+	}
+	globalBridgeAddrs.lock.Lock()
+	_, ok := globalBridgeAddrs.owners[id.BridgeAddr]
+	globalBridgeAddrs.lock.Unlock()
+	if ok {
+		t.Fatalf("expected bridge address %s to be released", id.BridgeAddr)
+	}
+}
+
+func TestExecDriver_DumpStack(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "dump",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":           "/bin/bash",
+			"args":              []string{"test.sh"},
+			"stack_dump_signal": "SIGUSR2",
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources:   basicResources,
+		KillTimeout: 10 * time.Second,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	testFile := filepath.Join(ctx.ExecCtx.TaskDir.Dir, "test.sh")
+	testData := []byte(`
+trap "echo 'Dumped.'" USR2
+echo 'Started.'
+while true; do
+    sleep 1
+done
+	`)
+	if err := ioutil.WriteFile(testFile, testData, 0777); err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+
+	outputFile := filepath.Join(ctx.ExecCtx.TaskDir.LogDir, "dump.stdout.0")
+	testutil.WaitForResult(func() (bool, error) {
+		act, err := ioutil.ReadFile(outputFile)
+		if err != nil {
+			return false, err
+		}
+		return strings.Contains(string(act), "Started."), fmt.Errorf("task not started: %q", act)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	dumper, ok := resp.Handle.(StackDumper)
+	if !ok {
+		t.Fatalf("handle %T doesn't implement StackDumper", resp.Handle)
+	}
+	if err := dumper.DumpStack(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The task handles the signal so it must still be running
+	testutil.WaitForResult(func() (bool, error) {
+		act, err := ioutil.ReadFile(outputFile)
+		if err != nil {
+			return false, err
+		}
+		return strings.Contains(string(act), "Dumped."), fmt.Errorf("stack not dumped: %q", act)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	select {
+	case res := <-resp.Handle.WaitCh():
+		t.Fatalf("task exited after dumping its stack: %v", res)
+	default:
+	}
+}
+
+func TestExecDriver_Start_Wait_Background(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "daemonize",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/bash",
+			"args":    []string{"-c", "sleep 1000 & echo $! > local/bg.pid"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The task exits with its command even though it started a background
+	// process
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*10) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The background process is killed along with the task
+	data, err := ioutil.ReadFile(filepath.Join(ctx.ExecCtx.TaskDir.LocalDir, "bg.pid"))
+	if err != nil {
+		t.Fatalf("Couldn't read background pid: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatalf("invalid background pid %q: %v", data, err)
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		if err := syscall.Kill(pid, 0); err == nil {
+			return false, fmt.Errorf("background process %d still running", pid)
+		}
+		return true, nil
+	}, func(err error) {
+		syscall.Kill(pid, syscall.SIGKILL)
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func TestExecDriver_Prestart_ScratchDir(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":       "/bin/sleep",
+			"args":          []string{"1"},
+			"scratch_dir":   "scratch",
+			"scratch_group": "1234",
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	// Prestart is idempotent and fixes up the directory's mode and owner
+	scratch := filepath.Join(ctx.ExecCtx.TaskDir.SharedAllocDir, "scratch")
+	for i := 0; i < 2; i++ {
+		if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+			t.Fatalf("prestart err: %v", err)
+		}
+
+		fi, err := os.Stat(scratch)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if fi.Mode()&os.ModeSetgid == 0 || fi.Mode().Perm() != 0770 {
+			t.Fatalf("unexpected mode %v", fi.Mode())
+		}
+		if gid := fi.Sys().(*syscall.Stat_t).Gid; gid != 1234 {
+			t.Fatalf("expected group 1234; got %d", gid)
+		}
+		if uid := fi.Sys().(*syscall.Stat_t).Uid; int(uid) != os.Getuid() {
+			t.Fatalf("expected owner %d; got %d", os.Getuid(), uid)
+		}
+		os.Chmod(scratch, 0700)
+		os.Chown(scratch, 65534, -1)
+	}
+
+	// Symlinks aren't followed
+	os.RemoveAll(scratch)
+	if err := os.Symlink("/etc", scratch); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := d.Prestart(ctx.ExecCtx, task); err == nil || !strings.Contains(err.Error(), "failed to open scratch_dir") {
+		t.Fatalf("expected error for symlink; got %v", err)
+	}
+
+	// The group must resolve
+	os.Remove(scratch)
+	task.Config["scratch_group"] = "nomad-no-such-group"
+	if _, err := d.Prestart(ctx.ExecCtx, task); err == nil || !strings.Contains(err.Error(), "scratch_group") {
+		t.Fatalf("expected error for unknown group; got %v", err)
+	}
+}
+
+func TestExecDriver_HealthCheck(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"100"},
+			"health_check": []interface{}{
+				map[string]interface{}{
+					"command":   "/bin/sh",
+					"args":      []interface{}{"-c", "test -e ${NOMAD_ALLOC_DIR}/healthy"},
+					"interval":  "1s",
+					"threshold": 1,
+				},
+			},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+	handle := resp.Handle.(HealthChecker)
+
+	waitForEvent := func(typ string) {
+		timeout := time.After(time.Duration(testutil.TestMultiplier()*10) * time.Second)
+		for {
+			select {
+			case event := <-resp.Handle.(EventStreamer).Events():
+				if event.Type == typ {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("timeout waiting for %s event", typ)
+			}
+		}
+	}
+
+	// The check fails until the task is ready
+	waitForEvent(DriverEventUnhealthy)
+	if h := handle.Health(); h != HealthUnhealthy {
+		t.Fatalf("got health %v; want %v", h, HealthUnhealthy)
+	}
+	if err := ioutil.WriteFile(filepath.Join(ctx.AllocDir.SharedDir, "healthy"), nil, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitForEvent(DriverEventHealthy)
+	if h := handle.Health(); h != HealthHealthy {
+		t.Fatalf("got health %v; want %v", h, HealthHealthy)
+	}
+
+	// A reattached handle keeps checking the task
+	handle2, err := d.Open(ctx.ExecCtx, resp.Handle.ID())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	checker := handle2.(*execHandle).healthChecker
+	if checker == nil || !reflect.DeepEqual(checker.check, resp.Handle.(*execHandle).healthChecker.check) {
+		t.Fatalf("expected the reattached handle to check the task")
+	}
+}
+
+func TestExecDriver_Events(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"100"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources:   basicResources,
+		KillTimeout: 10 * time.Second,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A reattached handle replays the current state first
+	handle2, err := d.Open(ctx.ExecCtx, resp.Handle.ID())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle2.Kill()
+	event := <-handle2.(EventStreamer).Events()
+	if event.Type != DriverEventStarted || !strings.Contains(event.Reason, "Reattached") {
+		t.Fatalf("unexpected first event of reattached handle: %+v", event)
+	}
+
+	if err := resp.Handle.Signal(syscall.SIGWINCH); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := resp.Handle.Kill(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-resp.Handle.WaitCh():
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	var types []string
+	for event := range resp.Handle.(EventStreamer).Events() {
+		if event.Time.IsZero() {
+			t.Fatalf("event without time: %+v", event)
+		}
+		types = append(types, event.Type)
+	}
+	expected := []string{
+		DriverEventStarting,
+		DriverEventStarted,
+		DriverEventSignaled,
+		DriverEventKilled,
+		DriverEventExited,
+	}
+	if !reflect.DeepEqual(types, expected) {
+		t.Fatalf("got events %v; want %v", types, expected)
+	}
+}
+
+func TestExecDriver_HandlerExecStreaming(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"9000"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+
+	streamer, ok := resp.Handle.(StreamingExecutor)
+	if !ok {
+		t.Fatalf("handle %T doesn't implement StreamingExecutor", resp.Handle)
+	}
+
+	// Stdin is streamed to the command in the chroot and its stdout and
+	// stderr are returned separately
+	var stdout, stderr bytes.Buffer
+	code, err := streamer.ExecStreaming(context.Background(), "/bin/sh",
+		[]string{"-c", "read line; echo \"got $line in $NOMAD_SECRETS_DIR\"; echo oops >&2; exit 3"}, false,
+		strings.NewReader("hello\n"), &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if code != 3 {
+		t.Fatalf("expected exit code 3, got %d", code)
+	}
+	if stdout.String() != "got hello in /secrets\n" {
+		t.Fatalf("unexpected stdout: %q", stdout.String())
+	}
+	if stderr.String() != "oops\n" {
+		t.Fatalf("unexpected stderr: %q", stderr.String())
+	}
+
+	// The command gets EOF once the reader is done
+	stdout.Reset()
+	code, err = streamer.ExecStreaming(context.Background(), "/bin/cat", nil, false,
+		strings.NewReader("partial"), &stdout, ioutil.Discard)
+	if err != nil || code != 0 {
+		t.Fatalf("expected cat to exit on EOF: code %d, err %v", code, err)
+	}
+	if stdout.String() != "partial" {
+		t.Fatalf("unexpected stdout: %q", stdout.String())
+	}
+
+	// With a TTY, the output of line-buffered programs is streamed
+	stdout.Reset()
+	code, err = streamer.ExecStreaming(context.Background(), "/bin/sh",
+		[]string{"-c", "test -t 0 && echo tty; cat"}, true,
+		strings.NewReader("hello\n"), &stdout, ioutil.Discard)
+	if err != nil || code != 0 {
+		t.Fatalf("expected a TTY exec to succeed: code %d, err %v: %q", code, err, stdout.String())
+	}
+	out := strings.Replace(stdout.String(), "\r\n", "\n", -1)
+	if !strings.Contains(out, "tty\n") || !strings.Contains(out, "hello\n") {
+		t.Fatalf("unexpected output: %q", stdout.String())
+	}
+}
+
+func TestExecDriver_HandlerExec_Cancel(t *testing.T) {
+	if !testutil.IsTravis() {
+		t.Parallel()
+	}
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"9000"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+
+	// Cancel the exec of a sleep with a child of its own
+	execCtx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, _, err = resp.Handle.Exec(execCtx, "/bin/sh", []string{"-c", "/bin/sleep 60 & exec /bin/sleep 60"})
+	if err != context.Canceled {
+		t.Fatalf("expected the exec to be canceled, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the exec to return promptly, took %v", elapsed)
+	}
+
+	// Neither the command nor its child linger
+	testutil.WaitForResult(func() (bool, error) {
+		if pids := execSleepPids(ctx.DriverCtx.allocID); len(pids) != 0 {
+			return false, fmt.Errorf("exec'd processes still running: %v", pids)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+// execSleepPids returns the pids of the `/bin/sleep 60` processes exec'd into
+// the alloc.
+func execSleepPids(allocID string) []int {
+	procs, _ := filepath.Glob("/proc/[0-9]*")
+	var pids []int
+	for _, proc := range procs {
+		cmdline, err := ioutil.ReadFile(filepath.Join(proc, "cmdline"))
+		if err != nil || string(cmdline) != "/bin/sleep\x0060\x00" {
+			continue
+		}
+		environ, err := ioutil.ReadFile(filepath.Join(proc, "environ"))
+		if err != nil || !bytes.Contains(environ, []byte("NOMAD_ALLOC_ID="+allocID+"\x00")) {
+			continue
+		}
+		pid, _ := strconv.Atoi(filepath.Base(proc))
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+func TestExecDriver_Userns(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+	if _, err := os.Stat("/proc/self/ns/user"); err != nil {
+		t.Skip("user namespaces are not supported")
+	}
+
+	// Give root subordinate ids of its own
+	dir, err := ioutil.TempDir("", "userns")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	origUIDFile, origGIDFile := subUIDFile, subGIDFile
+	defer func() {
+		subUIDFile, subGIDFile = origUIDFile, origGIDFile
+	}()
+	subUIDFile, subGIDFile = filepath.Join(dir, "subuid"), filepath.Join(dir, "subgid")
+	ioutil.WriteFile(subUIDFile, []byte("root:400000:65536\n"), 0644)
+	ioutil.WriteFile(subGIDFile, []byte("root:500000:65536\n"), 0644)
+
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/bash",
+			"args":    []string{"-c", "echo $EUID; touch /local/created /alloc/data/created; while read k v; do if [ $k = CapBnd: ]; then echo $v; fi; done < /proc/self/status"},
+			"userns":  []interface{}{map[string]interface{}{}},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	// The client must allow user namespaces and the node must advertise the
+	// support
+	if _, err := d.Prestart(ctx.ExecCtx, task); err == nil || !strings.Contains(err.Error(), "not allowed by the client") {
+		t.Fatalf("expected userns to be disallowed; got %v", err)
+	}
+	ctx.DriverCtx.config.Options = map[string]string{execUsernsConfigOption: "true"}
+	if _, err := d.Prestart(ctx.ExecCtx, task); err == nil || !strings.Contains(err.Error(), "userns requires") {
+		t.Fatalf("expected userns support error; got %v", err)
+	}
+	ctx.DriverCtx.node.Attributes[execDriverUsernsAttr] = "1"
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The task ran as root of its namespace and owns the files it creates
+	// as the first subordinate ids on the host
+	output, err := ioutil.ReadFile(filepath.Join(ctx.ExecCtx.TaskDir.LogDir, "sleep.stdout.0"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) != 2 || lines[0] != "0" {
+		t.Fatalf("expected to run as root of the namespace; got output %q", output)
+	}
+
+	// Root of the namespace can't chroot again to escape the task's chroot
+	bounding, err := strconv.ParseUint(lines[1], 16, 64)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if bounding&(1<<uint(capabilityBits([]string{"CAP_SYS_CHROOT"})[0])) != 0 {
+		t.Fatalf("expected CAP_SYS_CHROOT to be dropped from the bounding set %x", bounding)
+	}
+
+	for _, path := range []string{
+		ctx.ExecCtx.TaskDir.LocalDir,
+		filepath.Join(ctx.ExecCtx.TaskDir.LocalDir, "created"),
+		filepath.Join(ctx.ExecCtx.TaskDir.SharedAllocDir, allocdir.SharedDataDir, "created"),
+	} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if st := fi.Sys().(*syscall.Stat_t); st.Uid != 400000 || st.Gid != 500000 {
+			t.Fatalf("%s is owned by %d:%d; want 400000:500000", path, st.Uid, st.Gid)
+		}
+	}
+
+	// The ids are released once the task exits
+	id := fmt.Sprintf("%s/%s", ctx.DriverCtx.allocID, task.Name)
+	if _, err := globalSubUIDs.Acquire(id+"-other", []idRange{{Start: 400000, Size: 65536}}, 65536); err != nil {
+		t.Fatalf("expected the ids to be released: %v", err)
+	}
+	globalSubUIDs.Release(id + "-other")
+}
+
+func TestExecDriver_NoChroot(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+	t.Parallel()
+
+	// A file on the host outside of the task dir
+	dir, err := ioutil.TempDir("", "nochroot")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	marker := filepath.Join(dir, "marker")
+	if err := ioutil.WriteFile(marker, []byte("host"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	task := &structs.Task{
+		Name:   "cat",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":   "/bin/cat",
+			"args":      []string{marker},
+			"no_chroot": true,
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	// The client must allow it
+	if _, err := d.Start(ctx.ExecCtx, task); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("expected no_chroot to be rejected; got %v", err)
+	}
+	ctx.DriverCtx.config.Options = map[string]string{execNoChrootConfigOption: "true"}
+
+	// The chroot isn't built
+	if _, err := os.Stat(filepath.Join(ctx.ExecCtx.TaskDir.Dir, "bin")); !os.IsNotExist(err) {
+		t.Fatalf("expected no chroot in the task dir; got %v", err)
+	}
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	output, err := ioutil.ReadFile(filepath.Join(ctx.ExecCtx.TaskDir.LogDir, "cat.stdout.0"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if act := string(output); act != "host" {
+		t.Fatalf("expected the task to read the host's file; got %q", act)
+	}
+}
+
+func TestExecDriver_CoreDump(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+	t.Parallel()
+	pattern, err := readCorePattern()
+	if err != nil {
+		t.Skipf("err: %v", err)
+	}
+	if _, err := corePatternDir(pattern, true); err != nil {
+		t.Skipf("core dumps can't be kept: %v", err)
+	}
+
+	task := &structs.Task{
+		Name:   "crash",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":   "/bin/bash",
+			"args":      []string{"-c", "kill -SEGV $$"},
+			"core_dump": true,
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-resp.Handle.WaitCh():
+		if res.Signal != int(syscall.SIGSEGV) {
+			t.Fatalf("expected SIGSEGV; got %v", res)
+		}
+		if !res.CoreDumped {
+			t.Fatalf("expected a core dump")
+		}
+		if len(res.CoreFiles) != 1 {
+			t.Fatalf("expected one kept core dump; got %v", res.CoreFiles)
+		}
+		if _, err := os.Stat(filepath.Join(ctx.AllocDir.AllocDir, res.CoreFiles[0])); err != nil {
+			t.Fatalf("core dump wasn't kept: %v", err)
+		}
+	case <-time.After(time.Duration(testutil.TestMultiplier()*5) * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestExecDriver_StartThrottle(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+	t.Parallel()
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sleep",
+			"args":    []string{"100"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	ctx.DriverCtx.config.Options = map[string]string{execMinStartIntervalConfigOption: "1m"}
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+
+	// Only the first start in a tight loop succeeds
+	for i := 0; i < 3; i++ {
+		resp, err := d.Start(ctx.ExecCtx, task)
+		if i == 0 {
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if err := resp.Handle.Kill(); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			<-resp.Handle.WaitCh()
+			continue
+		}
+
+		if err == nil {
+			resp.Handle.Kill()
+			t.Fatalf("start %d: expected the start to be throttled", i)
+		}
+		wait, ok := dstructs.StartTooSoonWait(err)
+		if !ok || wait <= 0 || wait > time.Minute {
+			t.Fatalf("start %d: expected a too soon error; got %v", i, err)
+		}
+		if category := dstructs.StartFailureCategory(err); category != dstructs.StartFailureThrottled {
+			t.Fatalf("start %d: expected category %q; got %q", i, dstructs.StartFailureThrottled, category)
+		}
+		if !structs.IsRecoverable(err) {
+			t.Fatalf("start %d: expected a recoverable error", i)
+		}
+	}
+}
+
+func TestExecDriver_ReapOrphans(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+	t.Parallel()
+	task := &structs.Task{
+		Name:   "daemon",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sh",
+			"args": []string{"-c",
+				"setsid /bin/sh -c '/bin/sleep 1000 & echo $! > /local/orphan.pid' && exec /bin/sleep 1000"},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	ctx.DriverCtx.config.Options = map[string]string{"executor.reap_orphans": "true"}
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The double-forked child is adopted by the executor
+	var pid int
+	testutil.WaitForResult(func() (bool, error) {
+		data, err := ioutil.ReadFile(filepath.Join(ctx.ExecCtx.TaskDir.LocalDir, "orphan.pid"))
+		if err != nil {
+			return false, err
+		}
+		pid, err = strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return false, err
+		}
+		stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			return false, err
+		}
+		ppid := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))[1]
+		if exp := strconv.Itoa(resp.Handle.(*execHandle).pluginClient.ReattachConfig().Pid); ppid != exp {
+			return false, fmt.Errorf("expected orphan to be adopted by the executor %s; got parent %s", exp, ppid)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// Killing the task kills the orphan before Kill returns
+	if err := resp.Handle.Kill(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid)); err == nil {
+		if state := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))[0]; state != "Z" {
+			t.Fatalf("orphan %d is still running in state %s", pid, state)
+		}
+	} else if !os.IsNotExist(err) {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-resp.Handle.WaitCh():
+	case <-time.After(time.Duration(testutil.TestMultiplier()*10) * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestExecDriver_OOMDisable(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+	t.Parallel()
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command":     "/bin/sleep",
+			"args":        []string{"1000"},
+			"oom_disable": true,
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+	ctx.DriverCtx.node.Attributes["unique.cgroup.mountpoint"] = "/sys/fs/cgroup"
+	if !oomDisableSupported(ctx.DriverCtx.node) {
+		t.Skip("the memory cgroup's OOM killer can't be disabled")
+	}
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+
+	// Only the jobs the client allows may disable it
+	ctx.DriverCtx.config.Options = map[string]string{execOOMDisableJobsConfigOption: "coordinator"}
+	if _, err := d.Start(ctx.ExecCtx, task); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("expected oom_disable to be rejected; got %v", err)
+	}
+	job := ctx.ExecCtx.TaskEnv.EnvMap["NOMAD_JOB_NAME"]
+	ctx.DriverCtx.config.Options = map[string]string{execOOMDisableJobsConfigOption: "coordinator," + job}
+
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+
+	path := resp.Handle.(CgroupReader).CgroupPath()
+	control, err := ioutil.ReadFile(filepath.Join(path, "memory.oom_control"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.Contains(string(control), "oom_kill_disable 1") {
+		t.Fatalf("expected the OOM killer to be disabled; got %q", control)
+	}
+}
+
+func TestExecDriver_Devices(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+	t.Parallel()
+	task := &structs.Task{
+		Name:   "sleep",
+		Driver: "exec",
+		Config: map[string]interface{}{
+			"command": "/bin/sh",
+			"args":    []string{"-c", "echo ok > /dev/null && exec /bin/sleep 1000"},
+			"devices": []interface{}{
+				map[string]interface{}{"path": "/dev/null", "permissions": "rw"},
+			},
+		},
+		LogConfig: &structs.LogConfig{
+			MaxFiles:      10,
+			MaxFileSizeMB: 10,
+		},
+		Resources: basicResources,
+	}
+
+	ctx := testDriverContexts(t, task)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(ctx.DriverCtx)
+
+	if _, err := d.Prestart(ctx.ExecCtx, task); err != nil {
+		t.Fatalf("prestart err: %v", err)
+	}
+	resp, err := d.Start(ctx.ExecCtx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Handle.Kill()
+
+	cgroups, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", resp.Handle.(*execHandle).userPid))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var path string
+	for _, line := range strings.Split(string(cgroups), "\n") {
+		if parts := strings.SplitN(line, ":", 3); len(parts) == 3 && parts[1] == "devices" {
+			path = filepath.Join("/sys/fs/cgroup/devices", parts[2])
+		}
+	}
+	if path == "" {
+		t.Skip("the devices cgroup isn't mounted")
+	}
+
+	// The task is confined to its devices and the default devices
+	list, err := ioutil.ReadFile(filepath.Join(path, "devices.list"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if strings.Contains(string(list), "a *:* rwm") {
+		t.Fatalf("expected the task to be confined to its devices; got %q", list)
+	}
+	if !strings.Contains(string(list), "c 1:3 rw") {
+		t.Fatalf("expected /dev/null to be allowed; got %q", list)
+	}
+
+	// The task could use its device
+	select {
+	case res := <-resp.Handle.WaitCh():
+		t.Fatalf("expected the task to keep running; got %v", res)
+	case <-time.After(time.Second):
+	}
+}
+
+func TestExecDriver_hostCommandPath(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "nomadtest-hostcommand")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	taskDir := allocdir.NewAllocDir(testLogger(), dir).NewTaskDir("web")
+	if err := os.MkdirAll(taskDir.LocalDir, 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(taskDir.LocalDir, "app"), nil, 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found in the PATH")
+	}
+
+	cases := []struct {
+		command string
+		path    string
+		host    bool
+	}{
+		{"app", "", false},
+		{"/bin/sh", "/bin/sh", true},
+		{"sh", sh, true},
+		{"nomad-no-such-command", "", false},
+	}
+	for _, c := range cases {
+		path, host := hostCommandPath(taskDir, c.command)
+		if path != c.path || host != c.host {
+			t.Fatalf("command %q: got %q, %v; want %q, %v", c.command, path, host, c.path, c.host)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/client/lib/cgutil"
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+	cgroupConfig "github.com/opencontainers/runc/libcontainer/configs"
+)
+
+const (
+	// unifiedCgroupKey is the key of the command's cgroup in the cgroup paths
+	// if it's in the cgroup v2 unified hierarchy, where all controllers share
+	// a single cgroup.
+	unifiedCgroupKey = "unified"
+
+	// unifiedFreezeTimeout is how long freezing a cgroup is waited for.
+	unifiedFreezeTimeout = time.Second
+)
+
+var (
+	// unifiedControllers are the controllers enabled for the cgroups of
+	// commands, if the host provides them.
+	unifiedControllers = []string{"cpu", "cpuset", "io", "memory", "pids"}
+
+	unifiedMountOnce sync.Once
+	unifiedMount     string
+)
+
+// unifiedCgroupMountpoint returns the mount point of the cgroup v2 unified
+// hierarchy if the host only mounts it. Hosts that mount cgroup v1
+// hierarchies too, in hybrid mode, keep using the v1 hierarchies.
+func unifiedCgroupMountpoint() (string, bool) {
+	unifiedMountOnce.Do(func() {
+		unifiedMount, _ = cgutil.FindUnifiedMountpoint()
+	})
+	return unifiedMount, unifiedMount != ""
+}
+
+// unifiedManager is a libcontainer cgroup manager of a cgroup in the cgroup v2
+// unified hierarchy, which the vendored libcontainer doesn't support. The
+// cgroup v1 resources of the configuration are converted to their v2
+// equivalents.
+type unifiedManager struct {
+	Cgroups *cgroupConfig.Cgroup
+	Paths   map[string]string
+
+	// mountpoint is the mount point of the unified hierarchy the cgroup is
+	// created in if Paths is empty
+	mountpoint string
+}
+
+// path returns the directory of the cgroup.
+func (m *unifiedManager) path() string {
+	if p, ok := m.Paths[unifiedCgroupKey]; ok {
+		return p
+	}
+	return filepath.Join(m.mountpoint, m.Cgroups.Path)
+}
+
+// Apply creates the cgroup, enabling the controllers of commands for it, and
+// moves the process into it.
+func (m *unifiedManager) Apply(pid int) error {
+	path := m.path()
+	if path != m.mountpoint {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+
+		// Controllers are enabled for a cgroup by each of its ancestors
+		rel, err := filepath.Rel(m.mountpoint, path)
+		if err != nil {
+			return err
+		}
+		parent := m.mountpoint
+		for _, dir := range strings.Split(rel, string(filepath.Separator)) {
+			if err := enableUnifiedControllers(parent); err != nil {
+				return err
+			}
+			parent = filepath.Join(parent, dir)
+		}
+	}
+
+	if err := writeCgroupFile(path, "cgroup.procs", strconv.Itoa(pid)); err != nil {
+		return err
+	}
+	m.Paths = map[string]string{unifiedCgroupKey: path}
+	return nil
+}
+
+// enableUnifiedControllers enables the controllers of commands that the host
+// provides for the children of the cgroup.
+func enableUnifiedControllers(dir string) error {
+	available, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	provided := make(map[string]struct{})
+	for _, c := range strings.Fields(string(available)) {
+		provided[c] = struct{}{}
+	}
+
+	var enable []string
+	for _, c := range unifiedControllers {
+		if _, ok := provided[c]; ok {
+			enable = append(enable, "+"+c)
+		}
+	}
+	if len(enable) == 0 {
+		return nil
+	}
+	return writeCgroupFile(dir, "cgroup.subtree_control", strings.Join(enable, " "))
+}
+
+// Set writes the resources of the configuration to the cgroup.
+func (m *unifiedManager) Set(container *cgroupConfig.Config) error {
+	path := m.path()
+	r := container.Cgroups.Resources
+	if r == nil {
+		return nil
+	}
+
+	if r.CpuShares != 0 {
+		if err := writeCgroupFile(path, "cpu.weight", strconv.FormatUint(cpuSharesToWeight(r.CpuShares), 10)); err != nil {
+			return err
+		}
+	}
+	if r.CpuQuota > 0 {
+		period := r.CpuPeriod
+		if period == 0 {
+			period = 100000
+		}
+		if err := writeCgroupFile(path, "cpu.max", fmt.Sprintf("%d %d", r.CpuQuota, period)); err != nil {
+			return err
+		}
+	}
+	if r.CpusetCpus != "" {
+		if err := writeCgroupFile(path, "cpuset.cpus", r.CpusetCpus); err != nil {
+			return err
+		}
+	}
+
+	if r.Memory > 0 {
+		if err := writeCgroupFile(path, "memory.max", strconv.FormatInt(r.Memory, 10)); err != nil {
+			return err
+		}
+	}
+
+	// Unlike the v1 limit of memory and swap together, swap is limited on its
+	// own. Without swap accounting there's no limit to write.
+	switch {
+	case r.MemorySwap > 0:
+		swap := r.MemorySwap - r.Memory
+		if swap < 0 {
+			swap = 0
+		}
+		if err := writeCgroupFile(path, "memory.swap.max", strconv.FormatInt(swap, 10)); err != nil {
+			return fmt.Errorf("failed to limit swap, which requires swap accounting: %v", err)
+		}
+	case r.MemorySwap < 0:
+		if _, err := os.Stat(filepath.Join(path, "memory.swap.max")); err == nil {
+			if err := writeCgroupFile(path, "memory.swap.max", "max"); err != nil {
+				return err
+			}
+		}
+	}
+
+	if r.BlkioWeight != 0 {
+		// The BFQ scheduler takes v1 weights, others v2 weights
+		if _, err := os.Stat(filepath.Join(path, "io.bfq.weight")); err == nil {
+			if err := writeCgroupFile(path, "io.bfq.weight", strconv.Itoa(int(r.BlkioWeight))); err != nil {
+				return err
+			}
+		} else if err := writeCgroupFile(path, "io.weight", fmt.Sprintf("default %d", blkioWeightToWeight(r.BlkioWeight))); err != nil {
+			return err
+		}
+	}
+	for _, limit := range unifiedIOMax(r.BlkioThrottleReadBpsDevice, r.BlkioThrottleWriteBpsDevice) {
+		if err := writeCgroupFile(path, "io.max", limit); err != nil {
+			return err
+		}
+	}
+
+	if r.PidsLimit > 0 {
+		if err := writeCgroupFile(path, "pids.max", strconv.FormatInt(r.PidsLimit, 10)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cpuSharesToWeight converts cgroup v1 CPU shares, from 2 to 262144, to a
+// cgroup v2 CPU weight, from 1 to 10000.
+func cpuSharesToWeight(shares int64) uint64 {
+	if shares < 2 {
+		shares = 2
+	} else if shares > 262144 {
+		shares = 262144
+	}
+	return uint64(1 + ((shares-2)*9999)/262142)
+}
+
+// blkioWeightToWeight converts a cgroup v1 blkio weight, from 10 to 1000, to a
+// cgroup v2 I/O weight, from 1 to 10000.
+func blkioWeightToWeight(weight uint16) uint64 {
+	if weight < 10 {
+		weight = 10
+	} else if weight > 1000 {
+		weight = 1000
+	}
+	return uint64(1 + (int64(weight)-10)*9999/990)
+}
+
+// unifiedIOMax returns the io.max lines of the read and write bandwidth limits
+// of devices, one per device.
+func unifiedIOMax(read, write []*cgroupConfig.ThrottleDevice) []string {
+	var devices []string
+	limits := make(map[string][]string)
+	add := func(d *cgroupConfig.ThrottleDevice, key string) {
+		dev := fmt.Sprintf("%d:%d", d.Major, d.Minor)
+		if _, ok := limits[dev]; !ok {
+			devices = append(devices, dev)
+		}
+		limits[dev] = append(limits[dev], fmt.Sprintf("%s=%d", key, d.Rate))
+	}
+	for _, d := range read {
+		add(d, "rbps")
+	}
+	for _, d := range write {
+		add(d, "wbps")
+	}
+
+	lines := make([]string, len(devices))
+	for i, dev := range devices {
+		lines[i] = dev + " " + strings.Join(limits[dev], " ")
+	}
+	return lines
+}
+
+// GetPids returns the pids of the processes in the cgroup.
+func (m *unifiedManager) GetPids() ([]int, error) {
+	return readCgroupProcs(m.path())
+}
+
+// GetAllPids returns the pids of the processes in the cgroup and its
+// descendants.
+func (m *unifiedManager) GetAllPids() ([]int, error) {
+	var pids []int
+	err := filepath.Walk(m.path(), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		procs, err := readCgroupProcs(p)
+		if err != nil {
+			return err
+		}
+		pids = append(pids, procs...)
+		return nil
+	})
+	return pids, err
+}
+
+// readCgroupProcs returns the pids listed in the cgroup.procs of the cgroup.
+func readCgroupProcs(dir string) ([]int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, field := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pid %q in %s: %v", field, dir, err)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// GetStats returns the memory and CPU usage of the cgroup, converted to the
+// cgroup v1 stats libcontainer reports. The memory usage isn't reported if
+// the memory controller isn't enabled.
+func (m *unifiedManager) GetStats() (*cgroups.Stats, error) {
+	path := m.path()
+	stats := cgroups.NewStats()
+
+	cpu, err := readCgroupKeyValues(filepath.Join(path, "cpu.stat"))
+	if err != nil {
+		return nil, err
+	}
+	stats.CpuStats.CpuUsage.TotalUsage = cpu["usage_usec"] * 1000
+	stats.CpuStats.CpuUsage.UsageInUsermode = cpu["user_usec"] * 1000
+	stats.CpuStats.CpuUsage.UsageInKernelmode = cpu["system_usec"] * 1000
+	stats.CpuStats.ThrottlingData.Periods = cpu["nr_periods"]
+	stats.CpuStats.ThrottlingData.ThrottledPeriods = cpu["nr_throttled"]
+	stats.CpuStats.ThrottlingData.ThrottledTime = cpu["throttled_usec"] * 1000
+
+	memory, err := readCgroupKeyValues(filepath.Join(path, "memory.stat"))
+	if os.IsNotExist(err) {
+		return stats, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for k, v := range memory {
+		stats.MemoryStats.Stats[k] = v
+	}
+	stats.MemoryStats.Stats["rss"] = memory["anon"]
+	stats.MemoryStats.Stats["cache"] = memory["file"]
+	stats.MemoryStats.Cache = memory["file"]
+
+	// Older kernels don't sum the kernel's memory
+	kernel, ok := memory["kernel"]
+	if !ok {
+		kernel = memory["kernel_stack"] + memory["slab"] + memory["sock"]
+	}
+	stats.MemoryStats.KernelUsage.Usage = kernel
+
+	// The peak usage is only tracked by Linux 5.19 and later
+	stats.MemoryStats.Usage.Usage, _ = readCgroupUint(filepath.Join(path, "memory.current"))
+	stats.MemoryStats.Usage.MaxUsage, _ = readCgroupUint(filepath.Join(path, "memory.peak"))
+	stats.MemoryStats.Usage.Limit, _ = readCgroupUint(filepath.Join(path, "memory.max"))
+	stats.MemoryStats.SwapUsage.Usage, _ = readCgroupUint(filepath.Join(path, "memory.swap.current"))
+	return stats, nil
+}
+
+// readCgroupKeyValues reads a cgroup file of "key value" lines, such as
+// cpu.stat. Values that aren't integers are skipped.
+func readCgroupKeyValues(path string) (map[string]uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]uint64)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = v
+		}
+	}
+	return values, nil
+}
+
+// readCgroupUint reads a cgroup file of a single integer. A value of "max" is
+// returned as zero.
+func readCgroupUint(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// Freeze freezes or thaws the processes in the cgroup, waiting for them to be
+// frozen. Kernels older than Linux 5.2 can't freeze cgroups in the unified
+// hierarchy, so the cgroup.freeze file doesn't exist.
+func (m *unifiedManager) Freeze(state cgroupConfig.FreezerState) error {
+	path := m.path()
+	value := "0"
+	if state == cgroupConfig.Frozen {
+		value = "1"
+	}
+	if err := writeCgroupFile(path, "cgroup.freeze", value); err != nil {
+		return err
+	}
+	if state != cgroupConfig.Frozen {
+		return nil
+	}
+
+	deadline := time.Now().Add(unifiedFreezeTimeout)
+	for {
+		events, err := readCgroupKeyValues(filepath.Join(path, "cgroup.events"))
+		if err != nil {
+			return err
+		}
+		if events["frozen"] == 1 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out freezing cgroup %s", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Destroy removes the cgroup. Killed processes may take a moment to leave
+// the cgroup, so removing it is retried like libcontainer does.
+func (m *unifiedManager) Destroy() error {
+	path := m.path()
+	if path == m.mountpoint {
+		return nil
+	}
+
+	delay := 10 * time.Millisecond
+	var err error
+	for i := 0; i < 5; i++ {
+		if err = os.Remove(path); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	return err
+}
+
+// GetPaths returns the cgroup's path under unifiedCgroupKey.
+func (m *unifiedManager) GetPaths() map[string]string {
+	return m.Paths
+}
+
+// writeCgroupFile writes the value to the file of the cgroup.
+func writeCgroupFile(dir, file, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0700); err != nil {
+		return fmt.Errorf("failed to write %q to %s: %v", value, filepath.Join(dir, file), err)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	cgroupConfig "github.com/opencontainers/runc/libcontainer/configs"
+)
+
+func TestExecutor_CgroupV2Conversions(t *testing.T) {
+	t.Parallel()
+	for shares, weight := range map[int64]uint64{2: 1, 1024: 39, 262144: 10000, 1: 1} {
+		if w := cpuSharesToWeight(shares); w != weight {
+			t.Fatalf("got weight %d of %d shares; want %d", w, shares, weight)
+		}
+	}
+	for v1, v2 := range map[uint16]uint64{10: 1, 500: 4950, 1000: 10000} {
+		if w := blkioWeightToWeight(v1); w != v2 {
+			t.Fatalf("got weight %d of blkio weight %d; want %d", w, v1, v2)
+		}
+	}
+
+	lines := unifiedIOMax(
+		[]*cgroupConfig.ThrottleDevice{cgroupConfig.NewThrottleDevice(8, 0, 100), cgroupConfig.NewThrottleDevice(8, 16, 300)},
+		[]*cgroupConfig.ThrottleDevice{cgroupConfig.NewThrottleDevice(8, 0, 200)},
+	)
+	expected := []string{"8:0 rbps=100 wbps=200", "8:16 rbps=300"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("got io.max %q; want %q", lines, expected)
+	}
+}
+
+// testUnifiedHierarchy returns a directory laid out like the root of a unified
+// hierarchy with the nomad cgroup.
+func testUnifiedHierarchy(t *testing.T) string {
+	mount, err := ioutil.TempDir("", "cgroup2")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, dir := range []string{mount, filepath.Join(mount, "nomad")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.controllers"), []byte("cpuset cpu io memory hugetlb pids\n"), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	return mount
+}
+
+func TestUnifiedManager_ApplySet(t *testing.T) {
+	t.Parallel()
+	mount := testUnifiedHierarchy(t)
+	defer os.RemoveAll(mount)
+
+	groups := &cgroupConfig.Cgroup{
+		Path: "/nomad/task",
+		Resources: &cgroupConfig.Resources{
+			CpuShares:                   1024,
+			Memory:                      256 * 1024 * 1024,
+			MemorySwap:                  256 * 1024 * 1024,
+			BlkioWeight:                 500,
+			BlkioThrottleReadBpsDevice:  []*cgroupConfig.ThrottleDevice{cgroupConfig.NewThrottleDevice(8, 0, 1048576)},
+			BlkioThrottleWriteBpsDevice: []*cgroupConfig.ThrottleDevice{cgroupConfig.NewThrottleDevice(8, 0, 524288)},
+			CpusetCpus:                  "0-1",
+		},
+	}
+	m := &unifiedManager{Cgroups: groups, mountpoint: mount}
+	if err := m.Apply(1234); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	path := filepath.Join(mount, "nomad", "task")
+	if paths := m.GetPaths(); !reflect.DeepEqual(paths, map[string]string{unifiedCgroupKey: path}) {
+		t.Fatalf("unexpected paths %v", paths)
+	}
+	if err := m.Set(&cgroupConfig.Config{Cgroups: groups}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The controllers are enabled by every ancestor
+	expected := map[string]string{
+		"cgroup.subtree_control":       "+cpu +cpuset +io +memory +pids",
+		"nomad/cgroup.subtree_control": "+cpu +cpuset +io +memory +pids",
+		"nomad/task/cgroup.procs":      "1234",
+		"nomad/task/cpu.weight":        "39",
+		"nomad/task/cpuset.cpus":       "0-1",
+		"nomad/task/memory.max":        "268435456",
+		"nomad/task/memory.swap.max":   "0",
+		"nomad/task/io.weight":         "default 4950",
+		"nomad/task/io.max":            "8:0 rbps=1048576 wbps=524288",
+	}
+	for file, value := range expected {
+		data, err := ioutil.ReadFile(filepath.Join(mount, file))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(data) != value {
+			t.Fatalf("got %s %q; want %q", file, data, value)
+		}
+	}
+
+	pids, err := m.GetAllPids()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(pids, []int{1234}) {
+		t.Fatalf("got pids %v; want [1234]", pids)
+	}
+}
+
+func TestUnifiedManager_GetStats(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "cgroup2")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"cpu.stat": "usage_usec 3000\nuser_usec 2000\nsystem_usec 1000\nnr_periods 10\nnr_throttled 4\nthrottled_usec 500\n",
+		"memory.stat": "anon 4096\nfile 8192\nkernel_stack 16\nslab 32\nsock 0\n" +
+			"pgfault 100\npgmajfault 10\n",
+		"memory.current":      "12288\n",
+		"memory.max":          "max\n",
+		"memory.swap.current": "1024\n",
+	}
+	for file, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	m := &unifiedManager{Paths: map[string]string{unifiedCgroupKey: dir}}
+	stats, err := m.GetStats()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cpu := stats.CpuStats
+	if cpu.CpuUsage.TotalUsage != 3000000 || cpu.CpuUsage.UsageInUsermode != 2000000 || cpu.CpuUsage.UsageInKernelmode != 1000000 {
+		t.Fatalf("unexpected CPU usage %+v", cpu.CpuUsage)
+	}
+	if cpu.ThrottlingData.Periods != 10 || cpu.ThrottlingData.ThrottledPeriods != 4 || cpu.ThrottlingData.ThrottledTime != 500000 {
+		t.Fatalf("unexpected throttling %+v", cpu.ThrottlingData)
+	}
+
+	mem := stats.MemoryStats
+	if mem.Stats["rss"] != 4096 || mem.Stats["cache"] != 8192 || mem.Stats["pgfault"] != 100 || mem.Stats["pgmajfault"] != 10 {
+		t.Fatalf("unexpected memory stats %v", mem.Stats)
+	}
+	if mem.Usage.Usage != 12288 || mem.Usage.Limit != 0 || mem.SwapUsage.Usage != 1024 || mem.KernelUsage.Usage != 48 {
+		t.Fatalf("unexpected memory usage %+v", mem)
+	}
+
+	// The memory controller may not be enabled
+	os.Remove(filepath.Join(dir, "memory.stat"))
+	if _, err := m.GetStats(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
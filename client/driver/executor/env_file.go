@@ -0,0 +1,105 @@
+package executor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/driver/env"
+)
+
+// parseEnvFile parses an env file of KEY=VALUE lines. Blank lines and lines
+// starting with "#" are skipped. Values are taken verbatim up to the end of
+// the line, so they're neither quoted nor escaped.
+func parseEnvFile(r io.Reader) (map[string]string, error) {
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("line %d is not of the form KEY=VALUE", n)
+		}
+		vars[key] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+// envFileTaskEnv returns the task's environment merged with the variables of
+// the env file at path. The path is interpolated and relative to the task dir,
+// which includes the shared alloc dir, and the file is opened without
+// following symlinks in any of its components, so that a task can't have the
+// executor read host files into its environment, even by swapping them while
+// the file is opened. Variables set in the task's env take precedence over
+// the file's. A missing file is ignored if optional.
+func (e *UniversalExecutor) envFileTaskEnv(path string, optional bool) (*env.TaskEnv, error) {
+	path = filepath.Join(e.ctx.TaskDir, e.ctx.TaskEnv.ReplaceEnv(path))
+	rel, err := filepath.Rel(e.ctx.TaskDir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("env file %q must be within the task or alloc dir", path)
+	}
+
+	f, err := openEnvFile(e.ctx.TaskDir, rel)
+	if os.IsNotExist(err) {
+		if optional {
+			return e.ctx.TaskEnv, nil
+		}
+		return nil, fmt.Errorf("env file %q does not exist", path)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open env file %q: %v", path, err)
+	}
+	defer f.Close()
+	vars, err := parseEnvFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid env file %q: %v", path, err)
+	}
+
+	envMap := e.ctx.TaskEnv.Map()
+	for k, v := range vars {
+		if _, ok := e.ctx.Task.Env[k]; ok {
+			continue
+		}
+		envMap[k] = v
+	}
+	return env.NewTaskEnv(envMap, e.ctx.TaskEnv.NodeAttrs), nil
+}
+
+// openEnvFile opens the env file at the relative path rel within the task
+// dir through the descriptors of its parent directories. It's opened without
+// blocking and must be a regular file, so that a FIFO the task created at
+// the path can't hang launching the task.
+func openEnvFile(taskDir, rel string) (*os.File, error) {
+	dir, err := allocdir.OpenDirBeneath(taskDir, filepath.Dir(rel), false, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	f, err := allocdir.OpenFileAt(dir, filepath.Base(rel), os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("%q is not a regular file", f.Name())
+	}
+	return f, nil
+}
@@ -0,0 +1,103 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/driver/env"
+)
+
+func TestParseEnvFile(t *testing.T) {
+	t.Parallel()
+
+	input := `# Rendered by a template
+DB_HOST=db.service.consul
+
+DB_URL=postgres://user:p@ss=word@db/app
+  EMPTY=
+QUOTED="kept"
+`
+	act, err := parseEnvFile(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	exp := map[string]string{
+		"DB_HOST": "db.service.consul",
+		"DB_URL":  "postgres://user:p@ss=word@db/app",
+		"EMPTY":   "",
+		"QUOTED":  `"kept"`,
+	}
+	if !reflect.DeepEqual(act, exp) {
+		t.Fatalf("got %v; want %v", act, exp)
+	}
+
+	for _, input := range []string{"NO_VALUE", "=value", "TWO WORDS=value"} {
+		if _, err := parseEnvFile(strings.NewReader(input)); err == nil {
+			t.Fatalf("expected error for %q", input)
+		}
+	}
+}
+
+func TestExecutor_EnvFileTaskEnv(t *testing.T) {
+	t.Parallel()
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+	envMap := ctx.TaskEnv.Map()
+	envMap[env.TaskLocalDir] = "/" + allocdir.TaskLocal
+	ctx.TaskEnv = env.NewTaskEnv(envMap, nil)
+	e := &UniversalExecutor{ctx: ctx}
+
+	// The task's env takes precedence over the file
+	path := filepath.Join(ctx.TaskDir, allocdir.TaskLocal, "app.env")
+	if err := ioutil.WriteFile(path, []byte("FOO=file\nFROM_FILE=1\n"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	taskEnv, err := e.envFileTaskEnv("${NOMAD_TASK_DIR}/app.env", false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if v := taskEnv.EnvMap["FROM_FILE"]; v != "1" {
+		t.Fatalf("got FROM_FILE=%q; want 1", v)
+	}
+	if v := taskEnv.EnvMap["FOO"]; v != "bar" {
+		t.Fatalf("got FOO=%q; want the task's value", v)
+	}
+
+	// Missing files fail unless optional
+	if _, err := e.envFileTaskEnv("local/missing.env", false); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("expected missing file error; got %v", err)
+	}
+	if taskEnv, err := e.envFileTaskEnv("local/missing.env", true); err != nil || taskEnv != ctx.TaskEnv {
+		t.Fatalf("expected the unchanged environment; got %v", err)
+	}
+
+	// Files outside the task and alloc dirs can't be read
+	host, err := ioutil.TempFile("", "host.env")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.Remove(host.Name())
+	host.Close()
+	if err := os.Symlink(host.Name(), filepath.Join(ctx.TaskDir, allocdir.TaskLocal, "host.env")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := e.envFileTaskEnv(strings.Repeat("../", 32)+host.Name(), false); err == nil || !strings.Contains(err.Error(), "must be within") {
+		t.Fatalf("expected the path outside of the task dir to be rejected; got %v", err)
+	}
+
+	// Symlinks aren't followed, even to a directory within the task dir
+	if _, err := e.envFileTaskEnv("local/host.env", false); err == nil {
+		t.Fatalf("expected the symlink to the host file to be rejected")
+	}
+	if err := os.Symlink(filepath.Join(ctx.TaskDir, allocdir.TaskLocal), filepath.Join(ctx.TaskDir, "link")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := e.envFileTaskEnv("link/app.env", false); err == nil {
+		t.Fatalf("expected the symlinked directory to be rejected")
+	}
+}
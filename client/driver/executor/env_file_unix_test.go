@@ -0,0 +1,38 @@
+// +build !windows
+
+package executor
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+)
+
+func TestExecutor_EnvFileTaskEnv_FIFO(t *testing.T) {
+	t.Parallel()
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+	e := &UniversalExecutor{ctx: ctx}
+
+	// A FIFO without a writer is rejected rather than blocking
+	if err := syscall.Mkfifo(filepath.Join(ctx.TaskDir, allocdir.TaskLocal, "app.env"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := e.envFileTaskEnv("local/app.env", false)
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		if err == nil || !strings.Contains(err.Error(), "not a regular file") {
+			t.Fatalf("expected the FIFO to be rejected; got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("opening the FIFO blocked")
+	}
+}
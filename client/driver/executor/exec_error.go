@@ -0,0 +1,117 @@
+package executor
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// elfMachines maps a GOARCH to the machine of ELF binaries built for it.
+var elfMachines = map[string]elf.Machine{
+	"386":     elf.EM_386,
+	"amd64":   elf.EM_X86_64,
+	"arm":     elf.EM_ARM,
+	"arm64":   elf.EM_AARCH64,
+	"ppc64":   elf.EM_PPC64,
+	"ppc64le": elf.EM_PPC64,
+	"s390x":   elf.EM_S390,
+}
+
+// elfCompatMachines maps a GOARCH to the machines of 32-bit ELF binaries of
+// the same family that its kernels can usually run as well.
+var elfCompatMachines = map[string][]elf.Machine{
+	"amd64": {elf.EM_386},
+	"arm64": {elf.EM_ARM},
+}
+
+// ELFMachineRunnable returns whether a node of the GOARCH can run ELF binaries
+// built for the machine, either natively or as a compatible 32-bit binary.
+// Binaries are assumed to run on nodes of an unknown GOARCH.
+func ELFMachineRunnable(goarch string, m elf.Machine) bool {
+	native, ok := elfMachines[goarch]
+	if !ok || m == native {
+		return true
+	}
+	for _, compat := range elfCompatMachines[goarch] {
+		if m == compat {
+			return true
+		}
+	}
+	return false
+}
+
+// ExecError is returned if executing the command fails. It captures the
+// errno and the resolved path of the binary along with a hint at the likely
+// cause.
+type ExecError struct {
+	// Path is the resolved host path of the binary
+	Path string
+
+	// Errno is the error returned by execve
+	Errno syscall.Errno
+
+	// Hint is a human readable explanation of the likely cause, if known
+	Hint string
+}
+
+func (e *ExecError) Error() string {
+	if e.Hint == "" {
+		return fmt.Sprintf("exec %s: %v", e.Path, e.Errno)
+	}
+	return fmt.Sprintf("exec %s: %v (%s)", e.Path, e.Errno, e.Hint)
+}
+
+// newExecError returns an ExecError if err is the failure to execute the
+// binary at path and otherwise returns err as is.
+func newExecError(path string, err error) error {
+	perr, ok := err.(*os.PathError)
+	if !ok {
+		return err
+	}
+	errno, ok := perr.Err.(syscall.Errno)
+	if !ok {
+		return err
+	}
+	return &ExecError{
+		Path:  path,
+		Errno: errno,
+		Hint:  execErrorHint(path, errno),
+	}
+}
+
+// execErrorHint returns an explanation of the likely cause of execve failing
+// with errno for the binary at path.
+func execErrorHint(path string, errno syscall.Errno) string {
+	switch errno {
+	case syscall.ENOEXEC:
+		return archHint(path)
+	case syscall.ENOENT:
+		// The binary was found before executing it
+		return "is the binary's interpreter or dynamic linker missing from the task's file system?"
+	case syscall.EACCES:
+		return "is the binary executable and its file system not mounted noexec?"
+	case syscall.ETXTBSY:
+		return "is the binary still being written to?"
+	default:
+		return ""
+	}
+}
+
+// archHint explains why the binary at path has an unrecognized format.
+func archHint(path string) string {
+	f, err := elf.Open(path)
+	if err != nil {
+		return "the binary is neither an ELF binary nor a script starting with \"#!\""
+	}
+	defer f.Close()
+
+	if !ELFMachineRunnable(runtime.GOARCH, f.Machine) {
+		return fmt.Sprintf("the binary is built for %s but the node's architecture is %s", f.Machine, runtime.GOARCH)
+	}
+	if m := elfMachines[runtime.GOARCH]; f.Machine != m {
+		return fmt.Sprintf("the binary is built for %s, which the node's kernel must be configured to run on %s", f.Machine, runtime.GOARCH)
+	}
+	return "is the binary built for this architecture?"
+}
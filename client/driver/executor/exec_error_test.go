@@ -0,0 +1,96 @@
+package executor
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// foreignBinary writes a copy of /bin/true built for another architecture to
+// dir and returns its path and the architecture it claims to be built for.
+func foreignBinary(t *testing.T, dir string) (string, elf.Machine) {
+	data, err := ioutil.ReadFile("/bin/true")
+	if err != nil {
+		t.Skipf("failed to read /bin/true: %v", err)
+	}
+
+	// Patch e_machine of the ELF header
+	machine := elf.EM_AARCH64
+	if runtime.GOARCH == "arm64" {
+		machine = elf.EM_X86_64
+	}
+	binary.LittleEndian.PutUint16(data[18:20], uint16(machine))
+
+	path := filepath.Join(dir, "foreign")
+	if err := ioutil.WriteFile(path, data, 0755); err != nil {
+		t.Fatalf("failed to write binary: %v", err)
+	}
+	return path, machine
+}
+
+func TestExecError_Hint(t *testing.T) {
+	t.Parallel()
+	if _, ok := elfMachines[runtime.GOARCH]; !ok {
+		t.Skipf("unsupported architecture %s", runtime.GOARCH)
+	}
+	dir, err := ioutil.TempDir("", "execerror")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	foreign, machine := foreignBinary(t, dir)
+	err = newExecError(foreign, &os.PathError{Op: "fork/exec", Path: foreign, Err: syscall.ENOEXEC})
+	eerr, ok := err.(*ExecError)
+	if !ok {
+		t.Fatalf("expected ExecError; got %T", err)
+	}
+	if eerr.Errno != syscall.ENOEXEC || eerr.Path != foreign {
+		t.Fatalf("unexpected error %#v", eerr)
+	}
+	if !strings.Contains(err.Error(), "exec format error") || !strings.Contains(err.Error(), machine.String()) {
+		t.Fatalf("expected architecture explanation; got %v", err)
+	}
+
+	text := filepath.Join(dir, "text")
+	if err := ioutil.WriteFile(text, []byte("echo hi\n"), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err = newExecError(text, &os.PathError{Op: "fork/exec", Path: text, Err: syscall.ENOEXEC})
+	if !strings.Contains(err.Error(), "neither an ELF binary nor a script") {
+		t.Fatalf("expected format explanation; got %v", err)
+	}
+
+	// Other errors are returned as is
+	other := &os.PathError{Op: "open", Path: text, Err: os.ErrNotExist}
+	if err := newExecError(text, other); err != other {
+		t.Fatalf("expected error to be returned as is; got %v", err)
+	}
+}
+
+func TestExecutor_Start_ForeignBinary(t *testing.T) {
+	t.Parallel()
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+	foreign, machine := foreignBinary(t, ctx.TaskDir)
+	executor := NewExecutor(log.New(os.Stdout, "", log.LstdFlags))
+
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error")
+	}
+
+	_, err := executor.LaunchCmd(&ExecCommand{Cmd: foreign})
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+	if !strings.Contains(err.Error(), "exec "+foreign+": exec format error") || !strings.Contains(err.Error(), machine.String()) {
+		t.Fatalf("expected architecture explanation; got %v", err)
+	}
+}
@@ -0,0 +1,21 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package executor
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setExecProcessGroup makes the exec'd command run in a process group of its
+// own so that it's signaled together with its children.
+func setExecProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr.Setpgid = true
+	cmd.SysProcAttr.Pgid = 0
+}
+
+// signalExecGroup sends the signal to the process group of the exec'd
+// command.
+func signalExecGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
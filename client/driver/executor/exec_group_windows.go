@@ -0,0 +1,14 @@
+package executor
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setExecProcessGroup is a no-op as Windows has no process groups.
+func setExecProcessGroup(cmd *exec.Cmd) {}
+
+// signalExecGroup kills the exec'd command as Windows can't signal it.
+func signalExecGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	return cmd.Process.Kill()
+}
@@ -3,16 +3,19 @@ package executor
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -37,12 +40,76 @@ const (
 	// tree for finding out the pids that the executor and it's child processes
 	// have forked
 	pidScanInterval = 5 * time.Second
+
+	// logDrainTimeout is how long to wait for the output of an exited
+	// command to be copied to its log files. Background processes that
+	// inherited the command's output may keep it open indefinitely.
+	logDrainTimeout = 2 * time.Second
+
+	// cgroupPollInterval is how often the processes remaining in the
+	// command's cgroup are checked after the command itself has exited.
+	cgroupPollInterval = 500 * time.Millisecond
+
+	// startConfirmationPollInterval is how often a started command is
+	// checked for having exec'd while confirming its start.
+	startConfirmationPollInterval = 10 * time.Millisecond
+)
+
+const (
+	// statsConsumerClient identifies the client as the consumer of the
+	// executor's stats. Percentages derived from counters are calculated
+	// since the consumer's own previous sample.
+	statsConsumerClient = "client"
 )
 
+const (
+	// listenPidShell and listenPidScript set LISTEN_PID for socket
+	// activated commands before exec'ing them, with the command and its
+	// arguments as the script's arguments.
+	listenPidShell  = "/bin/sh"
+	listenPidScript = `LISTEN_PID=$$; export LISTEN_PID; exec "$0" "$@"`
+)
+
+// launchErrorRe matches the category prefix of errors returned by LaunchCmd.
+var launchErrorRe = regexp.MustCompile(`^([a-z]+) failure: `)
+
+// launchError prefixes the error with the failure category. The category is
+// part of the message so that it survives the RPC boundary to the driver.
+func launchError(category dstructs.StartFailure, err error) error {
+	return fmt.Errorf("%s failure: %v", category, err)
+}
+
+// LaunchErrorCategory returns the failure category of an error returned by
+// LaunchCmd.
+func LaunchErrorCategory(err error) dstructs.StartFailure {
+	if err == nil {
+		return dstructs.StartFailureUnknown
+	}
+
+	m := launchErrorRe.FindStringSubmatch(err.Error())
+	if m == nil {
+		return dstructs.StartFailureUnknown
+	}
+
+	switch c := dstructs.StartFailure(m[1]); c {
+	case dstructs.StartFailureConfig, dstructs.StartFailureCommand,
+		dstructs.StartFailureUser, dstructs.StartFailureChroot,
+		dstructs.StartFailureCgroup, dstructs.StartFailureFilesystem,
+		dstructs.StartFailureExecutor, dstructs.StartFailureNetwork:
+		return c
+	default:
+		return dstructs.StartFailureUnknown
+	}
+}
+
 var (
 	// The statistics the basic executor exposes
 	ExecutorBasicMeasuredMemStats = []string{"RSS", "Swap"}
 	ExecutorBasicMeasuredCpuStats = []string{"System Mode", "User Mode", "Percent"}
+
+	// ExecutorPageFaultMeasuredMemStats are measured in addition to the basic
+	// memory stats where the page faults of processes can be read
+	ExecutorPageFaultMeasuredMemStats = []string{"Major Page Faults", "Minor Page Faults"}
 )
 
 // Executor is the interface which allows a driver to launch and supervise
@@ -59,7 +126,10 @@ type Executor interface {
 	Version() (*ExecutorVersion, error)
 	Stats() (*cstructs.TaskResourceUsage, error)
 	Signal(s os.Signal) error
+	SignalGroup(s os.Signal) error
 	Exec(deadline time.Time, cmd string, args []string) ([]byte, int, error)
+	ExecStreaming(ctx context.Context, cmd string, args []string, tty bool, stdin io.Reader, stdout, stderr io.Writer) (int, error)
+	RecentOutput() (*TaskOutput, error)
 }
 
 // ExecutorContext holds context to configure the command user
@@ -104,12 +174,232 @@ type ExecCommand struct {
 	// FSIsolation determines whether the command would be run in a chroot.
 	FSIsolation bool
 
+	// ReadonlyRootfs runs the command with the root of its chroot mounted
+	// read-only. The mounts within the chroot keep their own flags.
+	ReadonlyRootfs bool
+
+	// Tmpfs are mounted into the chroot within the command's mount
+	// namespace, so they're released once the command and the commands
+	// executed within the task exit.
+	Tmpfs []*TmpfsMount
+
 	// User is the user which the executor uses to run the command.
 	User string
 
+	// OverrideGroups determines whether the supplementary groups of a
+	// command without a User are set to Groups rather than inherited from
+	// the executor.
+	OverrideGroups bool
+
+	// Groups are the supplementary groups of the command if OverrideGroups
+	// is set. An empty list drops all supplementary groups.
+	Groups []uint32
+
+	// Group is the name or ID of the group overriding the primary group of
+	// the command's user.
+	Group string
+
+	// ExtraGroups are the names or IDs of groups added to the supplementary
+	// groups of the command.
+	ExtraGroups []string
+
+	// ListenAddr is the TCP address of a socket the executor listens on and
+	// passes to the command as file descriptor 3 for socket activation.
+	ListenAddr string
+
+	// BridgeNetwork isolates the command in its own network namespace
+	// attached to a host bridge. Nil shares the host's network. The
+	// namespace is removed along with the resource container, so it
+	// requires ResourceLimits.
+	BridgeNetwork *BridgeNetwork
+
 	// ResourceLimits determines whether resource limits are enforced by the
 	// executor.
 	ResourceLimits bool
+
+	// CpusetCpus is an optional list of cores, such as "0-3,6", the command
+	// is pinned to if resource limits are enforced.
+	CpusetCpus string
+
+	// CgroupRetries is the number of times writing the cgroup limits is
+	// retried after transient errors.
+	CgroupRetries int
+
+	// TrackCgroup makes the processes in the command's cgroup, rather than
+	// the command itself, the unit of liveness. Commands that daemonize are
+	// then only considered exited once all their processes have exited and
+	// shutting them down signals all processes. It requires ResourceLimits.
+	TrackCgroup bool
+
+	// ReapOrphans makes the executor the subreaper of its descendants and
+	// reaps the processes orphaned by the command and its helpers, such as the
+	// background processes of check scripts, so that zombies don't accumulate.
+	// Shutting the command down signals the orphans too, and those still
+	// running once the command exited are killed before its exit is reported.
+	ReapOrphans bool
+
+	// MaxThreads is the soft RLIMIT_NPROC the command is started with,
+	// limiting the processes and threads of its user. Zero leaves the limit
+	// unchanged.
+	MaxThreads int
+
+	// Ulimits are the resource limits the command is started with.
+	Ulimits []*Ulimit
+
+	// CoreDump raises the command's soft core size limit to its hard limit
+	// so that it dumps core when it crashes.
+	CoreDump bool
+
+	// StartConfirmation is the window after starting the command in which
+	// it's confirmed to have exec'd and not to have failed. Zero disables the
+	// confirmation.
+	StartConfirmation time.Duration
+
+	// OOMScoreAdj is the oom_score_adj of the command, raising the chance
+	// of it being picked by the OOM killer. Zero leaves it unchanged.
+	OOMScoreAdj int
+
+	// Umask is the octal file mode creation mask the command is started
+	// with. Empty leaves the executor's umask unchanged.
+	Umask string
+
+	// EnvFile is the path, relative to the task dir, of a file of KEY=VALUE
+	// lines merged into the command's environment. Variables set in the
+	// task's env take precedence. A missing file fails the launch unless
+	// EnvFileOptional is set.
+	EnvFile         string
+	EnvFileOptional bool
+
+	// SecretFiles maps the names of files written to the task's secrets dir
+	// to their contents. The secrets dir must be a tmpfs.
+	SecretFiles map[string]string
+
+	// WorkDir is the directory, relative to the task dir, the command is
+	// started in. Empty starts it at the root of the task dir.
+	WorkDir string
+
+	// Nice is the scheduling priority, from -20 to 19, the command is
+	// started with. Zero leaves the executor's priority unchanged.
+	Nice int
+
+	// IOWeight is the relative weight, from 10 to 1000, of the command's
+	// block I/O, taking precedence over the task's IOPS resource. IOLimits cap
+	// its block I/O bandwidth per device. Both require ResourceLimits.
+	IOWeight uint16
+	IOLimits []*IOLimit
+
+	// Devices, if any, are the devices the command may access in addition to
+	// the default ones, such as /dev/null. Without them the command may
+	// access every device. It requires ResourceLimits.
+	Devices []*Device
+
+	// NoSwap limits the command's memory and swap to its memory limit so
+	// that it can't swap. It requires ResourceLimits.
+	NoSwap bool
+
+	// OOMDisable disables the OOM killer of the command's memory cgroup so
+	// that its processes are paused rather than killed when it runs out of
+	// memory. It requires ResourceLimits and cgroup v1.
+	OOMDisable bool
+
+	// CapAdd are the capabilities, by their bit in the capability sets,
+	// granted to the command as ambient capabilities so that they're kept by
+	// users other than root. CapDrop are removed from the bounding set of the
+	// command and the commands executed within the task so that not even root
+	// or file capabilities can gain them.
+	CapAdd  []int
+	CapDrop []int
+
+	// KillEscalationSignal is sent to the command's process group if it's
+	// still running KillEscalationDelay after being shut down. Setting it
+	// starts the command in its own process group so that children that
+	// were reparented are signalled too. Nil disables the escalation.
+	KillEscalationSignal os.Signal
+	KillEscalationDelay  time.Duration
+
+	// SignalProcessGroup starts the command in its own process group and
+	// sends signals, including the kill signal, to the whole group so that
+	// the children it forks are signalled too.
+	SignalProcessGroup bool
+
+	// ResetSignals starts the command with the default disposition of every
+	// signal, even those the executor was started ignoring. IgnoreSignals are
+	// the signals the command is started ignoring. Both are set by the launch
+	// shim, leaving the executor's own dispositions untouched.
+	ResetSignals  bool
+	IgnoreSignals []os.Signal
+
+	// MemorySoftLimit is the memory usage, in bytes, above which the command
+	// is killed once it stayed above it for MemorySoftLimitGrace. Zero
+	// disables the soft limit.
+	MemorySoftLimit      uint64
+	MemorySoftLimitGrace time.Duration
+
+	// UserNamespace runs the command in a user namespace of its own. Its
+	// User and groups are ids within the namespace.
+	UserNamespace *UserNamespace
+
+	// ReapExecProcesses kills the background processes that commands exec'd
+	// within the task, such as its post-start and pre-kill commands, leave
+	// running once they exit. Otherwise they keep running until the task
+	// exits.
+	ReapExecProcesses bool
+}
+
+// BridgeNetwork configures the network namespace of a command connected to a
+// host bridge through a veth pair.
+type BridgeNetwork struct {
+	// Bridge is the name of the host bridge, created if it doesn't exist
+	Bridge string
+
+	// Gateway is the address of the bridge in CIDR notation, such as
+	// "172.26.64.1/20", and the command's default route
+	Gateway string
+
+	// Address is the address of the command in CIDR notation
+	Address string
+
+	// Ports are the host ports forwarded to the same ports of the command's
+	// address
+	Ports []int
+}
+
+// TmpfsMount is a tmpfs mounted into the chroot of a command.
+type TmpfsMount struct {
+	// TaskPath is the absolute path within the chroot it's mounted at
+	TaskPath string
+
+	// SizeMB is the size of the tmpfs
+	SizeMB int
+}
+
+// UserNamespace maps the ids from zero to Size within a command's user
+// namespace to the host's ids starting at UID and GID, so that root within the
+// namespace is an unprivileged user on the host.
+type UserNamespace struct {
+	UID  uint32
+	GID  uint32
+	Size uint32
+}
+
+// IOLimit caps the block I/O bandwidth, in bytes per second, of a command to
+// the device with the major and minor number. Zero leaves a direction
+// unlimited.
+type IOLimit struct {
+	Major    int64
+	Minor    int64
+	ReadBps  uint64
+	WriteBps uint64
+}
+
+// Device is a device node the command may access with the device cgroup
+// permissions, a combination of "r", "w" and "m".
+type Device struct {
+	Path        string
+	Type        rune
+	Major       int64
+	Minor       int64
+	Permissions string
 }
 
 // ProcessState holds information about the state of a user process.
@@ -119,6 +409,35 @@ type ProcessState struct {
 	Signal          int
 	IsolationConfig *dstructs.IsolationConfig
 	Time            time.Time
+
+	// CgroupRetries is the number of cgroup writes that were retried while
+	// launching the command
+	CgroupRetries int
+
+	// OOMKilled is whether a process of the command was killed by the OOM
+	// killer for exceeding its memory limit
+	OOMKilled bool
+
+	// MemorySoftLimitKilled is whether the executor killed the command for
+	// exceeding its memory soft limit
+	MemorySoftLimitKilled bool
+
+	// CoreDumped is whether the command dumped core when killed by Signal
+	CoreDumped bool
+
+	// UserTime and SystemTime are the CPU time the command spent in user
+	// and kernel mode, from its resource usage when it was reaped
+	UserTime   time.Duration
+	SystemTime time.Duration
+
+	// Env is the environment the command was launched with
+	Env map[string]string
+}
+
+// TaskOutput holds the most recent output of a task's streams.
+type TaskOutput struct {
+	Stdout []byte
+	Stderr []byte
 }
 
 // nomadPid holds a pid and it's cpu percentage calculator
@@ -159,10 +478,38 @@ type UniversalExecutor struct {
 	processExited       chan interface{}
 	fsIsolationEnforced bool
 
+	// lre and lro are the same rotator if the task combines its logs
 	lre         *logging.FileRotator
 	lro         *logging.FileRotator
 	rotatorLock sync.Mutex
 
+	// outBuf and errBuf hold the recent output of the command if the
+	// task's log config enables buffering. Combined output is held by outBuf.
+	outBuf *logging.RingBuffer
+	errBuf *logging.RingBuffer
+
+	// logCopyWg tracks the copying of the command's output to the loggers
+	logCopyWg sync.WaitGroup
+
+	// cgroupRetries counts the cgroup writes that were retried
+	cgroupRetries int
+
+	// escalateOnce starts escalating the shutdown only once
+	escalateOnce sync.Once
+
+	// escalating is set atomically to 1 once the shutdown of a command with
+	// a kill escalation signal started. The command's process group is then
+	// waited on after the command exited.
+	escalating int32
+
+	// memorySoftLimitKilled is set atomically to 1 before the command is
+	// killed for exceeding its memory soft limit
+	memorySoftLimitKilled int32
+
+	// secretFiles are the paths of the secret files written for the command.
+	// They're removed on exit.
+	secretFiles []string
+
 	syslogServer *logging.SyslogServer
 	syslogChan   chan *logging.SyslogMessage
 
@@ -171,6 +518,7 @@ type UniversalExecutor struct {
 	totalCpuStats  *stats.CpuStats
 	userCpuStats   *stats.CpuStats
 	systemCpuStats *stats.CpuStats
+	throttleStats  *stats.ThrottleStats
 	logger         *log.Logger
 }
 
@@ -186,6 +534,7 @@ func NewExecutor(logger *log.Logger) Executor {
 		totalCpuStats:  stats.NewCpuStats(),
 		userCpuStats:   stats.NewCpuStats(),
 		systemCpuStats: stats.NewCpuStats(),
+		throttleStats:  stats.NewThrottleStats(),
 		pids:           make(map[int]*nomadPid),
 	}
 
@@ -216,45 +565,118 @@ func (e *UniversalExecutor) LaunchCmd(command *ExecCommand) (*ProcessState, erro
 
 	e.command = command
 
+	if command.ReapOrphans {
+		if err := startOrphanReaper(e.logger); err != nil {
+			e.logger.Printf("[WARN] executor: not reaping orphaned processes: %v", err)
+		}
+	}
+
 	// setting the user of the process
 	if command.User != "" {
 		e.logger.Printf("[DEBUG] executor: running command as %s", command.User)
 		if err := e.runAs(command.User); err != nil {
-			return nil, err
+			return nil, launchError(dstructs.StartFailureUser, err)
+		}
+	} else if command.OverrideGroups {
+		e.logger.Printf("[DEBUG] executor: running command with supplementary groups %v", command.Groups)
+		if err := e.setGroups(command.Groups); err != nil {
+			return nil, launchError(dstructs.StartFailureUser, err)
+		}
+	}
+	if command.Group != "" || len(command.ExtraGroups) != 0 {
+		if err := e.addGroups(command.Group, command.ExtraGroups); err != nil {
+			return nil, launchError(dstructs.StartFailureUser, err)
+		}
+	}
+	if ns := command.UserNamespace; ns != nil {
+		e.logger.Printf("[DEBUG] executor: mapping %d ids of the user namespace to uid %d and gid %d", ns.Size, ns.UID, ns.GID)
+		if err := e.setUserNamespace(ns); err != nil {
+			return nil, launchError(dstructs.StartFailureUser, err)
 		}
 	}
 
 	// set the task dir as the working directory for the command
 	e.cmd.Dir = e.ctx.TaskDir
 
+	// Give the command a process group of its own to signal and escalate
+	// shutdowns to
+	if command.KillEscalationSignal != nil || command.SignalProcessGroup {
+		e.setProcessGroup()
+	}
+
 	// configuring the chroot, resource container, and start the plugin
 	// process in the chroot.
 	if err := e.configureIsolation(); err != nil {
 		return nil, err
 	}
+
+	// The work dir is within the chroot, if any, so it's joined once the
+	// command's root is known
+	if command.WorkDir != "" {
+		e.cmd.Dir = filepath.Join(e.cmd.Dir, command.WorkDir)
+	}
 	// Apply ourselves into the resource container. The executor MUST be in
 	// the resource container before the user task is started, otherwise we
 	// are subject to a fork attack in which a process escapes isolation by
 	// immediately forking.
 	if err := e.applyLimits(os.Getpid()); err != nil {
-		return nil, err
+		return nil, launchError(dstructs.StartFailureCgroup, err)
 	}
 
 	// Setup the loggers
 	if err := e.configureLoggers(); err != nil {
-		return nil, err
+		return nil, launchError(dstructs.StartFailureFilesystem, err)
+	}
+
+	// Copy the output through pipes of our own rather than having os/exec do
+	// it, as os/exec waits for the output to be closed. The output is
+	// inherited by background processes the command starts, which would make
+	// waiting on the command also wait on them.
+	stdout, err := e.copyToLogger(bufferedWriter(e.lro, e.outBuf))
+	if err != nil {
+		return nil, launchError(dstructs.StartFailureFilesystem, err)
+	}
+	defer stdout.Close()
+
+	// Combined logs share a single pipe, so the streams are logged in the
+	// order the command writes them
+	stderr := stdout
+	if !e.ctx.Task.LogConfig.CombineLogs {
+		stderr, err = e.copyToLogger(bufferedWriter(e.lre, e.errBuf))
+		if err != nil {
+			return nil, launchError(dstructs.StartFailureFilesystem, err)
+		}
+		defer stderr.Close()
+	}
+	e.cmd.Stdout = stdout
+	e.cmd.Stderr = stderr
+
+	// Merge the env file into the environment before interpolating the
+	// command so that it can use the file's variables
+	if command.EnvFile != "" {
+		taskEnv, err := e.envFileTaskEnv(command.EnvFile, command.EnvFileOptional)
+		if err != nil {
+			return nil, launchError(dstructs.StartFailureFilesystem, err)
+		}
+		e.ctx.TaskEnv = taskEnv
+	}
+
+	// The secret files are written once the command's user is known so that
+	// they're only readable by it
+	if len(command.SecretFiles) != 0 {
+		if err := e.writeSecretFiles(command.SecretFiles); err != nil {
+			return nil, launchError(dstructs.StartFailureFilesystem, err)
+		}
 	}
-	e.cmd.Stdout = e.lro
-	e.cmd.Stderr = e.lre
 
 	// Look up the binary path and make it executable
 	absPath, err := e.lookupBin(e.ctx.TaskEnv.ReplaceEnv(command.Cmd))
 	if err != nil {
-		return nil, err
+		return nil, launchError(dstructs.StartFailureCommand, err)
 	}
 
 	if err := e.makeExecutable(absPath); err != nil {
-		return nil, err
+		return nil, launchError(dstructs.StartFailureCommand, err)
 	}
 
 	path := absPath
@@ -266,6 +688,12 @@ func (e *UniversalExecutor) LaunchCmd(command *ExecCommand) (*ProcessState, erro
 			return nil, fmt.Errorf("failed to determine relative path base=%q target=%q: %v", e.ctx.TaskDir, path, err)
 		}
 		path = rel
+
+		// Relative paths are resolved from the work dir, which isn't the
+		// root of the chroot
+		if command.WorkDir != "" {
+			path = filepath.Join("/", rel)
+		}
 	}
 
 	// Set the commands arguments
@@ -273,87 +701,531 @@ func (e *UniversalExecutor) LaunchCmd(command *ExecCommand) (*ProcessState, erro
 	e.cmd.Args = append([]string{e.cmd.Path}, e.ctx.TaskEnv.ParseAndReplace(command.Args)...)
 	e.cmd.Env = e.ctx.TaskEnv.List()
 
+	// Only the socket is inherited as the executor's other descriptors are
+	// close-on-exec. The executor's copy is closed once the command started.
+	if command.ListenAddr != "" {
+		socket, err := listenFile(command.ListenAddr)
+		if err != nil {
+			return nil, launchError(dstructs.StartFailureNetwork, err)
+		}
+		defer socket.Close()
+		e.cmd.ExtraFiles = []*os.File{socket}
+		e.setListenPid()
+	}
+
+	// Resource limits are applied to the command's process through the
+	// launch shim rather than to the executor for the process to inherit
+	gate, err := e.gateCommand(command)
+	if err != nil {
+		return nil, launchError(dstructs.StartFailureConfig, err)
+	}
+	restoreOOMScore, err := e.adjustOOMScore(command.OOMScoreAdj)
+	if err != nil {
+		gate.abort()
+		return nil, launchError(dstructs.StartFailureConfig, err)
+	}
+	restoreUmask, err := e.setUmask(command.Umask)
+	if err != nil {
+		restoreOOMScore()
+		gate.abort()
+		return nil, launchError(dstructs.StartFailureConfig, err)
+	}
+	restoreNice, err := e.setNice(command.Nice)
+	if err != nil {
+		restoreUmask()
+		restoreOOMScore()
+		gate.abort()
+		return nil, launchError(dstructs.StartFailureConfig, err)
+	}
+	restoreCaps, err := e.setCapabilities(command.CapAdd, command.CapDrop)
+	if err != nil {
+		restoreNice()
+		restoreUmask()
+		restoreOOMScore()
+		gate.abort()
+		return nil, launchError(dstructs.StartFailureConfig, err)
+	}
+	restoreRootfs, err := e.createTaskMountns()
+	if err != nil {
+		restoreCaps()
+		restoreNice()
+		restoreUmask()
+		restoreOOMScore()
+		gate.abort()
+		return nil, launchError(dstructs.StartFailureChroot, err)
+	}
+	restoreNetns, err := e.enterNetns()
+	if err != nil {
+		restoreRootfs()
+		restoreCaps()
+		restoreNice()
+		restoreUmask()
+		restoreOOMScore()
+		gate.abort()
+		return nil, launchError(dstructs.StartFailureNetwork, err)
+	}
+
 	// Start the process
-	if err := e.cmd.Start(); err != nil {
-		return nil, fmt.Errorf("failed to start command path=%q --- args=%q: %v", path, e.cmd.Args, err)
+	err = e.cmd.Start()
+	startedAt := time.Now()
+	restoreNetns()
+	restoreRootfs()
+	restoreCaps()
+	restoreNice()
+	restoreUmask()
+	restoreOOMScore()
+	if err != nil {
+		gate.abort()
+		return nil, launchError(dstructs.StartFailureCommand,
+			fmt.Errorf("failed to start command path=%q --- args=%q: %v", path, e.cmd.Args, newExecError(absPath, err)))
+	}
+	gate.started()
+	if gate != nil {
+		if err := e.openGate(gate, command, absPath); err != nil {
+			e.cmd.Wait()
+			return nil, err
+		}
 	}
 	go e.collectPids()
 	go e.wait()
+	if command.MemorySoftLimit > 0 {
+		go e.enforceMemorySoftLimit(command.MemorySoftLimit, command.MemorySoftLimitGrace)
+	}
+	if command.StartConfirmation > 0 {
+		if err := e.confirmStart(command.StartConfirmation); err != nil {
+			return nil, launchError(dstructs.StartFailureCommand, err)
+		}
+	}
 	ic := e.resConCtx.getIsolationConfig()
-	return &ProcessState{Pid: e.cmd.Process.Pid, ExitCode: -1, IsolationConfig: ic, Time: time.Now()}, nil
+	return &ProcessState{Pid: e.cmd.Process.Pid, ExitCode: -1, IsolationConfig: ic, Time: startedAt, CgroupRetries: e.cgroupRetries, Env: e.ctx.TaskEnv.Map()}, nil
 }
 
-// Exec a command inside a container for exec and java drivers.
+// confirmStart polls the started process for the window and returns an error
+// if it fails within it or hasn't exec'd by its end, killing it in the latter
+// case. Processes exiting successfully within the window are confirmed.
+func (e *UniversalExecutor) confirmStart(window time.Duration) error {
+	pid := e.cmd.Process.Pid
+	deadline := time.NewTimer(window)
+	defer deadline.Stop()
+	ticker := time.NewTicker(startConfirmationPollInterval)
+	defer ticker.Stop()
+
+	exited := func() error {
+		if e.exitState.OOMKilled {
+			return fmt.Errorf("process %d was OOM killed within the start confirmation of %v", pid, window)
+		}
+		if e.exitState.ExitCode == 0 {
+			return nil
+		}
+		return fmt.Errorf("process %d exited with code %d within the start confirmation of %v",
+			pid, e.exitState.ExitCode, window)
+	}
+
+	for expired := false; ; {
+		select {
+		case <-e.processExited:
+			return exited()
+		case <-ticker.C:
+		case <-deadline.C:
+			expired = true
+		}
+
+		// The exit of processes isn't reported until their output is drained
+		execed, running := pidExeced(pid)
+		if !running {
+			<-e.processExited
+			return exited()
+		}
+		if expired {
+			if execed {
+				return nil
+			}
+			e.cmd.Process.Kill()
+			return fmt.Errorf("process %d didn't exec within the start confirmation of %v", pid, window)
+		}
+	}
+}
+
+// Exec a command inside a container for exec and java drivers. The command
+// shares the task's network namespace, if any, besides its chroot and cgroup.
+// It joins the cgroup before it's exec'd, so it's subject to the task's limits
+// from its start.
 func (e *UniversalExecutor) Exec(deadline time.Time, name string, args []string) ([]byte, int, error) {
 	ctx, cancel := context.WithDeadline(context.Background(), deadline)
 	defer cancel()
-	return ExecScript(ctx, e.cmd.Dir, e.ctx.TaskEnv, e.cmd.SysProcAttr, name, args)
+
+	// The cgroups are opened before entering the task's mount namespace,
+	// which may not have the host's cgroup file system
+	cgroups, err := e.openCgroupProcs()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer closeFiles(cgroups)
+
+	if err := e.enterTaskMountns(); err != nil {
+		return nil, 0, err
+	}
+	if err := dropCapabilities(e.command.CapDrop); err != nil {
+		return nil, 0, err
+	}
+	restoreNetns, err := e.enterNetns()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer restoreNetns()
+	return execScript(ctx, e.cmd.Dir, e.ctx.TaskEnv, e.cmd.SysProcAttr, name, args, e.command.ReapExecProcesses, e.command.CapDrop, cgroups)
 }
 
 // ExecScript executes cmd with args and returns the output, exit code, and
-// error. Output is truncated to client/driver/structs.CheckBufSize
+// error. Output is truncated to client/driver/structs.CheckBufSize. Once the
+// context is done, the command and its children are killed and the context's
+// error is returned. Background processes the command leaves running once it
+// exits are left running.
 func ExecScript(ctx context.Context, dir string, env *env.TaskEnv, attrs *syscall.SysProcAttr,
 	name string, args []string) ([]byte, int, error) {
-	name = env.ReplaceEnv(name)
-	cmd := exec.CommandContext(ctx, name, env.ParseAndReplace(args)...)
+	return execScript(ctx, dir, env, attrs, name, args, false, nil, nil)
+}
 
-	// Copy runtime environment from the main command
-	cmd.SysProcAttr = attrs
-	cmd.Dir = dir
-	cmd.Env = env.List()
+// execScript executes cmd with args like ExecScript. Only the command itself
+// is waited on, so background processes that inherited its output don't delay
+// returning once it exited. If reap is set they're killed with the command's
+// process group. The drop capabilities are dropped within the command's user
+// namespace, if attrs create one, and the command joins the cgroups whose
+// cgroup.procs files are given before it's exec'd.
+func execScript(ctx context.Context, dir string, env *env.TaskEnv, attrs *syscall.SysProcAttr,
+	name string, args []string, reap bool, drop []int, cgroups []*os.File) ([]byte, int, error) {
+	cmd := execScriptCmd(dir, env, attrs, name, args)
+	exe, err := shimExecCmd(cmd, drop, cgroups)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer exe.Close()
 
-	// Capture output
+	// Capture output through a pipe of our own as os/exec waits for the
+	// output to be closed, which background processes may keep open
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, 0, err
+	}
 	buf, _ := circbuf.NewBuffer(int64(dstructs.CheckBufSize))
-	cmd.Stdout = buf
-	cmd.Stderr = buf
-
-	if err := cmd.Run(); err != nil {
-		exitErr, ok := err.(*exec.ExitError)
-		if !ok {
-			// Non-exit error, return it and let the caller treat
-			// it as a critical failure
-			return nil, 0, err
-		}
+	cmd.Stdout = w
+	cmd.Stderr = w
 
-		// Some kind of error happened; default to critical
-		exitCode := 2
-		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
-			exitCode = status.ExitStatus()
-		}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		r.Close()
+		return nil, 0, err
+	}
+	copyDoneCh := make(chan struct{})
+	go func() {
+		defer close(copyDoneCh)
+		io.Copy(buf, r)
+	}()
+
+	err = waitExecCmd(ctx, cmd)
+	if reap {
+		signalExecGroup(cmd, syscall.SIGKILL)
+	}
+	select {
+	case <-copyDoneCh:
+	case <-time.After(logDrainTimeout):
+	}
+	r.Close()
+	<-copyDoneCh
 
-		// Don't return the exitError as the caller only needs the
-		// output and code.
+	if err != nil {
+		exitCode, err := execExitCode(err)
+		if err != nil {
+			return nil, 0, err
+		}
 		return buf.Bytes(), exitCode, nil
 	}
 	return buf.Bytes(), 0, nil
 }
 
+// closeFiles closes the files.
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// execKillGrace is how long the process group of an exec'd command has to exit
+// after it was sent SIGTERM because the context of the exec is done, before
+// it's killed.
+const execKillGrace = time.Second
+
+// execScriptCmd returns the command with args to exec in the environment of
+// the main command. The command runs in its own process group so that it can
+// be killed with its children.
+func execScriptCmd(dir string, env *env.TaskEnv, attrs *syscall.SysProcAttr, name string, args []string) *exec.Cmd {
+	name = env.ReplaceEnv(name)
+	cmd := exec.Command(name, env.ParseAndReplace(args)...)
+
+	// Copy runtime environment from the main command, leaving it unchanged
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	if attrs != nil {
+		*cmd.SysProcAttr = *attrs
+	}
+	cmd.Dir = dir
+	cmd.Env = env.List()
+	setExecProcessGroup(cmd)
+	return cmd
+}
+
+// waitExecCmd waits for the started command to exit. Once the context is
+// done, the command's process group is sent SIGTERM, and SIGKILL if it
+// didn't exit within execKillGrace, and the context's error is returned once
+// the command was reaped.
+func waitExecCmd(ctx context.Context, cmd *exec.Cmd) error {
+	waitCh := make(chan error, 1)
+	go func() {
+		waitCh <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-waitCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	signalExecGroup(cmd, syscall.SIGTERM)
+	select {
+	case <-waitCh:
+		// Children that outlived the command are killed too
+		signalExecGroup(cmd, syscall.SIGKILL)
+	case <-time.After(execKillGrace):
+		signalExecGroup(cmd, syscall.SIGKILL)
+		<-waitCh
+	}
+	return ctx.Err()
+}
+
+// execExitCode returns the exit code of a command run by Exec from the error
+// it failed with. Errors other than the command exiting unsuccessfully are
+// returned so that the caller treats them as a critical failure.
+func execExitCode(err error) (int, error) {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, err
+	}
+
+	// Some kind of error happened; default to critical
+	exitCode := 2
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+		exitCode = status.ExitStatus()
+	}
+
+	// Don't return the exitError as the caller only needs the code
+	return exitCode, nil
+}
+
+// ExecStreaming executes the command in the task's context like Exec, but
+// streams stdin to the command and its stdout and stderr back instead of
+// buffering the output, and kills it once the context is done. With tty, the command runs in a pseudo terminal whose
+// output is streamed to stdout.
+func (e *UniversalExecutor) ExecStreaming(ctx context.Context, name string, args []string, tty bool,
+	stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	cgroups, err := e.openCgroupProcs()
+	if err != nil {
+		return 0, err
+	}
+	defer closeFiles(cgroups)
+
+	if err := e.enterTaskMountns(); err != nil {
+		return 0, err
+	}
+	if err := dropCapabilities(e.command.CapDrop); err != nil {
+		return 0, err
+	}
+	restoreNetns, err := e.enterNetns()
+	if err != nil {
+		return 0, err
+	}
+	defer restoreNetns()
+	return execScriptStreaming(ctx, e.cmd.Dir, e.ctx.TaskEnv, e.cmd.SysProcAttr, name, args, tty, stdin, stdout, stderr, e.command.CapDrop, cgroups)
+}
+
+// ExecScriptStreaming executes cmd with args, streaming stdin to it and its
+// stdout and stderr to the writers, and returns the exit code and error. The
+// command's stdin is closed once stdin returns EOF, or Ctrl-D is sent with
+// tty. It returns once the command exited, even if stdin is still being read.
+// Like ExecScript, the command is killed once the context is done.
+func ExecScriptStreaming(ctx context.Context, dir string, env *env.TaskEnv, attrs *syscall.SysProcAttr,
+	name string, args []string, tty bool, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	return execScriptStreaming(ctx, dir, env, attrs, name, args, tty, stdin, stdout, stderr, nil, nil)
+}
+
+// execScriptStreaming is ExecScriptStreaming dropping the drop capabilities
+// within the command's user namespace, if attrs create one, and joining the
+// cgroups like execScript.
+func execScriptStreaming(ctx context.Context, dir string, env *env.TaskEnv, attrs *syscall.SysProcAttr,
+	name string, args []string, tty bool, stdin io.Reader, stdout, stderr io.Writer, drop []int, cgroups []*os.File) (int, error) {
+	cmd := execScriptCmd(dir, env, attrs, name, args)
+	exe, err := shimExecCmd(cmd, drop, cgroups)
+	if err != nil {
+		return 0, err
+	}
+	defer exe.Close()
+	if tty {
+		return execPty(ctx, cmd, stdin, stdout)
+	}
+
+	// The command's stdin is piped rather than set to the reader so that
+	// waiting for the command doesn't wait for the reader too
+	stdinPipe, err := cmd.StdinPipe()
+	if err != nil {
+		return 0, err
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	stop := CopyInput(stdinPipe, stdin, func() { stdinPipe.Close() })
+	defer stop()
+
+	if err := waitExecCmd(ctx, cmd); err != nil {
+		return execExitCode(err)
+	}
+	return 0, nil
+}
+
+// readDeadliner is implemented by readers whose pending reads can be
+// interrupted, such as connections and pipes.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// CopyInput copies src to dst in the background until src returns EOF and
+// then calls eof, if set. The returned function stops the copy once the
+// reader of dst is gone, such as when the command exited. It interrupts the
+// pending read of src and waits for the copy to return if src supports read
+// deadlines, and otherwise only stops the copy after its next read.
+func CopyInput(dst io.Writer, src io.Reader, eof func()) func() {
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			if n > 0 {
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				if err == io.EOF && eof != nil {
+					eof()
+				}
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stopCh)
+			if d, ok := src.(readDeadliner); ok && d.SetReadDeadline(time.Now()) == nil {
+				<-doneCh
+			}
+		})
+	}
+}
+
 // configureLoggers sets up the standard out/error file rotators
 func (e *UniversalExecutor) configureLoggers() error {
 	e.rotatorLock.Lock()
 	defer e.rotatorLock.Unlock()
 
 	logFileSize := int64(e.ctx.Task.LogConfig.MaxFileSizeMB * 1024 * 1024)
+	allocID := e.ctx.TaskEnv.EnvMap[env.AllocID]
+	mode, uid, gid, err := e.logFileOptions()
+	if err != nil {
+		return err
+	}
+
+	// Combined logs are written by a single rotator for both streams
+	stream := "stdout"
+	if e.ctx.Task.LogConfig.CombineLogs {
+		stream = structs.LogStreamCombined
+	}
+
 	if e.lro == nil {
-		lro, err := logging.NewFileRotator(e.ctx.LogDir, fmt.Sprintf("%v.stdout", e.ctx.Task.Name),
+		lro, err := logging.NewFileRotator(e.ctx.LogDir, e.ctx.Task.LogConfig.FileBaseName(e.ctx.Task.Name, allocID, stream),
 			e.ctx.Task.LogConfig.MaxFiles, logFileSize, e.logger)
 		if err != nil {
-			return fmt.Errorf("error creating new stdout log file for %q: %v", e.ctx.Task.Name, err)
+			return fmt.Errorf("error creating new %s log file for %q: %v", stream, e.ctx.Task.Name, err)
+		}
+		if err := lro.SetFileOptions(mode, uid, gid); err != nil {
+			return fmt.Errorf("error configuring %s log file for %q: %v", stream, e.ctx.Task.Name, err)
 		}
 		e.lro = lro
 	}
 
-	if e.lre == nil {
-		lre, err := logging.NewFileRotator(e.ctx.LogDir, fmt.Sprintf("%v.stderr", e.ctx.Task.Name),
+	if e.lre == nil && e.ctx.Task.LogConfig.CombineLogs {
+		e.lre = e.lro
+	} else if e.lre == nil {
+		lre, err := logging.NewFileRotator(e.ctx.LogDir, e.ctx.Task.LogConfig.FileBaseName(e.ctx.Task.Name, allocID, "stderr"),
 			e.ctx.Task.LogConfig.MaxFiles, logFileSize, e.logger)
 		if err != nil {
 			return fmt.Errorf("error creating new stderr log file for %q: %v", e.ctx.Task.Name, err)
 		}
+		if err := lre.SetFileOptions(mode, uid, gid); err != nil {
+			return fmt.Errorf("error configuring stderr log file for %q: %v", e.ctx.Task.Name, err)
+		}
 		e.lre = lre
 	}
+
+	if size := e.ctx.Task.LogConfig.BufferSizeKB * 1024; size > 0 && e.outBuf == nil {
+		e.outBuf = logging.NewRingBuffer(size)
+		e.errBuf = logging.NewRingBuffer(size)
+	}
 	return nil
 }
 
+// bufferedWriter returns a writer that writes to the logger and, if
+// enabled, the buffer of recent output.
+func bufferedWriter(logger io.Writer, buf *logging.RingBuffer) io.Writer {
+	if buf == nil {
+		return logger
+	}
+	return io.MultiWriter(logger, buf)
+}
+
+// RecentOutput returns the most recent output of the command. An error is
+// returned if the task's log config doesn't enable buffering.
+func (e *UniversalExecutor) RecentOutput() (*TaskOutput, error) {
+	e.rotatorLock.Lock()
+	defer e.rotatorLock.Unlock()
+
+	if e.outBuf == nil {
+		return nil, fmt.Errorf("output buffering isn't enabled for task %q", e.ctx.Task.Name)
+	}
+	return &TaskOutput{
+		Stdout: e.outBuf.Bytes(),
+		Stderr: e.errBuf.Bytes(),
+	}, nil
+}
+
+// logFileOptions returns the mode and owner of the task's log files. The
+// owner is only returned if the executor runs as root and is otherwise -1.
+func (e *UniversalExecutor) logFileOptions() (os.FileMode, int, int, error) {
+	var taskUser string
+	if e.command != nil {
+		taskUser = e.command.User
+	}
+	return logging.FileOptions(e.ctx.Task.LogConfig, taskUser, e.logger)
+}
+
 // Wait waits until a process has exited and returns it's exitcode and errors
 func (e *UniversalExecutor) Wait() (*ProcessState, error) {
 	<-e.processExited
@@ -394,12 +1266,159 @@ func (e *UniversalExecutor) UpdateTask(task *structs.Task) error {
 	return nil
 }
 
+// copyToLogger returns the write end of a pipe whose output is copied to the
+// logger until all writers have closed it.
+func (e *UniversalExecutor) copyToLogger(logger io.Writer) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create log pipe: %v", err)
+	}
+
+	e.logCopyWg.Add(1)
+	go func() {
+		defer e.logCopyWg.Done()
+		defer r.Close()
+		io.Copy(logger, r)
+	}()
+	return w, nil
+}
+
+// trackingCgroup returns whether the processes in the command's cgroup are
+// tracked rather than only the command itself.
+func (e *UniversalExecutor) trackingCgroup() bool {
+	return e.command.TrackCgroup && e.command.ResourceLimits
+}
+
+// taskPids returns the pids of the processes in the command's cgroup other
+// than the executor itself.
+func (e *UniversalExecutor) taskPids() ([]int, error) {
+	pids, err := e.getAllPids()
+	if err != nil {
+		return nil, err
+	}
+	self := os.Getpid()
+	var out []int
+	for pid := range pids {
+		if pid != self {
+			out = append(out, pid)
+		}
+	}
+	return out, nil
+}
+
+// waitForCgroup waits for the processes remaining in the command's cgroup to
+// exit if the cgroup is tracked. Commands that daemonize exit immediately
+// while the daemon keeps running in the cgroup.
+func (e *UniversalExecutor) waitForCgroup() {
+	if !e.trackingCgroup() {
+		return
+	}
+
+	logged := false
+	for {
+		pids, err := e.taskPids()
+		if err != nil || len(pids) == 0 {
+			return
+		}
+		if !logged {
+			e.logger.Printf("[DEBUG] executor: command exited but processes %v remain in its cgroup; waiting for them to exit", pids)
+			logged = true
+		}
+		time.Sleep(cgroupPollInterval)
+	}
+}
+
+// waitForProcessGroup waits for the processes remaining in the command's
+// process group to exit if its shutdown is being escalated, so that the
+// escalation signal reaches them before the executor exits.
+func (e *UniversalExecutor) waitForProcessGroup() {
+	if atomic.LoadInt32(&e.escalating) == 0 {
+		return
+	}
+
+	logged := false
+	for e.processGroupRunning() {
+		if !logged {
+			e.logger.Printf("[DEBUG] executor: command exited but processes remain in its process group; waiting for them to exit")
+			logged = true
+		}
+		time.Sleep(cgroupPollInterval)
+	}
+}
+
+// listenFile listens on the TCP address and returns the listening socket as a
+// file to pass to the command.
+func listenFile(addr string) (*os.File, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	defer l.Close()
+
+	// The file is a duplicate of the listener's descriptor, so the socket
+	// stays open once the listener is closed
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the socket listening on %s: %v", addr, err)
+	}
+	return f, nil
+}
+
+// syncLogs flushes the log files of the exited command to disk, so that its
+// final output can be read as soon as its exit is reported rather than once
+// the rotators are periodically flushed.
+func (e *UniversalExecutor) syncLogs() {
+	e.rotatorLock.Lock()
+	defer e.rotatorLock.Unlock()
+	for _, rotator := range []*logging.FileRotator{e.lro, e.lre} {
+		if err := rotator.Sync(); err != nil {
+			e.logger.Printf("[WARN] executor: failed to sync log file: %v", err)
+		}
+	}
+}
+
+// waitForLogs waits for the output of the exited command to be copied to its
+// log files. Only the command itself is waited on, so if background processes
+// keep the output open the wait is bounded by logDrainTimeout.
+func (e *UniversalExecutor) waitForLogs() {
+	doneCh := make(chan struct{})
+	go func() {
+		e.logCopyWg.Wait()
+		close(doneCh)
+	}()
+
+	select {
+	case <-doneCh:
+	case <-time.After(logDrainTimeout):
+		e.logger.Printf("[DEBUG] executor: output of the command is held open by background processes")
+	}
+}
+
 func (e *UniversalExecutor) wait() {
 	defer close(e.processExited)
 	err := e.cmd.Wait()
+	e.waitForCgroup()
+	e.waitForProcessGroup()
+
+	// The command's detached descendants don't outlive it, so killing the
+	// task tears down its whole process tree
+	if e.command.ReapOrphans {
+		if err := killOrphans(e.logger); err != nil {
+			e.logger.Printf("[WARN] executor: %v", err)
+		}
+	}
+	e.waitForLogs()
+	e.syncLogs()
 	ic := e.resConCtx.getIsolationConfig()
+
+	// The cgroup counts OOM kills from its creation, so kills of processes
+	// that exited while the command was still being launched are included
+	oomKilled := e.oomKilled()
+	softLimitKilled := e.killedByMemorySoftLimit()
 	if err == nil {
-		e.exitState = &ProcessState{Pid: 0, ExitCode: 0, IsolationConfig: ic, Time: time.Now()}
+		e.exitState = &ProcessState{Pid: 0, ExitCode: 0, IsolationConfig: ic, Time: time.Now(), OOMKilled: oomKilled,
+			MemorySoftLimitKilled: softLimitKilled}
+		e.setExitUsage()
 		return
 	}
 
@@ -428,7 +1447,23 @@ func (e *UniversalExecutor) wait() {
 		e.logger.Printf("[DEBUG] executor: unexpected Wait() error type: %v", err)
 	}
 
-	e.exitState = &ProcessState{Pid: 0, ExitCode: exitCode, Signal: signal, IsolationConfig: ic, Time: time.Now()}
+	e.exitState = &ProcessState{Pid: 0, ExitCode: exitCode, Signal: signal, IsolationConfig: ic, Time: time.Now(), OOMKilled: oomKilled,
+		MemorySoftLimitKilled: softLimitKilled}
+	e.setExitUsage()
+}
+
+// setExitUsage records whether the reaped command dumped core and the CPU time
+// it used in its exit state.
+func (e *UniversalExecutor) setExitUsage() {
+	state := e.cmd.ProcessState
+	if state == nil {
+		return
+	}
+	e.exitState.UserTime = state.UserTime()
+	e.exitState.SystemTime = state.SystemTime()
+	if status, ok := state.Sys().(syscall.WaitStatus); ok {
+		e.exitState.CoreDumped = status.CoreDump()
+	}
 }
 
 var (
@@ -443,6 +1478,15 @@ func ClientCleanup(ic *dstructs.IsolationConfig, pid int) error {
 	return clientCleanup(ic, pid)
 }
 
+// CgroupPath returns the host path of the cgroup of the process isolated by the
+// config, or an empty string if it isn't in a cgroup.
+func CgroupPath(ic *dstructs.IsolationConfig) string {
+	if ic == nil {
+		return ""
+	}
+	return cgroupPath(ic)
+}
+
 // Exit cleans up the alloc directory, destroys resource container and kills the
 // user process
 func (e *UniversalExecutor) Exit() error {
@@ -481,6 +1525,18 @@ func (e *UniversalExecutor) Exit() error {
 			merr.Errors = append(merr.Errors, err)
 		}
 	}
+
+	// Secret files don't outlive the command, even if the tmpfs does
+	if err := e.removeSecretFiles(); err != nil {
+		merr.Errors = append(merr.Errors, err)
+	}
+
+	// Kill the detached descendants the executor adopted as their subreaper
+	if e.command.ReapOrphans {
+		if err := killOrphans(e.logger); err != nil {
+			merr.Errors = append(merr.Errors, err)
+		}
+	}
 	return merr.ErrorOrNil()
 }
 
@@ -509,13 +1565,96 @@ func (e *UniversalExecutor) ShutDown() error {
 		osSignal = os.Interrupt
 	}
 
-	if err = proc.Signal(osSignal); err != nil && err.Error() != finishedErr {
+	if e.command.KillEscalationSignal != nil || e.command.SignalProcessGroup {
+		if e.command.KillEscalationSignal != nil {
+			atomic.StoreInt32(&e.escalating, 1)
+		}
+		if err := e.signalProcessGroup(osSignal); err != nil {
+			return fmt.Errorf("executor.shutdown error: %v", err)
+		}
+		if e.command.KillEscalationSignal != nil {
+			e.escalateOnce.Do(func() { go e.escalateShutDown() })
+		}
+	} else if err = proc.Signal(osSignal); err != nil && err.Error() != finishedErr {
 		return fmt.Errorf("executor.shutdown error: %v", err)
 	}
 
+	// Daemonized processes aren't descendants of the command anymore so
+	// signal the orphans the executor adopted and every process in the cgroup
+	if e.command.ReapOrphans {
+		signalOrphans(osSignal, e.cmd.Process.Pid, e.logger)
+	}
+	if e.trackingCgroup() {
+		pids, err := e.taskPids()
+		if err != nil {
+			return fmt.Errorf("executor.shutdown error: failed to find processes in cgroup: %v", err)
+		}
+		for _, pid := range pids {
+			p, err := os.FindProcess(pid)
+			if err != nil {
+				continue
+			}
+			if err := p.Signal(osSignal); err != nil && err.Error() != finishedErr {
+				e.logger.Printf("[DEBUG] executor: failed to signal pid %d in cgroup: %v", pid, err)
+			}
+		}
+	}
+
 	return nil
 }
 
+// escalateShutDown sends the kill escalation signal to the command's process
+// group and cgroup if either is still running after the escalation delay. The
+// command's exit is only reported once its process group exited, so children
+// that outlive the command are escalated to as well.
+func (e *UniversalExecutor) escalateShutDown() {
+	select {
+	case <-e.processExited:
+		return
+	case <-time.After(e.command.KillEscalationDelay):
+	}
+
+	sig := e.command.KillEscalationSignal
+	e.logger.Printf("[DEBUG] executor: command still running %v after shutdown; sending %v", e.command.KillEscalationDelay, sig)
+	if err := e.signalProcessGroup(sig); err != nil {
+		e.logger.Printf("[WARN] executor: failed to send %v to process group: %v", sig, err)
+	}
+	if e.trackingCgroup() {
+		pids, err := e.taskPids()
+		if err != nil {
+			e.logger.Printf("[WARN] executor: failed to find processes in cgroup: %v", err)
+			return
+		}
+		for _, pid := range pids {
+			if p, err := os.FindProcess(pid); err == nil {
+				p.Signal(sig)
+			}
+		}
+	}
+}
+
+// pidsRSS returns the summed RSS of the pids launched by the executor.
+func (e *UniversalExecutor) pidsRSS() uint64 {
+	e.pidLock.RLock()
+	pids := make([]int, 0, len(e.pids))
+	for pid := range e.pids {
+		pids = append(pids, pid)
+	}
+	e.pidLock.RUnlock()
+
+	var rss uint64
+	for _, pid := range pids {
+		p, err := process.NewProcess(int32(pid))
+		if err != nil {
+			continue
+		}
+		if memInfo, err := p.MemoryInfo(); err == nil {
+			rss += memInfo.RSS
+		}
+	}
+	return rss
+}
+
 // pidStats returns the resource usage stats per pid
 func (e *UniversalExecutor) pidStats() (map[string]*cstructs.ResourceUsage, error) {
 	stats := make(map[string]*cstructs.ResourceUsage)
@@ -536,6 +1675,11 @@ func (e *UniversalExecutor) pidStats() (map[string]*cstructs.ResourceUsage, erro
 			ms.RSS = memInfo.RSS
 			ms.Swap = memInfo.Swap
 			ms.Measured = ExecutorBasicMeasuredMemStats
+			if major, minor, ok := pidPageFaults(pid); ok {
+				ms.MajorPageFaults = major
+				ms.MinorPageFaults = minor
+				ms.Measured = append(append([]string{}, ExecutorBasicMeasuredMemStats...), ExecutorPageFaultMeasuredMemStats...)
+			}
 		}
 
 		cs := &cstructs.CpuStats{}
@@ -553,6 +1697,30 @@ func (e *UniversalExecutor) pidStats() (map[string]*cstructs.ResourceUsage, erro
 	return stats, nil
 }
 
+// setListenPid starts the command through a shell that sets LISTEN_PID to its
+// own PID and execs the command, which keeps the PID, as socket activated
+// commands may check that the socket was meant for them. The PID is only known
+// once the command started, so the command runs without LISTEN_PID if the
+// shell isn't found.
+func (e *UniversalExecutor) setListenPid() {
+	shell := listenPidShell
+	if e.fsIsolationEnforced {
+		shell = filepath.Join(e.ctx.TaskDir, listenPidShell)
+	}
+	if _, err := os.Lstat(shell); err != nil {
+		e.logger.Printf("[WARN] executor: not setting LISTEN_PID as %s wasn't found: %v", listenPidShell, err)
+		return
+	}
+
+	// The shell would look up a command without a slash in the PATH
+	path := e.cmd.Path
+	if !strings.Contains(path, "/") {
+		path = "./" + path
+	}
+	e.cmd.Args = append([]string{listenPidShell, "-c", listenPidScript, path}, e.cmd.Args[1:]...)
+	e.cmd.Path = listenPidShell
+}
+
 // lookupBin looks for path to the binary to run by looking for the binary in
 // the following locations, in-order: task/local/, task/, based on host $PATH.
 // The return path is absolute.
@@ -730,6 +1898,24 @@ func (e *UniversalExecutor) scanPids(parentPid int, allPids []ps.Process) (map[i
 	return res, nil
 }
 
+// joinMeasured returns the union of the lists of measured stats.
+func joinMeasured(a, b []string) []string {
+	joined := a
+	for _, m := range b {
+		found := false
+		for _, j := range joined {
+			if j == m {
+				found = true
+				break
+			}
+		}
+		if !found {
+			joined = append(append([]string{}, joined...), m)
+		}
+	}
+	return joined
+}
+
 // aggregatedResourceUsage aggregates the resource usage of all the pids and
 // returns a TaskResourceUsage data point
 func (e *UniversalExecutor) aggregatedResourceUsage(pidStats map[string]*cstructs.ResourceUsage) *cstructs.TaskResourceUsage {
@@ -737,8 +1923,10 @@ func (e *UniversalExecutor) aggregatedResourceUsage(pidStats map[string]*cstruct
 	var (
 		systemModeCPU, userModeCPU, percent float64
 		totalRSS, totalSwap                 uint64
+		majorFaults, minorFaults            uint64
 	)
 
+	measuredMem := ExecutorBasicMeasuredMemStats
 	for _, pidStat := range pidStats {
 		systemModeCPU += pidStat.CpuStats.SystemMode
 		userModeCPU += pidStat.CpuStats.UserMode
@@ -746,6 +1934,9 @@ func (e *UniversalExecutor) aggregatedResourceUsage(pidStats map[string]*cstruct
 
 		totalRSS += pidStat.MemoryStats.RSS
 		totalSwap += pidStat.MemoryStats.Swap
+		majorFaults += pidStat.MemoryStats.MajorPageFaults
+		minorFaults += pidStat.MemoryStats.MinorPageFaults
+		measuredMem = joinMeasured(measuredMem, pidStat.MemoryStats.Measured)
 	}
 
 	totalCPU := &cstructs.CpuStats{
@@ -757,9 +1948,11 @@ func (e *UniversalExecutor) aggregatedResourceUsage(pidStats map[string]*cstruct
 	}
 
 	totalMemory := &cstructs.MemoryStats{
-		RSS:      totalRSS,
-		Swap:     totalSwap,
-		Measured: ExecutorBasicMeasuredMemStats,
+		RSS:             totalRSS,
+		Swap:            totalSwap,
+		MajorPageFaults: majorFaults,
+		MinorPageFaults: minorFaults,
+		Measured:        measuredMem,
 	}
 
 	resourceUsage := cstructs.ResourceUsage{
@@ -779,6 +1972,11 @@ func (e *UniversalExecutor) Signal(s os.Signal) error {
 		return fmt.Errorf("Task not yet run")
 	}
 
+	if e.command.SignalProcessGroup {
+		e.logger.Printf("[DEBUG] executor: sending signal %s to process group %d", s, e.cmd.Process.Pid)
+		return e.signalProcessGroup(s)
+	}
+
 	e.logger.Printf("[DEBUG] executor: sending signal %s to PID %d", s, e.cmd.Process.Pid)
 	err := e.cmd.Process.Signal(s)
 	if err != nil {
@@ -788,3 +1986,30 @@ func (e *UniversalExecutor) Signal(s os.Signal) error {
 
 	return nil
 }
+
+// SignalGroup sends the passed signal to every process of the task: the
+// processes in its cgroup or, without resource limits, the descendants of the
+// executor. The executor itself isn't signaled.
+func (e *UniversalExecutor) SignalGroup(s os.Signal) error {
+	if e.cmd.Process == nil {
+		return fmt.Errorf("Task not yet run")
+	}
+
+	pids, err := e.taskPids()
+	if err != nil {
+		return fmt.Errorf("failed to list the processes of the task: %v", err)
+	}
+
+	e.logger.Printf("[DEBUG] executor: sending signal %s to PIDs %v", s, pids)
+	var mErr multierror.Error
+	for _, pid := range pids {
+		proc, err := os.FindProcess(pid)
+		if err != nil {
+			continue
+		}
+		if err := proc.Signal(s); err != nil && err.Error() != finishedErr {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("failed to signal PID %d: %v", pid, err))
+		}
+	}
+	return mErr.ErrorOrNil()
+}
@@ -3,6 +3,7 @@
 package executor
 
 import (
+	"fmt"
 	"os"
 
 	cstructs "github.com/hashicorp/nomad/client/structs"
@@ -21,14 +22,117 @@ func (e *UniversalExecutor) runAs(userid string) error {
 	return nil
 }
 
+func (e *UniversalExecutor) setGroups(groups []uint32) error {
+	return fmt.Errorf("setting supplementary groups is only supported on Linux")
+}
+
+func (e *UniversalExecutor) addGroups(group string, extra []string) error {
+	return fmt.Errorf("setting the group and groups of a command is only supported on Linux")
+}
+
 func (e *UniversalExecutor) applyLimits(pid int) error {
 	return nil
 }
 
+// openCgroupProcs returns no cgroups as cgroups are only used on Linux.
+func (e *UniversalExecutor) openCgroupProcs() ([]*os.File, error) {
+	return nil, nil
+}
+
+func (e *UniversalExecutor) setProcessGroup() {}
+
+func (e *UniversalExecutor) setUserNamespace(ns *UserNamespace) error {
+	return fmt.Errorf("user namespaces are only supported on Linux")
+}
+
+// signalProcessGroup only signals the command as process groups are only
+// used on Linux.
+func (e *UniversalExecutor) signalProcessGroup(sig os.Signal) error {
+	if err := e.cmd.Process.Signal(sig); err != nil && err.Error() != finishedErr {
+		return err
+	}
+	return nil
+}
+
+// processGroupRunning always reports that the process group exited as
+// process groups are only used on Linux.
+func (e *UniversalExecutor) processGroupRunning() bool {
+	return false
+}
+
+func (e *UniversalExecutor) adjustOOMScore(adj int) (func(), error) {
+	return func() {}, nil
+}
+
+// HardUlimit returns an error as ulimits are only supported on Linux.
+func HardUlimit(name string) (uint64, error) {
+	return 0, fmt.Errorf("ulimits are only supported on Linux")
+}
+
+// openGate is never called as commands are only started through the launch
+// shim on Linux.
+func (e *UniversalExecutor) openGate(gate *launchGate, command *ExecCommand, absPath string) error {
+	return gate.open()
+}
+
+func (e *UniversalExecutor) enterNetns() (func(), error) {
+	return func() {}, nil
+}
+
+func (e *UniversalExecutor) createTaskMountns() (func(), error) {
+	return func() {}, nil
+}
+
+func (e *UniversalExecutor) enterTaskMountns() error {
+	return nil
+}
+
+func (e *UniversalExecutor) writeSecretFiles(files map[string]string) error {
+	return fmt.Errorf("secret files are only supported on Linux")
+}
+
+func (e *UniversalExecutor) removeSecretFiles() error {
+	return nil
+}
+
+func (e *UniversalExecutor) setUmask(umask string) (func(), error) {
+	return func() {}, nil
+}
+
+func (e *UniversalExecutor) setNice(nice int) (func(), error) {
+	return func() {}, nil
+}
+
+func (e *UniversalExecutor) setCapabilities(add, drop []int) (func(), error) {
+	return func() {}, nil
+}
+
+func dropCapabilities(drop []int) error {
+	return nil
+}
+
+// oomKilled always reports that no process was OOM killed as it's only
+// reported by memory cgroups.
+func (e *UniversalExecutor) oomKilled() bool {
+	return false
+}
+
 func (e *UniversalExecutor) configureIsolation() error {
 	return nil
 }
 
+// pidPageFaults isn't supported as the page faults of processes can only be
+// read on Linux.
+func pidPageFaults(pid int) (uint64, uint64, bool) {
+	return 0, 0, false
+}
+
+// pidExeced always reports that the process exec'd as it can only be read on
+// Linux.
+func pidExeced(pid int) (bool, bool) {
+	return true, true
+}
+
 func (e *UniversalExecutor) Stats() (*cstructs.TaskResourceUsage, error) {
 	pidStats, err := e.pidStats()
 	if err != nil {
@@ -37,6 +141,11 @@ func (e *UniversalExecutor) Stats() (*cstructs.TaskResourceUsage, error) {
 	return e.aggregatedResourceUsage(pidStats), nil
 }
 
+// memoryRSS returns the summed RSS of the pids launched by the executor.
+func (e *UniversalExecutor) memoryRSS() (uint64, error) {
+	return e.pidsRSS(), nil
+}
+
 func (e *UniversalExecutor) getAllPids() (map[int]*nomadPid, error) {
 	allProcesses, err := ps.Processes()
 	if err != nil {
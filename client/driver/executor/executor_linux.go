@@ -2,48 +2,409 @@ package executor
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/mitchellh/go-ps"
 	"github.com/opencontainers/runc/libcontainer/cgroups"
 	cgroupFs "github.com/opencontainers/runc/libcontainer/cgroups/fs"
 	cgroupConfig "github.com/opencontainers/runc/libcontainer/configs"
+	"golang.org/x/sys/unix"
 
+	"github.com/hashicorp/nomad/client/allocdir"
+	dstructs "github.com/hashicorp/nomad/client/driver/structs"
 	"github.com/hashicorp/nomad/client/stats"
 	cstructs "github.com/hashicorp/nomad/client/structs"
 	"github.com/hashicorp/nomad/helper/uuid"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
 
+const (
+	// cgroupRetryBaseline is the baseline time for exponential backoff when
+	// retrying failed cgroup writes
+	cgroupRetryBaseline = 50 * time.Millisecond
+
+	// cgroupRetryLimit is the limit of the exponential backoff when retrying
+	// failed cgroup writes
+	cgroupRetryLimit = time.Second
+
+	// oomScoreAdjPath is the executor's oom_score_adj inherited by commands
+	oomScoreAdjPath = "/proc/self/oom_score_adj"
+
+	// tmpfsMagic is the file system type statfs reports for a tmpfs
+	tmpfsMagic = 0x01021994
+)
+
 var (
+	// transientCgroupErrors are the errors writing to cgroup files fails
+	// with on busy nodes that are worth retrying
+	transientCgroupErrors = []syscall.Errno{syscall.EAGAIN, syscall.EBUSY, syscall.EINTR}
+
 	// The statistics the executor exposes when using cgroups
-	ExecutorCgroupMeasuredMemStats = []string{"RSS", "Cache", "Swap", "Max Usage", "Kernel Usage", "Kernel Max Usage"}
-	ExecutorCgroupMeasuredCpuStats = []string{"System Mode", "User Mode", "Throttled Periods", "Throttled Time", "Percent"}
+	ExecutorCgroupMeasuredMemStats = []string{"RSS", "Cache", "Swap", "Max Usage", "Kernel Usage", "Kernel Max Usage", "Usage", "Working Set", "Major Page Faults", "Minor Page Faults"}
+	ExecutorCgroupMeasuredCpuStats = []string{"System Mode", "User Mode", "Throttled Periods", "Throttled Time", "Throttled Percent", "Percent"}
 )
 
 // configureIsolation configures chroot and creates cgroups
 func (e *UniversalExecutor) configureIsolation() error {
 	if e.command.FSIsolation {
 		if err := e.configureChroot(); err != nil {
-			return err
+			return launchError(dstructs.StartFailureChroot, err)
 		}
 	}
 
 	if e.command.ResourceLimits {
 		if err := e.configureCgroups(e.ctx.Task.Resources); err != nil {
-			return fmt.Errorf("error creating cgroups: %v", err)
+			return launchError(dstructs.StartFailureCgroup, fmt.Errorf("error creating cgroups: %v", err))
+		}
+	}
+
+	if e.command.BridgeNetwork != nil {
+		netns, err := configureBridgeNetwork(e.command.BridgeNetwork)
+		if err != nil {
+			return launchError(dstructs.StartFailureNetwork, fmt.Errorf("error configuring network: %v", err))
+		}
+		e.resConCtx.netns = netns
+	}
+	return nil
+}
+
+// limitThreads sets the soft RLIMIT_NPROC of the current process to max. Only
+// the soft limit is lowered so that the process can still raise it up to its
+// inherited hard limit. A max of zero leaves the limit unchanged.
+func limitThreads(max int) error {
+	if max == 0 {
+		return nil
+	}
+
+	var orig unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NPROC, &orig); err != nil {
+		return fmt.Errorf("failed to get thread limit: %v", err)
+	}
+	limit := &unix.Rlimit{Cur: uint64(max), Max: orig.Max}
+	if limit.Cur > limit.Max {
+		limit.Cur = limit.Max
+	}
+	if err := unix.Setrlimit(unix.RLIMIT_NPROC, limit); err != nil {
+		return fmt.Errorf("failed to limit threads to %d: %v", max, err)
+	}
+	return nil
+}
+
+// rlimitResources maps the names of ulimits to their resources.
+var rlimitResources = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"data":       unix.RLIMIT_DATA,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nice":       unix.RLIMIT_NICE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rss":        unix.RLIMIT_RSS,
+	"rtprio":     unix.RLIMIT_RTPRIO,
+	"rttime":     unix.RLIMIT_RTTIME,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+// HardUlimit returns the hard limit of the ulimit of the current process,
+// which commands started by an executor it starts inherit.
+func HardUlimit(name string) (uint64, error) {
+	resource, ok := rlimitResources[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown ulimit %q", name)
+	}
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(resource, &limit); err != nil {
+		return 0, fmt.Errorf("failed to get ulimit %s: %v", name, err)
+	}
+	return limit.Max, nil
+}
+
+// prlimit sets the resource limit of the process. The vendored unix package
+// doesn't wrap prlimit(2).
+func prlimit(pid, resource int, limit *unix.Rlimit) error {
+	_, _, errno := unix.RawSyscall6(unix.SYS_PRLIMIT64, uintptr(pid), uintptr(resource),
+		uintptr(unsafe.Pointer(limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setUlimits sets the resource limits of the current process to the ulimits.
+func setUlimits(ulimits []*Ulimit) error {
+	for _, u := range ulimits {
+		resource, ok := rlimitResources[u.Name]
+		if !ok {
+			return fmt.Errorf("unknown ulimit %q", u.Name)
+		}
+		if err := unix.Setrlimit(resource, &unix.Rlimit{Cur: u.Soft, Max: u.Hard}); err != nil {
+			return fmt.Errorf("failed to set ulimit %s to %d:%d: %v", u.Name, u.Soft, u.Hard, err)
 		}
 	}
 	return nil
 }
 
+// raiseHardUlimits raises the hard limits of the process to those of the
+// ulimits that exceed the executor's own, which the process inherited. Only
+// a privileged process can raise them, so it's done by the executor rather
+// than by the launch shim running as the command's user.
+func raiseHardUlimits(pid int, ulimits []*Ulimit) error {
+	for _, u := range ulimits {
+		resource, ok := rlimitResources[u.Name]
+		if !ok {
+			return fmt.Errorf("unknown ulimit %q", u.Name)
+		}
+		var own unix.Rlimit
+		if err := unix.Getrlimit(resource, &own); err != nil {
+			return fmt.Errorf("failed to get ulimit %s: %v", u.Name, err)
+		}
+		if u.Hard <= own.Max {
+			continue
+		}
+		if err := prlimit(pid, resource, &unix.Rlimit{Cur: own.Cur, Max: u.Hard}); err != nil {
+			return fmt.Errorf("failed to raise the hard limit of ulimit %s to %d: %v", u.Name, u.Hard, err)
+		}
+	}
+	return nil
+}
+
+// openGate raises the hard limits of the launch shim's process as needed and
+// lets it exec the command, which it does after applying the command's
+// resource limits. The shim exits without exec'ing the command if either
+// fails.
+func (e *UniversalExecutor) openGate(gate *launchGate, command *ExecCommand, absPath string) error {
+	if err := raiseHardUlimits(e.cmd.Process.Pid, command.Ulimits); err != nil {
+		gate.abort()
+		return launchError(dstructs.StartFailureConfig, err)
+	}
+
+	err := gate.open()
+	if errno, ok := err.(syscall.Errno); ok {
+		return launchError(dstructs.StartFailureCommand, fmt.Errorf("failed to start command path=%q: %v",
+			absPath, newExecError(absPath, &os.PathError{Op: "exec", Path: absPath, Err: errno})))
+	}
+	if err != nil {
+		return launchError(dstructs.StartFailureConfig, err)
+	}
+	return nil
+}
+
+// adjustOOMScore sets the executor's oom_score_adj to adj so that the command
+// started next inherits it. The returned function restores the executor's own
+// score. An adj of zero leaves the score unchanged.
+func (e *UniversalExecutor) adjustOOMScore(adj int) (func(), error) {
+	if adj == 0 {
+		return func() {}, nil
+	}
+
+	orig, err := ioutil.ReadFile(oomScoreAdjPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read oom_score_adj: %v", err)
+	}
+	if err := ioutil.WriteFile(oomScoreAdjPath, []byte(strconv.Itoa(adj)), 0644); err != nil {
+		return nil, fmt.Errorf("failed to set oom_score_adj to %d: %v", adj, err)
+	}
+	return func() {
+		if err := ioutil.WriteFile(oomScoreAdjPath, orig, 0644); err != nil {
+			e.logger.Printf("[WARN] executor: failed to restore oom_score_adj: %v", err)
+		}
+	}, nil
+}
+
+// setUmask sets the executor's umask to the octal umask so that the command
+// started next inherits it. The returned function restores the executor's own
+// umask. An empty umask leaves it unchanged.
+func (e *UniversalExecutor) setUmask(umask string) (func(), error) {
+	if umask == "" {
+		return func() {}, nil
+	}
+
+	mask, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil || mask > 0777 {
+		return nil, fmt.Errorf("invalid umask %q", umask)
+	}
+	orig := syscall.Umask(int(mask))
+	return func() {
+		syscall.Umask(orig)
+	}, nil
+}
+
+// setNice sets the nice value of the calling goroutine's thread, which the
+// command started next from it inherits. The thread is locked to the goroutine
+// until the returned function restores its nice value. Lowering the nice value
+// below the executor's requires CAP_SYS_NICE, so that's reported as such.
+func (e *UniversalExecutor) setNice(nice int) (func(), error) {
+	if nice == 0 {
+		return func() {}, nil
+	}
+
+	runtime.LockOSThread()
+	// The raw syscall returns 20 - nice so that it's never negative
+	prio, err := unix.Getpriority(unix.PRIO_PROCESS, 0)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("failed to read nice value: %v", err)
+	}
+	orig := 20 - prio
+	if err := unix.Setpriority(unix.PRIO_PROCESS, 0, nice); err != nil {
+		runtime.UnlockOSThread()
+		if err == unix.EACCES || err == unix.EPERM {
+			return nil, fmt.Errorf("failed to set nice to %d: %v; nice values below %d require the client to run as root or with CAP_SYS_NICE", nice, err, orig)
+		}
+		return nil, fmt.Errorf("failed to set nice to %d: %v", nice, err)
+	}
+	return func() {
+		// Raising the priority again requires CAP_SYS_NICE, so a thread that
+		// can't be restored stays locked for it to exit with the goroutine
+		if err := unix.Setpriority(unix.PRIO_PROCESS, 0, orig); err != nil {
+			e.logger.Printf("[DEBUG] executor: failed to restore nice value: %v", err)
+			return
+		}
+		runtime.UnlockOSThread()
+	}, nil
+}
+
+// setCapabilities grants the added capabilities to the command as ambient
+// capabilities and removes the dropped ones from the bounding set of the
+// calling goroutine's thread, so that the command started next from it can't
+// gain them. The bounding set can't be raised again, so the returned function
+// keeps the thread locked to the goroutine for it to exit along with it.
+func (e *UniversalExecutor) setCapabilities(add, drop []int) (func(), error) {
+	if len(add) != 0 {
+		ambient := make([]uintptr, len(add))
+		for i, bit := range add {
+			ambient[i] = uintptr(bit)
+		}
+		if e.cmd.SysProcAttr == nil {
+			e.cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		e.cmd.SysProcAttr.AmbientCaps = ambient
+	}
+	if err := dropCapabilities(drop); err != nil {
+		return nil, err
+	}
+	return func() {}, nil
+}
+
+// dropCapabilities removes the capabilities from the bounding set of the
+// calling goroutine's thread, which stays locked to the goroutine for it to
+// exit along with it. Commands executed within the task are started through
+// it so that they can't gain the capabilities the task dropped either.
+func dropCapabilities(drop []int) error {
+	if len(drop) == 0 {
+		return nil
+	}
+	runtime.LockOSThread()
+	for _, bit := range drop {
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(bit), 0, 0, 0); err != nil {
+			return fmt.Errorf("failed to drop capability %d: %v", bit, err)
+		}
+	}
+	return nil
+}
+
+// memoryRSS returns the resident memory of the command: the anonymous memory
+// charged to its memory cgroup or, without resource limits, the summed RSS of
+// its processes. It's read directly rather than through the stats, which
+// also sample the command's CPU usage.
+func (e *UniversalExecutor) memoryRSS() (uint64, error) {
+	if !e.command.ResourceLimits {
+		return e.pidsRSS(), nil
+	}
+
+	// Cgroup v1 reports the anonymous memory as rss
+	key := "rss"
+	path, ok := e.resConCtx.cgPaths["memory"]
+	if unified, isUnified := e.resConCtx.cgPaths[unifiedCgroupKey]; isUnified {
+		key, path = "anon", unified
+	} else if !ok {
+		return 0, fmt.Errorf("command has no memory cgroup")
+	}
+	memory, err := readCgroupKeyValues(filepath.Join(path, "memory.stat"))
+	if err != nil {
+		return 0, err
+	}
+	return memory[key], nil
+}
+
+// oomKilled returns whether the OOM killer killed a process in the command's
+// memory cgroup.
+func (e *UniversalExecutor) oomKilled() bool {
+	file := filepath.Join(e.resConCtx.cgPaths["memory"], "memory.oom_control")
+	if path, ok := e.resConCtx.cgPaths[unifiedCgroupKey]; ok {
+		file = filepath.Join(path, "memory.events")
+	} else if _, ok := e.resConCtx.cgPaths["memory"]; !ok {
+		return false
+	}
+	control, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	kills, ok := parseOOMKills(string(control))
+	return ok && kills > 0
+}
+
+// parseOOMKills returns the oom_kill counter of the contents of a cgroup's
+// memory.oom_control, or memory.events in the unified hierarchy, and whether
+// the kernel reports it.
+func parseOOMKills(control string) (uint64, bool) {
+	for _, line := range strings.Split(control, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "oom_kill" {
+			continue
+		}
+		kills, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return kills, true
+	}
+	return 0, false
+}
+
+// setProcessGroup starts the command in a process group of its own.
+func (e *UniversalExecutor) setProcessGroup() {
+	if e.cmd.SysProcAttr == nil {
+		e.cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	e.cmd.SysProcAttr.Setpgid = true
+}
+
+// signalProcessGroup sends the signal to every process in the command's
+// process group, including children that were reparented.
+func (e *UniversalExecutor) signalProcessGroup(sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal %v", sig)
+	}
+	if err := unix.Kill(-e.cmd.Process.Pid, s); err != nil && err != unix.ESRCH {
+		return fmt.Errorf("failed to signal process group %d: %v", e.cmd.Process.Pid, err)
+	}
+	return nil
+}
+
+// processGroupRunning returns whether any process remains in the command's
+// process group.
+func (e *UniversalExecutor) processGroupRunning() bool {
+	return unix.Kill(-e.cmd.Process.Pid, 0) != unix.ESRCH
+}
+
 // applyLimits puts a process in a pre-configured cgroup
 func (e *UniversalExecutor) applyLimits(pid int) error {
 	if !e.command.ResourceLimits {
@@ -52,13 +413,13 @@ func (e *UniversalExecutor) applyLimits(pid int) error {
 
 	// Entering the process in the cgroup
 	manager := getCgroupManager(e.resConCtx.groups, nil)
-	if err := manager.Apply(pid); err != nil {
+	if err := e.retryCgroupWrite(func() error { return manager.Apply(pid) }); err != nil {
 		e.logger.Printf("[ERR] executor: error applying pid to cgroup: %v", err)
 		return err
 	}
 	e.resConCtx.cgPaths = manager.GetPaths()
 	cgConfig := cgroupConfig.Config{Cgroups: e.resConCtx.groups}
-	if err := manager.Set(&cgConfig); err != nil {
+	if err := e.retryCgroupWrite(func() error { return manager.Set(&cgConfig) }); err != nil {
 		e.logger.Printf("[ERR] executor: error setting cgroup config: %v", err)
 		if er := DestroyCgroup(e.resConCtx.groups, e.resConCtx.cgPaths, os.Getpid()); er != nil {
 			e.logger.Printf("[ERR] executor: error destroying cgroup: %v", er)
@@ -68,6 +429,72 @@ func (e *UniversalExecutor) applyLimits(pid int) error {
 	return nil
 }
 
+// openCgroupProcs opens the cgroup.procs files of the command's cgroups for
+// processes exec'd within the task to join them. None are returned if the
+// command isn't in cgroups.
+func (e *UniversalExecutor) openCgroupProcs() ([]*os.File, error) {
+	if !e.command.ResourceLimits {
+		return nil, nil
+	}
+
+	var files []*os.File
+	opened := make(map[string]struct{}, len(e.resConCtx.cgPaths))
+	for _, path := range e.resConCtx.cgPaths {
+		if _, ok := opened[path]; ok || path == "" {
+			continue
+		}
+		opened[path] = struct{}{}
+		f, err := os.OpenFile(filepath.Join(path, "cgroup.procs"), os.O_WRONLY, 0)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			closeFiles(files)
+			return nil, fmt.Errorf("failed to open the cgroup %q of the task: %v", path, err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// retryCgroupWrite calls write, retrying it with backoff up to the command's
+// CgroupRetries times while it fails with a transient error. The last error
+// is returned once the retries are exhausted. Errors such as a controller not
+// being available aren't retried.
+func (e *UniversalExecutor) retryCgroupWrite(write func() error) error {
+	backoff := cgroupRetryBaseline
+	for attempt := 0; ; attempt++ {
+		err := write()
+		if err == nil || !isTransientCgroupError(err) || attempt >= e.command.CgroupRetries {
+			return err
+		}
+
+		e.cgroupRetries++
+		e.logger.Printf("[DEBUG] executor: retrying cgroup write in %v after transient error: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > cgroupRetryLimit {
+			backoff = cgroupRetryLimit
+		}
+	}
+}
+
+// isTransientCgroupError returns whether writing to cgroup files failed with
+// a transient error. libcontainer doesn't preserve the underlying errors so
+// they're matched by their messages.
+func isTransientCgroupError(err error) bool {
+	if cgroups.IsNotFound(err) {
+		return false
+	}
+	msg := err.Error()
+	for _, errno := range transientCgroupErrors {
+		if strings.HasSuffix(msg, errno.Error()) {
+			return true
+		}
+	}
+	return false
+}
+
 // configureCgroups converts a Nomad Resources specification into the equivalent
 // cgroup configuration. It returns an error if the resources are invalid.
 func (e *UniversalExecutor) configureCgroups(resources *structs.Resources) error {
@@ -79,11 +506,35 @@ func (e *UniversalExecutor) configureCgroups(resources *structs.Resources) error
 	// TODO: verify this is needed for things like network access
 	e.resConCtx.groups.Resources.AllowAllDevices = true
 
+	// Commands listing devices may only access them and the default devices
+	if len(e.command.Devices) != 0 {
+		allowed := append([]*cgroupConfig.Device{}, cgroupConfig.DefaultAllowedDevices...)
+		for _, d := range e.command.Devices {
+			allowed = append(allowed, &cgroupConfig.Device{
+				Type:        d.Type,
+				Path:        d.Path,
+				Major:       d.Major,
+				Minor:       d.Minor,
+				Permissions: d.Permissions,
+				Allow:       true,
+			})
+		}
+		e.resConCtx.groups.Resources.AllowAllDevices = false
+		e.resConCtx.groups.Resources.AllowedDevices = allowed
+	}
+
 	if resources.MemoryMB > 0 {
 		// Total amount of memory allowed to consume
 		e.resConCtx.groups.Resources.Memory = int64(resources.MemoryMB * 1024 * 1024)
 		// Disable swap to avoid issues on the machine
 		e.resConCtx.groups.Resources.MemorySwap = int64(-1)
+
+		// Limiting memory and swap together to the memory limit leaves no
+		// room to swap
+		if e.command.NoSwap {
+			e.resConCtx.groups.Resources.MemorySwap = e.resConCtx.groups.Resources.Memory
+		}
+		e.resConCtx.groups.Resources.OomKillDisable = e.command.OOMDisable
 	}
 
 	if resources.CPU < 2 {
@@ -101,6 +552,24 @@ func (e *UniversalExecutor) configureCgroups(resources *structs.Resources) error
 
 		e.resConCtx.groups.Resources.BlkioWeight = uint16(resources.IOPS)
 	}
+	if e.command.IOWeight != 0 {
+		e.resConCtx.groups.Resources.BlkioWeight = e.command.IOWeight
+	}
+	for _, l := range e.command.IOLimits {
+		if l.ReadBps != 0 {
+			e.resConCtx.groups.Resources.BlkioThrottleReadBpsDevice = append(e.resConCtx.groups.Resources.BlkioThrottleReadBpsDevice,
+				cgroupConfig.NewThrottleDevice(l.Major, l.Minor, l.ReadBps))
+		}
+		if l.WriteBps != 0 {
+			e.resConCtx.groups.Resources.BlkioThrottleWriteBpsDevice = append(e.resConCtx.groups.Resources.BlkioThrottleWriteBpsDevice,
+				cgroupConfig.NewThrottleDevice(l.Major, l.Minor, l.WriteBps))
+		}
+	}
+
+	// Pin the task to the requested cores
+	if e.command.CpusetCpus != "" {
+		e.resConCtx.groups.Resources.CpusetCpus = e.command.CpusetCpus
+	}
 
 	return nil
 }
@@ -128,14 +597,27 @@ func (e *UniversalExecutor) Stats() (*cstructs.TaskResourceUsage, error) {
 	maxUsage := stats.MemoryStats.Usage.MaxUsage
 	rss := stats.MemoryStats.Stats["rss"]
 	cache := stats.MemoryStats.Stats["cache"]
+	usage := stats.MemoryStats.Usage.Usage
+
+	// The cgroup keeps counting the faults of processes that exited. pgfault
+	// counts all faults including the major ones.
+	majorFaults := stats.MemoryStats.Stats["pgmajfault"]
+	var minorFaults uint64
+	if faults := stats.MemoryStats.Stats["pgfault"]; faults > majorFaults {
+		minorFaults = faults - majorFaults
+	}
 	ms := &cstructs.MemoryStats{
-		RSS:            rss,
-		Cache:          cache,
-		Swap:           swap.Usage,
-		MaxUsage:       maxUsage,
-		KernelUsage:    stats.MemoryStats.KernelUsage.Usage,
-		KernelMaxUsage: stats.MemoryStats.KernelUsage.MaxUsage,
-		Measured:       ExecutorCgroupMeasuredMemStats,
+		RSS:             rss,
+		Cache:           cache,
+		Swap:            swap.Usage,
+		MaxUsage:        maxUsage,
+		KernelUsage:     stats.MemoryStats.KernelUsage.Usage,
+		KernelMaxUsage:  stats.MemoryStats.KernelUsage.MaxUsage,
+		Usage:           usage,
+		WorkingSet:      workingSet(usage, stats.MemoryStats.Stats),
+		MajorPageFaults: majorFaults,
+		MinorPageFaults: minorFaults,
+		Measured:        ExecutorCgroupMeasuredMemStats,
 	}
 
 	// CPU Related Stats
@@ -150,6 +632,7 @@ func (e *UniversalExecutor) Stats() (*cstructs.TaskResourceUsage, error) {
 		Percent:          totalPercent,
 		ThrottledPeriods: stats.CpuStats.ThrottlingData.ThrottledPeriods,
 		ThrottledTime:    stats.CpuStats.ThrottlingData.ThrottledTime,
+		ThrottledPercent: e.throttleStats.Percent(statsConsumerClient, stats.CpuStats.ThrottlingData.Periods, stats.CpuStats.ThrottlingData.ThrottledPeriods),
 		TotalTicks:       e.systemCpuStats.TicksConsumed(totalPercent),
 		Measured:         ExecutorCgroupMeasuredCpuStats,
 	}
@@ -166,6 +649,144 @@ func (e *UniversalExecutor) Stats() (*cstructs.TaskResourceUsage, error) {
 	return &taskResUsage, nil
 }
 
+// workingSet returns the memory usage of a cgroup excluding its inactive file
+// cache, given the keys of its memory.stat. Cgroup v1 counts the cache of the
+// cgroup's descendants in total_inactive_file while v2 counts it in
+// inactive_file. The cache is reclaimable, so it's excluded to not overstate
+// the memory the task needs.
+func workingSet(usage uint64, memoryStat map[string]uint64) uint64 {
+	inactive, ok := memoryStat["total_inactive_file"]
+	if !ok {
+		inactive = memoryStat["inactive_file"]
+	}
+	if inactive > usage {
+		return 0
+	}
+	return usage - inactive
+}
+
+// pidPageFaults returns the major and minor page faults of the process read
+// from /proc/<pid>/stat. They include the faults of the process's children
+// that exited and were waited for so that the faults of the task don't drop
+// when its processes exit.
+func pidPageFaults(pid int) (uint64, uint64, bool) {
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, 0, false
+	}
+	return parseProcStatFaults(string(stat))
+}
+
+// parseProcStatFaults returns the major and minor page faults of a process
+// and its waited for children from the contents of its /proc/<pid>/stat file.
+func parseProcStatFaults(stat string) (uint64, uint64, bool) {
+	i := strings.LastIndex(stat, ")")
+	if i == -1 {
+		return 0, 0, false
+	}
+
+	// The fields following the command name start at the state, so minflt,
+	// cminflt, majflt and cmajflt are the 8th to 11th
+	fields := strings.Fields(stat[i+1:])
+	if len(fields) < 11 {
+		return 0, 0, false
+	}
+	var faults [4]uint64
+	for j := range faults {
+		v, err := strconv.ParseUint(fields[7+j], 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		faults[j] = v
+	}
+	return faults[2] + faults[3], faults[0] + faults[1], true
+}
+
+// pidExeced returns whether the process exec'd, which is the case once its
+// executable isn't the executor's anymore, and whether it still exists.
+func pidExeced(pid int) (bool, bool) {
+	exe, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "exe"))
+	if err != nil {
+		return false, false
+	}
+	self, err := os.Readlink("/proc/self/exe")
+	return err != nil || exe != self, true
+}
+
+// setGroups sets the supplementary groups of the command while keeping the
+// executor's user and group.
+func (e *UniversalExecutor) setGroups(groups []uint32) error {
+	if e.cmd.SysProcAttr == nil {
+		e.cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	if e.cmd.SysProcAttr.Credential == nil {
+		e.cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid: uint32(os.Getuid()),
+			Gid: uint32(os.Getgid()),
+		}
+	}
+	e.cmd.SysProcAttr.Credential.Groups = groups
+	return nil
+}
+
+// addGroups overrides the primary group of the command and adds the extra
+// groups to its supplementary groups, resolving them by name or ID.
+func (e *UniversalExecutor) addGroups(group string, extra []string) error {
+	if e.cmd.SysProcAttr == nil {
+		e.cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cred := e.cmd.SysProcAttr.Credential
+	if cred == nil {
+		groups, err := os.Getgroups()
+		if err != nil {
+			return fmt.Errorf("Unable to lookup the executor's group membership: %v", err)
+		}
+		cred = &syscall.Credential{
+			Uid: uint32(os.Getuid()),
+			Gid: uint32(os.Getgid()),
+		}
+		for _, g := range groups {
+			cred.Groups = append(cred.Groups, uint32(g))
+		}
+		e.cmd.SysProcAttr.Credential = cred
+	}
+
+	if group != "" {
+		gid, err := lookupGroupID(group)
+		if err != nil {
+			return err
+		}
+		cred.Gid = gid
+	}
+	for _, g := range extra {
+		gid, err := lookupGroupID(g)
+		if err != nil {
+			return err
+		}
+		cred.Groups = append(cred.Groups, gid)
+	}
+
+	e.logger.Printf("[DEBUG] executor: running with group %d and group membership in %v", cred.Gid, cred.Groups)
+	return nil
+}
+
+// lookupGroupID resolves a group name or ID to the group's ID.
+func lookupGroupID(group string) (uint32, error) {
+	if gid, err := strconv.ParseUint(group, 10, 32); err == nil {
+		return uint32(gid), nil
+	}
+
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to identify group %v: %v", group, err)
+	}
+	gid, err := strconv.ParseUint(g.Gid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to convert groupid of group %v to uint32: %v", group, err)
+	}
+	return uint32(gid), nil
+}
+
 // runAs takes a user id as a string and looks up the user, and sets the command
 // to execute as that user.
 func (e *UniversalExecutor) runAs(userid string) error {
@@ -216,6 +837,58 @@ func (e *UniversalExecutor) runAs(userid string) error {
 	return nil
 }
 
+// capSysChroot is the bit of CAP_SYS_CHROOT in the capability sets.
+const capSysChroot = 18
+
+// setUserNamespace starts the command in a user namespace of its own whose
+// ids are mapped to the host's ids of ns. The command's credential is within
+// the namespace, so its ids must be mapped. Without a user it runs as root of
+// the namespace.
+func (e *UniversalExecutor) setUserNamespace(ns *UserNamespace) error {
+	if ns.Size == 0 {
+		return fmt.Errorf("user namespace must map at least one id")
+	}
+	if e.cmd.SysProcAttr == nil {
+		e.cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	attr := e.cmd.SysProcAttr
+	if attr.Credential == nil {
+		attr.Credential = &syscall.Credential{}
+	}
+	if attr.Credential.Uid >= ns.Size {
+		return fmt.Errorf("uid %d isn't mapped into the user namespace of %d ids", attr.Credential.Uid, ns.Size)
+	}
+	if attr.Credential.Gid >= ns.Size {
+		return fmt.Errorf("gid %d isn't mapped into the user namespace of %d ids", attr.Credential.Gid, ns.Size)
+	}
+	for _, g := range attr.Credential.Groups {
+		if g >= ns.Size {
+			return fmt.Errorf("supplementary gid %d isn't mapped into the user namespace of %d ids", g, ns.Size)
+		}
+	}
+
+	// Root of the namespace holds every capability within it. The task's
+	// root isn't pivoted in a mount namespace of its own, so CAP_SYS_CHROOT
+	// would let it escape the chroot by chrooting again. The namespace
+	// starts out with a full bounding set, so the launch shim drops it
+	// within the namespace along with the capabilities the task dropped.
+	for _, bit := range e.command.CapAdd {
+		if bit == capSysChroot {
+			return fmt.Errorf("CAP_SYS_CHROOT can't be added to tasks in a user namespace")
+		}
+	}
+	e.command.CapDrop = append(e.command.CapDrop, capSysChroot)
+
+	// The maps are written to /proc/<pid>/uid_map and gid_map before the
+	// command changes its credential. As the executor is privileged,
+	// setgroups stays allowed for the supplementary groups.
+	attr.Cloneflags |= syscall.CLONE_NEWUSER
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: int(ns.UID), Size: int(ns.Size)}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: int(ns.GID), Size: int(ns.Size)}}
+	attr.GidMappingsEnableSetgroups = true
+	return nil
+}
+
 // configureChroot configures a chroot
 func (e *UniversalExecutor) configureChroot() error {
 	if e.cmd.SysProcAttr == nil {
@@ -228,6 +901,154 @@ func (e *UniversalExecutor) configureChroot() error {
 	return nil
 }
 
+// writeSecretFiles writes the files to the task's secrets dir, readable only by
+// the command's user, so that the secrets aren't in the command's environment.
+// The secrets dir must be a tmpfs so that they're never written to disk.
+func (e *UniversalExecutor) writeSecretFiles(files map[string]string) error {
+	dir := filepath.Join(e.ctx.TaskDir, allocdir.TaskSecrets)
+	var fs unix.Statfs_t
+	if err := unix.Statfs(dir, &fs); err != nil {
+		return fmt.Errorf("failed to stat secrets dir: %v", err)
+	}
+	if fs.Type != tmpfsMagic {
+		return fmt.Errorf("secrets dir %q isn't a tmpfs; secret files require the client to run as root", dir)
+	}
+
+	uid, gid := e.commandOwner()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to replace secret file %q: %v", name, err)
+		}
+		e.secretFiles = append(e.secretFiles, path)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+		if err != nil {
+			return fmt.Errorf("failed to create secret file %q: %v", name, err)
+		}
+		if err := f.Chown(uid, gid); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to chown secret file %q: %v", name, err)
+		}
+		if _, err := f.WriteString(files[name]); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to write secret file %q: %v", name, err)
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to write secret file %q: %v", name, err)
+		}
+	}
+	e.logger.Printf("[DEBUG] executor: wrote secret files %v owned by %d:%d", names, uid, gid)
+	return nil
+}
+
+// removeSecretFiles removes the secret files written for the command.
+func (e *UniversalExecutor) removeSecretFiles() error {
+	var merr multierror.Error
+	for _, path := range e.secretFiles {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			merr.Errors = append(merr.Errors, fmt.Errorf("failed to remove secret file %q: %v", filepath.Base(path), err))
+		}
+	}
+	e.secretFiles = nil
+	return merr.ErrorOrNil()
+}
+
+// commandOwner returns the host's ids of the user and group the command runs
+// as, mapping the ids of its user namespace, if any.
+func (e *UniversalExecutor) commandOwner() (int, int) {
+	uid, gid := os.Getuid(), os.Getgid()
+	if attr := e.cmd.SysProcAttr; attr != nil && attr.Credential != nil {
+		uid, gid = int(attr.Credential.Uid), int(attr.Credential.Gid)
+	}
+	if ns := e.command.UserNamespace; ns != nil {
+		uid += int(ns.UID)
+		gid += int(ns.GID)
+	}
+	return uid, gid
+}
+
+// needsMountns returns whether the command runs in a mount namespace of its
+// own, which holds its tmpfs mounts and the read-only bind mount of its root.
+func (e *UniversalExecutor) needsMountns() bool {
+	return e.command.FSIsolation && (e.command.ReadonlyRootfs || len(e.command.Tmpfs) != 0)
+}
+
+// createTaskMountns moves the calling goroutine's thread into a mount
+// namespace of its own if the command needs one, so that the command started
+// next from it is created within the namespace. The command's tmpfs are
+// mounted into the task dir and, if its root is read-only, the task dir is
+// bind mounted read-only over itself. The mounts within the task dir, such as
+// the alloc dir and the tmpfs, are bound along with it and keep their own
+// flags. The host's task dir stays writable for the client and none of the
+// mounts are visible to it. The namespace can't be left again, so the
+// returned function keeps the thread locked to the goroutine for it to exit
+// along with it.
+func (e *UniversalExecutor) createTaskMountns() (func(), error) {
+	if !e.needsMountns() {
+		return func() {}, nil
+	}
+
+	runtime.LockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("failed to create mount namespace: %v", err)
+	}
+
+	// Mounts made within the namespace mustn't propagate to the host
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_SLAVE, ""); err != nil {
+		return nil, fmt.Errorf("failed to isolate mount namespace: %v", err)
+	}
+	dir := e.ctx.TaskDir
+	for _, m := range e.command.Tmpfs {
+		rel := strings.TrimPrefix(filepath.Clean(m.TaskPath), "/")
+		if err := allocdir.MountTmpfsBeneath(dir, rel, m.SizeMB); err != nil {
+			return nil, fmt.Errorf("failed to mount tmpfs at %q: %v", m.TaskPath, err)
+		}
+	}
+	if !e.command.ReadonlyRootfs {
+		return func() {}, nil
+	}
+	if err := unix.Mount(dir, dir, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return nil, fmt.Errorf("failed to bind mount task dir: %v", err)
+	}
+	if err := unix.Mount("", dir, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+		return nil, fmt.Errorf("failed to remount task dir read-only: %v", err)
+	}
+	return func() {}, nil
+}
+
+// enterTaskMountns moves the calling goroutine's thread into the mount
+// namespace of the command, if it has one, so that commands executed within
+// the task see the same root and tmpfs. Like createTaskMountns, the thread
+// stays locked to the goroutine for it to exit along with it.
+func (e *UniversalExecutor) enterTaskMountns() error {
+	if e.cmd.Process == nil || !e.needsMountns() {
+		return nil
+	}
+
+	runtime.LockOSThread()
+	// Joining a mount namespace requires the thread's root and working
+	// directory not to be shared with the executor's other threads
+	if err := unix.Unshare(unix.CLONE_FS); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to unshare file system attributes: %v", err)
+	}
+	ns, err := os.Open(fmt.Sprintf("/proc/%d/ns/mnt", e.cmd.Process.Pid))
+	if err != nil {
+		return fmt.Errorf("failed to open the task's mount namespace: %v", err)
+	}
+	defer ns.Close()
+	if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNS); err != nil {
+		return fmt.Errorf("failed to enter the task's mount namespace: %v", err)
+	}
+	return nil
+}
+
 // getAllPids returns the pids of all the processes spun up by the executor. We
 // use the libcontainer apis to get the pids when the user is using cgroup
 // isolation and we scan the entire process table if the user is not using any
@@ -330,7 +1151,17 @@ func DestroyCgroup(groups *cgroupConfig.Cgroup, cgPaths map[string]string, execu
 	return mErrs.ErrorOrNil()
 }
 
-// getCgroupManager returns the correct libcontainer cgroup manager.
+// getCgroupManager returns the correct libcontainer cgroup manager. Cgroups
+// that weren't created yet are created in the cgroup v2 unified hierarchy if
+// the host only mounts it.
 func getCgroupManager(groups *cgroupConfig.Cgroup, paths map[string]string) cgroups.Manager {
+	if _, ok := paths[unifiedCgroupKey]; ok {
+		return &unifiedManager{Cgroups: groups, Paths: paths}
+	}
+	if paths == nil {
+		if mount, ok := unifiedCgroupMountpoint(); ok {
+			return &unifiedManager{Cgroups: groups, mountpoint: mount}
+		}
+	}
 	return &cgroupFs.Manager{Cgroups: groups, Paths: paths}
 }
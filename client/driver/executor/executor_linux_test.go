@@ -1,12 +1,22 @@
 package executor
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -16,8 +26,19 @@ import (
 	cstructs "github.com/hashicorp/nomad/client/structs"
 	"github.com/hashicorp/nomad/client/testutil"
 	"github.com/hashicorp/nomad/nomad/mock"
+	tu "github.com/hashicorp/nomad/testutil"
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+	"golang.org/x/sys/unix"
 )
 
+func init() {
+	// The test binary stands in for the Nomad binary the launch shim is
+	// started from
+	if len(os.Args) == 3 && os.Args[1] == LaunchShimCommand {
+		os.Exit(RunLaunchShim(os.Args[2:]))
+	}
+}
+
 // testExecutorContextWithChroot returns an ExecutorContext and AllocDir with
 // chroot. Use testExecutorContext if you don't need a chroot.
 //
@@ -190,3 +211,1704 @@ func TestExecutor_ClientCleanup(t *testing.T) {
 		t.Fatalf("Expected size: %v, actual: %v", finfo.Size(), finfo1.Size())
 	}
 }
+
+func TestExecutor_IsTransientCgroupError(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		err       error
+		transient bool
+	}{
+		{fmt.Errorf("failed to write 100 to cpu.shares: write /sys/fs/cgroup/cpu/nomad/cpu.shares: %v", syscall.EBUSY), true},
+		{fmt.Errorf("failed to write 1234 to cgroup.procs: %v", syscall.EAGAIN), true},
+		{fmt.Errorf("failed to write 1234 to cgroup.procs: %v", syscall.EINTR), true},
+		{fmt.Errorf("failed to write 1234 to cgroup.procs: %v", syscall.EINVAL), false},
+		{cgroups.NewNotFoundError("cpuset"), false},
+	}
+
+	for _, c := range cases {
+		if got := isTransientCgroupError(c.err); got != c.transient {
+			t.Errorf("isTransientCgroupError(%q) = %v; want %v", c.err, got, c.transient)
+		}
+	}
+}
+
+func TestExecutor_CgroupPath(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		paths map[string]string
+		path  string
+	}{
+		{map[string]string{unifiedCgroupKey: "/sys/fs/cgroup/nomad/web", "memory": "/sys/fs/cgroup/memory/web"}, "/sys/fs/cgroup/nomad/web"},
+		{map[string]string{"cpu": "/sys/fs/cgroup/cpu/web", "memory": "/sys/fs/cgroup/memory/web"}, "/sys/fs/cgroup/memory/web"},
+		{map[string]string{"cpuset": "/sys/fs/cgroup/cpuset/web", "cpu": "/sys/fs/cgroup/cpu/web"}, "/sys/fs/cgroup/cpu/web"},
+		{map[string]string{}, ""},
+	}
+
+	for _, c := range cases {
+		ic := &dstructs.IsolationConfig{CgroupPaths: c.paths}
+		if got := CgroupPath(ic); got != c.path {
+			t.Errorf("CgroupPath(%v) = %q; want %q", c.paths, got, c.path)
+		}
+	}
+	if got := CgroupPath(nil); got != "" {
+		t.Errorf("CgroupPath(nil) = %q; want \"\"", got)
+	}
+}
+
+func TestExecutor_RetryCgroupWrite(t *testing.T) {
+	t.Parallel()
+	busy := fmt.Errorf("failed to write 1234 to cgroup.procs: %v", syscall.EBUSY)
+
+	// Transient errors are retried until the write succeeds
+	e := NewExecutor(testLogger()).(*UniversalExecutor)
+	e.command = &ExecCommand{CgroupRetries: 3}
+	calls := 0
+	err := e.retryCgroupWrite(func() error {
+		calls++
+		if calls < 3 {
+			return busy
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if calls != 3 || e.cgroupRetries != 2 {
+		t.Fatalf("got %d calls and %d retries; want 3 and 2", calls, e.cgroupRetries)
+	}
+
+	// The last error is returned once the retries are exhausted
+	e = NewExecutor(testLogger()).(*UniversalExecutor)
+	e.command = &ExecCommand{CgroupRetries: 1}
+	calls = 0
+	err = e.retryCgroupWrite(func() error {
+		calls++
+		return busy
+	})
+	if err != busy {
+		t.Fatalf("got %v; want %v", err, busy)
+	}
+	if calls != 2 {
+		t.Fatalf("got %d calls; want 2", calls)
+	}
+
+	// Other errors aren't retried
+	e = NewExecutor(testLogger()).(*UniversalExecutor)
+	e.command = &ExecCommand{CgroupRetries: 3}
+	calls = 0
+	notFound := cgroups.NewNotFoundError("cpuset")
+	err = e.retryCgroupWrite(func() error {
+		calls++
+		return notFound
+	})
+	if err != notFound || calls != 1 {
+		t.Fatalf("got %v after %d calls; want %v after 1", err, calls, notFound)
+	}
+}
+
+func TestExecutor_TrackCgroup(t *testing.T) {
+	testutil.ExecCompatible(t)
+
+	ctx, allocDir := testExecutorContextWithChroot(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The command double-forks a daemon and exits immediately
+	execCmd := ExecCommand{Cmd: "/bin/bash", Args: []string{"-c", "(/bin/sleep 2 &) ; exit 3"}}
+	execCmd.FSIsolation = true
+	execCmd.ResourceLimits = true
+	execCmd.TrackCgroup = true
+
+	start := time.Now()
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+	ps, err := executor.Wait()
+	if err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*time.Second {
+		t.Fatalf("Wait returned after %v; expected it to wait for the daemon", elapsed)
+	}
+	if ps.ExitCode != 3 {
+		t.Fatalf("got exit code %d; want the command's exit code 3", ps.ExitCode)
+	}
+
+	if err := executor.Exit(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestExecutor_TrackCgroup_ShutDown(t *testing.T) {
+	testutil.ExecCompatible(t)
+
+	ctx, allocDir := testExecutorContextWithChroot(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Background jobs of non-interactive shells ignore SIGINT so use SIGTERM
+	execCmd := ExecCommand{Cmd: "/bin/bash", Args: []string{"-c", "(/bin/sleep 100 &) ; exit 0"}}
+	execCmd.TaskKillSignal = syscall.SIGTERM
+	execCmd.FSIsolation = true
+	execCmd.ResourceLimits = true
+	execCmd.TrackCgroup = true
+
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+
+	// Shutting down must signal the daemon even though the command exited
+	time.Sleep(500 * time.Millisecond)
+	if err := executor.ShutDown(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	doneCh := make(chan struct{})
+	go func() {
+		executor.Wait()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("daemon wasn't stopped by ShutDown")
+	}
+
+	if err := executor.Exit(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestExecutor_ReapOrphans(t *testing.T) {
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	execCmd := ExecCommand{Cmd: "/bin/sh", Args: []string{"-c", "sleep 2; exit 7"}, ReapOrphans: true}
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+
+	// Every hook command orphans a background process
+	for i := 0; i < 20; i++ {
+		deadline := time.Now().Add(5 * time.Second)
+		if _, code, err := executor.Exec(deadline, "/bin/sh", []string{"-c", "/bin/true & exit 0"}); err != nil || code != 0 {
+			t.Fatalf("hook %d exited with %d: %v", i, code, err)
+		}
+	}
+
+	// The orphans are reaped rather than accumulating as zombies
+	tu.WaitForResult(func() (bool, error) {
+		zombies, err := zombieChildren("/proc", os.Getpid())
+		if err != nil {
+			return false, err
+		}
+		if len(zombies) != 0 {
+			return false, fmt.Errorf("zombies remain: %v", zombies)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// The command's own exit is still reported
+	ps, err := executor.Wait()
+	if err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+	if ps.ExitCode != 7 {
+		t.Fatalf("got exit code %d; want 7", ps.ExitCode)
+	}
+}
+
+func TestExecutor_LiveChildren(t *testing.T) {
+	t.Parallel()
+	cmd := exec.Command("/bin/sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	contains := func(pids []int) bool {
+		for _, pid := range pids {
+			if pid == cmd.Process.Pid {
+				return true
+			}
+		}
+		return false
+	}
+	live, err := liveChildren("/proc", os.Getpid())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !contains(live) {
+		t.Fatalf("expected %d in the live children %v", cmd.Process.Pid, live)
+	}
+	zombies, err := zombieChildren("/proc", os.Getpid())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if contains(zombies) {
+		t.Fatalf("expected %d not to be in the zombie children %v", cmd.Process.Pid, zombies)
+	}
+}
+
+func TestExecutor_workingSet(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		usage      uint64
+		memoryStat map[string]uint64
+		exp        uint64
+	}{
+		// cgroup v1 excludes the hierarchical inactive file cache
+		{100 << 20, map[string]uint64{"total_inactive_file": 30 << 20, "inactive_file": 10 << 20}, 70 << 20},
+		// cgroup v2
+		{100 << 20, map[string]uint64{"inactive_file": 30 << 20, "active_file": 20 << 20}, 70 << 20},
+		// Active cache is still counted
+		{100 << 20, map[string]uint64{"active_file": 20 << 20}, 100 << 20},
+		// Usage and memory.stat are read separately so the cache may exceed
+		// the usage
+		{10 << 20, map[string]uint64{"inactive_file": 30 << 20}, 0},
+		{0, nil, 0},
+	}
+	for _, c := range cases {
+		if act := workingSet(c.usage, c.memoryStat); act != c.exp {
+			t.Errorf("workingSet(%d, %v) = %d; want %d", c.usage, c.memoryStat, act, c.exp)
+		}
+	}
+}
+
+func TestExecutor_parseProcStat(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		stat  string
+		state string
+		ppid  int
+		ok    bool
+	}{
+		{"1234 (sleep) S 1 1234 1234 0 -1", "S", 1, true},
+		{"1235 (a (weird) name) Z 42 1235 1235 0 -1", "Z", 42, true},
+		{"1236 (truncated", "", 0, false},
+		{"1237 (sh) Z", "", 0, false},
+	}
+
+	for _, c := range cases {
+		state, ppid, ok := parseProcStat(c.stat)
+		if state != c.state || ppid != c.ppid || ok != c.ok {
+			t.Errorf("parseProcStat(%q) = %q, %d, %v; want %q, %d, %v", c.stat, state, ppid, ok, c.state, c.ppid, c.ok)
+		}
+	}
+}
+
+func TestExecutor_parseProcStatFaults(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		stat         string
+		major, minor uint64
+		ok           bool
+	}{
+		{"1234 (sleep) S 1 1234 1234 0 -1 4194304 100 20 3 1 0 0", 4, 120, true},
+		{"1235 (a (weird) name) R 42 1235 1235 0 -1 0 7 0 0 0 0 0", 0, 7, true},
+		{"1236 (truncated) S 1 1236 1236 0 -1 0 5", 0, 0, false},
+		{"1237 (sh) S 1 1237 1237 0 -1 0 x 0 0 0", 0, 0, false},
+	}
+
+	for _, c := range cases {
+		major, minor, ok := parseProcStatFaults(c.stat)
+		if major != c.major || minor != c.minor || ok != c.ok {
+			t.Errorf("parseProcStatFaults(%q) = %d, %d, %v; want %d, %d, %v", c.stat, major, minor, ok, c.major, c.minor, c.ok)
+		}
+	}
+}
+
+func TestExecutor_Stats_PageFaults(t *testing.T) {
+	t.Parallel()
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := executor.LaunchCmd(&ExecCommand{Cmd: "/bin/sleep", Args: []string{"10"}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer executor.Exit()
+
+	tu.WaitForResult(func() (bool, error) {
+		ru, err := executor.Stats()
+		if err != nil {
+			return false, err
+		}
+		ms := ru.ResourceUsage.MemoryStats
+		if ms.MinorPageFaults == 0 {
+			return false, fmt.Errorf("no minor page faults: %+v", ms)
+		}
+		for _, m := range ms.Measured {
+			if m == "Major Page Faults" {
+				return true, nil
+			}
+		}
+		return false, fmt.Errorf("page faults aren't measured: %v", ms.Measured)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func TestExecutor_Stats_WorkingSet(t *testing.T) {
+	t.Parallel()
+	testutil.ExecCompatible(t)
+	ctx, allocDir := testExecutorContextWithChroot(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Writing a file fills the page cache, which is charged to the task
+	execCmd := &ExecCommand{
+		Cmd:            "/bin/bash",
+		Args:           []string{"-c", `s=$(printf "%1048576s"); for ((i = 0; i < 64; i++)); do printf "$s"; done > /local/cache && sleep 10`},
+		FSIsolation:    true,
+		ResourceLimits: true,
+		User:           dstructs.DefaultUnprivilegedUser,
+	}
+	if _, err := executor.LaunchCmd(execCmd); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer executor.Exit()
+
+	tu.WaitForResult(func() (bool, error) {
+		ru, err := executor.Stats()
+		if err != nil {
+			return false, err
+		}
+		ms := ru.ResourceUsage.MemoryStats
+		if ms.Usage < 64<<20 {
+			return false, fmt.Errorf("expected the cache to be charged: %+v", ms)
+		}
+		if ms.WorkingSet > ms.Usage-32<<20 {
+			return false, fmt.Errorf("expected the working set to exclude the cache: %+v", ms)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func TestExecutor_Exec_Cgroup(t *testing.T) {
+	t.Parallel()
+	testutil.ExecCompatible(t)
+	ctx, allocDir := testExecutorContextWithChroot(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	execCmd := &ExecCommand{
+		Cmd:            "/bin/sleep",
+		Args:           []string{"30"},
+		FSIsolation:    true,
+		ResourceLimits: true,
+		User:           dstructs.DefaultUnprivilegedUser,
+	}
+	ps, err := executor.LaunchCmd(execCmd)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer executor.Exit()
+
+	expected, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", ps.Pid))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Commands don't depend on the executor being in the task's cgroups, so
+	// it's moved to the roots of the hierarchies
+	for _, path := range ps.IsolationConfig.CgroupPaths {
+		root := filepath.Join(filepath.Dir(filepath.Dir(path)), "cgroup.procs")
+		if err := ioutil.WriteFile(root, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Commands exec'd within the task, such as its health checks, are in
+	// its cgroups
+	readCgroup := "while read -r line; do echo $line; done < /proc/self/cgroup"
+	out, code, err := executor.Exec(time.Now().Add(5*time.Second), "/bin/bash", []string{"-c", readCgroup})
+	if err != nil || code != 0 {
+		t.Fatalf("unexpected result: code %d, err %v: %s", code, err, out)
+	}
+	if string(out) != string(expected) {
+		t.Fatalf("exec'd command is in cgroups\n%s\nwant\n%s", out, expected)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code, err = executor.ExecStreaming(context.Background(), "/bin/bash", []string{"-c", readCgroup}, false, strings.NewReader(""), &stdout, &stderr)
+	if err != nil || code != 0 {
+		t.Fatalf("unexpected result: code %d, err %v: %s", code, err, stderr.String())
+	}
+	if stdout.String() != string(expected) {
+		t.Fatalf("streamed command is in cgroups\n%s\nwant\n%s", stdout.String(), expected)
+	}
+}
+
+func TestExecutor_MemorySoftLimit_Cgroup(t *testing.T) {
+	t.Parallel()
+	testutil.ExecCompatible(t)
+	ctx, allocDir := testExecutorContextWithChroot(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The memory usage is read from the command's cgroup
+	execCmd := &ExecCommand{
+		Cmd:                  "/bin/bash",
+		Args:                 []string{"-c", "x=a; for ((i = 0; i < 25; i++)); do x=$x$x; done; sleep 30; true"},
+		FSIsolation:          true,
+		ResourceLimits:       true,
+		User:                 dstructs.DefaultUnprivilegedUser,
+		MemorySoftLimit:      16 * 1024 * 1024,
+		MemorySoftLimitGrace: time.Second,
+	}
+	if _, err := executor.LaunchCmd(execCmd); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer executor.Exit()
+
+	ps, err := executor.Wait()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ps.MemorySoftLimitKilled {
+		t.Fatalf("expected the command to be killed for exceeding the soft limit: %+v", ps)
+	}
+}
+
+func TestExecutor_MaxThreads(t *testing.T) {
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var orig unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NPROC, &orig); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	execCmd := ExecCommand{Cmd: "/bin/bash", Args: []string{"-c", "ulimit -u"}, MaxThreads: 50}
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+	if _, err := executor.Wait(); err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+	if err := executor.Exit(); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// The command inherited the limit
+	file := filepath.Join(ctx.LogDir, "web.stdout.0")
+	output, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Couldn't read file %v", file)
+	}
+	if act := strings.TrimSpace(string(output)); act != "50" {
+		t.Fatalf("got thread limit %q; want 50", act)
+	}
+
+	// The executor's own limit is unchanged
+	var after unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NPROC, &after); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if after != orig {
+		t.Fatalf("executor's limit is %+v; want %+v", after, orig)
+	}
+}
+
+func TestExecutor_parseOOMKills(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		control string
+		kills   uint64
+		ok      bool
+	}{
+		{"oom_kill_disable 0\nunder_oom 0\noom_kill 3\n", 3, true},
+		{"oom_kill_disable 0\nunder_oom 0\noom_kill 0\n", 0, true},
+		{"oom_kill_disable 0\nunder_oom 0\n", 0, false},
+		{"oom_kill x\n", 0, false},
+	}
+
+	for _, c := range cases {
+		kills, ok := parseOOMKills(c.control)
+		if kills != c.kills || ok != c.ok {
+			t.Errorf("parseOOMKills(%q) = %d, %v; want %d, %v", c.control, kills, ok, c.kills, c.ok)
+		}
+	}
+}
+
+func TestExecutor_OOMKilled(t *testing.T) {
+	t.Parallel()
+	testutil.ExecCompatible(t)
+
+	ctx, allocDir := testExecutorContextWithChroot(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if control, err := ioutil.ReadFile("/sys/fs/cgroup/memory/memory.oom_control"); err != nil || !strings.Contains(string(control), "oom_kill ") {
+		t.Skip("memory cgroup doesn't count OOM kills")
+	}
+
+	// Double a string until the memory limit is exceeded. The executor
+	// shares the cgroup so the command's score is raised for it to be picked.
+	execCmd := ExecCommand{
+		Cmd:            "/bin/bash",
+		Args:           []string{"-c", "x=a; while true; do x=$x$x; done"},
+		FSIsolation:    true,
+		ResourceLimits: true,
+		OOMScoreAdj:    1000,
+	}
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+	ps, err := executor.Wait()
+	if err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+	if err := executor.Exit(); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if !ps.OOMKilled {
+		t.Fatalf("expected command to be OOM killed: %+v", ps)
+	}
+	if ps.Signal != int(syscall.SIGKILL) {
+		t.Fatalf("expected SIGKILL; got signal %d", ps.Signal)
+	}
+}
+
+func TestExecutor_BridgeNetwork(t *testing.T) {
+	testutil.ExecCompatible(t)
+	for _, bin := range []string{"ip", "iptables"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s not found", bin)
+		}
+	}
+
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	bridge := "nomadtest0"
+	defer ip("link", "del", bridge)
+	execCmd := ExecCommand{
+		Cmd:            "/bin/bash",
+		Args:           []string{"-c", "ip -o -4 addr show dev eth0; ip route show default"},
+		ResourceLimits: true,
+		BridgeNetwork: &BridgeNetwork{
+			Bridge:  bridge,
+			Gateway: "10.250.0.1/24",
+			Address: "10.250.0.2/24",
+			Ports:   []int{28080},
+		},
+	}
+	ps, err := executor.LaunchCmd(&execCmd)
+	if err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+	netns := ps.IsolationConfig.NetworkNamespace
+	if netns == "" {
+		t.Fatalf("expected a network namespace")
+	}
+	if _, err := executor.Wait(); err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+	if err := executor.Exit(); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	file := filepath.Join(ctx.LogDir, "web.stdout.0")
+	output, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Couldn't read file %v", file)
+	}
+	if !strings.Contains(string(output), "inet 10.250.0.2/24") || !strings.Contains(string(output), "default via 10.250.0.1") {
+		t.Fatalf("unexpected network of the command: %s", output)
+	}
+
+	// The namespace, the forwarding of its ports and its veth pair are
+	// removed
+	if _, err := os.Stat(filepath.Join(netnsDir, netns)); !os.IsNotExist(err) {
+		t.Fatalf("expected network namespace %q to be removed: %v", netns, err)
+	}
+	if err := iptables("-t", "nat", "-n", "-L", portChain(netns)); err == nil {
+		t.Fatalf("expected chain %q to be removed", portChain(netns))
+	}
+	hostVeth := "nveth" + strings.TrimPrefix(netns, netnsPrefix)
+	tu.WaitForResult(func() (bool, error) {
+		if _, err := net.InterfaceByName(hostVeth); err == nil {
+			return false, fmt.Errorf("veth %q still exists", hostVeth)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func TestExecutor_PortRules(t *testing.T) {
+	rules := portRules("NOMAD-abc", net.ParseIP("10.250.0.2"), []int{8080})
+	expected := [][]string{
+		{"-t", "nat", "-A", "NOMAD-abc", "-p", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "10.250.0.2:8080"},
+		{"-t", "nat", "-A", "NOMAD-abc", "-p", "udp", "--dport", "8080", "-j", "DNAT", "--to-destination", "10.250.0.2:8080"},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("expected rules %v; got %v", expected, rules)
+	}
+	if chain := portChain("nomad-abc"); chain != "NOMAD-abc" {
+		t.Fatalf("unexpected chain %q", chain)
+	}
+}
+
+func TestExecutor_OOMScoreAdj(t *testing.T) {
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	orig, err := ioutil.ReadFile(oomScoreAdjPath)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	execCmd := ExecCommand{Cmd: "/bin/bash", Args: []string{"-c", "echo $(</proc/self/oom_score_adj)"}, OOMScoreAdj: 700}
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+	if _, err := executor.Wait(); err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+	if err := executor.Exit(); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// The command inherited the score
+	file := filepath.Join(ctx.LogDir, "web.stdout.0")
+	output, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Couldn't read file %v", file)
+	}
+	if act := strings.TrimSpace(string(output)); act != "700" {
+		t.Fatalf("got oom_score_adj %q; want 700", act)
+	}
+
+	// The executor's own score was restored
+	after, err := ioutil.ReadFile(oomScoreAdjPath)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(after) != string(orig) {
+		t.Fatalf("executor's oom_score_adj is %q; want %q", after, orig)
+	}
+}
+
+func TestExecutor_NoSwap(t *testing.T) {
+	t.Parallel()
+	testutil.ExecCompatible(t)
+	if _, err := os.Stat("/sys/fs/cgroup/memory/memory.memsw.limit_in_bytes"); err != nil {
+		t.Skip("swap accounting is not enabled")
+	}
+
+	ctx, allocDir := testExecutorContextWithChroot(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	execCmd := ExecCommand{Cmd: "/bin/echo", Args: []string{"hello"}, FSIsolation: true, ResourceLimits: true, NoSwap: true}
+	ps, err := executor.LaunchCmd(&execCmd)
+	if err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+	if _, err := executor.Wait(); err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+	defer executor.Exit()
+
+	// Memory and swap are limited to the memory limit
+	data, err := ioutil.ReadFile(filepath.Join(ps.IsolationConfig.CgroupPaths["memory"], "memory.memsw.limit_in_bytes"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := strconv.Itoa(ctx.Task.Resources.MemoryMB * 1024 * 1024)
+	if actual := strings.TrimSpace(string(data)); actual != expected {
+		t.Fatalf("got memory and swap limit %v; want %v", actual, expected)
+	}
+}
+
+func TestExecutor_UserNamespace(t *testing.T) {
+	t.Parallel()
+	testutil.ExecCompatible(t)
+	if _, err := os.Stat("/proc/self/ns/user"); err != nil {
+		t.Skip("user namespaces are not supported")
+	}
+
+	ctx, allocDir := testExecutorContextWithChroot(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Root of the namespace is the first mapped uid on the host. The
+	// namespace starts out with a full bounding set, so CAP_SYS_CHROOT must
+	// be dropped within it, for exec'd commands too.
+	capBnd := "while read k v; do if [ $k = CapBnd: ]; then echo $v; fi; done < /proc/self/status"
+	execCmd := ExecCommand{
+		Cmd:            "/bin/bash",
+		Args:           []string{"-c", "echo $EUID; echo ${GROUPS[0]}; echo $(</proc/self/uid_map); " + capBnd + "; sleep 2"},
+		FSIsolation:    true,
+		ResourceLimits: true,
+		User:           "root",
+		UserNamespace:  &UserNamespace{UID: 300000, GID: 310000, Size: 65536},
+	}
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+	out, code, err := executor.Exec(time.Now().Add(5*time.Second), "/bin/bash", []string{"-c", capBnd})
+	if err != nil || code != 0 {
+		t.Fatalf("exec failed: code %d, err %v, output %q", code, err, out)
+	}
+	checkChrootDropped(t, strings.TrimSpace(string(out)))
+	ps, err := executor.Wait()
+	if err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+	defer executor.Exit()
+	if ps.ExitCode != 0 {
+		t.Fatalf("command failed: %+v", ps)
+	}
+
+	output, err := ioutil.ReadFile(filepath.Join(ctx.LogDir, "web.stdout.0"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) != 4 || lines[0] != "0" || lines[1] != "0" {
+		t.Fatalf("expected to run as root of the namespace; got %q", output)
+	}
+	if fields := strings.Fields(lines[2]); len(fields) != 3 || fields[0] != "0" || fields[1] != "300000" || fields[2] != "65536" {
+		t.Fatalf("unexpected uid map %q", lines[2])
+	}
+	checkChrootDropped(t, lines[3])
+
+	// Ids that aren't mapped can't be used
+	execCmd = ExecCommand{
+		Cmd:           "/bin/true",
+		User:          "nobody",
+		UserNamespace: &UserNamespace{UID: 300000, GID: 310000, Size: 1000},
+	}
+	executor = NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := executor.LaunchCmd(&execCmd); err == nil || !strings.Contains(err.Error(), "isn't mapped") {
+		t.Fatalf("expected an unmapped uid error; got %v", err)
+	}
+}
+
+// checkChrootDropped fails the test unless the hexadecimal capability set
+// lacks CAP_SYS_CHROOT.
+func checkChrootDropped(t *testing.T, set string) {
+	t.Helper()
+	bits, err := strconv.ParseUint(set, 16, 64)
+	if err != nil {
+		t.Fatalf("invalid capability set %q: %v", set, err)
+	}
+	if bits&(1<<capSysChroot) != 0 {
+		t.Fatalf("expected CAP_SYS_CHROOT to be dropped from the bounding set %s", set)
+	}
+}
+
+func TestExecutor_IOLimits(t *testing.T) {
+	t.Parallel()
+	testutil.ExecCompatible(t)
+	if _, err := os.Stat("/sys/fs/cgroup/blkio/blkio.throttle.read_bps_device"); err != nil {
+		t.Skip("blkio throttling is not supported")
+	}
+
+	// Limit the first block device of the host
+	blocks, _ := ioutil.ReadDir("/sys/block")
+	var dev string
+	for _, b := range blocks {
+		data, err := ioutil.ReadFile(filepath.Join("/sys/block", b.Name(), "dev"))
+		if err == nil && !strings.HasPrefix(b.Name(), "loop") {
+			dev = strings.TrimSpace(string(data))
+			break
+		}
+	}
+	if dev == "" {
+		t.Skip("no block device to limit")
+	}
+	parts := strings.SplitN(dev, ":", 2)
+	major, _ := strconv.ParseInt(parts[0], 10, 64)
+	minor, _ := strconv.ParseInt(parts[1], 10, 64)
+
+	ctx, allocDir := testExecutorContextWithChroot(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	execCmd := ExecCommand{
+		Cmd:            "/bin/echo",
+		Args:           []string{"hello"},
+		FSIsolation:    true,
+		ResourceLimits: true,
+		IOLimits:       []*IOLimit{{Major: major, Minor: minor, ReadBps: 1048576}},
+	}
+	ps, err := executor.LaunchCmd(&execCmd)
+	if err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+	if _, err := executor.Wait(); err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+
+	path := ps.IsolationConfig.CgroupPaths["blkio"]
+	data, err := ioutil.ReadFile(filepath.Join(path, "blkio.throttle.read_bps_device"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if expected := dev + " 1048576"; !strings.Contains(string(data), expected) {
+		t.Fatalf("got read limits %q; want %q", data, expected)
+	}
+
+	// The cgroup is removed on exit
+	if err := executor.Exit(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the blkio cgroup %q to be removed; got %v", path, err)
+	}
+}
+
+func TestExecutor_Ulimits(t *testing.T) {
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var orig unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &orig); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	execCmd := ExecCommand{
+		Cmd:     "/bin/bash",
+		Args:    []string{"-c", "echo $(ulimit -Sn) $(ulimit -Hn)"},
+		Ulimits: []*Ulimit{{Name: "nofile", Soft: 100, Hard: 200}},
+	}
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+
+	// The executor's own limit is never changed, not even while starting
+	// the command
+	var during unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &during); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if during != orig {
+		t.Fatalf("executor's limit is %+v; want %+v", during, orig)
+	}
+
+	if _, err := executor.Wait(); err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+	if err := executor.Exit(); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	file := filepath.Join(ctx.LogDir, "web.stdout.0")
+	output, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Couldn't read file %v", file)
+	}
+	if act := strings.TrimSpace(string(output)); act != "100 200" {
+		t.Fatalf("got nofile limits %q; want \"100 200\"", act)
+	}
+}
+
+func TestExecutor_CoreDump(t *testing.T) {
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The soft limit is raised to the hard limit, which isn't lifted
+	execCmd := ExecCommand{
+		Cmd:      "/bin/bash",
+		Args:     []string{"-c", "echo $(ulimit -Sc) $(ulimit -Hc)"},
+		Ulimits:  []*Ulimit{{Name: "core", Soft: 0, Hard: 1024 * 1024}},
+		CoreDump: true,
+	}
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+	if _, err := executor.Wait(); err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+	if err := executor.Exit(); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	file := filepath.Join(ctx.LogDir, "web.stdout.0")
+	output, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Couldn't read file %v", file)
+	}
+	if act := strings.TrimSpace(string(output)); act != "1024 1024" {
+		t.Fatalf("got core limits %q; want \"1024 1024\"", act)
+	}
+}
+
+func TestExecutor_Ulimits_ExecError(t *testing.T) {
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer executor.Exit()
+
+	// Exec'ing the command through the shim fails like exec'ing it directly
+	path := filepath.Join(ctx.TaskDir, "not-executable")
+	if err := ioutil.WriteFile(path, []byte("data"), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	execCmd := ExecCommand{Cmd: path, Ulimits: []*Ulimit{{Name: "nofile", Soft: 100, Hard: 200}}}
+	_, err := executor.LaunchCmd(&execCmd)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if c := LaunchErrorCategory(err); c != dstructs.StartFailureCommand {
+		t.Fatalf("Expecting category %q; got %q: %v", dstructs.StartFailureCommand, c, err)
+	}
+	if !strings.Contains(err.Error(), "exec format error") {
+		t.Fatalf("expected an exec format error; got %v", err)
+	}
+}
+
+func TestExecutor_UlimitResources(t *testing.T) {
+	t.Parallel()
+	for name := range ulimitNames {
+		if _, ok := rlimitResources[name]; !ok {
+			t.Fatalf("ulimit %q has no resource", name)
+		}
+	}
+}
+
+func TestExecutor_Groups(t *testing.T) {
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	execCmd := ExecCommand{
+		Cmd:         "/bin/bash",
+		Args:        []string{"-c", "grep -E '^(Gid|Groups):' /proc/self/status"},
+		Group:       "4242",
+		ExtraGroups: []string{"4343", "root"},
+	}
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+	if _, err := executor.Wait(); err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+	if err := executor.Exit(); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	file := filepath.Join(ctx.LogDir, "web.stdout.0")
+	output, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Couldn't read file %v", file)
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected output: %q", output)
+	}
+	if gids := strings.Fields(lines[0]); len(gids) < 2 || gids[1] != "4242" {
+		t.Fatalf("expected primary group 4242, got %q", lines[0])
+	}
+	groups := strings.Fields(lines[1])[1:]
+	for _, exp := range []string{"4343", "0"} {
+		found := false
+		for _, g := range groups {
+			found = found || g == exp
+		}
+		if !found {
+			t.Fatalf("expected group %s in %v", exp, groups)
+		}
+	}
+}
+
+func TestExecutor_Groups_Unknown(t *testing.T) {
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer executor.Exit()
+
+	execCmd := ExecCommand{Cmd: "/bin/true", ExtraGroups: []string{"nomad-missing-group"}}
+	_, err := executor.LaunchCmd(&execCmd)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if msg := "group nomad-missing-group"; !strings.Contains(err.Error(), msg) {
+		t.Fatalf("Expecting '%v' in '%v'", msg, err)
+	}
+	if c := LaunchErrorCategory(err); c != dstructs.StartFailureUser {
+		t.Fatalf("Expecting category %q; got %q", dstructs.StartFailureUser, c)
+	}
+}
+
+func TestExecutor_ListenAddr(t *testing.T) {
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Find a free port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	execCmd := ExecCommand{
+		Cmd:        "/bin/bash",
+		Args:       []string{"-c", `readlink /proc/$$/fd/3; test "$LISTEN_PID" = $$ || echo "wrong LISTEN_PID $LISTEN_PID"; test -e /proc/$$/fd/4 && echo leaked`},
+		ListenAddr: addr,
+	}
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+	if _, err := executor.Wait(); err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+	if err := executor.Exit(); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// Only the socket was passed to the command
+	file := filepath.Join(ctx.LogDir, "web.stdout.0")
+	output, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Couldn't read file %v", file)
+	}
+	if act := strings.TrimSpace(string(output)); !strings.HasPrefix(act, "socket:") || strings.Contains(act, "leaked") || strings.Contains(act, "LISTEN_PID") {
+		t.Fatalf("expected only a socket as fd 3 and LISTEN_PID to be set; got %q", act)
+	}
+
+	// The port is released once the command exited
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("expected the port to be released: %v", err)
+	}
+	l.Close()
+}
+
+func TestExecutor_Capabilities(t *testing.T) {
+	// The bits of the capabilities in the capability sets
+	const (
+		capNetBindService = 10
+		capNetRaw         = 13
+	)
+
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	execCmd := ExecCommand{
+		Cmd:     "/bin/bash",
+		Args:    []string{"-c", "grep -E '^Cap(Eff|Bnd):' /proc/self/status"},
+		User:    "nobody",
+		CapAdd:  []int{capNetBindService},
+		CapDrop: []int{capNetRaw},
+	}
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+	defer executor.Exit()
+	if _, err := executor.Wait(); err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+
+	file := filepath.Join(ctx.LogDir, "web.stdout.0")
+	output, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Couldn't read file %v", file)
+	}
+	sets := make(map[string]uint64)
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			t.Fatalf("unexpected output: %q", output)
+		}
+		set, err := strconv.ParseUint(fields[1], 16, 64)
+		if err != nil {
+			t.Fatalf("unexpected output: %q", output)
+		}
+		sets[fields[0]] = set
+	}
+
+	// The user other than root kept the added capability only
+	if eff := sets["CapEff:"]; eff != 1<<capNetBindService {
+		t.Fatalf("expected only CAP_NET_BIND_SERVICE to be effective, got %x", eff)
+	}
+	if sets["CapBnd:"]&(1<<capNetRaw) != 0 {
+		t.Fatalf("expected CAP_NET_RAW to be dropped from the bounding set")
+	}
+
+	// Nor can commands executed within the task gain it
+	type result struct {
+		out  []byte
+		code int
+		err  error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		out, code, err := executor.Exec(time.Now().Add(5*time.Second), "/bin/bash", []string{"-c", "grep '^CapBnd:' /proc/self/status"})
+		resCh <- result{out, code, err}
+	}()
+	res := <-resCh
+	if res.err != nil || res.code != 0 {
+		t.Fatalf("exec failed with code %d: %v: %s", res.code, res.err, res.out)
+	}
+	fields := strings.Fields(string(res.out))
+	if len(fields) != 2 {
+		t.Fatalf("unexpected output: %q", res.out)
+	}
+	bnd, err := strconv.ParseUint(fields[1], 16, 64)
+	if err != nil {
+		t.Fatalf("unexpected output: %q", res.out)
+	}
+	if bnd&(1<<capNetRaw) != 0 {
+		t.Fatalf("expected CAP_NET_RAW to be dropped from the executed command's bounding set")
+	}
+}
+
+func TestExecutor_SecretFiles(t *testing.T) {
+	testutil.ExecCompatible(t)
+
+	ctx, allocDir := testExecutorContextWithChroot(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	execCmd := ExecCommand{
+		Cmd:         "/bin/bash",
+		Args:        []string{"-c", "echo \"$(< /secrets/db_password)\""},
+		User:        "nobody",
+		FSIsolation: true,
+		SecretFiles: map[string]string{"db_password": "hunter2"},
+	}
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+	if _, err := executor.Wait(); err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+
+	// The file is only readable by the command's user
+	path := filepath.Join(ctx.TaskDir, allocdir.TaskSecrets, "db_password")
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if fi.Mode().Perm() != 0400 {
+		t.Fatalf("expected mode 0400; got %v", fi.Mode())
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if uid := strconv.Itoa(int(fi.Sys().(*syscall.Stat_t).Uid)); uid != nobody.Uid {
+		t.Fatalf("expected the file to be owned by uid %s; got %s", nobody.Uid, uid)
+	}
+
+	// The file is removed once the executor exits
+	if err := executor.Exit(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the secret file to be removed: %v", err)
+	}
+
+	file := filepath.Join(ctx.LogDir, "web.stdout.0")
+	output, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Couldn't read file %v", file)
+	}
+	if act := strings.TrimSpace(string(output)); act != "hunter2" {
+		t.Fatalf("expected the command to read the secret; got %q", act)
+	}
+}
+
+func TestExecutor_ReadonlyRootfs(t *testing.T) {
+	testutil.ExecCompatible(t)
+
+	ctx, allocDir := testExecutorContextWithChroot(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	execCmd := ExecCommand{
+		Cmd:            "/bin/bash",
+		Args:           []string{"-c", "echo root > /root.txt; echo local > /local/local.txt; echo alloc > /alloc/alloc.txt; exec /bin/sleep 30"},
+		FSIsolation:    true,
+		ResourceLimits: true,
+		ReadonlyRootfs: true,
+	}
+
+	// Like the executor's RPCs, the command is launched from a goroutine of
+	// its own as its thread stays in the command's mount namespace
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := executor.LaunchCmd(&execCmd)
+		errCh <- err
+	}()
+	if err := <-errCh; err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+	defer executor.Exit()
+
+	// The task's errors are logged once it got to the alloc dir
+	file := filepath.Join(ctx.LogDir, "web.stderr.0")
+	tu.WaitForResult(func() (bool, error) {
+		output, err := ioutil.ReadFile(file)
+		if err != nil {
+			return false, err
+		}
+		for _, path := range []string{"/root.txt", "/local/local.txt"} {
+			if exp := path + ": Read-only file system"; !strings.Contains(string(output), exp) {
+				return false, fmt.Errorf("expected %q in %q", exp, output)
+			}
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// Writes to the alloc dir succeed
+	if _, err := os.Stat(filepath.Join(allocDir.SharedDir, "alloc.txt")); err != nil {
+		t.Fatalf("alloc dir wasn't written: %v", err)
+	}
+
+	// Writes elsewhere fail with EROFS
+	for _, path := range []string{"/root.txt", "/local/local.txt"} {
+		if _, err := os.Stat(filepath.Join(ctx.TaskDir, path)); !os.IsNotExist(err) {
+			t.Fatalf("expected %s not to be written: %v", path, err)
+		}
+	}
+
+	// Commands executed within the task share its root
+	type result struct {
+		code int
+		err  error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		_, code, err := executor.Exec(time.Now().Add(5*time.Second), "/bin/bash", []string{"-c", "echo exec > /exec.txt"})
+		resCh <- result{code, err}
+	}()
+	if res := <-resCh; res.err != nil || res.code == 0 {
+		t.Fatalf("expected the executed command to fail writing the root; got code %d: %v", res.code, res.err)
+	}
+
+	// The client still writes to the task dir on the host
+	if err := ioutil.WriteFile(filepath.Join(ctx.TaskDir, "local", "host.txt"), []byte("host"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestExecutor_Tmpfs(t *testing.T) {
+	testutil.ExecCompatible(t)
+
+	ctx, allocDir := testExecutorContextWithChroot(t)
+	defer allocDir.Destroy()
+
+	executor := NewExecutor(testLogger())
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	execCmd := ExecCommand{
+		Cmd:            "/bin/bash",
+		Args:           []string{"-c", "echo task > /scratch/task.txt; exec /bin/sleep 30"},
+		FSIsolation:    true,
+		ResourceLimits: true,
+		Tmpfs:          []*TmpfsMount{{TaskPath: "/scratch", SizeMB: 8}},
+	}
+
+	// The command is launched from a goroutine of its own as its thread
+	// stays in the command's mount namespace
+	type launched struct {
+		ps  *ProcessState
+		err error
+	}
+	launchCh := make(chan launched, 1)
+	go func() {
+		ps, err := executor.LaunchCmd(&execCmd)
+		launchCh <- launched{ps, err}
+	}()
+	l := <-launchCh
+	if l.err != nil {
+		t.Fatalf("error in launching command: %v", l.err)
+	}
+	defer executor.Exit()
+
+	// The tmpfs is mounted within the command's mount namespace
+	mountinfo, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/mountinfo", l.ps.Pid))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !regexp.MustCompile(`(?m) /scratch .* - tmpfs `).Match(mountinfo) {
+		t.Fatalf("expected a tmpfs at /scratch in the command's mounts:\n%s", mountinfo)
+	}
+
+	// Commands executed within the task see what the task wrote to it
+	type result struct {
+		out  []byte
+		code int
+		err  error
+	}
+	var res result
+	tu.WaitForResult(func() (bool, error) {
+		resCh := make(chan result, 1)
+		go func() {
+			out, code, err := executor.Exec(time.Now().Add(5*time.Second), "/bin/bash", []string{"-c", "read -r line < /scratch/task.txt && echo $line"})
+			resCh <- result{out, code, err}
+		}()
+		res = <-resCh
+		if res.err != nil || res.code != 0 {
+			return false, fmt.Errorf("exec failed with code %d: %v: %s", res.code, res.err, res.out)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	if out := strings.TrimSpace(string(res.out)); out != "task" {
+		t.Fatalf("unexpected output of the executed command: %q", out)
+	}
+
+	// The tmpfs isn't mounted on the host
+	if _, err := os.Stat(filepath.Join(ctx.TaskDir, "scratch", "task.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected the task's file not to be visible on the host: %v", err)
+	}
+}
+
+func TestExecutor_Signals(t *testing.T) {
+	// yes is killed by SIGPIPE once head exits unless it ignores SIGPIPE, in
+	// which case it fails writing instead
+	cases := []struct {
+		name    string
+		command ExecCommand
+		output  string
+	}{
+		{
+			name:    "reset",
+			command: ExecCommand{ResetSignals: true},
+			output:  "y 141",
+		},
+		{
+			name:    "ignore",
+			command: ExecCommand{IgnoreSignals: []os.Signal{syscall.SIGPIPE}},
+			output:  "y 1",
+		},
+		{
+			// SIGPIPE and SIGUSR1, 13 and 10, are bits 12 and 9 of the mask
+			name: "mask",
+			command: ExecCommand{
+				Cmd:           "/bin/grep",
+				Args:          []string{"^SigIgn:", "/proc/self/status"},
+				ResetSignals:  true,
+				IgnoreSignals: []os.Signal{syscall.SIGPIPE, syscall.SIGUSR1},
+			},
+			output: "SigIgn: 0000000000001200",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, allocDir := testExecutorContext(t)
+			defer allocDir.Destroy()
+
+			executor := NewExecutor(testLogger())
+			if err := executor.SetContext(ctx); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			execCmd := c.command
+			if execCmd.Cmd == "" {
+				execCmd.Cmd = "/bin/bash"
+				execCmd.Args = []string{"-c", "yes | head -n1; echo ${PIPESTATUS[0]}"}
+			}
+			if _, err := executor.LaunchCmd(&execCmd); err != nil {
+				t.Fatalf("error in launching command: %v", err)
+			}
+			if _, err := executor.Wait(); err != nil {
+				t.Fatalf("error in waiting for command: %v", err)
+			}
+			if err := executor.Exit(); err != nil {
+				t.Fatalf("error: %v", err)
+			}
+
+			file := filepath.Join(ctx.LogDir, "web.stdout.0")
+			output, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatalf("Couldn't read file %v", file)
+			}
+			if act := strings.Join(strings.Fields(string(output)), " "); act != c.output {
+				t.Fatalf("got output %q; want %q", act, c.output)
+			}
+
+			// The dispositions are only set in the command's process
+			if signal.Ignored(syscall.SIGPIPE) || signal.Ignored(syscall.SIGUSR1) {
+				t.Fatalf("expected the executor not to ignore the signals")
+			}
+		})
+	}
+}
+
+func TestExecScriptStreaming_Tty(t *testing.T) {
+	t.Parallel()
+	alloc := mock.Alloc()
+	task := alloc.Job.TaskGroups[0].Tasks[0]
+	taskEnv := env.NewBuilder(mock.Node(), alloc, task, "global").Build()
+
+	// The command runs in a terminal and Ctrl-D is sent on EOF
+	var stdout bytes.Buffer
+	code, err := ExecScriptStreaming(context.Background(), "", taskEnv, nil, "/bin/sh",
+		[]string{"-c", "test -t 0 && test -t 1 && echo tty; cat"}, true,
+		strings.NewReader("hello\n"), &stdout, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %q", code, stdout.String())
+	}
+	out := strings.Replace(stdout.String(), "\r\n", "\n", -1)
+	if !strings.Contains(out, "tty\n") || !strings.Contains(out, "hello\n") {
+		t.Fatalf("unexpected output: %q", stdout.String())
+	}
+}
+
+func TestExecScript_Cancel(t *testing.T) {
+	t.Parallel()
+	alloc := mock.Alloc()
+	task := alloc.Job.TaskGroups[0].Tasks[0]
+	taskEnv := env.NewBuilder(mock.Node(), alloc, task, "global").Build()
+
+	// The shell ignores SIGTERM so that it's killed after the grace period
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, _, err := ExecScript(ctx, "", taskEnv, nil, "/bin/sh",
+		[]string{"-c", "trap '' TERM; /bin/sleep 60.5 & /bin/sleep 60.5; wait"})
+	if err != context.Canceled {
+		t.Fatalf("expected the exec to be canceled, got: %v", err)
+	}
+	elapsed := time.Since(start)
+	if elapsed < execKillGrace || elapsed > execKillGrace+5*time.Second {
+		t.Fatalf("expected the exec to be killed after the grace period, took %v", elapsed)
+	}
+
+	// No child lingers
+	tu.WaitForResult(func() (bool, error) {
+		procs, _ := filepath.Glob("/proc/[0-9]*")
+		for _, proc := range procs {
+			cmdline, _ := ioutil.ReadFile(filepath.Join(proc, "cmdline"))
+			if string(cmdline) != "/bin/sleep\x0060.5\x00" {
+				continue
+			}
+			environ, _ := ioutil.ReadFile(filepath.Join(proc, "environ"))
+			if bytes.Contains(environ, []byte("NOMAD_ALLOC_ID="+alloc.ID+"\x00")) {
+				return false, fmt.Errorf("exec'd child %s still running", proc)
+			}
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func TestExecScript_Background(t *testing.T) {
+	t.Parallel()
+	alloc := mock.Alloc()
+	task := alloc.Job.TaskGroups[0].Tasks[0]
+	taskEnv := env.NewBuilder(mock.Node(), alloc, task, "global").Build()
+	dir, err := ioutil.TempDir("", "nomadtest-execscript")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, reap := range []bool{false, true} {
+		// The command returns once it exited even though the background
+		// process holds its output open
+		pidFile := filepath.Join(dir, fmt.Sprintf("bg-%v.pid", reap))
+		start := time.Now()
+		output, code, err := execScript(context.Background(), dir, taskEnv, &syscall.SysProcAttr{}, "/bin/sh",
+			[]string{"-c", fmt.Sprintf("/bin/sleep 60 & echo $! > %s; echo started", pidFile)}, reap, nil, nil)
+		if err != nil || code != 0 {
+			t.Fatalf("reap %v: unexpected result: code %d, err %v", reap, code, err)
+		}
+		if elapsed := time.Since(start); elapsed > logDrainTimeout+5*time.Second {
+			t.Fatalf("reap %v: exec waited on the background process for %v", reap, elapsed)
+		}
+		if !strings.Contains(string(output), "started") {
+			t.Fatalf("reap %v: unexpected output %q", reap, output)
+		}
+
+		data, err := ioutil.ReadFile(pidFile)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !reap {
+			if err := syscall.Kill(pid, 0); err != nil {
+				t.Fatalf("background process was killed: %v", err)
+			}
+			syscall.Kill(pid, syscall.SIGKILL)
+			continue
+		}
+		tu.WaitForResult(func() (bool, error) {
+			if _, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil {
+				status, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+				if !strings.Contains(string(status), ") Z ") {
+					return false, fmt.Errorf("background process %d still running", pid)
+				}
+			}
+			return true, nil
+		}, func(err error) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("err: %v", err)
+		})
+	}
+}
+
+func TestExecutor_SignalGroup(t *testing.T) {
+	t.Parallel()
+	script := `trap "echo parent" WINCH
+/bin/bash -c 'trap "echo child" WINCH; while true; do sleep 0.1; done' &
+while true; do sleep 0.1; done`
+	execCmd := ExecCommand{Cmd: "/bin/bash", Args: []string{"-c", script}}
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+	executor := NewExecutor(log.New(os.Stdout, "", log.LstdFlags))
+
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error")
+	}
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+
+	// Both the command and its child are signaled. The signal is resent
+	// until the traps are set up as SIGWINCH is otherwise ignored.
+	file := filepath.Join(ctx.LogDir, "web.stdout.0")
+	tu.WaitForResult(func() (bool, error) {
+		if err := executor.SignalGroup(syscall.SIGWINCH); err != nil {
+			return false, err
+		}
+		output, err := ioutil.ReadFile(file)
+		if err != nil {
+			return false, err
+		}
+		act := string(output)
+		return strings.Contains(act, "parent") && strings.Contains(act, "child"), fmt.Errorf("unexpected output %q", act)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	if err := executor.SignalGroup(syscall.SIGKILL); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if _, err := executor.Wait(); err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+	if err := executor.Exit(); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+}
@@ -1,6 +1,10 @@
 package executor
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -12,6 +16,7 @@ import (
 
 	"github.com/hashicorp/nomad/client/allocdir"
 	"github.com/hashicorp/nomad/client/driver/env"
+	dstructs "github.com/hashicorp/nomad/client/driver/structs"
 	cstructs "github.com/hashicorp/nomad/client/structs"
 	"github.com/hashicorp/nomad/nomad/mock"
 	tu "github.com/hashicorp/nomad/testutil"
@@ -60,9 +65,33 @@ func TestExecutor_Start_Invalid(t *testing.T) {
 		t.Fatalf("Unexpected error")
 	}
 
-	if _, err := executor.LaunchCmd(&execCmd); err == nil {
+	_, err := executor.LaunchCmd(&execCmd)
+	if err == nil {
 		t.Fatalf("Expected error")
 	}
+	if c := LaunchErrorCategory(err); c != dstructs.StartFailureCommand {
+		t.Fatalf("Expected category %q; got %q", dstructs.StartFailureCommand, c)
+	}
+}
+
+func TestExecutor_LaunchErrorCategory(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Err      error
+		Category dstructs.StartFailure
+	}{
+		{launchError(dstructs.StartFailureChroot, fmt.Errorf("foo")), dstructs.StartFailureChroot},
+		{launchError(dstructs.StartFailureUser, fmt.Errorf("foo")), dstructs.StartFailureUser},
+		{fmt.Errorf("unexpected EOF"), dstructs.StartFailureUnknown},
+		{fmt.Errorf("bogus failure: foo"), dstructs.StartFailureUnknown},
+		{nil, dstructs.StartFailureUnknown},
+	}
+
+	for _, c := range cases {
+		if act := LaunchErrorCategory(c.Err); act != c.Category {
+			t.Fatalf("LaunchErrorCategory(%v) = %q; want %q", c.Err, act, c.Category)
+		}
+	}
 }
 
 func TestExecutor_Start_Wait_Failure_Code(t *testing.T) {
@@ -93,6 +122,44 @@ func TestExecutor_Start_Wait_Failure_Code(t *testing.T) {
 	}
 }
 
+func TestExecutor_Start_Confirmation(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		name string
+		cmd  ExecCommand
+		err  bool
+	}{
+		{"failure", ExecCommand{Cmd: "/bin/date", Args: []string{"fail"}}, true},
+		{"success", ExecCommand{Cmd: "/bin/echo", Args: []string{"hello world"}}, false},
+		{"running", ExecCommand{Cmd: "/bin/sleep", Args: []string{"1"}}, false},
+	}
+
+	for _, c := range cases {
+		ctx, allocDir := testExecutorContext(t)
+		defer allocDir.Destroy()
+		executor := NewExecutor(log.New(os.Stdout, "", log.LstdFlags))
+		if err := executor.SetContext(ctx); err != nil {
+			t.Fatalf("Unexpected error")
+		}
+
+		c.cmd.StartConfirmation = 200 * time.Millisecond
+		_, err := executor.LaunchCmd(&c.cmd)
+		if c.err {
+			if err == nil || !strings.Contains(err.Error(), "within the start confirmation") {
+				t.Fatalf("%s: expected a start confirmation error, got: %v", c.name, err)
+			}
+			if cat := LaunchErrorCategory(err); cat != dstructs.StartFailureCommand {
+				t.Fatalf("%s: got category %q", c.name, cat)
+			}
+		} else if err != nil {
+			t.Fatalf("%s: error in launching command: %v", c.name, err)
+		}
+
+		executor.Wait()
+		executor.Exit()
+	}
+}
+
 func TestExecutor_Start_Wait(t *testing.T) {
 	t.Parallel()
 	execCmd := ExecCommand{Cmd: "/bin/echo", Args: []string{"hello world"}}
@@ -132,6 +199,169 @@ func TestExecutor_Start_Wait(t *testing.T) {
 	}
 }
 
+func TestExecutor_Start_Wait_FinalOutput(t *testing.T) {
+	t.Parallel()
+	execCmd := ExecCommand{Cmd: "/bin/bash", Args: []string{"-c", "echo running; echo PASS"}}
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+	executor := NewExecutor(log.New(os.Stdout, "", log.LstdFlags))
+
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error")
+	}
+	defer executor.Exit()
+
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+	if _, err := executor.Wait(); err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+
+	// The output is in the log file once the exit is reported, before the
+	// periodic flush and without exiting the executor
+	file := filepath.Join(ctx.LogDir, "web.stdout.0")
+	output, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Couldn't read file %v", file)
+	}
+	if act := strings.TrimSpace(string(output)); act != "running\nPASS" {
+		t.Fatalf("Command output incorrectly: want %q; got %q", "running\nPASS", act)
+	}
+}
+
+func TestExecutor_RecentOutput(t *testing.T) {
+	t.Parallel()
+	execCmd := ExecCommand{Cmd: "/bin/bash", Args: []string{"-c", "echo hello world; echo oops >&2"}}
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+	ctx.Task.LogConfig.BufferSizeKB = 1
+	executor := NewExecutor(log.New(os.Stdout, "", log.LstdFlags))
+
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error")
+	}
+
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+	if _, err := executor.Wait(); err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+
+	out, err := executor.RecentOutput()
+	if err != nil {
+		t.Fatalf("error getting recent output: %v", err)
+	}
+	if act := string(out.Stdout); act != "hello world\n" {
+		t.Fatalf("unexpected stdout %q", act)
+	}
+	if act := string(out.Stderr); act != "oops\n" {
+		t.Fatalf("unexpected stderr %q", act)
+	}
+	if err := executor.Exit(); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// The output is still written to the log files
+	file := filepath.Join(ctx.LogDir, "web.stdout.0")
+	output, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Couldn't read file %v", file)
+	}
+	if act := strings.TrimSpace(string(output)); act != "hello world" {
+		t.Fatalf("Command output incorrectly: want %v; got %v", "hello world", act)
+	}
+}
+
+func TestExecutor_CombineLogs(t *testing.T) {
+	t.Parallel()
+	execCmd := ExecCommand{Cmd: "/bin/bash", Args: []string{"-c", "for i in 1 2 3 4 5; do echo out $i; echo err $i >&2; done"}}
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+	ctx.Task.LogConfig.CombineLogs = true
+	executor := NewExecutor(log.New(os.Stdout, "", log.LstdFlags))
+
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error")
+	}
+
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+	if _, err := executor.Wait(); err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+	if err := executor.Exit(); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// Both streams are written in order to the output log files
+	file := filepath.Join(ctx.LogDir, "web.output.0")
+	output, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Couldn't read file %v", file)
+	}
+	var expected []string
+	for i := 1; i <= 5; i++ {
+		expected = append(expected, fmt.Sprintf("out %d", i), fmt.Sprintf("err %d", i))
+	}
+	if act, exp := strings.TrimSpace(string(output)), strings.Join(expected, "\n"); act != exp {
+		t.Fatalf("Command output incorrectly: want %q; got %q", exp, act)
+	}
+
+	for _, stream := range []string{"stdout", "stderr"} {
+		if _, err := os.Stat(filepath.Join(ctx.LogDir, "web."+stream+".0")); !os.IsNotExist(err) {
+			t.Fatalf("expected no %s log file; got %v", stream, err)
+		}
+	}
+}
+
+func TestExecutor_Start_Wait_Background(t *testing.T) {
+	t.Parallel()
+	execCmd := ExecCommand{Cmd: "/bin/bash", Args: []string{"-c", "sleep 30 & echo hello world"}}
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+	executor := NewExecutor(log.New(os.Stdout, "", log.LstdFlags))
+
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error")
+	}
+
+	start := time.Now()
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("error in launching command: %v", err)
+	}
+
+	// Only the command is waited on, not the process it left running in the
+	// background with its output still open
+	ps, err := executor.Wait()
+	if err != nil {
+		t.Fatalf("error in waiting for command: %v", err)
+	}
+	if ps.ExitCode != 0 {
+		t.Fatalf("expected exit code 0; got %d", ps.ExitCode)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("waiting on the command took %v", elapsed)
+	}
+	if err := executor.Exit(); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	expected := "hello world"
+	file := filepath.Join(ctx.LogDir, "web.stdout.0")
+	output, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Couldn't read file %v", file)
+	}
+
+	act := strings.TrimSpace(string(output))
+	if act != expected {
+		t.Fatalf("Command output incorrectly: want %v; got %v", expected, act)
+	}
+}
+
 func TestExecutor_WaitExitSignal(t *testing.T) {
 	t.Parallel()
 	execCmd := ExecCommand{Cmd: "/bin/sleep", Args: []string{"10000"}}
@@ -175,6 +405,72 @@ func TestExecutor_WaitExitSignal(t *testing.T) {
 	}
 }
 
+func TestExecutor_MemorySoftLimit(t *testing.T) {
+	t.Parallel()
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+	executor := NewExecutor(log.New(os.Stdout, "", log.LstdFlags))
+
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error")
+	}
+
+	// Hold about 32 MB in a variable, well above the soft limit. The trailing
+	// command keeps bash from exec'ing sleep, which would release it.
+	execCmd := ExecCommand{
+		Cmd:                  "/bin/bash",
+		Args:                 []string{"-c", "x=a; for i in $(seq 25); do x=$x$x; done; sleep 30; true"},
+		MemorySoftLimit:      16 * 1024 * 1024,
+		MemorySoftLimitGrace: time.Second,
+	}
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	start := time.Now()
+	ps, err := executor.Wait()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ps.MemorySoftLimitKilled {
+		t.Fatalf("expected the command to be killed for exceeding the soft limit: %+v", ps)
+	}
+	if ps.Signal != int(syscall.SIGKILL) {
+		t.Fatalf("expected signal: %v, actual: %v", int(syscall.SIGKILL), ps.Signal)
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Second {
+		t.Fatalf("command was killed after %v", elapsed)
+	}
+}
+
+func TestExecutor_MemorySoftLimit_Below(t *testing.T) {
+	t.Parallel()
+	ctx, allocDir := testExecutorContext(t)
+	defer allocDir.Destroy()
+	executor := NewExecutor(log.New(os.Stdout, "", log.LstdFlags))
+
+	if err := executor.SetContext(ctx); err != nil {
+		t.Fatalf("Unexpected error")
+	}
+
+	execCmd := ExecCommand{
+		Cmd:                  "/bin/sleep",
+		Args:                 []string{"3"},
+		MemorySoftLimit:      256 * 1024 * 1024,
+		MemorySoftLimitGrace: time.Second,
+	}
+	if _, err := executor.LaunchCmd(&execCmd); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ps, err := executor.Wait()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ps.MemorySoftLimitKilled || ps.ExitCode != 0 {
+		t.Fatalf("expected the command to exit successfully: %+v", ps)
+	}
+}
+
 func TestExecutor_Start_Kill(t *testing.T) {
 	t.Parallel()
 	execCmd := ExecCommand{Cmd: "/bin/sleep", Args: []string{"10 && hello world"}}
@@ -290,3 +586,87 @@ func (f FakeProcess) Executable() string {
 func NewFakeProcess(pid int, ppid int) ps.Process {
 	return FakeProcess{pid: pid, ppid: ppid}
 }
+
+func TestExecScriptStreaming(t *testing.T) {
+	t.Parallel()
+	alloc := mock.Alloc()
+	task := alloc.Job.TaskGroups[0].Tasks[0]
+	taskEnv := env.NewBuilder(mock.Node(), alloc, task, "global").Build()
+	ctx := context.Background()
+
+	// Stdin is streamed to the command and stdout and stderr are separate
+	var stdout, stderr bytes.Buffer
+	code, err := ExecScriptStreaming(ctx, "", taskEnv, nil, "/bin/sh",
+		[]string{"-c", "read line; echo \"got $line\"; echo oops >&2; exit 3"}, false,
+		strings.NewReader("hello\n"), &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if code != 3 {
+		t.Fatalf("expected exit code 3, got %d", code)
+	}
+	if stdout.String() != "got hello\n" {
+		t.Fatalf("unexpected stdout: %q", stdout.String())
+	}
+	if stderr.String() != "oops\n" {
+		t.Fatalf("unexpected stderr: %q", stderr.String())
+	}
+
+	// The command's stdin is closed when the reader returns EOF
+	stdout.Reset()
+	code, err = ExecScriptStreaming(ctx, "", taskEnv, nil, "/bin/cat", nil, false,
+		strings.NewReader("partial"), &stdout, ioutil.Discard)
+	if err != nil || code != 0 {
+		t.Fatalf("expected cat to exit on EOF: code %d, err %v", code, err)
+	}
+	if stdout.String() != "partial" {
+		t.Fatalf("unexpected stdout: %q", stdout.String())
+	}
+
+	// The command exiting doesn't wait for the reader
+	r, w := io.Pipe()
+	defer w.Close()
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		ExecScriptStreaming(ctx, "", taskEnv, nil, "/bin/true", nil, false, r, ioutil.Discard, ioutil.Discard)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(time.Duration(tu.TestMultiplier()*5) * time.Second):
+		t.Fatalf("exec didn't return while stdin was still open")
+	}
+}
+
+func TestCopyInput_Stop(t *testing.T) {
+	t.Parallel()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	// Stopping interrupts the pending read of a reader supporting deadlines
+	var dst bytes.Buffer
+	stop := CopyInput(&dst, r, nil)
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		stop()
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(time.Duration(tu.TestMultiplier()*5) * time.Second):
+		t.Fatalf("stopping the copy didn't interrupt its read")
+	}
+
+	// Nothing is copied anymore
+	if _, err := w.Write([]byte("late")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if dst.Len() != 0 {
+		t.Fatalf("expected nothing to be copied after stopping, got %q", dst.String())
+	}
+}
@@ -0,0 +1,61 @@
+package executor
+
+// LaunchShimCommand is the hidden command of the Nomad binary the executor
+// starts commands through when their process must be set up after it was
+// forked but before it execs the command, such as to apply resource limits
+// without changing those of the executor itself.
+const LaunchShimCommand = "executor-shim"
+
+// launchShimConfig is passed to the launch shim as its only argument.
+type launchShimConfig struct {
+	// Path and Args are the command the shim execs
+	Path string
+	Args []string
+
+	// Ulimits and MaxThreads are the resource limits the shim applies to
+	// itself for the command to inherit
+	Ulimits    []*Ulimit
+	MaxThreads int
+
+	// CoreDump raises the shim's soft core size limit to its hard limit
+	CoreDump bool
+
+	// ResetSignals sets the default disposition of every signal before the
+	// command is exec'd, and IgnoreSignals are ignored then
+	ResetSignals  bool
+	IgnoreSignals []int
+
+	// DropCapabilities are dropped from the shim's bounding set. A user
+	// namespace created for the command starts out with a full bounding
+	// set, so those the executor dropped from its own don't carry over.
+	DropCapabilities []int
+
+	// CgroupFds are descriptors of the cgroup.procs files of the task's
+	// cgroups, which the shim joins first so that the command is subject to
+	// the task's limits from its start.
+	CgroupFds []int
+
+	// GateFd is the descriptor the shim reads a byte from before setting
+	// up the command. The shim exits without exec'ing it if the executor
+	// closes the gate instead. Exec'd commands aren't gated, leaving it -1.
+	GateFd int
+
+	// ErrFd is the descriptor the shim writes a launchShimError to if it
+	// fails to set up or exec the command. It's closed on exec, so the
+	// executor reading EOF means the command was exec'd. If it's -1 the
+	// error is written to stderr instead.
+	ErrFd int
+
+	// ExeFd is the descriptor of the Nomad binary the shim was started
+	// from, which the command mustn't inherit.
+	ExeFd int
+}
+
+// launchShimError is why the launch shim failed to exec the command.
+type launchShimError struct {
+	// Errno is set if exec'ing the command failed
+	Errno uint32
+
+	// Setup is set if setting up the command failed
+	Setup string
+}
@@ -0,0 +1,35 @@
+// +build darwin dragonfly freebsd netbsd openbsd solaris windows
+
+package executor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// launchGate isn't used as commands are only set up through the launch shim
+// on Linux.
+type launchGate struct{}
+
+func (e *UniversalExecutor) gateCommand(command *ExecCommand) (*launchGate, error) {
+	return nil, nil
+}
+
+func shimExecCmd(cmd *exec.Cmd, drop []int, cgroups []*os.File) (*os.File, error) {
+	return nil, nil
+}
+
+func (g *launchGate) started() {}
+
+func (g *launchGate) open() error {
+	return nil
+}
+
+func (g *launchGate) abort() {}
+
+// RunLaunchShim returns an error as the launch shim is only used on Linux.
+func RunLaunchShim(args []string) int {
+	fmt.Fprintln(os.Stderr, "the launch shim is only supported on Linux")
+	return 1
+}
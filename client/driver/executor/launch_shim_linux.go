@@ -0,0 +1,349 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// launchGate holds a command started through the launch shim until the
+// executor has set up the shim's process. Its methods do nothing on a nil
+// gate so that commands that don't need the shim are handled alike.
+type launchGate struct {
+	// exe, gateR and errW are passed to the shim and closed by the
+	// executor once the shim started
+	exe   *os.File
+	gateR *os.File
+	errW  *os.File
+
+	// gateW and errR are the executor's ends of the pipes
+	gateW *os.File
+	errR  *os.File
+}
+
+// gateCommand makes the command start through the launch shim if its
+// process needs to be set up before it execs the command. The returned gate
+// is nil otherwise.
+func (e *UniversalExecutor) gateCommand(command *ExecCommand) (*launchGate, error) {
+	if len(command.Ulimits) == 0 && command.MaxThreads == 0 && !command.CoreDump && command.UserNamespace == nil &&
+		!command.ResetSignals && len(command.IgnoreSignals) == 0 {
+		return nil, nil
+	}
+
+	exe, err := os.Open("/proc/self/exe")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the executor's binary: %v", err)
+	}
+	gateR, gateW, err := os.Pipe()
+	if err != nil {
+		exe.Close()
+		return nil, fmt.Errorf("failed to create the launch shim's gate: %v", err)
+	}
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		exe.Close()
+		gateR.Close()
+		gateW.Close()
+		return nil, fmt.Errorf("failed to create the launch shim's status pipe: %v", err)
+	}
+	g := &launchGate{exe: exe, gateR: gateR, errW: errW, gateW: gateW, errR: errR}
+
+	// Extra files are the command's descriptors from 3 onwards
+	fd := 3 + len(e.cmd.ExtraFiles)
+	shimConfig := &launchShimConfig{
+		Path:         e.cmd.Path,
+		Args:         e.cmd.Args,
+		Ulimits:      command.Ulimits,
+		MaxThreads:   command.MaxThreads,
+		CoreDump:     command.CoreDump,
+		ResetSignals: command.ResetSignals,
+		ExeFd:        fd,
+		GateFd:       fd + 1,
+		ErrFd:        fd + 2,
+	}
+	for _, sig := range command.IgnoreSignals {
+		if s, ok := sig.(syscall.Signal); ok {
+			shimConfig.IgnoreSignals = append(shimConfig.IgnoreSignals, int(s))
+		}
+	}
+	if command.UserNamespace != nil {
+		shimConfig.DropCapabilities = command.CapDrop
+	}
+	config, err := json.Marshal(shimConfig)
+	if err != nil {
+		g.abort()
+		return nil, err
+	}
+	e.cmd.ExtraFiles = append(e.cmd.ExtraFiles, exe, gateR, errW)
+
+	// The binary is executed through its descriptor as it's usually outside
+	// of the command's chroot
+	e.cmd.Path = fmt.Sprintf("/proc/self/fd/%d", fd)
+	e.cmd.Args = []string{"nomad", LaunchShimCommand, string(config)}
+	return g, nil
+}
+
+// shimExecCmd makes a command exec'd within the task start through the launch
+// shim if it runs in a user namespace of its own, so that the shim drops the
+// capabilities from the namespace's bounding set, or if it joins the task's
+// cgroups through their cgroup.procs files. The returned binary is to be
+// closed once the command started.
+func shimExecCmd(cmd *exec.Cmd, drop []int, cgroups []*os.File) (*os.File, error) {
+	userns := cmd.SysProcAttr != nil && cmd.SysProcAttr.Cloneflags&syscall.CLONE_NEWUSER != 0
+	if !userns && len(cgroups) == 0 {
+		return nil, nil
+	}
+	if !userns {
+		drop = nil
+	}
+
+	exe, err := os.Open("/proc/self/exe")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the executor's binary: %v", err)
+	}
+	fd := 3 + len(cmd.ExtraFiles)
+	shimConfig := &launchShimConfig{
+		Path:             cmd.Path,
+		Args:             cmd.Args,
+		DropCapabilities: drop,
+		ExeFd:            fd,
+		GateFd:           -1,
+		ErrFd:            -1,
+	}
+	for i := range cgroups {
+		shimConfig.CgroupFds = append(shimConfig.CgroupFds, fd+1+i)
+	}
+	config, err := json.Marshal(shimConfig)
+	if err != nil {
+		exe.Close()
+		return nil, err
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, exe)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, cgroups...)
+	cmd.Path = fmt.Sprintf("/proc/self/fd/%d", fd)
+	cmd.Args = []string{"nomad", LaunchShimCommand, string(config)}
+	return exe, nil
+}
+
+// started closes the executor's copies of the shim's descriptors once the
+// shim was started.
+func (g *launchGate) started() {
+	if g == nil {
+		return
+	}
+	g.exe.Close()
+	g.gateR.Close()
+	g.errW.Close()
+}
+
+// open lets the shim set up and exec the command. It returns the errno
+// exec'ing the command failed with or the error setting it up, if any.
+func (g *launchGate) open() error {
+	if g == nil {
+		return nil
+	}
+	defer g.errR.Close()
+
+	_, err := g.gateW.Write([]byte{1})
+	g.gateW.Close()
+	if err != nil {
+		return fmt.Errorf("failed to open the launch shim's gate: %v", err)
+	}
+
+	var shimErr launchShimError
+	switch err := json.NewDecoder(g.errR).Decode(&shimErr); {
+	case err == io.EOF:
+		return nil
+	case err != nil:
+		return fmt.Errorf("failed to read the launch shim's status: %v", err)
+	case shimErr.Setup != "":
+		return fmt.Errorf("failed to set up the command: %s", shimErr.Setup)
+	default:
+		return syscall.Errno(shimErr.Errno)
+	}
+}
+
+// abort closes all of the gate's descriptors, making a started shim exit
+// without exec'ing the command.
+func (g *launchGate) abort() {
+	if g == nil {
+		return
+	}
+	g.started()
+	g.gateW.Close()
+	g.errR.Close()
+}
+
+// RunLaunchShim is run by the launch shim with its arguments. It waits for
+// the executor to open the gate, applies the command's resource limits and
+// execs the command, so it only returns if that fails.
+func RunLaunchShim(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "launch shim configuration not provided")
+		return 1
+	}
+	var config launchShimConfig
+	if err := json.Unmarshal([]byte(args[0]), &config); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid launch shim configuration: %v\n", err)
+		return 1
+	}
+
+	// The gate is closed without a byte if the executor gave up on the
+	// command
+	if config.GateFd >= 0 {
+		var b [1]byte
+		if n, _ := unix.Read(config.GateFd, b[:]); n != 1 {
+			return 1
+		}
+		unix.CloseOnExec(config.GateFd)
+	}
+	unix.CloseOnExec(config.ExeFd)
+	if config.ErrFd >= 0 {
+		unix.CloseOnExec(config.ErrFd)
+	}
+
+	var shimErr launchShimError
+	if err := joinCgroups(config.CgroupFds); err != nil {
+		shimErr.Setup = err.Error()
+	} else if err := dropBoundingSet(config.DropCapabilities); err != nil {
+		shimErr.Setup = err.Error()
+	} else if err := setUlimits(config.Ulimits); err != nil {
+		shimErr.Setup = err.Error()
+	} else if err := limitThreads(config.MaxThreads); err != nil {
+		shimErr.Setup = err.Error()
+	} else if err := enableCoreDump(config.CoreDump); err != nil {
+		shimErr.Setup = err.Error()
+	} else if err := setSignals(config.ResetSignals, config.IgnoreSignals); err != nil {
+		shimErr.Setup = err.Error()
+	} else {
+		err := syscall.Exec(config.Path, config.Args, os.Environ())
+		shimErr.Errno = uint32(syscall.EINVAL)
+		if errno, ok := err.(syscall.Errno); ok {
+			shimErr.Errno = uint32(errno)
+		}
+	}
+
+	if config.ErrFd < 0 {
+		if shimErr.Setup == "" {
+			shimErr.Setup = syscall.Errno(shimErr.Errno).Error()
+		}
+		fmt.Fprintf(os.Stderr, "failed to exec %s: %s\n", config.Path, shimErr.Setup)
+		return 127
+	}
+	json.NewEncoder(os.NewFile(uintptr(config.ErrFd), "status")).Encode(&shimErr)
+	return 127
+}
+
+// joinCgroups moves the shim into the cgroups by writing its pid to their
+// cgroup.procs files, which the executor opened as they're usually outside of
+// the command's chroot. The descriptors are closed so the command doesn't
+// inherit them.
+func joinCgroups(fds []int) error {
+	pid := []byte(strconv.Itoa(unix.Getpid()))
+	for _, fd := range fds {
+		_, err := unix.Write(fd, pid)
+		unix.Close(fd)
+		if err != nil {
+			return fmt.Errorf("failed to join the task's cgroup: %v", err)
+		}
+	}
+	return nil
+}
+
+// enableCoreDump raises the soft core size limit of the shim to its hard
+// limit if enable is set. The hard limit is left to the core ulimit, so tasks
+// can't lift it past the client's maximum.
+func enableCoreDump(enable bool) error {
+	if !enable {
+		return nil
+	}
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_CORE, &limit); err != nil {
+		return fmt.Errorf("failed to get the core size limit: %v", err)
+	}
+	limit.Cur = limit.Max
+	if err := unix.Setrlimit(unix.RLIMIT_CORE, &limit); err != nil {
+		return fmt.Errorf("failed to raise the core size limit: %v", err)
+	}
+	return nil
+}
+
+// setSignals sets the dispositions of the signals the command is exec'd
+// with, which only affects the shim's process. Exec resets handled signals to
+// their default but keeps ignored ones ignored, so with reset every signal is
+// set to its default, including a SIGHUP or SIGINT the runtime kept ignoring
+// as the shim was started ignoring it. The dispositions are set directly
+// rather than through the runtime as they're the command's, not the shim's.
+func setSignals(reset bool, ignore []int) error {
+	if reset {
+		for sig := 1; sig <= numSignals; sig++ {
+			if sig == int(unix.SIGKILL) || sig == int(unix.SIGSTOP) {
+				continue
+			}
+			if err := sigaction(sig, sigDfl); err != nil {
+				return fmt.Errorf("failed to reset signal %d: %v", sig, err)
+			}
+		}
+	}
+	for _, sig := range ignore {
+		if err := sigaction(sig, sigIgn); err != nil {
+			return fmt.Errorf("failed to ignore signal %d: %v", sig, err)
+		}
+	}
+	return nil
+}
+
+const (
+	// numSignals is the number of signals, including the real-time ones
+	numSignals = 64
+
+	// sigDfl and sigIgn are the SIG_DFL and SIG_IGN handlers
+	sigDfl = 0
+	sigIgn = 1
+)
+
+// sigaction sets the handler of the signal. The kernel's struct sigaction
+// starts with the handler, while the flags, restorer and mask following it
+// are left zero, which holds whether or not the architecture has a restorer.
+func sigaction(sig int, handler uintptr) error {
+	var act [6]uintptr
+	act[0] = handler
+	_, _, errno := unix.RawSyscall6(unix.SYS_RT_SIGACTION, uintptr(sig), uintptr(unsafe.Pointer(&act)), 0, numSignals/8, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// dropBoundingSet drops the capabilities from the bounding set of the shim's
+// thread, which stays locked for the command to be exec'd from it. Dropping
+// them requires CAP_SETPCAP, which the shim lacks if the command runs as a
+// user other than root of its namespace. The command is then kept from
+// gaining capabilities through setuid binaries instead.
+func dropBoundingSet(drop []int) error {
+	if len(drop) == 0 {
+		return nil
+	}
+	runtime.LockOSThread()
+	for _, bit := range drop {
+		err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(bit), 0, 0, 0)
+		if err == unix.EPERM {
+			if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+				return fmt.Errorf("failed to set no_new_privs: %v", err)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to drop capability %d: %v", bit, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package executor
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// memorySoftLimitPollInterval is how often the memory usage of a command with
+// a memory soft limit is checked.
+const memorySoftLimitPollInterval = time.Second
+
+// enforceMemorySoftLimit kills the command once its memory usage has stayed
+// above the soft limit for the grace period. Unlike the hard limit of the
+// cgroup, the soft limit doesn't throttle or reclaim the command's memory. It
+// returns once the command exited.
+func (e *UniversalExecutor) enforceMemorySoftLimit(limit uint64, grace time.Duration) {
+	ticker := time.NewTicker(memorySoftLimitPollInterval)
+	defer ticker.Stop()
+
+	var exceededSince time.Time
+	for {
+		select {
+		case <-e.processExited:
+			return
+		case <-ticker.C:
+		}
+
+		rss, err := e.memoryRSS()
+		if err != nil {
+			e.logger.Printf("[DEBUG] executor: failed to get the memory usage of the command: %v", err)
+			continue
+		}
+		if rss <= limit {
+			if !exceededSince.IsZero() {
+				e.logger.Printf("[INFO] executor: memory usage of %d bytes is back below the soft limit of %d bytes", rss, limit)
+				exceededSince = time.Time{}
+			}
+			continue
+		}
+
+		now := time.Now()
+		if exceededSince.IsZero() {
+			e.logger.Printf("[WARN] executor: memory usage of %d bytes exceeds the soft limit of %d bytes; killing the command after %v",
+				rss, limit, grace)
+			exceededSince = now
+		}
+		if now.Sub(exceededSince) < grace {
+			continue
+		}
+
+		e.logger.Printf("[WARN] executor: killing the command as its memory usage of %d bytes exceeded the soft limit of %d bytes for %v",
+			rss, limit, grace)
+		atomic.StoreInt32(&e.memorySoftLimitKilled, 1)
+		if err := e.SignalGroup(os.Kill); err != nil {
+			e.logger.Printf("[ERR] executor: failed to kill the processes of the command: %v", err)
+			if err := e.cmd.Process.Kill(); err != nil && err.Error() != finishedErr {
+				e.logger.Printf("[ERR] executor: failed to kill the command: %v", err)
+			}
+		}
+		return
+	}
+}
+
+// killedByMemorySoftLimit returns whether the command was killed for
+// exceeding its memory soft limit.
+func (e *UniversalExecutor) killedByMemorySoftLimit() bool {
+	return atomic.LoadInt32(&e.memorySoftLimitKilled) == 1
+}
@@ -0,0 +1,277 @@
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/helper/uuid"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// netnsDir is where ip(8) mounts named network namespaces
+	netnsDir = "/var/run/netns"
+
+	// netnsPrefix is the prefix of the names of the network namespaces of
+	// commands
+	netnsPrefix = "nomad-"
+
+	// bridgeNetworkInterface is the name of the command's end of its veth
+	// pair within its network namespace
+	bridgeNetworkInterface = "eth0"
+
+	// portChainPrefix is the prefix of the nat chains forwarding the host
+	// ports of commands, followed by the id of their network namespace
+	portChainPrefix = "NOMAD-"
+
+	// ipForwardPath enables forwarding IPv4 packets between interfaces
+	ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+)
+
+// ip runs ip(8) with the arguments, including its output in the error if it
+// fails.
+func ip(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// iptables runs iptables(8), waiting for other invocations holding its lock,
+// and includes its output in the error if it fails.
+func iptables(args ...string) error {
+	args = append([]string{"-w"}, args...)
+	out, err := exec.Command("iptables", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// ensureRule appends the rule to the chain of the table unless it exists.
+func ensureRule(table, chain string, rule ...string) error {
+	check := append([]string{"-t", table, "-C", chain}, rule...)
+	if iptables(check...) == nil {
+		return nil
+	}
+	return iptables(append([]string{"-t", table, "-A", chain}, rule...)...)
+}
+
+// configureBridgeNetwork creates a network namespace for the command, named
+// as returned, and connects it to the host bridge through a veth pair. The
+// bridge is created if it doesn't exist.
+func configureBridgeNetwork(n *BridgeNetwork) (string, error) {
+	gateway, subnet, err := net.ParseCIDR(n.Gateway)
+	if err != nil {
+		return "", fmt.Errorf("invalid gateway %q: %v", n.Gateway, err)
+	}
+	address, _, err := net.ParseCIDR(n.Address)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q: %v", n.Address, err)
+	}
+	if err := ensureBridge(n.Bridge, n.Gateway); err != nil {
+		return "", err
+	}
+	if err := ensureBridgeNAT(n.Bridge, subnet); err != nil {
+		return "", err
+	}
+
+	// Interface names are limited to 15 characters
+	id := strings.Replace(uuid.Generate(), "-", "", -1)[:8]
+	netns := netnsPrefix + id
+	hostVeth, peerVeth := "nveth"+id, "npeer"+id
+
+	if err := ip("netns", "add", netns); err != nil {
+		return "", err
+	}
+	steps := [][]string{
+		{"link", "add", hostVeth, "type", "veth", "peer", "name", peerVeth},
+		{"link", "set", hostVeth, "master", n.Bridge},
+		{"link", "set", hostVeth, "up"},
+		{"link", "set", peerVeth, "netns", netns},
+		{"-n", netns, "link", "set", peerVeth, "name", bridgeNetworkInterface},
+		{"-n", netns, "addr", "add", n.Address, "dev", bridgeNetworkInterface},
+		{"-n", netns, "link", "set", bridgeNetworkInterface, "up"},
+		{"-n", netns, "link", "set", "lo", "up"},
+		{"-n", netns, "route", "add", "default", "via", gateway.String()},
+	}
+	for _, args := range steps {
+		if err := ip(args...); err != nil {
+			// The host end is only removed along with the namespace once
+			// the peer was moved into it
+			ip("link", "del", hostVeth)
+			destroyNetns(netns)
+			return "", err
+		}
+	}
+	if err := forwardPorts(portChain(netns), address, n.Ports); err != nil {
+		destroyNetns(netns)
+		return "", err
+	}
+	return netns, nil
+}
+
+// ensureBridgeNAT lets commands on the bridge reach other networks through
+// the host. Packets are forwarded between the bridge and other interfaces,
+// and those leaving the bridge's subnet are masqueraded as the host. The
+// rules are shared by all commands on the bridge and left in place, like the
+// bridge itself.
+func ensureBridgeNAT(bridge string, subnet *net.IPNet) error {
+	if err := ioutil.WriteFile(ipForwardPath, []byte("1"), 0644); err != nil {
+		return fmt.Errorf("failed to enable IP forwarding: %v", err)
+	}
+	rules := []struct {
+		table, chain string
+		rule         []string
+	}{
+		{"nat", "POSTROUTING", []string{"-s", subnet.String(), "!", "-o", bridge, "-j", "MASQUERADE"}},
+		{"filter", "FORWARD", []string{"-i", bridge, "-j", "ACCEPT"}},
+		{"filter", "FORWARD", []string{"-o", bridge, "-j", "ACCEPT"}},
+	}
+	for _, r := range rules {
+		if err := ensureRule(r.table, r.chain, r.rule...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// portChain returns the name of the nat chain forwarding the host ports of
+// the command in the network namespace.
+func portChain(netns string) string {
+	return portChainPrefix + strings.TrimPrefix(netns, netnsPrefix)
+}
+
+// portRules returns the rules of the chain forwarding the host ports to the
+// same ports of the address, for both TCP and UDP.
+func portRules(chain string, address net.IP, ports []int) [][]string {
+	var rules [][]string
+	for _, port := range ports {
+		for _, proto := range []string{"tcp", "udp"} {
+			rules = append(rules, []string{"-t", "nat", "-A", chain,
+				"-p", proto, "--dport", strconv.Itoa(port),
+				"-j", "DNAT", "--to-destination", net.JoinHostPort(address.String(), strconv.Itoa(port))})
+		}
+	}
+	return rules
+}
+
+// forwardPorts creates the nat chain forwarding the host ports to the command
+// and jumps to it for packets addressed to the host, whether they arrive from
+// other hosts or are sent by the host itself.
+func forwardPorts(chain string, address net.IP, ports []int) error {
+	if len(ports) == 0 {
+		return nil
+	}
+	if err := iptables("-t", "nat", "-N", chain); err != nil {
+		return err
+	}
+	for _, rule := range portRules(chain, address, ports) {
+		if err := iptables(rule...); err != nil {
+			return err
+		}
+	}
+	for _, hook := range []string{"PREROUTING", "OUTPUT"} {
+		if err := iptables("-t", "nat", "-A", hook, "-m", "addrtype", "--dst-type", "LOCAL", "-j", chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removePorts removes the nat chain forwarding the host ports to the command,
+// if it exists.
+func removePorts(chain string) error {
+	if iptables("-t", "nat", "-n", "-L", chain) != nil {
+		return nil
+	}
+	for _, hook := range []string{"PREROUTING", "OUTPUT"} {
+		jump := []string{hook, "-m", "addrtype", "--dst-type", "LOCAL", "-j", chain}
+		if iptables(append([]string{"-t", "nat", "-C"}, jump...)...) != nil {
+			continue
+		}
+		if err := iptables(append([]string{"-t", "nat", "-D"}, jump...)...); err != nil {
+			return err
+		}
+	}
+	if err := iptables("-t", "nat", "-F", chain); err != nil {
+		return err
+	}
+	return iptables("-t", "nat", "-X", chain)
+}
+
+// ensureBridge creates the bridge with the gateway address unless it exists.
+// Executors creating the bridge concurrently are tolerated.
+func ensureBridge(bridge, gateway string) error {
+	if ip("link", "show", "dev", bridge) == nil {
+		return nil
+	}
+	if err := ip("link", "add", "name", bridge, "type", "bridge"); err != nil && !strings.Contains(err.Error(), "File exists") {
+		return err
+	}
+	if err := ip("addr", "add", gateway, "dev", bridge); err != nil && !strings.Contains(err.Error(), "File exists") {
+		return err
+	}
+	return ip("link", "set", bridge, "up")
+}
+
+// destroyNetns removes the network namespace and the forwarding of its host
+// ports. Its veth pair is removed by the kernel once the processes in it
+// exited.
+func destroyNetns(netns string) error {
+	if err := removePorts(portChain(netns)); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(netnsDir, netns)); os.IsNotExist(err) {
+		return nil
+	}
+	return ip("netns", "del", netns)
+}
+
+// enterNetns moves the calling goroutine's thread into the command's network
+// namespace, if any, so that the command started next from it is created
+// within the namespace. The returned function moves the thread back.
+func (e *UniversalExecutor) enterNetns() (func(), error) {
+	netns := e.resConCtx.netns
+	if netns == "" {
+		return func() {}, nil
+	}
+
+	runtime.LockOSThread()
+	orig, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("failed to open the executor's network namespace: %v", err)
+	}
+	target, err := os.Open(filepath.Join(netnsDir, netns))
+	if err != nil {
+		orig.Close()
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("failed to open network namespace %q: %v", netns, err)
+	}
+	defer target.Close()
+
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		orig.Close()
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("failed to enter network namespace %q: %v", netns, err)
+	}
+	return func() {
+		defer orig.Close()
+		if err := unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET); err != nil {
+			// Keep the thread locked so that it exits with the goroutine
+			// rather than running other goroutines in the namespace
+			e.logger.Printf("[WARN] executor: failed to leave network namespace %q: %v", netns, err)
+			return
+		}
+		runtime.UnlockOSThread()
+	}, nil
+}
@@ -0,0 +1,15 @@
+// +build darwin dragonfly freebsd netbsd openbsd solaris windows
+
+package executor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// execPty isn't supported as pseudo terminals are only allocated on Linux.
+func execPty(ctx context.Context, cmd *exec.Cmd, stdin io.Reader, stdout io.Writer) (int, error) {
+	return 0, fmt.Errorf("TTY is only supported on Linux")
+}
@@ -0,0 +1,99 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ptyEOF is the character a terminal sends for Ctrl-D, which makes reading
+// the pseudo terminal return EOF.
+const ptyEOF = 0x04
+
+// ptyDrainTimeout is how long the output of the pseudo terminal is read after
+// the command exited, as background processes may keep it open.
+const ptyDrainTimeout = time.Second
+
+// openPty opens a new pseudo terminal and returns its master and slave.
+func openPty() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to get the pseudo terminal number: %v", err)
+	}
+	var unlock int32
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, master.Fd(), unix.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to unlock the pseudo terminal: %v", errno)
+	}
+
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// execPty runs the command in a new session with a pseudo terminal as its
+// controlling terminal, streaming stdin to it and its output to stdout. Once
+// stdin returns EOF, Ctrl-D is sent. The session is killed once the context
+// is done.
+func execPty(ctx context.Context, cmd *exec.Cmd, stdin io.Reader, stdout io.Writer) (int, error) {
+	master, slave, err := openPty()
+	if err != nil {
+		return 0, err
+	}
+	defer master.Close()
+
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	// The new session is a process group of its own
+	cmd.SysProcAttr.Setpgid = false
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+
+	err = cmd.Start()
+	slave.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	stop := CopyInput(master, stdin, func() { master.Write([]byte{ptyEOF}) })
+	defer stop()
+
+	// Reading the master fails with EIO once the command and any of its
+	// children holding the terminal exited
+	outputCh := make(chan struct{})
+	go func() {
+		io.Copy(stdout, master)
+		close(outputCh)
+	}()
+
+	err = waitExecCmd(ctx, cmd)
+	select {
+	case <-outputCh:
+	case <-time.After(ptyDrainTimeout):
+		master.Close()
+		<-outputCh
+	}
+	if err != nil {
+		return execExitCode(err)
+	}
+	return 0, nil
+}
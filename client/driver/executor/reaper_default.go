@@ -0,0 +1,24 @@
+// +build darwin dragonfly freebsd netbsd openbsd solaris windows
+
+package executor
+
+import (
+	"log"
+	"os"
+)
+
+// startOrphanReaper is a no-op as orphaned processes can only be reparented
+// to the executor on Linux.
+func startOrphanReaper(logger *log.Logger) error {
+	return nil
+}
+
+// killOrphans is a no-op as orphaned processes can only be reparented to the
+// executor on Linux.
+func killOrphans(logger *log.Logger) error {
+	return nil
+}
+
+// signalOrphans is a no-op as orphaned processes can only be reparented to
+// the executor on Linux.
+func signalOrphans(sig os.Signal, pid int, logger *log.Logger) {}
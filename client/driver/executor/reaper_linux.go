@@ -0,0 +1,220 @@
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// orphanReapInterval is how often zombie children are looked for in
+	// addition to whenever SIGCHLD is received
+	orphanReapInterval = 5 * time.Second
+
+	// orphanGracePeriod is how long a zombie child must remain unreaped
+	// before it's considered orphaned. Children the executor waits on itself,
+	// such as the command and the commands run by Exec, are reaped well
+	// within it.
+	orphanGracePeriod = 500 * time.Millisecond
+
+	// orphanKillTimeout is how long killing the orphans left when the
+	// executor exits may take and orphanKillInterval how often the remaining
+	// ones are looked for
+	orphanKillTimeout  = 5 * time.Second
+	orphanKillInterval = 50 * time.Millisecond
+)
+
+var (
+	// reaperOnce ensures the orphan reaper is only started once per process
+	reaperOnce sync.Once
+	reaperErr  error
+)
+
+// startOrphanReaper makes the executor the subreaper of its descendants so
+// that processes orphaned by helpers, such as the background processes of
+// check scripts, are reparented to the executor rather than init, and starts
+// reaping them. Zombie children that nothing waits on for longer than
+// orphanGracePeriod are reaped so that they don't accumulate.
+func startOrphanReaper(logger *log.Logger) error {
+	reaperOnce.Do(func() {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, unix.PR_SET_CHILD_SUBREAPER, 1, 0); errno != 0 {
+			reaperErr = fmt.Errorf("failed to become child subreaper: %v", errno)
+			return
+		}
+		go reapOrphans(logger)
+	})
+	return reaperErr
+}
+
+// reapOrphans reaps orphaned zombie children whenever a child exits.
+func reapOrphans(logger *log.Logger) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGCHLD)
+	ticker := time.NewTicker(orphanReapInterval)
+	defer ticker.Stop()
+
+	// seen tracks when zombie children were first seen
+	seen := make(map[int]time.Time)
+	var recheck <-chan time.Time
+	for {
+		select {
+		case <-sigCh:
+		case <-ticker.C:
+		case <-recheck:
+		}
+		recheck = nil
+
+		zombies, err := zombieChildren("/proc", os.Getpid())
+		if err != nil {
+			logger.Printf("[DEBUG] executor: failed to look for orphaned processes: %v", err)
+			continue
+		}
+
+		now := time.Now()
+		current := make(map[int]time.Time, len(zombies))
+		for _, pid := range zombies {
+			first, ok := seen[pid]
+			if !ok {
+				first = now
+			}
+			if now.Sub(first) < orphanGracePeriod {
+				current[pid] = first
+				continue
+			}
+
+			var status syscall.WaitStatus
+			if wpid, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err == nil && wpid == pid {
+				logger.Printf("[DEBUG] executor: reaped orphaned process %d", pid)
+			}
+		}
+		seen = current
+
+		// Zombies within their grace period are reaped once it elapses
+		if len(seen) != 0 {
+			recheck = time.After(orphanGracePeriod)
+		}
+	}
+}
+
+// zombieChildren returns the pids of the zombie children of the process with
+// the given pid according to the proc file system mounted at procDir.
+func zombieChildren(procDir string, ppid int) ([]int, error) {
+	return childProcesses(procDir, ppid, true)
+}
+
+// liveChildren returns the pids of the children of the process with the given
+// pid that haven't exited according to the proc file system mounted at
+// procDir.
+func liveChildren(procDir string, ppid int) ([]int, error) {
+	return childProcesses(procDir, ppid, false)
+}
+
+// childProcesses returns the pids of either the zombie or the live children of
+// the process with the given pid.
+func childProcesses(procDir string, ppid int, zombies bool) ([]int, error) {
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		// The process may have exited since listing the directory
+		stat, err := ioutil.ReadFile(filepath.Join(procDir, entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		state, parent, ok := parseProcStat(string(stat))
+		if ok && parent == ppid && (state == "Z") == zombies {
+			children = append(children, pid)
+		}
+	}
+	return children, nil
+}
+
+// killOrphans kills every remaining child of the executor. As the executor is
+// the subreaper of its descendants, processes that double-forked and detached
+// from the command are its children once their parents exit, so killing its
+// children until none remain tears down the command's whole process tree.
+// Each executor runs in its own process, so all of its children belong to the
+// task.
+func killOrphans(logger *log.Logger) error {
+	deadline := time.Now().Add(orphanKillTimeout)
+	for {
+		pids, err := liveChildren("/proc", os.Getpid())
+		if err != nil {
+			return fmt.Errorf("failed to look for orphaned processes: %v", err)
+		}
+		if len(pids) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("orphaned processes %v remain after killing them", pids)
+		}
+
+		for _, pid := range pids {
+			if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+				logger.Printf("[DEBUG] executor: failed to kill orphaned process %d: %v", pid, err)
+			}
+		}
+
+		// Killed processes are zombies until reaped and their children are
+		// reparented to the executor, so look again
+		time.Sleep(orphanKillInterval)
+	}
+}
+
+// signalOrphans sends the signal to the live children of the executor other
+// than the command with the pid, which are the orphans it adopted as their
+// subreaper.
+func signalOrphans(sig os.Signal, pid int, logger *log.Logger) {
+	pids, err := liveChildren("/proc", os.Getpid())
+	if err != nil {
+		logger.Printf("[DEBUG] executor: failed to look for orphaned processes: %v", err)
+		return
+	}
+	for _, child := range pids {
+		if child == pid {
+			continue
+		}
+		if p, err := os.FindProcess(child); err == nil {
+			if err := p.Signal(sig); err != nil && err.Error() != finishedErr {
+				logger.Printf("[DEBUG] executor: failed to signal orphaned process %d: %v", child, err)
+			}
+		}
+	}
+}
+
+// parseProcStat returns the state and parent pid from the contents of a
+// /proc/<pid>/stat file. The command name may contain spaces and parentheses
+// so fields are parsed after its closing parenthesis.
+func parseProcStat(stat string) (string, int, bool) {
+	i := strings.LastIndex(stat, ")")
+	if i == -1 {
+		return "", 0, false
+	}
+	fields := strings.Fields(stat[i+1:])
+	if len(fields) < 2 {
+		return "", 0, false
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", 0, false
+	}
+	return fields[0], ppid, true
+}
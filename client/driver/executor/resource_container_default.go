@@ -15,6 +15,10 @@ func clientCleanup(ic *dstructs.IsolationConfig, pid int) error {
 	return nil
 }
 
+func cgroupPath(ic *dstructs.IsolationConfig) string {
+	return ""
+}
+
 func (rc *resourceContainerContext) executorCleanup() error {
 	return nil
 }
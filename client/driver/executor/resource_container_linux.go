@@ -2,8 +2,10 @@ package executor
 
 import (
 	"os"
+	"sort"
 	"sync"
 
+	multierror "github.com/hashicorp/go-multierror"
 	dstructs "github.com/hashicorp/nomad/client/driver/structs"
 	cgroupConfig "github.com/opencontainers/runc/libcontainer/configs"
 )
@@ -14,29 +16,69 @@ type resourceContainerContext struct {
 	groups  *cgroupConfig.Cgroup
 	cgPaths map[string]string
 	cgLock  sync.Mutex
+
+	// netns is the name of the command's network namespace, if any
+	netns string
 }
 
-// clientCleanup remoevs this host's Cgroup from the Nomad Client's context
+// clientCleanup remoevs this host's Cgroup and network namespace from the
+// Nomad Client's context
 func clientCleanup(ic *dstructs.IsolationConfig, pid int) error {
+	var merr multierror.Error
 	if err := DestroyCgroup(ic.Cgroup, ic.CgroupPaths, pid); err != nil {
-		return err
+		merr.Errors = append(merr.Errors, err)
+	}
+	if ic.NetworkNamespace != "" {
+		if err := destroyNetns(ic.NetworkNamespace); err != nil {
+			merr.Errors = append(merr.Errors, err)
+		}
+	}
+	return merr.ErrorOrNil()
+}
+
+// cgroupPath returns the host path of the cgroup in the isolation config. In
+// the v1 hierarchies, where the process has a cgroup in each, it's the cgroup
+// in the memory hierarchy, or else in the first hierarchy by name.
+func cgroupPath(ic *dstructs.IsolationConfig) string {
+	if path, ok := ic.CgroupPaths[unifiedCgroupKey]; ok {
+		return path
 	}
-	return nil
+	if path, ok := ic.CgroupPaths["memory"]; ok {
+		return path
+	}
+	subsystems := make([]string, 0, len(ic.CgroupPaths))
+	for subsystem := range ic.CgroupPaths {
+		subsystems = append(subsystems, subsystem)
+	}
+	if len(subsystems) == 0 {
+		return ""
+	}
+	sort.Strings(subsystems)
+	return ic.CgroupPaths[subsystems[0]]
 }
 
-// cleanup removes this host's Cgroup from within an Executor's context
+// cleanup removes this host's Cgroup and network namespace from within an
+// Executor's context
 func (rc *resourceContainerContext) executorCleanup() error {
 	rc.cgLock.Lock()
 	defer rc.cgLock.Unlock()
+
+	var merr multierror.Error
 	if err := DestroyCgroup(rc.groups, rc.cgPaths, os.Getpid()); err != nil {
-		return err
+		merr.Errors = append(merr.Errors, err)
+	}
+	if rc.netns != "" {
+		if err := destroyNetns(rc.netns); err != nil {
+			merr.Errors = append(merr.Errors, err)
+		}
 	}
-	return nil
+	return merr.ErrorOrNil()
 }
 
 func (rc *resourceContainerContext) getIsolationConfig() *dstructs.IsolationConfig {
 	return &dstructs.IsolationConfig{
-		Cgroup:      rc.groups,
-		CgroupPaths: rc.cgPaths,
+		Cgroup:           rc.groups,
+		CgroupPaths:      rc.cgPaths,
+		NetworkNamespace: rc.netns,
 	}
 }
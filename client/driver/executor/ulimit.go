@@ -0,0 +1,96 @@
+package executor
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ulimitUnlimited is the value of limits without a bound
+const ulimitUnlimited = "unlimited"
+
+// ulimitNames are the resources, named as by ulimit(1) and Docker, that
+// ulimits can be set for.
+var ulimitNames = map[string]struct{}{
+	"as":         {},
+	"core":       {},
+	"cpu":        {},
+	"data":       {},
+	"fsize":      {},
+	"locks":      {},
+	"memlock":    {},
+	"msgqueue":   {},
+	"nice":       {},
+	"nofile":     {},
+	"nproc":      {},
+	"rss":        {},
+	"rtprio":     {},
+	"rttime":     {},
+	"sigpending": {},
+	"stack":      {},
+}
+
+// Ulimit is a resource limit the command is started with.
+type Ulimit struct {
+	// Name is the resource, such as "nofile"
+	Name string
+
+	// Soft and Hard are the limits, math.MaxUint64 being unlimited
+	Soft uint64
+	Hard uint64
+}
+
+// ParseUlimits parses ulimits of the form "soft:hard", or a single value
+// applied to both, keyed by resource name. Either limit may be "unlimited".
+// The ulimits are returned sorted by name.
+func ParseUlimits(raw map[string]string) ([]*Ulimit, error) {
+	ulimits := make([]*Ulimit, 0, len(raw))
+	for name, value := range raw {
+		if _, ok := ulimitNames[name]; !ok {
+			return nil, fmt.Errorf("unknown ulimit %q", name)
+		}
+
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) == 1 {
+			parts = append(parts, parts[0])
+		}
+		soft, err := parseUlimitValue(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid soft limit of ulimit %s %q: %v", name, value, err)
+		}
+		hard, err := parseUlimitValue(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid hard limit of ulimit %s %q: %v", name, value, err)
+		}
+		if soft > hard {
+			return nil, fmt.Errorf("soft limit of ulimit %s %q exceeds its hard limit", name, value)
+		}
+
+		ulimits = append(ulimits, &Ulimit{Name: name, Soft: soft, Hard: hard})
+	}
+
+	sort.Slice(ulimits, func(i, j int) bool { return ulimits[i].Name < ulimits[j].Name })
+	return ulimits, nil
+}
+
+// FormatUlimitValue formats a single limit.
+func FormatUlimitValue(v uint64) string {
+	if v == math.MaxUint64 {
+		return ulimitUnlimited
+	}
+	return strconv.FormatUint(v, 10)
+}
+
+// parseUlimitValue parses a single limit.
+func parseUlimitValue(value string) (uint64, error) {
+	if value == ulimitUnlimited {
+		return math.MaxUint64, nil
+	}
+	v, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("must be a non-negative integer or %q", ulimitUnlimited)
+	}
+	return v, nil
+}
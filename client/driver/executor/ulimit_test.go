@@ -0,0 +1,48 @@
+package executor
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestParseUlimits(t *testing.T) {
+	t.Parallel()
+
+	raw := map[string]string{
+		"nofile": "1024:65536",
+		"nproc":  "512",
+		"core":   "0:unlimited",
+	}
+	act, err := ParseUlimits(raw)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	exp := []*Ulimit{
+		{Name: "core", Soft: 0, Hard: math.MaxUint64},
+		{Name: "nofile", Soft: 1024, Hard: 65536},
+		{Name: "nproc", Soft: 512, Hard: 512},
+	}
+	if !reflect.DeepEqual(act, exp) {
+		t.Fatalf("got %+v; want %+v", act, exp)
+	}
+}
+
+func TestParseUlimits_Invalid(t *testing.T) {
+	t.Parallel()
+
+	cases := []map[string]string{
+		{"files": "1024"},
+		{"nofile": ""},
+		{"nofile": "-1"},
+		{"nofile": "1024:"},
+		{"nofile": "1024:abc"},
+		{"nofile": "2048:1024"},
+		{"nofile": "unlimited:1024"},
+	}
+	for _, raw := range cases {
+		if _, err := ParseUlimits(raw); err == nil {
+			t.Fatalf("expected error for %v", raw)
+		}
+	}
+}
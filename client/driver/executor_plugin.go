@@ -1,10 +1,14 @@
 package driver
 
 import (
+	"context"
 	"encoding/gob"
+	"fmt"
+	"io"
 	"log"
 	"net/rpc"
 	"os"
+	"sync"
 	"syscall"
 	"time"
 
@@ -26,6 +30,7 @@ func init() {
 
 type ExecutorRPC struct {
 	client *rpc.Client
+	broker *plugin.MuxBroker
 	logger *log.Logger
 }
 
@@ -45,6 +50,18 @@ type ExecCmdReturn struct {
 	Code   int
 }
 
+// ExecStreamingArgs are the args of ExecStreaming. The executor dials the
+// connections with the IDs to stream the stdin, stdout and stderr.
+type ExecStreamingArgs struct {
+	Deadline time.Time
+	Name     string
+	Args     []string
+	Tty      bool
+	StdinID  uint32
+	StdoutID uint32
+	StderrID uint32
+}
+
 func (e *ExecutorRPC) LaunchCmd(cmd *executor.ExecCommand) (*executor.ProcessState, error) {
 	var ps *executor.ProcessState
 	err := e.client.Call("Plugin.LaunchCmd", LaunchCmdArgs{Cmd: cmd}, &ps)
@@ -87,6 +104,13 @@ func (e *ExecutorRPC) DeregisterServices() error {
 	return e.client.Call("Plugin.DeregisterServices", new(interface{}), new(interface{}))
 }
 
+// Detach closes the connection to the executor without shutting it down, so
+// that pending calls such as Wait return while the executor keeps running the
+// task. The executor can be reattached to with its reattach config.
+func (e *ExecutorRPC) Detach() error {
+	return e.broker.Close()
+}
+
 func (e *ExecutorRPC) Version() (*executor.ExecutorVersion, error) {
 	var version executor.ExecutorVersion
 	err := e.client.Call("Plugin.Version", new(interface{}), &version)
@@ -103,6 +127,10 @@ func (e *ExecutorRPC) Signal(s os.Signal) error {
 	return e.client.Call("Plugin.Signal", &s, new(interface{}))
 }
 
+func (e *ExecutorRPC) SignalGroup(s os.Signal) error {
+	return e.client.Call("Plugin.SignalGroup", &s, new(interface{}))
+}
+
 func (e *ExecutorRPC) Exec(deadline time.Time, name string, args []string) ([]byte, int, error) {
 	req := ExecCmdArgs{
 		Deadline: deadline,
@@ -117,9 +145,94 @@ func (e *ExecutorRPC) Exec(deadline time.Time, name string, args []string) ([]by
 	return resp.Output, resp.Code, err
 }
 
+func (e *ExecutorRPC) ExecStreaming(ctx context.Context, name string, args []string, tty bool,
+	stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, fmt.Errorf("exec of %q has no deadline", name)
+	}
+	req := ExecStreamingArgs{
+		Deadline: deadline,
+		Name:     name,
+		Args:     args,
+		Tty:      tty,
+		StdinID:  e.broker.NextId(),
+		StdoutID: e.broker.NextId(),
+		StderrID: e.broker.NextId(),
+	}
+
+	// Streaming stdin is stopped once the command exited, as the reader may
+	// never return EOF
+	stdinCh := make(chan func(), 1)
+	go func() {
+		conn, err := e.broker.Accept(req.StdinID)
+		if err != nil {
+			e.logger.Printf("[ERR] executor: failed to accept the stdin of exec %q: %v", name, err)
+			stdinCh <- func() {}
+			return
+		}
+		stop := executor.CopyInput(conn, stdin, func() { conn.Close() })
+		stdinCh <- func() {
+			stop()
+			conn.Close()
+		}
+	}()
+
+	// Streaming the output is done once the executor closes the connections
+	var wg sync.WaitGroup
+	for id, w := range map[uint32]io.Writer{req.StdoutID: stdout, req.StderrID: stderr} {
+		wg.Add(1)
+		go func(id uint32, w io.Writer) {
+			defer wg.Done()
+			conn, err := e.broker.Accept(id)
+			if err != nil {
+				e.logger.Printf("[ERR] executor: failed to accept the output of exec %q: %v", name, err)
+				return
+			}
+			defer conn.Close()
+			io.Copy(w, conn)
+		}(id, w)
+	}
+
+	// The stdin ID identifies the exec to cancel
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := e.client.Call("Plugin.CancelExec", req.StdinID, new(interface{})); err != nil {
+				e.logger.Printf("[ERR] executor: failed to cancel exec %q: %v", name, err)
+			}
+		case <-doneCh:
+		}
+	}()
+
+	var code int
+	err := e.client.Call("Plugin.ExecStreaming", req, &code)
+	wg.Wait()
+	(<-stdinCh)()
+	if ctx.Err() != nil {
+		// The command was killed
+		return 0, ctx.Err()
+	}
+	return code, err
+}
+
+func (e *ExecutorRPC) RecentOutput() (*executor.TaskOutput, error) {
+	var output executor.TaskOutput
+	err := e.client.Call("Plugin.RecentOutput", new(interface{}), &output)
+	return &output, err
+}
+
 type ExecutorRPCServer struct {
 	Impl   executor.Executor
+	broker *plugin.MuxBroker
 	logger *log.Logger
+
+	// execCancels cancels the running streaming execs by the IDs of their
+	// stdin
+	execCancels     map[uint32]context.CancelFunc
+	execCancelsLock sync.Mutex
 }
 
 func (e *ExecutorRPCServer) LaunchCmd(args LaunchCmdArgs, ps *executor.ProcessState) error {
@@ -191,6 +304,10 @@ func (e *ExecutorRPCServer) Signal(args os.Signal, resp *interface{}) error {
 	return e.Impl.Signal(args)
 }
 
+func (e *ExecutorRPCServer) SignalGroup(args os.Signal, resp *interface{}) error {
+	return e.Impl.SignalGroup(args)
+}
+
 func (e *ExecutorRPCServer) Exec(args ExecCmdArgs, result *ExecCmdReturn) error {
 	out, code, err := e.Impl.Exec(args.Deadline, args.Name, args.Args)
 	ret := &ExecCmdReturn{
@@ -201,18 +318,71 @@ func (e *ExecutorRPCServer) Exec(args ExecCmdArgs, result *ExecCmdReturn) error
 	return err
 }
 
+func (e *ExecutorRPCServer) ExecStreaming(args ExecStreamingArgs, code *int) error {
+	stdin, err := e.broker.Dial(args.StdinID)
+	if err != nil {
+		return fmt.Errorf("failed to dial the stdin of exec: %v", err)
+	}
+	defer stdin.Close()
+	stdout, err := e.broker.Dial(args.StdoutID)
+	if err != nil {
+		return fmt.Errorf("failed to dial the stdout of exec: %v", err)
+	}
+	defer stdout.Close()
+	stderr, err := e.broker.Dial(args.StderrID)
+	if err != nil {
+		return fmt.Errorf("failed to dial the stderr of exec: %v", err)
+	}
+	defer stderr.Close()
+
+	ctx, cancel := context.WithDeadline(context.Background(), args.Deadline)
+	defer cancel()
+	e.execCancelsLock.Lock()
+	if e.execCancels == nil {
+		e.execCancels = make(map[uint32]context.CancelFunc)
+	}
+	e.execCancels[args.StdinID] = cancel
+	e.execCancelsLock.Unlock()
+	defer func() {
+		e.execCancelsLock.Lock()
+		delete(e.execCancels, args.StdinID)
+		e.execCancelsLock.Unlock()
+	}()
+
+	*code, err = e.Impl.ExecStreaming(ctx, args.Name, args.Args, args.Tty, stdin, stdout, stderr)
+	return err
+}
+
+func (e *ExecutorRPCServer) CancelExec(id uint32, resp *interface{}) error {
+	e.execCancelsLock.Lock()
+	cancel, ok := e.execCancels[id]
+	e.execCancelsLock.Unlock()
+	if ok {
+		cancel()
+	}
+	return nil
+}
+
+func (e *ExecutorRPCServer) RecentOutput(args interface{}, output *executor.TaskOutput) error {
+	out, err := e.Impl.RecentOutput()
+	if out != nil {
+		*output = *out
+	}
+	return err
+}
+
 type ExecutorPlugin struct {
 	logger *log.Logger
 	Impl   *ExecutorRPCServer
 }
 
-func (p *ExecutorPlugin) Server(*plugin.MuxBroker) (interface{}, error) {
+func (p *ExecutorPlugin) Server(b *plugin.MuxBroker) (interface{}, error) {
 	if p.Impl == nil {
-		p.Impl = &ExecutorRPCServer{Impl: executor.NewExecutor(p.logger), logger: p.logger}
+		p.Impl = &ExecutorRPCServer{Impl: executor.NewExecutor(p.logger), broker: b, logger: p.logger}
 	}
 	return p.Impl, nil
 }
 
 func (p *ExecutorPlugin) Client(b *plugin.MuxBroker, c *rpc.Client) (interface{}, error) {
-	return &ExecutorRPC{client: c, logger: p.logger}, nil
+	return &ExecutorRPC{client: c, broker: b, logger: p.logger}, nil
 }
@@ -0,0 +1,224 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultHealthCheckInterval is how often a task's health check runs if
+	// no interval is configured.
+	defaultHealthCheckInterval = 10 * time.Second
+
+	// minHealthCheckInterval bounds the interval as every check execs a
+	// command within the task.
+	minHealthCheckInterval = time.Second
+
+	// defaultHealthCheckTimeout is how long a health check runs before it's
+	// failed if no timeout is configured. It's lowered to the interval.
+	defaultHealthCheckTimeout = 5 * time.Second
+
+	// defaultHealthCheckThreshold is how many consecutive times a health
+	// check fails before the task is unhealthy if no threshold is configured.
+	defaultHealthCheckThreshold = 3
+)
+
+// healthCheck is the parsed health_check of a task. It's persisted in the
+// handle ID so that reattached handles keep checking the task.
+type healthCheck struct {
+	// Command is the command and arguments run within the task
+	Command   []string
+	Interval  time.Duration
+	Timeout   time.Duration
+	Threshold int
+}
+
+// parseHealthCheck parses the health_check of a task, returning nil if it
+// has none.
+func parseHealthCheck(checks []*ExecHealthCheck) (*healthCheck, error) {
+	switch len(checks) {
+	case 0:
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("only one health_check may be set")
+	}
+	c := checks[0]
+
+	if err := validateCommand(c.Command, "args"); err != nil {
+		return nil, fmt.Errorf("invalid health_check command: %v", err)
+	}
+
+	interval := defaultHealthCheckInterval
+	if c.Interval != "" {
+		d, err := time.ParseDuration(c.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health_check interval %q: %v", c.Interval, err)
+		}
+		if d < minHealthCheckInterval {
+			return nil, fmt.Errorf("health_check interval %q must be at least %v", c.Interval, minHealthCheckInterval)
+		}
+		interval = d
+	}
+
+	timeout := defaultHealthCheckTimeout
+	if timeout > interval {
+		timeout = interval
+	}
+	if c.Timeout != "" {
+		d, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health_check timeout %q: %v", c.Timeout, err)
+		}
+		if d <= 0 || d > interval {
+			return nil, fmt.Errorf("health_check timeout %q must be positive and at most the interval of %v", c.Timeout, interval)
+		}
+		timeout = d
+	}
+
+	threshold := defaultHealthCheckThreshold
+	if c.Threshold < 0 {
+		return nil, fmt.Errorf("health_check threshold %d must not be negative", c.Threshold)
+	} else if c.Threshold != 0 {
+		threshold = c.Threshold
+	}
+
+	return &healthCheck{
+		Command:   append([]string{c.Command}, c.Args...),
+		Interval:  interval,
+		Timeout:   timeout,
+		Threshold: threshold,
+	}, nil
+}
+
+// healthChecker runs a task's health check within the task every interval,
+// starting right away. The task is healthy once a check passes and unhealthy
+// once the check failed threshold consecutive times. Transitions are published
+// as driver events and emitted as task events.
+type healthChecker struct {
+	check *healthCheck
+	exec  func(ctx context.Context, cmd string, args []string) ([]byte, int, error)
+
+	events    *eventStream
+	emitEvent LogEventFn
+	logger    *log.Logger
+
+	// state is the task's health and failures the number of consecutive
+	// failed checks
+	state    HealthState
+	failures int
+	lock     sync.Mutex
+}
+
+// newHealthChecker returns a healthChecker of the check whose task's health
+// is unknown.
+func newHealthChecker(check *healthCheck, exec func(context.Context, string, []string) ([]byte, int, error),
+	events *eventStream, emitEvent LogEventFn, logger *log.Logger) *healthChecker {
+	return &healthChecker{
+		check:     check,
+		exec:      exec,
+		events:    events,
+		emitEvent: emitEvent,
+		logger:    logger,
+		state:     HealthUnknown,
+	}
+}
+
+// Health returns the task's current health.
+func (c *healthChecker) Health() HealthState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.state
+}
+
+// run checks the task's health every interval until stopCh is closed.
+func (c *healthChecker) run(stopCh <-chan struct{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-stopCh:
+			return
+		}
+
+		failure, stopped := c.probe(stopCh)
+		if stopped {
+			return
+		}
+		c.record(failure)
+		timer.Reset(c.check.Interval)
+	}
+}
+
+// probe runs the check once and returns why it failed, or an empty string if
+// it passed. It returns stopped if stopCh was closed while the check ran.
+func (c *healthChecker) probe(stopCh <-chan struct{}) (failure string, stopped bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.check.Timeout)
+	defer cancel()
+
+	type result struct {
+		output []byte
+		code   int
+		err    error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		output, code, err := c.exec(ctx, c.check.Command[0], c.check.Command[1:])
+		resultCh <- result{output, code, err}
+	}()
+
+	// Like the pre-kill command, the check isn't trusted to stop at the
+	// deadline
+	select {
+	case res := <-resultCh:
+		switch {
+		case res.err != nil:
+			return fmt.Sprintf("failed: %v", res.err), false
+		case res.code != 0:
+			return fmt.Sprintf("exited with code %d: %s", res.code, strings.TrimSpace(string(res.output))), false
+		}
+		return "", false
+	case <-ctx.Done():
+		return fmt.Sprintf("timed out after %v", c.check.Timeout), false
+	case <-stopCh:
+		return "", true
+	}
+}
+
+// record updates the task's health with the result of a check, publishing
+// the transition if the health changed.
+func (c *healthChecker) record(failure string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if failure == "" {
+		c.failures = 0
+		if c.state != HealthHealthy {
+			c.state = HealthHealthy
+			c.logger.Printf("[INFO] driver.exec: health check %q passed; task is healthy", c.check.Command[0])
+			c.events.publish(time.Now(), DriverEventHealthy, "Health check passed")
+			if c.emitEvent != nil {
+				c.emitEvent("Health check passed; task is healthy")
+			}
+		}
+		return
+	}
+
+	c.failures++
+	c.logger.Printf("[DEBUG] driver.exec: health check %q %s (%d/%d)", c.check.Command[0], failure, c.failures, c.check.Threshold)
+	if c.failures < c.check.Threshold || c.state == HealthUnhealthy {
+		return
+	}
+	c.state = HealthUnhealthy
+	c.logger.Printf("[WARN] driver.exec: health check %q %s; task is unhealthy after %d consecutive failures", c.check.Command[0], failure, c.failures)
+	c.events.publish(time.Now(), DriverEventUnhealthy, "Health check %s", failure)
+	if c.emitEvent != nil {
+		c.emitEvent("Health check %s; task is unhealthy after %d consecutive failures", failure, c.failures)
+	}
+}
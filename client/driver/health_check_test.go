@@ -0,0 +1,151 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHealthCheck(t *testing.T) {
+	t.Parallel()
+	if check, err := parseHealthCheck(nil); err != nil || check != nil {
+		t.Fatalf("expected no check; got %+v %v", check, err)
+	}
+
+	// Defaults apply to unset fields and the timeout is lowered to the interval
+	check, err := parseHealthCheck([]*ExecHealthCheck{{Command: "/bin/true", Interval: "2s"}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := &healthCheck{
+		Command:   []string{"/bin/true"},
+		Interval:  2 * time.Second,
+		Timeout:   2 * time.Second,
+		Threshold: defaultHealthCheckThreshold,
+	}
+	if !reflect.DeepEqual(check, expected) {
+		t.Fatalf("got %+v; want %+v", check, expected)
+	}
+
+	check, err = parseHealthCheck([]*ExecHealthCheck{{
+		Command:   "/bin/sh",
+		Args:      []string{"-c", "true"},
+		Interval:  "30s",
+		Timeout:   "10s",
+		Threshold: 1,
+	}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected = &healthCheck{
+		Command:   []string{"/bin/sh", "-c", "true"},
+		Interval:  30 * time.Second,
+		Timeout:   10 * time.Second,
+		Threshold: 1,
+	}
+	if !reflect.DeepEqual(check, expected) {
+		t.Fatalf("got %+v; want %+v", check, expected)
+	}
+
+	for _, checks := range [][]*ExecHealthCheck{
+		{{Command: ""}},
+		{{Command: "/bin/true", Interval: "500ms"}},
+		{{Command: "/bin/true", Interval: "abc"}},
+		{{Command: "/bin/true", Interval: "5s", Timeout: "6s"}},
+		{{Command: "/bin/true", Timeout: "0s"}},
+		{{Command: "/bin/true", Threshold: -1}},
+		{{Command: "/bin/true"}, {Command: "/bin/false"}},
+	} {
+		if _, err := parseHealthCheck(checks); err == nil {
+			t.Fatalf("expected error for %+v", checks[0])
+		}
+	}
+}
+
+func TestHealthChecker_Record(t *testing.T) {
+	t.Parallel()
+	var emitted []string
+	events := newEventStream("")
+	c := newHealthChecker(&healthCheck{Command: []string{"/bin/check"}, Threshold: 2}, nil, events,
+		func(format string, args ...interface{}) {
+			emitted = append(emitted, fmt.Sprintf(format, args...))
+		}, testLogger())
+	if h := c.Health(); h != HealthUnknown {
+		t.Fatalf("got health %v; want %v", h, HealthUnknown)
+	}
+
+	// The task is unhealthy once the threshold of consecutive failures is
+	// reached and transitions are only published once
+	states := []HealthState{}
+	for _, failure := range []string{"", "exited with code 1: down", "", "exited with code 1: down", "exited with code 2: down", "timed out after 1s", ""} {
+		c.record(failure)
+		states = append(states, c.Health())
+	}
+	expectedStates := []HealthState{
+		HealthHealthy, HealthHealthy, HealthHealthy, HealthHealthy, HealthUnhealthy, HealthUnhealthy, HealthHealthy,
+	}
+	if !reflect.DeepEqual(states, expectedStates) {
+		t.Fatalf("got states %v; want %v", states, expectedStates)
+	}
+
+	expected := []string{
+		"Health check passed; task is healthy",
+		"Health check exited with code 2: down; task is unhealthy after 2 consecutive failures",
+		"Health check passed; task is healthy",
+	}
+	if !reflect.DeepEqual(emitted, expected) {
+		t.Fatalf("got task events %q; want %q", emitted, expected)
+	}
+
+	var types []string
+	for len(events.Events()) != 0 {
+		types = append(types, (<-events.Events()).Type)
+	}
+	if exp := []string{DriverEventHealthy, DriverEventUnhealthy, DriverEventHealthy}; !reflect.DeepEqual(types, exp) {
+		t.Fatalf("got driver events %v; want %v", types, exp)
+	}
+}
+
+func TestHealthChecker_Probe(t *testing.T) {
+	t.Parallel()
+	check := &healthCheck{Command: []string{"/bin/check", "-v"}, Timeout: 50 * time.Millisecond}
+	var code int
+	var err error
+	exec := func(ctx context.Context, cmd string, args []string) ([]byte, int, error) {
+		if cmd != "/bin/check" || !reflect.DeepEqual(args, []string{"-v"}) {
+			t.Errorf("unexpected command %q %v", cmd, args)
+		}
+		if code < 0 {
+			// The check hangs past its deadline
+			time.Sleep(time.Second)
+		}
+		return []byte("output\n"), code, err
+	}
+	c := newHealthChecker(check, exec, newEventStream(""), nil, testLogger())
+	stopCh := make(chan struct{})
+
+	if failure, _ := c.probe(stopCh); failure != "" {
+		t.Fatalf("expected the check to pass; got %q", failure)
+	}
+	code = 1
+	if failure, _ := c.probe(stopCh); failure != "exited with code 1: output" {
+		t.Fatalf("unexpected failure %q", failure)
+	}
+	code, err = 0, fmt.Errorf("exec failed")
+	if failure, _ := c.probe(stopCh); !strings.Contains(failure, "exec failed") {
+		t.Fatalf("unexpected failure %q", failure)
+	}
+	code, err = -1, nil
+	if failure, _ := c.probe(stopCh); !strings.Contains(failure, "timed out") {
+		t.Fatalf("unexpected failure %q", failure)
+	}
+
+	// Checks stop with the task
+	close(stopCh)
+	if _, stopped := c.probe(stopCh); !stopped {
+		t.Fatalf("expected the check to be stopped")
+	}
+}
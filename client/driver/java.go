@@ -14,10 +14,12 @@ import (
 	"syscall"
 	"time"
 
+	metrics "github.com/armon/go-metrics"
 	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/go-plugin"
 	"github.com/mitchellh/mapstructure"
 
+	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/client/driver/env"
 	"github.com/hashicorp/nomad/client/driver/executor"
 	dstructs "github.com/hashicorp/nomad/client/driver/structs"
@@ -108,6 +110,7 @@ func (d *JavaDriver) Abilities() DriverAbilities {
 	return DriverAbilities{
 		SendSignals: true,
 		Exec:        true,
+		CombineLogs: true,
 	}
 }
 
@@ -278,6 +281,8 @@ func (d *JavaDriver) Start(ctx *ExecContext, task *structs.Task) (*StartResponse
 		ResourceLimits: true,
 		User:           getExecutorUser(task),
 		TaskKillSignal: taskKillSignal,
+		CgroupRetries:  d.config.ReadIntDefault("cgroup.write_retries", config.DefaultCgroupWriteRetries),
+		ReapOrphans:    d.config.ReadBoolDefault("executor.reap_orphans", false),
 	}
 	ps, err := execIntf.LaunchCmd(execCmd)
 	if err != nil {
@@ -285,6 +290,9 @@ func (d *JavaDriver) Start(ctx *ExecContext, task *structs.Task) (*StartResponse
 		return nil, err
 	}
 	d.logger.Printf("[DEBUG] driver.java: started process with pid: %v", ps.Pid)
+	if ps.CgroupRetries > 0 {
+		metrics.IncrCounter([]string{"client", "driver", "java", "cgroup_write_retries"}, float32(ps.CgroupRetries))
+	}
 
 	// Return a driver handle
 	maxKill := d.DriverContext.config.MaxKillTimeout
@@ -408,6 +416,16 @@ func (h *javaHandle) Signal(s os.Signal) error {
 	return h.executor.Signal(s)
 }
 
+// RecentOutput returns the most recent output of the task if its log config
+// enables buffering.
+func (h *javaHandle) RecentOutput() ([]byte, []byte, error) {
+	out, err := h.executor.RecentOutput()
+	if err != nil {
+		return nil, nil, err
+	}
+	return out.Stdout, out.Stderr, nil
+}
+
 func (h *javaHandle) Kill() error {
 	if err := h.executor.ShutDown(); err != nil {
 		if h.pluginClient.Exited() {
@@ -455,6 +473,13 @@ func (h *javaHandle) run() {
 	h.pluginClient.Kill()
 
 	// Send the results
-	h.waitCh <- &dstructs.WaitResult{ExitCode: ps.ExitCode, Signal: ps.Signal, Err: werr}
+	h.waitCh <- &dstructs.WaitResult{
+		ExitCode:   ps.ExitCode,
+		Signal:     ps.Signal,
+		Err:        werr,
+		CoreDumped: ps.CoreDumped,
+		UserTime:   ps.UserTime,
+		SystemTime: ps.SystemTime,
+	}
 	close(h.waitCh)
 }
@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// FileOptions returns the mode and owner of a task's log files, as set by its
+// log config. A zero mode or negative uid and gid leave the files' defaults.
+// The owner is only returned if the caller runs as root. The log dir is
+// writable by the task, so the files may only be given to the task's user and
+// its groups, which need taskUser to be set.
+func FileOptions(logConfig *structs.LogConfig, taskUser string, logger *log.Logger) (os.FileMode, int, int, error) {
+	mode, err := logConfig.ParseFileMode()
+	if err != nil {
+		return 0, -1, -1, err
+	}
+	if logConfig == nil || logConfig.FileOwner == "" {
+		return mode, -1, -1, nil
+	}
+	if os.Geteuid() != 0 {
+		logger.Printf("[WARN] driver.rotator: ignoring log file owner %q as the client isn't running as root", logConfig.FileOwner)
+		return mode, -1, -1, nil
+	}
+	if taskUser == "" {
+		return 0, -1, -1, fmt.Errorf("log file owner %q can only be set for tasks run as a user", logConfig.FileOwner)
+	}
+
+	name, group := logConfig.FileOwner, ""
+	if i := strings.Index(name, ":"); i != -1 {
+		name, group = name[:i], name[i+1:]
+	}
+
+	owner, err := user.Lookup(name)
+	if err != nil {
+		return 0, -1, -1, fmt.Errorf("failed to look up log file owner %q: %v", name, err)
+	}
+	task, err := user.Lookup(taskUser)
+	if err != nil {
+		return 0, -1, -1, fmt.Errorf("failed to look up task user %q: %v", taskUser, err)
+	}
+	if owner.Uid != task.Uid {
+		return 0, -1, -1, fmt.Errorf("log file owner %q must be the task's user %q", name, taskUser)
+	}
+
+	gidStr := task.Gid
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return 0, -1, -1, fmt.Errorf("failed to look up log file group %q: %v", group, err)
+		}
+		gids, err := task.GroupIds()
+		if err != nil {
+			return 0, -1, -1, fmt.Errorf("failed to look up the groups of task user %q: %v", taskUser, err)
+		}
+		member := g.Gid == task.Gid
+		for _, gid := range gids {
+			member = member || gid == g.Gid
+		}
+		if !member {
+			return 0, -1, -1, fmt.Errorf("log file group %q must be a group of the task's user %q", group, taskUser)
+		}
+		gidStr = g.Gid
+	}
+
+	uid, err := strconv.Atoi(task.Uid)
+	if err != nil {
+		return 0, -1, -1, fmt.Errorf("invalid uid %q of log file owner: %v", task.Uid, err)
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, -1, -1, fmt.Errorf("invalid gid %q of log file group: %v", gidStr, err)
+	}
+	return mode, uid, gid, nil
+}
@@ -0,0 +1,45 @@
+package logging
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileOptions(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	mode, uid, gid, err := FileOptions(&structs.LogConfig{FileMode: "0640"}, "", logger)
+	require.Nil(err)
+	require.Equal(os.FileMode(0640), mode)
+	require.Equal(-1, uid)
+	require.Equal(-1, gid)
+
+	if os.Geteuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("nobody user not found")
+	}
+
+	// The files may only be given to the task's user
+	_, _, _, err = FileOptions(&structs.LogConfig{FileOwner: "nobody"}, "", logger)
+	require.NotNil(err)
+	_, _, _, err = FileOptions(&structs.LogConfig{FileOwner: "root"}, "nobody", logger)
+	require.NotNil(err)
+	require.Contains(err.Error(), "must be the task's user")
+	_, _, _, err = FileOptions(&structs.LogConfig{FileOwner: "nobody:root"}, "nobody", logger)
+	require.NotNil(err)
+	require.Contains(err.Error(), "must be a group of the task's user")
+
+	_, uid, gid, err = FileOptions(&structs.LogConfig{FileOwner: "nobody"}, "nobody", logger)
+	require.Nil(err)
+	require.Equal(nobody.Uid, strconv.Itoa(uid))
+	require.Equal(nobody.Gid, strconv.Itoa(gid))
+}
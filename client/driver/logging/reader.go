@@ -0,0 +1,203 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// readerPollDur is how often a followed set of rotated files is checked for
+// new output once the reader caught up.
+const readerPollDur = 250 * time.Millisecond
+
+// rotatedReader is the reading end of a set of rotated files. Closing it stops
+// the stream.
+type rotatedReader struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (r *rotatedReader) Close() error {
+	r.cancel()
+	return r.PipeReader.Close()
+}
+
+// RotatedOffset is a position within a set of rotated files.
+type RotatedOffset struct {
+	// Index is the index of the file, or -1 for the start of the oldest file
+	Index int
+
+	// Offset is the offset within the file
+	Offset int64
+}
+
+// RotatedEnd returns the current end of the set of files written by a
+// FileRotator, such as to only read the output written after it. The start of
+// the oldest file is returned if there are no files yet.
+func RotatedEnd(path, baseFile string) (RotatedOffset, error) {
+	idx, err := lastFileIndex(path, baseFile)
+	if err != nil || idx < 0 {
+		return RotatedOffset{Index: -1}, err
+	}
+	fi, err := os.Stat(filepath.Join(path, fmt.Sprintf("%s.%d", baseFile, idx)))
+	if err != nil {
+		return RotatedOffset{Index: -1}, err
+	}
+	return RotatedOffset{Index: idx, Offset: fi.Size()}, nil
+}
+
+// NewRotatedReader returns a reader of the set of files written by a
+// FileRotator, starting with the oldest file. Once a file is read, reading
+// continues with the next file, so output isn't dropped when the files are
+// rotated while they're read. Without follow, the stream ends once the newest
+// file is read. With follow, the stream waits for new output until ctx is
+// done or the reader is closed and then ends with io.EOF.
+func NewRotatedReader(ctx context.Context, path, baseFile string, follow bool) (io.ReadCloser, error) {
+	return NewRotatedReaderFrom(ctx, path, baseFile, RotatedOffset{Index: -1}, follow)
+}
+
+// NewRotatedReaderFrom is like NewRotatedReader but starts reading at the
+// given offset. If its file was purged, reading starts with the oldest file
+// following it.
+func NewRotatedReaderFrom(ctx context.Context, path, baseFile string, from RotatedOffset, follow bool) (io.ReadCloser, error) {
+	idx, offset := from.Index, from.Offset
+	if idx < 0 {
+		var err error
+		if idx, err = nextFileIndex(path, baseFile, -1); err != nil {
+			return nil, err
+		}
+		if idx < 0 {
+			return nil, fmt.Errorf("no log files named %q found", baseFile)
+		}
+		offset = 0
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	go func() {
+		// Unblock writes to a reader that stopped reading
+		<-ctx.Done()
+		pw.Close()
+	}()
+	go func() {
+		defer cancel()
+		pw.CloseWithError(streamRotatedFiles(ctx, path, baseFile, idx, offset, follow, pw))
+	}()
+	return &rotatedReader{PipeReader: pr, cancel: cancel}, nil
+}
+
+// streamRotatedFiles copies the rotated files to w, starting at the offset
+// within the file of the given index, until the stream ends.
+func streamRotatedFiles(ctx context.Context, path, baseFile string, idx int, offset int64, follow bool, w io.Writer) error {
+	for {
+		file, err := os.Open(filepath.Join(path, fmt.Sprintf("%s.%d", baseFile, idx)))
+		if os.IsNotExist(err) {
+			// The file was purged before it was opened, so the stream
+			// continues with the oldest remaining file
+			offset = 0
+			next, err := nextFileIndex(path, baseFile, idx)
+			if err != nil {
+				return err
+			}
+			if next < 0 {
+				return fmt.Errorf("log file %s.%d was removed", baseFile, idx)
+			}
+			idx = next
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if offset != 0 {
+			if _, err := file.Seek(offset, io.SeekStart); err != nil {
+				file.Close()
+				return err
+			}
+			offset = 0
+		}
+
+		next, err := streamRotatedFile(ctx, path, baseFile, idx, follow, file, w)
+		file.Close()
+		if err != nil || next < 0 {
+			return err
+		}
+		idx = next
+	}
+}
+
+// streamRotatedFile copies the file of the given index to w and returns the
+// index of the file to continue with, or -1 if the stream ended.
+func streamRotatedFile(ctx context.Context, path, baseFile string, idx int, follow bool,
+	file *os.File, w io.Writer) (int, error) {
+	for {
+		if _, err := io.Copy(w, file); err != nil {
+			return -1, err
+		}
+
+		// The rotator closes a file before it creates the next one, so once
+		// a later file exists the rest of this one can be read
+		next, err := nextFileIndex(path, baseFile, idx)
+		if err != nil {
+			return -1, err
+		}
+		if next >= 0 {
+			if _, err := io.Copy(w, file); err != nil {
+				return -1, err
+			}
+			return next, nil
+		}
+		if !follow {
+			return -1, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return -1, nil
+		case <-time.After(readerPollDur):
+		}
+	}
+}
+
+// lastFileIndex returns the highest index of the rotated files, or -1 if
+// there's none.
+func lastFileIndex(path, baseFile string) (int, error) {
+	last := -1
+	for {
+		next, err := nextFileIndex(path, baseFile, last)
+		if err != nil || next < 0 {
+			return last, err
+		}
+		last = next
+	}
+}
+
+// nextFileIndex returns the lowest index of the rotated files that is greater
+// than after, or -1 if there's none.
+func nextFileIndex(path, baseFile string, after int) (int, error) {
+	finfos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return -1, err
+	}
+
+	next := -1
+	prefix := fmt.Sprintf("%s.", baseFile)
+	for _, fi := range finfos {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), prefix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(fi.Name(), prefix))
+		if err != nil {
+			continue
+		}
+		if n > after && (next < 0 || n < next) {
+			next = n
+		}
+	}
+	return next, nil
+}
@@ -0,0 +1,183 @@
+package logging
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotatedReader_NoFiles(t *testing.T) {
+	t.Parallel()
+	path, err := ioutil.TempDir("", pathPrefix)
+	if err != nil {
+		t.Fatalf("test setup err: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	if _, err := NewRotatedReader(context.Background(), path, baseFileName, false); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestRotatedReader_Rotated(t *testing.T) {
+	t.Parallel()
+	path, err := ioutil.TempDir("", pathPrefix)
+	if err != nil {
+		t.Fatalf("test setup err: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	// The files are read in index order from the oldest remaining file
+	files := map[string]string{
+		baseFileName + ".2":  "two\n",
+		baseFileName + ".3":  "three\n",
+		baseFileName + ".10": "ten\n",
+		"redis.stderr.4":     "other stream\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(path, name), []byte(content), 0644); err != nil {
+			t.Fatalf("test setup err: %v", err)
+		}
+	}
+
+	r, err := NewRotatedReader(context.Background(), path, baseFileName, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if act := string(out); act != "two\nthree\nten\n" {
+		t.Fatalf("unexpected output %q", act)
+	}
+}
+
+func TestRotatedReader_From(t *testing.T) {
+	t.Parallel()
+	path, err := ioutil.TempDir("", pathPrefix)
+	if err != nil {
+		t.Fatalf("test setup err: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	if end, err := RotatedEnd(path, baseFileName); err != nil || end.Index != -1 {
+		t.Fatalf("expected the start of the oldest file without files; got %+v, %v", end, err)
+	}
+
+	write := func(idx int, content string) {
+		name := filepath.Join(path, fmt.Sprintf("%s.%d", baseFileName, idx))
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("test setup err: %v", err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(content); err != nil {
+			t.Fatalf("test setup err: %v", err)
+		}
+	}
+	read := func(from RotatedOffset) string {
+		r, err := NewRotatedReaderFrom(context.Background(), path, baseFileName, from, false)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer r.Close()
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return string(out)
+	}
+
+	// Only the output written after the recorded end is read
+	write(2, "two\n")
+	write(3, "old\n")
+	end, err := RotatedEnd(path, baseFileName)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if exp := (RotatedOffset{Index: 3, Offset: 4}); end != exp {
+		t.Fatalf("got end %+v; want %+v", end, exp)
+	}
+	write(3, "new\n")
+	write(4, "four\n")
+	if act := read(end); act != "new\nfour\n" {
+		t.Fatalf("unexpected output %q", act)
+	}
+
+	// Reading continues with the following file if the file was purged
+	if err := os.Remove(filepath.Join(path, baseFileName+".3")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if act := read(end); act != "four\n" {
+		t.Fatalf("unexpected output %q", act)
+	}
+}
+
+func TestRotatedReader_Follow(t *testing.T) {
+	t.Parallel()
+	path, err := ioutil.TempDir("", pathPrefix)
+	if err != nil {
+		t.Fatalf("test setup err: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	fr, err := NewFileRotator(path, baseFileName, 1000, 64, logger)
+	if err != nil {
+		t.Fatalf("test setup err: %v", err)
+	}
+	defer fr.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, err := NewRotatedReader(ctx, path, baseFileName, true)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Close()
+
+	// Lines written while the reader follows the files are read in order
+	// across many rotations
+	const lines = 100
+	go func() {
+		for i := 0; i < lines; i++ {
+			fmt.Fprintf(fr, "line %d\n", i)
+			if i%10 == 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}()
+
+	scanner := bufio.NewScanner(r)
+	for i := 0; i < lines; i++ {
+		if !scanner.Scan() {
+			t.Fatalf("stream ended after %d lines: %v", i, scanner.Err())
+		}
+		if exp := fmt.Sprintf("line %d", i); scanner.Text() != exp {
+			t.Fatalf("got line %q; want %q", scanner.Text(), exp)
+		}
+	}
+	if idx, _ := nextFileIndex(path, baseFileName, 0); idx < 0 {
+		t.Fatalf("expected the files to be rotated")
+	}
+
+	// Cancelling the context ends the stream
+	cancel()
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for scanner.Scan() {
+		}
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stream didn't end once the context was cancelled")
+	}
+}
@@ -0,0 +1,71 @@
+package logging
+
+import (
+	"sync"
+)
+
+// RingBuffer is an io.Writer that retains the most recent bytes written to it
+// up to a fixed size, discarding older bytes.
+type RingBuffer struct {
+	buf   []byte // buf holds the retained bytes once it has wrapped around
+	size  int    // size is the maximum number of bytes retained
+	start int    // start is the index of the oldest byte in buf
+	full  bool   // full is whether buf has wrapped around
+	lock  sync.Mutex
+}
+
+// NewRingBuffer returns a ring buffer retaining up to size bytes.
+func NewRingBuffer(size int) *RingBuffer {
+	return &RingBuffer{
+		buf:  make([]byte, 0, size),
+		size: size,
+	}
+}
+
+// Write appends p to the buffer, discarding the oldest bytes if the buffer
+// is full. It never fails.
+func (r *RingBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if r.size == 0 {
+		return n, nil
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// Only the tail of writes larger than the buffer is retained
+	if len(p) >= r.size {
+		r.buf = append(r.buf[:0], p[len(p)-r.size:]...)
+		r.start = 0
+		r.full = true
+		return n, nil
+	}
+
+	if !r.full {
+		free := r.size - len(r.buf)
+		if len(p) <= free {
+			r.buf = append(r.buf, p...)
+			return n, nil
+		}
+		r.buf = append(r.buf, p[:free]...)
+		p = p[free:]
+		r.full = true
+	}
+
+	for len(p) > 0 {
+		c := copy(r.buf[r.start:], p)
+		p = p[c:]
+		r.start = (r.start + c) % r.size
+	}
+	return n, nil
+}
+
+// Bytes returns a copy of the retained bytes, oldest first.
+func (r *RingBuffer) Bytes() []byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	out := make([]byte, 0, len(r.buf))
+	out = append(out, r.buf[r.start:]...)
+	return append(out, r.buf[:r.start]...)
+}
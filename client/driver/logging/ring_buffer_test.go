@@ -0,0 +1,47 @@
+package logging
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRingBuffer_Write(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		name   string
+		writes []string
+		expect string
+	}{
+		{"empty", nil, ""},
+		{"partial", []string{"ab", "c"}, "abc"},
+		{"exact", []string{"abc", "de"}, "abcde"},
+		{"wrap", []string{"abc", "def", "g"}, "cdefg"},
+		{"wrap twice", []string{"abcd", "efgh", "ijkl"}, "hijkl"},
+		{"large write", []string{"ab", "cdefghij"}, "fghij"},
+		{"wrap after large write", []string{"abcdefgh", "xy"}, "fghxy"},
+	}
+
+	for _, c := range cases {
+		r := NewRingBuffer(5)
+		for _, w := range c.writes {
+			n, err := r.Write([]byte(w))
+			if err != nil || n != len(w) {
+				t.Fatalf("%s: Write(%q) = %d, %v", c.name, w, n, err)
+			}
+		}
+		if out := r.Bytes(); !bytes.Equal(out, []byte(c.expect)) {
+			t.Fatalf("%s: got %q; want %q", c.name, out, c.expect)
+		}
+	}
+}
+
+func TestRingBuffer_ZeroSize(t *testing.T) {
+	t.Parallel()
+	r := NewRingBuffer(0)
+	if n, err := r.Write([]byte("abc")); n != 3 || err != nil {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+	if out := r.Bytes(); len(out) != 0 {
+		t.Fatalf("got %q; want nothing", out)
+	}
+}
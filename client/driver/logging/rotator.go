@@ -12,6 +12,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/hashicorp/nomad/client/allocdir"
 )
 
 const (
@@ -34,6 +36,10 @@ type FileRotator struct {
 	bufw        *bufio.Writer
 	bufLock     sync.Mutex
 
+	fileMode os.FileMode // fileMode is the mode of the files, if set
+	uid      int         // uid is the owner of the files, if not negative
+	gid      int         // gid is the group of the files, if not negative
+
 	flushTicker *time.Ticker
 	logger      *log.Logger
 	purgeCh     chan struct{}
@@ -52,6 +58,8 @@ func NewFileRotator(path string, baseFile string, maxFiles int,
 
 		path:         path,
 		baseFileName: baseFile,
+		uid:          -1,
+		gid:          -1,
 
 		flushTicker: time.NewTicker(flushDur),
 		logger:      logger,
@@ -170,13 +178,30 @@ func (f *FileRotator) lastFile() error {
 	return nil
 }
 
-// createFile opens a new or existing file for writing
+// createFile opens a new or existing file for writing. Tasks can write to the
+// log dir, so neither the dir nor the file are followed if they're symbolic
+// links and the file must be a regular file without other hard links, as its
+// mode and owner are changed once it's opened.
 func (f *FileRotator) createFile() error {
-	logFileName := filepath.Join(f.path, fmt.Sprintf("%s.%d", f.baseFileName, f.logFileIdx))
-	cFile, err := os.OpenFile(logFileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	dir, err := allocdir.OpenDirBeneath(filepath.Dir(f.path), filepath.Base(f.path), false, 0)
 	if err != nil {
 		return err
 	}
+	defer dir.Close()
+
+	logFileName := fmt.Sprintf("%s.%d", f.baseFileName, f.logFileIdx)
+	cFile, err := allocdir.OpenFileAt(dir, logFileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if fi, err := cFile.Stat(); err != nil || !fi.Mode().IsRegular() {
+		cFile.Close()
+		return fmt.Errorf("log file %q is not a regular file", cFile.Name())
+	}
+	if err := f.applyFileOptions(cFile); err != nil {
+		cFile.Close()
+		return err
+	}
 	f.currentFile = cFile
 	fi, err := f.currentFile.Stat()
 	if err != nil {
@@ -187,6 +212,32 @@ func (f *FileRotator) createFile() error {
 	return nil
 }
 
+// SetFileOptions sets the mode and owner of the rotated files. They are applied
+// to the current file and to every file created on rotation. A zero mode or
+// negative uid and gid leave the respective attributes unchanged. It should be
+// called before writing to the rotator.
+func (f *FileRotator) SetFileOptions(mode os.FileMode, uid, gid int) error {
+	f.fileMode = mode
+	f.uid = uid
+	f.gid = gid
+	return f.applyFileOptions(f.currentFile)
+}
+
+// applyFileOptions sets the configured mode and owner on the file.
+func (f *FileRotator) applyFileOptions(file *os.File) error {
+	if f.fileMode != 0 {
+		if err := file.Chmod(f.fileMode); err != nil {
+			return fmt.Errorf("failed to set mode of log file: %v", err)
+		}
+	}
+	if f.uid >= 0 || f.gid >= 0 {
+		if err := file.Chown(f.uid, f.gid); err != nil {
+			return fmt.Errorf("failed to set owner of log file: %v", err)
+		}
+	}
+	return nil
+}
+
 // flushPeriodically flushes the buffered writer every 100ms to the underlying
 // file
 func (f *FileRotator) flushPeriodically() {
@@ -211,6 +262,21 @@ func (f *FileRotator) Close() {
 	}
 }
 
+// Sync flushes the buffered writes and commits the current file to stable
+// storage. It's used to make sure the output of a task that exited is in its
+// log files before its exit is reported.
+func (f *FileRotator) Sync() error {
+	f.bufLock.Lock()
+	defer f.bufLock.Unlock()
+	if f.bufw == nil {
+		return nil
+	}
+	if err := f.bufw.Flush(); err != nil {
+		return err
+	}
+	return f.currentFile.Sync()
+}
+
 // purgeOldFiles removes older files and keeps only the last N files rotated for
 // a file
 func (f *FileRotator) purgeOldFiles() {
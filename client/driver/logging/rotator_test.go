@@ -43,6 +43,39 @@ func TestFileRotator_CreateNewFile(t *testing.T) {
 	}
 }
 
+func TestFileRotator_FileMode(t *testing.T) {
+	t.Parallel()
+	var path string
+	var err error
+	if path, err = ioutil.TempDir("", pathPrefix); err != nil {
+		t.Fatalf("test setup err: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	fr, err := NewFileRotator(path, baseFileName, 10, 5, logger)
+	if err != nil {
+		t.Fatalf("test setup err: %v", err)
+	}
+	if err := fr.SetFileOptions(0640, -1, -1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Write enough to rotate so the new file must have the same mode
+	if _, err := fr.Write([]byte("abcdefgh")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	for _, name := range []string{"redis.stdout.0", "redis.stdout.1"} {
+		fi, err := os.Stat(filepath.Join(path, name))
+		if err != nil {
+			t.Fatalf("expected file %v: %v", name, err)
+		}
+		if mode := fi.Mode().Perm(); mode != 0640 {
+			t.Fatalf("expected mode of %v to be 0640; got %o", name, mode)
+		}
+	}
+}
+
 func TestFileRotator_OpenLastFile(t *testing.T) {
 	t.Parallel()
 	var path string
@@ -109,6 +142,38 @@ func TestFileRotator_WriteToCurrentFile(t *testing.T) {
 	})
 }
 
+func TestFileRotator_Sync(t *testing.T) {
+	t.Parallel()
+	var path string
+	var err error
+	if path, err = ioutil.TempDir("", pathPrefix); err != nil {
+		t.Fatalf("test setup err: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	fr, err := NewFileRotator(path, baseFileName, 10, 1024, logger)
+	if err != nil {
+		t.Fatalf("test setup err: %v", err)
+	}
+	defer fr.Close()
+
+	if _, err := fr.Write([]byte("verdict: PASS")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := fr.Sync(); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	// The write is in the file without waiting for the periodic flush
+	act, err := ioutil.ReadFile(filepath.Join(path, "redis.stdout.0"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(act) != "verdict: PASS" {
+		t.Fatalf("expected the synced write, got %q", act)
+	}
+}
+
 func TestFileRotator_RotateFiles(t *testing.T) {
 	t.Parallel()
 	var path string
@@ -0,0 +1,59 @@
+// +build !windows
+
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileRotator_Links(t *testing.T) {
+	t.Parallel()
+	path, err := ioutil.TempDir("", pathPrefix)
+	if err != nil {
+		t.Fatalf("test setup err: %v", err)
+	}
+	defer os.RemoveAll(path)
+
+	outside := filepath.Join(path, "outside")
+	if err := ioutil.WriteFile(outside, []byte("host"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	logs := filepath.Join(path, "logs")
+	if err := os.Mkdir(logs, 0777); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Neither a symbolic nor a hard link planted by the task is opened, so
+	// the file it points to keeps its mode
+	if err := os.Symlink(outside, filepath.Join(logs, "redis.stdout.0")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := NewFileRotator(logs, baseFileName, 10, 10, logger); err == nil {
+		t.Fatalf("expected an error opening a symbolic link")
+	}
+	os.Remove(filepath.Join(logs, "redis.stdout.0"))
+	if err := os.Link(outside, filepath.Join(logs, "redis.stdout.0")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := NewFileRotator(logs, baseFileName, 10, 10, logger); err == nil {
+		t.Fatalf("expected an error opening a hard link")
+	}
+	if fi, err := os.Stat(outside); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected the linked file to be untouched: %v", err)
+	}
+
+	// Nor is a log dir replaced by a symbolic link
+	dir := filepath.Join(path, "dir")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Symlink(dir, filepath.Join(path, "linked")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := NewFileRotator(filepath.Join(path, "linked"), baseFileName, 10, 10, logger); err == nil {
+		t.Fatalf("expected an error opening a symbolic link to the log dir")
+	}
+}
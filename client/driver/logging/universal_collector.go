@@ -22,6 +22,9 @@ type LogCollectorContext struct {
 	// TaskName is the name of the Task
 	TaskName string
 
+	// AllocID is the ID of the allocation the task belongs to
+	AllocID string
+
 	// AllocDir is the handle to do operations on the alloc dir of
 	// the task
 	AllocDir *allocdir.AllocDir
@@ -29,6 +32,10 @@ type LogCollectorContext struct {
 	// LogConfig provides configuration related to log rotation
 	LogConfig *structs.LogConfig
 
+	// User is the user the task runs as, which the log files may be given
+	// to by the log config
+	User string
+
 	// PortUpperBound is the upper bound of the ports that we can use to start
 	// the syslog server
 	PortUpperBound uint
@@ -86,25 +93,36 @@ func (s *SyslogCollector) LaunchCollector(ctx *LogCollectorContext) (*SyslogColl
 		return nil, err
 	}
 
+	mode, uid, gid, err := FileOptions(ctx.LogConfig, ctx.User, s.logger)
+	if err != nil {
+		return nil, err
+	}
+
 	s.server = NewSyslogServer(l, s.syslogChan, s.logger)
 	go s.server.Start()
 	logFileSize := int64(ctx.LogConfig.MaxFileSizeMB * 1024 * 1024)
 
 	//FIXME There's an easier way to get this
 	logdir := ctx.AllocDir.TaskDirs[ctx.TaskName].LogDir
-	lro, err := NewFileRotator(logdir, fmt.Sprintf("%v.stdout", ctx.TaskName),
+	lro, err := NewFileRotator(logdir, ctx.LogConfig.FileBaseName(ctx.TaskName, ctx.AllocID, "stdout"),
 		ctx.LogConfig.MaxFiles, logFileSize, s.logger)
 
 	if err != nil {
 		return nil, err
 	}
+	if err := lro.SetFileOptions(mode, uid, gid); err != nil {
+		return nil, err
+	}
 	s.lro = lro
 
-	lre, err := NewFileRotator(logdir, fmt.Sprintf("%v.stderr", ctx.TaskName),
+	lre, err := NewFileRotator(logdir, ctx.LogConfig.FileBaseName(ctx.TaskName, ctx.AllocID, "stderr"),
 		ctx.LogConfig.MaxFiles, logFileSize, s.logger)
 	if err != nil {
 		return nil, err
 	}
+	if err := lre.SetFileOptions(mode, uid, gid); err != nil {
+		return nil, err
+	}
 	s.lre = lre
 
 	go s.collectLogs(lre, lro)
@@ -0,0 +1,118 @@
+package driver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/client/driver/executor"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// memInfoPath is the path memory statistics are read from
+	memInfoPath = "/proc/meminfo"
+)
+
+// parseMemInfo parses the contents of /proc/meminfo into a map of field
+// names to values in kB.
+func parseMemInfo(r io.Reader) (map[string]uint64, error) {
+	fields := make(map[string]uint64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse meminfo field %q: %v", parts[0], err)
+		}
+		fields[strings.TrimSuffix(parts[0], ":")] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// availableMemoryMB returns the memory that can be allocated without
+// swapping, in MB. It uses the kernel's own estimate if available and
+// otherwise counts free memory together with reclaimable caches.
+func availableMemoryMB(fields map[string]uint64) (uint64, error) {
+	if v, ok := fields["MemAvailable"]; ok {
+		return v / 1024, nil
+	}
+
+	free, ok := fields["MemFree"]
+	if !ok {
+		return 0, fmt.Errorf("meminfo is missing MemFree")
+	}
+	kb := free + fields["Buffers"] + fields["Cached"] + fields["SReclaimable"]
+	return kb / 1024, nil
+}
+
+// hostTotalMemoryMB returns the total memory of the host in MB.
+func hostTotalMemoryMB() (uint64, error) {
+	f, err := os.Open(memInfoPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fields, err := parseMemInfo(f)
+	if err != nil {
+		return 0, err
+	}
+	total, ok := fields["MemTotal"]
+	if !ok {
+		return 0, fmt.Errorf("meminfo is missing MemTotal")
+	}
+	return total / 1024, nil
+}
+
+// hostAvailableMemoryMB returns the available memory of the host in MB.
+func hostAvailableMemoryMB() (uint64, error) {
+	f, err := os.Open(memInfoPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fields, err := parseMemInfo(f)
+	if err != nil {
+		return 0, err
+	}
+	return availableMemoryMB(fields)
+}
+
+// checkAvailableMemory returns an error if less than the task's memory plus
+// the headroom is available.
+func checkAvailableMemory(task *structs.Task, headroomMB int, availableMB uint64) error {
+	if task.Resources == nil {
+		return nil
+	}
+
+	required := uint64(task.Resources.MemoryMB + headroomMB)
+	if availableMB < required {
+		return fmt.Errorf("insufficient memory to start task %q: %d MB available, %d MB required (%d MB for the task and %d MB headroom)",
+			task.Name, availableMB, required, task.Resources.MemoryMB, headroomMB)
+	}
+	return nil
+}
+
+// checkTmpfsSize returns an error if the tmpfs of a task together are larger
+// than the host's memory.
+func checkTmpfsSize(mounts []*executor.TmpfsMount, totalMB uint64) error {
+	var size uint64
+	for _, m := range mounts {
+		size += uint64(m.SizeMB)
+	}
+	if size > totalMB {
+		return fmt.Errorf("tmpfs of %d MB exceed the host's %d MB of memory", size, totalMB)
+	}
+	return nil
+}
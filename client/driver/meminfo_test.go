@@ -0,0 +1,73 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/client/driver/executor"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemInfo_Available(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// The kernel's estimate is preferred
+	fields, err := parseMemInfo(strings.NewReader(`MemTotal:        8048576 kB
+MemFree:          102400 kB
+MemAvailable:    2097152 kB
+Buffers:          204800 kB
+Cached:          1048576 kB
+SReclaimable:     102400 kB
+HugePages_Total:       0
+`))
+	require.Nil(err)
+	require.EqualValues(0, fields["HugePages_Total"])
+	available, err := availableMemoryMB(fields)
+	require.Nil(err)
+	require.EqualValues(2048, available)
+
+	// Older kernels count free memory and reclaimable caches
+	delete(fields, "MemAvailable")
+	available, err = availableMemoryMB(fields)
+	require.Nil(err)
+	require.EqualValues(1424, available)
+
+	_, err = availableMemoryMB(map[string]uint64{})
+	require.NotNil(err)
+
+	_, err = parseMemInfo(strings.NewReader("MemFree: lots kB\n"))
+	require.NotNil(err)
+}
+
+func TestMemInfo_CheckAvailable(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	task := &structs.Task{
+		Name:      "web",
+		Resources: &structs.Resources{MemoryMB: 256},
+	}
+	require.Nil(checkAvailableMemory(task, 0, 256))
+	require.Nil(checkAvailableMemory(task, 64, 512))
+
+	err := checkAvailableMemory(task, 64, 300)
+	require.NotNil(err)
+	require.Contains(err.Error(), "insufficient memory")
+}
+
+func TestMemInfo_CheckTmpfsSize(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	mounts := []*executor.TmpfsMount{
+		{TaskPath: "/scratch", SizeMB: 512},
+		{TaskPath: "/cache", SizeMB: 512},
+	}
+	require.Nil(checkTmpfsSize(mounts, 1024))
+
+	err := checkTmpfsSize(mounts, 1000)
+	require.NotNil(err)
+	require.Contains(err.Error(), "exceed the host's 1000 MB")
+}
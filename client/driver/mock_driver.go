@@ -176,6 +176,7 @@ func (m *MockDriver) Start(ctx *ExecContext, task *structs.Task) (*StartResponse
 		ctx:             ctx,
 		task:            task,
 		taskName:        task.Name,
+		allocID:         m.allocID,
 		runFor:          driverConfig.RunFor,
 		killAfter:       driverConfig.KillAfter,
 		killTimeout:     task.KillTimeout,
@@ -252,6 +253,7 @@ type mockDriverHandle struct {
 	ctx             *ExecContext
 	task            *structs.Task
 	taskName        string
+	allocID         string
 	runFor          time.Duration
 	killAfter       time.Duration
 	killTimeout     time.Duration
@@ -406,7 +408,7 @@ func (h *mockDriverHandle) handleLogging() {
 
 	// Setup a log rotator
 	logFileSize := int64(h.task.LogConfig.MaxFileSizeMB * 1024 * 1024)
-	lro, err := logging.NewFileRotator(h.ctx.TaskDir.LogDir, fmt.Sprintf("%v.stdout", h.taskName),
+	lro, err := logging.NewFileRotator(h.ctx.TaskDir.LogDir, h.task.LogConfig.FileBaseName(h.taskName, h.allocID, "stdout"),
 		h.task.LogConfig.MaxFiles, logFileSize, h.logger)
 	if err != nil {
 		h.exitErr = err
@@ -147,6 +147,7 @@ func (d *QemuDriver) Abilities() DriverAbilities {
 	return DriverAbilities{
 		SendSignals: false,
 		Exec:        false,
+		CombineLogs: true,
 	}
 }
 
@@ -331,10 +332,18 @@ func (d *QemuDriver) Start(ctx *ExecContext, task *structs.Task) (*StartResponse
 		return nil, fmt.Errorf("failed to set executor context: %v", err)
 	}
 
+	overrideGroups, groups, err := getExecutorGroups(d.config, task)
+	if err != nil {
+		pluginClient.Kill()
+		return nil, err
+	}
+
 	execCmd := &executor.ExecCommand{
-		Cmd:  args[0],
-		Args: args[1:],
-		User: task.User,
+		Cmd:            args[0],
+		Args:           args[1:],
+		User:           task.User,
+		OverrideGroups: overrideGroups,
+		Groups:         groups,
 	}
 	ps, err := exec.LaunchCmd(execCmd)
 	if err != nil {
@@ -451,6 +460,16 @@ func (h *qemuHandle) Signal(s os.Signal) error {
 	return fmt.Errorf("Qemu driver can't send signals")
 }
 
+// RecentOutput returns the most recent output of the task if its log config
+// enables buffering.
+func (h *qemuHandle) RecentOutput() ([]byte, []byte, error) {
+	out, err := h.executor.RecentOutput()
+	if err != nil {
+		return nil, nil, err
+	}
+	return out.Stdout, out.Stderr, nil
+}
+
 func (h *qemuHandle) Kill() error {
 	gracefulShutdownSent := false
 	// Attempt a graceful shutdown only if it was configured in the job
@@ -511,7 +530,14 @@ func (h *qemuHandle) run() {
 	h.pluginClient.Kill()
 
 	// Send the results
-	h.waitCh <- &dstructs.WaitResult{ExitCode: ps.ExitCode, Signal: ps.Signal, Err: werr}
+	h.waitCh <- &dstructs.WaitResult{
+		ExitCode:   ps.ExitCode,
+		Signal:     ps.Signal,
+		Err:        werr,
+		CoreDumped: ps.CoreDumped,
+		UserTime:   ps.UserTime,
+		SystemTime: ps.SystemTime,
+	}
 	close(h.waitCh)
 }
 
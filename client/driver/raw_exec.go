@@ -84,6 +84,7 @@ func (d *RawExecDriver) Abilities() DriverAbilities {
 	return DriverAbilities{
 		SendSignals: true,
 		Exec:        true,
+		CombineLogs: true,
 	}
 }
 
@@ -149,10 +150,18 @@ func (d *RawExecDriver) Start(ctx *ExecContext, task *structs.Task) (*StartRespo
 		return nil, err
 	}
 
+	overrideGroups, groups, err := getExecutorGroups(d.config, task)
+	if err != nil {
+		pluginClient.Kill()
+		return nil, err
+	}
+
 	execCmd := &executor.ExecCommand{
 		Cmd:            command,
 		Args:           driverConfig.Args,
 		User:           task.User,
+		OverrideGroups: overrideGroups,
+		Groups:         groups,
 		TaskKillSignal: taskKillSignal,
 	}
 	ps, err := exec.LaunchCmd(execCmd)
@@ -267,6 +276,16 @@ func (h *rawExecHandle) Signal(s os.Signal) error {
 	return h.executor.Signal(s)
 }
 
+// RecentOutput returns the most recent output of the task if its log config
+// enables buffering.
+func (h *rawExecHandle) RecentOutput() ([]byte, []byte, error) {
+	out, err := h.executor.RecentOutput()
+	if err != nil {
+		return nil, nil, err
+	}
+	return out.Stdout, out.Stderr, nil
+}
+
 func (h *rawExecHandle) Kill() error {
 	if err := h.executor.ShutDown(); err != nil {
 		if h.pluginClient.Exited() {
@@ -310,6 +329,13 @@ func (h *rawExecHandle) run() {
 	h.pluginClient.Kill()
 
 	// Send the results
-	h.waitCh <- &dstructs.WaitResult{ExitCode: ps.ExitCode, Signal: ps.Signal, Err: werr}
+	h.waitCh <- &dstructs.WaitResult{
+		ExitCode:   ps.ExitCode,
+		Signal:     ps.Signal,
+		Err:        werr,
+		CoreDumped: ps.CoreDumped,
+		UserTime:   ps.UserTime,
+		SystemTime: ps.SystemTime,
+	}
 	close(h.waitCh)
 }
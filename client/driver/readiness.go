@@ -0,0 +1,297 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/driver/logging"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// defaultReadinessTimeout is how long Start waits for a task to be ready
+	// if no timeout is configured.
+	defaultReadinessTimeout = 30 * time.Second
+
+	// maxReadinessTimeout bounds the timeout as Start blocks while waiting.
+	maxReadinessTimeout = 5 * time.Minute
+
+	// readinessPollInterval is how often the file and TCP readiness gates
+	// are checked.
+	readinessPollInterval = 100 * time.Millisecond
+
+	// readinessDialTimeout bounds each connection attempt of a TCP readiness
+	// gate.
+	readinessDialTimeout = time.Second
+)
+
+// readiness is the parsed readiness gate of a task. Exactly one of File, TCP
+// and Stdout is set.
+type readiness struct {
+	// File is the path of the file within the task's chroot
+	File string
+
+	// TCP is the address to connect to. If its host is empty, the task's
+	// address is used.
+	TCP string
+
+	// Stdout is the sentinel the task writes to its stdout once it's ready
+	Stdout string
+
+	Timeout time.Duration
+
+	// tcpAddr is the address the TCP gate connects to once prepared
+	tcpAddr string
+
+	// stdoutFrom is the end of the task's stdout logs when it was launched.
+	// The logs persist across restarts, so a sentinel written by an earlier
+	// run doesn't make the task ready.
+	stdoutFrom logging.RotatedOffset
+}
+
+// parseReadiness parses the readiness gate of a task, returning nil if it has
+// none.
+func parseReadiness(gates []*ExecReadiness) (*readiness, error) {
+	switch len(gates) {
+	case 0:
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("only one readiness may be set")
+	}
+	g := gates[0]
+
+	set := 0
+	for _, v := range []string{g.File, g.TCP, g.Stdout} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("readiness must set exactly one of file, tcp and stdout")
+	}
+
+	r := &readiness{Stdout: g.Stdout, Timeout: defaultReadinessTimeout}
+	if g.File != "" {
+		// The path is within the chroot, so it can't escape the task dir
+		r.File = filepath.Clean("/" + g.File)
+		if r.File == "/" {
+			return nil, fmt.Errorf("readiness file %q must name a file", g.File)
+		}
+	}
+	if g.TCP != "" {
+		_, port, err := net.SplitHostPort(g.TCP)
+		if err != nil {
+			return nil, fmt.Errorf("invalid readiness tcp address %q: %v", g.TCP, err)
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("readiness tcp address %q must have a port between 1 and 65535", g.TCP)
+		}
+		r.TCP = g.TCP
+	}
+	if strings.Contains(g.Stdout, "\n") {
+		return nil, fmt.Errorf("readiness stdout sentinel must not contain a newline")
+	}
+
+	if g.Timeout != "" {
+		d, err := time.ParseDuration(g.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid readiness timeout %q: %v", g.Timeout, err)
+		}
+		if d <= 0 || d > maxReadinessTimeout {
+			return nil, fmt.Errorf("readiness timeout %q must be positive and at most %v", g.Timeout, maxReadinessTimeout)
+		}
+		r.Timeout = d
+	}
+	return r, nil
+}
+
+// prepare resolves the gate before the task is launched: the address the TCP
+// gate connects to and where the stdout gate starts reading the task's logs.
+// The file of the file gate is removed as the task dir persists across
+// restarts, so a file written by an earlier run doesn't make the task ready.
+func (r *readiness) prepare(task *structs.Task, taskDir, bridgeAddr, logDir string, logFiles map[string]string) error {
+	if r.File != "" {
+		if err := removeReadinessFile(taskDir, r.File); err != nil {
+			return err
+		}
+	}
+	if r.TCP != "" {
+		addr, err := readinessTCPAddr(r.TCP, task, bridgeAddr)
+		if err != nil {
+			return err
+		}
+		r.tcpAddr = addr
+	}
+	if r.Stdout != "" {
+		base, ok := logFiles[structs.LogStreamCombined]
+		if !ok {
+			base = logFiles["stdout"]
+		}
+		end, err := logging.RotatedEnd(logDir, base)
+		if err != nil {
+			return fmt.Errorf("failed to find the end of the task's stdout: %v", err)
+		}
+		r.stdoutFrom = end
+	}
+	return nil
+}
+
+// removeReadinessFile removes the file of a file gate from the task dir. The
+// task controls its task dir, so the file is removed without following
+// symbolic links.
+func removeReadinessFile(taskDir, file string) error {
+	rel := strings.TrimPrefix(file, "/")
+	dir, err := allocdir.OpenDirBeneath(taskDir, filepath.Dir(rel), false, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to remove the readiness file %q of an earlier run: %v", file, err)
+	}
+	defer dir.Close()
+
+	if err := allocdir.RemoveAt(dir, filepath.Base(rel)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove the readiness file %q of an earlier run: %v", file, err)
+	}
+	return nil
+}
+
+// waitReady blocks until the task of the handle is ready and returns an
+// error if it exits or isn't ready within the timeout.
+func (r *readiness) waitReady(h *execHandle) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+
+	readyCh := make(chan error, 1)
+	switch {
+	case r.File != "":
+		path := filepath.Join(h.taskDir.Dir, r.File)
+		go func() {
+			readyCh <- pollReady(ctx, func() bool {
+				_, err := os.Stat(path)
+				return err == nil
+			})
+		}()
+	case r.TCP != "":
+		addr := r.tcpAddr
+		go func() {
+			readyCh <- pollReady(ctx, func() bool {
+				conn, err := net.DialTimeout("tcp", addr, readinessDialTimeout)
+				if err != nil {
+					return false
+				}
+				conn.Close()
+				return true
+			})
+		}()
+	default:
+		go func() {
+			readyCh <- r.waitForStdout(ctx, h)
+		}()
+	}
+
+	select {
+	case err := <-readyCh:
+		// Gates stopped by the timeout report it below
+		if err == nil || ctx.Err() == nil {
+			return err
+		}
+	case <-h.doneCh:
+		return fmt.Errorf("task exited before it was ready")
+	case <-ctx.Done():
+	}
+	return fmt.Errorf("task wasn't ready within the readiness timeout of %v", r.Timeout)
+}
+
+// readinessTCPAddr returns the address a TCP gate connects to. Addresses
+// without a host use the task's bridge address, if any. On the host network,
+// the port must be one of the task's ports and its address is used, as any
+// process on the host could be listening on another port.
+func readinessTCPAddr(addr string, task *structs.Task, bridgeAddr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid readiness tcp address %q: %v", addr, err)
+	}
+	if host != "" {
+		return addr, nil
+	}
+	if bridgeAddr != "" {
+		return net.JoinHostPort(bridgeAddr, port), nil
+	}
+
+	p, _ := strconv.Atoi(port)
+	if task.Resources != nil {
+		for _, n := range task.Resources.Networks {
+			for _, ports := range [][]structs.Port{n.ReservedPorts, n.DynamicPorts} {
+				for _, np := range ports {
+					if np.Value == p && n.IP != "" {
+						return net.JoinHostPort(n.IP, port), nil
+					}
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("readiness tcp address %q must have a host or use one of the task's ports", addr)
+}
+
+// waitForStdout reads the task's stdout written since it was launched until
+// the sentinel is written. The stdout of tasks combining their logs is read
+// from their combined output.
+func (r *readiness) waitForStdout(ctx context.Context, h *execHandle) error {
+	base, ok := h.logFiles[structs.LogStreamCombined]
+	if !ok {
+		base = h.logFiles["stdout"]
+	}
+	logs, err := logging.NewRotatedReaderFrom(ctx, h.taskDir.LogDir, base, r.stdoutFrom, true)
+	if err != nil {
+		return err
+	}
+	defer logs.Close()
+
+	// Only the end of the previous read is kept in case the sentinel spans
+	// reads
+	var tail string
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := logs.Read(buf)
+		window := tail + string(buf[:n])
+		if strings.Contains(window, r.Stdout) {
+			return nil
+		}
+		if keep := len(r.Stdout) - 1; len(window) > keep {
+			tail = window[len(window)-keep:]
+		} else {
+			tail = window
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("failed to read stdout: %v", err)
+		}
+	}
+}
+
+// pollReady calls ready every readinessPollInterval, starting right away,
+// until it returns true or the context is done.
+func pollReady(ctx context.Context, ready func() bool) error {
+	ticker := time.NewTicker(readinessPollInterval)
+	defer ticker.Stop()
+	for {
+		if ready() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package driver
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestParseReadiness(t *testing.T) {
+	t.Parallel()
+	if r, err := parseReadiness(nil); err != nil || r != nil {
+		t.Fatalf("expected no readiness; got %+v %v", r, err)
+	}
+
+	cases := []struct {
+		gate     *ExecReadiness
+		expected *readiness
+	}{
+		{
+			&ExecReadiness{File: "local/ready"},
+			&readiness{File: "/local/ready", Timeout: defaultReadinessTimeout},
+		},
+		{
+			// Paths can't escape the chroot
+			&ExecReadiness{File: "../../etc/passwd", Timeout: "1m"},
+			&readiness{File: "/etc/passwd", Timeout: time.Minute},
+		},
+		{
+			&ExecReadiness{TCP: ":8080"},
+			&readiness{TCP: ":8080", Timeout: defaultReadinessTimeout},
+		},
+		{
+			&ExecReadiness{Stdout: "listening", Timeout: "10s"},
+			&readiness{Stdout: "listening", Timeout: 10 * time.Second},
+		},
+	}
+	for _, c := range cases {
+		r, err := parseReadiness([]*ExecReadiness{c.gate})
+		if err != nil {
+			t.Fatalf("failed to parse %+v: %v", c.gate, err)
+		}
+		if !reflect.DeepEqual(r, c.expected) {
+			t.Fatalf("got %+v; want %+v", r, c.expected)
+		}
+	}
+
+	for _, gates := range [][]*ExecReadiness{
+		{{}},
+		{{File: "ready", Stdout: "ready"}},
+		{{File: "/"}},
+		{{TCP: "8080"}},
+		{{TCP: ":0"}},
+		{{TCP: "localhost:http"}},
+		{{Stdout: "a\nb"}},
+		{{File: "ready", Timeout: "0s"}},
+		{{File: "ready", Timeout: "1h"}},
+		{{File: "ready"}, {File: "other"}},
+	} {
+		if _, err := parseReadiness(gates); err == nil {
+			t.Fatalf("expected error for %+v", gates[0])
+		}
+	}
+}
+
+func TestReadiness_TCPAddr(t *testing.T) {
+	t.Parallel()
+	task := &structs.Task{
+		Resources: &structs.Resources{
+			Networks: []*structs.NetworkResource{
+				{
+					IP:            "10.0.0.5",
+					ReservedPorts: []structs.Port{{Label: "http", Value: 80}},
+					DynamicPorts:  []structs.Port{{Label: "admin", Value: 23456}},
+				},
+			},
+		},
+	}
+	cases := map[string][]string{
+		// address, bridge address, expected address
+		"10.0.0.1:80": {"", "10.0.0.1:80"},
+		":80":         {"", "10.0.0.5:80"},
+		":23456":      {"", "10.0.0.5:23456"},
+		":8080":       {"172.26.64.2", "172.26.64.2:8080"},
+		"[::1]:80":    {"172.26.64.2", "[::1]:80"},
+	}
+	for addr, c := range cases {
+		act, err := readinessTCPAddr(addr, task, c[0])
+		if err != nil {
+			t.Fatalf("err for %q: %v", addr, err)
+		}
+		if act != c[1] {
+			t.Fatalf("got %q for %q; want %q", act, addr, c[1])
+		}
+	}
+
+	// On the host network, ports that aren't the task's are rejected as any
+	// process on the host could listen on them
+	if _, err := readinessTCPAddr(":8080", task, ""); err == nil {
+		t.Fatalf("expected error for a port that isn't the task's")
+	}
+}
+
+func TestReadiness_Prepare_RemovesFile(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "readiness")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Missing directories are fine
+	r := &readiness{File: "/local/ready", Timeout: 100 * time.Millisecond}
+	if err := r.prepare(&structs.Task{}, dir, "", dir, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A file left over from an earlier run doesn't make the task ready
+	os.MkdirAll(filepath.Join(dir, "local"), 0755)
+	if err := ioutil.WriteFile(filepath.Join(dir, "local", "ready"), nil, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := r.prepare(&structs.Task{}, dir, "", dir, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "local", "ready")); !os.IsNotExist(err) {
+		t.Fatalf("expected the readiness file to be removed: %v", err)
+	}
+	h := &execHandle{taskDir: &allocdir.TaskDir{Dir: dir}, doneCh: make(chan struct{})}
+	if err := r.waitReady(h); err == nil || !strings.Contains(err.Error(), "readiness timeout") {
+		t.Fatalf("expected the readiness timeout; got %v", err)
+	}
+}
+
+func TestReadiness_WaitReady(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "readiness")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	h := &execHandle{taskDir: &allocdir.TaskDir{Dir: dir}, doneCh: make(chan struct{})}
+
+	// The file gate waits for the file to exist
+	r := &readiness{File: "/local/ready", Timeout: 100 * time.Millisecond}
+	if err := r.waitReady(h); err == nil || !strings.Contains(err.Error(), "readiness timeout") {
+		t.Fatalf("expected the readiness timeout; got %v", err)
+	}
+	os.MkdirAll(filepath.Join(dir, "local"), 0755)
+	if err := ioutil.WriteFile(filepath.Join(dir, "local", "ready"), nil, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := r.waitReady(h); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The TCP gate waits for the address to accept connections
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	r = &readiness{TCP: ":" + strconv.Itoa(port), tcpAddr: l.Addr().String(), Timeout: time.Second}
+	if err := r.waitReady(h); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Gates stop waiting once the task exited
+	close(h.doneCh)
+	r = &readiness{File: "/missing", Timeout: time.Minute}
+	if err := r.waitReady(h); err == nil || !strings.Contains(err.Error(), "exited") {
+		t.Fatalf("expected the task to have exited; got %v", err)
+	}
+}
@@ -308,6 +308,7 @@ func (d *RktDriver) Abilities() DriverAbilities {
 	return DriverAbilities{
 		SendSignals: false,
 		Exec:        true,
+		CombineLogs: true,
 	}
 }
 
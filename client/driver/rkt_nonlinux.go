@@ -37,6 +37,10 @@ func (RktDriver) Validate(map[string]interface{}) error {
 	panic("not implemented")
 }
 
+func (RktDriver) ValidateTask(*structs.Task) error {
+	return nil
+}
+
 func (RktDriver) Abilities() DriverAbilities {
 	panic("not implemented")
 }
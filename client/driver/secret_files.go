@@ -0,0 +1,57 @@
+package driver
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/nomad/client/driver/env"
+)
+
+// secretFileVarRe matches the variables interpolated into secret files
+var secretFileVarRe = regexp.MustCompile(`\${([a-zA-Z0-9_\-\.]+)}`)
+
+// validateSecretFiles returns an error if the name of a secret file isn't the
+// name of a file directly within the secrets dir.
+func validateSecretFiles(files map[string]string) error {
+	for name := range files {
+		switch {
+		case name == "", name == ".", name == "..":
+			return fmt.Errorf("secret_files name %q is invalid", name)
+		case strings.Contains(name, "/"):
+			return fmt.Errorf("secret_files name %q must not contain a path separator", name)
+		}
+	}
+	return nil
+}
+
+// interpolateSecretFiles returns the contents of the secret files interpolated
+// with the task's environment and the sorted names of the variables
+// interpolated into them.
+func interpolateSecretFiles(taskEnv *env.TaskEnv, files map[string]string) (map[string]string, []string) {
+	contents := make(map[string]string, len(files))
+	seen := make(map[string]struct{})
+	var vars []string
+	for name, value := range files {
+		contents[name] = taskEnv.ReplaceEnv(value)
+		for _, m := range secretFileVarRe.FindAllStringSubmatch(value, -1) {
+			if _, ok := seen[m[1]]; !ok {
+				seen[m[1]] = struct{}{}
+				vars = append(vars, m[1])
+			}
+		}
+	}
+	sort.Strings(vars)
+	return contents, vars
+}
+
+// withoutTaskEnv returns a copy of the task's environment without the
+// variables.
+func withoutTaskEnv(taskEnv *env.TaskEnv, vars []string) *env.TaskEnv {
+	envMap := taskEnv.Map()
+	for _, k := range vars {
+		delete(envMap, k)
+	}
+	return env.NewTaskEnv(envMap, taskEnv.NodeAttrs)
+}
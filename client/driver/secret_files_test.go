@@ -0,0 +1,56 @@
+package driver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/client/driver/env"
+)
+
+func TestValidateSecretFiles(t *testing.T) {
+	t.Parallel()
+	if err := validateSecretFiles(map[string]string{"db_password": "${DB_PASSWORD}", ".pgpass": "x"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, name := range []string{"", ".", "..", "db/password", "../password"} {
+		if err := validateSecretFiles(map[string]string{name: "x"}); err == nil {
+			t.Fatalf("expected error for name %q", name)
+		}
+	}
+}
+
+func TestInterpolateSecretFiles(t *testing.T) {
+	t.Parallel()
+	taskEnv := env.NewTaskEnv(map[string]string{
+		"DB_USER":     "web",
+		"DB_PASSWORD": "hunter2",
+		"PORT":        "8080",
+	}, map[string]string{"attr.unique.hostname": "node1"})
+
+	contents, vars := interpolateSecretFiles(taskEnv, map[string]string{
+		"db_password": "${DB_PASSWORD}",
+		"pgpass":      "${attr.unique.hostname}:5432:*:${DB_USER}:${DB_PASSWORD}",
+	})
+	expContents := map[string]string{
+		"db_password": "hunter2",
+		"pgpass":      "node1:5432:*:web:hunter2",
+	}
+	if !reflect.DeepEqual(contents, expContents) {
+		t.Fatalf("expected contents %v; got %v", expContents, contents)
+	}
+	if exp := []string{"DB_PASSWORD", "DB_USER", "attr.unique.hostname"}; !reflect.DeepEqual(vars, exp) {
+		t.Fatalf("expected vars %v; got %v", exp, vars)
+	}
+
+	// The variables are removed from a copy of the environment
+	without := withoutTaskEnv(taskEnv, vars)
+	if exp := map[string]string{"PORT": "8080"}; !reflect.DeepEqual(without.EnvMap, exp) {
+		t.Fatalf("expected environment %v; got %v", exp, without.EnvMap)
+	}
+	if _, ok := taskEnv.EnvMap["DB_PASSWORD"]; !ok {
+		t.Fatalf("expected the task's environment to be unchanged")
+	}
+	if without.ReplaceEnv("${attr.unique.hostname}") != "node1" {
+		t.Fatalf("expected the node attributes to be kept")
+	}
+}
@@ -0,0 +1,78 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul-template/signals"
+)
+
+// signalCoalescer collapses repeated deliveries of the same signal that occur
+// within a configured window into a single delivery. Only signals that have
+// been explicitly configured are coalesced; all others are always delivered.
+type signalCoalescer struct {
+	windows map[os.Signal]time.Duration
+	last    map[os.Signal]time.Time
+	lock    sync.Mutex
+}
+
+// newSignalCoalescer returns a signalCoalescer for the given mapping of signal
+// names to coalescing windows. Signal names must be valid or an error is
+// returned.
+func newSignalCoalescer(windows map[string]time.Duration) (*signalCoalescer, error) {
+	c := &signalCoalescer{
+		windows: make(map[os.Signal]time.Duration, len(windows)),
+		last:    make(map[os.Signal]time.Time, len(windows)),
+	}
+	for name, window := range windows {
+		sig, err := signals.Parse(name)
+		if err != nil {
+			return nil, err
+		}
+		if window < 0 {
+			return nil, fmt.Errorf("coalescing window for signal %s must not be negative: %v", name, window)
+		}
+		c.windows[sig] = window
+	}
+	return c, nil
+}
+
+// Allow returns whether the signal should be delivered. If the signal was
+// already delivered within its coalescing window the call is collapsed into
+// the prior delivery and false is returned.
+func (c *signalCoalescer) Allow(s os.Signal) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	window, ok := c.windows[s]
+	if !ok || window == 0 {
+		return true
+	}
+
+	now := time.Now()
+	if last, ok := c.last[s]; ok && now.Sub(last) < window {
+		return false
+	}
+	c.last[s] = now
+	return true
+}
+
+// parseSignalCoalesce parses a mapping of signal names to duration strings as
+// given in a task's config.
+func parseSignalCoalesce(raw map[string]string) (map[string]time.Duration, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	windows := make(map[string]time.Duration, len(raw))
+	for name, v := range raw {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid coalescing window for signal %s: %v", name, err)
+		}
+		windows[name] = d
+	}
+	return windows, nil
+}
@@ -0,0 +1,54 @@
+package driver
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignalCoalescer_Allow(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	c, err := newSignalCoalescer(map[string]time.Duration{"SIGHUP": time.Hour})
+	require.Nil(err)
+
+	// The first signal is always delivered and repeats are collapsed
+	require.True(c.Allow(syscall.SIGHUP))
+	require.False(c.Allow(syscall.SIGHUP))
+	require.False(c.Allow(syscall.SIGHUP))
+
+	// Signals that aren't configured are never coalesced
+	require.True(c.Allow(syscall.SIGTERM))
+	require.True(c.Allow(syscall.SIGTERM))
+}
+
+func TestSignalCoalescer_WindowExpires(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	c, err := newSignalCoalescer(map[string]time.Duration{"sighup": 50 * time.Millisecond})
+	require.Nil(err)
+
+	require.True(c.Allow(syscall.SIGHUP))
+	require.False(c.Allow(syscall.SIGHUP))
+	time.Sleep(100 * time.Millisecond)
+	require.True(c.Allow(syscall.SIGHUP))
+}
+
+func TestSignalCoalescer_Invalid(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	_, err := newSignalCoalescer(map[string]time.Duration{"SIGFOO": time.Second})
+	require.NotNil(err)
+
+	_, err = parseSignalCoalesce(map[string]string{"SIGHUP": "soon"})
+	require.NotNil(err)
+
+	windows, err := parseSignalCoalesce(map[string]string{"SIGHUP": "2s"})
+	require.Nil(err)
+	require.Equal(2*time.Second, windows["SIGHUP"])
+}
@@ -0,0 +1,50 @@
+package driver
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// globalStartThrottle tracks when the tasks on the node were last
+	// started so that starting them again too soon can be throttled.
+	globalStartThrottle = newStartThrottle()
+)
+
+// startThrottle enforces a minimum interval between starts of the same task so
+// that tasks crash looping faster than their restart policy delays them don't
+// thrash the node.
+type startThrottle struct {
+	// last maps a task ID to when it was last started
+	last map[string]time.Time
+
+	lock sync.Mutex
+}
+
+// newStartThrottle returns an empty startThrottle.
+func newStartThrottle() *startThrottle {
+	return &startThrottle{
+		last: make(map[string]time.Time),
+	}
+}
+
+// Allow records a start of the task with the given ID at now and returns zero,
+// or returns how long until the task may be started again if it was started
+// less than interval ago. Starts that are throttled aren't recorded. Tasks
+// last started longer than interval ago are forgotten.
+func (t *startThrottle) Allow(id string, now time.Time, interval time.Duration) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for other, last := range t.last {
+		if now.Sub(last) >= interval {
+			delete(t.last, other)
+		}
+	}
+
+	if last, ok := t.last[id]; ok {
+		return last.Add(interval).Sub(now)
+	}
+	t.last[id] = now
+	return 0
+}
@@ -0,0 +1,29 @@
+package driver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartThrottle_Allow(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	throttle := newStartThrottle()
+	now := time.Now()
+
+	require.Zero(throttle.Allow("a", now, 10*time.Second))
+	require.Zero(throttle.Allow("b", now, 10*time.Second))
+
+	// Starting again too soon is throttled without being recorded
+	require.Equal(7*time.Second, throttle.Allow("a", now.Add(3*time.Second), 10*time.Second))
+	require.Equal(2*time.Second, throttle.Allow("a", now.Add(8*time.Second), 10*time.Second))
+
+	// Once the interval elapsed the task may start again
+	require.Zero(throttle.Allow("a", now.Add(10*time.Second), 10*time.Second))
+	require.Equal(10*time.Second, throttle.Allow("a", now.Add(10*time.Second), 10*time.Second))
+
+	// Tasks that weren't started within the interval are forgotten
+	require.NotContains(throttle.last, "b")
+}
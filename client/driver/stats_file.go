@@ -0,0 +1,204 @@
+package driver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	cstructs "github.com/hashicorp/nomad/client/structs"
+)
+
+const (
+	// defaultStatsFileInterval is how often the task's stats are appended to
+	// its stats file if no interval is configured.
+	defaultStatsFileInterval = 10 * time.Second
+
+	// defaultStatsFileMaxMB is the size in MB at which the stats file is
+	// rotated if no size is configured.
+	defaultStatsFileMaxMB = 10
+
+	// procDir is the directory the IO and file descriptor stats of processes
+	// are read from
+	procDir = "/proc"
+)
+
+// statsFileRecord is a line of a task's stats file.
+type statsFileRecord struct {
+	Timestamp   int64
+	MemoryStats *cstructs.MemoryStats `json:",omitempty"`
+	CpuStats    *cstructs.CpuStats    `json:",omitempty"`
+
+	// IOStats and OpenFiles are summed over the task's processes. They're
+	// only available on Linux.
+	IOStats   *statsFileIO `json:",omitempty"`
+	OpenFiles *int         `json:",omitempty"`
+}
+
+// statsFileIO holds the bytes the task's processes read from and wrote to
+// storage.
+type statsFileIO struct {
+	ReadBytes  uint64
+	WriteBytes uint64
+}
+
+// statsFileWriter periodically appends a task's resource usage to a file in
+// its task directory as JSON lines. Once the file exceeds its maximum size it's
+// rotated to a single ".1" backup so at most twice the size is retained. The
+// task can write to its task directory, so the file is written without
+// following symbolic links.
+type statsFileWriter struct {
+	// dir is the task directory and path the file's path relative to it
+	dir      string
+	path     string
+	interval time.Duration
+	maxBytes int64
+	stats    func() (*cstructs.TaskResourceUsage, error)
+	logger   *log.Logger
+}
+
+// run appends the task's stats to the file every interval until stopCh is
+// closed.
+func (w *statsFileWriter) run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+
+		ru, err := w.stats()
+		if err != nil {
+			w.logger.Printf("[DEBUG] driver: failed to collect stats for stats file %q: %v", w.path, err)
+			continue
+		}
+		if err := w.write(newStatsFileRecord(ru)); err != nil {
+			w.logger.Printf("[WARN] driver: %v", err)
+		}
+	}
+}
+
+// write appends the record to the stats file, rotating the file first if the
+// record would make it exceed its maximum size.
+func (w *statsFileWriter) write(record *statsFileRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode stats: %v", err)
+	}
+	line = append(line, '\n')
+
+	dir, err := allocdir.OpenDirBeneath(w.dir, filepath.Dir(w.path), true, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to open stats file directory: %v", err)
+	}
+	defer dir.Close()
+
+	name := filepath.Base(w.path)
+	f, err := allocdir.OpenFileAt(dir, name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open stats file: %v", err)
+	}
+	if fi, err := f.Stat(); err == nil && fi.Size() > 0 && fi.Size()+int64(len(line)) > w.maxBytes {
+		f.Close()
+		if err := allocdir.RenameAt(dir, name, dir, name+".1"); err != nil {
+			return fmt.Errorf("failed to rotate stats file: %v", err)
+		}
+		if f, err = allocdir.OpenFileAt(dir, name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return fmt.Errorf("failed to open stats file: %v", err)
+		}
+	}
+	defer f.Close()
+	if _, err := f.Write(line); err != nil {
+		return fmt.Errorf("failed to write stats file: %v", err)
+	}
+	return nil
+}
+
+// newStatsFileRecord returns the record of the task's resource usage.
+func newStatsFileRecord(ru *cstructs.TaskResourceUsage) *statsFileRecord {
+	record := &statsFileRecord{Timestamp: ru.Timestamp}
+	if ru.ResourceUsage != nil {
+		record.MemoryStats = ru.ResourceUsage.MemoryStats
+		record.CpuStats = ru.ResourceUsage.CpuStats
+	}
+
+	var pids []int
+	for p := range ru.Pids {
+		if pid, err := strconv.Atoi(p); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	record.IOStats, record.OpenFiles = procStats(procDir, pids)
+	return record
+}
+
+// procStats sums the IO and open file descriptors of the processes from the
+// proc file system mounted at dir. Either is nil if it can't be read for any
+// of the processes, such as on systems without a proc file system.
+func procStats(dir string, pids []int) (*statsFileIO, *int) {
+	if len(pids) == 0 {
+		return nil, nil
+	}
+
+	io := &statsFileIO{}
+	files := 0
+	for _, pid := range pids {
+		piddir := filepath.Join(dir, strconv.Itoa(pid))
+		if io != nil {
+			if err := readProcIO(filepath.Join(piddir, "io"), io); err != nil {
+				io = nil
+			}
+		}
+		if files >= 0 {
+			fds, err := ioutil.ReadDir(filepath.Join(piddir, "fd"))
+			if err != nil {
+				files = -1
+			} else {
+				files += len(fds)
+			}
+		}
+	}
+
+	if files < 0 {
+		return io, nil
+	}
+	return io, &files
+}
+
+// readProcIO adds the storage IO from the proc io file at path to io.
+func readProcIO(path string, io *statsFileIO) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch parts[0] {
+		case "read_bytes":
+			io.ReadBytes += v
+		case "write_bytes":
+			io.WriteBytes += v
+		}
+	}
+	return scanner.Err()
+}
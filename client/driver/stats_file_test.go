@@ -0,0 +1,141 @@
+package driver
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cstructs "github.com/hashicorp/nomad/client/structs"
+)
+
+func TestStatsFileWriter_Write(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "stats_file")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	record := &statsFileRecord{
+		Timestamp:   1,
+		MemoryStats: &cstructs.MemoryStats{RSS: 1024},
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Records are appended until the file would exceed its maximum size
+	w := &statsFileWriter{
+		dir:      dir,
+		path:     filepath.Join("local", "stats.jsonl"),
+		maxBytes: int64(3 * (len(line) + 1)),
+		logger:   testLogger(),
+	}
+	for i := 0; i < 3; i++ {
+		if err := w.write(record); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	path := filepath.Join(dir, w.path)
+	if lines := readStatsFile(t, path); len(lines) != 3 {
+		t.Fatalf("got %d records; want 3", len(lines))
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Fatalf("stats file rotated too early: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := w.write(record); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	lines := readStatsFile(t, path)
+	rotated := readStatsFile(t, path+".1")
+	if len(lines) != 3 || len(rotated) != 3 {
+		t.Fatalf("got %d and %d rotated records; want 3 each", len(lines), len(rotated))
+	}
+	if lines[0].MemoryStats == nil || lines[0].MemoryStats.RSS != 1024 {
+		t.Fatalf("unexpected record %+v", lines[0])
+	}
+
+	// A symlink the task put in place of the directory isn't followed
+	outside, err := ioutil.TempDir("", "stats_file")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	os.RemoveAll(filepath.Join(dir, "local"))
+	if err := os.Symlink(outside, filepath.Join(dir, "local")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := w.write(record); err == nil {
+		t.Fatalf("expected error writing through a symlink")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "stats.jsonl")); !os.IsNotExist(err) {
+		t.Fatalf("stats file written outside of the task dir: %v", err)
+	}
+}
+
+func TestStatsFile_procStats(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for pid, io := range map[string]string{
+		"10": "rchar: 5\nread_bytes: 100\nwrite_bytes: 7\n",
+		"11": "read_bytes: 20\nwrite_bytes: 3\ncancelled_write_bytes: 1\n",
+	} {
+		fds := filepath.Join(dir, pid, "fd")
+		if err := os.MkdirAll(fds, 0755); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		for _, fd := range []string{"0", "1"} {
+			if err := ioutil.WriteFile(filepath.Join(fds, fd), nil, 0644); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, pid, "io"), []byte(io), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	io, files := procStats(dir, []int{10, 11})
+	if io == nil || io.ReadBytes != 120 || io.WriteBytes != 10 {
+		t.Fatalf("got io %+v; want 120 bytes read and 10 written", io)
+	}
+	if files == nil || *files != 4 {
+		t.Fatalf("got %v open files; want 4", files)
+	}
+
+	// Stats are omitted if any process can't be read
+	io, files = procStats(dir, []int{10, 12})
+	if io != nil || files != nil {
+		t.Fatalf("got %+v and %v; want no stats", io, files)
+	}
+}
+
+func readStatsFile(t *testing.T, path string) []*statsFileRecord {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer f.Close()
+
+	var records []*statsFileRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r statsFileRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("invalid record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, &r)
+	}
+	return records
+}
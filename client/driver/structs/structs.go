@@ -18,6 +18,31 @@ type WaitResult struct {
 	ExitCode int
 	Signal   int
 	Err      error
+
+	// OOMKilled is whether the task was killed by the OOM killer for
+	// exceeding its memory limit
+	OOMKilled bool
+
+	// MemorySoftLimitKilled is whether the driver killed the task for
+	// exceeding its memory soft limit for longer than its grace period
+	MemorySoftLimitKilled bool
+
+	// CoreDumped is whether the task dumped core when killed by Signal
+	CoreDumped bool
+
+	// CoreFiles are the paths, relative to the alloc dir, the driver moved
+	// the task's core dumps to, if it keeps them
+	CoreFiles []string
+
+	// UserTime and SystemTime are the CPU time the task spent in user and
+	// kernel mode, if the driver reports them
+	UserTime   time.Duration
+	SystemTime time.Duration
+
+	// StartedAt and FinishedAt are when the task was started and exited, if
+	// the driver reports them
+	StartedAt  time.Time
+	FinishedAt time.Time
 }
 
 func NewWaitResult(code, signal int, err error) *WaitResult {
@@ -28,15 +53,153 @@ func NewWaitResult(code, signal int, err error) *WaitResult {
 	}
 }
 
+// Runtime returns how long the task ran, or zero if the driver doesn't report
+// when it was started and exited. Tasks failing shortly after starting are
+// likely crash looping rather than failing after doing work.
+func (r *WaitResult) Runtime() time.Duration {
+	if r.StartedAt.IsZero() || r.FinishedAt.IsZero() {
+		return 0
+	}
+	return r.FinishedAt.Sub(r.StartedAt)
+}
+
 func (r *WaitResult) Successful() bool {
 	return r.ExitCode == 0 && r.Signal == 0 && r.Err == nil
 }
 
 func (r *WaitResult) String() string {
+	if r.OOMKilled {
+		return fmt.Sprintf("Wait returned exit code %v, signal %v, and error %v after being OOM killed",
+			r.ExitCode, r.Signal, r.Err)
+	}
+	if r.MemorySoftLimitKilled {
+		return fmt.Sprintf("Wait returned exit code %v, signal %v, and error %v after being killed for exceeding the memory soft limit",
+			r.ExitCode, r.Signal, r.Err)
+	}
 	return fmt.Sprintf("Wait returned exit code %v, signal %v, and error %v",
 		r.ExitCode, r.Signal, r.Err)
 }
 
+// StartFailure categorizes why a task failed to start. The set of categories
+// is stable so it can be relied upon by operators and metrics.
+type StartFailure string
+
+const (
+	// StartFailureConfig is an invalid task configuration.
+	StartFailureConfig StartFailure = "config"
+
+	// StartFailureCommand is a command that couldn't be found or executed.
+	StartFailureCommand StartFailure = "command"
+
+	// StartFailureUser is a user that couldn't be resolved or assumed.
+	StartFailureUser StartFailure = "user"
+
+	// StartFailureChroot is a failure to set up the task's chroot.
+	StartFailureChroot StartFailure = "chroot"
+
+	// StartFailureCgroup is a failure to create or join the task's cgroups.
+	StartFailureCgroup StartFailure = "cgroup"
+
+	// StartFailureFilesystem is a failure to write into the task's
+	// directories, such as for logging.
+	StartFailureFilesystem StartFailure = "filesystem"
+
+	// StartFailureExecutor is a failure to launch or talk to the executor.
+	StartFailureExecutor StartFailure = "executor"
+
+	// StartFailureNetwork is a failure to set up the task's networking, such
+	// as listening on its socket activated port.
+	StartFailureNetwork StartFailure = "network"
+
+	// StartFailureThrottled is a start rejected as the task was started
+	// again too soon after its previous start.
+	StartFailureThrottled StartFailure = "throttled"
+
+	// StartFailureUnknown is used when a failure couldn't be categorized.
+	StartFailureUnknown StartFailure = "unknown"
+)
+
+// UserFault returns whether the failure is caused by the job rather than by
+// the node the task was placed on.
+func (f StartFailure) UserFault() bool {
+	switch f {
+	case StartFailureConfig, StartFailureCommand, StartFailureUser:
+		return true
+	default:
+		return false
+	}
+}
+
+// StartError is returned by drivers when a task fails to start and carries
+// the category of the failure.
+type StartError struct {
+	Category StartFailure
+	Err      error
+}
+
+// NewStartError wraps the error with the given failure category.
+func NewStartError(category StartFailure, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &StartError{Category: category, Err: err}
+}
+
+func (e *StartError) Error() string {
+	return e.Err.Error()
+}
+
+// IsRecoverable returns whether the wrapped error is recoverable.
+func (e *StartError) IsRecoverable() bool {
+	r, ok := e.Err.(interface {
+		IsRecoverable() bool
+	})
+	return ok && r.IsRecoverable()
+}
+
+// StartFailureCategory returns the failure category of an error returned when
+// starting a task.
+func StartFailureCategory(err error) StartFailure {
+	if serr, ok := err.(*StartError); ok {
+		return serr.Category
+	}
+	return StartFailureUnknown
+}
+
+// StartTooSoonError is returned by drivers that throttle starting a task again
+// too soon after its previous start to protect the node from tasks that crash
+// loop. The task may be started again after Wait.
+type StartTooSoonError struct {
+	Wait time.Duration
+}
+
+// NewStartTooSoonError returns a StartTooSoonError for a task that may be
+// started again after wait.
+func NewStartTooSoonError(wait time.Duration) error {
+	return &StartTooSoonError{Wait: wait}
+}
+
+func (e *StartTooSoonError) Error() string {
+	return fmt.Sprintf("task was started again too soon; it may be started again in %v", e.Wait)
+}
+
+// IsRecoverable returns true as the task can be started once Wait elapsed.
+func (e *StartTooSoonError) IsRecoverable() bool {
+	return true
+}
+
+// StartTooSoonWait returns how long to wait before starting the task again if
+// the error, or the error wrapped by a StartError, is a StartTooSoonError.
+func StartTooSoonWait(err error) (time.Duration, bool) {
+	if serr, ok := err.(*StartError); ok {
+		err = serr.Err
+	}
+	if terr, ok := err.(*StartTooSoonError); ok {
+		return terr.Wait, true
+	}
+	return 0, false
+}
+
 // CheckResult encapsulates the result of a check
 type CheckResult struct {
 
@@ -7,4 +7,8 @@ import cgroupConfig "github.com/opencontainers/runc/libcontainer/configs"
 type IsolationConfig struct {
 	Cgroup      *cgroupConfig.Cgroup
 	CgroupPaths map[string]string
+
+	// NetworkNamespace is the name of the network namespace the user process
+	// runs in, if it's isolated from the host network
+	NetworkNamespace string
 }
@@ -0,0 +1,42 @@
+package driver
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// taskUUID returns the stable ID of the task of the allocation. Unlike the
+// task's PID it's the same across restarts of the task and reattaches of its
+// handle, as it's derived from the allocation ID and the task's name.
+func taskUUID(allocID, taskName string) string {
+	sum := sha256.Sum256([]byte(allocID + "/" + taskName))
+
+	// The ID is formatted as a name based UUID
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// taskLogWriter logs the lines written to it with the driver's logger, tagged
+// with the ID of the task they're logged for.
+type taskLogWriter struct {
+	logger *log.Logger
+	taskID string
+}
+
+func (w *taskLogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	if err := w.logger.Output(2, fmt.Sprintf("%s task_id=%s", line, w.taskID)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// newTaskLogger returns a logger that logs with the driver's logger, tagging
+// every line with the task's ID so that the lines logged for the task can be
+// correlated across its restarts.
+func newTaskLogger(logger *log.Logger, taskID string) *log.Logger {
+	return log.New(&taskLogWriter{logger: logger, taskID: taskID}, "", 0)
+}
@@ -0,0 +1,48 @@
+package driver
+
+import (
+	"bytes"
+	"log"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestTaskUUID(t *testing.T) {
+	t.Parallel()
+	id := taskUUID("2a5c3f9e-0c1d-4b8a-9e3f-6d7c8b9a0e1f", "web")
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Fatalf("expected a UUID; got %q", id)
+	}
+
+	// The ID is stable and differs between the tasks of an allocation
+	if id2 := taskUUID("2a5c3f9e-0c1d-4b8a-9e3f-6d7c8b9a0e1f", "web"); id2 != id {
+		t.Fatalf("expected task ID %q; got %q", id, id2)
+	}
+	if other := taskUUID("2a5c3f9e-0c1d-4b8a-9e3f-6d7c8b9a0e1f", "db"); other == id {
+		t.Fatalf("expected tasks to have different IDs; got %q", id)
+	}
+}
+
+func TestTaskLogger(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	logger := newTaskLogger(log.New(&buf, "nomad: ", 0), "3f1c2a4e-8d9b-5c6f-a7e8-1b2c3d4e5f60")
+
+	logger.Printf("[INFO] driver.exec: started user process %d", 42)
+	logger.Println("[ERR] driver.exec: failed")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	exp := []string{
+		"nomad: [INFO] driver.exec: started user process 42 task_id=3f1c2a4e-8d9b-5c6f-a7e8-1b2c3d4e5f60",
+		"nomad: [ERR] driver.exec: failed task_id=3f1c2a4e-8d9b-5c6f-a7e8-1b2c3d4e5f60",
+	}
+	if len(lines) != len(exp) {
+		t.Fatalf("expected %d lines; got %q", len(exp), lines)
+	}
+	for i := range exp {
+		if lines[i] != exp[i] {
+			t.Fatalf("expected line %q; got %q", exp[i], lines[i])
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package driver
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	cstructs "github.com/hashicorp/nomad/client/structs"
+)
+
+const (
+	// threadCheckInterval is how often the threads of a task are counted
+	threadCheckInterval = 10 * time.Second
+)
+
+// threadMonitor periodically counts the threads of a task's processes. The
+// count is published as a metric and a task event is emitted whenever it
+// crosses the threshold so that thread leaks are caught before they exhaust
+// the node's pids.
+type threadMonitor struct {
+	threshold int
+	stats     func() (*cstructs.TaskResourceUsage, error)
+
+	// excludePid is the pid of the executor whose threads aren't counted
+	excludePid int
+
+	emitEvent LogEventFn
+	labels    []metrics.Label
+	logger    *log.Logger
+
+	// above is whether the count was at or above the threshold when last
+	// checked
+	above bool
+}
+
+// run counts the task's threads every interval until stopCh is closed.
+func (m *threadMonitor) run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(threadCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+
+		ru, err := m.stats()
+		if err != nil {
+			m.logger.Printf("[DEBUG] driver: failed to collect pids to count threads: %v", err)
+			continue
+		}
+
+		var pids []int
+		for p := range ru.Pids {
+			if pid, err := strconv.Atoi(p); err == nil && pid != m.excludePid {
+				pids = append(pids, pid)
+			}
+		}
+		m.check(procThreads(procDir, pids))
+	}
+}
+
+// check publishes the thread count and emits an event if it crossed the
+// threshold since the last check.
+func (m *threadMonitor) check(count int) {
+	metrics.SetGaugeWithLabels([]string{"client", "driver", "exec", "threads"}, float32(count), m.labels)
+
+	above := count >= m.threshold
+	if above == m.above {
+		return
+	}
+	m.above = above
+
+	if above {
+		m.logger.Printf("[WARN] driver: task has %d threads, reaching its threshold of %d", count, m.threshold)
+		if m.emitEvent != nil {
+			m.emitEvent("Task has %d threads, reaching the threshold of %d", count, m.threshold)
+		}
+	} else if m.emitEvent != nil {
+		m.emitEvent("Task has %d threads, back below the threshold of %d", count, m.threshold)
+	}
+}
+
+// procThreads sums the threads of the processes from the proc file system
+// mounted at dir. Processes that exited in the meantime are skipped.
+func procThreads(dir string, pids []int) int {
+	threads := 0
+	for _, pid := range pids {
+		tasks, err := ioutil.ReadDir(filepath.Join(dir, strconv.Itoa(pid), "task"))
+		if err != nil {
+			continue
+		}
+		threads += len(tasks)
+	}
+	return threads
+}
@@ -0,0 +1,83 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestThreadMonitor_Check(t *testing.T) {
+	t.Parallel()
+	var events []string
+	m := &threadMonitor{
+		threshold: 10,
+		emitEvent: func(format string, args ...interface{}) {
+			events = append(events, fmt.Sprintf(format, args...))
+		},
+		logger: testLogger(),
+	}
+
+	// Events are only emitted when the count crosses the threshold
+	for _, count := range []int{5, 9, 10, 12, 11, 8, 3, 10} {
+		m.check(count)
+	}
+
+	expected := []string{
+		"Task has 10 threads, reaching the threshold of 10",
+		"Task has 8 threads, back below the threshold of 10",
+		"Task has 10 threads, reaching the threshold of 10",
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("got events %q; want %q", events, expected)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("got events %q; want %q", events, expected)
+		}
+	}
+}
+
+func TestThreadMonitor_procThreads(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for pid, threads := range map[string][]string{
+		"10": {"10", "11", "12"},
+		"20": {"20"},
+	} {
+		for _, tid := range threads {
+			if err := os.MkdirAll(filepath.Join(dir, pid, "task", tid), 0755); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+	}
+
+	// Processes that exited are skipped
+	if n := procThreads(dir, []int{10, 20, 30}); n != 4 {
+		t.Fatalf("got %d threads; want 4", n)
+	}
+}
+
+func TestExecDriver_threadsThreshold(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		max, threshold, expected int
+	}{
+		{0, 0, 0},
+		{0, 50, 50},
+		{100, 0, 90},
+		{100, 20, 20},
+		{1, 0, 1},
+	}
+	for _, c := range cases {
+		if got := threadsThreshold(c.max, c.threshold); got != c.expected {
+			t.Errorf("threadsThreshold(%d, %d) = %d; want %d", c.max, c.threshold, got, c.expected)
+		}
+	}
+}
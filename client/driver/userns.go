@@ -0,0 +1,299 @@
+package driver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/driver/executor"
+)
+
+const (
+	// execDriverUsernsAttr is the key populated in Node Attributes if tasks
+	// can run in user namespaces: the kernel allows creating them and the
+	// userns owner has subordinate uids and gids.
+	execDriverUsernsAttr = "driver.exec.userns"
+
+	// execUsernsConfigOption is the key for allowing tasks to run in user
+	// namespaces with userns. It's disabled by default as root of a task's
+	// namespace holds every capability within it.
+	execUsernsConfigOption = "driver.exec.userns.enable"
+
+	// execUsernsOwnerConfigOption is the key for the user whose subordinate
+	// uids and gids, in /etc/subuid and /etc/subgid, the ids of tasks in user
+	// namespaces are mapped to.
+	execUsernsOwnerConfigOption = "driver.exec.userns_owner"
+
+	// defaultUsernsOwner is the default owner of the subordinate ids
+	defaultUsernsOwner = "root"
+
+	// defaultUsernsSize is the number of ids mapped into the user namespace
+	// of a task by default, covering the 16-bit ids of most distributions.
+	defaultUsernsSize = 65536
+)
+
+var (
+	// subUIDFile and subGIDFile list the subordinate uids and gids of users
+	subUIDFile = "/etc/subuid"
+	subGIDFile = "/etc/subgid"
+
+	// globalSubUIDs and globalSubGIDs track the subordinate ids mapped into
+	// the user namespaces of the tasks on the node.
+	globalSubUIDs = newIDRangeAllocator()
+	globalSubGIDs = newIDRangeAllocator()
+)
+
+// ExecUserns runs the task in a user namespace in which its ids, from zero to
+// size, are mapped to subordinate ids of the userns owner.
+type ExecUserns struct {
+	Size int `mapstructure:"size"`
+}
+
+// parseUserns returns the number of ids mapped into the task's user
+// namespace, or zero if it doesn't use one.
+func parseUserns(userns []*ExecUserns) (uint32, error) {
+	switch len(userns) {
+	case 0:
+		return 0, nil
+	case 1:
+	default:
+		return 0, fmt.Errorf("only one userns may be set")
+	}
+
+	size := userns[0].Size
+	if size == 0 {
+		return defaultUsernsSize, nil
+	}
+	if size < 0 {
+		return 0, fmt.Errorf("userns size %d must be positive", size)
+	}
+	return uint32(size), nil
+}
+
+// idRange is a range of Size subordinate ids starting at Start.
+type idRange struct {
+	Start uint32
+	Size  uint32
+}
+
+// end returns the id after the range.
+func (r idRange) end() uint64 {
+	return uint64(r.Start) + uint64(r.Size)
+}
+
+// overlaps returns whether the ranges share an id.
+func (r idRange) overlaps(o idRange) bool {
+	return uint64(r.Start) < o.end() && uint64(o.Start) < r.end()
+}
+
+// parseSubIDs parses the ranges of the owner, by name or uid, in the
+// name:start:count lines of a subordinate id file.
+func parseSubIDs(r io.Reader, name, uid string) ([]idRange, error) {
+	var ranges []idRange
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 || (parts[0] != name && parts[0] != uid) {
+			continue
+		}
+		start, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subordinate id range %q: %v", line, err)
+		}
+		count, err := strconv.ParseUint(parts[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subordinate id range %q: %v", line, err)
+		}
+		if count == 0 {
+			continue
+		}
+		ranges = append(ranges, idRange{Start: uint32(start), Size: uint32(count)})
+	}
+	return ranges, scanner.Err()
+}
+
+// readSubIDs returns the subordinate id ranges of the user in the file.
+func readSubIDs(path string, u *user.User) ([]idRange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseSubIDs(f, u.Username, u.Uid)
+}
+
+// lookupUsernsOwner looks up the owner of the subordinate ids by name or uid.
+func lookupUsernsOwner(owner string) (*user.User, error) {
+	u, err := user.Lookup(owner)
+	if err == nil {
+		return u, nil
+	}
+	if _, perr := strconv.ParseUint(owner, 10, 32); perr == nil {
+		if u, err := user.LookupId(owner); err == nil {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to look up userns owner %q: %v", owner, err)
+}
+
+// usernsSupported returns whether the owner has subordinate uids and gids to
+// map the ids of tasks to.
+func usernsSupported(owner string) bool {
+	u, err := lookupUsernsOwner(owner)
+	if err != nil {
+		return false
+	}
+	uids, err := readSubIDs(subUIDFile, u)
+	if err != nil || len(uids) == 0 {
+		return false
+	}
+	gids, err := readSubIDs(subGIDFile, u)
+	return err == nil && len(gids) != 0
+}
+
+// idRangeAllocator allocates blocks of subordinate ids to tasks so that the
+// ids of tasks in user namespaces don't overlap.
+type idRangeAllocator struct {
+	// ranges maps a task ID to the ids allocated to it
+	ranges map[string]idRange
+
+	lock sync.Mutex
+}
+
+// newIDRangeAllocator returns an empty idRangeAllocator.
+func newIDRangeAllocator() *idRangeAllocator {
+	return &idRangeAllocator{
+		ranges: make(map[string]idRange),
+	}
+}
+
+// Acquire allocates a block of size free ids from the subordinate ranges to
+// the task with the given ID and returns its first id. Blocks are aligned to
+// their size from the start of each range. A task that already has a block
+// of the size within the ranges keeps it.
+func (a *idRangeAllocator) Acquire(id string, ranges []idRange, size uint32) (uint32, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if r, ok := a.ranges[id]; ok {
+		if r.Size == size && withinRanges(r, ranges) {
+			return r.Start, nil
+		}
+		delete(a.ranges, id)
+	}
+
+	for _, sub := range ranges {
+		for start := uint64(sub.Start); start+uint64(size) <= sub.end(); start += uint64(size) {
+			block := idRange{Start: uint32(start), Size: size}
+			if a.allocated(block) {
+				continue
+			}
+			a.ranges[id] = block
+			return block.Start, nil
+		}
+	}
+	return 0, fmt.Errorf("no free block of %d subordinate ids left", size)
+}
+
+// Reserve tracks the ids as allocated to the task with the given ID, such as
+// when reattaching to the task.
+func (a *idRangeAllocator) Reserve(id string, start, size uint32) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.ranges[id] = idRange{Start: start, Size: size}
+}
+
+// Release frees the ids of the task with the given ID.
+func (a *idRangeAllocator) Release(id string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.ranges, id)
+}
+
+// allocated returns whether any id of the block is allocated. The lock must
+// be held.
+func (a *idRangeAllocator) allocated(block idRange) bool {
+	for _, r := range a.ranges {
+		if r.overlaps(block) {
+			return true
+		}
+	}
+	return false
+}
+
+// withinRanges returns whether the block is within one of the ranges.
+func withinRanges(block idRange, ranges []idRange) bool {
+	for _, r := range ranges {
+		if block.Start >= r.Start && block.end() <= r.end() {
+			return true
+		}
+	}
+	return false
+}
+
+// acquireUserns allocates the subordinate uids and gids of the owner mapped
+// into the user namespace of the task with the given ID.
+func acquireUserns(id, owner string, size uint32) (*executor.UserNamespace, error) {
+	u, err := lookupUsernsOwner(owner)
+	if err != nil {
+		return nil, err
+	}
+	uids, err := readSubIDs(subUIDFile, u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subordinate uids: %v", err)
+	}
+	gids, err := readSubIDs(subGIDFile, u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subordinate gids: %v", err)
+	}
+
+	uid, err := globalSubUIDs.Acquire(id, uids, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate uids of %q: %v", u.Username, err)
+	}
+	gid, err := globalSubGIDs.Acquire(id, gids, size)
+	if err != nil {
+		globalSubUIDs.Release(id)
+		return nil, fmt.Errorf("failed to allocate gids of %q: %v", u.Username, err)
+	}
+	return &executor.UserNamespace{UID: uid, GID: gid, Size: size}, nil
+}
+
+// releaseUserns frees the subordinate ids of the task with the given ID.
+func releaseUserns(id string) {
+	globalSubUIDs.Release(id)
+	globalSubGIDs.Release(id)
+}
+
+// chownUsernsTaskDir gives the task's local, secrets and tmp dirs, the alloc
+// dir's data and tmp dirs and their contents to root of the task's user
+// namespace. Files owned by host users are owned by no one within the
+// namespace, so without it the task couldn't write the files that were
+// rendered or downloaded for it. The dirs are walked without following
+// symbolic links as tasks control their contents.
+func chownUsernsTaskDir(taskDir *allocdir.TaskDir, userns *executor.UserNamespace) error {
+	uid, gid := int(userns.UID), int(userns.GID)
+	dirs := map[string][]string{
+		taskDir.Dir:            {allocdir.TaskLocal, allocdir.TaskSecrets, allocdir.TmpDirName},
+		taskDir.SharedAllocDir: {allocdir.SharedDataDir, allocdir.TmpDirName},
+	}
+	for root, names := range dirs {
+		for _, name := range names {
+			if err := allocdir.ChownTreeBeneath(root, name, uid, gid); err != nil {
+				return fmt.Errorf("failed to change the owner of %q: %v", filepath.Join(root, name), err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseUserns(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		userns []*ExecUserns
+		size   uint32
+		err    bool
+	}{
+		{nil, 0, false},
+		{[]*ExecUserns{{}}, defaultUsernsSize, false},
+		{[]*ExecUserns{{Size: 1000}}, 1000, false},
+		{[]*ExecUserns{{Size: -1}}, 0, true},
+		{[]*ExecUserns{{}, {}}, 0, true},
+	}
+	for _, c := range cases {
+		size, err := parseUserns(c.userns)
+		if (err != nil) != c.err || size != c.size {
+			t.Fatalf("parseUserns(%v) = %d, %v; want %d, error %v", c.userns, size, err, c.size, c.err)
+		}
+	}
+}
+
+func TestParseSubIDs(t *testing.T) {
+	t.Parallel()
+	file := `# comment
+nomad:100000:65536
+other:200000:65536
+
+1001:300000:1000
+nomad:400000:0
+`
+	ranges, err := parseSubIDs(strings.NewReader(file), "nomad", "1001")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []idRange{{Start: 100000, Size: 65536}, {Start: 300000, Size: 1000}}
+	if len(ranges) != len(expected) || ranges[0] != expected[0] || ranges[1] != expected[1] {
+		t.Fatalf("got ranges %v; want %v", ranges, expected)
+	}
+
+	if _, err := parseSubIDs(strings.NewReader("nomad:abc:65536\n"), "nomad", "1001"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestIDRangeAllocator(t *testing.T) {
+	t.Parallel()
+	a := newIDRangeAllocator()
+	ranges := []idRange{{Start: 100000, Size: 131072}, {Start: 500000, Size: 65536}}
+
+	// Blocks are allocated in order without overlapping
+	for i, expected := range []uint32{100000, 165536, 500000} {
+		start, err := a.Acquire(string('a'+rune(i)), ranges, 65536)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if start != expected {
+			t.Fatalf("got block at %d; want %d", start, expected)
+		}
+	}
+	if _, err := a.Acquire("d", ranges, 65536); err == nil {
+		t.Fatalf("expected the ranges to be exhausted")
+	}
+
+	// A task keeps its block and released blocks are reused
+	if start, err := a.Acquire("b", ranges, 65536); err != nil || start != 165536 {
+		t.Fatalf("expected task b to keep its block; got %d, %v", start, err)
+	}
+	a.Release("a")
+	if start, err := a.Acquire("d", ranges, 65536); err != nil || start != 100000 {
+		t.Fatalf("expected the released block; got %d, %v", start, err)
+	}
+
+	// Reserved blocks of reattached tasks aren't allocated again
+	a = newIDRangeAllocator()
+	a.Reserve("a", 100005, 10)
+	if start, err := a.Acquire("b", []idRange{{Start: 100000, Size: 40}}, 10); err != nil || start != 100020 {
+		t.Fatalf("expected the block after the reserved one; got %d, %v", start, err)
+	}
+}
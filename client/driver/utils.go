@@ -1,12 +1,18 @@
 package driver
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,12 +23,23 @@ import (
 	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/client/driver/env"
 	"github.com/hashicorp/nomad/client/driver/executor"
+	"github.com/hashicorp/nomad/client/driver/logging"
 	dstructs "github.com/hashicorp/nomad/client/driver/structs"
 	cstructs "github.com/hashicorp/nomad/client/structs"
 	"github.com/hashicorp/nomad/helper/discover"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
 
+const (
+	// executorStderrFile is the base name of the files the executor plugin's
+	// stderr is written to next to its log file if enabled
+	executorStderrFile = "executor.stderr"
+
+	// executorStderrPollInterval is the interval at which it's checked whether
+	// the executor plugin exited to close its stderr file
+	executorStderrPollInterval = 5 * time.Second
+)
+
 // cgroupsMounted returns true if the cgroups are mounted on a system otherwise
 // returns false
 func cgroupsMounted(node *structs.Node) bool {
@@ -52,6 +69,17 @@ func createExecutor(w io.Writer, clientConfig *config.Config,
 	config.MaxPort = clientConfig.ClientMaxPort
 	config.MinPort = clientConfig.ClientMinPort
 
+	// Capture the plugin's raw stderr, such as the output of panics, which
+	// bypasses its logger
+	var stderr *logging.FileRotator
+	if clientConfig.ReadBoolDefault("executor.stderr_file", false) {
+		stderr, err = executorStderrRotator(w, clientConfig, filepath.Dir(executorConfig.LogFile))
+		if err != nil {
+			return nil, nil, err
+		}
+		config.Stderr = stderr
+	}
+
 	// setting the setsid of the plugin process so that it doesn't get signals sent to
 	// the nomad client.
 	if config.Cmd != nil {
@@ -61,17 +89,59 @@ func createExecutor(w io.Writer, clientConfig *config.Config,
 	executorClient := plugin.NewClient(config)
 	rpcClient, err := executorClient.Client()
 	if err != nil {
+		// The plugin is stopped if it started, as the caller can't without
+		// its client, so that it doesn't hold on to its stderr
+		executorClient.Kill()
+		if stderr != nil {
+			stderr.Close()
+		}
 		return nil, nil, fmt.Errorf("error creating rpc client for executor plugin: %v", err)
 	}
+	if stderr != nil {
+		go closeExecutorStderr(executorClient, stderr)
+	}
 
 	raw, err := rpcClient.Dispense("executor")
 	if err != nil {
+		executorClient.Kill()
 		return nil, nil, fmt.Errorf("unable to dispense the executor plugin: %v", err)
 	}
 	executorPlugin := raw.(executor.Executor)
 	return executorPlugin, executorClient, nil
 }
 
+// executorStderrRotator returns the rotator for the executor plugin's stderr
+// in the given directory, sized by the client's options.
+func executorStderrRotator(w io.Writer, clientConfig *config.Config, dir string) (*logging.FileRotator, error) {
+	maxFiles := clientConfig.ReadIntDefault("executor.stderr_max_files", 2)
+	maxFileSizeMB := clientConfig.ReadIntDefault("executor.stderr_max_file_size", 1)
+	if maxFiles < 1 || maxFileSizeMB < 1 {
+		return nil, fmt.Errorf("executor.stderr_max_files and executor.stderr_max_file_size must be at least 1")
+	}
+
+	logger := log.New(w, "", log.LstdFlags|log.Lmicroseconds)
+	rotator, err := logging.NewFileRotator(dir, executorStderrFile, maxFiles, int64(maxFileSizeMB)*1024*1024, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create executor stderr file: %v", err)
+	}
+	return rotator, nil
+}
+
+// closeExecutorStderr closes the stderr rotator of the executor plugin once it
+// exited. It must only be called once the plugin started, as the client is
+// only marked as exited once its process was waited for. Stderr isn't
+// captured anymore once the client reattaches to it.
+func closeExecutorStderr(client *plugin.Client, stderr *logging.FileRotator) {
+	ticker := time.NewTicker(executorStderrPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if client.Exited() {
+			stderr.Close()
+			return
+		}
+	}
+}
+
 func createExecutorWithConfig(config *plugin.ClientConfig, w io.Writer) (executor.Executor, *plugin.Client, error) {
 	config.HandshakeConfig = HandshakeConfig
 
@@ -183,6 +253,118 @@ func getExecutorUser(task *structs.Task) string {
 	return task.User
 }
 
+const (
+	// groupsPolicyInherit runs tasks without a user with the supplementary
+	// groups of the agent.
+	groupsPolicyInherit = "inherit"
+
+	// groupsPolicyDrop runs tasks without a user without any supplementary
+	// groups.
+	groupsPolicyDrop = "drop"
+
+	// groupsPolicyFixed runs tasks without a user with the supplementary
+	// groups listed in the "user.groups" client option.
+	groupsPolicyFixed = "fixed"
+)
+
+// getExecutorGroups returns whether the supplementary groups of the task
+// should be overridden and the groups to use instead, as configured by the
+// "user.groups_policy" client option. Tasks that set a user always use that
+// user's groups.
+func getExecutorGroups(conf *config.Config, task *structs.Task) (bool, []uint32, error) {
+	if task.User != "" {
+		return false, nil, nil
+	}
+
+	switch policy := conf.ReadDefault("user.groups_policy", groupsPolicyInherit); policy {
+	case groupsPolicyInherit:
+		return false, nil, nil
+	case groupsPolicyDrop:
+		return true, nil, nil
+	case groupsPolicyFixed:
+		var gids []uint32
+		for _, g := range strings.Split(conf.ReadDefault("user.groups", ""), ",") {
+			g = strings.TrimSpace(g)
+			if g == "" {
+				continue
+			}
+
+			gid, err := lookupGID(g)
+			if err != nil {
+				return false, nil, err
+			}
+			gids = append(gids, gid)
+		}
+		return true, gids, nil
+	default:
+		return false, nil, fmt.Errorf("unknown user.groups_policy %q", policy)
+	}
+}
+
+// checkGroupsAllowed returns an error if a task may not run with any of the
+// groups, as configured by the client's group allowlist and denylist. Groups
+// are compared by ID so that a name can't bypass a listed ID or vice versa.
+// Only allowed groups may be used, so groups such as disk or docker, which
+// grant control of the host, can't be joined unless the operator lists them.
+func checkGroupsAllowed(conf *config.Config, groups []string) error {
+	if len(groups) == 0 {
+		return nil
+	}
+
+	allowed, err := lookupGIDs(conf.ReadStringListToMap(execAllowGroupsConfigOption))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", execAllowGroupsConfigOption, err)
+	}
+	denied, err := lookupGIDs(conf.ReadStringListToMapDefault(execDenyGroupsConfigOption, execDefaultDenyGroups))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", execDenyGroupsConfigOption, err)
+	}
+
+	for _, g := range groups {
+		gid, err := lookupGID(g)
+		if err != nil {
+			return err
+		}
+		if _, ok := denied[gid]; ok {
+			return fmt.Errorf("group %q is denied by the client's %s", g, execDenyGroupsConfigOption)
+		}
+		if _, ok := allowed[gid]; !ok {
+			return fmt.Errorf("group %q is not in the client's %s", g, execAllowGroupsConfigOption)
+		}
+	}
+	return nil
+}
+
+// lookupGIDs resolves a set of group names or IDs to the groups' IDs.
+func lookupGIDs(groups map[string]struct{}) (map[uint32]struct{}, error) {
+	gids := make(map[uint32]struct{}, len(groups))
+	for g := range groups {
+		gid, err := lookupGID(g)
+		if err != nil {
+			return nil, err
+		}
+		gids[gid] = struct{}{}
+	}
+	return gids, nil
+}
+
+// lookupGID resolves a group name or ID to the group's ID.
+func lookupGID(g string) (uint32, error) {
+	if _, err := strconv.ParseUint(g, 10, 32); err != nil {
+		group, err := user.LookupGroup(g)
+		if err != nil {
+			return 0, fmt.Errorf("failed to look up group %q: %v", g, err)
+		}
+		g = group.Gid
+	}
+
+	gid, err := strconv.ParseUint(g, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid group ID %q: %v", g, err)
+	}
+	return uint32(gid), nil
+}
+
 // SetEnvvars sets path and host env vars depending on the FS isolation used.
 func SetEnvvars(envBuilder *env.Builder, fsi cstructs.FSIsolation, taskDir *allocdir.TaskDir, conf *config.Config) {
 	// Set driver-specific environment variables
@@ -206,6 +388,26 @@ func SetEnvvars(envBuilder *env.Builder, fsi cstructs.FSIsolation, taskDir *allo
 	}
 }
 
+// SetDefaultEnvvars sets the environment variables the client configures for
+// every task of the driver.
+func SetDefaultEnvvars(envBuilder *env.Builder, driver string, conf *config.Config) {
+	switch driver {
+	case "exec":
+		envBuilder.SetDefaultEnv(execDefaultEnv(conf))
+	}
+}
+
+// SetHostEnvPassthrough limits the host environment variables of the task to
+// those its driver config passes through, if it limits them.
+func SetHostEnvPassthrough(envBuilder *env.Builder, task *structs.Task) {
+	switch task.Driver {
+	case "exec":
+		if keys, ok := execHostEnvPassthrough(task); ok {
+			envBuilder.SetHostEnvPassthrough(keys)
+		}
+	}
+}
+
 // getTaskKillSignal looks up the signal specified for the task if it has been
 // specified. If it is not supported on the platform, returns an error.
 func getTaskKillSignal(signal string) (os.Signal, error) {
@@ -220,3 +422,101 @@ func getTaskKillSignal(signal string) (os.Signal, error) {
 
 	return taskKillSignal, nil
 }
+
+// ParseSignal returns the signal of the given name, such as "SIGHUP". Names are
+// case insensitive and the "SIG" prefix is optional. An error is returned if
+// the signal isn't supported on the platform.
+func ParseSignal(name string) (os.Signal, error) {
+	upper := strings.ToUpper(strings.TrimSpace(name))
+	if !strings.HasPrefix(upper, "SIG") {
+		upper = "SIG" + upper
+	}
+	sig, ok := signals.SignalLookup[upper]
+	if !ok {
+		return nil, fmt.Errorf("unknown signal %q", name)
+	}
+	return sig, nil
+}
+
+// SignalTask sends the signal of the given name to the task's main process
+// or, with group, to every process of the task if the handle supports it.
+func SignalTask(h DriverHandle, name string, group bool) error {
+	sig, err := ParseSignal(name)
+	if err != nil {
+		return err
+	}
+	if !group {
+		return h.Signal(sig)
+	}
+	gs, ok := h.(GroupSignaler)
+	if !ok {
+		return fmt.Errorf("driver doesn't support signaling all processes of a task")
+	}
+	return gs.SignalGroup(sig)
+}
+
+// redactedValue replaces the values of secrets in logs and output.
+const redactedValue = "<redacted>"
+
+// redactEnv formats the environment as sorted KEY=VALUE pairs for logging,
+// replacing the values of any keys in secrets.
+func redactEnv(envMap map[string]string, secrets map[string]struct{}) string {
+	pairs := make([]string, 0, len(envMap))
+	for k, v := range envMap {
+		if _, ok := secrets[k]; ok {
+			v = redactedValue
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// writeEnvFile writes the given environment to path as sorted KEY=VALUE lines
+// excluding any keys in exclude. Values spanning multiple lines can't be
+// represented and are skipped. The file is written atomically so readers never
+// observe a partially written environment.
+func writeEnvFile(path string, envMap map[string]string, exclude map[string]struct{}) error {
+	keys := make([]string, 0, len(envMap))
+	for k, v := range envMap {
+		if _, ok := exclude[k]; ok {
+			continue
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s=%s\n", k, envMap[k])
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("failed to create env file: %v", err)
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write env file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write env file: %v", err)
+	}
+
+	// Sibling tasks may run as a different user so the file must be world
+	// readable.
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to set env file permissions: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write env file: %v", err)
+	}
+	return nil
+}
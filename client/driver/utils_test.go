@@ -1,12 +1,18 @@
 package driver
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/client/driver/env"
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -56,3 +62,199 @@ func TestDriver_getTaskKillSignal(t *testing.T) {
 		assert.Equal(sig, syscall.SIGKILL)
 	}
 }
+
+func TestDriver_writeEnvFile(t *testing.T) {
+	assert := assert.New(t)
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "nomadtest_envfile")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	envMap := map[string]string{
+		"B_VAR":       "b",
+		"A_VAR":       "a=1",
+		"VAULT_TOKEN": "secret",
+		"MULTI":       "line1\nline2",
+	}
+	exclude := map[string]struct{}{"VAULT_TOKEN": {}}
+
+	path := filepath.Join(dir, "task.env")
+	assert.Nil(writeEnvFile(path, envMap, exclude))
+
+	out, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	assert.Equal("A_VAR=a=1\nB_VAR=b\n", string(out))
+
+	fi, err := os.Stat(path)
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0644), fi.Mode().Perm())
+}
+
+func TestDriver_redactEnv(t *testing.T) {
+	assert := assert.New(t)
+	t.Parallel()
+
+	envMap := map[string]string{
+		"HTTP_PROXY": "http://proxy:3128",
+		"API_KEY":    "hunter2",
+	}
+	secrets := map[string]struct{}{"API_KEY": {}}
+	assert.Equal("API_KEY=<redacted> HTTP_PROXY=http://proxy:3128", redactEnv(envMap, secrets))
+}
+
+func TestDriver_SetDefaultEnvvars(t *testing.T) {
+	assert := assert.New(t)
+	t.Parallel()
+
+	conf := &config.Config{Options: map[string]string{
+		"driver.exec.env.HTTP_PROXY": "http://proxy:3128",
+		"driver.exec.env.":           "ignored",
+		"driver.exec.env_secrets":    "HTTP_PROXY",
+	}}
+	alloc := mock.Alloc()
+	task := alloc.Job.TaskGroups[0].Tasks[0]
+
+	eb := env.NewBuilder(mock.Node(), alloc, task, "global")
+	SetDefaultEnvvars(eb, "exec", conf)
+	envMap := eb.Build().Map()
+	assert.Equal("http://proxy:3128", envMap["HTTP_PROXY"])
+	assert.NotContains(envMap, "")
+
+	eb = env.NewBuilder(mock.Node(), alloc, task, "global")
+	SetDefaultEnvvars(eb, "raw_exec", conf)
+	assert.NotContains(eb.Build().Map(), "HTTP_PROXY")
+}
+
+func TestDriver_SetHostEnvPassthrough(t *testing.T) {
+	assert := assert.New(t)
+	os.Setenv("NOMAD_TEST_HOST_TZ", "UTC")
+	defer os.Unsetenv("NOMAD_TEST_HOST_TZ")
+
+	alloc := mock.Alloc()
+	task := alloc.Job.TaskGroups[0].Tasks[0]
+	task.Driver = "exec"
+	hostEnv := func() map[string]string {
+		eb := env.NewBuilder(mock.Node(), alloc, task, "global").SetHostEnvvars(nil)
+		SetHostEnvPassthrough(eb, task)
+		return eb.Build().Map()
+	}
+
+	// Every host variable is inherited by default
+	assert.Equal("UTC", hostEnv()["NOMAD_TEST_HOST_TZ"])
+
+	task.Config["host_env_passthrough"] = []string{"LANG"}
+	assert.NotContains(hostEnv(), "NOMAD_TEST_HOST_TZ")
+
+	task.Config["host_env_passthrough"] = []string{"LANG", "NOMAD_TEST_HOST_TZ"}
+	assert.Equal("UTC", hostEnv()["NOMAD_TEST_HOST_TZ"])
+}
+
+func TestDriver_getExecutorGroups(t *testing.T) {
+	assert := assert.New(t)
+	t.Parallel()
+
+	task := &structs.Task{Name: "foo"}
+	conf := &config.Config{Options: map[string]string{}}
+
+	// Test that groups are inherited by default
+	{
+		override, groups, err := getExecutorGroups(conf, task)
+		assert.Nil(err)
+		assert.False(override)
+		assert.Empty(groups)
+	}
+
+	// Test that groups can be dropped
+	{
+		conf.Options["user.groups_policy"] = "drop"
+		override, groups, err := getExecutorGroups(conf, task)
+		assert.Nil(err)
+		assert.True(override)
+		assert.Empty(groups)
+	}
+
+	// Test that a fixed set of groups is used
+	{
+		conf.Options["user.groups_policy"] = "fixed"
+		conf.Options["user.groups"] = "100, 200"
+		override, groups, err := getExecutorGroups(conf, task)
+		assert.Nil(err)
+		assert.True(override)
+		assert.Equal([]uint32{100, 200}, groups)
+	}
+
+	// Test that tasks with a user always use the user's groups
+	{
+		override, _, err := getExecutorGroups(conf, &structs.Task{Name: "foo", User: "nobody"})
+		assert.Nil(err)
+		assert.False(override)
+	}
+
+	// Test that unknown policies return an error
+	{
+		conf.Options["user.groups_policy"] = "foo"
+		_, _, err := getExecutorGroups(conf, task)
+		assert.NotNil(err)
+	}
+}
+
+func TestDriver_checkGroupsAllowed(t *testing.T) {
+	assert := assert.New(t)
+	t.Parallel()
+
+	conf := &config.Config{Options: map[string]string{}}
+
+	// Test that no group is allowed by default
+	assert.Nil(checkGroupsAllowed(conf, nil))
+	assert.NotNil(checkGroupsAllowed(conf, []string{"100"}))
+
+	// Test that groups not in the allowlist are denied
+	conf.Options[execAllowGroupsConfigOption] = "100"
+	assert.Nil(checkGroupsAllowed(conf, []string{"100"}))
+	assert.NotNil(checkGroupsAllowed(conf, []string{"100", "200"}))
+
+	// Test that the root group is denied even if it's allowed
+	conf.Options[execAllowGroupsConfigOption] = "100,0"
+	assert.NotNil(checkGroupsAllowed(conf, []string{"0"}))
+
+	// Test that the denylist takes precedence over the allowlist
+	conf.Options[execDenyGroupsConfigOption] = "100"
+	assert.NotNil(checkGroupsAllowed(conf, []string{"100"}))
+
+	// Test that groups that can't be found are denied
+	assert.NotNil(checkGroupsAllowed(conf, []string{"nomad-missing-group"}))
+}
+
+func TestDriver_executorStderrRotator(t *testing.T) {
+	assert := assert.New(t)
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// Test that the stderr is written to a rotated file in the directory
+	{
+		conf := &config.Config{Options: map[string]string{"executor.stderr_max_file_size": "2"}}
+		rotator, err := executorStderrRotator(ioutil.Discard, conf, dir)
+		assert.Nil(err)
+		assert.Equal(2, rotator.MaxFiles)
+		assert.Equal(int64(2*1024*1024), rotator.FileSize)
+
+		_, err = rotator.Write([]byte("panic: foo\n"))
+		assert.Nil(err)
+		rotator.Close()
+
+		out, err := ioutil.ReadFile(filepath.Join(dir, executorStderrFile+".0"))
+		assert.Nil(err)
+		assert.Equal("panic: foo\n", string(out))
+	}
+
+	// Test that invalid sizes return an error
+	{
+		conf := &config.Config{Options: map[string]string{"executor.stderr_max_files": "0"}}
+		_, err := executorStderrRotator(ioutil.Discard, conf, dir)
+		assert.NotNil(err)
+	}
+}
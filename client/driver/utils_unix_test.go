@@ -0,0 +1,36 @@
+// +build !windows
+
+package driver
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestDriver_ParseSignal(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]os.Signal{
+		"SIGHUP":   syscall.SIGHUP,
+		"sigusr2":  syscall.SIGUSR2,
+		"SigWinch": syscall.SIGWINCH,
+		"term":     syscall.SIGTERM,
+		" USR1 ":   syscall.SIGUSR1,
+	}
+	for name, expected := range cases {
+		sig, err := ParseSignal(name)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", name, err)
+		}
+		if sig != expected {
+			t.Fatalf("got signal %v for %q; want %v", sig, name, expected)
+		}
+	}
+
+	for _, name := range []string{"", "SIG", "SIGFOO", "hup1", "9"} {
+		if _, err := ParseSignal(name); err == nil {
+			t.Fatalf("expected error parsing %q", name)
+		}
+	}
+}
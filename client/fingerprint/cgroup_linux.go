@@ -5,19 +5,22 @@ package fingerprint
 import (
 	"fmt"
 
+	"github.com/hashicorp/nomad/client/lib/cgutil"
 	cstructs "github.com/hashicorp/nomad/client/structs"
 	"github.com/opencontainers/runc/libcontainer/cgroups"
 )
 
 // FindCgroupMountpointDir is used to find the cgroup mount point on a Linux
-// system.
+// system. The directory of the cgroup v1 hierarchies is preferred over the
+// mount point of the cgroup v2 unified hierarchy, which is only used if no v1
+// hierarchy is mounted.
 func FindCgroupMountpointDir() (string, error) {
 	mount, err := cgroups.FindCgroupMountpointDir()
 	if err != nil {
 		switch e := err.(type) {
 		case *cgroups.NotFoundError:
 			// It's okay if the mount point is not discovered
-			return "", nil
+			return cgutil.FindUnifiedMountpoint()
 		default:
 			// All other errors are passed back as is
 			return "", e
@@ -52,6 +52,11 @@ func (f *CPUFingerprint) Fingerprint(req *cstructs.FingerprintRequest, resp *cst
 		f.logger.Printf("[DEBUG] fingerprint.cpu: core count: %d", numCores)
 	}
 
+	// Advertise the cores tasks can be pinned to
+	if online := stats.CPUOnline(); online != "" {
+		resp.AddAttribute("unique.cpu.cpuset", online)
+	}
+
 	tt := int(stats.TotalTicksAvailable())
 	if cfg.CpuCompute > 0 {
 		f.logger.Printf("[DEBUG] fingerprint.cpu: Using specified cpu compute %d", cfg.CpuCompute)
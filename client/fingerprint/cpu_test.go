@@ -1,6 +1,7 @@
 package fingerprint
 
 import (
+	"runtime"
 	"testing"
 
 	"github.com/hashicorp/nomad/client/config"
@@ -43,6 +44,9 @@ func TestCPUFingerprint(t *testing.T) {
 	if attributes["cpu.totalcompute"] == "" {
 		t.Fatalf("Missing CPU Total Compute")
 	}
+	if runtime.GOOS == "linux" && attributes["unique.cpu.cpuset"] == "" {
+		t.Fatalf("Missing CPU cpuset")
+	}
 
 	if response.Resources == nil || response.Resources.CPU == 0 {
 		t.Fatalf("Expected to find CPU Resources")
@@ -29,7 +29,7 @@ var (
 	allocIDNotPresentErr = fmt.Errorf("must provide a valid alloc id")
 	pathNotPresentErr    = fmt.Errorf("must provide a file path")
 	taskNotPresentErr    = fmt.Errorf("must provide task name")
-	logTypeNotPresentErr = fmt.Errorf("must provide log type (stdout/stderr)")
+	logTypeNotPresentErr = fmt.Errorf("must provide log type (stdout/stderr/output)")
 	invalidOrigin        = fmt.Errorf("origin must be start or end")
 )
 
@@ -343,7 +343,7 @@ func (f *FileSystem) logs(conn io.ReadWriteCloser) {
 		return
 	}
 	switch req.LogType {
-	case "stdout", "stderr":
+	case "stdout", "stderr", structs.LogStreamCombined:
 	default:
 		f.handleStreamResultError(logTypeNotPresentErr, helper.Int64ToPtr(400), encoder)
 		return
@@ -385,7 +385,9 @@ func (f *FileSystem) logs(conn io.ReadWriteCloser) {
 		f.handleStreamResultError(fmt.Errorf("Failed to lookup task group for allocation"),
 			helper.Int64ToPtr(500), encoder)
 		return
-	} else if taskStruct := tg.LookupTask(req.Task); taskStruct == nil {
+	}
+	taskStruct := tg.LookupTask(req.Task)
+	if taskStruct == nil {
 		f.handleStreamResultError(
 			fmt.Errorf("task group %q does not have task with name %q", alloc.TaskGroup, req.Task),
 			helper.Int64ToPtr(400),
@@ -393,6 +395,19 @@ func (f *FileSystem) logs(conn io.ReadWriteCloser) {
 		return
 	}
 
+	// Tasks combining their logs only have the combined stream
+	if combined := taskStruct.LogConfig != nil && taskStruct.LogConfig.CombineLogs; combined != (req.LogType == structs.LogStreamCombined) {
+		err := fmt.Errorf("task %q has no %s logs", req.Task, req.LogType)
+		if combined {
+			err = fmt.Errorf("task %q combines its logs; use the %q log type", req.Task, structs.LogStreamCombined)
+		}
+		f.handleStreamResultError(err, helper.Int64ToPtr(400), encoder)
+		return
+	}
+
+	// Determine the name of the task's log files
+	logBase := taskStruct.LogConfig.FileBaseName(req.Task, req.AllocID, req.LogType)
+
 	state, ok := alloc.TaskStates[req.Task]
 	if !ok || state.StartedAt.IsZero() {
 		f.handleStreamResultError(fmt.Errorf("task %q not started yet. No logs available", req.Task),
@@ -411,7 +426,7 @@ func (f *FileSystem) logs(conn io.ReadWriteCloser) {
 	// Start streaming
 	go func() {
 		if err := f.logsImpl(ctx, req.Follow, req.PlainText,
-			req.Offset, req.Origin, req.Task, req.LogType, fs, frames); err != nil {
+			req.Offset, req.Origin, logBase, fs, frames); err != nil {
 			select {
 			case errCh <- err:
 			case <-ctx.Done():
@@ -473,11 +488,12 @@ OUTER:
 	}
 }
 
-// logsImpl is used to stream the logs of a the given task. Output is sent on
-// the passed frames channel and the method will return on EOF if follow is not
-// true otherwise when the context is cancelled or on an error.
+// logsImpl is used to stream the logs of a the given task. logBase is the name
+// of the log files without their rotation index. Output is sent on the passed
+// frames channel and the method will return on EOF if follow is not true
+// otherwise when the context is cancelled or on an error.
 func (f *FileSystem) logsImpl(ctx context.Context, follow, plain bool, offset int64,
-	origin, task, logType string,
+	origin, logBase string,
 	fs allocdir.AllocDirFS, frames chan<- *sframer.StreamFrame) error {
 
 	// Create the framer
@@ -516,14 +532,14 @@ func (f *FileSystem) logsImpl(ctx context.Context, follow, plain bool, offset in
 		// interested in so we can stop there.
 		maxIndex := int64(math.MaxInt64)
 		if !follow {
-			_, idx, _, err := findClosest(entries, maxIndex, 0, task, logType)
+			_, idx, _, err := findClosest(entries, maxIndex, 0, logBase)
 			if err != nil {
 				return err
 			}
 			maxIndex = idx
 		}
 
-		logEntry, idx, openOffset, err := findClosest(entries, nextIdx, offset, task, logType)
+		logEntry, idx, openOffset, err := findClosest(entries, nextIdx, offset, logBase)
 		if err != nil {
 			return err
 		}
@@ -539,7 +555,7 @@ func (f *FileSystem) logsImpl(ctx context.Context, follow, plain bool, offset in
 			close(eofCancelCh)
 			exitAfter = true
 		} else {
-			eofCancelCh = blockUntilNextLog(ctx, fs, logPath, task, logType, idx+1)
+			eofCancelCh = blockUntilNextLog(ctx, fs, logPath, logBase, idx+1)
 		}
 
 		p := filepath.Join(logPath, logEntry.Name)
@@ -721,8 +737,8 @@ OUTER:
 
 // blockUntilNextLog returns a channel that will have data sent when the next
 // log index or anything greater is created.
-func blockUntilNextLog(ctx context.Context, fs allocdir.AllocDirFS, logPath, task, logType string, nextIndex int64) chan error {
-	nextPath := filepath.Join(logPath, fmt.Sprintf("%s.%s.%d", task, logType, nextIndex))
+func blockUntilNextLog(ctx context.Context, fs allocdir.AllocDirFS, logPath, logBase string, nextIndex int64) chan error {
+	nextPath := filepath.Join(logPath, fmt.Sprintf("%s.%d", logBase, nextIndex))
 	next := make(chan error, 1)
 
 	go func() {
@@ -754,7 +770,7 @@ func blockUntilNextLog(ctx context.Context, fs allocdir.AllocDirFS, logPath, tas
 					return
 				}
 
-				indexes, err := logIndexes(entries, task, logType)
+				indexes, err := logIndexes(entries, logBase)
 				if err != nil {
 					next <- err
 					close(next)
@@ -791,11 +807,11 @@ func (a indexTupleArray) Less(i, j int) bool { return a[i].idx < a[j].idx }
 func (a indexTupleArray) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 
 // logIndexes takes a set of entries and returns a indexTupleArray of
-// the desired log file entries. If the indexes could not be determined, an
-// error is returned.
-func logIndexes(entries []*cstructs.AllocFileInfo, task, logType string) (indexTupleArray, error) {
+// the log file entries named after logBase. If the indexes could not be
+// determined, an error is returned.
+func logIndexes(entries []*cstructs.AllocFileInfo, logBase string) (indexTupleArray, error) {
 	var indexes []indexTuple
-	prefix := fmt.Sprintf("%s.%s.", task, logType)
+	prefix := fmt.Sprintf("%s.", logBase)
 	for _, entry := range entries {
 		if entry.IsDir {
 			continue
@@ -820,19 +836,19 @@ func logIndexes(entries []*cstructs.AllocFileInfo, task, logType string) (indexT
 }
 
 // findClosest takes a list of entries, the desired log index and desired log
-// offset (which can be negative, treated as offset from end), task name and log
-// type and returns the log entry, the log index, the offset to read from and a
-// potential error.
+// offset (which can be negative, treated as offset from end) and the log file
+// base name and returns the log entry, the log index, the offset to read from
+// and a potential error.
 func findClosest(entries []*cstructs.AllocFileInfo, desiredIdx, desiredOffset int64,
-	task, logType string) (*cstructs.AllocFileInfo, int64, int64, error) {
+	logBase string) (*cstructs.AllocFileInfo, int64, int64, error) {
 
 	// Build the matching indexes
-	indexes, err := logIndexes(entries, task, logType)
+	indexes, err := logIndexes(entries, logBase)
 	if err != nil {
 		return nil, 0, 0, err
 	}
 	if len(indexes) == 0 {
-		return nil, 0, 0, fmt.Errorf("log entry for task %q and log type %q not found", task, logType)
+		return nil, 0, 0, fmt.Errorf("log entry %q not found", logBase)
 	}
 
 	// Binary search the indexes to get the desiredIdx
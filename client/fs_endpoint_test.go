@@ -1605,7 +1605,7 @@ func TestFS_findClosest(t *testing.T) {
 	}
 
 	for i, c := range cases {
-		entry, idx, offset, err := findClosest(c.Entries, c.DesiredIdx, c.DesiredOffset, c.Task, c.LogType)
+		entry, idx, offset, err := findClosest(c.Entries, c.DesiredIdx, c.DesiredOffset, fmt.Sprintf("%s.%s", c.Task, c.LogType))
 		if err != nil {
 			if !c.Error {
 				t.Fatalf("case %d: Unexpected error: %v", i, err)
@@ -1940,7 +1940,7 @@ func TestFS_logsImpl_NoFollow(t *testing.T) {
 	go func() {
 		if err := c.endpoints.FileSystem.logsImpl(
 			context.Background(), false, false, 0,
-			OriginStart, task, logType, ad, frames); err != nil {
+			OriginStart, fmt.Sprintf("%s.%s", task, logType), ad, frames); err != nil {
 			t.Fatalf("logs() failed: %v", err)
 		}
 	}()
@@ -2014,7 +2014,7 @@ func TestFS_logsImpl_Follow(t *testing.T) {
 	// Start streaming logs
 	go c.endpoints.FileSystem.logsImpl(
 		context.Background(), true, false, 0,
-		OriginStart, task, logType, ad, frames)
+		OriginStart, fmt.Sprintf("%s.%s", task, logType), ad, frames)
 
 	select {
 	case <-firstResultCh:
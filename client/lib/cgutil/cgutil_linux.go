@@ -0,0 +1,47 @@
+package cgutil
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// FindUnifiedMountpoint returns the mount point of the cgroup v2 unified
+// hierarchy, or an empty string if it isn't mounted or a cgroup v1 hierarchy
+// is mounted as well, in hybrid mode, as the v1 hierarchies are used then.
+func FindUnifiedMountpoint() (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return ParseUnifiedMountpoint(f)
+}
+
+// ParseUnifiedMountpoint returns the mount point of the cgroup2 file system
+// in the mountinfo like FindUnifiedMountpoint.
+func ParseUnifiedMountpoint(r io.Reader) (string, error) {
+	var mount string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, " - ")
+		if i < 0 {
+			continue
+		}
+		fields, post := strings.Fields(line[:i]), strings.Fields(line[i+3:])
+		if len(fields) < 5 || len(post) == 0 {
+			continue
+		}
+		switch post[0] {
+		case "cgroup":
+			return "", nil
+		case "cgroup2":
+			if mount == "" {
+				mount = fields[4]
+			}
+		}
+	}
+	return mount, scanner.Err()
+}
@@ -0,0 +1,31 @@
+package cgutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseUnifiedMountpoint(t *testing.T) {
+	unified := `22 27 0:20 / /sys rw,nosuid,nodev,noexec,relatime shared:7 - sysfs sysfs rw
+26 22 0:23 / /sys/fs/cgroup rw,nosuid,nodev,noexec,relatime shared:4 - cgroup2 cgroup2 rw,nsdelegate
+`
+	mount, err := ParseUnifiedMountpoint(strings.NewReader(unified))
+	if err != nil || mount != "/sys/fs/cgroup" {
+		t.Fatalf("got mount point %q %v; want /sys/fs/cgroup", mount, err)
+	}
+
+	mount, err = ParseUnifiedMountpoint(strings.NewReader("22 27 0:20 / /sys rw - sysfs sysfs rw\n"))
+	if err != nil || mount != "" {
+		t.Fatalf("expected no mount point; got %q %v", mount, err)
+	}
+
+	// Hybrid hosts keep using the v1 hierarchies
+	hybrid := `25 22 0:22 / /sys/fs/cgroup ro,nosuid,nodev,noexec shared:3 - tmpfs tmpfs ro,mode=755
+26 25 0:23 / /sys/fs/cgroup/unified rw,nosuid,nodev,noexec,relatime shared:4 - cgroup2 cgroup2 rw,nsdelegate
+29 25 0:26 / /sys/fs/cgroup/memory rw,nosuid,nodev,noexec,relatime shared:9 - cgroup cgroup rw,memory
+`
+	mount, err = ParseUnifiedMountpoint(strings.NewReader(hybrid))
+	if err != nil || mount != "" {
+		t.Fatalf("expected no unified mount point on hybrid hosts; got %q %v", mount, err)
+	}
+}
@@ -0,0 +1,4 @@
+// Package cgutil contains helpers shared by the client's fingerprinters and
+// drivers to find the cgroup hierarchies of the host, which are only
+// supported on Linux.
+package cgutil
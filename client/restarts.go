@@ -11,13 +11,18 @@ import (
 )
 
 const (
-	// jitter is the percent of jitter added to restart delays.
+	// jitter is the default fraction of jitter added to restart delays.
 	jitter = 0.25
 
+	// maxJitterPercent is the largest jitter that may be configured, which
+	// spreads restarts over up to twice the restart delay.
+	maxJitterPercent = 100
+
 	ReasonNoRestartsAllowed   = "Policy allows no restarts"
 	ReasonUnrecoverableErrror = "Error was unrecoverable"
 	ReasonWithinPolicy        = "Restart within policy"
 	ReasonDelay               = "Exceeded allowed attempts, applying a delay"
+	ReasonStartTooSoon        = "Driver throttled starting the task again too soon"
 )
 
 func newRestartTracker(policy *structs.RestartPolicy, jobType string) *RestartTracker {
@@ -26,10 +31,14 @@ func newRestartTracker(policy *structs.RestartPolicy, jobType string) *RestartTr
 		onSuccess = false
 	}
 	return &RestartTracker{
-		startTime: time.Now(),
-		onSuccess: onSuccess,
-		policy:    policy,
-		rand:      rand.New(rand.NewSource(time.Now().Unix())),
+		startTime:      time.Now(),
+		onSuccess:      onSuccess,
+		policy:         policy,
+		jitterFraction: jitter,
+
+		// Seed each tracker differently so that tasks created in the same
+		// second don't restart in lockstep
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 }
 
@@ -43,6 +52,7 @@ type RestartTracker struct {
 	startTime        time.Time // When the interval began
 	reason           string    // The reason for the last state
 	policy           *structs.RestartPolicy
+	jitterFraction   float64 // Fraction of the delay restarts are spread over
 	rand             *rand.Rand
 	lock             sync.Mutex
 }
@@ -54,6 +64,19 @@ func (r *RestartTracker) SetPolicy(policy *structs.RestartPolicy) {
 	r.policy = policy
 }
 
+// SetJitter sets the percent of the restart delay that restarts are randomly
+// delayed by in addition so that many instances of a failing task don't
+// restart in lockstep.
+func (r *RestartTracker) SetJitter(percent int) error {
+	if percent < 0 || percent > maxJitterPercent {
+		return fmt.Errorf("restart jitter of %d%% must be between 0%% and %d%%", percent, maxJitterPercent)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.jitterFraction = float64(percent) / 100
+	return nil
+}
+
 // SetStartError is used to mark the most recent start error. If starting was
 // successful the error should be nil.
 func (r *RestartTracker) SetStartError(err error) *RestartTracker {
@@ -124,6 +147,13 @@ func (r *RestartTracker) GetState() (string, time.Duration) {
 		return structs.TaskRestarting, 0
 	}
 
+	// Retry once the driver allows starting the task again. The task didn't
+	// run, so it doesn't count against the policy.
+	if wait, ok := dstructs.StartTooSoonWait(r.startErr); ok {
+		r.reason = ReasonStartTooSoon
+		return structs.TaskRestarting, wait
+	}
+
 	// Hot path if no attempts are expected
 	if r.policy.Attempts == 0 {
 		r.reason = ReasonNoRestartsAllowed
@@ -198,6 +228,6 @@ func (r *RestartTracker) jitter() time.Duration {
 		d = 1
 	}
 
-	j := float64(r.rand.Int63n(d)) * jitter
+	j := float64(r.rand.Int63n(d)) * r.jitterFraction
 	return time.Duration(d + int64(j))
 }
@@ -162,3 +162,89 @@ func TestClient_RestartTracker_StartError_Recoverable_Delay(t *testing.T) {
 		t.Fatalf("NextRestart() returned %v; want > %v and <= %v", when, p.Delay, p.Interval)
 	}
 }
+
+func TestClient_RestartTracker_StartTooSoon(t *testing.T) {
+	t.Parallel()
+	p := testPolicy(true, structs.RestartPolicyModeFail)
+	rt := newRestartTracker(p, structs.JobTypeService)
+	tooSoon := cstructs.NewStartError(cstructs.StartFailureThrottled, cstructs.NewStartTooSoonError(3*time.Second))
+
+	// Throttled starts are retried once the driver allows them and don't
+	// count against the policy
+	for i := 0; i < p.Attempts+1; i++ {
+		state, when := rt.SetStartError(tooSoon).GetState()
+		if state != structs.TaskRestarting {
+			t.Fatalf("NextRestart() returned %v, want %v", state, structs.TaskRestarting)
+		}
+		if when != 3*time.Second {
+			t.Fatalf("NextRestart() returned %v; want %v", when, 3*time.Second)
+		}
+		if reason := rt.GetReason(); reason != ReasonStartTooSoon {
+			t.Fatalf("expected reason %q; got %q", ReasonStartTooSoon, reason)
+		}
+	}
+	for i := 0; i < p.Attempts; i++ {
+		if state, _ := rt.SetWaitResult(testWaitResult(127)).GetState(); state != structs.TaskRestarting {
+			t.Fatalf("NextRestart() returned %v, want %v", state, structs.TaskRestarting)
+		}
+	}
+}
+
+func TestClient_RestartTracker_Jitter(t *testing.T) {
+	t.Parallel()
+	p := testPolicy(true, structs.RestartPolicyModeDelay)
+	p.Attempts = 100
+
+	// Without jitter restarts are delayed by exactly the policy's delay
+	rt := newRestartTracker(p, structs.JobTypeService)
+	if err := rt.SetJitter(0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, when := rt.SetWaitResult(testWaitResult(127)).GetState(); when != p.Delay {
+		t.Fatalf("NextRestart() returned %v; want %v", when, p.Delay)
+	}
+
+	// With full jitter the delay is spread over up to twice the delay
+	if err := rt.SetJitter(100); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	spread := false
+	for i := 0; i < 20; i++ {
+		_, when := rt.SetWaitResult(testWaitResult(127)).GetState()
+		if when < p.Delay || when > 2*p.Delay {
+			t.Fatalf("NextRestart() returned %v; want between %v and %v", when, p.Delay, 2*p.Delay)
+		}
+		if when > p.Delay+p.Delay/4 {
+			spread = true
+		}
+	}
+	if !spread {
+		t.Fatalf("restarts weren't spread beyond the default jitter")
+	}
+
+	for _, percent := range []int{-1, 101} {
+		if err := rt.SetJitter(percent); err == nil {
+			t.Fatalf("expected error for %d%%", percent)
+		}
+	}
+}
+
+func TestClient_RestartTracker_Jitter_Seed(t *testing.T) {
+	t.Parallel()
+	p := testPolicy(true, structs.RestartPolicyModeDelay)
+
+	// Trackers created at the same time don't share their delays
+	rt1 := newRestartTracker(p, structs.JobTypeService)
+	rt2 := newRestartTracker(p, structs.JobTypeService)
+	same := true
+	for i := 0; i < p.Attempts; i++ {
+		_, when1 := rt1.SetWaitResult(testWaitResult(127)).GetState()
+		_, when2 := rt2.SetWaitResult(testWaitResult(127)).GetState()
+		if when1 != when2 {
+			same = false
+		}
+	}
+	if same {
+		t.Fatalf("trackers restarted in lockstep")
+	}
+}
@@ -2,6 +2,7 @@ package stats
 
 import (
 	"runtime"
+	"sync"
 	"time"
 
 	shelpers "github.com/hashicorp/nomad/helper/stats"
@@ -59,3 +60,57 @@ func (c *CpuStats) calculatePercent(t1, t2 float64, timeDelta int64) float64 {
 	overall_percent := (vDelta / float64(timeDelta)) * 100.0
 	return overall_percent
 }
+
+// ThrottleStats calculates the percent of CPU periods a task was throttled in
+// since the previous sample. The previous sample is kept per consumer so that
+// a consumer sampling more often doesn't shorten the window of another.
+type ThrottleStats struct {
+	consumers map[string]*throttleSample
+	l         sync.Mutex
+}
+
+// throttleSample is a consumer's previous sample of the cumulative periods
+// and throttled periods and the percent calculated from it
+type throttleSample struct {
+	periods   uint64
+	throttled uint64
+	percent   float64
+}
+
+// NewThrottleStats returns a throttling calculator
+func NewThrottleStats() *ThrottleStats {
+	return &ThrottleStats{
+		consumers: make(map[string]*throttleSample),
+	}
+}
+
+// Percent calculates the percent of periods the task was throttled in since
+// the consumer's previous sample given the cumulative periods and throttled
+// periods of its cgroup. If no period elapsed since the previous sample the
+// previous percent is returned.
+func (t *ThrottleStats) Percent(consumer string, periods, throttled uint64) float64 {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	prev, ok := t.consumers[consumer]
+	if !ok {
+		prev = &throttleSample{}
+		t.consumers[consumer] = prev
+	}
+	if periods == prev.periods {
+		return prev.percent
+	}
+	prev.percent = ThrottledPercent(prev.periods, prev.throttled, periods, throttled)
+	prev.periods = periods
+	prev.throttled = throttled
+	return prev.percent
+}
+
+// ThrottledPercent calculates the percent of periods that were throttled
+// between two samples of cumulative periods and throttled periods.
+func ThrottledPercent(prevPeriods, prevThrottled, periods, throttled uint64) float64 {
+	if periods <= prevPeriods || throttled < prevThrottled {
+		return 0.0
+	}
+	return float64(throttled-prevThrottled) / float64(periods-prevPeriods) * 100.0
+}
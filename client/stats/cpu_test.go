@@ -22,6 +22,25 @@ func TestCpuStatsPercent(t *testing.T) {
 	}
 }
 
+func TestThrottleStatsPercent(t *testing.T) {
+	assert := assert.New(t)
+	ts := NewThrottleStats()
+
+	assert.Equal(50.0, ts.Percent("client", 100, 50))
+	assert.Equal(10.0, ts.Percent("client", 200, 60))
+
+	// The previous percent is kept until another period elapsed
+	assert.Equal(10.0, ts.Percent("client", 200, 60))
+	assert.Equal(0.0, ts.Percent("client", 300, 60))
+
+	// Another consumer's samples don't affect the window of the first
+	assert.Equal(20.0, ts.Percent("other", 300, 60))
+	assert.Equal(40.0, ts.Percent("client", 400, 100))
+
+	// Counters that were reset aren't reported as throttling
+	assert.Equal(0.0, ThrottledPercent(300, 60, 100, 10))
+}
+
 func TestHostStats_CPU(t *testing.T) {
 	assert := assert.New(t)
 	assert.Nil(shelpers.Init())
@@ -174,6 +174,19 @@ type MemoryStats struct {
 	KernelUsage    uint64
 	KernelMaxUsage uint64
 
+	// Usage is the memory charged to the task, including the page cache, and
+	// WorkingSet is the usage excluding the inactive file cache, which the
+	// kernel reclaims first. WorkingSet better reflects the memory the task
+	// needs.
+	Usage      uint64
+	WorkingSet uint64
+
+	// MajorPageFaults and MinorPageFaults are the page faults of the task
+	// since it started, including those of its exited processes. A rising
+	// rate of major faults indicates swapping or memory mapped I/O.
+	MajorPageFaults uint64
+	MinorPageFaults uint64
+
 	// A list of fields whose values were actually sampled
 	Measured []string
 }
@@ -185,6 +198,10 @@ func (ms *MemoryStats) Add(other *MemoryStats) {
 	ms.MaxUsage += other.MaxUsage
 	ms.KernelUsage += other.KernelUsage
 	ms.KernelMaxUsage += other.KernelMaxUsage
+	ms.Usage += other.Usage
+	ms.WorkingSet += other.WorkingSet
+	ms.MajorPageFaults += other.MajorPageFaults
+	ms.MinorPageFaults += other.MinorPageFaults
 	ms.Measured = joinStringSet(ms.Measured, other.Measured)
 }
 
@@ -197,6 +214,11 @@ type CpuStats struct {
 	ThrottledTime    uint64
 	Percent          float64
 
+	// ThrottledPercent is the percent of CPU periods the task was throttled
+	// in since the previous sample. It's non-zero while the task's CPU
+	// reservation is too low for its load.
+	ThrottledPercent float64
+
 	// A list of fields whose values were actually sampled
 	Measured []string
 }
@@ -91,6 +91,10 @@ type TaskRunner struct {
 	restartTracker *RestartTracker
 	consul         ConsulServiceAPI
 
+	// execLimiter limits the concurrent Exec calls of script checks into the
+	// task. Nil if unlimited.
+	execLimiter *execLimiter
+
 	// running marks whether the task is running
 	running     bool
 	runningLock sync.Mutex
@@ -105,6 +109,11 @@ type TaskRunner struct {
 	// envBuilder is used to build the task's environment
 	envBuilder *env.Builder
 
+	// startGate blocks until the tasks this task starts after are ready. It
+	// returns the tasks that aren't ready if the timeout elapses, or an error
+	// if any of them failed.
+	startGate func(task *structs.Task, timeout time.Duration, stopCh <-chan struct{}) ([]string, error)
+
 	// driverNet is the network information returned by the driver
 	driverNet     *cstructs.DriverNetwork
 	driverNetLock sync.Mutex
@@ -241,6 +250,9 @@ func NewTaskRunner(logger *log.Logger, config *config.Config,
 		return nil
 	}
 	restartTracker := newRestartTracker(tg.RestartPolicy, alloc.Job.Type)
+	if err := restartTracker.SetJitter(config.ReadIntDefault("restart.jitter_percent", int(jitter*100))); err != nil {
+		logger.Printf("[WARN] client: ignoring invalid restart.jitter_percent: %v", err)
+	}
 
 	// Initialize the environment builder
 	envBuilder := env.NewBuilder(config.Node, alloc, task, config.Region)
@@ -286,6 +298,7 @@ func NewTaskRunner(logger *log.Logger, config *config.Config,
 			Value: tc.task.Name,
 		},
 	}
+	tc.execLimiter = tc.newExecLimiter()
 
 	return tc
 }
@@ -600,15 +613,35 @@ func (r *TaskRunner) Run() {
 		return
 	}
 
+	// Fail before building the task dir if the driver can tell the task can't
+	// start on this node. Tasks restored after a client restart are already
+	// running, so they aren't failed if the node changed since they started.
+	if r.getHandle() == nil {
+		if err := tmpDrv.ValidateTask(r.task); err != nil {
+			r.setState(
+				structs.TaskStateDead,
+				structs.NewTaskEvent(structs.TaskFailedValidation).SetValidationError(err).SetFailsTask(),
+				false)
+			return
+		}
+	}
+
 	// Build base task directory structure regardless of FS isolation abilities.
 	// This needs to happen before we start the Vault manager and call prestart
 	// as both those can write to the task directories
-	if err := r.buildTaskDir(tmpDrv.FSIsolation()); err != nil {
+	fsi := tmpDrv.FSIsolation()
+	if isolator, ok := tmpDrv.(driver.TaskFSIsolator); ok {
+		fsi = isolator.TaskFSIsolation(r.task)
+	}
+	if err := r.buildTaskDir(fsi); err != nil {
 		e := fmt.Errorf("failed to build task directory for %q: %v", r.task.Name, err)
-		r.setState(
-			structs.TaskStateDead,
-			structs.NewTaskEvent(structs.TaskSetupFailure).SetSetupError(e).SetFailsTask(),
-			false)
+		event := structs.NewTaskEvent(structs.TaskSetupFailure)
+		if cerr, ok := err.(*allocdir.ChrootBuildError); ok {
+			r.logger.Printf("[ERR] client: failed to build chroot for task %q (alloc %q), category %q: %v",
+				r.task.Name, r.alloc.ID, cerr.Category, cerr)
+			event = structs.NewTaskEvent(structs.TaskChrootBuildFailed).SetChrootBuildCategory(cerr.Category)
+		}
+		r.setState(structs.TaskStateDead, event.SetSetupError(e).SetFailsTask(), false)
 		return
 	}
 
@@ -984,12 +1017,17 @@ func (r *TaskRunner) prestart(alloc *structs.Allocation, task *structs.Task, res
 		downloaded := r.artifactsDownloaded
 		r.persistLock.Unlock()
 
+		// stopProgress stops reporting the progress of a slow step
+		var stopProgress func()
+
 		// Download the task's artifacts
 		if !downloaded && len(task.Artifacts) > 0 {
 			r.setState(structs.TaskStatePending, structs.NewTaskEvent(structs.TaskDownloadingArtifacts), false)
 			taskEnv := r.envBuilder.Build()
+			stopProgress = r.reportProgress("downloading artifacts")
 			for _, artifact := range task.Artifacts {
 				if err := getter.GetArtifact(taskEnv, artifact, r.taskDir.Dir); err != nil {
+					stopProgress()
 					wrapped := fmt.Errorf("failed to download artifact %q: %v", artifact.GetterSource, err)
 					r.logger.Printf("[DEBUG] client: %v", wrapped)
 					r.setState(structs.TaskStatePending,
@@ -998,6 +1036,7 @@ func (r *TaskRunner) prestart(alloc *structs.Allocation, task *structs.Task, res
 					goto RESTART
 				}
 			}
+			stopProgress()
 
 			r.persistLock.Lock()
 			r.artifactsDownloaded = true
@@ -1006,6 +1045,16 @@ func (r *TaskRunner) prestart(alloc *structs.Allocation, task *structs.Task, res
 
 		// We don't have to wait for any template
 		if len(task.Templates) == 0 {
+			// Wait for the tasks of lower start orders
+			if err := r.waitForStartOrder(); err != nil {
+				r.setState(
+					structs.TaskStateDead,
+					structs.NewTaskEvent(structs.TaskSetupFailure).SetSetupError(err).SetFailsTask(),
+					false)
+				resultCh <- false
+				return
+			}
+
 			// Send the start signal
 			select {
 			case r.startCh <- struct{}{}:
@@ -1040,8 +1089,21 @@ func (r *TaskRunner) prestart(alloc *structs.Allocation, task *structs.Task, res
 		// Block for consul-template
 		// TODO Hooks should register themselves as blocking and then we can
 		// perioidcally enumerate what we are still blocked on
+		stopProgress = r.reportProgress("waiting for templates to render")
 		select {
 		case <-r.unblockCh:
+			stopProgress()
+
+			// Wait for the tasks of lower start orders
+			if err := r.waitForStartOrder(); err != nil {
+				r.setState(
+					structs.TaskStateDead,
+					structs.NewTaskEvent(structs.TaskSetupFailure).SetSetupError(err).SetFailsTask(),
+					false)
+				resultCh <- false
+				return
+			}
+
 			// Send the start signal
 			select {
 			case r.startCh <- struct{}{}:
@@ -1052,6 +1114,7 @@ func (r *TaskRunner) prestart(alloc *structs.Allocation, task *structs.Task, res
 			return
 		case <-r.waitCh:
 			// The run loop has exited so exit too
+			stopProgress()
 			resultCh <- false
 			return
 		}
@@ -1065,6 +1128,39 @@ func (r *TaskRunner) prestart(alloc *structs.Allocation, task *structs.Task, res
 	}
 }
 
+// waitForStartOrder blocks until the tasks of the group with a lower start
+// order are ready. If they aren't ready before the client's
+// "start_order.timeout" elapses, an error is returned unless
+// "start_order.on_timeout" is set to proceed. An error is returned right away
+// if any of the tasks failed. Tasks that are already running, such as restored
+// ones, never wait.
+func (r *TaskRunner) waitForStartOrder() error {
+	if r.startGate == nil || r.getHandle() != nil {
+		return nil
+	}
+
+	timeout := r.config.ReadDurationDefault("start_order.timeout", config.DefaultStartOrderTimeout)
+	stopProgress := r.reportProgress("waiting for tasks of lower start orders")
+	pending, err := r.startGate(r.task, timeout, r.waitCh)
+	stopProgress()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if r.config.ReadDefault("start_order.on_timeout", "fail") == "proceed" {
+		r.logger.Printf("[WARN] client: task %q (alloc %q) starting although tasks %v aren't ready after %v",
+			r.task.Name, r.alloc.ID, pending, timeout)
+		r.setState(structs.TaskStatePending,
+			structs.NewTaskEvent(structs.TaskSetup).SetMessage(fmt.Sprintf("Starting although tasks %v aren't ready after %v", pending, timeout)),
+			false)
+		return nil
+	}
+	return fmt.Errorf("tasks %v of lower start orders aren't ready after %v", pending, timeout)
+}
+
 // postrun is used to do any cleanup that is necessary after exiting the runloop
 func (r *TaskRunner) postrun() {
 	// Stop the template manager
@@ -1406,9 +1502,18 @@ func (r *TaskRunner) startTask() error {
 			r.task.Name, r.alloc.ID, err)
 	}
 
+	// Drivers that don't write the task's logs through the executor can't
+	// combine them
+	if r.task.LogConfig != nil && r.task.LogConfig.CombineLogs && !drv.Abilities().CombineLogs {
+		return structs.NewRecoverableError(fmt.Errorf("driver %q of task %q doesn't support combine_logs",
+			r.task.Driver, r.task.Name), false)
+	}
+
 	// Run prestart
 	ctx := driver.NewExecContext(r.taskDir, r.envBuilder.Build())
+	stopProgress := r.reportProgress("preparing the task in the driver")
 	presp, err := drv.Prestart(ctx, r.task)
+	stopProgress()
 
 	// Merge newly created resources into previously created resources
 	if presp != nil {
@@ -1433,6 +1538,14 @@ func (r *TaskRunner) startTask() error {
 	// Start the job
 	sresp, err := drv.Start(ctx, r.task)
 	if err != nil {
+		// The restart tracker retries once the driver allows starting the
+		// task again, so the error isn't wrapped
+		if wait, ok := dstructs.StartTooSoonWait(err); ok {
+			r.logger.Printf("[WARN] client: driver throttled starting task %q for alloc %q; retrying in %v",
+				r.task.Name, r.alloc.ID, wait)
+			return err
+		}
+
 		wrapped := fmt.Sprintf("failed to start task %q for alloc %q: %v",
 			r.task.Name, r.alloc.ID, err)
 		r.logger.Printf("[WARN] client: %s", wrapped)
@@ -1488,7 +1601,7 @@ func (r *TaskRunner) registerServices(d driver.Driver, h driver.DriverHandle, n
 	var exec driver.ScriptExecutor
 	if d.Abilities().Exec {
 		// Allow set the script executor if the driver supports it
-		exec = h
+		exec = r.execLimiter.wrap(h)
 	}
 	interpolatedTask := interpolateServices(r.envBuilder.Build(), r.task)
 	return r.consul.RegisterTask(r.alloc.ID, interpolatedTask, r, exec, n)
@@ -1548,10 +1661,38 @@ func (r *TaskRunner) buildTaskDir(fsi cstructs.FSIsolation) error {
 	if len(r.config.ChrootEnv) > 0 {
 		chroot = r.config.ChrootEnv
 	}
-	if err := r.taskDir.Build(built, chroot, fsi); err != nil {
+	concurrency := r.config.ReadIntDefault("chroot.copy_concurrency", config.DefaultChrootCopyConcurrency)
+	r.taskDir.SetChrootConcurrency(concurrency)
+	r.taskDir.SetChrootMaxTotalMB(chrootMaxTotalMB(r.config.ReadIntDefault("chroot.max_total_mb", 0), r.task.ChrootMaxTotalMB))
+	r.taskDir.SetChrootBuildTimeout(r.config.ReadDurationDefault("chroot.build_timeout", config.DefaultChrootBuildTimeout))
+	if r.config.ReadBoolDefault("chroot.shared_base", false) {
+		r.taskDir.SetChrootBaseDir(filepath.Join(r.config.AllocDir, allocdir.ChrootBaseDirName))
+	}
+	if err := r.taskDir.SetChrootStaleCheck(r.config.ReadDefault("chroot.stale_check", "")); err != nil {
+		return err
+	}
+	if err := r.taskDir.SetMountPropagation(r.config.ReadDefault("chroot.mount_propagation", allocdir.MountPropagationPrivate)); err != nil {
 		return err
 	}
 
+	start := time.Now()
+	var stopProgress func()
+	if !built {
+		stopProgress = r.reportProgress("building the task directory")
+	} else {
+		stopProgress = func() {}
+	}
+	err := r.taskDir.Build(built, chroot, fsi)
+	stopProgress()
+	if err != nil {
+		return err
+	}
+	if !built && fsi == cstructs.FSIsolationChroot {
+		metrics.MeasureSince([]string{"client", "allocs", "chroot_build"}, start)
+		r.logger.Printf("[DEBUG] client: built chroot for task %q (alloc %q) in %v",
+			r.task.Name, r.alloc.ID, time.Since(start))
+	}
+
 	// Mark task dir as successfully built
 	r.persistLock.Lock()
 	r.taskDirBuilt = true
@@ -1559,9 +1700,56 @@ func (r *TaskRunner) buildTaskDir(fsi cstructs.FSIsolation) error {
 
 	// Set path and host related env vars
 	driver.SetEnvvars(r.envBuilder, fsi, r.taskDir, r.config)
+	driver.SetDefaultEnvvars(r.envBuilder, r.task.Driver, r.config)
+	driver.SetHostEnvPassthrough(r.envBuilder, r.task)
 	return nil
 }
 
+// chrootMaxTotalMB returns the size limit of a task's chroot given the client's
+// and the task's limits. The task may only lower the client's limit and zero
+// means unlimited.
+func chrootMaxTotalMB(client, task int) int {
+	if task <= 0 || (client > 0 && task > client) {
+		return client
+	}
+	return task
+}
+
+// reportProgress periodically emits an event with the elapsed time while a
+// potentially slow step preparing the task runs, so that it doesn't appear
+// hung. The returned function must be called once the step is done.
+func (r *TaskRunner) reportProgress(step string) func() {
+	interval := r.config.ReadDurationDefault("prestart.progress_interval", config.DefaultPrestartProgressInterval)
+	if interval <= 0 {
+		return func() {}
+	}
+
+	start := time.Now()
+	doneCh := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				elapsed := time.Since(start).Round(time.Second)
+				r.logger.Printf("[DEBUG] client: task %q (alloc %q) still %s after %v",
+					r.task.Name, r.alloc.ID, step, elapsed)
+				r.setState(structs.TaskStatePending,
+					structs.NewTaskEvent(structs.TaskSetup).SetMessage(fmt.Sprintf("Still %s after %v", step, elapsed)),
+					false)
+			case <-doneCh:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(doneCh) })
+	}
+}
+
 // collectResourceUsageStats starts collecting resource usage stats of a Task.
 // Collection ends when the passed channel is closed
 func (r *TaskRunner) collectResourceUsageStats(stopCollection <-chan struct{}) {
@@ -1569,6 +1757,7 @@ func (r *TaskRunner) collectResourceUsageStats(stopCollection <-chan struct{}) {
 	// collection interval
 	next := time.NewTimer(0)
 	defer next.Stop()
+	throttle := r.newCPUThrottleWatcher()
 	for {
 		select {
 		case <-next.C:
@@ -1600,6 +1789,9 @@ func (r *TaskRunner) collectResourceUsageStats(stopCollection <-chan struct{}) {
 			r.resourceUsageLock.Unlock()
 			if ru != nil {
 				r.emitStats(ru)
+				if throttle != nil {
+					r.checkCPUThrottle(throttle, ru)
+				}
 			}
 		case <-stopCollection:
 			return
@@ -1693,7 +1885,7 @@ func (r *TaskRunner) updateServices(d driver.Driver, h driver.ScriptExecutor, ol
 	var exec driver.ScriptExecutor
 	if d.Abilities().Exec {
 		// Allow set the script executor if the driver supports it
-		exec = h
+		exec = r.execLimiter.wrap(h)
 	}
 	r.driverNetLock.Lock()
 	net := r.driverNet.Copy()
@@ -1798,6 +1990,8 @@ func (r *TaskRunner) waitErrorToEvent(res *dstructs.WaitResult) *structs.TaskEve
 	return structs.NewTaskEvent(structs.TaskTerminated).
 		SetExitCode(res.ExitCode).
 		SetSignal(res.Signal).
+		SetOOMKilled(res.OOMKilled).
+		SetMemorySoftLimitKilled(res.MemorySoftLimitKilled).
 		SetExitMessage(res.Err)
 }
 
@@ -1825,6 +2019,19 @@ func (r *TaskRunner) Destroy(event *structs.TaskEvent) {
 	close(r.destroyCh)
 }
 
+// Detach stops managing the task without killing it if its driver handle
+// supports it, leaving the task to be reattached to once its state is
+// restored. The task runner must not be used afterwards.
+func (r *TaskRunner) Detach() {
+	detacher, ok := r.getHandle().(driver.Detacher)
+	if !ok {
+		return
+	}
+	if err := detacher.Detach(); err != nil {
+		r.logger.Printf("[WARN] client: failed to detach from task %q in alloc %q: %v", r.task.Name, r.alloc.ID, err)
+	}
+}
+
 // getCreatedResources returns the resources created by drivers. It will never
 // return nil.
 func (r *TaskRunner) getCreatedResources() *driver.CreatedResources {
@@ -1865,6 +2072,14 @@ func (r *TaskRunner) setGaugeForMemory(ru *cstructs.TaskResourceUsage) {
 			float32(ru.ResourceUsage.MemoryStats.KernelUsage), r.baseLabels)
 		metrics.SetGaugeWithLabels([]string{"client", "allocs", "memory", "kernel_max_usage"},
 			float32(ru.ResourceUsage.MemoryStats.KernelMaxUsage), r.baseLabels)
+		metrics.SetGaugeWithLabels([]string{"client", "allocs", "memory", "usage"},
+			float32(ru.ResourceUsage.MemoryStats.Usage), r.baseLabels)
+		metrics.SetGaugeWithLabels([]string{"client", "allocs", "memory", "working_set"},
+			float32(ru.ResourceUsage.MemoryStats.WorkingSet), r.baseLabels)
+		metrics.SetGaugeWithLabels([]string{"client", "allocs", "memory", "major_page_faults"},
+			float32(ru.ResourceUsage.MemoryStats.MajorPageFaults), r.baseLabels)
+		metrics.SetGaugeWithLabels([]string{"client", "allocs", "memory", "minor_page_faults"},
+			float32(ru.ResourceUsage.MemoryStats.MinorPageFaults), r.baseLabels)
 	}
 
 	if r.config.BackwardsCompatibleMetrics {
@@ -1874,6 +2089,10 @@ func (r *TaskRunner) setGaugeForMemory(ru *cstructs.TaskResourceUsage) {
 		metrics.SetGauge([]string{"client", "allocs", r.alloc.Job.Name, r.alloc.TaskGroup, r.alloc.ID, r.task.Name, "memory", "max_usage"}, float32(ru.ResourceUsage.MemoryStats.MaxUsage))
 		metrics.SetGauge([]string{"client", "allocs", r.alloc.Job.Name, r.alloc.TaskGroup, r.alloc.ID, r.task.Name, "memory", "kernel_usage"}, float32(ru.ResourceUsage.MemoryStats.KernelUsage))
 		metrics.SetGauge([]string{"client", "allocs", r.alloc.Job.Name, r.alloc.TaskGroup, r.alloc.ID, r.task.Name, "memory", "kernel_max_usage"}, float32(ru.ResourceUsage.MemoryStats.KernelMaxUsage))
+		metrics.SetGauge([]string{"client", "allocs", r.alloc.Job.Name, r.alloc.TaskGroup, r.alloc.ID, r.task.Name, "memory", "usage"}, float32(ru.ResourceUsage.MemoryStats.Usage))
+		metrics.SetGauge([]string{"client", "allocs", r.alloc.Job.Name, r.alloc.TaskGroup, r.alloc.ID, r.task.Name, "memory", "working_set"}, float32(ru.ResourceUsage.MemoryStats.WorkingSet))
+		metrics.SetGauge([]string{"client", "allocs", r.alloc.Job.Name, r.alloc.TaskGroup, r.alloc.ID, r.task.Name, "memory", "major_page_faults"}, float32(ru.ResourceUsage.MemoryStats.MajorPageFaults))
+		metrics.SetGauge([]string{"client", "allocs", r.alloc.Job.Name, r.alloc.TaskGroup, r.alloc.ID, r.task.Name, "memory", "minor_page_faults"}, float32(ru.ResourceUsage.MemoryStats.MinorPageFaults))
 	}
 }
 
@@ -1889,6 +2108,8 @@ func (r *TaskRunner) setGaugeForCPU(ru *cstructs.TaskResourceUsage) {
 			float32(ru.ResourceUsage.CpuStats.ThrottledTime), r.baseLabels)
 		metrics.SetGaugeWithLabels([]string{"client", "allocs", "cpu", "throttled_periods"},
 			float32(ru.ResourceUsage.CpuStats.ThrottledPeriods), r.baseLabels)
+		metrics.SetGaugeWithLabels([]string{"client", "allocs", "cpu", "throttled_percent"},
+			float32(ru.ResourceUsage.CpuStats.ThrottledPercent), r.baseLabels)
 		metrics.SetGaugeWithLabels([]string{"client", "allocs", "cpu", "total_ticks"},
 			float32(ru.ResourceUsage.CpuStats.TotalTicks), r.baseLabels)
 	}
@@ -1899,6 +2120,7 @@ func (r *TaskRunner) setGaugeForCPU(ru *cstructs.TaskResourceUsage) {
 		metrics.SetGauge([]string{"client", "allocs", r.alloc.Job.Name, r.alloc.TaskGroup, r.alloc.ID, r.task.Name, "cpu", "user"}, float32(ru.ResourceUsage.CpuStats.UserMode))
 		metrics.SetGauge([]string{"client", "allocs", r.alloc.Job.Name, r.alloc.TaskGroup, r.alloc.ID, r.task.Name, "cpu", "throttled_time"}, float32(ru.ResourceUsage.CpuStats.ThrottledTime))
 		metrics.SetGauge([]string{"client", "allocs", r.alloc.Job.Name, r.alloc.TaskGroup, r.alloc.ID, r.task.Name, "cpu", "throttled_periods"}, float32(ru.ResourceUsage.CpuStats.ThrottledPeriods))
+		metrics.SetGauge([]string{"client", "allocs", r.alloc.Job.Name, r.alloc.TaskGroup, r.alloc.ID, r.task.Name, "cpu", "throttled_percent"}, float32(ru.ResourceUsage.CpuStats.ThrottledPercent))
 		metrics.SetGauge([]string{"client", "allocs", r.alloc.Job.Name, r.alloc.TaskGroup, r.alloc.ID, r.task.Name, "cpu", "total_ticks"}, float32(ru.ResourceUsage.CpuStats.TotalTicks))
 	}
 }
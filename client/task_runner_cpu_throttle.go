@@ -0,0 +1,69 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+	cstructs "github.com/hashicorp/nomad/client/structs"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// cpuThrottleWatcher tracks how long a task has been CPU throttled above the
+// configured threshold and emits an event once it's sustained.
+type cpuThrottleWatcher struct {
+	threshold float64
+	duration  time.Duration
+
+	// since is when the throttling last went above the threshold and
+	// reported whether an event was emitted since then
+	since    time.Time
+	reported bool
+}
+
+// newCPUThrottleWatcher returns a watcher for the client's configured
+// threshold or nil if the event is disabled.
+func (r *TaskRunner) newCPUThrottleWatcher() *cpuThrottleWatcher {
+	threshold := r.config.ReadIntDefault("cpu_throttle.threshold_percent", 0)
+	if threshold <= 0 {
+		return nil
+	}
+	if threshold > 100 {
+		r.logger.Printf("[WARN] client: ignoring invalid cpu_throttle.threshold_percent %d; must be between 0 and 100", threshold)
+		return nil
+	}
+
+	return &cpuThrottleWatcher{
+		threshold: float64(threshold),
+		duration:  r.config.ReadDurationDefault("cpu_throttle.duration", config.DefaultCPUThrottleDuration),
+	}
+}
+
+// checkCPUThrottle compares the throttling of the sampled resource usage to
+// the threshold, emitting an event once per period of sustained throttling.
+func (r *TaskRunner) checkCPUThrottle(w *cpuThrottleWatcher, ru *cstructs.TaskResourceUsage) {
+	if ru.ResourceUsage == nil || ru.ResourceUsage.CpuStats == nil {
+		return
+	}
+
+	percent := ru.ResourceUsage.CpuStats.ThrottledPercent
+	if percent < w.threshold {
+		w.since = time.Time{}
+		w.reported = false
+		return
+	}
+
+	now := time.Unix(0, ru.Timestamp)
+	if w.since.IsZero() {
+		w.since = now
+	}
+	if w.reported || now.Sub(w.since) < w.duration {
+		return
+	}
+
+	w.reported = true
+	msg := fmt.Sprintf("Task was CPU throttled %.2f%% of the time for %v; its CPU resources may be too low",
+		percent, now.Sub(w.since))
+	r.logger.Printf("[WARN] client: task %q for alloc %q: %s", r.task.Name, r.alloc.ID, msg)
+	r.setState(structs.TaskStateRunning, structs.NewTaskEvent(structs.TaskCPUThrottled).SetMessage(msg), false)
+}
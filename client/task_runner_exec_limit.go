@@ -0,0 +1,94 @@
+package client
+
+import (
+	"context"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/nomad/client/driver"
+)
+
+const (
+	// execLimitQueue makes Exec calls over the limit wait for a slot.
+	execLimitQueue = "queue"
+
+	// execLimitSkip makes Exec calls over the limit return
+	// driver.ScriptExecSkipped right away.
+	execLimitSkip = "skip"
+)
+
+// execLimiter limits the concurrent Exec calls, such as script checks, into a
+// task so that slow probes don't pile up and degrade the task.
+type execLimiter struct {
+	// slots holds a value for every running Exec call
+	slots chan struct{}
+	skip  bool
+
+	// onSkip is called when a call is skipped
+	onSkip func()
+}
+
+// newExecLimiter returns the limiter of the task's Exec calls configured by
+// the client or nil if they're unlimited.
+func (r *TaskRunner) newExecLimiter() *execLimiter {
+	max := r.config.ReadIntDefault("exec.max_concurrent", 1)
+	if max <= 0 {
+		return nil
+	}
+
+	policy := r.config.ReadDefault("exec.limit_policy", execLimitQueue)
+	if policy != execLimitQueue && policy != execLimitSkip {
+		r.logger.Printf("[WARN] client: invalid exec.limit_policy %q; must be %q or %q, using %q",
+			policy, execLimitQueue, execLimitSkip, execLimitQueue)
+		policy = execLimitQueue
+	}
+
+	return &execLimiter{
+		slots: make(chan struct{}, max),
+		skip:  policy == execLimitSkip,
+		onSkip: func() {
+			r.logger.Printf("[DEBUG] client: skipped exec into task %q for alloc %q as %d are running",
+				r.task.Name, r.alloc.ID, max)
+			if !r.config.DisableTaggedMetrics {
+				metrics.IncrCounterWithLabels([]string{"client", "allocs", "exec", "skipped"}, 1, r.baseLabels)
+			}
+			if r.config.BackwardsCompatibleMetrics {
+				metrics.IncrCounter([]string{"client", "allocs", r.alloc.Job.Name, r.alloc.TaskGroup, r.alloc.ID, r.task.Name, "exec", "skipped"}, 1)
+			}
+		},
+	}
+}
+
+// wrap returns a ScriptExecutor limiting the Exec calls into exec. It returns
+// exec if the limiter is nil.
+func (l *execLimiter) wrap(exec driver.ScriptExecutor) driver.ScriptExecutor {
+	if l == nil || exec == nil {
+		return exec
+	}
+	return &limitedScriptExecutor{limiter: l, exec: exec}
+}
+
+// limitedScriptExecutor is a ScriptExecutor whose concurrent Exec calls are
+// limited by an execLimiter.
+type limitedScriptExecutor struct {
+	limiter *execLimiter
+	exec    driver.ScriptExecutor
+}
+
+func (e *limitedScriptExecutor) Exec(ctx context.Context, cmd string, args []string) ([]byte, int, error) {
+	select {
+	case e.limiter.slots <- struct{}{}:
+	default:
+		if e.limiter.skip {
+			e.limiter.onSkip()
+			return nil, 0, driver.ScriptExecSkipped
+		}
+		select {
+		case e.limiter.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+	defer func() { <-e.limiter.slots }()
+
+	return e.exec.Exec(ctx, cmd, args)
+}
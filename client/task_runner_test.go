@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -10,6 +11,8 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -18,6 +21,7 @@ import (
 	"github.com/golang/snappy"
 	"github.com/hashicorp/nomad/client/allocdir"
 	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/client/driver"
 	"github.com/hashicorp/nomad/client/driver/env"
 	cstructs "github.com/hashicorp/nomad/client/structs"
 	"github.com/hashicorp/nomad/client/vaultclient"
@@ -88,6 +92,39 @@ func (ctx *taskRunnerTestCtx) Cleanup() {
 	ctx.allocDir.Destroy()
 }
 
+func TestTaskRunner_CombineLogs_Unsupported(t *testing.T) {
+	t.Parallel()
+	alloc := mock.Alloc()
+	task := alloc.Job.TaskGroups[0].Tasks[0]
+	task.Driver = "mock_driver"
+	task.Config = map[string]interface{}{
+		"exit_code": 0,
+	}
+	task.LogConfig.CombineLogs = true
+
+	ctx := testTaskRunnerFromAlloc(t, true, alloc)
+	ctx.tr.MarkReceived()
+	go ctx.tr.Run()
+	defer ctx.Cleanup()
+
+	// The mock driver doesn't combine logs, so the task fails without
+	// restarting
+	select {
+	case <-ctx.tr.WaitCh():
+	case <-time.After(time.Duration(testutil.TestMultiplier()*15) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	last := ctx.upd.events[len(ctx.upd.events)-1]
+	if last.Type != structs.TaskNotRestarting {
+		t.Fatalf("Last Event was %v; want %v", last.Type, structs.TaskNotRestarting)
+	}
+	failure := ctx.upd.events[len(ctx.upd.events)-2]
+	if failure.Type != structs.TaskDriverFailure || !strings.Contains(failure.DriverError, "combine_logs") {
+		t.Fatalf("expected the driver to fail for combine_logs; got %#v", failure)
+	}
+}
+
 func testTaskRunner(t *testing.T, restarts bool) *taskRunnerTestCtx {
 	// Use mock driver
 	alloc := mock.Alloc()
@@ -471,6 +508,36 @@ func TestTaskRunner_SaveRestoreState(t *testing.T) {
 	}
 }
 
+// detachHandle is a driver handle that records being detached from.
+type detachHandle struct {
+	driver.DriverHandle
+	detached bool
+}
+
+func (h *detachHandle) Detach() error {
+	h.detached = true
+	return nil
+}
+
+func TestTaskRunner_Detach(t *testing.T) {
+	t.Parallel()
+	ctx := testTaskRunner(t, false)
+	defer ctx.Cleanup()
+
+	// Handles that can't be detached from are left alone
+	ctx.tr.Detach()
+
+	h := &detachHandle{}
+	ctx.tr.handleLock.Lock()
+	ctx.tr.handle = h
+	ctx.tr.handleLock.Unlock()
+
+	ctx.tr.Detach()
+	if !h.detached {
+		t.Fatalf("expected the handle to be detached from")
+	}
+}
+
 func TestTaskRunner_Download_List(t *testing.T) {
 	t.Parallel()
 	ts := httptest.NewServer(http.FileServer(http.Dir(filepath.Dir("."))))
@@ -1186,6 +1253,80 @@ func TestTaskRunner_Template_Block(t *testing.T) {
 	}
 }
 
+func TestTaskRunner_chrootMaxTotalMB(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		client, task, expected int
+	}{
+		{0, 0, 0},
+		{0, 100, 100},
+		{500, 0, 500},
+		{500, 100, 100},
+		{500, 1000, 500},
+	}
+	for _, c := range cases {
+		if actual := chrootMaxTotalMB(c.client, c.task); actual != c.expected {
+			t.Errorf("chrootMaxTotalMB(%d, %d) = %d; want %d", c.client, c.task, actual, c.expected)
+		}
+	}
+}
+
+func TestTaskRunner_Template_Block_Progress(t *testing.T) {
+	t.Parallel()
+	alloc := mock.Alloc()
+	task := alloc.Job.TaskGroups[0].Tasks[0]
+	task.Driver = "mock_driver"
+	task.Config = map[string]interface{}{
+		"exit_code": "0",
+		"run_for":   "1s",
+	}
+	task.Templates = []*structs.Template{
+		{
+			EmbeddedTmpl: "{{key \"foo\"}}",
+			DestPath:     "local/test",
+			ChangeMode:   structs.TemplateChangeModeNoop,
+		},
+	}
+
+	ctx := testTaskRunnerFromAlloc(t, false, alloc)
+	ctx.tr.config.Options = map[string]string{
+		"prestart.progress_interval": "100ms",
+	}
+	ctx.tr.MarkReceived()
+	go ctx.tr.Run()
+	defer ctx.Cleanup()
+
+	select {
+	case <-ctx.tr.WaitCh():
+		t.Fatalf("premature exit")
+	case <-time.After(1 * time.Second):
+	}
+
+	// Progress is reported while blocked on the template
+	var progress int
+	for _, e := range ctx.upd.events {
+		if e.Type == structs.TaskSetup && strings.HasPrefix(e.Message, "Still waiting for templates to render after") {
+			progress++
+		}
+	}
+	if progress == 0 {
+		t.Fatalf("expected progress events: %v", ctx.upd)
+	}
+
+	// Unblock
+	ctx.tr.UnblockStart("test")
+
+	select {
+	case <-ctx.tr.WaitCh():
+	case <-time.After(time.Duration(testutil.TestMultiplier()*15) * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	if ctx.upd.state != structs.TaskStateDead {
+		t.Fatalf("TaskState %v; want %v", ctx.upd.state, structs.TaskStateDead)
+	}
+}
+
 func TestTaskRunner_Template_Artifact(t *testing.T) {
 	t.Parallel()
 	dir, err := os.Getwd()
@@ -2031,3 +2172,127 @@ func TestTaskRunner_DriverNetwork(t *testing.T) {
 		t.Fatalf("error: %v", err)
 	})
 }
+
+func TestTaskRunner_CPUThrottle(t *testing.T) {
+	t.Parallel()
+	ctx := testTaskRunner(t, false)
+	defer ctx.Cleanup()
+
+	ctx.tr.config.Options = map[string]string{"cpu_throttle.threshold_percent": "50"}
+	w := ctx.tr.newCPUThrottleWatcher()
+	if w == nil {
+		t.Fatalf("expected a watcher")
+	}
+	if w.duration != config.DefaultCPUThrottleDuration {
+		t.Fatalf("got duration %v; want %v", w.duration, config.DefaultCPUThrottleDuration)
+	}
+
+	sample := func(offset time.Duration, percent float64) *cstructs.TaskResourceUsage {
+		return &cstructs.TaskResourceUsage{
+			ResourceUsage: &cstructs.ResourceUsage{
+				CpuStats: &cstructs.CpuStats{ThrottledPercent: percent},
+			},
+			Timestamp: time.Unix(0, 0).Add(offset).UnixNano(),
+		}
+	}
+
+	// An event is emitted once per sustained period above the threshold
+	samples := []*cstructs.TaskResourceUsage{
+		sample(0, 80),
+		sample(30*time.Second, 60),
+		sample(time.Minute, 90),
+		sample(2*time.Minute, 90),
+		sample(3*time.Minute, 10),
+		sample(4*time.Minute, 70),
+		sample(4*time.Minute+30*time.Second, 70),
+	}
+	for _, ru := range samples {
+		ctx.tr.checkCPUThrottle(w, ru)
+	}
+	if len(ctx.upd.events) != 1 {
+		t.Fatalf("got %d events; want 1: %v", len(ctx.upd.events), ctx.upd)
+	}
+	if e := ctx.upd.events[0]; e.Type != structs.TaskCPUThrottled || !strings.Contains(e.Message, "90.00%") {
+		t.Fatalf("unexpected event: %v", e)
+	}
+
+	ctx.tr.config.Options = map[string]string{"cpu_throttle.threshold_percent": "0"}
+	if ctx.tr.newCPUThrottleWatcher() != nil {
+		t.Fatalf("expected the watcher to be disabled")
+	}
+}
+
+// blockingScriptExec is a ScriptExecutor blocking until its context is done
+// and counting the concurrent calls.
+type blockingScriptExec struct {
+	running int32
+	max     int32
+}
+
+func (b *blockingScriptExec) Exec(ctx context.Context, _ string, _ []string) ([]byte, int, error) {
+	n := atomic.AddInt32(&b.running, 1)
+	defer atomic.AddInt32(&b.running, -1)
+	for {
+		max := atomic.LoadInt32(&b.max)
+		if n <= max || atomic.CompareAndSwapInt32(&b.max, max, n) {
+			break
+		}
+	}
+	<-ctx.Done()
+	return nil, 0, ctx.Err()
+}
+
+func TestTaskRunner_ExecLimiter(t *testing.T) {
+	t.Parallel()
+	ctx := testTaskRunner(t, false)
+	defer ctx.Cleanup()
+
+	// Execs are serialized by default
+	exec := &blockingScriptExec{}
+	limited := ctx.tr.newExecLimiter().wrap(exec)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			execCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			limited.Exec(execCtx, "foo", nil)
+		}()
+	}
+	wg.Wait()
+	if exec.max != 1 {
+		t.Fatalf("got %d concurrent execs; want 1", exec.max)
+	}
+
+	// Execs over the limit are skipped
+	ctx.tr.config.Options = map[string]string{
+		"exec.max_concurrent": "2",
+		"exec.limit_policy":   "skip",
+	}
+	exec = &blockingScriptExec{}
+	limited = ctx.tr.newExecLimiter().wrap(exec)
+	execCtx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, _, err := limited.Exec(execCtx, "foo", nil)
+			errCh <- err
+		}()
+	}
+	if err := <-errCh; err != driver.ScriptExecSkipped {
+		t.Fatalf("expected the exec to be skipped, got: %v", err)
+	}
+	cancel()
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != context.Canceled {
+			t.Fatalf("expected the exec to be canceled, got: %v", err)
+		}
+	}
+
+	// A limit of zero disables the limiter
+	ctx.tr.config.Options = map[string]string{"exec.max_concurrent": "0"}
+	if ctx.tr.newExecLimiter() != nil {
+		t.Fatalf("expected no limiter")
+	}
+}
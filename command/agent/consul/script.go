@@ -115,6 +115,20 @@ func (s *scriptCheck) run() *scriptHandle {
 			// cleanup context
 			cancel()
 
+			// Keep the check's status rather than failing it when it was
+			// skipped because other execs into the task are still running.
+			// The skip is counted by the task's exec limiter.
+			if err == driver.ScriptExecSkipped {
+				s.logger.Printf("[DEBUG] consul.checks: check %q for task %q alloc %q skipped: %v",
+					s.check.Name, s.taskName, s.allocID, err)
+				select {
+				case <-s.shutdownCh:
+					return
+				default:
+				}
+				continue
+			}
+
 			state := api.HealthCritical
 			switch code {
 			case 0:
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/nomad/client/driver"
 	"github.com/hashicorp/nomad/helper/testtask"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
@@ -278,3 +279,34 @@ func TestConsulScript_Exec_Codes(t *testing.T) {
 	t.Run("Error-2", run(2, err, api.HealthCritical))
 	t.Run("Error-9000", run(9000, err, api.HealthCritical))
 }
+
+// TestConsulScript_Exec_Skipped asserts a skipped script doesn't update the
+// check.
+func TestConsulScript_Exec_Skipped(t *testing.T) {
+	t.Parallel()
+	serviceCheck := structs.ServiceCheck{
+		Name:     "test",
+		Interval: 10 * time.Millisecond,
+		Timeout:  3 * time.Second,
+	}
+
+	hb := newFakeHeartbeater()
+	shutdown := make(chan struct{})
+	exec := newSimpleExec(0, driver.ScriptExecSkipped)
+	check := newScriptCheck("allocid", "testtask", "checkid", &serviceCheck, exec, hb, testLogger(), shutdown)
+	handle := check.run()
+
+	select {
+	case update := <-hb.updates:
+		t.Fatalf("unexpected update of a skipped check: %v", update)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Skipped checks still exit on shutdown
+	close(shutdown)
+	select {
+	case <-handle.wait():
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for script check to exit")
+	}
+}
@@ -20,7 +20,7 @@ var (
 	allocIDNotPresentErr  = fmt.Errorf("must provide a valid alloc id")
 	fileNameNotPresentErr = fmt.Errorf("must provide a file name")
 	taskNotPresentErr     = fmt.Errorf("must provide task name")
-	logTypeNotPresentErr  = fmt.Errorf("must provide log type (stdout/stderr)")
+	logTypeNotPresentErr  = fmt.Errorf("must provide log type (stdout/stderr/output)")
 	clientNotRunning      = fmt.Errorf("node is not running a Nomad Client")
 	invalidOrigin         = fmt.Errorf("origin must be start or end")
 )
@@ -277,7 +277,7 @@ func (s *HTTPServer) Logs(resp http.ResponseWriter, req *http.Request) (interfac
 
 	logType = q.Get("type")
 	switch logType {
-	case "stdout", "stderr":
+	case "stdout", "stderr", structs.LogStreamCombined:
 	default:
 		return nil, logTypeNotPresentErr
 	}
@@ -683,6 +683,9 @@ func ApiTaskToStructsTask(apiTask *api.Task, structsTask *structs.Task) {
 	structsTask.Meta = apiTask.Meta
 	structsTask.KillTimeout = *apiTask.KillTimeout
 	structsTask.ShutdownDelay = apiTask.ShutdownDelay
+	structsTask.ShutdownOrder = apiTask.ShutdownOrder
+	structsTask.StartOrder = apiTask.StartOrder
+	structsTask.ChrootMaxTotalMB = apiTask.ChrootMaxTotalMB
 	structsTask.KillSignal = apiTask.KillSignal
 
 	if l := len(apiTask.Constraints); l != 0 {
@@ -773,8 +776,13 @@ func ApiTaskToStructsTask(apiTask *api.Task, structsTask *structs.Task) {
 	}
 
 	structsTask.LogConfig = &structs.LogConfig{
-		MaxFiles:      *apiTask.LogConfig.MaxFiles,
-		MaxFileSizeMB: *apiTask.LogConfig.MaxFileSizeMB,
+		MaxFiles:        *apiTask.LogConfig.MaxFiles,
+		MaxFileSizeMB:   *apiTask.LogConfig.MaxFileSizeMB,
+		FileNamePattern: apiTask.LogConfig.FileNamePattern,
+		FileMode:        apiTask.LogConfig.FileMode,
+		FileOwner:       apiTask.LogConfig.FileOwner,
+		BufferSizeKB:    apiTask.LogConfig.BufferSizeKB,
+		CombineLogs:     apiTask.LogConfig.CombineLogs,
 	}
 
 	if l := len(apiTask.Artifacts); l != 0 {
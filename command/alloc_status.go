@@ -404,6 +404,14 @@ func buildDisplayMessage(event *api.TaskEvent) string {
 			parts = append(parts, fmt.Sprintf("Signal: %d", event.Signal))
 		}
 
+		if event.Details["oom_killed"] == "true" {
+			parts = append(parts, "OOM Killed")
+		}
+
+		if event.Details["memory_soft_limit_killed"] == "true" {
+			parts = append(parts, "Memory Soft Limit Exceeded")
+		}
+
 		if event.Message != "" {
 			parts = append(parts, fmt.Sprintf("Exit Message: %q", event.Message))
 		}
@@ -450,6 +458,12 @@ func buildDisplayMessage(event *api.TaskEvent) string {
 		desc = event.DriverMessage
 	case api.TaskLeaderDead:
 		desc = "Leader Task in Group dead"
+	case api.TaskChrootBuildFailed:
+		if event.SetupError != "" {
+			desc = event.SetupError
+		} else {
+			desc = "Building the chroot failed"
+		}
 	default:
 		desc = event.Message
 	}
@@ -538,6 +552,14 @@ func (c *AllocStatusCommand) outputVerboseResourceUsage(task string, resourceUsa
 				measuredStats = append(measuredStats, humanize.IBytes(memoryStats.KernelUsage))
 			case "Kernel Max Usage":
 				measuredStats = append(measuredStats, humanize.IBytes(memoryStats.KernelMaxUsage))
+			case "Usage":
+				measuredStats = append(measuredStats, humanize.IBytes(memoryStats.Usage))
+			case "Working Set":
+				measuredStats = append(measuredStats, humanize.IBytes(memoryStats.WorkingSet))
+			case "Major Page Faults":
+				measuredStats = append(measuredStats, strconv.FormatUint(memoryStats.MajorPageFaults, 10))
+			case "Minor Page Faults":
+				measuredStats = append(measuredStats, strconv.FormatUint(memoryStats.MinorPageFaults, 10))
 			}
 		}
 
@@ -564,6 +586,8 @@ func (c *AllocStatusCommand) outputVerboseResourceUsage(task string, resourceUsa
 				measuredStats = append(measuredStats, fmt.Sprintf("%v", cpuStats.ThrottledPeriods))
 			case "Throttled Time":
 				measuredStats = append(measuredStats, fmt.Sprintf("%v", cpuStats.ThrottledTime))
+			case "Throttled Percent":
+				measuredStats = append(measuredStats, fmt.Sprintf("%.2f%%", cpuStats.ThrottledPercent))
 			case "User Mode":
 				percent := strconv.FormatFloat(cpuStats.UserMode, 'f', 2, 64)
 				measuredStats = append(measuredStats, fmt.Sprintf("%v%%", percent))
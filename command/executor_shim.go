@@ -0,0 +1,27 @@
+package command
+
+import (
+	"strings"
+
+	"github.com/hashicorp/nomad/client/driver/executor"
+)
+
+type ExecutorShimCommand struct {
+	Meta
+}
+
+func (e *ExecutorShimCommand) Help() string {
+	helpText := `
+	This is a command used by Nomad internally to set up the process of a
+	command before the executor execs it
+	`
+	return strings.TrimSpace(helpText)
+}
+
+func (e *ExecutorShimCommand) Synopsis() string {
+	return "internal - launch a command for an executor"
+}
+
+func (e *ExecutorShimCommand) Run(args []string) int {
+	return executor.RunLaunchShim(args)
+}
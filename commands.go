@@ -163,6 +163,11 @@ func Commands(metaPtr *command.Meta) map[string]cli.CommandFactory {
 				Meta: meta,
 			}, nil
 		},
+		"executor-shim": func() (cli.Command, error) {
+			return &command.ExecutorShimCommand{
+				Meta: meta,
+			}, nil
+		},
 		"fs": func() (cli.Command, error) {
 			return &command.FSCommand{
 				Meta: meta,
@@ -2,7 +2,9 @@ package stats
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math"
+	"strings"
 	"sync"
 
 	multierror "github.com/hashicorp/go-multierror"
@@ -68,3 +70,13 @@ func CPUModelName() string {
 func TotalTicksAvailable() float64 {
 	return cpuTotalTicks
 }
+
+// CPUOnline returns the cores that are online in the cgroup cpuset format, such
+// as "0-3,6". It's empty on platforms that don't report them.
+func CPUOnline() string {
+	online, err := ioutil.ReadFile("/sys/devices/system/cpu/online")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(online))
+}
@@ -632,6 +632,7 @@ func parseTasks(jobName string, taskGroupName string, result *[]*api.Task, list
 		// Check for invalid keys
 		valid := []string{
 			"artifact",
+			"chroot_max_total_mb",
 			"config",
 			"constraint",
 			"dispatch_payload",
@@ -644,6 +645,8 @@ func parseTasks(jobName string, taskGroupName string, result *[]*api.Task, list
 			"resources",
 			"service",
 			"shutdown_delay",
+			"shutdown_order",
+			"start_order",
 			"template",
 			"user",
 			"vault",
@@ -765,6 +768,11 @@ func parseTasks(jobName string, taskGroupName string, result *[]*api.Task, list
 			valid := []string{
 				"max_files",
 				"max_file_size",
+				"file_name_pattern",
+				"file_mode",
+				"file_owner",
+				"buffer_size",
+				"combine_logs",
 			}
 			if err := helper.CheckHCLKeys(logsBlock.Val, valid); err != nil {
 				return multierror.Prefix(err, fmt.Sprintf("'%s', logs ->", n))
@@ -158,11 +158,19 @@ func TestParse(t *testing.T) {
 										},
 									},
 								},
-								KillTimeout:   helper.TimeToPtr(22 * time.Second),
-								ShutdownDelay: 11 * time.Second,
+								KillTimeout:      helper.TimeToPtr(22 * time.Second),
+								ShutdownDelay:    11 * time.Second,
+								ShutdownOrder:    1,
+								StartOrder:       2,
+								ChrootMaxTotalMB: 512,
 								LogConfig: &api.LogConfig{
-									MaxFiles:      helper.IntToPtr(14),
-									MaxFileSizeMB: helper.IntToPtr(101),
+									MaxFiles:        helper.IntToPtr(14),
+									MaxFileSizeMB:   helper.IntToPtr(101),
+									FileNamePattern: "{task}-{stream}.{index}",
+									FileMode:        "0640",
+									FileOwner:       "nomad:adm",
+									BufferSizeKB:    64,
+									CombineLogs:     true,
 								},
 								Artifacts: []*api.TaskArtifact{
 									{
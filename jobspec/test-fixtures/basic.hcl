@@ -81,8 +81,13 @@ job "binstore-storagelocker" {
       }
 
       logs {
-        max_files     = 14
-        max_file_size = 101
+        max_files         = 14
+        max_file_size     = 101
+        file_name_pattern = "{task}-{stream}.{index}"
+        file_mode         = "0640"
+        file_owner        = "nomad:adm"
+        buffer_size       = 64
+        combine_logs      = true
       }
 
       env {
@@ -143,6 +148,12 @@ job "binstore-storagelocker" {
 
       shutdown_delay = "11s"
 
+      shutdown_order = 1
+
+      start_order = 2
+
+      chroot_max_total_mb = 512
+
       artifact {
         source = "http://foo.com/artifact"
 
@@ -1173,9 +1173,15 @@ func validateJob(job *structs.Job) (invalid, warnings error) {
 				continue
 			}
 
+			// Without a node to check against, ValidateTask only checks what
+			// doesn't depend on one. Checks such as whether the command exists
+			// happen on the client before the task starts.
 			if err := d.Validate(task.Config); err != nil {
 				formatted := fmt.Errorf("group %q -> task %q -> config: %v", tg.Name, task.Name, err)
 				multierror.Append(validationErrors, formatted)
+			} else if err := d.ValidateTask(task); err != nil {
+				formatted := fmt.Errorf("group %q -> task %q: %v", tg.Name, task.Name, err)
+				multierror.Append(validationErrors, formatted)
 			}
 
 			// The task group didn't have any task that required signals
@@ -3338,8 +3338,55 @@ const (
 type LogConfig struct {
 	MaxFiles      int
 	MaxFileSizeMB int
+
+	// FileNamePattern is an optional template for naming the log files of a
+	// task. It may reference the {task}, {alloc} and {stream} placeholders
+	// and may end with a ".{index}" placeholder for the rotation index which
+	// is otherwise implied. If empty, DefaultLogFileNamePattern is used.
+	FileNamePattern string
+
+	// FileMode is an optional octal file mode, such as "0640", for the log
+	// files of a task.
+	FileMode string
+
+	// FileOwner is an optional "user" or "user:group" owning the log files
+	// of a task. It only takes effect if the client runs as root.
+	FileOwner string
+
+	// BufferSizeKB is the size of an optional in-memory buffer holding the
+	// most recent output of each of the task's streams, in addition to the
+	// log files. Zero disables the buffer.
+	BufferSizeKB int
+
+	// CombineLogs writes the task's stdout and stderr, in the order they're
+	// written, to a single set of log files named after the "output" stream
+	// rather than one set per stream.
+	CombineLogs bool
 }
 
+const (
+	// DefaultLogFileNamePattern is the log file naming pattern used if none
+	// is given. It yields names such as "redis.stdout.0".
+	DefaultLogFileNamePattern = "{task}.{stream}.{index}"
+
+	logFileTaskPlaceholder   = "{task}"
+	logFileAllocPlaceholder  = "{alloc}"
+	logFileStreamPlaceholder = "{stream}"
+	logFileIndexSuffix       = ".{index}"
+
+	// LogStreamCombined is the name of the stream whose log files hold the
+	// stdout and stderr of tasks combining their logs.
+	LogStreamCombined = "output"
+
+	// MaxLogBufferSizeKB bounds the memory used to buffer the recent output
+	// of each of a task's streams.
+	MaxLogBufferSizeKB = 10 * 1024
+)
+
+// validLogFileNameLiteral matches the characters allowed in the literal parts
+// of a log file naming pattern.
+var validLogFileNameLiteral = regexp.MustCompile(`^[a-zA-Z0-9._-]*$`)
+
 // DefaultLogConfig returns the default LogConfig values.
 func DefaultLogConfig() *LogConfig {
 	return &LogConfig{
@@ -3358,9 +3405,77 @@ func (l *LogConfig) Validate() error {
 	if l.MaxFileSizeMB < 1 {
 		mErr.Errors = append(mErr.Errors, fmt.Errorf("minimum file size is 1MB; got %d", l.MaxFileSizeMB))
 	}
+	if err := l.validateFileNamePattern(); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
+	}
+	if _, err := l.ParseFileMode(); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
+	}
+	if l.BufferSizeKB < 0 || l.BufferSizeKB > MaxLogBufferSizeKB {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("log buffer size must be between 0 and %dKB; got %d", MaxLogBufferSizeKB, l.BufferSizeKB))
+	}
 	return mErr.ErrorOrNil()
 }
 
+// ParseFileMode returns the file mode of the log files or zero if none is
+// set. An error is returned if the mode isn't a valid octal permission.
+func (l *LogConfig) ParseFileMode() (os.FileMode, error) {
+	if l == nil || l.FileMode == "" {
+		return 0, nil
+	}
+
+	mode, err := strconv.ParseUint(l.FileMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("log file mode %q must be an octal permission between 0000 and 0777", l.FileMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// validateFileNamePattern ensures the file naming pattern yields file system
+// safe names that are unique per task and stream.
+func (l *LogConfig) validateFileNamePattern() error {
+	if l.FileNamePattern == "" {
+		return nil
+	}
+
+	base := strings.TrimSuffix(l.FileNamePattern, logFileIndexSuffix)
+	if !strings.Contains(base, logFileTaskPlaceholder) {
+		return fmt.Errorf("log file name pattern %q must contain %s", l.FileNamePattern, logFileTaskPlaceholder)
+	}
+	if !strings.Contains(base, logFileStreamPlaceholder) {
+		return fmt.Errorf("log file name pattern %q must contain %s", l.FileNamePattern, logFileStreamPlaceholder)
+	}
+
+	literal := strings.NewReplacer(
+		logFileTaskPlaceholder, "",
+		logFileAllocPlaceholder, "",
+		logFileStreamPlaceholder, "").Replace(base)
+	if !validLogFileNameLiteral.MatchString(literal) {
+		return fmt.Errorf("log file name pattern %q may only contain letters, digits, '.', '_', '-' and "+
+			"the {task}, {alloc}, {stream} and trailing .{index} placeholders", l.FileNamePattern)
+	}
+	if strings.HasPrefix(base, ".") {
+		return fmt.Errorf("log file name pattern %q must not start with '.'", l.FileNamePattern)
+	}
+	return nil
+}
+
+// FileBaseName returns the name of the log files for the given task,
+// allocation and stream without the rotation index. Log files are named
+// "<base>.<index>".
+func (l *LogConfig) FileBaseName(task, allocID, stream string) string {
+	pattern := DefaultLogFileNamePattern
+	if l != nil && l.FileNamePattern != "" {
+		pattern = l.FileNamePattern
+	}
+
+	base := strings.TrimSuffix(pattern, logFileIndexSuffix)
+	return strings.NewReplacer(
+		logFileTaskPlaceholder, task,
+		logFileAllocPlaceholder, allocID,
+		logFileStreamPlaceholder, stream).Replace(base)
+}
+
 // Task is a single process typically that is executed as part of a task group.
 type Task struct {
 	// Name of the task
@@ -3422,6 +3537,22 @@ type Task struct {
 	// task from Consul and sending it a signal to shutdown. See #2441
 	ShutdownDelay time.Duration
 
+	// ShutdownOrder orders the shutdown of the tasks in a group when the
+	// allocation is stopped. Tasks are killed in ascending order, each order
+	// only after the tasks of the lower orders have exited or their kill
+	// timeouts have elapsed. Tasks of the same order are killed concurrently.
+	ShutdownOrder int
+
+	// StartOrder orders the start of the tasks in a group. A task is only
+	// started once the tasks of lower orders are running or have completed
+	// successfully. Tasks of the same order are started concurrently.
+	StartOrder int
+
+	// ChrootMaxTotalMB limits the total size of the files embedded in the
+	// task's chroot. It is capped by the client's limit and zero uses the
+	// client's limit.
+	ChrootMaxTotalMB int
+
 	// The kill signal to use for the task. This is an optional specification,
 
 	// KillSignal is the kill signal to use for the task. This is an optional
@@ -3540,6 +3671,9 @@ func (t *Task) Validate(ephemeralDisk *EphemeralDisk) error {
 	if t.ShutdownDelay < 0 {
 		mErr.Errors = append(mErr.Errors, errors.New("ShutdownDelay must be a positive value"))
 	}
+	if t.ChrootMaxTotalMB < 0 {
+		mErr.Errors = append(mErr.Errors, errors.New("ChrootMaxTotalMB must be a positive value"))
+	}
 
 	// Validate the resources.
 	if t.Resources == nil {
@@ -4046,6 +4180,22 @@ const (
 
 	// TaskLeaderDead indicates that the leader task within the has finished.
 	TaskLeaderDead = "Leader Task Dead"
+
+	// TaskChrootBuildFailed indicates that building the task's chroot failed.
+	// The event carries the category of the failure and a remediation hint.
+	TaskChrootBuildFailed = "Chroot Build Failed"
+
+	// TaskDiskQuotaExceeded indicates that the task's disk usage exceeded
+	// its allocation's ephemeral disk.
+	TaskDiskQuotaExceeded = "Disk Quota Exceeded"
+
+	// TaskCPUThrottled indicates that the task has been CPU throttled above
+	// the client's threshold for a sustained period.
+	TaskCPUThrottled = "CPU Throttled"
+
+	// TaskUnmountFailed indicates that a mount of the task's directory
+	// failed to be torn down after the allocation stopped.
+	TaskUnmountFailed = "Unmount Failed"
 )
 
 // TaskEvent is an event that effects the state of a task and contains meta-data
@@ -4209,6 +4359,14 @@ func (event *TaskEvent) PopulateEventDisplayMessage() {
 			parts = append(parts, fmt.Sprintf("Signal: %d", event.Signal))
 		}
 
+		if event.Details["oom_killed"] == "true" {
+			parts = append(parts, "OOM Killed")
+		}
+
+		if event.Details["memory_soft_limit_killed"] == "true" {
+			parts = append(parts, "Memory Soft Limit Exceeded")
+		}
+
 		if event.Message != "" {
 			parts = append(parts, fmt.Sprintf("Exit Message: %q", event.Message))
 		}
@@ -4255,6 +4413,12 @@ func (event *TaskEvent) PopulateEventDisplayMessage() {
 		desc = event.DriverMessage
 	case TaskLeaderDead:
 		desc = "Leader Task in Group dead"
+	case TaskChrootBuildFailed:
+		if event.SetupError != "" {
+			desc = event.SetupError
+		} else {
+			desc = "Building the chroot failed"
+		}
 	default:
 		desc = event.Message
 	}
@@ -4326,6 +4490,23 @@ func (e *TaskEvent) SetSignal(s int) *TaskEvent {
 	return e
 }
 
+// SetOOMKilled marks the task as killed by the OOM killer.
+func (e *TaskEvent) SetOOMKilled(oom bool) *TaskEvent {
+	if oom {
+		e.Details["oom_killed"] = "true"
+	}
+	return e
+}
+
+// SetMemorySoftLimitKilled marks the task as killed by the driver for
+// exceeding its memory soft limit.
+func (e *TaskEvent) SetMemorySoftLimitKilled(killed bool) *TaskEvent {
+	if killed {
+		e.Details["memory_soft_limit_killed"] = "true"
+	}
+	return e
+}
+
 func (e *TaskEvent) SetExitMessage(err error) *TaskEvent {
 	if err != nil {
 		e.Message = err.Error()
@@ -4420,6 +4601,12 @@ func (e *TaskEvent) SetDriverMessage(m string) *TaskEvent {
 	return e
 }
 
+// SetChrootBuildCategory sets the category of a chroot build failure
+func (e *TaskEvent) SetChrootBuildCategory(c string) *TaskEvent {
+	e.Details["chroot_build_failed"] = c
+	return e
+}
+
 // TaskArtifact is an artifact to download before running the task.
 type TaskArtifact struct {
 	// GetterSource is the source to download an artifact using go-getter
@@ -1607,6 +1607,62 @@ func TestTask_Validate_LogConfig(t *testing.T) {
 	}
 }
 
+func TestLogConfig_FileNamePattern(t *testing.T) {
+	l := DefaultLogConfig()
+	assert.Nil(t, l.Validate())
+	assert.Equal(t, "web.stdout", l.FileBaseName("web", "abc", "stdout"))
+
+	l.FileNamePattern = "{alloc}-{task}_{stream}.log.{index}"
+	assert.Nil(t, l.Validate())
+	assert.Equal(t, "abc-web_stderr.log", l.FileBaseName("web", "abc", "stderr"))
+
+	l.FileNamePattern = "{task}-{stream}"
+	assert.Nil(t, l.Validate())
+	assert.Equal(t, "web-stdout", l.FileBaseName("web", "abc", "stdout"))
+
+	bad := []string{
+		"{task}.log",
+		"{stream}.log",
+		"{task}/{stream}",
+		".{task}.{stream}",
+		"{task}.{stream}.{index}.log",
+		"{task}.{stream}.{unknown}",
+	}
+	for _, p := range bad {
+		l.FileNamePattern = p
+		assert.NotNil(t, l.Validate(), "pattern %q", p)
+	}
+}
+
+func TestLogConfig_FileMode(t *testing.T) {
+	l := DefaultLogConfig()
+	mode, err := l.ParseFileMode()
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0), mode)
+
+	l.FileMode = "0640"
+	assert.Nil(t, l.Validate())
+	mode, err = l.ParseFileMode()
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0640), mode)
+
+	for _, m := range []string{"rw-r-----", "0800", "01777", "-1"} {
+		l.FileMode = m
+		assert.NotNil(t, l.Validate(), "mode %q", m)
+	}
+}
+
+func TestLogConfig_BufferSize(t *testing.T) {
+	l := DefaultLogConfig()
+	l.BufferSizeKB = 64
+	assert.Nil(t, l.Validate())
+
+	for _, size := range []int{-1, MaxLogBufferSizeKB + 1} {
+		l.BufferSizeKB = size
+		assert.NotNil(t, l.Validate(), "size %d", size)
+	}
+}
+
 func TestTask_Validate_Template(t *testing.T) {
 
 	bad := &Template{}
@@ -3081,6 +3137,8 @@ func TestTaskEventPopulate(t *testing.T) {
 		{NewTaskEvent(TaskKilling).SetKillTimeout(1 * time.Second), "Sent interrupt. Waiting 1s before force killing"},
 		{NewTaskEvent(TaskTerminated).SetExitCode(-1).SetSignal(3), "Exit Code: -1, Signal: 3"},
 		{NewTaskEvent(TaskTerminated).SetMessage("Goodbye"), "Exit Code: 0, Exit Message: \"Goodbye\""},
+		{NewTaskEvent(TaskTerminated).SetExitCode(137).SetSignal(9).SetOOMKilled(true), "Exit Code: 137, Signal: 9, OOM Killed"},
+		{NewTaskEvent(TaskTerminated).SetExitCode(137).SetSignal(9).SetMemorySoftLimitKilled(true), "Exit Code: 137, Signal: 9, Memory Soft Limit Exceeded"},
 		{NewTaskEvent(TaskKilled), "Task successfully killed"},
 		{NewTaskEvent(TaskKilled).SetKillError(fmt.Errorf("undead creatures can't be killed")), "undead creatures can't be killed"},
 		{NewTaskEvent(TaskNotRestarting).SetRestartReason("Chaos Monkey did it"), "Chaos Monkey did it"},